@@ -0,0 +1,64 @@
+package lazydb
+
+import "github.com/billsjc123/LazyDB/logfile"
+
+// Operation is the kind of access to a key checked by DBConfig.AccessControl.
+type Operation uint8
+
+const (
+	// OpRead reads a key without changing it.
+	OpRead Operation = iota + 1
+	// OpWrite changes a key, including deleting it, popping from it and changing its time to live.
+	OpWrite
+)
+
+func (op Operation) String() string {
+	switch op {
+	case OpRead:
+		return "read"
+	case OpWrite:
+		return "write"
+	default:
+		return "unknown"
+	}
+}
+
+// checkAccess calls DBConfig.AccessControl with every key, and returns the first error returned by it.
+// It is the single point where public operations are checked, and must be called before any index lock is taken.
+func (db *LazyDB) checkAccess(op Operation, keys ...[]byte) error {
+	if db.cfg.AccessControl == nil {
+		return nil
+	}
+	for _, key := range keys {
+		if err := db.cfg.AccessControl(op, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkPairsAccess is like checkAccess, but keys are at even indexes of args, which are key value pairs.
+func (db *LazyDB) checkPairsAccess(op Operation, args [][]byte) error {
+	if db.cfg.AccessControl == nil {
+		return nil
+	}
+	for i := 0; i < len(args); i += 2 {
+		if err := db.cfg.AccessControl(op, args[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkEntriesAccess is like checkAccess, but keys are keys of entries.
+func (db *LazyDB) checkEntriesAccess(op Operation, entries []*logfile.LogEntry) error {
+	if db.cfg.AccessControl == nil {
+		return nil
+	}
+	for _, entry := range entries {
+		if err := db.cfg.AccessControl(op, entry.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package lazydb
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/billsjc123/LazyDB/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_AccessControl(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_access_control")
+	cfg := DefaultDBConfig(path)
+	errDenied := errors.New("denied")
+	cfg.AccessControl = func(op Operation, key []byte) error {
+		if op == OpWrite && bytes.HasPrefix(key, []byte("ro:")) {
+			return errDenied
+		}
+		return nil
+	}
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	denied, allowed := []byte("ro:key"), []byte("rw:key")
+	assert.Equal(t, errDenied, db.Set(denied, []byte("v")))
+	assert.Equal(t, errDenied, db.HSet(denied, []byte("f"), []byte("v")))
+	assert.Equal(t, errDenied, db.RPush(denied, []byte("v")))
+	assert.Equal(t, errDenied, db.SAdd(denied, []byte("m")))
+	assert.Equal(t, errDenied, db.ZAdd(denied, util.Float64ToByte(1), []byte("m")))
+	assert.Equal(t, errDenied, db.MSet(allowed, []byte("v"), denied, []byte("v")))
+	assert.Equal(t, errDenied, db.Delete(denied))
+
+	// nothing is written by a batch with a denied key
+	wb := db.NewWriteBatch()
+	wb.Set(allowed, []byte("batch"))
+	wb.Set(denied, []byte("batch"))
+	assert.Equal(t, errDenied, wb.Commit())
+
+	tx, err := db.Begin(RWTX)
+	assert.Nil(t, err)
+	tx.Set(denied, []byte("tx"))
+	assert.Equal(t, errDenied, tx.Commit())
+	assert.Nil(t, tx.Rollback())
+
+	_, err = db.Get(denied)
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get(allowed)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// reads of denied keys and writes elsewhere still work
+	assert.Nil(t, db.Set(allowed, []byte("v")))
+	val, err := db.Get(allowed)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), val)
+	assert.Nil(t, db.HSet(allowed, []byte("f"), []byte("v")))
+	val, err = db.HGet(allowed, []byte("f"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), val)
+	_, err = db.HGet(denied, []byte("f"))
+	assert.NotEqual(t, errDenied, err)
+	assert.Equal(t, 0, lLen(t, db, denied))
+	assert.False(t, sIsMember(t, db, denied, []byte("m")))
+}
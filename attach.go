@@ -0,0 +1,184 @@
+package lazydb
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/billsjc123/LazyDB/logfile"
+)
+
+// attachDirName the directory in db directory where log files are staged by AttachLogFile before they are attached.
+const attachDirName = "ATTACH"
+
+// ErrAttachUnsupported is returned by AttachLogFile if the log file holds entries which can not be indexed
+// without the rest of the db which wrote them, i.e. interned values and entries of transactions.
+var ErrAttachUnsupported = errors.New("log file holds entries which can not be attached")
+
+// AttachLogFile imports the log file at path written by another db, e.g. by a pipeline ingesting shards offline,
+// as an archived log file of typ. The file is copied into the db directory with a fresh fid, and its entries are
+// indexed as if they had been written right now: they are newer than every existing entry by position, so they
+// overwrite existing keys, unless DBConfig.VersionedEntries is on and the existing ones have newer versions.
+// Entries overwritten by it, and entries of it overwritten by later ones of the same file, are counted as stale
+// for merging. Reopening the db recovers the same index, since the file is replayed in the same place.
+//
+// The file must be written with the same DBConfig.BlockAlign, and no larger than DBConfig.MaxLogFileSize,
+// ErrInvalidParam is returned otherwise. Only types whose indexes are recovered from log files can be attached,
+// i.e. String, Hash and custom types. The file is validated before it is attached, a corrupted file fails with
+// the error of reading it, and a file holding entries listed by ErrAttachUnsupported fails with it.
+//
+// It is crash-safe: the file is staged and synced in a directory of its own first, and moved into place by a rename
+// once the active log file is archived, so that a crash leaves either the db without the file, or with all of it.
+func (db *LazyDB) AttachLogFile(typ valueType, path string) error {
+	if db.IsClosed() {
+		return ErrDatabaseClosed
+	}
+	if db.readOnly() {
+		return ErrReadOnly
+	}
+	if typ != valueTypeString && typ != valueTypeHash && db.getCustomType(typ) == nil {
+		return ErrInvalidParam
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() > db.cfg.MaxLogFileSize {
+		return ErrInvalidParam
+	}
+
+	// files left by an attach interrupted by a crash are dropped
+	stageDir := filepath.Join(db.cfg.DBPath, attachDirName)
+	if err = os.RemoveAll(stageDir); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(stageDir, os.ModePerm); err != nil {
+		return err
+	}
+	defer os.RemoveAll(stageDir)
+	stagedPath, err := db.stageLogFile(typ, path, stageDir)
+	if err != nil {
+		return err
+	}
+
+	mu := db.getIndexLock(typ)
+	mu.Lock()
+	defer mu.Unlock()
+	activeLogFile := db.getActiveLogFile(typ)
+	activeLogFile.mu.Lock()
+	defer activeLogFile.mu.Unlock()
+
+	// the attached file goes right after the active log file, which is archived, and before the new active one
+	fid := db.availableFid(typ, db.nextFid(activeLogFile.lf.Fid))
+	if err = db.rotateActiveLogFileTo(typ, activeLogFile, db.availableFid(typ, db.nextFid(fid)), time.Time{}); err != nil {
+		return err
+	}
+	name, _ := logfile.FileName(logfile.FType(typ), fid)
+	if err = os.Rename(stagedPath, filepath.Join(db.cfg.DBPath, name)); err != nil {
+		return err
+	}
+	if !db.cfg.NoSyncDir {
+		if err = syncDir(db.cfg.DBPath); err != nil {
+			return err
+		}
+	}
+	lf, err := db.openLogFile(typ, fid)
+	if err != nil {
+		return err
+	}
+	db.archivedLogFile[typ].Set(fid, &MutexLogFile{lf: lf})
+	db.cacheLogFile(typ, lf)
+	fids := db.fidsMap[typ]
+	fids.mu.Lock()
+	fids.fids = append(fids.fids, fid)
+	sort.Slice(fids.fids, func(i, j int) bool {
+		return fids.fids[i] < fids.fids[j]
+	})
+	fids.mu.Unlock()
+	db.discardsMap[typ].setTotal(fid, uint32(db.cfg.MaxLogFileSize))
+
+	// versions of keys deleted by the file, which are not in the index any more
+	deleted := make(map[string]uint64)
+	var discardErr error
+	offset, err := db.replayLogFile(typ, lf, 0, func(entry *logfile.LogEntry, vPos *ValuePos) {
+		if db.cfg.VersionedEntries && !db.replayedNewerVersion(typ, entry, deleted) {
+			return
+		}
+		var oldVal any
+		idxTree, idxKey := db.locateIndex(typ, entry)
+		if idxTree != nil {
+			oldVal = idxTree.Get(idxKey)
+		}
+		db.buildIndexByVType(typ, entry, vPos)
+		if oldVal == nil {
+			return
+		}
+		if idxTree, idxKey = db.locateIndex(typ, entry); idxTree == nil || idxTree.Get(idxKey) != oldVal {
+			if err := db.sendDiscard(oldVal, true, typ); err != nil && discardErr == nil {
+				discardErr = err
+			}
+		}
+	})
+	atomic.StoreInt64(&lf.Offset, offset)
+	if err != nil {
+		return err
+	}
+	return discardErr
+}
+
+// stageLogFile copies the log file at path into stageDir and syncs it, then reads all entries of the copy to check
+// that it can be attached by AttachLogFile. It returns the path of the copy.
+func (db *LazyDB) stageLogFile(typ valueType, path, stageDir string) (string, error) {
+	name, ok := logfile.FileName(logfile.FType(typ), 0)
+	if !ok {
+		return "", ErrInvalidParam
+	}
+	stagedPath := filepath.Join(stageDir, name)
+	if err := copyFile(path, stagedPath); err != nil {
+		return "", err
+	}
+
+	lf, err := logfile.Open(stageDir, 0, db.cfg.MaxLogFileSize, logfile.FType(typ), db.cfg.IOType)
+	if err != nil {
+		return "", err
+	}
+	defer lf.Close()
+	lf.BlockAlign = db.cfg.BlockAlign
+	var offset int64
+	for {
+		entry, entSize, err := lf.ReadLogEntry(offset)
+		if err != nil {
+			if err == io.EOF || err == logfile.ErrLogEndOfFile {
+				break
+			}
+			return "", err
+		}
+		if entry.Stat == logfile.SValueBlob || entry.Stat == logfile.SValueRef || entry.TxStat == logfile.TxUncommited {
+			return "", ErrAttachUnsupported
+		}
+		offset += int64(entSize)
+	}
+	return stagedPath, nil
+}
+
+// copyFile copies the file at src to dst, and syncs dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err = io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
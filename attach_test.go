@@ -0,0 +1,66 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_AttachLogFile(t *testing.T) {
+	wd, _ := os.Getwd()
+	srcPath := filepath.Join(wd, "test_attach_src")
+	src, err := Open(DefaultDBConfig(srcPath))
+	assert.Nil(t, err)
+	defer os.RemoveAll(srcPath)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, src.Set(GetKey(i), []byte("imported")))
+	}
+	assert.Nil(t, src.Delete(GetKey(99)))
+	assert.Nil(t, src.HSet([]byte("h"), []byte("f1"), []byte("imported")))
+	assert.Nil(t, src.Close())
+
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_attach_dst"))
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+	assert.Nil(t, db.Set(GetKey(0), []byte("local")))
+	assert.Nil(t, db.Set(GetKey(99), []byte("local")))
+	assert.Nil(t, db.Set(GetKey(1000), []byte("local")))
+	assert.Nil(t, db.HSet([]byte("h"), []byte("f2"), []byte("local")))
+
+	assert.Nil(t, db.AttachLogFile(valueTypeString, logFileName(srcPath, logfile.Strs, 1)))
+	assert.Nil(t, db.AttachLogFile(valueTypeHash, logFileName(srcPath, logfile.Hash, 1)))
+	assert.Equal(t, ErrInvalidParam, db.AttachLogFile(valueTypeList, logFileName(srcPath, logfile.List, 1)))
+	_, err = os.Stat(filepath.Join(cfg.DBPath, attachDirName))
+	assert.True(t, os.IsNotExist(err))
+
+	local := []byte("local")
+	check := func() {
+		for i := 0; i < 99; i++ {
+			val, err := db.Get(GetKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("imported"), val)
+		}
+		// deleted by the attached file
+		_, err := db.Get(GetKey(99))
+		assert.Equal(t, ErrKeyNotFound, err)
+		val, err := db.Get(GetKey(1000))
+		assert.Nil(t, err)
+		assert.Equal(t, local, val)
+		fields, err := db.HGetAll([]byte("h"))
+		assert.Nil(t, err)
+		assert.Equal(t, 4, len(fields))
+	}
+	check()
+
+	// writes after attaching win over the attached file
+	local = []byte("written after attaching")
+	assert.Nil(t, db.Set(GetKey(1000), local))
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	check()
+}
@@ -0,0 +1,55 @@
+package lazydb
+
+import (
+	"log"
+	"time"
+)
+
+// MergeWindow a daily window of time in which DBConfig.AutoMerge may run, e.g. the off-peak hours at night.
+// Start and End are offsets from midnight in the location of the clock of the db, the window wraps around
+// midnight if End is before Start, e.g. Start 22h and End 6h. It never contains any time if Start equals End.
+type MergeWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// contains returns whether t is within the window, Start inclusive and End exclusive.
+func (w *MergeWindow) contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// runAutoMerge merges log files every interval until closeCh is closed, see DBConfig.AutoMerge.
+func (db *LazyDB) runAutoMerge(interval time.Duration, closeCh <-chan struct{}) {
+	defer db.bgWg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closeCh:
+			return
+		case <-ticker.C:
+			if _, err := db.autoMerge(); err != nil {
+				log.Printf("auto merge err: %v", err)
+			}
+		}
+	}
+}
+
+// autoMerge merges archived log files of all types whose ratio of stale data exceeds DBConfig.LogFileGCRatio,
+// if now is within DBConfig.MergeSchedule. It returns whether merging has run, it is deferred to the next tick
+// otherwise, and stale data keeps piling up meanwhile.
+func (db *LazyDB) autoMerge() (bool, error) {
+	if db.readOnly() || db.IsClosed() {
+		return false, nil
+	}
+	if db.cfg.MergeSchedule != nil && !db.cfg.MergeSchedule.contains(db.now()) {
+		return false, nil
+	}
+	_, err := db.Maintenance(MaintenanceOptions{Merge: true})
+	return true, err
+}
@@ -0,0 +1,75 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_MergeSchedule(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_merge_schedule"))
+	cfg.MaxLogFileSize = 500
+	cfg.AutoMerge = true
+	cfg.MergeSchedule = &MergeWindow{Start: 22 * time.Hour, End: 6 * time.Hour}
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	typ := valueTypeString
+	for i := 0; i < 40; i++ {
+		assert.Nil(t, db.Set(GetKey(i%4), GetKey(i)))
+	}
+	assert.Eventually(t, func() bool {
+		ccl, err := db.discardsMap[typ].getCCL(db.getActiveLogFile(typ).lf.Fid, cfg.LogFileGCRatio)
+		return err == nil && len(ccl) > 0
+	}, time.Second, 10*time.Millisecond)
+	ccl, err := db.discardsMap[typ].getCCL(db.getActiveLogFile(typ).lf.Fid, cfg.LogFileGCRatio)
+	assert.Nil(t, err)
+
+	// skipped during business hours
+	now := time.Date(2024, 1, 1, 14, 0, 0, 0, time.Local)
+	db.clock = func() time.Time { return now }
+	merged, err := db.autoMerge()
+	assert.Nil(t, err)
+	assert.False(t, merged)
+	for _, fid := range ccl {
+		assert.NotNil(t, db.getArchivedLogFile(typ, fid))
+	}
+
+	// runs within the window across midnight
+	now = time.Date(2024, 1, 2, 1, 30, 0, 0, time.Local)
+	merged, err = db.autoMerge()
+	assert.Nil(t, err)
+	assert.True(t, merged)
+	for _, fid := range ccl {
+		assert.Nil(t, db.getArchivedLogFile(typ, fid))
+	}
+	for i := 0; i < 4; i++ {
+		val, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, GetKey(36+i), val)
+	}
+}
+
+func TestMergeWindow_contains(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2024, 1, 1, hour, min, 0, 0, time.UTC)
+	}
+	day := &MergeWindow{Start: 2 * time.Hour, End: 4 * time.Hour}
+	assert.False(t, day.contains(at(1, 59)))
+	assert.True(t, day.contains(at(2, 0)))
+	assert.True(t, day.contains(at(3, 59)))
+	assert.False(t, day.contains(at(4, 0)))
+
+	night := &MergeWindow{Start: 22 * time.Hour, End: 6 * time.Hour}
+	assert.True(t, night.contains(at(23, 0)))
+	assert.True(t, night.contains(at(0, 0)))
+	assert.False(t, night.contains(at(6, 0)))
+	assert.False(t, night.contains(at(12, 0)))
+
+	assert.False(t, (&MergeWindow{Start: time.Hour, End: time.Hour}).contains(at(1, 0)))
+}
@@ -0,0 +1,46 @@
+package lazydb
+
+import (
+	"log"
+	"time"
+)
+
+// runAutoSync syncs active log files every interval until closeCh is closed, see DBConfig.AutoSyncInterval.
+func (db *LazyDB) runAutoSync(interval time.Duration, closeCh <-chan struct{}) {
+	defer db.bgWg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closeCh:
+			return
+		case <-ticker.C:
+			if err := db.syncOpenedActiveLogFiles(); err != nil {
+				log.Printf("auto sync err: %v", err)
+			}
+		}
+	}
+}
+
+// syncOpenedActiveLogFiles syncs active log files of all types, unlike syncActiveLogFiles,
+// no log file is created for types never written.
+func (db *LazyDB) syncOpenedActiveLogFiles() error {
+	// custom types may be registered meanwhile
+	db.mu.RLock()
+	types := db.valueTypes()
+	db.mu.RUnlock()
+
+	for _, typ := range types {
+		activeLogFile := db.activeLogFileMap[typ]
+		if activeLogFile == nil {
+			continue
+		}
+		activeLogFile.mu.Lock()
+		err := activeLogFile.lf.Sync()
+		activeLogFile.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
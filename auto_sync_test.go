@@ -0,0 +1,60 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_AutoSyncInterval(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_auto_sync_interval"))
+	cfg.AutoSyncInterval = 20 * time.Millisecond
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	activeLogFile := db.getActiveLogFile(valueTypeString)
+	controller := &crashIOController{IOController: activeLogFile.lf.IoController}
+	activeLogFile.lf.IoController = controller
+	syncs := func() (int, bool) {
+		activeLogFile.mu.Lock()
+		defer activeLogFile.mu.Unlock()
+		return controller.syncs, controller.synced == controller.written
+	}
+
+	// synced periodically without syncing writes
+	value := GetValue32()
+	assert.Nil(t, db.Set(GetKey(1), value))
+	assert.Eventually(t, func() bool {
+		_, synced := syncs()
+		return synced
+	}, time.Second, 5*time.Millisecond)
+
+	// at the cadence of the interval
+	start := time.Now()
+	before, _ := syncs()
+	time.Sleep(10 * cfg.AutoSyncInterval)
+	after, _ := syncs()
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, after-before, 5)
+	assert.LessOrEqual(t, after-before, int(elapsed/cfg.AutoSyncInterval)+1)
+
+	// stopped on close
+	assert.Nil(t, controller.crash())
+	assert.Nil(t, db.Close())
+	closed, _ := syncs()
+	time.Sleep(3 * cfg.AutoSyncInterval)
+	now, _ := syncs()
+	assert.Equal(t, closed, now)
+
+	// the write survives the crash
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	got, err := db.Get(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, got)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/billsjc123/LazyDB"
 	"math/rand"
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
@@ -60,6 +61,65 @@ func BenchmarkSetValue(b *testing.B) {
 	}
 }
 
+func BenchmarkSetDuplicateValue(b *testing.B) {
+	path := filepath.Join("bench_duplicate_records")
+	opts := lazydb.DefaultDBConfig(path)
+	opts.SkipDuplicateWrites = true
+	dupDB, err := lazydb.Open(opts)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		_ = dupDB.Close()
+		_ = os.RemoveAll(path)
+	}()
+
+	value := GetValue()
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		err := dupDB.Set(GetKey(i%1000), value)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkGetValueBlockAlign(b *testing.B) {
+	for _, align := range []int64{0, 512} {
+		b.Run(fmt.Sprintf("align-%d", align), func(b *testing.B) {
+			path := filepath.Join(fmt.Sprintf("bench_align_records_%d", align))
+			opts := lazydb.DefaultDBConfig(path)
+			opts.IOType = 1
+			opts.BlockAlign = align
+			alignDB, err := lazydb.Open(opts)
+			if err != nil {
+				panic(err)
+			}
+			defer func() {
+				_ = alignDB.Close()
+				_ = os.RemoveAll(path)
+			}()
+
+			const keyNum = 100000
+			for i := 0; i < keyNum; i++ {
+				if err := alignDB.Set(GetKey(i), GetValue()); err != nil {
+					panic(err)
+				}
+			}
+			b.ResetTimer()
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := alignDB.Get(GetKey(rand.Intn(keyNum))); err != nil {
+					panic(err)
+				}
+			}
+		})
+	}
+}
+
 func init() {
 	rand.Seed(time.Now().Unix())
 	opts := lazydb.DefaultDBConfig(filepath.Join("bench_records"))
@@ -0,0 +1,140 @@
+package lazydb
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/billsjc123/LazyDB/logfile"
+)
+
+// paddedHeaderSize the length of a padded value, see logfile.SPadded.
+const paddedHeaderSize = 4
+
+// encodePadded returns the value of a padded entry holding value, with room for it to grow to capacity.
+func encodePadded(value []byte, capacity int) []byte {
+	buf := make([]byte, paddedHeaderSize+capacity)
+	binary.LittleEndian.PutUint32(buf, uint32(len(value)))
+	copy(buf[paddedHeaderSize:], value)
+	return buf
+}
+
+// decodePadded returns the value held by a padded entry and its capacity.
+func decodePadded(buf []byte) ([]byte, int) {
+	if len(buf) < paddedHeaderSize {
+		return nil, 0
+	}
+	capacity := len(buf) - paddedHeaderSize
+	size := int(binary.LittleEndian.Uint32(buf))
+	if size > capacity {
+		size = capacity
+	}
+	return buf[paddedHeaderSize : paddedHeaderSize+size], capacity
+}
+
+// SetWithCapacity is like Set, but reserves room for the value to grow to cap bytes, so that Append and SetRange
+// within cap overwrite the entry in place rather than appending a new one, even if DBConfig.InPlaceUpdates is off.
+// The room is kept while the value grows within it, and dropped once it grows beyond or the key is set by Set.
+// Reads return the value without the room. cap smaller than the value is raised to the size of the value.
+// Values are only overwritten in place under the same conditions as DBConfig.InPlaceUpdates.
+func (db *LazyDB) SetWithCapacity(key, value []byte, cap int) error {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return err
+	}
+	if cap < len(value) {
+		cap = len(value)
+	}
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	if err := db.evict(); err != nil {
+		return err
+	}
+	return db.setPadded(key, value, cap)
+}
+
+// SetRange overwrites part of the value stored at key starting at offset with value like SETRANGE of Redis,
+// and returns the length of the value after it is modified. The value is padded with zero bytes if offset is
+// beyond its end, and a key which does not exist is taken as an empty value. Nothing is written if value is empty.
+func (db *LazyDB) SetRange(key []byte, offset int, value []byte) (int, error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return 0, ErrInvalidParam
+	}
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	old, capacity, err := db.getStrWithCapacity(key)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return 0, err
+	}
+	if len(value) == 0 {
+		return len(old), nil
+	}
+	if err = db.evict(); err != nil {
+		return 0, err
+	}
+	size := len(old)
+	if offset+len(value) > size {
+		size = offset + len(value)
+	}
+	newValue := make([]byte, size)
+	copy(newValue, old)
+	copy(newValue[offset:], value)
+	if err = db.setGrown(key, newValue, capacity); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// getStrWithCapacity returns the value of key along with the capacity reserved by SetWithCapacity,
+// which is 0 if there is none. Lock of strIndex must be held by the caller.
+func (db *LazyDB) getStrWithCapacity(key []byte) ([]byte, int, error) {
+	ref, err := db.lookupValue(db.strIndex.idxTree, key, valueTypeString)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer db.releaseLogFile(ref.typ, ref.lf.Fid)
+	ent, _, err := db.readHeldLogEntry(ref.typ, ref.lf, ref.offset, nil, time.Time{})
+	if err != nil {
+		return nil, 0, err
+	}
+	if ent.Stat != logfile.SPadded {
+		value, err := db.readHeldValue(ref, key, nil, time.Time{})
+		return value, 0, err
+	}
+	if ent.ExpiredAt != 0 && expiredAtMilli(ent.ExpiredAt) < db.now().UnixMilli() {
+		return nil, 0, ErrKeyNotFound
+	}
+	value, capacity := decodePadded(ent.Value)
+	return value, capacity, nil
+}
+
+// setGrown sets key to value grown from a value with capacity, which keeps the capacity if value fits in it.
+// Lock of strIndex must be held by the caller.
+func (db *LazyDB) setGrown(key, value []byte, capacity int) error {
+	if len(value) <= capacity {
+		return db.setPadded(key, value, capacity)
+	}
+	entry := &logfile.LogEntry{Key: key, Value: value, ExpiredAt: db.defaultExpiredAt(db.now())}
+	valuePos, err := db.writeLogEntry(valueTypeString, entry)
+	if err != nil {
+		return err
+	}
+	return db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valuePos, true)
+}
+
+// setPadded sets key to value with room for it to grow to capacity, see SetWithCapacity.
+// Lock of strIndex must be held by the caller.
+func (db *LazyDB) setPadded(key, value []byte, capacity int) error {
+	entry := &logfile.LogEntry{Key: key, Value: encodePadded(value, capacity), Stat: logfile.SPadded,
+		ExpiredAt: db.defaultExpiredAt(db.now())}
+	valuePos, inPlace, err := db.writeStrEntry(entry, time.Time{})
+	if err != nil {
+		return err
+	}
+	// the older entry is still live if it is overwritten in place
+	return db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valuePos, !inPlace)
+}
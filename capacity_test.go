@@ -0,0 +1,76 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_SetWithCapacity(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_set_with_capacity"))
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	activeOffset := func() int64 {
+		return db.getActiveLogFile(valueTypeString).lf.Offset
+	}
+	key := []byte("buffer")
+	assert.Nil(t, db.SetWithCapacity(key, []byte("abc"), 16))
+	val, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abc"), val)
+	n, err := db.StrLen(key)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+
+	// the value grows within its capacity in place
+	offset := activeOffset()
+	assert.Nil(t, db.Append(key, []byte("def")))
+	size, err := db.SetRange(key, 8, []byte("xyz"))
+	assert.Nil(t, err)
+	assert.Equal(t, 11, size)
+	size, err = db.SetRange(key, 0, []byte("A"))
+	assert.Nil(t, err)
+	assert.Equal(t, 11, size)
+	assert.Equal(t, offset, activeOffset())
+	want := []byte("Abcdef\x00\x00xyz")
+	val, err = db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, want, val)
+	val, err = db.GetRange(key, -3, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("xyz"), val)
+
+	// up to the capacity exactly
+	assert.Nil(t, db.Append(key, []byte("12345")))
+	assert.Equal(t, offset, activeOffset())
+	want = append(want, "12345"...)
+
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	val, err = db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, want, val)
+
+	// beyond the capacity the value is appended without room
+	offset = activeOffset()
+	assert.Nil(t, db.Append(key, []byte("!")))
+	assert.Greater(t, activeOffset(), offset)
+	val, err = db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, append(want, '!'), val)
+
+	size, err = db.SetRange([]byte("missing"), 2, []byte("v"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, size)
+	val, err = db.Get([]byte("missing"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("\x00\x00v"), val)
+	_, err = db.SetRange(key, -1, []byte("v"))
+	assert.Equal(t, ErrInvalidParam, err)
+}
@@ -0,0 +1,385 @@
+package lazydb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/billsjc123/LazyDB/ds"
+	"github.com/billsjc123/LazyDB/logfile"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// recoveryCheckpointPrefix prefix of recovery checkpoint files, one file for each type, like "CHECKPOINT.strs".
+const recoveryCheckpointPrefix = "CHECKPOINT."
+
+var errInvalidCheckpoint = errors.New("recovery checkpoint is invalid")
+
+// afterReplayHook is called after an archived log file is replayed and checkpointed during recovery, for testing.
+var afterReplayHook func(typ valueType, fid uint32)
+
+// recoveryCheckpoint is the index of a type built from archived log files up to lastFid.
+type recoveryCheckpoint struct {
+	lastFid uint32
+	offsets map[uint32]int64 // WriteAt of replayed log files
+	entries []checkpointEntry
+}
+
+type checkpointEntry struct {
+	treeKey []byte // key of the hash, empty for String and custom types
+	key     []byte
+	val     *Value
+}
+
+func (db *LazyDB) checkpointEnabled() bool {
+	return db.cfg.RecoveryCheckpointInterval > 0 && db.checkpointAllowed()
+}
+
+// checkpointAllowed returns whether checkpoints can be saved, references to interned values are not saved in
+// them, and keys skipped by DBConfig.RecoveryFilter would be lost.
+func (db *LazyDB) checkpointAllowed() bool {
+	return !db.readOnly() && !db.cfg.InternValues && db.cfg.RecoveryFilter == nil
+}
+
+func (db *LazyDB) checkpointPath(typ valueType) string {
+	name, _ := logfile.FileNamePrefix(logfile.FType(typ))
+	return filepath.Join(db.cfg.DBPath, recoveryCheckpointPrefix+name[len(logfile.FilePrefix):len(name)-1])
+}
+
+// writeCheckpoint saves the index of the type built from logFiles up to their WriteAt,
+// it replaces the old checkpoint atomically.
+// Format: lastFid | number of files | (fid, offset)... | entries... | crc32 of all above,
+// an entry is: tree key | index key | fid | offset | entrySize | expiredAt | packed | writtenAt,
+// the tree key is empty for String and custom types.
+func (db *LazyDB) writeCheckpoint(typ valueType, logFiles []*logfile.LogFile) error {
+	path := db.checkpointPath(typ)
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	crc := crc32.NewIEEE()
+	w := bufio.NewWriter(io.MultiWriter(file, crc))
+	buf := make([]byte, binary.MaxVarintLen64)
+	putUvarint := func(v uint64) {
+		n := binary.PutUvarint(buf, v)
+		w.Write(buf[:n])
+	}
+	putVarint := func(v int64) {
+		n := binary.PutVarint(buf, v)
+		w.Write(buf[:n])
+	}
+	putBytes := func(b []byte) {
+		putUvarint(uint64(len(b)))
+		w.Write(b)
+	}
+	putEntries := func(treeKey []byte, tree *ds.AdaptiveRadixTree) error {
+		iter := tree.Iterator()
+		for iter.HasNext() {
+			node, err := iter.Next()
+			if err != nil {
+				return err
+			}
+			val, _ := node.Value().(*Value)
+			if val == nil {
+				continue
+			}
+			putBytes(treeKey)
+			putBytes(node.Key())
+			putUvarint(uint64(val.fid))
+			putVarint(val.offset)
+			putUvarint(uint64(val.entrySize))
+			putVarint(val.expiredAt)
+			if val.packed {
+				putUvarint(1)
+			} else {
+				putUvarint(0)
+			}
+			putVarint(val.writtenAt)
+		}
+		return nil
+	}
+
+	putUvarint(uint64(logFiles[len(logFiles)-1].Fid))
+	putUvarint(uint64(len(logFiles)))
+	for _, lf := range logFiles {
+		putUvarint(uint64(lf.Fid))
+		putVarint(lf.Offset)
+	}
+	switch typ {
+	case valueTypeString:
+		err = putEntries(nil, db.strIndex.idxTree)
+	case valueTypeHash:
+		for key, tree := range db.hashIndex.trees {
+			if err = putEntries([]byte(key), tree); err != nil {
+				break
+			}
+		}
+	default:
+		if ct := db.getCustomType(typ); ct != nil {
+			err = putEntries(nil, ct.index.idxTree)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = binary.Write(file, binary.LittleEndian, crc.Sum32()); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// loadCheckpoint reads the checkpoint of the type.
+// It returns nil if there is no checkpoint, and errInvalidCheckpoint if it is broken.
+func (db *LazyDB) loadCheckpoint(typ valueType) (*recoveryCheckpoint, error) {
+	data, err := os.ReadFile(db.checkpointPath(typ))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, errInvalidCheckpoint
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return nil, errInvalidCheckpoint
+	}
+
+	var pos int
+	broken := false
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(body[pos:])
+		if n <= 0 {
+			broken = true
+			return 0
+		}
+		pos += n
+		return v
+	}
+	varint := func() int64 {
+		v, n := binary.Varint(body[pos:])
+		if n <= 0 {
+			broken = true
+			return 0
+		}
+		pos += n
+		return v
+	}
+	bytesOf := func() []byte {
+		size := int(uvarint())
+		if broken || pos+size > len(body) {
+			broken = true
+			return nil
+		}
+		b := make([]byte, size)
+		copy(b, body[pos:pos+size])
+		pos += size
+		return b
+	}
+
+	cp := &recoveryCheckpoint{lastFid: uint32(uvarint()), offsets: make(map[uint32]int64)}
+	fileNum := int(uvarint())
+	for i := 0; i < fileNum && !broken; i++ {
+		fid := uint32(uvarint())
+		cp.offsets[fid] = varint()
+	}
+	for pos < len(body) && !broken {
+		treeKey, key := bytesOf(), bytesOf()
+		val := &Value{vType: typ, fid: uint32(uvarint()), offset: varint(), entrySize: int(uvarint()), expiredAt: varint(),
+			packed: uvarint() == 1, writtenAt: varint(), lastAccess: db.now().UnixNano()}
+		cp.entries = append(cp.entries, checkpointEntry{treeKey: treeKey, key: key, val: val})
+	}
+	if broken {
+		return nil, errInvalidCheckpoint
+	}
+	return cp, nil
+}
+
+// applyCheckpoint builds the index of the type from the checkpoint, and sets WriteAt of the replayed log files
+// to where the checkpoint was taken. logFiles must be sorted by fid, and the checkpoint is rejected if they do not
+// match the replayed log files. It returns the number of log files covered by the checkpoint, whose entries
+// after WriteAt are left to be replayed by the caller.
+func (db *LazyDB) applyCheckpoint(typ valueType, cp *recoveryCheckpoint, logFiles []*logfile.LogFile) (int, error) {
+	var n int
+	for n < len(logFiles) && logFiles[n].Fid <= cp.lastFid {
+		if _, ok := cp.offsets[logFiles[n].Fid]; !ok {
+			return 0, errInvalidCheckpoint
+		}
+		n++
+	}
+	if n != len(cp.offsets) {
+		return 0, errInvalidCheckpoint
+	}
+
+	for _, ent := range cp.entries {
+		switch typ {
+		case valueTypeString:
+			oldVal, _ := db.strIndex.idxTree.Put(ent.key, ent.val)
+			db.replaceStrValue(ent.key, oldVal, ent.val)
+		case valueTypeHash:
+			db.collectionTree(valueTypeHash, ent.treeKey).Put(ent.key, ent.val)
+		default:
+			if ct := db.getCustomType(typ); ct != nil {
+				ct.index.idxTree.Put(ent.key, ent.val)
+			}
+		}
+	}
+	for _, lf := range logFiles[:n] {
+		atomic.StoreInt64(&lf.Offset, cp.offsets[lf.Fid])
+	}
+	return n, nil
+}
+
+// resumeFromCheckpoint builds the index of the type from its checkpoint if there is a valid one,
+// and returns the number of log files covered by it, see applyCheckpoint. Invalid checkpoints are ignored.
+func (db *LazyDB) resumeFromCheckpoint(typ valueType, logFiles []*logfile.LogFile) int {
+	// references to interned values are not saved in checkpoints, keys skipped by the filter may be in them,
+	// and so may keys of log files which are not recovered
+	if db.readOnly() || db.cfg.InternValues || db.cfg.RecoveryFilter != nil || db.cfg.RecoverLatestFiles > 0 {
+		return 0
+	}
+	cp, err := db.loadCheckpoint(typ)
+	if err == nil && cp == nil {
+		return 0
+	}
+	var n int
+	if err == nil {
+		n, err = db.applyCheckpoint(typ, cp, logFiles)
+	}
+	if err != nil {
+		log.Printf("ignore recovery checkpoint of %s: %v", db.checkpointPath(typ), err)
+		return 0
+	}
+	return n
+}
+
+// checkpointAfterReplay is called after logFiles[i] is replayed and applied to the index,
+// replayed is the number of log files replayed since opening.
+func (db *LazyDB) checkpointAfterReplay(typ valueType, logFiles []*logfile.LogFile, i, replayed int) {
+	// the active log file is never checkpointed
+	if i == len(logFiles)-1 {
+		return
+	}
+	if db.checkpointEnabled() && replayed%db.cfg.RecoveryCheckpointInterval == 0 {
+		if err := db.writeCheckpoint(typ, logFiles[:i+1]); err != nil {
+			log.Printf("write recovery checkpoint err: %v", err)
+		}
+	}
+	if afterReplayHook != nil {
+		afterReplayHook(typ, logFiles[i].Fid)
+	}
+}
+
+// removeCheckpoints removes checkpoints of all types once recovery finishes,
+// unless they are kept for the next opening by DBConfig.CheckpointInterval.
+func (db *LazyDB) removeCheckpoints() error {
+	if db.readOnly() || db.cfg.CheckpointInterval > 0 {
+		return nil
+	}
+	return db.deleteCheckpoints()
+}
+
+// deleteCheckpoints removes checkpoints of all types, along with temporary files of unfinished ones.
+func (db *LazyDB) deleteCheckpoints() error {
+	for _, typ := range db.valueTypes() {
+		path := db.checkpointPath(typ)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Remove(path + ".tmp"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// runCheckpoint saves checkpoints of indexes every interval until closeCh is closed, see DBConfig.CheckpointInterval.
+func (db *LazyDB) runCheckpoint(interval time.Duration, closeCh <-chan struct{}) {
+	defer db.bgWg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closeCh:
+			return
+		case <-ticker.C:
+			if err := db.saveCheckpoints(); err != nil {
+				log.Printf("save checkpoint err: %v", err)
+			}
+		}
+	}
+}
+
+// saveCheckpoints saves the indexes built from log files on opening into checkpoints, so that opening again
+// builds them from the checkpoints and replays only entries written after.
+func (db *LazyDB) saveCheckpoints() error {
+	// an uncommitted transaction holds the lock of db, and writes without index locks on commit
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, typ := range db.valueTypes() {
+		// indexes of the other types are not built from log files
+		if typ == valueTypeList || typ == valueTypeSet || typ == valueTypeZSet {
+			continue
+		}
+		if err := db.saveCheckpoint(typ); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveCheckpoint saves the index of the type, covering all its log files up to the current WriteAt.
+func (db *LazyDB) saveCheckpoint(typ valueType) error {
+	// writes of the type are blocked, so that the index matches WriteAt of log files
+	mu := db.getIndexLock(typ)
+	mu.RLock()
+	defer mu.RUnlock()
+
+	mutexFids := db.fidsMap[typ]
+	mutexFids.mu.RLock()
+	fids := make([]uint32, len(mutexFids.fids))
+	copy(fids, mutexFids.fids)
+	mutexFids.mu.RUnlock()
+	if len(fids) == 0 {
+		return nil
+	}
+	sort.Slice(fids, func(i, j int) bool {
+		return fids[i] < fids[j]
+	})
+	logFiles := make([]*logfile.LogFile, 0, len(fids))
+	for _, fid := range fids {
+		// removed by merge meanwhile
+		lf := db.getLogFile(typ, fid)
+		if lf == nil {
+			return nil
+		}
+		logFiles = append(logFiles, lf)
+	}
+
+	// entries covered by the checkpoint must survive a crash, archived log files are synced on rotation
+	if activeLogFile := db.activeLogFileMap[typ]; activeLogFile != nil {
+		activeLogFile.mu.Lock()
+		err := activeLogFile.lf.Sync()
+		activeLogFile.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return db.writeCheckpoint(typ, logFiles)
+}
@@ -0,0 +1,97 @@
+package lazydb
+
+import (
+	"errors"
+)
+
+// ErrCollectionTooLarge is returned by writes which would grow a collection beyond
+// DBConfig.MaxHashFields, DBConfig.MaxSetMembers or DBConfig.MaxListLength, nothing is written then.
+var ErrCollectionTooLarge = errors.New("collection exceeds max number of elements")
+
+// checkCollectionLimit returns ErrCollectionTooLarge if a collection of size elements exceeds limit
+// once added elements are added. No limitation if limit is not a positive number.
+func checkCollectionLimit(limit, size, added int) error {
+	if limit > 0 && added > 0 && size+added > limit {
+		return ErrCollectionTooLarge
+	}
+	return nil
+}
+
+// checkHashLimit checks DBConfig.MaxHashFields before fields of args are set into the hash at key,
+// fields which already exist are not counted. Hash index lock must be held by the caller.
+func (db *LazyDB) checkHashLimit(key []byte, args [][]byte) error {
+	if db.cfg.MaxHashFields <= 0 {
+		return nil
+	}
+	idxTree := db.hashIndex.trees[string(key)]
+	var size int
+	if idxTree != nil {
+		size = idxTree.Size()
+	}
+	added := make(map[string]struct{})
+	for i := 0; i < len(args); i += 2 {
+		if idxTree != nil && idxTree.Get(db.encodeKey(key, args[i])) != nil {
+			continue
+		}
+		added[string(args[i])] = struct{}{}
+	}
+	return checkCollectionLimit(db.cfg.MaxHashFields, size, len(added))
+}
+
+// checkSetLimit checks DBConfig.MaxSetMembers before members are added into the set at key,
+// members which already exist are not counted. Set index lock must be held by the caller.
+func (db *LazyDB) checkSetLimit(key []byte, members [][]byte) error {
+	if db.cfg.MaxSetMembers <= 0 {
+		return nil
+	}
+	idxTree := db.setIndex.trees[string(key)]
+	var size int
+	if idxTree != nil {
+		size = idxTree.Size()
+	}
+	added := make(map[string]struct{})
+	for _, mem := range members {
+		if len(mem) == 0 {
+			continue
+		}
+		if idxTree != nil {
+			if err := db.setIndex.murHash.Write(mem); err != nil {
+				return err
+			}
+			sum := db.setIndex.murHash.EncodeSum128()
+			db.setIndex.murHash.Reset()
+			if idxTree.Get(sum) != nil {
+				continue
+			}
+		}
+		added[string(mem)] = struct{}{}
+	}
+	return checkCollectionLimit(db.cfg.MaxSetMembers, size, len(added))
+}
+
+// checkListLimit checks DBConfig.MaxListLength before added elements are pushed into the list at key.
+// List index lock must be held by the caller.
+func (db *LazyDB) checkListLimit(key []byte, added int) error {
+	if db.cfg.MaxListLength <= 0 {
+		return nil
+	}
+	length, err := db.listLength(key)
+	if err != nil {
+		return err
+	}
+	return checkCollectionLimit(db.cfg.MaxListLength, length, added)
+}
+
+// listLength returns the number of elements of the list at key by its meta, popped elements are still kept
+// by the index, so its size can't be used. List index lock must be held by the caller.
+func (db *LazyDB) listLength(key []byte) (int, error) {
+	idxTree := db.listIndex.trees[string(key)]
+	if idxTree == nil {
+		return 0, nil
+	}
+	headSeq, tailSeq, err := db.lMeta(idxTree, key)
+	if err != nil {
+		return 0, err
+	}
+	return int(tailSeq - headSeq - 1), nil
+}
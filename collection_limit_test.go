@@ -0,0 +1,71 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_CollectionLimit(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_collection_limit")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxHashFields = 3
+	cfg.MaxSetMembers = 3
+	cfg.MaxListLength = 3
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	t.Run("hash", func(t *testing.T) {
+		key := []byte("hash")
+		assert.Nil(t, db.HSet(key, []byte("f1"), []byte("v1"), []byte("f2"), []byte("v2")))
+		assert.Equal(t, ErrCollectionTooLarge, db.HSet(key, []byte("f3"), []byte("v3"), []byte("f4"), []byte("v4")))
+		assert.Nil(t, db.HSet(key, []byte("f3"), []byte("v3"), []byte("f1"), []byte("new")))
+		assert.Equal(t, ErrCollectionTooLarge, db.HSetNX(key, []byte("f4"), []byte("v4")))
+		all, err := db.HGetAll(key)
+		assert.Nil(t, err)
+		assert.Equal(t, [][]byte{[]byte("f1"), []byte("new"), []byte("f2"), []byte("v2"), []byte("f3"), []byte("v3")}, all)
+	})
+
+	t.Run("set", func(t *testing.T) {
+		key := []byte("set")
+		assert.Equal(t, ErrCollectionTooLarge, db.SAdd(key, []byte("m1"), []byte("m2"), []byte("m3"), []byte("m4")))
+		assert.False(t, sIsMember(t, db, key, []byte("m1")))
+		assert.Nil(t, db.SAdd(key, []byte("m1"), []byte("m2"), []byte("m2")))
+		assert.Nil(t, db.SAdd(key, []byte("m1"), []byte("m3")))
+		assert.Equal(t, ErrCollectionTooLarge, db.SAdd(key, []byte("m4")))
+		members, err := db.SMembers(key)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(members))
+		assert.False(t, sIsMember(t, db, key, []byte("m4")))
+	})
+
+	t.Run("list", func(t *testing.T) {
+		key, other := []byte("list"), []byte("other")
+		assert.Nil(t, db.RPush(key, []byte("a"), []byte("b")))
+		assert.Equal(t, ErrCollectionTooLarge, db.LPush(key, []byte("c"), []byte("d")))
+		assert.Nil(t, db.LPushX(key, []byte("c")))
+		assert.Equal(t, ErrCollectionTooLarge, db.RPushX(key, []byte("d")))
+		assert.Nil(t, db.RPush(other, []byte("x")))
+		_, err := db.LMove(other, key, true, false)
+		assert.Equal(t, ErrCollectionTooLarge, err)
+		// moving within a full list is fine
+		val, err := db.LMove(key, key, true, false)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("c"), val)
+
+		values, err := db.LRange(key, 0, -1)
+		assert.Nil(t, err)
+		assert.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, values)
+		assert.Equal(t, 1, lLen(t, db, other))
+
+		// popped elements make room
+		_, err = db.LPop(key)
+		assert.Nil(t, err)
+		assert.Nil(t, db.RPush(key, []byte("d")))
+		assert.Equal(t, ErrCollectionTooLarge, db.RPush(key, []byte("e")))
+	})
+}
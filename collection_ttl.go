@@ -0,0 +1,246 @@
+package lazydb
+
+import (
+	"time"
+
+	"github.com/billsjc123/LazyDB/ds"
+	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/billsjc123/LazyDB/util"
+)
+
+// CollectionWriteOptions options of writing elements into a hash, set or list, see HSetWithOptions.
+//
+// A collection expires as a whole: every element of it is written with the same expiredAt, and an element
+// written into an expiring collection inherits its expiredAt by default, so that writes neither extend nor
+// shorten the time to live of the collection. The time to live can be overridden explicitly by the options,
+// which rewrites all existing elements with the new one. DBConfig.DefaultTTL does not apply to collections.
+type CollectionWriteOptions struct {
+	// TTL overrides the time to live of the whole collection if it is positive.
+	TTL time.Duration
+
+	// Persist makes the whole collection never expire.
+	Persist bool
+}
+
+// expiredAt returns expiredAt(unix milliseconds) of the collection written with the options at now,
+// and false if the options do not override the one of the collection.
+func (opts CollectionWriteOptions) expiredAt(now time.Time) (int64, bool) {
+	switch {
+	case opts.Persist:
+		return 0, true
+	case opts.TTL > 0:
+		return now.Add(opts.TTL).UnixMilli(), true
+	}
+	return 0, false
+}
+
+// ExpireCollection sets the time to live of the hash, set or list stored at key, and the whole collection is removed
+// once it expires. It never expires if duration is not positive. All elements are rewritten with the new expiredAt,
+// so it costs writes proportional to the size of the collection. ErrKeyNotFound is returned if it does not exist.
+func (db *LazyDB) ExpireCollection(typ valueType, key []byte, duration time.Duration) error {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return err
+	}
+	trees := db.collectionTrees(typ)
+	if trees == nil {
+		return ErrInvalidParam
+	}
+	mu := db.getIndexLock(typ)
+	mu.Lock()
+	defer mu.Unlock()
+
+	db.removeExpiredCollection(typ, key)
+	if idxTree := trees[util.ByteToString(key)]; idxTree == nil || idxTree.Size() == 0 {
+		return ErrKeyNotFound
+	}
+	var expiredAt int64
+	if duration > 0 {
+		expiredAt = db.now().Add(duration).UnixMilli()
+	}
+	return db.setCollectionExpiredAt(typ, key, expiredAt)
+}
+
+// CollectionPTTL returns the time to live in milliseconds of the hash, set or list stored at key like PTTL,
+// 0 if it never expires. ErrKeyNotFound is returned if it does not exist.
+func (db *LazyDB) CollectionPTTL(typ valueType, key []byte) (int64, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return 0, err
+	}
+	trees := db.collectionTrees(typ)
+	if trees == nil {
+		return 0, ErrInvalidParam
+	}
+	mu := db.getIndexLock(typ)
+	mu.RLock()
+	defer mu.RUnlock()
+
+	idxTree := db.liveCollection(typ, key)
+	if idxTree == nil || idxTree.Size() == 0 {
+		return 0, ErrKeyNotFound
+	}
+	expiredAt := collectionExpiredAt(typ, idxTree, key)
+	if expiredAt == 0 {
+		return 0, nil
+	}
+	return expiredAt - db.now().UnixMilli(), nil
+}
+
+// collectionTrees returns index trees of collections of the type, nil if the type is not a hash, set or list.
+func (db *LazyDB) collectionTrees(typ valueType) map[string]*ds.AdaptiveRadixTree {
+	switch typ {
+	case valueTypeHash:
+		return db.hashIndex.trees
+	case valueTypeSet:
+		return db.setIndex.trees
+	case valueTypeList:
+		return db.listIndex.trees
+	}
+	return nil
+}
+
+// collectionExpiredAt returns expiredAt(unix milliseconds) of the collection at key, 0 if it never expires.
+// It is the one of the metadata of a list, and the one shared by all elements of a hash or set.
+func collectionExpiredAt(typ valueType, idxTree *ds.AdaptiveRadixTree, key []byte) int64 {
+	if idxTree == nil {
+		return 0
+	}
+	if typ == valueTypeList {
+		val, _ := idxTree.Get(key).(*Value)
+		if val == nil {
+			return 0
+		}
+		return val.expiredAt
+	}
+	iter := idxTree.Iterator()
+	if !iter.HasNext() {
+		return 0
+	}
+	node, err := iter.Next()
+	if err != nil {
+		return 0
+	}
+	val, _ := node.Value().(*Value)
+	if val == nil {
+		return 0
+	}
+	return val.expiredAt
+}
+
+// liveCollection returns the index tree of the collection at key, nil if it does not exist or has expired.
+// Index lock of the type must be held by the caller.
+func (db *LazyDB) liveCollection(typ valueType, key []byte) *ds.AdaptiveRadixTree {
+	idxTree := db.collectionTrees(typ)[util.ByteToString(key)]
+	expiredAt := collectionExpiredAt(typ, idxTree, key)
+	if expiredAt != 0 && expiredAt <= db.now().UnixMilli() {
+		return nil
+	}
+	return idxTree
+}
+
+// removeExpiredCollection removes the index of the collection at key if it has expired, so that it is written
+// as a new one. Entries of its elements are left to merge, which skips expired entries.
+// Index lock of the type must be held by the caller.
+func (db *LazyDB) removeExpiredCollection(typ valueType, key []byte) {
+	trees := db.collectionTrees(typ)
+	idxTree := trees[util.ByteToString(key)]
+	if idxTree == nil || db.liveCollection(typ, key) != nil {
+		return
+	}
+	iter := idxTree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil {
+			break
+		}
+		db.sendDiscard(node.Value(), true, typ)
+	}
+	db.removeCollectionTree(typ, key)
+}
+
+// prepareCollectionWrite removes the collection at key if it has expired, and overrides its time to live by opts.
+// It returns expiredAt which elements written into the collection should carry.
+// Index lock of the type must be held by the caller.
+func (db *LazyDB) prepareCollectionWrite(typ valueType, key []byte, opts CollectionWriteOptions) (int64, error) {
+	db.removeExpiredCollection(typ, key)
+	idxTree := db.collectionTrees(typ)[util.ByteToString(key)]
+	current := collectionExpiredAt(typ, idxTree, key)
+	expiredAt, ok := opts.expiredAt(db.now())
+	if !ok || expiredAt == current {
+		return current, nil
+	}
+	if idxTree != nil && idxTree.Size() > 0 {
+		if err := db.setCollectionExpiredAt(typ, key, expiredAt); err != nil {
+			return 0, err
+		}
+	}
+	return expiredAt, nil
+}
+
+// setCollectionExpiredAt rewrites all elements of the collection at key with expiredAt, and the metadata of a list.
+// Index lock of the type must be held by the caller.
+func (db *LazyDB) setCollectionExpiredAt(typ valueType, key []byte, expiredAt int64) error {
+	idxTree := db.collectionTrees(typ)[util.ByteToString(key)]
+	if typ == valueTypeHash && isPacked(idxTree) {
+		pairs, err := db.packedPairs(valueTypeHash, key, idxTree)
+		if err != nil {
+			return err
+		}
+		return db.writePackedHash(key, pairs, expiredAt)
+	}
+	if typ == valueTypeSet && isPacked(idxTree) {
+		members, err := db.packedMembers(idxTree)
+		if err != nil {
+			return err
+		}
+		return db.writePackedSet(key, members, expiredAt)
+	}
+
+	var idxKeys [][]byte
+	if typ == valueTypeList {
+		// popped elements are left in the index, only elements between the head and tail are live
+		headSeq, tailSeq, err := db.lMeta(idxTree, key)
+		if err != nil {
+			return err
+		}
+		for seq := headSeq + 1; seq < tailSeq; seq++ {
+			idxKeys = append(idxKeys, db.encodeListKey(key, seq))
+		}
+		idxKeys = append(idxKeys, key)
+	} else {
+		iter := idxTree.Iterator()
+		for iter.HasNext() {
+			node, err := iter.Next()
+			if err != nil {
+				return err
+			}
+			idxKeys = append(idxKeys, node.Key())
+		}
+	}
+	for _, idxKey := range idxKeys {
+		value, err := db.getValue(idxTree, idxKey, typ)
+		if err != nil {
+			return err
+		}
+		entry := &logfile.LogEntry{Key: idxKey, Value: value, ExpiredAt: expiredAt}
+		if typ == valueTypeList && len(idxKey) == len(key) {
+			entry.Stat = logfile.SListMeta
+		}
+		// members are written with the key of the set, and indexed by their sums
+		ent := entry
+		if typ == valueTypeSet {
+			ent = &logfile.LogEntry{Key: key, Value: value, ExpiredAt: expiredAt}
+		}
+		valPos, err := db.writeLogEntry(typ, ent)
+		if err != nil {
+			return err
+		}
+		if typ == valueTypeSet {
+			entry.WrittenAt = ent.WrittenAt
+			valPos.entrySize = db.entrySize(ent)
+		}
+		if err = db.updateIndexTree(typ, idxTree, entry, valPos, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_ExpireCollection(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_expire_collection"))
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+
+	hash, set, list := []byte("hash"), []byte("set"), []byte("list")
+	assert.Nil(t, db.HSet(hash, []byte("f1"), []byte("v1")))
+	assert.Nil(t, db.SAdd(set, []byte("m1")))
+	assert.Nil(t, db.RPush(list, []byte("e1")))
+	assert.Equal(t, ErrKeyNotFound, db.ExpireCollection(valueTypeHash, []byte("missing"), time.Second))
+	assert.Equal(t, ErrInvalidParam, db.ExpireCollection(valueTypeString, hash, time.Second))
+
+	for _, typ := range []valueType{valueTypeHash, valueTypeSet, valueTypeList} {
+		key := map[valueType][]byte{valueTypeHash: hash, valueTypeSet: set, valueTypeList: list}[typ]
+		ttl, err := db.CollectionPTTL(typ, key)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(0), ttl)
+		assert.Nil(t, db.ExpireCollection(typ, key, 10*time.Second))
+	}
+
+	// elements added later inherit the time to live, rather than resetting it
+	now = now.Add(5 * time.Second)
+	assert.Nil(t, db.HSet(hash, []byte("f2"), []byte("v2")))
+	assert.Nil(t, db.SAdd(set, []byte("m2")))
+	assert.Nil(t, db.RPush(list, []byte("e2")))
+	for _, typ := range []valueType{valueTypeHash, valueTypeSet, valueTypeList} {
+		key := map[valueType][]byte{valueTypeHash: hash, valueTypeSet: set, valueTypeList: list}[typ]
+		ttl, err := db.CollectionPTTL(typ, key)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(5000), ttl)
+	}
+	assert.Equal(t, 2, hLen(t, db, hash))
+	assert.Equal(t, 2, lLen(t, db, list))
+
+	// the whole collection expires together
+	now = now.Add(6 * time.Second)
+	val, err := db.HGet(hash, []byte("f2"))
+	assert.Nil(t, err)
+	assert.Nil(t, val)
+	pairs, err := db.HGetAll(hash)
+	assert.Nil(t, err)
+	assert.Empty(t, pairs)
+	assert.Equal(t, 0, hLen(t, db, hash))
+	members, err := db.SMembers(set)
+	assert.Nil(t, err)
+	assert.Empty(t, members)
+	assert.False(t, sIsMember(t, db, set, []byte("m1")))
+	assert.Equal(t, 0, lLen(t, db, list))
+	_, err = db.LRange(list, 0, -1)
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.CollectionPTTL(valueTypeHash, hash)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// written again as a new collection without time to live
+	assert.Nil(t, db.HSet(hash, []byte("f3"), []byte("v3")))
+	assert.Equal(t, 1, hLen(t, db, hash))
+	ttl, err := db.CollectionPTTL(valueTypeHash, hash)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), ttl)
+
+	// the time to live is overridden explicitly
+	assert.Nil(t, db.HSetWithOptions(hash, CollectionWriteOptions{TTL: 20 * time.Second}, []byte("f4"), []byte("v4")))
+	assert.Nil(t, db.SAddWithOptions(set, CollectionWriteOptions{TTL: 20 * time.Second}, []byte("m3")))
+	assert.Nil(t, db.RPushWithOptions(list, CollectionWriteOptions{TTL: 20 * time.Second}, []byte("e3")))
+	for _, typ := range []valueType{valueTypeHash, valueTypeSet, valueTypeList} {
+		key := map[valueType][]byte{valueTypeHash: hash, valueTypeSet: set, valueTypeList: list}[typ]
+		ttl, err := db.CollectionPTTL(typ, key)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(20000), ttl)
+	}
+	assert.Nil(t, db.SAddWithOptions(set, CollectionWriteOptions{Persist: true}, []byte("m4")))
+	ttl, err = db.CollectionPTTL(valueTypeSet, set)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), ttl)
+
+	// the time to live of a hash is kept after reopen
+	hash2 := []byte("hash2")
+	assert.Nil(t, db.HSetWithOptions(hash2, CollectionWriteOptions{TTL: time.Hour}, []byte("f1"), []byte("v1")))
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	db.clock = func() time.Time { return now }
+	ttl, err = db.CollectionPTTL(valueTypeHash, hash2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(time.Hour/time.Millisecond), ttl)
+	now = now.Add(time.Hour + time.Second)
+	assert.Equal(t, 0, hLen(t, db, hash2))
+}
@@ -0,0 +1,114 @@
+package lazydb
+
+// CommandInfo describes a command of LazyDB like COMMAND INFO of Redis, so that servers or REPLs built on it can
+// look up commands and validate arguments before calling the methods, see Commands.
+type CommandInfo struct {
+	// Name the name of the method in upper case, e.g. "HSET" for HSet.
+	Name string
+	// Arity number of arguments including the name, the arguments are those of the method in order, with variadic
+	// and slice arguments spread, e.g. field and value pairs of HSET. It is -N if it takes at least N arguments.
+	Arity int
+	// FirstKey, LastKey and KeyStep locate keys among the arguments, the name being at 0. LastKey is -1 if keys
+	// run up to the last argument. They are all 0 if the command takes no key.
+	FirstKey int
+	LastKey  int
+	KeyStep  int
+	// Write whether the command may modify keys.
+	Write bool
+	// Blocking whether the command may block waiting for other writes, e.g. BLPOP.
+	Blocking bool
+}
+
+// commands is the table returned by Commands, in alphabetical order of names. Every command must be a method of
+// LazyDB, a new method of a data type is added here along with it.
+var commands = []CommandInfo{
+	{Name: "APPEND", Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "BLPOP", Arity: -3, FirstKey: 2, LastKey: -1, KeyStep: 1, Write: true, Blocking: true},
+	{Name: "BRPOP", Arity: -3, FirstKey: 2, LastKey: -1, KeyStep: 1, Write: true, Blocking: true},
+	{Name: "DECR", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "DECRBY", Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "DELETE", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "EXISTS", Arity: -2, FirstKey: 1, LastKey: -1, KeyStep: 1},
+	{Name: "EXPIRE", Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "GEOADD", Arity: 5, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "GEOPOS", Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "GEOSEARCH", Arity: 5, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "GET", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "GETDEL", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "GETRANGE", Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "HDEL", Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "HEXISTS", Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "HGET", Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "HGETALL", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "HGETDEL", Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "HKEYS", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "HLEN", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "HMGET", Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "HRANDFIELD", Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "HSCAN", Arity: 5, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "HSET", Arity: -4, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "HSETNX", Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "HVALS", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "INCR", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "INCRBY", Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "LINDEX", Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "LLEN", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "LMOVE", Arity: 5, FirstKey: 1, LastKey: 2, KeyStep: 1, Write: true},
+	{Name: "LPOP", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "LPUSH", Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "LPUSHX", Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "LRANGE", Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "LSET", Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "MGET", Arity: -2, FirstKey: 1, LastKey: -1, KeyStep: 1},
+	{Name: "MSET", Arity: -3, FirstKey: 1, LastKey: -1, KeyStep: 2, Write: true},
+	{Name: "MSETNX", Arity: -3, FirstKey: 1, LastKey: -1, KeyStep: 2, Write: true},
+	{Name: "PERSIST", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "PEXPIRE", Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "PFADD", Arity: -2, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "PFCOUNT", Arity: -2, FirstKey: 1, LastKey: -1, KeyStep: 1},
+	{Name: "PFMERGE", Arity: -2, FirstKey: 1, LastKey: -1, KeyStep: 1, Write: true},
+	{Name: "PSETEX", Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "PTTL", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "RPOP", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "RPUSH", Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "RPUSHX", Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "SADD", Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "SET", Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "SETEX", Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "SETNX", Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "SINTERCARD", Arity: -3, FirstKey: 2, LastKey: -1, KeyStep: 1},
+	{Name: "SISMEMBER", Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "SMEMBERS", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "SMISMEMBER", Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "SMOVE", Arity: 4, FirstKey: 1, LastKey: 2, KeyStep: 1, Write: true},
+	{Name: "SPOP", Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "SRANDMEMBER", Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "SREM", Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "STRLEN", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "SUNIONCARD", Arity: -2, FirstKey: 1, LastKey: -1, KeyStep: 1},
+	{Name: "TOUCH", Arity: -2, FirstKey: 1, LastKey: -1, KeyStep: 1},
+	{Name: "TTL", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "TYPE", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "UNLINK", Arity: -2, FirstKey: 1, LastKey: -1, KeyStep: 1, Write: true},
+	{Name: "ZADD", Arity: -4, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "ZCARD", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "ZDIFF", Arity: -2, FirstKey: 1, LastKey: -1, KeyStep: 1},
+	{Name: "ZINCRBY", Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "ZPOPMAX", Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "ZPOPMIN", Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "ZPOPMINTIMEOUT", Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true, Blocking: true},
+	{Name: "ZRANDMEMBER", Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "ZRANGE", Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "ZRANGEBYLEX", Arity: 6, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "ZRANK", Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "ZREM", Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true},
+	{Name: "ZREVRANGE", Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "ZREVRANK", Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	{Name: "ZSCORE", Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+}
+
+// Commands returns information of the data commands supported by LazyDB, in alphabetical order of names.
+// Administrative methods, e.g. Merge or Close, and variants taking options structs are not listed.
+func (db *LazyDB) Commands() []CommandInfo {
+	return append([]CommandInfo(nil), commands...)
+}
@@ -0,0 +1,43 @@
+package lazydb
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_Commands(t *testing.T) {
+	db := &LazyDB{}
+	infos := make(map[string]CommandInfo)
+	for _, info := range db.Commands() {
+		infos[info.Name] = info
+	}
+	assert.Equal(t, CommandInfo{Name: "GET", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1}, infos["GET"])
+	assert.Equal(t, CommandInfo{Name: "HSET", Arity: -4, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true}, infos["HSET"])
+	assert.Equal(t, CommandInfo{Name: "ZADD", Arity: -4, FirstKey: 1, LastKey: 1, KeyStep: 1, Write: true}, infos["ZADD"])
+	assert.True(t, infos["BLPOP"].Blocking)
+	assert.Equal(t, 2, infos["MSET"].KeyStep)
+
+	// every command is a method, and takes the arguments of the method
+	methods := make(map[string]reflect.Method)
+	dbType := reflect.TypeOf(db)
+	for i := 0; i < dbType.NumMethod(); i++ {
+		methods[strings.ToUpper(dbType.Method(i).Name)] = dbType.Method(i)
+	}
+	for _, info := range db.Commands() {
+		method, ok := methods[info.Name]
+		if !assert.True(t, ok, info.Name) {
+			continue
+		}
+		// the receiver is counted like the name
+		numIn := method.Type.NumIn()
+		switch {
+		case method.Type.IsVariadic():
+			assert.GreaterOrEqual(t, -info.Arity, numIn-1, info.Name)
+		case info.Arity > 0:
+			assert.Equal(t, numIn, info.Arity, info.Name)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package lazydb
+
+import (
+	"sync"
+	"time"
+)
+
+// commitSyncer coalesces fsyncs of concurrent commits of transactions, see DBConfig.CommitSyncWindow.
+type commitSyncer struct {
+	mu    sync.Mutex
+	group *syncGroup // the group collecting commits until its window ends, nil if none
+}
+
+// syncGroup commits sharing a single fsync of the active log file of each type.
+type syncGroup struct {
+	types map[valueType]struct{}
+	done  chan struct{} // closed once synced
+	err   error
+}
+
+// syncCommit syncs the active log files of types written by a commit, and returns once they are synced.
+// Commits within DBConfig.CommitSyncWindow join the same group, which is synced once when the window ends.
+func (db *LazyDB) syncCommit(types []valueType) error {
+	window := db.cfg.CommitSyncWindow
+	if window <= 0 {
+		return db.syncActiveLogFiles(types)
+	}
+
+	cs := &db.commitSyncer
+	cs.mu.Lock()
+	g := cs.group
+	if g == nil {
+		g = &syncGroup{types: make(map[valueType]struct{}), done: make(chan struct{})}
+		cs.group = g
+		time.AfterFunc(window, func() {
+			// commits coming later join a new group
+			cs.mu.Lock()
+			cs.group = nil
+			cs.mu.Unlock()
+
+			synced := make([]valueType, 0, len(g.types))
+			for typ := range g.types {
+				synced = append(synced, typ)
+			}
+			g.err = db.syncActiveLogFiles(synced)
+			close(g.done)
+		})
+	}
+	for _, typ := range types {
+		g.types[typ] = struct{}{}
+	}
+	cs.mu.Unlock()
+
+	<-g.done
+	return g.err
+}
+
+// syncActiveLogFiles syncs the active log files of types, archived log files have been synced by rotating.
+func (db *LazyDB) syncActiveLogFiles(types []valueType) error {
+	for _, typ := range types {
+		activeLogFile := db.getActiveLogFile(typ)
+		if activeLogFile == nil {
+			continue
+		}
+		activeLogFile.mu.Lock()
+		err := activeLogFile.lf.Sync()
+		activeLogFile.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package lazydb
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/billsjc123/LazyDB/logfile"
+)
+
+// compactKeyPrefix prefix of the temporary file of a log file rewritten by CompactKey,
+// like "COMPACT.log.strs.0000000001", which is ignored by opening.
+const compactKeyPrefix = "COMPACT."
+
+// CompactKey removes superseded entries of the key of type String from archived log files and keeps its live entry,
+// so that the history of a key overwritten many times is reclaimed without merging whole log files. Delete entries
+// of the key are removed too, since all older entries of it are removed along with them.
+//
+// Each archived log file holding such entries is rewritten with the same fid, where the other entries are kept in
+// order, and positions of live ones are moved in the index. Log files whose footers tell the key is out of their key
+// range are skipped without reading them, others are scanned. The active log file is not rewritten.
+// Writes of type String are blocked until it finishes, and positions of rewritten log files held by Tail are invalid.
+func (db *LazyDB) CompactKey(key []byte) error {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return err
+	}
+	if err := db.checkRewrite(); err != nil {
+		return err
+	}
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	mutexFids := db.fidsMap[valueTypeString]
+	mutexFids.mu.RLock()
+	fids := make([]uint32, len(mutexFids.fids))
+	copy(fids, mutexFids.fids)
+	mutexFids.mu.RUnlock()
+
+	live, _ := db.strIndex.idxTree.Get(key).(*Value)
+	for _, fid := range fids {
+		// the active log file is not archived
+		mlf := db.getArchivedLogFile(valueTypeString, fid)
+		if mlf == nil {
+			continue
+		}
+		if err := db.compactKeyInFile(key, live, mlf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactKeyInFile rewrites the archived log file without entries of key other than live, the indexed value of key.
+// The log file is rewritten into a temporary file, which replaces it atomically, so that a crash leaves either of them.
+// Lock of strIndex must be held by the caller.
+func (db *LazyDB) compactKeyInFile(key []byte, live *Value, mlf *MutexLogFile) error {
+	typ := valueTypeString
+	lf := mlf.lf
+	if err := db.pinLogFile(typ, lf); err != nil {
+		return err
+	}
+	footer, err := lf.ReadFooter()
+	lf.Mu.RUnlock()
+	if err == nil && (bytes.Compare(key, footer.MinKey) < 0 || bytes.Compare(key, footer.MaxKey) > 0) {
+		return nil
+	}
+
+	type keptEntry struct {
+		key    []byte
+		offset int64
+		blob   bool // an interned value, whose key is the hash of it
+	}
+	var kept []keptEntry
+	var removed int
+	_, err = db.replayLogFile(typ, lf, 0, func(entry *logfile.LogEntry, vPos *ValuePos) {
+		blob := entry.Stat == logfile.SValueBlob
+		if !blob && bytes.Equal(entry.Key, key) && (live == nil || live.fid != vPos.fid || live.offset != vPos.offset) {
+			removed += vPos.entrySize
+			return
+		}
+		kept = append(kept, keptEntry{key: entry.Key, offset: vPos.offset, blob: blob})
+	})
+	if err != nil || removed == 0 {
+		return err
+	}
+
+	path := lf.Path()
+	tmpPath := filepath.Join(filepath.Dir(path), compactKeyPrefix+filepath.Base(path))
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	footer = &logfile.Footer{}
+	offsets := make([]int64, len(kept))
+	var offset int64
+	for i, ent := range kept {
+		if err = db.pinLogFile(typ, lf); err != nil {
+			return err
+		}
+		buf, err := lf.ReadRawLogEntry(ent.offset)
+		lf.Mu.RUnlock()
+		if err != nil {
+			return err
+		}
+		// padding is not read
+		if size := logfile.AlignSize(len(buf), db.cfg.BlockAlign); size > len(buf) {
+			buf = append(buf, make([]byte, size-len(buf))...)
+		}
+		if _, err = w.Write(buf); err != nil {
+			return err
+		}
+		footer.Add(ent.key, buf)
+		offsets[i] = offset
+		offset += int64(len(buf))
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+
+	// positions of entries in the log file change, so its index log and checkpoints are stale
+	db.removeIndexLog(typ, lf.Fid)
+	if err = db.deleteCheckpoints(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	newLf, err := db.openLogFile(typ, lf.Fid)
+	if err != nil {
+		return err
+	}
+	newLf.Offset = offset
+	if err = newLf.WriteFooter(footer); err != nil && err != logfile.ErrFooterNoSpace {
+		return err
+	}
+	if err = newLf.Sync(); err != nil {
+		return err
+	}
+
+	// reads in flight still hold the replaced log file, which is closed once they finish
+	if db.fileCache != nil {
+		db.fileCache.remove(typ, lf.Fid)
+	}
+	if db.valueCache != nil {
+		db.valueCache.removeFile(lf.Fid)
+	}
+	db.archivedLogFile[typ].Set(lf.Fid, &MutexLogFile{lf: newLf})
+	db.cacheLogFile(typ, newLf)
+	mlf.replaced = true
+	db.retireLogFile(typ, mlf)
+
+	for i, ent := range kept {
+		if offsets[i] == ent.offset {
+			continue
+		}
+		if ent.blob {
+			if iv := db.strIndex.interned[string(ent.key)]; iv != nil && iv.pos.fid == lf.Fid && iv.pos.offset == ent.offset {
+				iv.pos.offset = offsets[i]
+			}
+			continue
+		}
+		if val, _ := db.strIndex.idxTree.Get(ent.key).(*Value); val != nil && val.fid == lf.Fid && val.offset == ent.offset {
+			val.offset = offsets[i]
+		}
+	}
+	db.discardsMap[typ].decrDiscard(lf.Fid, removed)
+	return nil
+}
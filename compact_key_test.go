@@ -0,0 +1,101 @@
+package lazydb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/stretchr/testify/assert"
+)
+
+// archivedHistory returns the number and total size of entries of key in archived log files of type String,
+// along with the total size of entries in them.
+func archivedHistory(t *testing.T, db *LazyDB, key []byte) (int, int, int64) {
+	var count, size int
+	var total int64
+	for _, fid := range db.fidsMap[valueTypeString].fids {
+		mlf := db.getArchivedLogFile(valueTypeString, fid)
+		if mlf == nil {
+			continue
+		}
+		end, err := db.replayLogFile(valueTypeString, mlf.lf, 0, func(entry *logfile.LogEntry, vPos *ValuePos) {
+			if bytes.Equal(entry.Key, key) {
+				count++
+				size += vPos.entrySize
+			}
+		})
+		assert.Nil(t, err)
+		total += end
+	}
+	return count, size, total
+}
+
+func TestLazyDB_CompactKey(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_compact_key"))
+	cfg.MaxLogFileSize = 1000
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	hot, deleted := []byte("hot"), []byte("deleted")
+	others := make(map[string][]byte)
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Set(hot, GetValue(16)))
+		assert.Nil(t, db.Set(deleted, GetValue(16)))
+		if i%10 == 0 {
+			others[string(GetKey(i))] = GetValue(16)
+			assert.Nil(t, db.Set(GetKey(i), others[string(GetKey(i))]))
+		}
+	}
+	assert.Nil(t, db.Delete(deleted))
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.Set(GetKey(1000+i), GetValue(16)))
+	}
+	want, err := db.Get(hot)
+	assert.Nil(t, err)
+	count, size, total := archivedHistory(t, db, hot)
+	assert.Greater(t, count, 100)
+
+	assert.Nil(t, db.CompactKey(hot))
+	// only the live entry is kept
+	newCount, newSize, newTotal := archivedHistory(t, db, hot)
+	assert.Equal(t, 1, newCount)
+	assert.Equal(t, total-int64(size-newSize), newTotal)
+	val, err := db.Get(hot)
+	assert.Nil(t, err)
+	assert.Equal(t, want, val)
+	for key, want := range others {
+		val, err = db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, want, val)
+	}
+
+	// the delete entry goes along with the history of a deleted key
+	assert.Nil(t, db.CompactKey(deleted))
+	newCount, _, _ = archivedHistory(t, db, deleted)
+	assert.Equal(t, 0, newCount)
+	_, err = db.Get(deleted)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// rewritten log files are sealed with footers, and recovered the same
+	report, err := db.Verify()
+	assert.Nil(t, err)
+	assert.Empty(t, report.Corrupted)
+	assert.Equal(t, report.Files, report.ByFooter)
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	val, err = db.Get(hot)
+	assert.Nil(t, err)
+	assert.Equal(t, want, val)
+	_, err = db.Get(deleted)
+	assert.Equal(t, ErrKeyNotFound, err)
+	for key, want := range others {
+		val, err = db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, want, val)
+	}
+}
@@ -3,6 +3,7 @@ package lazydb
 import (
 	"github.com/billsjc123/LazyDB/ds"
 	"github.com/billsjc123/LazyDB/logfile"
+	"math/rand"
 	"time"
 )
 
@@ -12,12 +13,31 @@ const (
 	defaultIOType               logfile.IOType = logfile.FileIO
 )
 
+// IndexUpdateMode represents when the index is updated after an entry is written into the log file.
+type IndexUpdateMode uint8
+
+const (
+	// IndexUpdateAfterWrite updates the index right after the entry is written into the log file without fsync.
+	// Writes are visible immediately, but visible writes may be lost if the machine crashes before they are synced.
+	IndexUpdateAfterWrite IndexUpdateMode = iota
+	// IndexUpdateAfterSync updates the index only after the entry is synced into stable storage.
+	// Visible writes always survive a crash, but every write costs a fsync.
+	IndexUpdateAfterSync
+)
+
 type DBConfig struct {
 	DBPath               string        // Directory path for storing log files on disk.
 	HashIndexShardCount  int64         // default 32
 	MaxLogFileSize       int64         // Max capacity of a log file.
 	LogFileMergeInterval time.Duration // Max time interval for merging log files.
 
+	// MaxLogFileAge makes the active log file archived once it is older than MaxLogFileAge, even if it is not full,
+	// so that every archived log file holds entries of a bounded span of time, e.g. for merging or backing up log
+	// files older than an hour. It is checked by writes, an idle active log file is archived by the next write into it.
+	// The age of an active log file reopened by opening the db counts from the opening. Disabled if it is not positive,
+	// default value is 0.
+	MaxLogFileAge time.Duration
+
 	//  IOType
 	//  Only support FileIO at the moment
 	IOType logfile.IOType
@@ -32,6 +52,308 @@ type DBConfig struct {
 	// The recommended ratio is 0.5, half of the file can be compacted.
 	// Default value is 0.5.
 	LogFileGCRatio float64
+
+	// MaxOpenFiles limits the number of archived log files that are kept open at the same time.
+	// Least recently used archived files will be closed, and reopened lazily when they are accessed again.
+	// Active log files are always open and not counted.
+	// No limitation if it is not a positive number, default value is 0.
+	MaxOpenFiles int
+
+	// ValueCacheSize max total size in bytes of values of type String kept in memory after they are read by Get,
+	// so that repeated reads of hot keys do not hit the log files. Least recently read values are dropped first.
+	// Disabled if it is not a positive number, default value is 0.
+	ValueCacheSize int64
+
+	// RandSource the source of randomness of SRandMember, HRandField and ZRandMember, so that their samples are
+	// reproducible with a seeded source, e.g. in property tests. It is not required to be safe for concurrent use.
+	// A time-seeded source is used if it is nil, default value is nil.
+	RandSource rand.Source
+
+	// ActiveExpireInterval interval of the background goroutine which removes expired keys of type String.
+	// Expired keys are still removed lazily when they are read if active expire is disabled.
+	// Disabled if it is not a positive number, default value is 0. It can be turned on or off at runtime by SetActiveExpire.
+	ActiveExpireInterval time.Duration
+
+	// TrackAccess counts accesses of every key of type String when it is on, see HotKeys.
+	// Counters are approximate and will be reset on restart.
+	TrackAccess bool
+
+	// StartFid the fid of the first log file of each type, fid 0 is reserved. Default value is 1.
+	// FidIncrement the difference between fids of two successive log files. Default value is 1.
+	// They can be used to pre-assign fid ranges in sharded deployments, so that data directories can be merged without collisions.
+	StartFid     uint32
+	FidIncrement uint32
+
+	// IndexUpdateMode decides whether the index is updated before or after a written entry is synced.
+	// Default value is IndexUpdateAfterWrite.
+	IndexUpdateMode IndexUpdateMode
+
+	// SkipDuplicateWrites makes Set skip writing if the key already holds the same value without time to live.
+	// It saves space of log files for idempotent upserts, at the cost of reading the current value on every Set.
+	SkipDuplicateWrites bool
+
+	// InPlaceUpdates makes Set and IncrBy overwrite the entry of a key of type String in place rather than appending
+	// a new one, if the key is in the active log file without time to live, and the new entry has the same size.
+	// It saves space of log files and merges for fixed-size values updated frequently, e.g. counters. Each overwrite
+	// is recorded in a journal synced before overwriting, so that an overwrite interrupted by a crash is redone on
+	// opening, which makes an overwrite slower than appending without syncing.
+	// Overwritten entries are not seen by Tail, and files sealed while it is on have no footer. Entries are appended
+	// rather than overwritten while a Snapshot is open. It is ignored with ValueCacheSize or InternValues.
+	InPlaceUpdates bool
+
+	// NXConflictError makes SetNX, MSetNX and HSetNX return ErrKeyExists rather than nil if nothing is written
+	// because the key or field already exists, so that callers racing for the same key can tell which one wins.
+	NXConflictError bool
+
+	// WrongTypeError makes getters of a type return ErrWrongType naming the type held by the key rather than
+	// ErrKeyNotFound or an empty result, if the key holds no value of the type but values of other types, like
+	// WRONGTYPE of Redis. It applies to every getter of a single type reading a key, e.g. Get, StrLen, HGet, HLen,
+	// LRange, SIsMember and ZRange, and the type is checked under the same lock as the read.
+	// A key may hold values of more than one type, it is not an error then.
+	WrongTypeError bool
+
+	// RecoveryConcurrency max number of log files read at the same time when building indexes on opening.
+	// Entries are still applied in order of fid, so that newer entries win.
+	// Log files of different types are read concurrently, but files of the same type are read one by one
+	// if it is not a positive number, default value is 0.
+	RecoveryConcurrency int
+
+	// DefaultTTL is the time to live of keys of type String written without an explicit one, see WriteOptions.
+	// It turns the db into a cache whose keys expire by default. It does not apply to other types, hashes, sets
+	// and lists expire as a whole by ExpireCollection or CollectionWriteOptions.
+	// Keys never expire by default if it is not a positive number, default value is 0.
+	DefaultTTL time.Duration
+
+	// BlockAlign pads every log entry to a multiple of BlockAlign bytes, e.g. 512, so that entries start at
+	// block boundaries, and reading an entry touches as few blocks as possible. It trades space for read speed.
+	// It must not be changed for existing log files. No padding if it is not a positive number, default value is 0.
+	BlockAlign int64
+
+	// RecoveryCheckpointInterval saves the index built so far into a checkpoint file every RecoveryCheckpointInterval
+	// archived log files of a type are replayed when building indexes on opening, so that opening again after
+	// a crash during recovery resumes from the last checkpoint rather than replaying all log files.
+	// Checkpoints are removed once recovery finishes. Disabled if it is not a positive number, default value is 0.
+	RecoveryCheckpointInterval int
+
+	// CheckpointInterval saves the indexes of type String, Hash and custom types into checkpoint files every
+	// CheckpointInterval in background, so that opening builds them from the checkpoints and replays only entries
+	// written after, rather than all log files. Checkpoints are written into temporary files and renamed, and are
+	// kept after opening. A checkpoint is ignored if log files covered by it have been merged since it was taken.
+	// They are saved again by Close, and removed on opening if the db was not closed cleanly, see LazyDB.Close.
+	// It is ignored with InternValues. Disabled if it is not a positive number, default value is 0.
+	CheckpointInterval time.Duration
+
+	// RecoveryFilter skips building index entries of keys for which it returns false when building indexes on
+	// opening, so that opening is faster when only a subset of keys is needed, e.g. keys with a prefix.
+	// The key of a hash is passed for its fields. Skipped keys remain in log files, but they can't be read, and
+	// they should not be written either. Since the indexes are partial, log files can't be rewritten by merge or
+	// compaction, which return ErrPartialIndex, and checkpoints are neither applied nor saved.
+	// All keys are indexed if it is nil, default value is nil.
+	RecoveryFilter func(key []byte, typ valueType) bool
+
+	// RecoveryProgress is called when building indexes on opening, once before log files of a type are read
+	// and once after each of them is read, with the numbers of files and bytes of the type read so far.
+	// Bytes are sizes of log files on disk. Types are recovered concurrently, so it may be called concurrently,
+	// and it should return quickly without calling the db. Nothing is reported if it is nil, default value is nil.
+	RecoveryProgress func(typ valueType, filesDone, filesTotal int, bytesDone, bytesTotal int64)
+
+	// MaxMemory limits the estimated memory of indexes in bytes, see IndexMemoryUsage. Once it is exceeded,
+	// writes of type String evict keys by EvictionPolicy before writing, so that the db works as a bounded cache.
+	// No limitation if it is not a positive number, default value is 0.
+	MaxMemory int64
+
+	// EvictionPolicy decides which keys are evicted once MaxMemory is exceeded. Default value is NoEviction.
+	EvictionPolicy EvictionPolicy
+
+	// LRUSamples makes AllKeysLRU evict the coldest of LRUSamples keys picked at random rather than the coldest
+	// of all keys, like maxmemory-samples of Redis, so that picking a key to evict does not walk and sort all keys.
+	// Keys are picked from a list of keys taken by walking the index, which is taken again once it gets stale,
+	// so keys written since then are not picked for a while. AllKeysLRU evicts the coldest of all keys
+	// if it is not a positive number, default value is 0.
+	LRUSamples int
+
+	// NoSyncDir skips fsync of DBPath after a new log file is created. By default the directory is synced,
+	// otherwise a crash may lose the new log file along with its synced entries, since its directory entry
+	// is not durable. It can be turned on for tests or file systems in memory, where durability does not matter.
+	NoSyncDir bool
+
+	// ChecksumType the algorithm of check sums of written entries, logfile.ChecksumNone, logfile.ChecksumCRC32
+	// or logfile.ChecksumXXHash, see BenchmarkWriteLogEntry. The algorithm is recorded in every entry,
+	// so it can be changed for existing log files. Default value is logfile.ChecksumCRC32.
+	ChecksumType logfile.ChecksumType
+
+	// PersistStats saves the counters of Stats into a stats file in DBPath on Close, and loads them on opening,
+	// so that they are counted over the lifetime of the db rather than since it is opened.
+	// Counters start from zero if the stats file is missing or corrupt.
+	// StatsPersistInterval also saves them every StatsPersistInterval if it is positive, so that a crash loses
+	// at most one interval of counts. Only saved on Close if it is not positive, default value is 0.
+	PersistStats         bool
+	StatsPersistInterval time.Duration
+
+	// KeyComparator orders keys returned by ScanAll, Scan and DumpAll, e.g. to sort "key10" after "key2".
+	// It returns a negative number if a is less than b, zero if they are equal and a positive number otherwise,
+	// like bytes.Compare. Indexes are always ordered by bytes, so a custom order costs a sort of the results.
+	// Keys are ordered by bytes if it is nil, default value is nil.
+	KeyComparator func(a, b []byte) int
+
+	// CollectionCodec packs the key of a hash or a sorted set and the field or member of an element into the key of
+	// its log entries, e.g. a more compact format to shrink small elements. Entries are packed by two varint lengths,
+	// the key and the subKey if it is nil. Log files written with one codec can't be read with another, so it must not
+	// change once the db holds hashes or sorted sets. Lists and sets are packed on their own, default value is nil.
+	CollectionCodec CollectionCodec
+
+	// SkipCorruptFiles makes opening skip log files that can't be opened or read rather than failing, so that
+	// a partially damaged db can be salvaged. Entries of a log file before the first unreadable one are recovered.
+	// Skipped log files are logged and reported by RecoveryReport, and those which can't be opened are left on disk untouched.
+	SkipCorruptFiles bool
+
+	// RepairDuplicateFids makes opening rename log files which share a fid with others in the same type, e.g. left by
+	// a botched copy, with new fids rather than failing with ErrDuplicateFid. The least recently modified file keeps
+	// the fid, entries of the renamed ones win over it. Renamed log files are reported by RecoveryReport.
+	RepairDuplicateFids bool
+
+	// RecoverLatestFiles makes opening recover only the latest RecoverLatestFiles log files of each type, and ignore
+	// the older ones entirely, so that a large db used as a cache opens quickly. All keys whose latest entries are
+	// in the older log files are LOST, including keys never written since, and keys deleted by tombstones in them
+	// may come back from the older files if they are recovered by a later opening without it. The older log files are
+	// left on disk and reported by RecoveryReport, or removed if RemoveUnrecoveredFiles is on.
+	// Checkpoints are not applied while it is on. All log files are recovered if it is not a positive number,
+	// default value is 0.
+	RecoverLatestFiles     int
+	RemoveUnrecoveredFiles bool
+
+	// IndexLog appends a small record of every entry written, holding its key, position and time to live but not
+	// its value, to an index log alongside its log file, e.g. "INDEX.log.strs.0000000001". Opening builds indexes
+	// from index logs rather than reading whole log files, and only replays entries written after the last record.
+	// It is a middle ground between replaying log files and recovery checkpoints: records cost a small write for
+	// every entry, and are not synced with entries, since missing ones are rebuilt from log files on opening.
+	// Index logs are removed along with their log files by merge. Opening with it off removes all index logs.
+	IndexLog bool
+
+	// VersionedEntries stamps a monotonic version into every written entry, which is the current time in unix nanoseconds
+	// unless the clock goes backwards. Indexes built on opening keep the entry of the highest version of every key,
+	// rather than the last one in order of log files, and ApplyEntry ignores entries older than the indexed ones,
+	// so that the last writer wins even if entries are replicated or merged out of order.
+	// Versions are not kept in recovery checkpoints, entries replayed after a checkpoint win over the checkpointed ones.
+	// Versioned entries are 1~10 bytes larger. It can be changed for existing log files, unversioned entries are older
+	// than versioned ones.
+	VersionedEntries bool
+
+	// RecordTimestamps stamps the time of writing into every written entry, so that when a key was written last
+	// can be told by ObjectInfo. Entries rewritten by merge or applied from a leader keep their timestamps.
+	// Timestamped entries are about 7 bytes larger. It can be changed for existing log files,
+	// entries written while it is off have no timestamp.
+	RecordTimestamps bool
+
+	// RecoveryReadRepair makes the index of hashes built on opening keep the entry of every field written last by
+	// the timestamps of RecordTimestamps, rather than the last one in order of log files. So that a stale entry
+	// replayed after a newer one, e.g. left in a log file between a newer entry and the older file it is merged into
+	// by MergeInto, is discarded. Entries written at the same millisecond, and entries of packed hashes, are resolved
+	// by the order they are replayed. Entries without timestamps are older than timestamped ones, so it has no effect
+	// unless RecordTimestamps is on, and log files written while it was off may lose newer entries.
+	// It is ignored with VersionedEntries, which resolves entries by versions, default value is false.
+	RecoveryReadRepair bool
+
+	// TombstoneGracePeriod keeps delete entries in log files through merges until they are older than the period,
+	// and have been acknowledged by all followers reporting by AckReplica. So that a follower lagging behind still
+	// reads the deletes by Tail, rather than keeping keys deleted on this db forever.
+	// Delete entries are timestamped if it is positive, those written while it is not have no timestamp and are
+	// only kept until acknowledged. Default value is 0, delete entries are dropped by the first merge.
+	TombstoneGracePeriod time.Duration
+
+	// InternValues makes Set store values of type String larger than 64 bytes only once, identified by their
+	// SHA-256 hash, and keys holding the same value reference it by the hash. It saves space of log files when many
+	// keys share identical large values. An interned value is reclaimed by merge once no key references it.
+	// It can be changed for existing log files, values written while it is off are not interned.
+	// Recovery checkpoints are not written or applied while it is on, see RecoveryCheckpointInterval.
+	InternValues bool
+
+	// Thresholds of small collections reported by Encoding, which are the max number of elements, and the max size
+	// in bytes of fields, values or members. They are the same as Redis, and default values of Redis are used if they are
+	// not positive: 128 and 64 for hashes, sets and sorted sets, 512 for sets of integers and 128 for lists.
+	// Collections within them are also packed if PackSmallHashes, PackSmallSets or PackSmallZSets is on,
+	// SetMaxListpackEntries and SetMaxListpackValue only decide packing of sets.
+	HashMaxListpackEntries int
+	HashMaxListpackValue   int
+	SetMaxIntsetEntries    int
+	SetMaxListpackEntries  int
+	SetMaxListpackValue    int
+	ZSetMaxListpackEntries int
+	ZSetMaxListpackValue   int
+	ListMaxListpackSize    int
+
+	// PackSmallHashes writes all fields and values of a small hash into a single packed entry, which is rewritten
+	// on every write of the hash, rather than an entry for each field. It saves space of headers and stale entries
+	// of small hashes at the cost of rewriting the whole hash. A hash is converted into entries for each field once it
+	// exceeds HashMaxListpackEntries or HashMaxListpackValue, and is not packed again until it is emptied.
+	// It can be changed for existing log files, packed hashes are read and written as normal ones if it is off.
+	PackSmallHashes bool
+
+	// PackSmallSets and PackSmallZSets are like PackSmallHashes, but pack members of a small set within
+	// SetMaxListpackEntries and SetMaxListpackValue, and members and scores of a small sorted set within
+	// ZSetMaxListpackEntries and ZSetMaxListpackValue.
+	PackSmallSets  bool
+	PackSmallZSets bool
+
+	// MaxHashFields, MaxSetMembers and MaxListLength limit the number of elements of a single hash, set or list,
+	// writes which would exceed them return ErrCollectionTooLarge without writing anything, so that a collection
+	// can't grow unbounded. They are checked against the number of elements kept by the index,
+	// or the length kept by the meta of a list.
+	// No limitation if it is not a positive number, default value is 0.
+	MaxHashFields int
+	MaxSetMembers int
+	MaxListLength int
+
+	// MaxKeySize limits the size of keys in bytes, writes of larger keys return ErrKeyTooLarge without writing anything.
+	// Fields of hashes and members of sorted sets are limited along with their keys they are encoded with,
+	// and elements of lists with the 4 bytes of their seqs. Keys already written are still read, deleted and merged.
+	// No limitation if it is not a positive number, default value is 0.
+	MaxKeySize int
+
+	// TxTimeout rolls back transactions which have been idle, i.e. begun or buffered no write, for longer than it
+	// by a background goroutine, so that abandoned transactions do not hold the lock of db and buffered writes forever.
+	// Transactions being committed are never rolled back, and Commit of a rolled back one returns ErrTxClosed.
+	// Disabled if it is not a positive number, default value is 0.
+	TxTimeout time.Duration
+
+	// SyncCommits has no effect any more, entries and the commit marker of a transaction are always synced into
+	// stable storage before its writes become visible, see Tx.Exec.
+	// CommitSyncWindow makes commits being synced within the window share a single fsync of each log file rather than
+	// syncing one by one, which trades a little latency of each commit for throughput of concurrent commits of
+	// different types, commits writing the same type wait for each other. Each commit is synced alone if it is not
+	// positive, default value is 0.
+	SyncCommits      bool
+	CommitSyncWindow time.Duration
+
+	// AutoSyncInterval syncs active log files of all types into stable storage every AutoSyncInterval in background,
+	// so that a crash loses at most the writes of the last interval, without the cost of syncing every write.
+	// Disabled if it is not a positive number, default value is 0.
+	AutoSyncInterval time.Duration
+
+	// AutoMerge merges archived log files of all types whose ratio of stale data exceeds LogFileGCRatio every
+	// LogFileMergeInterval in background, like Maintenance with Merge. Log files must not be merged by Merge,
+	// StepMerge or Maintenance meanwhile. Default value is false.
+	AutoMerge bool
+
+	// MergeSchedule restricts AutoMerge to a daily window, so that merging does not compete with the traffic of
+	// business hours. Ticks of AutoMerge outside the window are skipped, and stale data keeps piling up until the
+	// window opens. AutoMerge runs at any time if it is nil, default value is nil.
+	MergeSchedule *MergeWindow
+
+	// LazyFreeQueueSize max number of large keys removed by Unlink waiting for the background goroutine to write
+	// their tombstones. Unlink blocks once the queue is full, so that deleting faster than cleaning up does not
+	// grow it unbounded. Keys with at most 64 entries are cleaned up by Unlink itself.
+	// Default value is 128 if it is not a positive number.
+	LazyFreeQueueSize int
+
+	// AccessControl is called with the key and the kind of access before every public operation on keys, including
+	// every key of operations on multiple keys, and writes of WriteBatch and Tx when they are committed.
+	// An operation is aborted with the error returned by it, and returns zero values if it returns no error.
+	// It is called outside index locks, so it must be cheap and must not call back into db. It may be called more than once
+	// for a key by operations built on others, e.g. GetAny and Sort.
+	// Operations enumerating keys, e.g. Scan, ScanAll and ScanMatchType, maintenance and ApplyEntry are not checked.
+	// Nothing is checked if it is nil, default value is nil.
+	AccessControl func(op Operation, key []byte) error
 }
 
 func DefaultDBConfig(path string) DBConfig {
@@ -43,5 +365,7 @@ func DefaultDBConfig(path string) DBConfig {
 		IOType:               defaultIOType,
 		DiscardBufferSize:    8 << 20,
 		LogFileGCRatio:       0.5,
+		StartFid:             1,
+		FidIncrement:         1,
 	}
 }
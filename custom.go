@@ -0,0 +1,208 @@
+package lazydb
+
+import (
+	"errors"
+	"github.com/billsjc123/LazyDB/ds"
+	"github.com/billsjc123/LazyDB/logfile"
+	"path"
+	"sort"
+)
+
+var (
+	ErrTypeRegistered    = errors.New("value type has been registered")
+	ErrTypeNotRegistered = errors.New("value type is not registered")
+)
+
+// TypeCodec encodes and decodes values of a custom value type, see RegisterType.
+type TypeCodec interface {
+	Encode(value interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+// customType a value type registered by RegisterType, every key holds a single encoded value like String.
+type customType struct {
+	name  string
+	codec TypeCodec
+	index *strIndex
+}
+
+// RegisterType registers a custom value type named name beyond the built-in ones, and returns its value type.
+// Values of the type are encoded by codec and written into their own log files named like "log.name.00000001",
+// which are recovered on registering and can be merged like other types, see SetCustom and GetCustom.
+//
+// Types must be registered again with the same name every time the db is opened, log files of unregistered types
+// are left untouched. The value type of a name may differ between processes, so do not persist it.
+// RegisterType must not be called concurrently with other operations, register types right after opening the db.
+func (db *LazyDB) RegisterType(name string, codec TypeCodec) (valueType, error) {
+	if codec == nil {
+		return 0, ErrInvalidParam
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.IsClosed() {
+		return 0, ErrDatabaseClosed
+	}
+
+	ftype, err := logfile.RegisterFType(name)
+	if err != nil {
+		return 0, err
+	}
+	typ := valueType(ftype)
+	if typ < logFileTypeNum || db.customTypes[typ] != nil {
+		return 0, ErrTypeRegistered
+	}
+
+	if !db.readOnly() {
+		prefix, _ := logfile.FileNamePrefix(ftype)
+		d, err := newDiscard(path.Join(db.cfg.DBPath, discardFilePath), prefix+discardFileName, db.cfg.DiscardBufferSize)
+		if err != nil {
+			return 0, err
+		}
+		db.discardsMap[typ] = d
+	}
+	db.fidsMap[typ] = &MutexFids{fids: make([]uint32, 0)}
+	db.archivedLogFile[typ] = ds.NewWithCustomShardingFunction[uint32](ds.DefaultShardCount, ds.SimpleSharding)
+	if db.customTypes == nil {
+		db.customTypes = make(map[valueType]*customType)
+	}
+	db.customTypes[typ] = &customType{name: name, codec: codec, index: newStrIndex()}
+
+	// recover existing log files of the type
+	fids, err := db.scanLogFiles()
+	if err != nil {
+		return 0, err
+	}
+	db.fidsMap[typ].fids = fids[typ]
+	if err = db.openLogFilesOfType(typ); err != nil {
+		return 0, err
+	}
+	var sem chan struct{}
+	if db.cfg.RecoveryConcurrency > 0 {
+		sem = make(chan struct{}, db.cfg.RecoveryConcurrency)
+	}
+	if err = db.buildIndexOfType(typ, sem); err != nil {
+		return 0, err
+	}
+	if err = db.removeCheckpoints(); err != nil {
+		return 0, err
+	}
+	return typ, nil
+}
+
+// valueTypes returns built-in value types and registered custom types in order.
+func (db *LazyDB) valueTypes() []valueType {
+	types := make([]valueType, 0, logFileTypeNum+len(db.customTypes))
+	for typ := valueType(0); typ < logFileTypeNum; typ++ {
+		types = append(types, typ)
+	}
+	custom := make([]valueType, 0, len(db.customTypes))
+	for typ := range db.customTypes {
+		custom = append(custom, typ)
+	}
+	sort.Slice(custom, func(i, j int) bool {
+		return custom[i] < custom[j]
+	})
+	return append(types, custom...)
+}
+
+// getCustomType returns the registered custom type, nil if typ is not registered.
+func (db *LazyDB) getCustomType(typ valueType) *customType {
+	return db.customTypes[typ]
+}
+
+// SetCustom sets key to hold the value of the custom type typ, the value is encoded by codec of the type.
+func (db *LazyDB) SetCustom(typ valueType, key []byte, value interface{}) error {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return err
+	}
+	ct := db.getCustomType(typ)
+	if ct == nil {
+		return ErrTypeNotRegistered
+	}
+	data, err := ct.codec.Encode(value)
+	if err != nil {
+		return err
+	}
+
+	ct.index.mu.Lock()
+	defer ct.index.mu.Unlock()
+
+	entry := &logfile.LogEntry{Key: key, Value: data}
+	valuePos, err := db.writeLogEntry(typ, entry)
+	if err != nil {
+		return err
+	}
+	return db.updateIndexTree(typ, ct.index.idxTree, entry, valuePos, true)
+}
+
+// GetCustom gets the value of key of the custom type typ, decoded by codec of the type.
+// If the key does not exist the error ErrKeyNotFound is returned.
+func (db *LazyDB) GetCustom(typ valueType, key []byte) (interface{}, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
+	ct := db.getCustomType(typ)
+	if ct == nil {
+		return nil, ErrTypeNotRegistered
+	}
+
+	ct.index.mu.RLock()
+	data, err := db.getValue(ct.index.idxTree, key, typ)
+	ct.index.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return ct.codec.Decode(data)
+}
+
+// DeleteCustom deletes key of the custom type typ.
+func (db *LazyDB) DeleteCustom(typ valueType, key []byte) error {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return err
+	}
+	ct := db.getCustomType(typ)
+	if ct == nil {
+		return ErrTypeNotRegistered
+	}
+
+	ct.index.mu.Lock()
+	defer ct.index.mu.Unlock()
+
+	entry := &logfile.LogEntry{Key: key, Stat: logfile.SDelete}
+	pos, err := db.writeLogEntry(typ, entry)
+	if err != nil {
+		return err
+	}
+	delVal, updated := ct.index.idxTree.Delete(key)
+	db.sendDiscard(delVal, updated, typ)
+	// also merge the delete entry
+	size := db.entrySize(entry)
+	return db.sendDiscard(&Value{fid: pos.fid, entrySize: size}, true, typ)
+}
+
+// buildCustomIndex builds index of the custom type from the entry during recovery.
+func (db *LazyDB) buildCustomIndex(typ valueType, ct *customType, entry *logfile.LogEntry, vPos *ValuePos) {
+	if entry.Stat == logfile.SDelete {
+		ct.index.idxTree.Delete(entry.Key)
+		return
+	}
+	idxNode := &Value{vType: typ, fid: vPos.fid, offset: vPos.offset, entrySize: vPos.entrySize,
+		version: entry.Version, writtenAt: entry.WrittenAt}
+	if entry.ExpiredAt != 0 {
+		idxNode.expiredAt = expiredAtMilli(entry.ExpiredAt)
+	}
+	ct.index.idxTree.Put(entry.Key, idxNode)
+}
+
+// mergeCustom rewrites the entry of the custom type if it is still live.
+func (db *LazyDB) mergeCustom(typ valueType, fid uint32, offset int64, ent *logfile.LogEntry) error {
+	ct := db.getCustomType(typ)
+	if ct == nil {
+		return ErrTypeNotRegistered
+	}
+	ct.index.mu.Lock()
+	defer ct.index.mu.Unlock()
+	return db.rewriteLiveEntry(typ, fid, offset, ent, func(ent *logfile.LogEntry) (*ValuePos, error) {
+		return db.rewriteLogEntry(typ, ent)
+	})
+}
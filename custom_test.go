@@ -0,0 +1,110 @@
+package lazydb
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pointCodec encodes [2]int64 points of a custom type.
+type pointCodec struct{}
+
+func (pointCodec) Encode(value interface{}) ([]byte, error) {
+	p, ok := value.([2]int64)
+	if !ok {
+		return nil, errors.New("not a point")
+	}
+	buf := make([]byte, 16)
+	binary.LittleEndian.PutUint64(buf, uint64(p[0]))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(p[1]))
+	return buf, nil
+}
+
+func (pointCodec) Decode(data []byte) (interface{}, error) {
+	if len(data) != 16 {
+		return nil, errors.New("not a point")
+	}
+	return [2]int64{int64(binary.LittleEndian.Uint64(data)), int64(binary.LittleEndian.Uint64(data[8:]))}, nil
+}
+
+func TestLazyDB_RegisterType(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_register_type")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 500
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	_, err = db.RegisterType("strs", pointCodec{})
+	assert.Equal(t, ErrTypeRegistered, err)
+	_, err = db.RegisterType("bad.name", pointCodec{})
+	assert.NotNil(t, err)
+
+	typ, err := db.RegisterType("point", pointCodec{})
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, int(typ), logFileTypeNum)
+	_, err = db.RegisterType("point", pointCodec{})
+	assert.Equal(t, ErrTypeRegistered, err)
+
+	assert.Nil(t, db.SetCustom(typ, GetKey(1), [2]int64{1, 2}))
+	assert.NotNil(t, db.SetCustom(typ, GetKey(1), "not a point"))
+	val, err := db.GetCustom(typ, GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, [2]int64{1, 2}, val)
+	_, err = db.GetCustom(typ, GetKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	// keys of different types do not collide
+	_, err = db.Get(GetKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.GetCustom(typ+1, GetKey(1))
+	assert.Equal(t, ErrTypeNotRegistered, err)
+
+	// fill several log files, only the last write of each key is live
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.SetCustom(typ, GetKey(i%5), [2]int64{int64(i), int64(-i)}))
+	}
+	assert.Nil(t, db.DeleteCustom(typ, GetKey(4)))
+	assert.Greater(t, db.archivedLogFile[typ].Size(), 1)
+
+	check := func(db *LazyDB) {
+		for i := 0; i < 4; i++ {
+			val, err := db.GetCustom(typ, GetKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, [2]int64{int64(45 + i), int64(-45 - i)}, val)
+		}
+		_, err := db.GetCustom(typ, GetKey(4))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	check(db)
+
+	// survives reopen
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	// log files of unregistered types are left untouched
+	_, err = db.GetCustom(typ, GetKey(1))
+	assert.Equal(t, ErrTypeNotRegistered, err)
+	_, err = db.Get(GetKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	typ, err = db.RegisterType("point", pointCodec{})
+	assert.Nil(t, err)
+	check(db)
+
+	// participates in merge
+	fid := db.fidsMap[typ].fids[0]
+	assert.Eventually(t, func() bool {
+		ccl, err := db.discardsMap[typ].getCCL(db.getActiveLogFile(typ).lf.Fid, 0)
+		return err == nil && len(ccl) > 0 && ccl[0] == fid
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, db.Merge(typ, fid, 0))
+	assert.Nil(t, db.getArchivedLogFile(typ, fid))
+	check(db)
+}
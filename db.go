@@ -1,12 +1,15 @@
 package lazydb
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"github.com/billsjc123/LazyDB/ds"
 	"github.com/billsjc123/LazyDB/logfile"
 	"github.com/billsjc123/LazyDB/util"
 	"io"
+	"io/fs"
 	"log"
 	"math"
 	"os"
@@ -15,13 +18,14 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type (
 	LazyDB struct {
 		cfg              *DBConfig
-		index            *ds.ConcurrentMap[string]
+		index            *ds.ConcurrentMap[string] // key -> keyEntry, the types of every key, see keyEntry
 		strIndex         *strIndex
 		hashIndex        *hashIndex
 		listIndex        *listIndex
@@ -31,17 +35,70 @@ type (
 		fidsMap          map[valueType]*MutexFids
 		activeLogFileMap map[valueType]*MutexLogFile
 		archivedLogFile  map[valueType]*ds.ConcurrentMap[uint32] // [uint32]*MutexLogFile
+		fileCache        *logFileCache
+		valueCache       *valueCache
+		clock            func() time.Time // returns current time, time.Now is used if nil
+		expirySubs       *subscribers[[]byte]
+		evictionSubs     *subscribers[EvictionEvent]
+		closeCh          chan struct{}              // closed when db is closing, to stop background goroutines
+		fsys             fs.FS                      // not nil if db is opened by OpenFS, db is read-only then
+		listInitSeq      uint32                     // head seq of an empty list, initialListSeq is used if 0. Only changed in tests
+		bgWg             sync.WaitGroup             // wait for background goroutines to exit
+		keyLocks         [keyLockStripes]sync.Mutex // see Lock
+		customTypes      map[valueType]*customType  // registered by RegisterType
+		stats            Stats                      // updated atomically, see Stats
+		replica          replicaState               // see ApplyEntry
+		stepMerges       stepMergeCursors           // see StepMerge
+		recovery         recoveryState              // see RecoveryReport
+		activeExpireOff  int32                      // 1 if active expire is turned off by SetActiveExpire, accessed atomically
+		activeExpireOn   bool                       // whether the active expire goroutine has been started, protected by mu
+		lastVersion      uint64                     // the greatest version of entries, accessed atomically, see DBConfig.VersionedEntries
+		fileRefs         logFileRefs                // see acquireLogFile
+		txs              txRegistry                 // see ActiveTransactions
+		lazyFreeCh       chan *unlinkedKey          // large keys removed by Unlink to be cleaned up in background
+		commitSyncer     commitSyncer               // see DBConfig.CommitSyncWindow
+		rand             lockedRand                 // see DBConfig.RandSource
+		txCommits        txCommitLog                // see Tx.Exec
+		inPlace          inPlaceJournal             // see DBConfig.InPlaceUpdates
+		snapshots        int32                      // number of open snapshots, accessed atomically, see Snapshot
 		mu               sync.RWMutex
 	}
 
 	MutexFids struct {
 		fids []uint32
 		mu   sync.RWMutex
+		// the greatest fid of log files removed by DropType, log files created later take fids after it
+		dropped uint32
 	}
 
 	MutexLogFile struct {
 		lf *logfile.LogFile
 		mu sync.RWMutex
+		// position of the last entry written since the db is opened, only kept for active log files, see WaitReplicas
+		last ValuePos
+		// footer of entries written into the active log file, nil if it is not created by this process,
+		// it is written when the log file is archived, see Verify
+		footer *logfile.Footer
+		// index log of the active log file, opened by the first record, see DBConfig.IndexLog
+		indexLog *os.File
+		// replaced by a rewritten log file of the same fid, so it is closed rather than deleted once retired
+		replaced bool
+		// when the active log file is created or opened, see DBConfig.MaxLogFileAge
+		createdAt time.Time
+	}
+
+	// logFileRefs counts in-flight reads of log files by type and fid, so that a log file removed by merge
+	// is deleted only after all reads of it finish, see acquireLogFile. The zero value is ready to use.
+	logFileRefs struct {
+		files sync.Map // logFileCacheKey -> *logFileRef
+	}
+
+	// logFileRef is the read count of a log file, which is changed atomically by reads,
+	// mu is only locked by retiring and deleting the file.
+	logFileRef struct {
+		refs    int64
+		mu      sync.Mutex
+		removed []*MutexLogFile // removed log files waiting for reads to finish, oldest first
 	}
 
 	valueType uint8
@@ -49,6 +106,11 @@ type (
 	strIndex struct {
 		mu      *sync.RWMutex
 		idxTree *ds.AdaptiveRadixTree
+		ttlTree *ds.AdaptiveRadixTree // keys with time to live ordered by expiredAt, see updateTTLIndex
+		// values shared by keys by their hashes, see DBConfig.InternValues
+		interned map[string]*internedValue
+		// keys picked from by DBConfig.LRUSamples, see sampleLRUKey
+		lruKeys [][]byte
 	}
 
 	hashIndex struct {
@@ -59,6 +121,9 @@ type (
 	listIndex struct {
 		mu    *sync.RWMutex
 		trees map[string]*ds.AdaptiveRadixTree
+		// waiters of BLPop and BRPop by list, each of them is signaled by pushes with mu locked
+		waiters map[string]map[chan struct{}]struct{}
+		closed  bool // set by Close with mu locked, to wake up waiters with ErrDatabaseClosed
 	}
 
 	setIndex struct {
@@ -69,16 +134,24 @@ type (
 
 	zSetIndex struct {
 		mu      *sync.RWMutex
+		cond    *sync.Cond // signaled by ZAdd with mu locked, see ZPopMinTimeout
 		indexes map[string]*ZSetIndex
 	}
 
 	Value struct {
 		value     []byte
 		vType     valueType
+		packed    bool // the element of a hash, set or sorted set is in a packed entry, see DBConfig.PackSmallHashes
 		fid       uint32
 		offset    int64
 		entrySize int
-		expiredAt int64
+		expiredAt int64 // unix milliseconds
+
+		accessCount uint64         // approximate access count, only used when DBConfig.TrackAccess is on
+		lastAccess  int64          // unix nanoseconds of the last read or write of a key of type String, not persisted
+		version     uint64         // version of the entry, see DBConfig.VersionedEntries
+		writtenAt   int64          // unix milliseconds of writing the entry, see DBConfig.RecordTimestamps
+		ref         *internedValue // the value of a key of type String is interned, see DBConfig.InternValues
 	}
 
 	// 写LogFile之后返回位置信息的结构体
@@ -101,19 +174,39 @@ const (
 	encodeHeaderSize = 10
 	discardFilePath  = "DISCARD"
 
+	// initialListSeq the headSeq of an empty list, whose tailSeq is initialListSeq+1. headSeq and tailSeq are the
+	// free seqs next to both ends, elements are at seqs between them exclusively. LPush writes at headSeq and
+	// decrements it, RPush writes at tailSeq and increments it, so the first elements pushed on either end of a new
+	// list never share a seq, whichever end comes first.
 	initialListSeq = uint32(math.MaxUint32 / 2)
+
+	// expiredAt smaller than this bound was written in unix seconds by older versions.
+	secondExpiredAtBound = int64(1e11)
 )
 
 var (
-	ErrKeyNotFound     = errors.New("key not found")
-	ErrLogFileNotExist = errors.New("log file is not exist")
-	ErrOpenLogFile     = errors.New("open Log file error")
-	ErrWrongIndex      = errors.New("index is out of range")
-	ErrDatabaseClosed  = errors.New("database is closed")
+	ErrKeyNotFound       = errors.New("key not found")
+	ErrLogFileNotExist   = errors.New("log file is not exist")
+	ErrOpenLogFile       = errors.New("open Log file error")
+	ErrWrongIndex        = errors.New("index is out of range")
+	ErrDatabaseClosed    = errors.New("database is closed")
+	ErrReadOnly          = errors.New("database is read-only")
+	ErrCorruptedEntry    = errors.New("log entry is corrupted")
+	ErrPartialIndex      = errors.New("index is partial, log files can't be rewritten")
+	ErrKeyExists         = errors.New("key already exists")
+	ErrDuplicateFid      = errors.New("log files of the same type share a fid")
+	ErrMergeVerification = errors.New("merged log file fails verification")
+	ErrDiskFull          = logfile.ErrDiskFull
+	// ErrWrongType is returned by getters of a type if the key holds values of other types only,
+	// see DBConfig.WrongTypeError. The returned error wraps it with the name of the type held by the key.
+	ErrWrongType = errors.New("operation against a key holding the wrong kind of value")
+
+	errLogFileFull = errors.New("log file is full")
 )
 
 func newStrIndex() *strIndex {
-	return &strIndex{idxTree: ds.NewART(), mu: new(sync.RWMutex)}
+	return &strIndex{idxTree: ds.NewART(), ttlTree: ds.NewART(), mu: new(sync.RWMutex),
+		interned: make(map[string]*internedValue)}
 }
 
 func newHashIndex() *hashIndex {
@@ -121,7 +214,11 @@ func newHashIndex() *hashIndex {
 }
 
 func newListIndex() *listIndex {
-	return &listIndex{trees: make(map[string]*ds.AdaptiveRadixTree), mu: new(sync.RWMutex)}
+	return &listIndex{
+		trees:   make(map[string]*ds.AdaptiveRadixTree),
+		mu:      new(sync.RWMutex),
+		waiters: make(map[string]map[chan struct{}]struct{}),
+	}
 }
 
 func newSetIndex() *setIndex {
@@ -133,8 +230,10 @@ func newSetIndex() *setIndex {
 }
 
 func newZSetIndex() *zSetIndex {
+	mu := new(sync.RWMutex)
 	return &zSetIndex{
-		mu:      new(sync.RWMutex),
+		mu:      mu,
+		cond:    sync.NewCond(mu),
 		indexes: make(map[string]*ZSetIndex),
 	}
 }
@@ -143,11 +242,145 @@ func Open(cfg DBConfig) (*LazyDB, error) {
 	// create the dir path if not exist
 	if !util.PathExist(cfg.DBPath) {
 		if err := os.MkdirAll(cfg.DBPath, os.ModePerm); err != nil {
-			log.Fatalf("Create db directory in %s error: %v", cfg.DBPath, err)
 			return nil, err
 		}
 	}
 
+	db := newLazyDB(cfg)
+
+	if err := db.initDiscard(); err != nil {
+		db.closeFailedOpen()
+		return nil, fmt.Errorf("init discard files: %w", err)
+	}
+
+	if err := db.loadTxCommits(); err != nil {
+		db.closeFailedOpen()
+		return nil, fmt.Errorf("load transaction commits: %w", err)
+	}
+
+	if err := db.prepareRecovery(); err != nil {
+		db.closeFailedOpen()
+		return nil, fmt.Errorf("check clean shutdown: %w", err)
+	}
+
+	if err := db.completeDrops(); err != nil {
+		db.closeFailedOpen()
+		return nil, fmt.Errorf("complete drops: %w", err)
+	}
+
+	if err := db.buildLogFiles(); err != nil {
+		db.closeFailedOpen()
+		return nil, fmt.Errorf("build log files: %w", err)
+	}
+
+	if err := db.removeIndexLogs(); err != nil {
+		db.closeFailedOpen()
+		return nil, fmt.Errorf("remove index logs: %w", err)
+	}
+
+	if err := db.loadInPlaceJournal(); err != nil {
+		db.closeFailedOpen()
+		return nil, fmt.Errorf("load in-place journal: %w", err)
+	}
+
+	if err := db.buildIndexFromLogFiles(); err != nil {
+		db.closeFailedOpen()
+		return nil, fmt.Errorf("build index from log files: %w", err)
+	}
+
+	if err := db.compactTxCommits(true); err != nil {
+		db.closeFailedOpen()
+		return nil, fmt.Errorf("compact transaction commits: %w", err)
+	}
+
+	if err := db.removeCleanShutdown(); err != nil {
+		db.closeFailedOpen()
+		return nil, fmt.Errorf("remove clean shutdown marker: %w", err)
+	}
+
+	if cfg.ActiveExpireInterval > 0 {
+		db.activeExpireOn = true
+		db.bgWg.Add(1)
+		go db.runActiveExpire(cfg.ActiveExpireInterval, db.closeCh)
+	}
+
+	if cfg.TxTimeout > 0 {
+		db.bgWg.Add(1)
+		go db.runTxReaper(cfg.TxTimeout, db.closeCh)
+	}
+
+	db.bgWg.Add(1)
+	go db.runLazyFree(db.closeCh)
+
+	if cfg.CheckpointInterval > 0 && db.checkpointAllowed() {
+		db.bgWg.Add(1)
+		go db.runCheckpoint(cfg.CheckpointInterval, db.closeCh)
+	}
+
+	if cfg.AutoSyncInterval > 0 {
+		db.bgWg.Add(1)
+		go db.runAutoSync(cfg.AutoSyncInterval, db.closeCh)
+	}
+
+	if cfg.AutoMerge && cfg.LogFileMergeInterval > 0 {
+		db.bgWg.Add(1)
+		go db.runAutoMerge(cfg.LogFileMergeInterval, db.closeCh)
+	}
+
+	if cfg.PersistStats {
+		db.loadStats()
+		if cfg.StatsPersistInterval > 0 {
+			db.bgWg.Add(1)
+			go db.runPersistStats(cfg.StatsPersistInterval, db.closeCh)
+		}
+	}
+
+	return db, nil
+}
+
+// closeFailedOpen closes files opened by Open before it fails, nothing is synced or written.
+func (db *LazyDB) closeFailedOpen() {
+	for _, mlf := range db.activeLogFileMap {
+		_ = mlf.closeIndexLog()
+		_ = mlf.lf.Close()
+	}
+	for typ, mutexFids := range db.fidsMap {
+		for _, fid := range mutexFids.fids {
+			if mlf := db.getArchivedLogFile(typ, fid); mlf != nil {
+				_ = mlf.lf.Close()
+			}
+		}
+	}
+	for _, dis := range db.discardsMap {
+		close(dis.valChan)
+	}
+	_ = db.txCommits.close()
+	_ = db.inPlace.close()
+}
+
+// OpenFS opens a read-only db whose log files are read from the root directory of fsys, e.g. an embed.FS,
+// so that an immutable dataset can be shipped inside a binary.
+// DBPath of cfg is ignored, and all write operations return ErrReadOnly.
+func OpenFS(fsys fs.FS, cfg DBConfig) (*LazyDB, error) {
+	db := newLazyDB(cfg)
+	db.fsys = fsys
+
+	if err := db.loadTxCommits(); err != nil {
+		return nil, err
+	}
+
+	if err := db.buildLogFiles(); err != nil {
+		return nil, err
+	}
+
+	if err := db.buildIndexFromLogFiles(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// newLazyDB creates a LazyDB with empty indexes and log files.
+func newLazyDB(cfg DBConfig) *LazyDB {
 	db := &LazyDB{
 		cfg:              &cfg,
 		index:            ds.NewConcurrentMap(int(cfg.HashIndexShardCount)),
@@ -159,29 +392,29 @@ func Open(cfg DBConfig) (*LazyDB, error) {
 		fidsMap:          make(map[valueType]*MutexFids),
 		activeLogFileMap: make(map[valueType]*MutexLogFile),
 		archivedLogFile:  make(map[valueType]*ds.ConcurrentMap[uint32]),
+		expirySubs:       newSubscribers[[]byte](),
+		evictionSubs:     newSubscribers[EvictionEvent](),
+		closeCh:          make(chan struct{}),
 	}
 
-	for i := 0; i < logFileTypeNum; i++ {
-		db.fidsMap[valueType(i)] = &MutexFids{fids: make([]uint32, 0)}
-		db.archivedLogFile[valueType(i)] = ds.NewWithCustomShardingFunction[uint32](ds.DefaultShardCount, ds.SimpleSharding)
+	lazyFreeQueueSize := cfg.LazyFreeQueueSize
+	if lazyFreeQueueSize <= 0 {
+		lazyFreeQueueSize = defaultLazyFreeQueueSize
 	}
+	db.lazyFreeCh = make(chan *unlinkedKey, lazyFreeQueueSize)
 
-	if err := db.initDiscard(); err != nil {
-		log.Fatalf("Init Discard Files error: %v", err)
-		return nil, err
+	if cfg.MaxOpenFiles > 0 {
+		db.fileCache = newLogFileCache(cfg.MaxOpenFiles)
 	}
-
-	if err := db.buildLogFiles(); err != nil {
-		log.Fatalf("Build Log Files error: %v", err)
-		return nil, err
+	if cfg.ValueCacheSize > 0 {
+		db.valueCache = newValueCache(cfg.ValueCacheSize)
 	}
 
-	if err := db.buildIndexFromLogFiles(); err != nil {
-		log.Fatalf("Build Index From Log Files error: %v", err)
-		return nil, err
+	for i := 0; i < logFileTypeNum; i++ {
+		db.fidsMap[valueType(i)] = &MutexFids{fids: make([]uint32, 0)}
+		db.archivedLogFile[valueType(i)] = ds.NewWithCustomShardingFunction[uint32](ds.DefaultShardCount, ds.SimpleSharding)
 	}
-
-	return db, nil
+	return db
 }
 
 // Sync flush the buffer into stable storage.
@@ -202,10 +435,87 @@ func (db *LazyDB) Sync() error {
 	return nil
 }
 
-// Close db
+// CurrentPositions returns the end of the active log file of each type, where the next entry is written.
+// Along with SyncUpTo, it captures a cut of log files which survives a crash without blocking writes,
+// e.g. for backup tools copying log files up to the positions. Types which have never been written are omitted.
+func (db *LazyDB) CurrentPositions() map[valueType]ValuePos {
+	positions := make(map[valueType]ValuePos)
+	for _, typ := range db.valueTypes() {
+		mlf := db.activeLogFileMap[typ]
+		if mlf == nil {
+			continue
+		}
+		mlf.mu.RLock()
+		positions[typ] = ValuePos{fid: mlf.lf.Fid, offset: mlf.lf.Offset}
+		mlf.mu.RUnlock()
+	}
+	return positions
+}
+
+// SyncUpTo makes entries written before positions returned by CurrentPositions durable. Only the active log file
+// of a type is synced if the position is in it, archived log files have been synced by rotating.
+// It returns ErrInvalidParam if a position is beyond the end of the active log file of its type.
+func (db *LazyDB) SyncUpTo(positions map[valueType]ValuePos) error {
+	if db.IsClosed() {
+		return ErrDatabaseClosed
+	}
+	for typ, pos := range positions {
+		mlf := db.activeLogFileMap[typ]
+		if mlf == nil {
+			return ErrInvalidParam
+		}
+		mlf.mu.Lock()
+		lf := mlf.lf
+		var err error
+		if pos.after(ValuePos{fid: lf.Fid, offset: lf.Offset}) {
+			err = ErrInvalidParam
+		} else if pos.fid == lf.Fid {
+			err = lf.Sync()
+		}
+		mlf.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close db. All log files and discard files are synced before they are closed, and the first error of syncing
+// is returned. Once everything is synced, a clean shutdown marker is written, so that the next opening trusts
+// the checkpoints saved by DBConfig.CheckpointInterval, which are saved again on closing. Opening a db without
+// the marker, e.g. after a crash, replays all log files instead, see RecoveryReport.CleanShutdown.
 func (db *LazyDB) Close() error {
+	// stop background goroutines
+	// background goroutines may be started by SetActiveExpire with mu locked
+	db.mu.Lock()
+	closeCh := db.closeCh
+	db.closeCh = nil
+	db.mu.Unlock()
+	if closeCh != nil {
+		close(closeCh)
+		db.bgWg.Wait()
+	}
+	db.wakeListWaiters()
+	if db.persistStatsEnabled() {
+		if err := db.saveStats(); err != nil {
+			log.Printf("persist stats err: %v", err)
+		}
+	}
+
+	if db.cfg.CheckpointInterval > 0 && db.checkpointAllowed() {
+		if err := db.saveCheckpoints(); err != nil {
+			log.Printf("save checkpoint err: %v", err)
+		}
+	}
+
+	var syncErr error
 	for _, mlf := range db.activeLogFileMap {
-		mlf.lf.Sync()
+		if err := mlf.lf.Sync(); err != nil && syncErr == nil {
+			syncErr = err
+		}
+		if err := mlf.closeIndexLog(); err != nil && syncErr == nil {
+			syncErr = err
+		}
 		err := mlf.lf.Close()
 		if err != nil {
 			log.Fatalf("Close log file err: %v", err)
@@ -217,15 +527,33 @@ func (db *LazyDB) Close() error {
 			if mlf == nil {
 				continue
 			}
-			mlf.lf.Sync()
+			if err := mlf.lf.Sync(); err != nil && syncErr == nil {
+				syncErr = err
+			}
 			err := mlf.lf.Close()
 			if err != nil {
 				log.Fatalf("Close archived log file err: %v", err)
 			}
 		}
 	}
+	for _, dis := range db.discardsMap {
+		if err := dis.sync(); err != nil && syncErr == nil {
+			syncErr = err
+		}
+	}
+	if err := db.txCommits.sync(); err != nil && syncErr == nil {
+		syncErr = err
+	}
+	if err := db.txCommits.close(); err != nil && syncErr == nil {
+		syncErr = err
+	}
+	if err := db.inPlace.close(); err != nil && syncErr == nil {
+		syncErr = err
+	}
+	if syncErr == nil && !db.readOnly() {
+		syncErr = db.writeCleanShutdown()
+	}
 
-	db.index = nil
 	db.fidsMap = nil
 	db.activeLogFileMap = nil
 	db.archivedLogFile = nil
@@ -233,17 +561,400 @@ func (db *LazyDB) Close() error {
 	for _, dis := range db.discardsMap {
 		close(dis.valChan)
 	}
-	return nil
+	return syncErr
 }
 
 func (db *LazyDB) IsClosed() bool {
 	return db.fidsMap == nil && db.activeLogFileMap == nil && db.archivedLogFile == nil
 }
 
+// GetAny looks up the key across indexes of all types, and returns its value along with its type.
+// Value will be []byte for String, map[string][]byte for Hash, [][]byte for List and Set, and []ZMember for ZSet.
+// Types are looked up in order of String, Hash, List, Set and ZSet, and the first one found is returned.
+// ErrKeyNotFound will be returned if the key does not exist in any type.
+// ErrWrongType of DBConfig.WrongTypeError is taken as the key not existing in the type.
+func (db *LazyDB) GetAny(key []byte) (interface{}, valueType, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, 0, err
+	}
+	val, err := db.Get(key)
+	if err == nil {
+		return val, valueTypeString, nil
+	}
+	if !errors.Is(err, ErrKeyNotFound) && !errors.Is(err, ErrWrongType) {
+		return nil, valueTypeString, err
+	}
+
+	pairs, err := db.HGetAll(key)
+	if err != nil && !errors.Is(err, ErrWrongType) {
+		return nil, valueTypeHash, err
+	}
+	if len(pairs) > 0 {
+		hash := make(map[string][]byte, len(pairs)/2)
+		for i := 0; i < len(pairs); i += 2 {
+			hash[string(pairs[i])] = pairs[i+1]
+		}
+		return hash, valueTypeHash, nil
+	}
+
+	n, err := db.LLen(key)
+	if err != nil && !errors.Is(err, ErrWrongType) {
+		return nil, valueTypeList, err
+	}
+	if n > 0 {
+		values, err := db.LRange(key, 0, -1)
+		if err != nil {
+			return nil, valueTypeList, err
+		}
+		return values, valueTypeList, nil
+	}
+
+	members, err := db.SMembers(key)
+	if err != nil && !errors.Is(err, ErrWrongType) {
+		return nil, valueTypeSet, err
+	}
+	if len(members) > 0 {
+		return members, valueTypeSet, nil
+	}
+
+	zMembers, scores, err := db.ZRangeWithScores(key, 0, -1)
+	if err != nil && !errors.Is(err, ErrWrongType) {
+		return nil, valueTypeZSet, err
+	}
+	if len(zMembers) > 0 {
+		values := make([]ZMember, len(zMembers))
+		for i := range zMembers {
+			values[i] = ZMember{Member: zMembers[i], Score: scores[i]}
+		}
+		return values, valueTypeZSet, nil
+	}
+	return nil, valueTypeString, ErrKeyNotFound
+}
+
+// Type returns the type of the value of key, it is looked up in the same order as GetAny but values are not read.
+// A key may hold a value of each type independently, e.g. Set and HSet on the same key do not conflict,
+// so the first type found is returned. Types are looked up in db.index, see keyEntry.
+// ErrKeyNotFound will be returned if the key does not exist in any type.
+func (db *LazyDB) Type(key []byte) (valueType, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return 0, err
+	}
+	types := db.keyTypes(key)
+	if len(types) == 0 {
+		return valueTypeString, ErrKeyNotFound
+	}
+	return types[0], nil
+}
+
+// Exists returns the number of keys existing in any type, a key given more than once is counted each time.
+// Keys denied by DBConfig.AccessControl are not counted.
+func (db *LazyDB) Exists(keys ...[]byte) int {
+	var count int
+	for _, key := range keys {
+		if db.checkAccess(OpRead, key) == nil && db.keyExists(key) {
+			count++
+		}
+	}
+	return count
+}
+
+// keyExists returns whether key exists in any type, values are not read.
+// Only the types recorded by db.index are looked up, in the order of GetAny, and the lookup stops
+// at the first one found.
+func (db *LazyDB) keyExists(key []byte) bool {
+	entry := db.lookupKey(key)
+	for _, typ := range getAnyTypes {
+		if db.entryExists(entry, typ, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// getAnyTypes types in the order they are looked up by GetAny.
+var getAnyTypes = []valueType{valueTypeString, valueTypeHash, valueTypeList, valueTypeSet, valueTypeZSet}
+
+// keyTypes returns types of the values of key in the order of GetAny.
+func (db *LazyDB) keyTypes(key []byte) []valueType {
+	var types []valueType
+	entry := db.lookupKey(key)
+	for _, typ := range getAnyTypes {
+		if db.entryExists(entry, typ, key) {
+			types = append(types, typ)
+		}
+	}
+	return types
+}
+
+// entryExists returns whether key, whose entry in db.index is entry, holds a value of the type.
+// Nothing is looked up if the type is not recorded, the expiry of a string is checked by the recorded value,
+// and only the index of the type is looked up for a collection.
+func (db *LazyDB) entryExists(entry keyEntry, typ valueType, key []byte) bool {
+	if !entry.has(typ) {
+		return false
+	}
+	if typ == valueTypeString {
+		return !entry.str.isExpired(db.now().UnixMilli())
+	}
+	return db.existsInType(typ, key)
+}
+
+// typedKeyExists returns whether key exists in the type, keys denied by DBConfig.AccessControl do not exist.
+func (db *LazyDB) typedKeyExists(typ valueType, key []byte) bool {
+	return db.checkAccess(OpRead, key) == nil && db.existsInType(typ, key)
+}
+
+// checkType returns ErrWrongType along with the name of the type held by key, if DBConfig.WrongTypeError is on
+// and key holds no value of typ but one of another type by db.index.
+// Index lock of typ must be held by the caller, so that the value of typ is checked along with the read of it.
+// Indexes of other types are not looked up, so a collection of another type counts until it is removed
+// even if it has expired, while an expired string does not.
+func (db *LazyDB) checkType(typ valueType, key []byte) error {
+	if !db.cfg.WrongTypeError {
+		return nil
+	}
+	entry := db.lookupKey(key)
+	if entry.types&^(1<<typ) == 0 || db.existsInTypeLocked(typ, key) {
+		return nil
+	}
+	for _, other := range getAnyTypes {
+		if other == typ || !entry.has(other) {
+			continue
+		}
+		if other == valueTypeString && entry.str.isExpired(db.now().UnixMilli()) {
+			continue
+		}
+		return fmt.Errorf("%w: key holds a %s", ErrWrongType, dumpTypeNames[other])
+	}
+	return nil
+}
+
+// existsInType returns whether key holds a value of the type, only the index of the type is looked up.
+// Expired values and collections do not exist, nor do collections whose elements are all removed.
+func (db *LazyDB) existsInType(typ valueType, key []byte) bool {
+	mu := db.getIndexLock(typ)
+	mu.RLock()
+	defer mu.RUnlock()
+	return db.existsInTypeLocked(typ, key)
+}
+
+// existsInTypeLocked is like existsInType, but the index lock of the type must be held by the caller.
+func (db *LazyDB) existsInTypeLocked(typ valueType, key []byte) bool {
+	switch typ {
+	case valueTypeString:
+		val, _ := db.strIndex.idxTree.Get(key).(*Value)
+		return val != nil && !val.isExpired(db.now().UnixMilli())
+	case valueTypeZSet:
+		idx := db.zSetIndex.indexes[util.ByteToString(key)]
+		return idx != nil && idx.tree != nil && idx.tree.Size() > 0
+	}
+	idxTree := db.liveCollection(typ, key)
+	return idxTree != nil && idxTree.Size() > 0
+}
+
+// KeyType is a key paired with the type of its value.
+type KeyType struct {
+	Key  []byte
+	Type valueType
+}
+
+// scanCursorTypeShift is the bit position of value type in the cursor of ScanAll,
+// lower bits are the position of key in the type.
+const scanCursorTypeShift = 56
+
+// ScanAll iterates over keys of all types, and returns at most count keys along with their types,
+// and the cursor to continue with. Iteration starts with cursor 0, and finishes when the returned cursor is 0.
+// Types are iterated in order, and keys of each type are iterated in order of DBConfig.KeyComparator,
+// so every key is returned exactly once if the db is not modified during the iteration.
+func (db *LazyDB) ScanAll(cursor uint64, count int) (uint64, []KeyType, error) {
+	if count <= 0 {
+		return 0, nil, ErrInvalidParam
+	}
+	typ := valueType(cursor >> scanCursorTypeShift)
+	pos := int(cursor & (1<<scanCursorTypeShift - 1))
+	if typ >= logFileTypeNum {
+		return 0, nil, ErrInvalidParam
+	}
+
+	var keyTypes []KeyType
+	for ; typ < logFileTypeNum; typ, pos = typ+1, 0 {
+		keys, err := db.sortedKeys(typ)
+		if err != nil {
+			return 0, nil, err
+		}
+		for ; pos < len(keys) && len(keyTypes) < count; pos++ {
+			keyTypes = append(keyTypes, KeyType{Key: keys[pos], Type: typ})
+		}
+		if len(keyTypes) < count {
+			continue
+		}
+		if pos < len(keys) {
+			return uint64(typ)<<scanCursorTypeShift | uint64(pos), keyTypes, nil
+		}
+		if typ+1 < logFileTypeNum {
+			return uint64(typ+1) << scanCursorTypeShift, keyTypes, nil
+		}
+	}
+	return 0, keyTypes, nil
+}
+
+// ScanMatchType iterates over keys like ScanAll, and returns keys of at most count keys iterated along with
+// the cursor to continue with. Only keys matching the glob-style pattern match are returned if it is not empty,
+// see util.GlobMatch, and only keys of typ if it is not empty, which is one of "string", "list", "hash", "set"
+// and "zset". So fewer than count keys may be returned before the iteration finishes.
+// Keys of each type are iterated in order of their hashes rather than DBConfig.KeyComparator, and the cursor is
+// a position of hashes, so a key existing during the whole iteration is returned at least once even if other
+// keys are written or deleted concurrently. Keys of the same hash are returned together, so more than count keys
+// may be iterated.
+func (db *LazyDB) ScanMatchType(cursor uint64, match string, typ string, count int) (uint64, [][]byte, error) {
+	if count <= 0 {
+		return 0, nil, ErrInvalidParam
+	}
+	first, last := valueType(0), valueType(logFileTypeNum-1)
+	if typ != "" {
+		t, ok := scanTypeOf(typ)
+		if !ok {
+			return 0, nil, ErrInvalidParam
+		}
+		first, last = t, t
+	}
+	curTyp := valueType(cursor >> scanCursorTypeShift)
+	pos := cursor & (1<<scanCursorTypeShift - 1)
+	if cursor == 0 {
+		curTyp = first
+	} else if curTyp < first || curTyp > last {
+		return 0, nil, ErrInvalidParam
+	}
+
+	type hashedKey struct {
+		key  []byte
+		hash uint64
+	}
+	var results [][]byte
+	iterated := 0
+	for ; curTyp <= last; curTyp, pos = curTyp+1, 0 {
+		keys, err := db.keysOf(curTyp)
+		if err != nil {
+			return 0, nil, err
+		}
+		hashed := make([]hashedKey, 0, len(keys))
+		for _, key := range keys {
+			if h := scanHash(key); h >= pos {
+				hashed = append(hashed, hashedKey{key: key, hash: h})
+			}
+		}
+		sort.Slice(hashed, func(i, j int) bool {
+			if hashed[i].hash != hashed[j].hash {
+				return hashed[i].hash < hashed[j].hash
+			}
+			return bytes.Compare(hashed[i].key, hashed[j].key) < 0
+		})
+		i := 0
+		for ; i < len(hashed); i++ {
+			// the cursor must not stop between keys of the same hash
+			if iterated >= count && i > 0 && hashed[i].hash != hashed[i-1].hash {
+				break
+			}
+			iterated++
+			if match == "" || util.GlobMatch([]byte(match), hashed[i].key) {
+				results = append(results, hashed[i].key)
+			}
+		}
+		if i < len(hashed) {
+			return uint64(curTyp)<<scanCursorTypeShift | hashed[i].hash, results, nil
+		}
+		if iterated >= count && curTyp < last {
+			return uint64(curTyp+1) << scanCursorTypeShift, results, nil
+		}
+	}
+	return 0, results, nil
+}
+
+// scanHash returns the position of key in the cursor of ScanMatchType.
+func scanHash(key []byte) uint64 {
+	return util.XXHash64Sum(key) >> (64 - scanCursorTypeShift)
+}
+
+// scanTypeOf returns the value type named name as in DumpAll.
+func scanTypeOf(name string) (valueType, bool) {
+	for typ, typName := range dumpTypeNames {
+		if typName == name {
+			return typ, true
+		}
+	}
+	return 0, false
+}
+
+// compareKeys compares keys by DBConfig.KeyComparator, or by bytes if it is nil.
+func (db *LazyDB) compareKeys(a, b []byte) int {
+	if db.cfg.KeyComparator != nil {
+		return db.cfg.KeyComparator(a, b)
+	}
+	return bytes.Compare(a, b)
+}
+
+// sortedKeys returns all keys of the type in order of DBConfig.KeyComparator.
+func (db *LazyDB) sortedKeys(typ valueType) ([][]byte, error) {
+	keys, err := db.keysOf(typ)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return db.compareKeys(keys[i], keys[j]) < 0
+	})
+	return keys, nil
+}
+
+// keysOf returns all keys of the type in no particular order.
+func (db *LazyDB) keysOf(typ valueType) ([][]byte, error) {
+	mu := db.getIndexLock(typ)
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var keys [][]byte
+	switch typ {
+	case valueTypeString:
+		ts := db.now().UnixMilli()
+		iter := db.strIndex.idxTree.Iterator()
+		for iter.HasNext() {
+			node, err := iter.Next()
+			if err != nil {
+				return nil, err
+			}
+			if val, _ := node.Value().(*Value); val.isExpired(ts) {
+				continue
+			}
+			keys = append(keys, node.Key())
+		}
+	case valueTypeHash:
+		for key := range db.hashIndex.trees {
+			keys = append(keys, []byte(key))
+		}
+	case valueTypeList:
+		for key := range db.listIndex.trees {
+			keys = append(keys, []byte(key))
+		}
+	case valueTypeSet:
+		for key := range db.setIndex.trees {
+			keys = append(keys, []byte(key))
+		}
+	case valueTypeZSet:
+		for key := range db.zSetIndex.indexes {
+			keys = append(keys, []byte(key))
+		}
+	}
+	return keys, nil
+}
+
 func (db *LazyDB) mergeStr(fid uint32, offset int64, ent *logfile.LogEntry) error {
-	db.strIndex.mu.RLock()
-	defer db.strIndex.mu.RUnlock()
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
 
+	if ent.Stat == logfile.SValueBlob {
+		return db.rewriteInterned(fid, offset, ent, func(ent *logfile.LogEntry) (*ValuePos, error) {
+			return db.rewriteLogEntry(valueTypeString, ent)
+		})
+	}
 	indexVal := db.strIndex.idxTree.Get(ent.Key)
 	if indexVal == nil {
 		return nil
@@ -254,7 +965,7 @@ func (db *LazyDB) mergeStr(fid uint32, offset int64, ent *logfile.LogEntry) erro
 	// as in index. Otherwise, this entry is updated in other log.
 	if val != nil && val.fid == fid && val.offset == offset {
 		// rewrite entry
-		valuePos, err := db.writeLogEntry(valueTypeString, ent)
+		valuePos, err := db.rewriteLogEntry(valueTypeString, ent)
 		if err != nil {
 			return err
 		}
@@ -265,9 +976,14 @@ func (db *LazyDB) mergeStr(fid uint32, offset int64, ent *logfile.LogEntry) erro
 }
 
 func (db *LazyDB) mergeHash(fid uint32, offset int64, ent *logfile.LogEntry) error {
-	key, _ := decodeKey(ent.Key)
-	db.hashIndex.mu.RLock()
-	defer db.hashIndex.mu.RUnlock()
+	db.hashIndex.mu.Lock()
+	defer db.hashIndex.mu.Unlock()
+	if ent.Stat == logfile.SPacked {
+		return db.rewritePackedHash(fid, offset, ent, func(ent *logfile.LogEntry) (*ValuePos, error) {
+			return db.rewriteLogEntry(valueTypeHash, ent)
+		})
+	}
+	key, _ := db.decodeKey(ent.Key)
 	idxTree := db.hashIndex.trees[util.ByteToString(key)]
 
 	indexVal := idxTree.Get(ent.Key)
@@ -280,7 +996,7 @@ func (db *LazyDB) mergeHash(fid uint32, offset int64, ent *logfile.LogEntry) err
 	// as in index. Otherwise, this entry is updated in other log.
 	if val != nil && val.fid == fid && val.offset == offset {
 		// rewrite entry
-		valuePos, err := db.writeLogEntry(valueTypeHash, ent)
+		valuePos, err := db.rewriteLogEntry(valueTypeHash, ent)
 		if err != nil {
 			return err
 		}
@@ -291,9 +1007,14 @@ func (db *LazyDB) mergeHash(fid uint32, offset int64, ent *logfile.LogEntry) err
 }
 
 func (db *LazyDB) mergeSet(fid uint32, offset int64, ent *logfile.LogEntry) error {
+	db.setIndex.mu.Lock()
+	defer db.setIndex.mu.Unlock()
+	if ent.Stat == logfile.SPacked {
+		return db.rewritePackedSet(fid, offset, ent, func(ent *logfile.LogEntry) (*ValuePos, error) {
+			return db.rewriteLogEntry(valueTypeSet, ent)
+		})
+	}
 	key, _ := decodeKey(ent.Key)
-	db.setIndex.mu.RLock()
-	defer db.setIndex.mu.RUnlock()
 	idxTree := db.setIndex.trees[util.ByteToString(key)]
 
 	indexVal := idxTree.Get(ent.Key)
@@ -306,7 +1027,7 @@ func (db *LazyDB) mergeSet(fid uint32, offset int64, ent *logfile.LogEntry) erro
 	// as in index. Otherwise, this entry is updated in other log.
 	if val != nil && val.fid == fid && val.offset == offset {
 		// rewrite entry
-		valuePos, err := db.writeLogEntry(valueTypeSet, ent)
+		valuePos, err := db.rewriteLogEntry(valueTypeSet, ent)
 		if err != nil {
 			return err
 		}
@@ -317,9 +1038,14 @@ func (db *LazyDB) mergeSet(fid uint32, offset int64, ent *logfile.LogEntry) erro
 }
 
 func (db *LazyDB) mergeZSet(fid uint32, offset int64, ent *logfile.LogEntry) error {
-	key, _ := decodeKey(ent.Key)
-	db.zSetIndex.mu.RLock()
-	defer db.zSetIndex.mu.RUnlock()
+	db.zSetIndex.mu.Lock()
+	defer db.zSetIndex.mu.Unlock()
+	if ent.Stat == logfile.SPacked {
+		return db.rewritePackedZSet(fid, offset, ent, func(ent *logfile.LogEntry) (*ValuePos, error) {
+			return db.rewriteLogEntry(valueTypeZSet, ent)
+		})
+	}
+	key, _ := db.decodeKey(ent.Key)
 	idxTree := db.zSetIndex.indexes[util.ByteToString(key)].tree
 
 	indexVal := idxTree.Get(ent.Key)
@@ -332,7 +1058,7 @@ func (db *LazyDB) mergeZSet(fid uint32, offset int64, ent *logfile.LogEntry) err
 	// as in index. Otherwise, this entry is updated in other log.
 	if val != nil && val.fid == fid && val.offset == offset {
 		// rewrite entry
-		valuePos, err := db.writeLogEntry(valueTypeZSet, ent)
+		valuePos, err := db.rewriteLogEntry(valueTypeZSet, ent)
 		if err != nil {
 			return err
 		}
@@ -344,8 +1070,8 @@ func (db *LazyDB) mergeZSet(fid uint32, offset int64, ent *logfile.LogEntry) err
 
 func (db *LazyDB) mergeList(fid uint32, offset int64, ent *logfile.LogEntry) error {
 	key, _ := decodeKey(ent.Key)
-	db.listIndex.mu.RLock()
-	defer db.listIndex.mu.RUnlock()
+	db.listIndex.mu.Lock()
+	defer db.listIndex.mu.Unlock()
 	idxTree := db.listIndex.trees[util.ByteToString(key)]
 	indexVal := idxTree.Get(ent.Key)
 	if indexVal == nil {
@@ -357,7 +1083,7 @@ func (db *LazyDB) mergeList(fid uint32, offset int64, ent *logfile.LogEntry) err
 	// as in index. Otherwise, this entry is updated in other log.
 	if val != nil && val.fid == fid && val.offset == offset {
 		// rewrite entry
-		valuePos, err := db.writeLogEntry(valueTypeList, ent)
+		valuePos, err := db.rewriteLogEntry(valueTypeList, ent)
 		if err != nil {
 			return err
 		}
@@ -368,6 +1094,16 @@ func (db *LazyDB) mergeList(fid uint32, offset int64, ent *logfile.LogEntry) err
 }
 
 func (db *LazyDB) Merge(typ valueType, targetFid uint32, gcRatio float64) error {
+	return db.MergeWithOptions(typ, targetFid, gcRatio, MergeOptions{})
+}
+
+// MergeWithOptions is like Merge, but with options.
+// The merge of a log file is aborted with ErrCorruptedEntry if an entry of it fails the crc check,
+// since the entry may still be live, and the log file is left intact.
+func (db *LazyDB) MergeWithOptions(typ valueType, targetFid uint32, gcRatio float64, opts MergeOptions) error {
+	if err := db.checkRewrite(); err != nil {
+		return err
+	}
 
 	activeFile := db.getActiveLogFile(typ)
 
@@ -380,6 +1116,8 @@ func (db *LazyDB) Merge(typ valueType, targetFid uint32, gcRatio float64) error
 		return err
 	}
 
+	var archivedFiles []*MutexLogFile
+	var total int64
 	for _, fid := range ccl {
 		// only merge specified log file
 		if targetFid >= 0 && targetFid != fid {
@@ -389,124 +1127,561 @@ func (db *LazyDB) Merge(typ valueType, targetFid uint32, gcRatio float64) error
 		if archivedFile == nil {
 			continue
 		}
-		var offset int64
-		for {
-			ent, size, err := archivedFile.lf.ReadLogEntry(offset)
-			if err != nil {
-				if err == io.EOF || err == logfile.ErrLogEndOfFile {
-					break
-				}
+		archivedFiles = append(archivedFiles, archivedFile)
+		total += archivedFile.lf.Offset
+	}
+	progress := newMergeProgress(opts.Progress, total)
+
+	for _, archivedFile := range archivedFiles {
+		var err error
+		if opts.GroupByRecency {
+			err = db.mergeByRecency(typ, archivedFile.lf, opts, progress)
+		} else {
+			err = db.scanMergedFile(typ, archivedFile.lf, opts, progress, func(offset int64, ent *logfile.LogEntry) error {
+				return db.mergeEntry(typ, archivedFile.lf.Fid, offset, ent)
+			})
+		}
+		if err != nil {
+			return err
+		}
+
+		if opts.Verify {
+			if err := db.verifyMerged(typ, archivedFile.lf); err != nil {
 				return err
 			}
-			var off = offset
+		}
+		// delete older log file
+		db.removeArchivedLogFile(typ, archivedFile.lf.Fid)
+		atomic.AddUint64(&db.stats.Merges, 1)
+		progress.finishFile(archivedFile.lf.Offset)
+	}
+
+	return nil
+}
+
+// scanMergedFile calls fn with entries of the log file being merged in order of offsets, and reports progress.
+// Corrupted entries are skipped if opts.Force is on, otherwise the scan fails with ErrCorruptedEntry.
+func (db *LazyDB) scanMergedFile(typ valueType, lf *logfile.LogFile, opts MergeOptions, progress *mergeProgress,
+	fn func(offset int64, ent *logfile.LogEntry) error) error {
+	var offset int64
+	for {
+		progress.report(offset, false)
+		if err := db.pinLogFile(typ, lf); err != nil {
+			return err
+		}
+		ent, size, err := lf.ReadLogEntry(offset)
+		lf.Mu.RUnlock()
+		if err == logfile.ErrInvalidCrc && opts.Force {
+			log.Printf("skip corrupted entry, fid: %d, offset: %d", lf.Fid, offset)
 			offset += int64(size)
-			if ent.Stat == logfile.SDelete {
-				continue
-			}
-			ts := time.Now().Unix()
-			if ent.ExpiredAt != 0 && ent.ExpiredAt <= ts {
-				continue
+			continue
+		}
+		if err != nil {
+			if err == io.EOF || err == logfile.ErrLogEndOfFile {
+				return nil
 			}
-			var mergeErr error
-			switch typ {
-			case valueTypeString:
-				mergeErr = db.mergeStr(archivedFile.lf.Fid, off, ent)
-			case valueTypeHash:
-				mergeErr = db.mergeHash(archivedFile.lf.Fid, off, ent)
-			case valueTypeSet:
-				mergeErr = db.mergeSet(archivedFile.lf.Fid, off, ent)
-			case valueTypeZSet:
-				mergeErr = db.mergeZSet(archivedFile.lf.Fid, off, ent)
-			case valueTypeList:
-				mergeErr = db.mergeList(archivedFile.lf.Fid, off, ent)
+			if err == logfile.ErrInvalidCrc {
+				return corruptedEntryError(lf.Fid, offset)
 			}
+			return err
+		}
+		var off = offset
+		offset += int64(size)
+		if err := fn(off, ent); err != nil {
+			return err
+		}
+	}
+}
 
-			if mergeErr != nil {
-				return mergeErr
-			}
+// mergeByRecency merges the log file like MergeWithOptions, but rewrites its entries in order of written-at
+// timestamps, see MergeOptions.GroupByRecency.
+func (db *LazyDB) mergeByRecency(typ valueType, lf *logfile.LogFile, opts MergeOptions, progress *mergeProgress) error {
+	type mergedEntry struct {
+		offset int64
+		ent    *logfile.LogEntry
+	}
+	var entries []mergedEntry
+	err := db.scanMergedFile(typ, lf, opts, progress, func(offset int64, ent *logfile.LogEntry) error {
+		entries = append(entries, mergedEntry{offset: offset, ent: ent})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// tombstones go first, they only shadow entries of older log files, and a live entry of the same key in this
+	// log file, which is written after the tombstone, must not be shadowed by it even if timestamps disagree
+	sort.SliceStable(entries, func(i, j int) bool {
+		di, dj := entries[i].ent.Stat == logfile.SDelete, entries[j].ent.Stat == logfile.SDelete
+		if di != dj {
+			return di
 		}
+		return entries[i].ent.WrittenAt < entries[j].ent.WrittenAt
+	})
+	for _, e := range entries {
+		if err := db.mergeEntry(typ, lf.Fid, e.offset, e.ent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		// delete older log file
-		archivedLogFiles := db.archivedLogFile[typ]
-		shard := archivedLogFiles.GetShardByWriting(targetFid)
+// mergeEntry rewrites the entry at offset of the archived log file fid if it is still live,
+// or it is a delete entry kept for DBConfig.TombstoneGracePeriod. Entries of uncommitted transactions are skipped.
+func (db *LazyDB) mergeEntry(typ valueType, fid uint32, offset int64, ent *logfile.LogEntry) error {
+	if db.txDiscarded(ent) {
+		return nil
+	}
+	if ent.Stat == logfile.SDelete {
+		if !db.keepTombstone(typ, fid, offset, ent) {
+			return nil
+		}
+		mu := db.getIndexLock(typ)
+		mu.Lock()
+		defer mu.Unlock()
+		return db.rewriteTombstone(typ, ent, func(ent *logfile.LogEntry) (*ValuePos, error) {
+			return db.rewriteLogEntry(typ, ent)
+		})
+	}
+	ts := db.now().UnixMilli()
+	if ent.ExpiredAt != 0 && expiredAtMilli(ent.ExpiredAt) <= ts {
+		return nil
+	}
+	switch typ {
+	case valueTypeString:
+		return db.mergeStr(fid, offset, ent)
+	case valueTypeHash:
+		return db.mergeHash(fid, offset, ent)
+	case valueTypeSet:
+		return db.mergeSet(fid, offset, ent)
+	case valueTypeZSet:
+		return db.mergeZSet(fid, offset, ent)
+	case valueTypeList:
+		return db.mergeList(fid, offset, ent)
+	default:
+		return db.mergeCustom(typ, fid, offset, ent)
+	}
+}
+
+// CompactActive seals the active log file of the given type, rewrites its live entries into a new active log file,
+// and then removes it. So that stale entries of overwrite-heavy keys in the active log file can be reclaimed.
+// Writes of the type are blocked until the compaction finishes.
+func (db *LazyDB) CompactActive(typ valueType) error {
+	if err := db.checkRewrite(); err != nil {
+		return err
+	}
+	mu := db.getIndexLock(typ)
+	mu.Lock()
+	defer mu.Unlock()
+
+	activeLogFile, ok := db.activeLogFileMap[typ]
+	if !ok {
+		return nil
+	}
+	activeLogFile.mu.Lock()
+	sealed := activeLogFile.lf
+	if sealed.Offset == 0 {
+		activeLogFile.mu.Unlock()
+		return nil
+	}
+	if err := db.rotateActiveLogFile(typ, activeLogFile, time.Time{}); err != nil {
+		activeLogFile.mu.Unlock()
+		return err
+	}
+	activeLogFile.mu.Unlock()
+
+	write := func(ent *logfile.LogEntry) (*ValuePos, error) {
+		return db.rewriteLogEntry(typ, ent)
+	}
+	if err := db.rewriteLiveEntries(typ, sealed, write); err != nil {
+		return err
+	}
+
+	db.removeArchivedLogFile(typ, sealed.Fid)
+	return nil
+}
+
+// MergeInto appends live entries of the archived log file targetFid into an existing log file destFid
+// rather than a brand-new file, and then removes the target file. So that many sparse archived files can be
+// consolidated into fewer ones. Entries will be written into the active log file once the destination is full.
+// Writes of the type are blocked until the merge finishes.
+//
+// destFid must be newer than targetFid, ErrInvalidParam is returned otherwise. Log files are replayed in order of
+// fid when the db is opened, so entries moved into an older file would be shadowed by stale entries of the files
+// between them.
+func (db *LazyDB) MergeInto(typ valueType, targetFid, destFid uint32) error {
+	if err := db.checkRewrite(); err != nil {
+		return err
+	}
+	if destFid <= targetFid {
+		return ErrInvalidParam
+	}
+	mu := db.getIndexLock(typ)
+	mu.Lock()
+	defer mu.Unlock()
+
+	target := db.getArchivedLogFile(typ, targetFid)
+	if target == nil {
+		return ErrLogFileNotExist
+	}
+	var dest *MutexLogFile
+	if activeLogFile, ok := db.activeLogFileMap[typ]; ok && activeLogFile.lf.Fid == destFid {
+		dest = activeLogFile
+	} else if dest = db.getArchivedLogFile(typ, destFid); dest == nil {
+		return ErrLogFileNotExist
+	}
 
-		val, _ := shard.Get(targetFid)
-		mutexLF := val.(*MutexLogFile)
+	write := func(ent *logfile.LogEntry) (*ValuePos, error) {
+		if db.isActiveLogFile(typ, dest.lf) {
+			return db.rewriteLogEntry(typ, ent)
+		}
+		valuePos, err := db.writeArchivedLogEntry(typ, dest, ent)
+		// destination is full, roll over to the active log file
+		if err == errLogFileFull {
+			return db.rewriteLogEntry(typ, ent)
+		}
+		if err == nil {
+			db.recordRewrite(valuePos.entrySize)
+		}
+		return valuePos, err
+	}
+	if err := db.rewriteLiveEntries(typ, target.lf, write); err != nil {
+		return err
+	}
 
-		_ = mutexLF.lf.Delete() // close file and remove local file
-		shard.Remove(targetFid) // remove index from memory
+	db.removeArchivedLogFile(typ, targetFid)
+	return nil
+}
 
-		shard.Unlock()
+// writeArchivedLogEntry appends entry at the end of an archived log file.
+// Return errLogFileFull if there is not enough space.
+func (db *LazyDB) writeArchivedLogEntry(typ valueType, mlf *MutexLogFile, entry *logfile.LogEntry) (*ValuePos, error) {
+	mlf.mu.Lock()
+	defer mlf.mu.Unlock()
 
-		db.discardsMap[typ].clear(fid)
+	commitRewritten(entry)
+	entBuf, entSize := db.encodeEntry(entry)
+	lf := mlf.lf
+	if lf.Offset+int64(entSize) > db.cfg.MaxLogFileSize {
+		return nil, errLogFileFull
+	}
+	if err := db.pinLogFile(typ, lf); err != nil {
+		return nil, err
+	}
+	defer lf.Mu.RUnlock()
+
+	// the footer would be read as entries after the entry, and it does not match entries any more
+	if err := lf.ClearFooter(); err != nil {
+		return nil, err
+	}
+	db.removeIndexLog(typ, lf.Fid)
+	writeAt := lf.Offset
+	if err := lf.Write(entBuf); err != nil {
+		return nil, err
 	}
+	db.recordWrite(entSize)
+	return &ValuePos{fid: lf.Fid, offset: writeAt, entrySize: entSize}, nil
+}
 
+// rewriteLiveEntries rewrites live entries of the log file by write function.
+// Deleted or expired entries, entries of uncommitted transactions, and entries that have been updated in other
+// log files will be skipped.
+// Delete entries are skipped too, unless they are kept for DBConfig.TombstoneGracePeriod, or older log files of the
+// type still exist, which may hold values of the deleted keys that would come back when indexes are built.
+// Index lock of the type must be held by the caller.
+func (db *LazyDB) rewriteLiveEntries(typ valueType, lf *logfile.LogFile,
+	write func(ent *logfile.LogEntry) (*ValuePos, error)) error {
+
+	var offset int64
+	for {
+		if err := db.pinLogFile(typ, lf); err != nil {
+			return err
+		}
+		ent, size, err := lf.ReadLogEntry(offset)
+		lf.Mu.RUnlock()
+		if err != nil {
+			if err == io.EOF || err == logfile.ErrLogEndOfFile {
+				break
+			}
+			if err == logfile.ErrInvalidCrc {
+				return corruptedEntryError(lf.Fid, offset)
+			}
+			return err
+		}
+		var off = offset
+		offset += int64(size)
+		if db.txDiscarded(ent) {
+			continue
+		}
+		if ent.Stat == logfile.SDelete {
+			if db.hasOlderLogFile(typ, lf.Fid) || db.keepTombstone(typ, lf.Fid, off, ent) {
+				if err := db.rewriteTombstone(typ, ent, write); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if ent.ExpiredAt != 0 && expiredAtMilli(ent.ExpiredAt) <= db.now().UnixMilli() {
+			continue
+		}
+		if err := db.rewriteLiveEntry(typ, lf.Fid, off, ent, write); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// rewriteLiveEntry rewrites the entry by write function if index still points to it.
+// Index lock of the type must be held by the caller.
+func (db *LazyDB) rewriteLiveEntry(typ valueType, fid uint32, offset int64, ent *logfile.LogEntry,
+	write func(ent *logfile.LogEntry) (*ValuePos, error)) error {
+
+	if ent.Stat == logfile.SPacked {
+		switch typ {
+		case valueTypeHash:
+			return db.rewritePackedHash(fid, offset, ent, write)
+		case valueTypeSet:
+			return db.rewritePackedSet(fid, offset, ent, write)
+		case valueTypeZSet:
+			return db.rewritePackedZSet(fid, offset, ent, write)
+		}
+	}
+	if typ == valueTypeString && ent.Stat == logfile.SValueBlob {
+		return db.rewriteInterned(fid, offset, ent, write)
+	}
+	idxTree, idxKey := db.locateIndex(typ, ent)
+	if idxTree == nil {
+		return nil
+	}
+	val, _ := idxTree.Get(idxKey).(*Value)
+	if val == nil || val.fid != fid || val.offset != offset {
+		return nil
+	}
+	valuePos, err := write(ent)
+	if err != nil {
+		return err
+	}
+	newVal := &Value{
+		vType:       val.vType,
+		fid:         valuePos.fid,
+		offset:      valuePos.offset,
+		entrySize:   valuePos.entrySize,
+		expiredAt:   val.expiredAt,
+		accessCount: atomic.LoadUint64(&val.accessCount),
+		lastAccess:  atomic.LoadInt64(&val.lastAccess),
+		version:     val.version,
+		writtenAt:   val.writtenAt,
+		ref:         val.ref,
+	}
+	idxTree.Put(idxKey, newVal)
+	if typ == valueTypeString {
+		db.indexKey(typ, idxKey, newVal)
+	}
+	return nil
+}
+
+// corruptedEntryError wraps ErrCorruptedEntry with the position of the entry.
+func corruptedEntryError(fid uint32, offset int64) error {
+	return fmt.Errorf("%w, fid: %d, offset: %d", ErrCorruptedEntry, fid, offset)
+}
+
+// removeArchivedLogFile deletes the archived log file from disk and memory.
+// The file is removed from memory at once, so that it can't be read any more, but it is deleted from disk
+// only after all in-flight reads of it release it.
+func (db *LazyDB) removeArchivedLogFile(typ valueType, fid uint32) {
+	shard := db.archivedLogFile[typ].GetShardByWriting(fid)
+	val, ok := shard.Pop(fid) // remove index from memory
+	shard.Unlock()
+
+	if ok {
+		db.retireLogFile(typ, val.(*MutexLogFile))
+	}
+	if db.fileCache != nil {
+		db.fileCache.remove(typ, fid)
+	}
+	if db.valueCache != nil && typ == valueTypeString {
+		db.valueCache.removeFile(fid)
+	}
+	db.discardsMap[typ].clear(fid)
+}
+
+// retireLogFile deletes the log file removed from memory, or leaves it to the last release of in-flight reads.
+// A fid may be retired again before then, e.g. a log file replaced by CompactKey and then merged, so that all
+// retired files of the fid are kept until the last release.
+func (db *LazyDB) retireLogFile(typ valueType, mutexLF *MutexLogFile) {
+	key := logFileCacheKey{typ: typ, fid: mutexLF.lf.Fid}
+	ref := db.fileRefs.get(key)
+	ref.mu.Lock()
+	ref.removed = append(ref.removed, mutexLF)
+	db.deleteRemovedLogFiles(key, ref)
+}
+
+// get returns the read count of the log file, which is created on the first read.
+func (refs *logFileRefs) get(key logFileCacheKey) *logFileRef {
+	if ref, ok := refs.files.Load(key); ok {
+		return ref.(*logFileRef)
+	}
+	ref, _ := refs.files.LoadOrStore(key, &logFileRef{})
+	return ref.(*logFileRef)
+}
+
+// deleteRemovedLogFiles deletes the removed log files of key if no read holds them, and unlocks ref.mu,
+// which must be locked by the caller.
+// A read which holds the file after the count is checked can't find it, since the file is removed from memory
+// before it is retired, and it leaves the deleting to its own release.
+func (db *LazyDB) deleteRemovedLogFiles(key logFileCacheKey, ref *logFileRef) {
+	if atomic.LoadInt64(&ref.refs) > 0 || len(ref.removed) == 0 {
+		ref.mu.Unlock()
+		return
+	}
+	removed := ref.removed
+	ref.removed = nil
+	// the count of a fid removed from memory is dropped, a file replaced by CompactKey is still readable by fid
+	if !removed[len(removed)-1].replaced {
+		db.fileRefs.files.Delete(key)
+	}
+	ref.mu.Unlock()
+	for _, mutexLF := range removed {
+		db.deleteLogFile(key.typ, mutexLF)
+	}
+}
+
+// acquireLogFile returns the active or archived log file by fid, and holds it from being deleted by merge
+// until it is released by releaseLogFile. It is held by fid, so it stays valid even if the active log file
+// is archived and merged in the meantime. Returns ErrLogFileNotExist when target log file does not exist.
+func (db *LazyDB) acquireLogFile(typ valueType, fid uint32) (*logfile.LogFile, error) {
+	activeLogFile := db.activeLogFileMap[typ]
+	if activeLogFile == nil || activeLogFile.lf == nil {
+		return nil, ErrOpenLogFile
+	}
+	// counted before the file is looked up, so that the file is either held before it is retired or not found
+	key := logFileCacheKey{typ: typ, fid: fid}
+	ref := db.fileRefs.get(key)
+	atomic.AddInt64(&ref.refs, 1)
+	lf := db.getLogFile(typ, fid)
+	if lf == nil {
+		db.releaseLogFileRef(key, ref)
+		return nil, ErrLogFileNotExist
+	}
+	return lf, nil
+}
+
+// releaseLogFile releases the log file held by acquireLogFile,
+// the last release of a removed log file deletes it.
+func (db *LazyDB) releaseLogFile(typ valueType, fid uint32) {
+	key := logFileCacheKey{typ: typ, fid: fid}
+	db.releaseLogFileRef(key, db.fileRefs.get(key))
+}
+
+// releaseLogFileRef decreases the read count of the log file, and deletes its removed files on the last release.
+func (db *LazyDB) releaseLogFileRef(key logFileCacheKey, ref *logFileRef) {
+	if atomic.AddInt64(&ref.refs, -1) > 0 {
+		return
+	}
+	ref.mu.Lock()
+	db.deleteRemovedLogFiles(key, ref)
+}
+
+// deleteLogFile closes the removed log file and removes it from disk.
+// A log file replaced by a rewritten one of the same fid is only closed, see CompactKey.
+func (db *LazyDB) deleteLogFile(typ valueType, mutexLF *MutexLogFile) {
+	// wait for readers which do not hold the file, e.g. Tail
+	mutexLF.lf.Mu.Lock()
+	if mutexLF.replaced {
+		_ = mutexLF.lf.Close()
+		mutexLF.lf.Mu.Unlock()
+		return
+	}
+	_ = mutexLF.lf.Delete() // close file and remove local file
+	mutexLF.lf.Mu.Unlock()
+	db.removeIndexLog(typ, mutexLF.lf.Fid)
+	// the file may be cached again by a read in flight
+	if db.fileCache != nil {
+		db.fileCache.remove(typ, mutexLF.lf.Fid)
+	}
+}
+
 // readLogEntry Reads entry from log files by fid and offset.
 // Return error if entry does not exist.
 func (db *LazyDB) readLogEntry(typ valueType, fid uint32, offset int64) (*logfile.LogEntry, error) {
-	var lf *logfile.LogFile
-	activelf := db.activeLogFileMap[typ]
+	return db.readLogEntryWithDeadline(typ, fid, offset, time.Time{})
+}
 
-	lf = activelf.lf
-	if lf == nil {
-		return nil, ErrOpenLogFile
+// readLogEntryWithDeadline is like readLogEntry, but gives up waiting for the log file once deadline is exceeded.
+func (db *LazyDB) readLogEntryWithDeadline(typ valueType, fid uint32, offset int64, deadline time.Time) (*logfile.LogEntry, error) {
+	entry, _, err := db.readLogEntryInto(typ, fid, offset, nil, deadline)
+	return entry, err
+}
+
+// readLogEntryInto is like readLogEntryWithDeadline, but key and value of the entry are appended to dst.
+// It returns the entry and the extended dst.
+func (db *LazyDB) readLogEntryInto(typ valueType, fid uint32, offset int64, dst []byte,
+	deadline time.Time) (*logfile.LogEntry, []byte, error) {
+	lf, err := db.acquireLogFile(typ, fid)
+	if err != nil {
+		return nil, dst, err
 	}
+	defer db.releaseLogFile(typ, fid)
+	return db.readHeldLogEntry(typ, lf, offset, dst, deadline)
+}
 
-	if lf.Fid != fid {
-		mlf := db.getArchivedLogFile(typ, fid)
-		if mlf == nil || mlf.lf == nil {
-			return nil, ErrLogFileNotExist
-		}
-		lf = mlf.lf
+// readHeldLogEntry reads entry at offset from the log file held by acquireLogFile, see readLogEntryInto.
+func (db *LazyDB) readHeldLogEntry(typ valueType, lf *logfile.LogFile, offset int64, dst []byte,
+	deadline time.Time) (*logfile.LogEntry, []byte, error) {
+	if err := db.pinLogFileWithDeadline(typ, lf, deadline); err != nil {
+		return nil, dst, err
 	}
-	lf.Mu.RLock()
 	defer lf.Mu.RUnlock()
-	entry, _, err := lf.ReadLogEntry(offset)
-	return entry, err
+	if readLogEntryHook != nil {
+		readLogEntryHook(typ, lf.Fid, offset)
+	}
+	entry, dst, _, err := lf.ReadLogEntryInto(offset, dst)
+	return entry, dst, err
 }
 
+// readLogEntryHook is called before an entry is read from a log file by readLogEntryInto, for testing.
+var readLogEntryHook func(typ valueType, fid uint32, offset int64)
+
 // writeLogEntry writes entry into active log file and returns position.
+// The entry has been synced when it returns if DBConfig.IndexUpdateMode is IndexUpdateAfterSync.
 // Return nil and error if writing fails.
 func (db *LazyDB) writeLogEntry(typ valueType, entry *logfile.LogEntry) (*ValuePos, error) {
+	return db.writeLogEntryWithDeadline(typ, entry, time.Time{})
+}
+
+// writeLogEntryWithDeadline is like writeLogEntry,
+// but gives up waiting for the log file and fsync once deadline is exceeded.
+func (db *LazyDB) writeLogEntryWithDeadline(typ valueType, entry *logfile.LogEntry, deadline time.Time) (*ValuePos, error) {
+	if err := db.checkKeySize(entry); err != nil {
+		return nil, err
+	}
+	return db.appendLogEntry(typ, entry, deadline)
+}
+
+// appendLogEntry writes the entry into the active log file without checking its key,
+// entries rewritten by merge or compaction are written by it.
+func (db *LazyDB) appendLogEntry(typ valueType, entry *logfile.LogEntry, deadline time.Time) (*ValuePos, error) {
+	if db.readOnly() {
+		return nil, ErrReadOnly
+	}
 	activeLogFile := db.getActiveLogFile(typ)
 	if activeLogFile == nil {
 		return nil, ErrOpenLogFile
 	}
-	activeLogFile.mu.Lock()
+	if err := lockWithDeadline(&activeLogFile.mu, deadline); err != nil {
+		return nil, err
+	}
 	defer activeLogFile.mu.Unlock()
 
 	lf := activeLogFile.lf
-	entBuf, entSize := logfile.EncodeEntry(entry)
+	db.stampVersion(entry)
+	db.stampWrittenAt(entry)
+	entBuf, entSize := db.encodeEntry(entry)
 
-	// maxsize exceeded
-	if lf.Offset+int64(entSize) > db.cfg.MaxLogFileSize {
-		if err := lf.Sync(); err != nil {
+	// maxsize or max age exceeded
+	if db.shouldRotate(activeLogFile, entSize) {
+		if err := db.rotateActiveLogFile(typ, activeLogFile, deadline); err != nil {
 			return nil, err
 		}
-
-		newFid := lf.Fid + 1
-		newActiveLF, err := logfile.Open(db.cfg.DBPath, newFid, db.cfg.MaxLogFileSize, logfile.FType(typ), db.cfg.IOType)
-		if err != nil {
-			return nil, err
-		}
-
-		// move activeLogFile to archive
-		db.archivedLogFile[typ].Set(lf.Fid, &MutexLogFile{lf: lf})
-
-		// insert new fid
-		fids := db.fidsMap[typ]
-		fids.mu.Lock()
-		fids.fids = append(fids.fids, newFid)
-		fids.mu.Unlock()
-
-		// update discard of new file
-		db.discardsMap[typ].setTotal(newFid, uint32(db.cfg.MaxLogFileSize))
-
-		// update activeLogFile
-		activeLogFile.lf = newActiveLF
 	}
 
 	lf = activeLogFile.lf
@@ -514,21 +1689,124 @@ func (db *LazyDB) writeLogEntry(typ valueType, entry *logfile.LogEntry) (*ValueP
 	if err := lf.Write(entBuf); err != nil {
 		return nil, err
 	}
+	// the index is updated by the caller, so make sure the entry is durable before it becomes visible
+	if db.cfg.IndexUpdateMode == IndexUpdateAfterSync {
+		if err := syncWithDeadline(lf, deadline); err != nil {
+			// roll the entry back like a failed write, so that a write which returns an error is not applied
+			// on recovery, unless the fsync left running in background persists it before the next one
+			if revertErr := lf.Revert(writeAt); revertErr != nil {
+				return nil, fmt.Errorf("%w, rolling back the entry: %v", err, revertErr)
+			}
+			return nil, err
+		}
+	}
+	if activeLogFile.footer != nil {
+		activeLogFile.footer.Add(entry.Key, entBuf)
+	}
+	db.recordWrite(entSize)
 	valPos := &ValuePos{
 		fid:       lf.Fid,
 		offset:    writeAt,
 		entrySize: entSize,
 	}
+	if err := db.appendIndexRecord(typ, activeLogFile, entry, valPos); err != nil {
+		return nil, err
+	}
+	activeLogFile.last = *valPos
 	return valPos, nil
 }
 
+// rotateActiveLogFile archives the active log file and opens a new one as the active log file.
+// It gives up waiting for fsync once deadline is exceeded, no deadline if it is zero.
+// Lock of activeLogFile must be held by the caller.
+func (db *LazyDB) rotateActiveLogFile(typ valueType, activeLogFile *MutexLogFile, deadline time.Time) error {
+	return db.rotateActiveLogFileTo(typ, activeLogFile, db.availableFid(typ, db.nextFid(activeLogFile.lf.Fid)), deadline)
+}
+
+// rotateActiveLogFileTo is like rotateActiveLogFile, but the new active log file is created with newFid.
+func (db *LazyDB) rotateActiveLogFileTo(typ valueType, activeLogFile *MutexLogFile, newFid uint32,
+	deadline time.Time) error {
+	lf := activeLogFile.lf
+	// the log file is sealed without a footer if some entries are not added into it, or it does not fit
+	if footer := activeLogFile.footer; footer != nil && footer.DataSize == lf.Offset {
+		if err := lf.WriteFooter(footer); err != nil && err != logfile.ErrFooterNoSpace {
+			return err
+		}
+	}
+	if err := syncWithDeadline(lf, deadline); err != nil {
+		return err
+	}
+	if err := activeLogFile.closeIndexLog(); err != nil {
+		return err
+	}
+
+	newActiveLF, err := db.createLogFile(typ, newFid)
+	if err != nil {
+		return err
+	}
+
+	// move activeLogFile to archive
+	db.archivedLogFile[typ].Set(lf.Fid, &MutexLogFile{lf: lf})
+	db.cacheLogFile(typ, lf)
+
+	// insert new fid
+	fids := db.fidsMap[typ]
+	fids.mu.Lock()
+	fids.fids = append(fids.fids, newFid)
+	fids.mu.Unlock()
+
+	// update discard of new file
+	db.discardsMap[typ].setTotal(newFid, uint32(db.cfg.MaxLogFileSize))
+
+	// update activeLogFile
+	activeLogFile.lf = newActiveLF
+	activeLogFile.footer = &logfile.Footer{}
+	activeLogFile.createdAt = db.now()
+	return nil
+}
+
+// shouldRotate returns whether the active log file must be archived before writing an entry of entSize into it,
+// since it is full, or older than DBConfig.MaxLogFileAge. Lock of activeLogFile must be held by the caller.
+func (db *LazyDB) shouldRotate(activeLogFile *MutexLogFile, entSize int) bool {
+	lf := activeLogFile.lf
+	if lf.Offset+int64(entSize) > db.cfg.MaxLogFileSize {
+		return true
+	}
+	return db.cfg.MaxLogFileAge > 0 && lf.Offset > 0 && db.now().Sub(activeLogFile.createdAt) >= db.cfg.MaxLogFileAge
+}
+
 // buildLogFiles Recover archivedLogFile from disk.
 // Only run once when program start running.
 func (db *LazyDB) buildLogFiles() error {
-	fileInfos, err := os.ReadDir(db.cfg.DBPath)
+	fidsMap, err := db.scanLogFiles()
 	if err != nil {
 		return err
 	}
+	for typ := 0; typ < logFileTypeNum; typ++ {
+		db.fidsMap[valueType(typ)].fids = append(db.fidsMap[valueType(typ)].fids, fidsMap[valueType(typ)]...)
+		if err = db.openLogFilesOfType(valueType(typ)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanLogFiles returns fids of log files in db directory by type.
+// Log files of custom types which are not registered are skipped.
+func (db *LazyDB) scanLogFiles() (map[valueType][]uint32, error) {
+	var fileInfos []fs.DirEntry
+	var err error
+	if db.readOnly() {
+		fileInfos, err = fs.ReadDir(db.fsys, ".")
+	} else {
+		fileInfos, err = os.ReadDir(db.cfg.DBPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// several files of a fid in a type, e.g. a padded name and a legacy one left by a botched copy, are
+	// detected by names of fids
+	names := make(map[valueType]map[uint32][]string)
 	for _, file := range fileInfos {
 		if !strings.HasPrefix(file.Name(), logfile.FilePrefix) {
 			continue
@@ -538,48 +1816,125 @@ func (db *LazyDB) buildLogFiles() error {
 			log.Printf("Invalid log file name: %s", file.Name())
 			continue
 		}
-		typ := valueType(logfile.FileTypesMap[splitInfo[1]])
+		ftype, ok := logfile.LookupFType(splitInfo[1])
+		if !ok || db.fidsMap[valueType(ftype)] == nil {
+			continue
+		}
 		fid, err := strconv.Atoi(splitInfo[2])
 		if err != nil {
 			log.Printf("Invalid log file name: %s", file.Name())
 			continue
 		}
-		fids := db.fidsMap[typ]
-		fids.fids = append(fids.fids, uint32(fid))
+		typ := valueType(ftype)
+		if names[typ] == nil {
+			names[typ] = make(map[uint32][]string)
+		}
+		names[typ][uint32(fid)] = append(names[typ][uint32(fid)], file.Name())
+	}
+	if err := db.resolveDuplicateFids(names); err != nil {
+		return nil, err
 	}
 
-	build := func(typ valueType) {
-		mutexFids := db.fidsMap[typ]
-		fids := mutexFids.fids
-		if len(fids) == 0 {
-			return
+	fidsMap := make(map[valueType][]uint32)
+	for typ, fids := range names {
+		for fid := range fids {
+			fidsMap[typ] = append(fidsMap[typ], fid)
 		}
-		// newly created log file has bigger fid
-		sort.Slice(fids, func(i, j int) bool {
-			return fids[i] < fids[j]
-		})
-		archivedLogFiles := db.archivedLogFile[typ]
-		for i, fid := range fids {
-			lf, err := logfile.Open(db.cfg.DBPath, fid, db.cfg.MaxLogFileSize, logfile.FType(typ), db.cfg.IOType)
-			if err != nil {
-				log.Fatalf("Open Log File error:%v. Type: %v, Fid: %v,", err, typ, fid)
-				continue
-			}
+	}
+	return fidsMap, nil
+}
 
-			// latest one is the active log file
-			if i == len(fids)-1 {
-				db.activeLogFileMap[typ] = &MutexLogFile{lf: lf}
-			} else {
-				archivedLogFiles.Set(fid, &MutexLogFile{lf: lf})
+// openLogFilesOfType opens log files of the type in fidsMap, the latest one is opened as the active log file.
+// Log files opened are closed if one fails to open, see skipCorruptFile.
+func (db *LazyDB) openLogFilesOfType(typ valueType) error {
+	mutexFids := db.fidsMap[typ]
+	fids := mutexFids.fids
+	if len(fids) == 0 {
+		return nil
+	}
+	// newly created log file has bigger fid
+	sort.Slice(fids, func(i, j int) bool {
+		return fids[i] < fids[j]
+	})
+	fids = db.dropUnrecoveredFiles(typ, fids)
+	var logFiles []*logfile.LogFile
+	for _, fid := range fids {
+		lf, err := db.openLogFile(typ, fid)
+		if err != nil {
+			if err = db.skipCorruptFile(typ, fid, 0, err); err != nil {
+				for _, opened := range logFiles {
+					_ = opened.Close()
+				}
+				return err
 			}
+			continue
 		}
+		logFiles = append(logFiles, lf)
 	}
-	for typ := 0; typ < logFileTypeNum; typ++ {
-		build(valueType(typ))
+
+	archivedLogFiles := db.archivedLogFile[typ]
+	mutexFids.fids = mutexFids.fids[:0]
+	for i, lf := range logFiles {
+		mutexFids.fids = append(mutexFids.fids, lf.Fid)
+		// latest one is the active log file
+		if i == len(logFiles)-1 {
+			db.activeLogFileMap[typ] = &MutexLogFile{lf: lf, createdAt: db.now()}
+		} else {
+			archivedLogFiles.Set(lf.Fid, &MutexLogFile{lf: lf})
+			db.cacheLogFile(typ, lf)
+		}
 	}
 	return nil
 }
 
+// syncDir fsyncs the directory of db, it is a variable so that tests can count syncs.
+var syncDir = util.SyncDir
+
+// createLogFile opens a new log file as the active log file, and syncs the directory unless DBConfig.NoSyncDir is on,
+// so that the log file survives a crash once its entries are synced.
+func (db *LazyDB) createLogFile(typ valueType, fid uint32) (*logfile.LogFile, error) {
+	lf, err := db.openLogFile(typ, fid)
+	if err != nil {
+		return nil, err
+	}
+	if !db.cfg.NoSyncDir {
+		if err = syncDir(db.cfg.DBPath); err != nil {
+			_ = lf.Close()
+			return nil, err
+		}
+	}
+	return lf, nil
+}
+
+// openLogFile opens an existing log file from disk, or from fsys if db is read-only.
+func (db *LazyDB) openLogFile(typ valueType, fid uint32) (*logfile.LogFile, error) {
+	var lf *logfile.LogFile
+	var err error
+	if db.readOnly() {
+		lf, err = logfile.OpenFS(db.fsys, fid, logfile.FType(typ))
+	} else {
+		lf, err = logfile.Open(db.cfg.DBPath, fid, db.cfg.MaxLogFileSize, logfile.FType(typ), db.cfg.IOType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	lf.BlockAlign = db.cfg.BlockAlign
+	return lf, nil
+}
+
+// encodeEntry encodes entry into binary form padded to DBConfig.BlockAlign, returns it with its size.
+// The check sum of entry is computed by DBConfig.ChecksumType.
+func (db *LazyDB) encodeEntry(entry *logfile.LogEntry) ([]byte, int) {
+	entry.Checksum = db.cfg.ChecksumType
+	return logfile.EncodeEntryAligned(entry, db.cfg.BlockAlign)
+}
+
+// entrySize returns the size of entry in log file, including padding.
+func (db *LazyDB) entrySize(entry *logfile.LogEntry) int {
+	_, size := db.encodeEntry(entry)
+	return size
+}
+
 // getArchivedLogFile Util function for get archivedLogFile from ConcurrentMap.
 // Returns nil when target log file does not exist
 func (db *LazyDB) getArchivedLogFile(typ valueType, fid uint32) *MutexLogFile {
@@ -592,18 +1947,57 @@ func (db *LazyDB) getArchivedLogFile(typ valueType, fid uint32) *MutexLogFile {
 	return lf
 }
 
+// getLogFile returns the active or archived log file by fid.
+// Returns nil when target log file does not exist.
+func (db *LazyDB) getLogFile(typ valueType, fid uint32) *logfile.LogFile {
+	if activeLogFile, ok := db.activeLogFileMap[typ]; ok && activeLogFile.lf != nil && activeLogFile.lf.Fid == fid {
+		return activeLogFile.lf
+	}
+	mlf := db.getArchivedLogFile(typ, fid)
+	if mlf == nil {
+		return nil
+	}
+	return mlf.lf
+}
+
+// getIndexLock returns the lock which protects the index of the given type.
+func (db *LazyDB) getIndexLock(typ valueType) *sync.RWMutex {
+	switch typ {
+	case valueTypeString:
+		return db.strIndex.mu
+	case valueTypeList:
+		return db.listIndex.mu
+	case valueTypeHash:
+		return db.hashIndex.mu
+	case valueTypeSet:
+		return db.setIndex.mu
+	case valueTypeZSet:
+		return db.zSetIndex.mu
+	}
+	if ct := db.getCustomType(typ); ct != nil {
+		return ct.index.mu
+	}
+	return db.zSetIndex.mu
+}
+
 func (db *LazyDB) getActiveLogFile(typ valueType) *MutexLogFile {
 	mutexLf, ok := db.activeLogFileMap[typ]
 	if !ok {
-		lf, err := logfile.Open(db.cfg.DBPath, 1, db.cfg.MaxLogFileSize, logfile.FType(typ), db.cfg.IOType)
+		fid := db.startFid()
+		fids := db.fidsMap[typ]
+		fids.mu.RLock()
+		if fids.dropped >= fid {
+			fid = db.nextFid(fids.dropped)
+		}
+		fids.mu.RUnlock()
+		lf, err := db.createLogFile(typ, db.availableFid(typ, fid))
 		if err != nil {
 			log.Fatalf("Create New Log File error: %v", err)
 			return nil
 		}
-		newMutexLf := &MutexLogFile{lf: lf}
+		newMutexLf := &MutexLogFile{lf: lf, footer: &logfile.Footer{}, createdAt: db.now()}
 		db.activeLogFileMap[typ] = newMutexLf
 
-		fids := db.fidsMap[typ]
 		fids.mu.Lock()
 		fids.fids = append(fids.fids, lf.Fid)
 		fids.mu.Unlock()
@@ -614,6 +2008,23 @@ func (db *LazyDB) getActiveLogFile(typ valueType) *MutexLogFile {
 	}
 	return mutexLf
 }
+
+// startFid returns the fid of the first log file.
+func (db *LazyDB) startFid() uint32 {
+	if db.cfg.StartFid == 0 {
+		return 1
+	}
+	return db.cfg.StartFid
+}
+
+// nextFid returns the fid of the log file created after the given one.
+func (db *LazyDB) nextFid(fid uint32) uint32 {
+	if db.cfg.FidIncrement == 0 {
+		return fid + 1
+	}
+	return fid + db.cfg.FidIncrement
+}
+
 func (db *LazyDB) initDiscard() error {
 	discardPath := path.Join(db.cfg.DBPath, discardFilePath)
 	if !util.PathExist(discardPath) {
@@ -624,7 +2035,8 @@ func (db *LazyDB) initDiscard() error {
 
 	discardsMap := make(map[valueType]*discard)
 	for i := 0; i < logFileTypeNum; i++ {
-		name := logfile.FileNamesMap[logfile.FType(i)] + discardFileName
+		prefix, _ := logfile.FileNamePrefix(logfile.FType(i))
+		name := prefix + discardFileName
 		d, err := newDiscard(discardPath, name, db.cfg.DiscardBufferSize)
 		if err != nil {
 			return err
@@ -644,6 +2056,11 @@ func (db *LazyDB) sendDiscard(oldVal any, updated bool, typ valueType) error {
 	if node == nil || node.entrySize == 0 {
 		return nil
 	}
+	if node.ref != nil {
+		db.releaseInterned(node.ref)
+	} else if db.valueCache != nil && typ == valueTypeString {
+		db.valueCache.remove(node.fid, node.offset)
+	}
 
 	select {
 	case db.discardsMap[typ].valChan <- node:
@@ -653,6 +2070,64 @@ func (db *LazyDB) sendDiscard(oldVal any, updated bool, typ valueType) error {
 	return nil
 }
 
+// now returns the current time of db clock.
+// readOnly returns whether db is opened by OpenFS.
+func (db *LazyDB) readOnly() bool {
+	return db.fsys != nil
+}
+
+// checkRewrite returns the error why log files can't be rewritten by merge or compaction, if any.
+// Entries of keys skipped by DBConfig.RecoveryFilter are not in the indexes, so they would be dropped as stale.
+func (db *LazyDB) checkRewrite() error {
+	if db.readOnly() {
+		return ErrReadOnly
+	}
+	if db.cfg.RecoveryFilter != nil {
+		return ErrPartialIndex
+	}
+	return nil
+}
+
+func (db *LazyDB) now() time.Time {
+	if db.clock == nil {
+		return time.Now()
+	}
+	return db.clock()
+}
+
+// expiredAtMilli converts expiredAt of a log entry into unix milliseconds.
+// Entries written by older versions hold expiredAt in unix seconds.
+func expiredAtMilli(expiredAt int64) int64 {
+	if expiredAt > 0 && expiredAt < secondExpiredAtBound {
+		return expiredAt * int64(time.Second/time.Millisecond)
+	}
+	return expiredAt
+}
+
+// CollectionCodec packs the key of a collection and the key of an element in it, a field of a hash or a member of
+// a sorted set, into the key of a log entry, and unpacks them, see DBConfig.CollectionCodec.
+// Decode must return the key and subKey given to Encode, and Encode must be deterministic.
+type CollectionCodec interface {
+	Encode(key, subKey []byte) []byte
+	Decode(data []byte) (key, subKey []byte)
+}
+
+// encodeKey packs key and subKey by DBConfig.CollectionCodec, or by the default format if it is nil.
+func (db *LazyDB) encodeKey(key, subKey []byte) []byte {
+	if db.cfg.CollectionCodec != nil {
+		return db.cfg.CollectionCodec.Encode(key, subKey)
+	}
+	return encodeKey(key, subKey)
+}
+
+// decodeKey unpacks key and subKey packed by encodeKey.
+func (db *LazyDB) decodeKey(data []byte) ([]byte, []byte) {
+	if db.cfg.CollectionCodec != nil {
+		return db.cfg.CollectionCodec.Decode(data)
+	}
+	return decodeKey(data)
+}
+
 func encodeKey(key, subKey []byte) []byte {
 	header := make([]byte, encodeHeaderSize)
 	var index int
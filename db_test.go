@@ -2,15 +2,24 @@ package lazydb
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/billsjc123/LazyDB/ds"
+	"github.com/billsjc123/LazyDB/iocontroller"
 	"github.com/billsjc123/LazyDB/logfile"
 	"github.com/billsjc123/LazyDB/util"
 	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/stretchr/testify/assert"
@@ -61,6 +70,150 @@ func TestLazyDB_Close(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestLazyDB_ScanAll(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	_, _, err := db.ScanAll(0, 0)
+	assert.Equal(t, ErrInvalidParam, err)
+
+	want := make(map[string]valueType)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+		want[fmt.Sprintf("%d:%s", valueTypeString, GetKey(i))] = valueTypeString
+		assert.Nil(t, db.HSet(GetKey(i), []byte("f"), GetValue32()))
+		want[fmt.Sprintf("%d:%s", valueTypeHash, GetKey(i))] = valueTypeHash
+		assert.Nil(t, db.RPush(GetKey(i), GetValue32()))
+		want[fmt.Sprintf("%d:%s", valueTypeList, GetKey(i))] = valueTypeList
+		assert.Nil(t, db.SAdd(GetKey(i), []byte("m")))
+		want[fmt.Sprintf("%d:%s", valueTypeSet, GetKey(i))] = valueTypeSet
+	}
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, db.ZAdd(GetKey(i), util.Float64ToByte(1), []byte("m")))
+		want[fmt.Sprintf("%d:%s", valueTypeZSet, GetKey(i))] = valueTypeZSet
+	}
+
+	for _, count := range []int{1, 3, 5, 100} {
+		got := make(map[string]valueType)
+		var cursor uint64
+		pages := 0
+		for {
+			next, keyTypes, err := db.ScanAll(cursor, count)
+			assert.Nil(t, err)
+			assert.LessOrEqual(t, len(keyTypes), count)
+			for _, kt := range keyTypes {
+				id := fmt.Sprintf("%d:%s", kt.Type, kt.Key)
+				_, dup := got[id]
+				assert.False(t, dup, "duplicate key %s", id)
+				got[id] = kt.Type
+			}
+			pages++
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+		assert.Equal(t, want, got)
+		assert.Equal(t, (len(want)+count-1)/count, pages)
+	}
+}
+
+func TestLazyDB_ScanMatchType(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+
+	_, _, err := db.ScanMatchType(0, "", "", 0)
+	assert.Equal(t, ErrInvalidParam, err)
+	_, _, err = db.ScanMatchType(0, "", "stream", 10)
+	assert.Equal(t, ErrInvalidParam, err)
+
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("user:%d", i)), GetValue32()))
+		assert.Nil(t, db.HSet([]byte(fmt.Sprintf("user:%d:profile", i)), []byte("f"), GetValue32()))
+		assert.Nil(t, db.HSet([]byte(fmt.Sprintf("order:%d", i)), []byte("f"), GetValue32()))
+	}
+	assert.Nil(t, db.SAdd([]byte("user:set"), []byte("m")))
+
+	scan := func(match, typ string, count int) []string {
+		var keys []string
+		var cursor uint64
+		for {
+			next, page, err := db.ScanMatchType(cursor, match, typ, count)
+			assert.Nil(t, err)
+			for _, key := range page {
+				keys = append(keys, string(key))
+			}
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	var want []string
+	for i := 0; i < 20; i++ {
+		want = append(want, fmt.Sprintf("user:%d:profile", i))
+	}
+	sort.Strings(want)
+	for _, count := range []int{1, 7, 100} {
+		assert.Equal(t, want, scan("user:*", "hash", count))
+	}
+	teens := []string{"user:10", "user:11", "user:12", "user:13", "user:14", "user:15", "user:16", "user:17",
+		"user:18", "user:19"}
+	assert.Equal(t, teens, scan("user:1?", "string", 3))
+	assert.Equal(t, teens, scan("user:1[0-9]", "string", 3))
+	assert.Equal(t, []string{"user:0", "user:1"}, scan("user:[^2-9]", "string", 3))
+	assert.Equal(t, []string{"user:set"}, scan("user:*", "set", 3))
+	assert.Equal(t, 41, len(scan("user:*", "", 5)))
+	assert.Empty(t, scan("user:*", "zset", 5))
+}
+
+func TestLazyDB_ScanMatchTypeConcurrentWrites(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+
+	stable := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("stable:%d", i)
+		assert.Nil(t, db.Set([]byte(key), GetValue32()))
+		stable[key] = true
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			// keys are written and deleted all over the hash space
+			_ = db.Set([]byte(fmt.Sprintf("volatile:%d", i%500)), GetValue32())
+			_ = db.Delete([]byte(fmt.Sprintf("volatile:%d", (i+250)%500)))
+		}
+	}()
+
+	for round := 0; round < 20; round++ {
+		got := make(map[string]bool)
+		var cursor uint64
+		for {
+			next, keys, err := db.ScanMatchType(cursor, "stable:*", "string", 10)
+			assert.Nil(t, err)
+			for _, key := range keys {
+				got[string(key)] = true
+			}
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+		assert.Equal(t, stable, got)
+	}
+	close(stop)
+	<-done
+}
+
 func TestLazyDB_Merge(t *testing.T) {
 	wd, _ := os.Getwd()
 	path := filepath.Join(wd, "tmp")
@@ -108,6 +261,504 @@ func TestLazyDB_Merge(t *testing.T) {
 	defer destroyDB(db)
 }
 
+func TestLazyDB_MergeConcurrentGet(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_merge_concurrent_get")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 200
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	key, value := GetKey(0), GetValue32()
+	assert.Nil(t, db.Set(key, value))
+
+	var reads, failures int64
+	var firstErr atomic.Value
+	stop := make(chan struct{})
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				val, err := db.Get(key)
+				atomic.AddInt64(&reads, 1)
+				if err != nil || !bytes.Equal(value, val) {
+					atomic.AddInt64(&failures, 1)
+					firstErr.CompareAndSwap(nil, fmt.Sprintf("value: %q, err: %v", val, err))
+				}
+			}
+		}()
+	}
+
+	fidOfKey := func() uint32 {
+		db.strIndex.mu.RLock()
+		defer db.strIndex.mu.RUnlock()
+		return db.strIndex.idxTree.Get(key).(*Value).fid
+	}
+	for round := 0; round < 50; round++ {
+		// the key is merged out of its file, which is then deleted
+		for fidOfKey() == db.getActiveLogFile(valueTypeString).lf.Fid {
+			assert.Nil(t, db.Set(GetKey(1), GetValue32()))
+		}
+		fid := fidOfKey()
+		assert.Nil(t, db.Merge(valueTypeString, fid, -1))
+		assert.Nil(t, db.getArchivedLogFile(valueTypeString, fid))
+	}
+	close(stop)
+	wg.Wait()
+	assert.Greater(t, atomic.LoadInt64(&reads), int64(0))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&failures), firstErr.Load())
+}
+
+func TestLazyDB_RemoveAcquiredLogFile(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_remove_acquired_log_file")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 200
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+	}
+	fid := db.fidsMap[valueTypeString].fids[0]
+	lf, err := db.acquireLogFile(valueTypeString, fid)
+	assert.Nil(t, err)
+	fileName := logFileName(path, logfile.Strs, fid)
+
+	// a removed log file is not deleted until it is released
+	db.removeArchivedLogFile(valueTypeString, fid)
+	_, err = db.acquireLogFile(valueTypeString, fid)
+	assert.Equal(t, ErrLogFileNotExist, err)
+	_, err = os.Stat(fileName)
+	assert.Nil(t, err)
+	ent, _, err := lf.ReadLogEntry(0)
+	assert.Nil(t, err)
+	assert.Equal(t, GetKey(0), ent.Key)
+
+	db.releaseLogFile(valueTypeString, fid)
+	_, err = os.Stat(fileName)
+	assert.True(t, os.IsNotExist(err))
+	// the read count of the deleted log file is dropped
+	_, ok := db.fileRefs.files.Load(logFileCacheKey{typ: valueTypeString, fid: fid})
+	assert.False(t, ok)
+}
+
+func TestLazyDB_RetireAcquiredLogFileTwice(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_retire_acquired_log_file_twice")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 200
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// stale entries of the key in fid 1 are removed by CompactKey
+	assert.Nil(t, db.Set(GetKey(0), GetValue32()))
+	assert.Nil(t, db.Set(GetKey(0), GetValue32()))
+	for i := 1; i < 10; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+	}
+	fid := db.fidsMap[valueTypeString].fids[0]
+	lf, err := db.acquireLogFile(valueTypeString, fid)
+	assert.Nil(t, err)
+
+	// the replaced log file and then the rewritten one of the same fid are retired while it is held
+	assert.Nil(t, db.CompactKey(GetKey(0)))
+	assert.NotEqual(t, lf, db.getArchivedLogFile(valueTypeString, fid).lf)
+	rewritten := db.getArchivedLogFile(valueTypeString, fid).lf
+	db.removeArchivedLogFile(valueTypeString, fid)
+	_, _, err = lf.ReadLogEntry(0)
+	assert.Nil(t, err)
+
+	// both are closed by the last release
+	db.releaseLogFile(valueTypeString, fid)
+	for _, f := range []*logfile.LogFile{lf, rewritten} {
+		_, _, err = f.ReadLogEntry(0)
+		assert.NotNil(t, err)
+	}
+	_, err = os.Stat(logFileName(path, logfile.Strs, fid))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLazyDB_MergeDuringUnlockedGet(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_merge_during_unlocked_get")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 200
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	key, value := GetKey(0), GetValue32()
+	assert.Nil(t, db.Set(key, value))
+	fid := db.getActiveLogFile(valueTypeString).lf.Fid
+	fileName := logFileName(path, logfile.Strs, fid)
+
+	reading, proceed := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	readLogEntryHook = func(typ valueType, readFid uint32, offset int64) {
+		if typ == valueTypeString && readFid == fid {
+			once.Do(func() {
+				close(reading)
+				<-proceed
+			})
+		}
+	}
+	defer func() {
+		readLogEntryHook = nil
+	}()
+
+	type result struct {
+		val []byte
+		err error
+	}
+	got := make(chan result)
+	go func() {
+		val, err := db.Get(key)
+		got <- result{val: val, err: err}
+	}()
+	<-reading
+
+	// the active log file is archived and merged while it is being read, the index lock is not held by the read
+	for db.getActiveLogFile(valueTypeString).lf.Fid == fid {
+		assert.Nil(t, db.Set(GetKey(1), GetValue32()))
+	}
+	assert.Nil(t, db.Merge(valueTypeString, fid, -1))
+	assert.Nil(t, db.getArchivedLogFile(valueTypeString, fid))
+	_, err = os.Stat(fileName)
+	assert.Nil(t, err)
+
+	close(proceed)
+	res := <-got
+	assert.Nil(t, res.err)
+	assert.Equal(t, value, res.val)
+	// deleted once the read is finished
+	_, err = os.Stat(fileName)
+	assert.True(t, os.IsNotExist(err))
+
+	val, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+}
+
+func TestLazyDB_MergeCorruptedEntry(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "tmp")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 500
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// fid 1 is full after 6 entries, overwrite all keys except key 0 in fid 2
+	values := make([][]byte, 6)
+	for i := 0; i < 6; i++ {
+		values[i] = GetValue32()
+		assert.Nil(t, db.Set(GetKey(i), values[i]))
+	}
+	for i := 1; i < 6; i++ {
+		values[i] = GetValue32()
+		assert.Nil(t, db.Set(GetKey(i), values[i]))
+	}
+	// discards are updated in background
+	assert.Eventually(t, func() bool {
+		ccl, err := db.discardsMap[valueTypeString].getCCL(db.getActiveLogFile(valueTypeString).lf.Fid, 0)
+		return err == nil && len(ccl) == 1 && ccl[0] == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// corrupt the live entry of key 0
+	val, _ := db.strIndex.idxTree.Get(GetKey(0)).(*Value)
+	assert.Equal(t, uint32(1), val.fid)
+	lf := db.getArchivedLogFile(valueTypeString, 1).lf
+	_, err = lf.IoController.Write([]byte{0xff}, val.offset+int64(val.entrySize)-1)
+	assert.Nil(t, err)
+
+	err = db.Merge(valueTypeString, 1, 0)
+	assert.True(t, errors.Is(err, ErrCorruptedEntry))
+	assert.Contains(t, err.Error(), fmt.Sprintf("fid: %d, offset: %d", val.fid, val.offset))
+	// source file is intact
+	assert.NotNil(t, db.getArchivedLogFile(valueTypeString, 1))
+	_, err = os.Stat(logFileName(path, logfile.Strs, 1))
+	assert.Nil(t, err)
+
+	// force skips the corrupted entry
+	err = db.MergeWithOptions(valueTypeString, 1, 0, MergeOptions{Force: true})
+	assert.Nil(t, err)
+	assert.Nil(t, db.getArchivedLogFile(valueTypeString, 1))
+	for i := 1; i < 6; i++ {
+		got, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], got)
+	}
+}
+
+func TestLazyDB_MergeProgress(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "tmp")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 500
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 6; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+	}
+	for i := 1; i < 6; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+	}
+	assert.Eventually(t, func() bool {
+		ccl, err := db.discardsMap[valueTypeString].getCCL(db.getActiveLogFile(valueTypeString).lf.Fid, 0)
+		return err == nil && len(ccl) == 1 && ccl[0] == 1
+	}, time.Second, 10*time.Millisecond)
+	size := db.getArchivedLogFile(valueTypeString, 1).lf.Offset
+
+	var dones []int64
+	progress := func(done, total int64) {
+		assert.Equal(t, size, total)
+		dones = append(dones, done)
+	}
+	err = db.MergeWithOptions(valueTypeString, 1, 0, MergeOptions{Progress: progress})
+	assert.Nil(t, err)
+
+	assert.Greater(t, len(dones), 1)
+	for i := 1; i < len(dones); i++ {
+		assert.Greater(t, dones[i], dones[i-1])
+	}
+	assert.Equal(t, size, dones[len(dones)-1])
+}
+
+func TestLazyDB_MergeVerify(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "tmp")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 500
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// only key 0 is live in fid 1
+	values := make([][]byte, 6)
+	for i := 0; i < 6; i++ {
+		values[i] = GetValue32()
+		assert.Nil(t, db.Set(GetKey(i), values[i]))
+	}
+	for i := 1; i < 6; i++ {
+		values[i] = GetValue32()
+		assert.Nil(t, db.Set(GetKey(i), values[i]))
+	}
+	assert.Eventually(t, func() bool {
+		ccl, err := db.discardsMap[valueTypeString].getCCL(db.getActiveLogFile(valueTypeString).lf.Fid, 0)
+		return err == nil && len(ccl) == 1 && ccl[0] == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// a buggy rewrite writes the entry under another key
+	rewriteLogEntryHook = func(typ valueType, ent *logfile.LogEntry) {
+		ent.Key = append([]byte("corrupted-"), ent.Key...)
+	}
+	err = db.MergeWithOptions(valueTypeString, 1, 0, MergeOptions{Verify: true})
+	rewriteLogEntryHook = nil
+	assert.ErrorIs(t, err, ErrMergeVerification)
+	// source file is intact
+	assert.NotNil(t, db.getArchivedLogFile(valueTypeString, 1))
+	_, err = os.Stat(logFileName(path, logfile.Strs, 1))
+	assert.Nil(t, err)
+	for i := range values {
+		got, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], got)
+	}
+
+	assert.Nil(t, db.MergeWithOptions(valueTypeString, 1, 0, MergeOptions{Verify: true}))
+	assert.Nil(t, db.getArchivedLogFile(valueTypeString, 1))
+	for i := range values {
+		got, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], got)
+	}
+}
+
+// writeScrambledByTime writes n keys with timestamps in random order by the clock of db, so that keys written close
+// together in time are spread across log files. It returns the keys by the second they are written in.
+func writeScrambledByTime(db *LazyDB, n int) ([][]byte, error) {
+	base := time.Now()
+	byTime := make([][]byte, n)
+	for i, sec := range rand.New(rand.NewSource(1)).Perm(n) {
+		now := base.Add(time.Duration(sec) * time.Second)
+		db.clock = func() time.Time { return now }
+		if err := db.Set(GetKey(i), GetValue(128)); err != nil {
+			return nil, err
+		}
+		byTime[sec] = GetKey(i)
+	}
+	db.clock = nil
+	// makes fid 1 stale enough to be merged
+	return byTime, db.Set(GetKey(0), GetValue(128))
+}
+
+func TestLazyDB_MergeGroupByRecency(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_merge_recency"))
+	cfg.MaxLogFileSize = 16 << 10
+	cfg.RecordTimestamps = true
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	_, err = writeScrambledByTime(db, 500)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Delete(GetKey(1)))
+	values := make(map[string][]byte)
+	var merged [][]byte
+	for i := 2; i < 500; i++ {
+		val, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		values[string(GetKey(i))] = val
+		if idxNode, _ := db.strIndex.idxTree.Get(GetKey(i)).(*Value); idxNode.fid == 1 {
+			merged = append(merged, GetKey(i))
+		}
+	}
+	assert.Greater(t, len(merged), 1)
+	assert.Eventually(t, func() bool {
+		ccl, err := db.discardsMap[valueTypeString].getCCL(db.getActiveLogFile(valueTypeString).lf.Fid, 0)
+		return err == nil && len(ccl) > 0 && ccl[0] == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, db.MergeWithOptions(valueTypeString, 1, 0, MergeOptions{GroupByRecency: true}))
+	assert.Nil(t, db.getArchivedLogFile(valueTypeString, 1))
+
+	// rewritten entries are in order of timestamps
+	rewritten := make([]*Value, len(merged))
+	for i, key := range merged {
+		rewritten[i] = db.strIndex.idxTree.Get(key).(*Value)
+	}
+	sort.Slice(rewritten, func(i, j int) bool {
+		if rewritten[i].fid != rewritten[j].fid {
+			return rewritten[i].fid < rewritten[j].fid
+		}
+		return rewritten[i].offset < rewritten[j].offset
+	})
+	for i := 1; i < len(rewritten); i++ {
+		assert.LessOrEqual(t, rewritten[i-1].writtenAt, rewritten[i].writtenAt)
+	}
+
+	check := func() {
+		for key, val := range values {
+			got, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, val, got)
+		}
+		_, err := db.Get(GetKey(1))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	check()
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	check()
+}
+
+// BenchmarkMerge_GroupByRecency reads keys written in the same period of time, after a log file of keys written
+// in random order of time is merged in order of offsets or grouped by recency.
+func BenchmarkMerge_GroupByRecency(b *testing.B) {
+	for _, group := range []bool{false, true} {
+		name := "arbitrary"
+		if group {
+			name = "recency-grouped"
+		}
+		b.Run(name, func(b *testing.B) {
+			wd, _ := os.Getwd()
+			cfg := DefaultDBConfig(filepath.Join(wd, "test_merge_recency_benchmark"))
+			cfg.MaxLogFileSize = 1 << 20
+			cfg.RecordTimestamps = true
+			db, err := Open(cfg)
+			assert.Nil(b, err)
+			defer destroyDB(db)
+			byTime, err := writeScrambledByTime(db, 20000)
+			assert.Nil(b, err)
+			assert.Eventually(b, func() bool {
+				ccl, err := db.discardsMap[valueTypeString].getCCL(db.getActiveLogFile(valueTypeString).lf.Fid, 0)
+				return err == nil && len(ccl) > 0 && ccl[0] == 1
+			}, time.Second, 10*time.Millisecond)
+			// only keys of the merged log file are read
+			var merged [][]byte
+			for _, key := range byTime {
+				if idxNode, _ := db.strIndex.idxTree.Get(key).(*Value); idxNode.fid == 1 {
+					merged = append(merged, key)
+				}
+			}
+			byTime = merged
+			assert.Nil(b, db.MergeWithOptions(valueTypeString, 1, 0, MergeOptions{GroupByRecency: group}))
+
+			const window = 100
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := (i * window) % (len(byTime) - window)
+				for _, key := range byTime[start : start+window] {
+					if _, err := db.Get(key); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestLazyDB_BlockAlign(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_block_align")
+	cfg := DefaultDBConfig(path)
+	cfg.BlockAlign = 512
+	cfg.MaxLogFileSize = 4096
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	values := make([][]byte, 20)
+	for i := range values {
+		values[i] = GetValue(i * 50)
+		assert.Nil(t, db.Set(GetKey(i), values[i]))
+	}
+	assert.Nil(t, db.HSet([]byte("hash"), []byte("field"), []byte("value")))
+	assert.Nil(t, db.Delete(GetKey(0)))
+
+	for i := 1; i < len(values); i++ {
+		val, _ := db.strIndex.idxTree.Get(GetKey(i)).(*Value)
+		assert.Equal(t, int64(0), val.offset%512)
+		assert.Equal(t, 0, val.entrySize%512)
+	}
+
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+
+	_, err = db.Get(GetKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	for i := 1; i < len(values); i++ {
+		got, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], got)
+	}
+	got, err := db.HGet([]byte("hash"), []byte("field"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), got)
+	// new entries are appended at block boundaries after recovery
+	assert.Equal(t, int64(0), db.getActiveLogFile(valueTypeString).lf.Offset%512)
+}
+
 func TestLazyDB_ReadLogEntry(t *testing.T) {
 	wd, _ := os.Getwd()
 	path := filepath.Join(wd, "tmp")
@@ -150,7 +801,7 @@ func TestLazyDB_ReadLogEntry(t *testing.T) {
 			arg: arg{
 				typ:    valueTypeString,
 				fid:    1,
-				offset: 74,
+				offset: 75,
 			},
 			expectedKey:      entry2.Key,
 			expectedValue:    entry2.Value,
@@ -207,7 +858,7 @@ func TestLazyDB_WriteLogEntry(t *testing.T) {
 			},
 			wantFid:       1,
 			wantOffset:    0,
-			wantEntrySize: 74,
+			wantEntrySize: 75,
 		},
 		{
 			args: args{
@@ -215,8 +866,8 @@ func TestLazyDB_WriteLogEntry(t *testing.T) {
 				value: GetValue32(),
 			},
 			wantFid:       1,
-			wantOffset:    74,
-			wantEntrySize: 74,
+			wantOffset:    75,
+			wantEntrySize: 75,
 		},
 		{
 			args: args{
@@ -225,7 +876,7 @@ func TestLazyDB_WriteLogEntry(t *testing.T) {
 			},
 			wantFid:       2,
 			wantOffset:    0,
-			wantEntrySize: 74,
+			wantEntrySize: 75,
 		},
 	}
 
@@ -238,6 +889,48 @@ func TestLazyDB_WriteLogEntry(t *testing.T) {
 	}
 }
 
+func TestLazyDB_WriteLogEntryDiskFull(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_disk_full")
+	cfg := DefaultDBConfig(path)
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	assert.Nil(t, db.Set(GetKey(1), GetValue32()))
+	lf := db.getActiveLogFile(valueTypeString).lf
+	offset := lf.Offset
+	writes := db.Stats().Writes
+
+	// only a part of the next entry fits on the device
+	full := &fullDiskIOController{IOController: lf.IoController, end: offset, left: 10}
+	lf.IoController = full
+	err = db.Set(GetKey(2), GetValue32())
+	assert.True(t, errors.Is(err, ErrDiskFull))
+	assert.Equal(t, offset, lf.Offset)
+	assert.Equal(t, writes, db.Stats().Writes)
+	_, err = db.Get(GetKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the partial entry is rolled back
+	_, _, err = lf.ReadLogEntry(offset)
+	assert.Equal(t, logfile.ErrLogEndOfFile, err)
+
+	// writes succeed once there is space again
+	lf.IoController = full.IOController
+	value := GetValue32()
+	assert.Nil(t, db.Set(GetKey(2), value))
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Empty(t, db.RecoveryReport().SkippedFiles)
+	val, err := db.Get(GetKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+	_, err = db.Get(GetKey(1))
+	assert.Nil(t, err)
+}
+
 func TestLazyDB_BuildLogFile(t *testing.T) {
 	// Create Two Log File for test, same logic as TestLazyDB_WriteLogEntry
 	wd, _ := os.Getwd()
@@ -303,16 +996,17 @@ func TestEncodeKey_DecodeKey(t *testing.T) {
 		args args
 	}{
 		{name: "normal", args: args{key: []byte("k1"), subKey: []byte("f1")}},
-		{name: "both empty", args: args{key: []byte(""), subKey: []byte("")}},
-		{name: "empty ", args: args{key: []byte(""), subKey: []byte("")}},
+		{name: "empty key", args: args{key: []byte(""), subKey: []byte("f1")}},
+		{name: "empty subKey", args: args{key: []byte("k1"), subKey: []byte("")}},
 		{name: "both empty", args: args{key: []byte(""), subKey: []byte("")}},
 	}
 
 	for _, tt := range tests {
 		encoded := encodeKey(tt.args.key, tt.args.subKey)
+		assert.NotEmpty(t, encoded)
 		gotKey, gotSubkey := decodeKey(encoded)
-		assert.NotEqual(t, tt.args.key, gotKey)
-		assert.NotEqual(t, tt.args.subKey, gotSubkey)
+		assert.Equal(t, tt.args.key, gotKey)
+		assert.Equal(t, tt.args.subKey, gotSubkey)
 	}
 }
 
@@ -349,3 +1043,949 @@ func GetValue(n int) []byte {
 	}
 	return str.Bytes()
 }
+
+func TestLazyDB_StartFid(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_start_fid")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 150 //  set max file so that it can only contain 2 entry in a file
+	cfg.StartFid = 1000
+	cfg.FidIncrement = 10
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	var wantFids = []uint32{1000, 1000, 1010, 1010, 1020}
+	for i, wantFid := range wantFids {
+		valPos, err := db.writeLogEntry(valueTypeString, &logfile.LogEntry{Key: GetKey(i), Value: GetValue32()})
+		assert.Nil(t, err)
+		assert.Equal(t, wantFid, valPos.fid)
+	}
+	assert.Equal(t, []uint32{1000, 1010, 1020}, db.fidsMap[valueTypeString].fids)
+
+	// the max fid is picked as active log file after restarting
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1020), db.getActiveLogFile(valueTypeString).lf.Fid)
+	assert.NotNil(t, db.getArchivedLogFile(valueTypeString, 1000))
+	assert.NotNil(t, db.getArchivedLogFile(valueTypeString, 1010))
+
+	valPos, err := db.writeLogEntry(valueTypeString, &logfile.LogEntry{Key: GetKey(5), Value: GetValue32()})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1020), valPos.fid)
+	valPos, err = db.writeLogEntry(valueTypeString, &logfile.LogEntry{Key: GetKey(6), Value: GetValue32()})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1030), valPos.fid)
+}
+
+func TestLazyDB_SyncDir(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_sync_dir")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 150 //  set max file so that it can only contain 2 entry in a file
+
+	var synced []string
+	defer func() {
+		syncDir = util.SyncDir
+	}()
+	syncDir = func(dir string) error {
+		synced = append(synced, dir)
+		return util.SyncDir(dir)
+	}
+
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	// the directory is synced once the first log file and every rolled one is created
+	values := make([][]byte, 5)
+	for i := range values {
+		values[i] = GetValue32()
+		assert.Nil(t, db.Set(GetKey(i), values[i]))
+	}
+	assert.Equal(t, []uint32{1, 2, 3}, db.fidsMap[valueTypeString].fids)
+	assert.Equal(t, []string{path, path, path}, synced)
+
+	// simulate a crash, entries in synced log files are recovered without closing the db
+	assert.Nil(t, db.Sync())
+	crashed := db
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{1, 2, 3}, db.fidsMap[valueTypeString].fids)
+	for i := range values {
+		val, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+	}
+	assert.Nil(t, crashed.Close())
+
+	// skipped if NoSyncDir is on
+	synced = nil
+	db.cfg.NoSyncDir = true
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+	}
+	assert.Greater(t, len(db.fidsMap[valueTypeString].fids), 3)
+	assert.Empty(t, synced)
+}
+
+func TestLazyDB_CompactActive(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_compact_active")
+	cfg := DefaultDBConfig(path)
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	var value, fieldValue []byte
+	for i := 0; i < 1000; i++ {
+		value, fieldValue = GetValue32(), GetValue32()
+		assert.Nil(t, db.Set(GetKey(1), value))
+		assert.Nil(t, db.HSet(GetKey(1), []byte("f1"), fieldValue))
+	}
+	assert.Nil(t, db.Set(GetKey(2), GetValue32()))
+	assert.Nil(t, db.Delete(GetKey(2)))
+
+	for _, typ := range []valueType{valueTypeString, valueTypeHash} {
+		sealedFid := db.getActiveLogFile(typ).lf.Fid
+		usedBefore := db.getActiveLogFile(typ).lf.Offset
+
+		err = db.CompactActive(typ)
+		assert.Nil(t, err)
+
+		activeLogFile := db.getActiveLogFile(typ).lf
+		assert.NotEqual(t, sealedFid, activeLogFile.Fid)
+		assert.Less(t, activeLogFile.Offset*100, usedBefore)
+		assert.Nil(t, db.getArchivedLogFile(typ, sealedFid))
+		fileName := logFileName(path, logfile.FType(typ), sealedFid)
+		assert.False(t, util.PathExist(fileName))
+	}
+
+	got, err := db.Get(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, got)
+	_, err = db.Get(GetKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	got, err = db.HGet(GetKey(1), []byte("f1"))
+	assert.Nil(t, err)
+	assert.Equal(t, fieldValue, got)
+
+	// compacted data can be recovered after restarting
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	got, err = db.Get(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, got)
+	_, err = db.Get(GetKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestLazyDB_CompactActiveKeepTombstones(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_compact_active_tombstones")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 150
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	// the old value of k2 is archived, and the delete entry is in the active log file
+	assert.Nil(t, db.Set([]byte("k2"), bytes.Repeat([]byte("2"), 100)))
+	assert.Nil(t, db.Set([]byte("k3"), bytes.Repeat([]byte("3"), 100)))
+	assert.Nil(t, db.Delete([]byte("k2")))
+	activeFid := db.getActiveLogFile(valueTypeString).lf.Fid
+	assert.True(t, db.hasOlderLogFile(valueTypeString, activeFid))
+
+	assert.Nil(t, db.CompactActive(valueTypeString))
+	assert.Nil(t, db.getArchivedLogFile(valueTypeString, activeFid))
+	_, err = db.Get([]byte("k2"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the delete entry is kept, so the archived old value does not come back
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("k2"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	got, err := db.Get([]byte("k3"))
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("3"), 100), got)
+}
+
+func TestLazyDB_GetAny(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	assert.Nil(t, db.Set([]byte("str"), []byte("v1")))
+	assert.Nil(t, db.HSet([]byte("hash"), []byte("f1"), []byte("v1"), []byte("f2"), []byte("v2")))
+	assert.Nil(t, db.RPush([]byte("list"), []byte("v1"), []byte("v2")))
+	assert.Nil(t, db.SAdd([]byte("set"), []byte("v1")))
+	assert.Nil(t, db.ZAdd([]byte("zset"), util.Float64ToByte(2), []byte("m2"), util.Float64ToByte(1), []byte("m1")))
+	assert.Nil(t, db.PSetEX([]byte("expired"), []byte("v1"), 1))
+	time.Sleep(10 * time.Millisecond)
+
+	tests := []struct {
+		key     string
+		want    interface{}
+		wantTyp valueType
+		wantErr error
+	}{
+		{key: "str", want: []byte("v1"), wantTyp: valueTypeString},
+		{key: "hash", want: map[string][]byte{"f1": []byte("v1"), "f2": []byte("v2")}, wantTyp: valueTypeHash},
+		{key: "list", want: [][]byte{[]byte("v1"), []byte("v2")}, wantTyp: valueTypeList},
+		{key: "set", want: [][]byte{[]byte("v1")}, wantTyp: valueTypeSet},
+		{key: "zset", want: []ZMember{{Member: []byte("m1"), Score: 1}, {Member: []byte("m2"), Score: 2}}, wantTyp: valueTypeZSet},
+		{key: "expired", wantErr: ErrKeyNotFound},
+		{key: "not_exist", wantErr: ErrKeyNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			got, typ, err := db.GetAny([]byte(tt.key))
+			assert.Equal(t, tt.wantErr, err)
+			if tt.wantErr != nil {
+				return
+			}
+			assert.Equal(t, tt.wantTyp, typ)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestLazyDB_MergeInto(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_merge_into")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 500 // 6 entries in a file
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	// fid 1~4 are full, only the first entry of fid 1~3 is alive, fid 5 is active
+	values := make(map[int][]byte)
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 6; j++ {
+			key := i*6 + j
+			if i < 3 && j > 0 {
+				key = 100
+			}
+			values[key] = GetValue32()
+			assert.Nil(t, db.Set(GetKey(key), values[key]))
+		}
+	}
+	values[200] = GetValue32()
+	assert.Nil(t, db.Set(GetKey(200), values[200]))
+	assert.Equal(t, uint32(5), db.getActiveLogFile(valueTypeString).lf.Fid)
+
+	// consolidate fid 1~3 into fid 4, which has no room for them, so they go to the active file
+	for _, fid := range []uint32{1, 2, 3} {
+		err = db.MergeInto(valueTypeString, fid, 4)
+		assert.Nil(t, err)
+		assert.Nil(t, db.getArchivedLogFile(valueTypeString, fid))
+	}
+	assert.Equal(t, 1, db.archivedLogFile[valueTypeString].Size())
+
+	// consolidate fid 4 into the active file, which rolls over
+	err = db.MergeInto(valueTypeString, 4, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, db.archivedLogFile[valueTypeString].Size())
+	assert.NotNil(t, db.getArchivedLogFile(valueTypeString, 5))
+
+	for key, value := range values {
+		got, err := db.Get(GetKey(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, got)
+	}
+
+	assert.Equal(t, ErrLogFileNotExist, db.MergeInto(valueTypeString, 1, 6))
+	assert.Equal(t, ErrInvalidParam, db.MergeInto(valueTypeString, 5, 5))
+	assert.Equal(t, ErrInvalidParam, db.MergeInto(valueTypeString, 5, 4))
+
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	for key, value := range values {
+		got, err := db.Get(GetKey(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, got)
+	}
+}
+
+func TestLazyDB_MergeIntoOlderFile(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_merge_into_older")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 150 // 2 entries in a file
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	// fid 1 is sparse, fid 2 holds an older value of the key whose latest value is in fid 3
+	key, oldValue, newValue := GetKey(1), GetValue32(), GetValue32()
+	assert.Nil(t, db.Set(GetKey(2), GetValue32()))
+	assert.Nil(t, db.Set(GetKey(3), GetValue32()))
+	assert.Nil(t, db.Set(key, oldValue))
+	assert.Nil(t, db.Set(GetKey(4), GetValue32()))
+	assert.Nil(t, db.Set(key, newValue))
+	assert.Nil(t, db.Set(GetKey(5), GetValue32()))
+	assert.Nil(t, db.Set(GetKey(6), GetValue32()))
+	assert.Equal(t, []uint32{1, 2, 3, 4}, db.fidsMap[valueTypeString].fids)
+
+	// moving the latest value into fid 1 would let the stale one of fid 2 win after reopening
+	assert.Equal(t, ErrInvalidParam, db.MergeInto(valueTypeString, 3, 1))
+	assert.NotNil(t, db.getArchivedLogFile(valueTypeString, 3))
+	assert.Nil(t, db.MergeInto(valueTypeString, 1, 3))
+
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	got, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, newValue, got)
+}
+
+func TestOpenFS(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_open_fs")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 150 // 2 entries in a file
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer os.RemoveAll(path)
+
+	values := make([][]byte, 5)
+	for i := 0; i < 5; i++ {
+		values[i] = GetValue32()
+		assert.Nil(t, db.Set(GetKey(i), values[i]))
+	}
+	assert.Nil(t, db.Delete(GetKey(4)))
+	assert.Nil(t, db.HSet([]byte("hash"), []byte("field"), []byte("value")))
+	assert.Nil(t, db.Close())
+
+	// build an embedded dataset from log files
+	fsys := fstest.MapFS{}
+	entries, err := os.ReadDir(path)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(path, entry.Name()))
+		assert.Nil(t, err)
+		fsys[entry.Name()] = &fstest.MapFile{Data: data}
+	}
+
+	db, err = OpenFS(fsys, DefaultDBConfig(""))
+	assert.Nil(t, err)
+	defer db.Close()
+
+	for i := 0; i < 4; i++ {
+		val, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+	}
+	_, err = db.Get(GetKey(4))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db.HGet([]byte("hash"), []byte("field"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+
+	assert.Equal(t, ErrReadOnly, db.Set(GetKey(0), GetValue32()))
+	assert.Equal(t, ErrReadOnly, db.Delete(GetKey(0)))
+	assert.Equal(t, ErrReadOnly, db.HSet([]byte("hash"), []byte("field"), []byte("v2")))
+	assert.Equal(t, ErrReadOnly, db.Merge(valueTypeString, 1, 0))
+	val, err = db.Get(GetKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, values[0], val)
+}
+
+func TestLazyDB_LegacyLogFileNames(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_legacy_log_file_names")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 500
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	values := make([][]byte, 80)
+	for i := range values {
+		values[i] = GetValue32()
+		assert.Nil(t, db.Set(GetKey(i), values[i]))
+	}
+	fids := append([]uint32{}, db.fidsMap[valueTypeString].fids...)
+	assert.Greater(t, len(fids), 10)
+	assert.Nil(t, db.Close())
+
+	// fids padded to 8 digits, and not padded, which sort wrong by name, e.g. 10 before 9
+	for _, fid := range fids[:len(fids)/2] {
+		prefix, _ := logfile.FileNamePrefix(logfile.Strs)
+		legacy := filepath.Join(path, prefix+fmt.Sprintf("%08d", fid))
+		if fid%2 == 0 {
+			legacy = filepath.Join(path, prefix+fmt.Sprintf("%d", fid))
+		}
+		assert.Nil(t, os.Rename(logFileName(path, logfile.Strs, fid), legacy))
+	}
+
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, fids, db.fidsMap[valueTypeString].fids)
+	for i := range values {
+		val, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+	}
+	// new log files are padded
+	for i := range values {
+		assert.Nil(t, db.Set(GetKey(len(values)+i), GetValue32()))
+	}
+	activeFid := db.getActiveLogFile(valueTypeString).lf.Fid
+	assert.Greater(t, activeFid, fids[len(fids)-1])
+	assert.True(t, util.PathExist(logFileName(path, logfile.Strs, activeFid)))
+}
+
+// logFileName returns the path of the log file of ftype and fid in path.
+func logFileName(path string, ftype logfile.FType, fid uint32) string {
+	name, _ := logfile.FileName(ftype, fid)
+	return filepath.Join(path, name)
+}
+
+// crashIOController simulates a machine crash, which loses data that has not been synced.
+type crashIOController struct {
+	iocontroller.IOController
+	written int64
+	synced  int64
+	syncs   int
+}
+
+func (c *crashIOController) Write(b []byte, offset int64) (int, error) {
+	n, err := c.IOController.Write(b, offset)
+	if end := offset + int64(n); end > c.written {
+		c.written = end
+	}
+	return n, err
+}
+
+func (c *crashIOController) Sync() error {
+	c.syncs++
+	c.synced = c.written
+	return c.IOController.Sync()
+}
+
+// fullDiskIOController simulates a device with only left bytes of free space, bytes before end have been allocated.
+type fullDiskIOController struct {
+	iocontroller.IOController
+	end  int64
+	left int64
+}
+
+func (c *fullDiskIOController) Write(b []byte, offset int64) (int, error) {
+	fits := c.end + c.left - offset
+	if fits > int64(len(b)) {
+		fits = int64(len(b))
+	}
+	n, err := c.IOController.Write(b[:fits], offset)
+	if end := offset + int64(n); end > c.end {
+		c.left -= end - c.end
+		c.end = end
+	}
+	if err == nil && n < len(b) {
+		err = syscall.ENOSPC
+	}
+	return n, err
+}
+
+func (c *crashIOController) crash() error {
+	if c.written <= c.synced {
+		return nil
+	}
+	_, err := c.IOController.Write(make([]byte, c.written-c.synced), c.synced)
+	return err
+}
+
+func TestLazyDB_IndexUpdateMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    IndexUpdateMode
+		durable bool
+	}{
+		{"after-write", IndexUpdateAfterWrite, false},
+		{"after-sync", IndexUpdateAfterSync, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wd, _ := os.Getwd()
+			path := filepath.Join(wd, "test_index_update_mode")
+			cfg := DefaultDBConfig(path)
+			cfg.IndexUpdateMode = tt.mode
+			db, err := Open(cfg)
+			assert.Nil(t, err)
+			defer func() {
+				destroyDB(db)
+			}()
+
+			lf := db.getActiveLogFile(valueTypeString).lf
+			controller := &crashIOController{IOController: lf.IoController}
+			lf.IoController = controller
+
+			value := GetValue32()
+			assert.Nil(t, db.Set(GetKey(1), value))
+			// the write is always visible before crash
+			got, err := db.Get(GetKey(1))
+			assert.Nil(t, err)
+			assert.Equal(t, value, got)
+
+			assert.Nil(t, controller.crash())
+			assert.Nil(t, db.Close())
+			db, err = Open(cfg)
+			assert.Nil(t, err)
+
+			got, err = db.Get(GetKey(1))
+			if tt.durable {
+				assert.Nil(t, err)
+				assert.Equal(t, value, got)
+			} else {
+				assert.Equal(t, ErrKeyNotFound, err)
+			}
+		})
+	}
+}
+
+func TestLazyDB_ChecksumType(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_checksum_type")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 150
+
+	values := make([][]byte, 9)
+	var db *LazyDB
+	defer func() {
+		destroyDB(db)
+	}()
+	// log files are written with different algorithms by turns
+	for i, checksum := range []logfile.ChecksumType{logfile.ChecksumCRC32, logfile.ChecksumXXHash, logfile.ChecksumNone} {
+		var err error
+		cfg.ChecksumType = checksum
+		db, err = Open(cfg)
+		assert.Nil(t, err)
+		for j := i * 3; j < i*3+3; j++ {
+			values[j] = GetValue32()
+			assert.Nil(t, db.Set(GetKey(j), values[j]))
+		}
+		if i < 2 {
+			assert.Nil(t, db.Close())
+		}
+	}
+
+	check := func(db *LazyDB) {
+		for i := range values {
+			val, err := db.Get(GetKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, values[i], val)
+		}
+	}
+	check(db)
+	assert.Nil(t, db.Close())
+	cfg.ChecksumType = logfile.ChecksumCRC32
+	var err error
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	check(db)
+}
+
+func TestLazyDB_KeyComparator(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	// numeric comparator orders keys like "key2" and "key10" by their numeric suffix
+	numeric := func(a, b []byte) int {
+		split := func(k []byte) ([]byte, int) {
+			i := len(k)
+			for i > 0 && k[i-1] >= '0' && k[i-1] <= '9' {
+				i--
+			}
+			n, _ := strconv.Atoi(string(k[i:]))
+			return k[:i], n
+		}
+		pa, na := split(a)
+		pb, nb := split(b)
+		if c := bytes.Compare(pa, pb); c != 0 {
+			return c
+		}
+		return na - nb
+	}
+	for _, i := range []int{10, 2, 1, 20, 3} {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("key%d", i)), GetValue32()))
+	}
+	scanKeys := func() [][]byte {
+		_, keyTypes, err := db.ScanAll(0, 100)
+		assert.Nil(t, err)
+		var keys [][]byte
+		for _, kt := range keyTypes {
+			keys = append(keys, kt.Key)
+		}
+		return keys
+	}
+	byteOrder := [][]byte{[]byte("key1"), []byte("key10"), []byte("key2"), []byte("key20"), []byte("key3")}
+	numericOrder := [][]byte{[]byte("key1"), []byte("key2"), []byte("key3"), []byte("key10"), []byte("key20")}
+	assert.Equal(t, byteOrder, scanKeys())
+
+	db.cfg.KeyComparator = numeric
+	assert.Equal(t, numericOrder, scanKeys())
+	values, err := db.Scan([]byte("key"), "", 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(values))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, numericOrder[i], values[2*i])
+	}
+}
+
+func TestLazyDB_TypeExists(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+
+	assert.Nil(t, db.Set([]byte("str"), []byte("v")))
+	assert.Nil(t, db.SetEX([]byte("expired"), []byte("v"), time.Second))
+	assert.Nil(t, db.HSet([]byte("hash"), []byte("f"), []byte("v")))
+	assert.Nil(t, db.HSet([]byte("emptied"), []byte("f"), []byte("v")))
+	_, err := db.HDel([]byte("emptied"), []byte("f"))
+	assert.Nil(t, err)
+	assert.Nil(t, db.RPush([]byte("list"), []byte("a"), []byte("b")))
+	_, err = db.LPop([]byte("list"))
+	assert.Nil(t, err)
+	assert.Nil(t, db.SAdd([]byte("set"), []byte("m1"), []byte("m2")))
+	assert.Nil(t, db.SRem([]byte("set"), []byte("m1")))
+	assert.Nil(t, db.ZAdd([]byte("zset"), util.Float64ToByte(1), []byte("m")))
+	// a key holds values of more than one type
+	assert.Nil(t, db.Set([]byte("both"), []byte("v")))
+	assert.Nil(t, db.SAdd([]byte("both"), []byte("m")))
+	assert.Nil(t, db.Set([]byte("deleted"), []byte("v")))
+	assert.Nil(t, db.Delete([]byte("deleted")))
+	assert.Nil(t, db.RPush([]byte("unlinked"), []byte("a")))
+	_, err = db.Unlink([]byte("unlinked"))
+	assert.Nil(t, err)
+	now = now.Add(2 * time.Second)
+
+	keys := []string{"str", "expired", "hash", "emptied", "list", "set", "zset", "both", "deleted", "unlinked", "none"}
+	scanned := make(map[string]valueType)
+	cursor := uint64(0)
+	for {
+		next, kts, err := db.ScanAll(cursor, 3)
+		assert.Nil(t, err)
+		for _, kt := range kts {
+			if _, ok := scanned[string(kt.Key)]; !ok {
+				scanned[string(kt.Key)] = kt.Type
+			}
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	for _, key := range keys {
+		typ, err := db.Type([]byte(key))
+		_, anyTyp, anyErr := db.GetAny([]byte(key))
+		assert.Equal(t, anyErr, err, key)
+		_, ok := scanned[key]
+		assert.Equal(t, err == nil, ok, key)
+		if err == nil {
+			assert.Equal(t, anyTyp, typ, key)
+			assert.Equal(t, 1, db.Exists([]byte(key)), key)
+		} else {
+			assert.Equal(t, 0, db.Exists([]byte(key)), key)
+		}
+	}
+	typ, err := db.Type([]byte("both"))
+	assert.Nil(t, err)
+	assert.Equal(t, valueTypeString, typ)
+	assert.Equal(t, 3, db.Exists([]byte("str"), []byte("none"), []byte("str"), []byte("zset")))
+}
+
+func TestLazyDB_TypedExistsKey(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+
+	assert.Nil(t, db.HSet([]byte("hash"), []byte("f"), []byte("v")))
+	assert.Nil(t, db.RPush([]byte("list"), []byte("a")))
+	assert.Nil(t, db.SAdd([]byte("set"), []byte("m")))
+	assert.Nil(t, db.ZAdd([]byte("zset"), util.Float64ToByte(1), []byte("m")))
+	// a key holding another type does not exist in the type
+	assert.Nil(t, db.Set([]byte("str"), []byte("v")))
+
+	exists := map[valueType]func(key []byte) bool{
+		valueTypeHash: db.HExistsKey,
+		valueTypeList: db.LExistsKey,
+		valueTypeSet:  db.SExistsKey,
+		valueTypeZSet: db.ZExistsKey,
+	}
+	keys := map[valueType]string{valueTypeHash: "hash", valueTypeList: "list", valueTypeSet: "set", valueTypeZSet: "zset"}
+	for typ, fn := range exists {
+		for other, key := range keys {
+			assert.Equal(t, typ == other, fn([]byte(key)), key)
+		}
+		assert.False(t, fn([]byte("str")))
+		assert.False(t, fn([]byte("none")))
+	}
+
+	// emptied collections
+	_, err := db.HDel([]byte("hash"), []byte("f"))
+	assert.Nil(t, err)
+	assert.False(t, db.HExistsKey([]byte("hash")))
+	_, err = db.LPop([]byte("list"))
+	assert.Nil(t, err)
+	assert.False(t, db.LExistsKey([]byte("list")))
+	assert.Nil(t, db.SRem([]byte("set"), []byte("m")))
+	assert.False(t, db.SExistsKey([]byte("set")))
+	_, err = db.ZRem([]byte("zset"), []byte("m"))
+	assert.Nil(t, err)
+	assert.False(t, db.ZExistsKey([]byte("zset")))
+
+	// expired collections
+	assert.Nil(t, db.HSet([]byte("hash"), []byte("f"), []byte("v")))
+	assert.Nil(t, db.RPush([]byte("list"), []byte("a")))
+	assert.Nil(t, db.SAdd([]byte("set"), []byte("m")))
+	for _, typ := range []valueType{valueTypeHash, valueTypeList, valueTypeSet} {
+		assert.Nil(t, db.ExpireCollection(typ, []byte(keys[typ]), time.Second))
+		assert.True(t, exists[typ]([]byte(keys[typ])))
+	}
+	now = now.Add(2 * time.Second)
+	for _, typ := range []valueType{valueTypeHash, valueTypeList, valueTypeSet} {
+		assert.False(t, exists[typ]([]byte(keys[typ])))
+	}
+	assert.Equal(t, 0, db.Exists([]byte("hash"), []byte("list"), []byte("set")))
+}
+
+func BenchmarkLazyDB_Exists(b *testing.B) {
+	db := initTestDB()
+	defer destroyDB(db)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(b, db.Set(GetKey(i), []byte("v")))
+		assert.Nil(b, db.HSet(GetKey(i+1000), []byte("f"), []byte("v")))
+	}
+	assert.Nil(b, db.Set([]byte("str"), []byte("v")))
+	assert.Nil(b, db.ZAdd([]byte("zset"), util.Float64ToByte(1), []byte("m")))
+
+	// keyExists looks up db.index once and only the types recorded there,
+	// while the index of every type is probed in order without it
+	lookups := map[string]func(key []byte) bool{
+		"probe-indexes": func(key []byte) bool {
+			for _, typ := range getAnyTypes {
+				if db.existsInType(typ, key) {
+					return true
+				}
+			}
+			return false
+		},
+		"key-index": db.keyExists,
+	}
+	for name, lookup := range lookups {
+		for _, key := range []string{"str", "zset", "none"} {
+			b.Run(name+"/"+key, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					lookup([]byte(key))
+				}
+			})
+		}
+	}
+}
+
+func TestLazyDB_MaxLogFileAge(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_max_log_file_age"))
+	cfg.MaxLogFileAge = time.Hour
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+
+	assert.Nil(t, db.Set(GetKey(0), GetValue(16)))
+	fid := db.getActiveLogFile(valueTypeString).lf.Fid
+	now = now.Add(30 * time.Minute)
+	assert.Nil(t, db.Set(GetKey(1), GetValue(16)))
+	assert.Equal(t, fid, db.getActiveLogFile(valueTypeString).lf.Fid)
+
+	// the active log file is archived by the next write once it is old enough
+	now = now.Add(31 * time.Minute)
+	assert.Nil(t, db.Set(GetKey(2), GetValue(16)))
+	active := db.getActiveLogFile(valueTypeString).lf
+	assert.NotEqual(t, fid, active.Fid)
+	assert.Equal(t, []uint32{fid, active.Fid}, db.fidsMap[valueTypeString].fids)
+	assert.NotNil(t, db.getArchivedLogFile(valueTypeString, fid))
+
+	// a batch is written into the new log file, which is aged from its creation
+	now = now.Add(59 * time.Minute)
+	batch := db.NewWriteBatch()
+	batch.Set(GetKey(3), GetValue(16))
+	assert.Nil(t, batch.Commit())
+	assert.Equal(t, active.Fid, db.getActiveLogFile(valueTypeString).lf.Fid)
+	for i := 0; i < 4; i++ {
+		_, err = db.Get(GetKey(i))
+		assert.Nil(t, err)
+	}
+}
+
+func TestLazyDB_SyncUpTo(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_sync_up_to"))
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	lf := db.getActiveLogFile(valueTypeString).lf
+	controller := &crashIOController{IOController: lf.IoController}
+	lf.IoController = controller
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue(16)))
+	}
+	assert.Nil(t, db.HSet([]byte("hash"), []byte("field"), GetValue(16)))
+	positions := db.CurrentPositions()
+	assert.Equal(t, ValuePos{fid: lf.Fid, offset: lf.Offset}, positions[valueTypeString])
+	assert.Contains(t, positions, valueTypeHash)
+	assert.NotContains(t, positions, valueTypeZSet)
+	for i := 10; i < 20; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue(16)))
+	}
+	assert.Equal(t, 0, controller.syncs)
+	assert.Nil(t, db.SyncUpTo(positions))
+	assert.Equal(t, 1, controller.syncs)
+
+	// positions which have not been written yet
+	future := map[valueType]ValuePos{valueTypeString: {fid: lf.Fid, offset: lf.Offset + 1}}
+	assert.Equal(t, ErrInvalidParam, db.SyncUpTo(future))
+	future = map[valueType]ValuePos{valueTypeZSet: {fid: 1}}
+	assert.Equal(t, ErrInvalidParam, db.SyncUpTo(future))
+
+	// entries written after syncing are lost by a crash, but the captured ones survive
+	assert.Nil(t, db.Set(GetKey(100), GetValue(16)))
+	assert.Nil(t, controller.crash())
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		_, err = db.Get(GetKey(i))
+		assert.Nil(t, err)
+	}
+	_, err = db.Get(GetKey(100))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db.HGet([]byte("hash"), []byte("field"))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+}
+
+func TestLazyDB_WrongTypeError(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_wrong_type"))
+	cfg.WrongTypeError = true
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	str, hash, list, set, zset := []byte("str"), []byte("hash"), []byte("list"), []byte("set"), []byte("zset")
+	assert.Nil(t, db.Set(str, GetValue(8)))
+	hashValue := GetValue(8)
+	assert.Nil(t, db.HSet(hash, GetKey(1), hashValue))
+	assert.Nil(t, db.LPush(list, GetValue(8)))
+	assert.Nil(t, db.SAdd(set, GetValue(8)))
+	assert.Nil(t, db.ZAdd(zset, util.Float64ToByte(1), GetKey(1)))
+
+	assertWrongType := func(err error, name string) {
+		assert.True(t, errors.Is(err, ErrWrongType), "%v", err)
+		if err != nil {
+			assert.True(t, strings.HasSuffix(err.Error(), "holds a "+name), err.Error())
+		}
+	}
+	_, err = db.Get(hash)
+	assertWrongType(err, "hash")
+	_, err = db.HGet(str, GetKey(1))
+	assertWrongType(err, "string")
+	_, err = db.HGetAll(list)
+	assertWrongType(err, "list")
+	_, err = db.LIndex(set, 0)
+	assertWrongType(err, "set")
+	_, err = db.LRange(zset, 0, -1)
+	assertWrongType(err, "zset")
+	_, err = db.SMembers(str)
+	assertWrongType(err, "string")
+	_, err = db.ZScore(hash, GetKey(1))
+	assertWrongType(err, "hash")
+
+	// every getter checks the type
+	getters := []struct {
+		name string
+		key  []byte
+		get  func(key []byte) error
+	}{
+		{"StrLen", hash, func(key []byte) error { _, err := db.StrLen(key); return err }},
+		{"GetRange", list, func(key []byte) error { _, err := db.GetRange(key, 0, -1); return err }},
+		{"GetWithTTL", set, func(key []byte) error { _, _, err := db.GetWithTTL(key); return err }},
+		{"HLen", str, func(key []byte) error { _, err := db.HLen(key); return err }},
+		{"HKeys", list, func(key []byte) error { _, err := db.HKeys(key); return err }},
+		{"HVals", set, func(key []byte) error { _, err := db.HVals(key); return err }},
+		{"HExists", zset, func(key []byte) error { _, err := db.HExists(key, GetKey(1)); return err }},
+		{"HStrLen", str, func(key []byte) error { _, err := db.HStrLen(key, GetKey(1)); return err }},
+		{"HMGet", list, func(key []byte) error { _, err := db.HMGet(key, GetKey(1)); return err }},
+		{"LLen", hash, func(key []byte) error { _, err := db.LLen(key); return err }},
+		{"LGetAll", set, func(key []byte) error { _, err := db.LGetAll(key); return err }},
+		{"SIsMember", list, func(key []byte) error { _, err := db.SIsMember(key, GetKey(1)); return err }},
+		{"SCard", zset, func(key []byte) error { _, err := db.SCard(key); return err }},
+		{"SMIsMember", str, func(key []byte) error { _, err := db.SMIsMember(key, GetKey(1)); return err }},
+		{"ZCard", set, func(key []byte) error { _, err := db.ZCard(key); return err }},
+		{"ZRank", str, func(key []byte) error { _, err := db.ZRank(key, GetKey(1)); return err }},
+		{"ZRange", hash, func(key []byte) error { _, err := db.ZRange(key, 0, -1); return err }},
+		{"ZRangeWithScores", list, func(key []byte) error { _, _, err := db.ZRangeWithScores(key, 0, -1); return err }},
+	}
+	names := map[string]string{"str": "string", "hash": "hash", "list": "list", "set": "set", "zset": "zset"}
+	for _, g := range getters {
+		t.Run(g.name, func(t *testing.T) {
+			err := g.get(g.key)
+			assert.True(t, errors.Is(err, ErrWrongType), "%v", err)
+			if err != nil {
+				assert.True(t, strings.HasSuffix(err.Error(), "holds a "+names[string(g.key)]), err.Error())
+			}
+		})
+	}
+
+	// GetAny moves on to the type held by the key
+	val, typ, err := db.GetAny(zset)
+	assert.Nil(t, err)
+	assert.Equal(t, valueTypeZSet, typ)
+	assert.Equal(t, []ZMember{{Member: GetKey(1), Score: 1}}, val)
+
+	// missing keys and keys holding the type are unaffected
+	_, err = db.Get([]byte("missing"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	got, err := db.HGet(hash, GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, hashValue, got)
+
+	// a key holding several types is read by each of them
+	assert.Nil(t, db.Set(hash, GetValue(8)))
+	_, err = db.Get(hash)
+	assert.Nil(t, err)
+
+	// the error is off by default
+	db.cfg.WrongTypeError = false
+	_, err = db.HGet(str, GetKey(1))
+	assert.False(t, errors.Is(err, ErrWrongType))
+}
@@ -0,0 +1,130 @@
+package lazydb
+
+import (
+	"sort"
+
+	"github.com/billsjc123/LazyDB/ds"
+	"github.com/billsjc123/LazyDB/logfile"
+)
+
+// Defrag rewrites live entries of all log files of the type into fresh log files in order of keys, so that entries
+// of a key, e.g. fields of a hash or elements of a list, sit next to each other, and then removes all the old
+// log files. Unlike Merge, which reclaims stale entries, it restores the locality of entries spread across many
+// log files by writes over time, which speeds up reading a whole collection and iterating keys in order.
+// Stale entries are reclaimed along the way. Writes of the type are blocked until it finishes.
+//
+// It is crash-safe like FullCompact: fresh log files are written after the sealed active log file and synced
+// before any old log file is removed in order of fid.
+func (db *LazyDB) Defrag(typ valueType) error {
+	if err := db.checkRewrite(); err != nil {
+		return err
+	}
+	mu := db.getIndexLock(typ)
+	mu.Lock()
+	defer mu.Unlock()
+
+	activeLogFile, oldFids, err := db.sealForCompaction(typ)
+	if err != nil || len(oldFids) == 0 {
+		return err
+	}
+	old := make(map[uint32]struct{}, len(oldFids))
+	for _, fid := range oldFids {
+		old[fid] = struct{}{}
+	}
+
+	// positions are collected first, since the index is updated by rewriting
+	type entryPos struct {
+		fid    uint32
+		offset int64
+	}
+	var positions []entryPos
+	seen := make(map[entryPos]struct{})
+	for _, idxTree := range db.indexTreesInOrder(typ) {
+		iter := idxTree.Iterator()
+		for iter.HasNext() {
+			node, err := iter.Next()
+			if err != nil {
+				return err
+			}
+			val, _ := node.Value().(*Value)
+			if val == nil {
+				continue
+			}
+			pos := entryPos{fid: val.fid, offset: val.offset}
+			if _, ok := old[pos.fid]; !ok {
+				continue
+			}
+			// elements of a packed collection share an entry
+			if _, ok := seen[pos]; ok {
+				continue
+			}
+			seen[pos] = struct{}{}
+			positions = append(positions, pos)
+		}
+	}
+	if typ == valueTypeString {
+		for _, iv := range db.strIndex.interned {
+			if _, ok := old[iv.pos.fid]; ok && iv.pos.entrySize > 0 {
+				positions = append(positions, entryPos{fid: iv.pos.fid, offset: iv.pos.offset})
+			}
+		}
+	}
+
+	write := func(ent *logfile.LogEntry) (*ValuePos, error) {
+		return db.rewriteLogEntry(typ, ent)
+	}
+	for _, pos := range positions {
+		ent, err := db.readLogEntry(typ, pos.fid, pos.offset)
+		if err != nil {
+			if err == logfile.ErrInvalidCrc {
+				return corruptedEntryError(pos.fid, pos.offset)
+			}
+			return err
+		}
+		if ent.ExpiredAt != 0 && expiredAtMilli(ent.ExpiredAt) <= db.now().UnixMilli() {
+			continue
+		}
+		if err = db.rewriteLiveEntry(typ, pos.fid, pos.offset, ent, write); err != nil {
+			return err
+		}
+	}
+
+	return db.removeCompacted(typ, activeLogFile, oldFids)
+}
+
+// indexTreesInOrder returns index trees of the type in order of keys, a tree for each key of collections.
+// Index lock of the type must be held by the caller.
+func (db *LazyDB) indexTreesInOrder(typ valueType) []*ds.AdaptiveRadixTree {
+	var trees map[string]*ds.AdaptiveRadixTree
+	switch typ {
+	case valueTypeString:
+		return []*ds.AdaptiveRadixTree{db.strIndex.idxTree}
+	case valueTypeHash:
+		trees = db.hashIndex.trees
+	case valueTypeList:
+		trees = db.listIndex.trees
+	case valueTypeSet:
+		trees = db.setIndex.trees
+	case valueTypeZSet:
+		trees = make(map[string]*ds.AdaptiveRadixTree, len(db.zSetIndex.indexes))
+		for key, idx := range db.zSetIndex.indexes {
+			trees[key] = idx.tree
+		}
+	default:
+		if ct := db.getCustomType(typ); ct != nil {
+			return []*ds.AdaptiveRadixTree{ct.index.idxTree}
+		}
+		return nil
+	}
+
+	keys := make([]string, 0, len(trees))
+	for key := range trees {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	ordered := make([]*ds.AdaptiveRadixTree, len(keys))
+	for i, key := range keys {
+		ordered[i] = trees[key]
+	}
+	return ordered
+}
@@ -0,0 +1,108 @@
+package lazydb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeFragmentedHashes writes fields of hashes round-robin, so that fields of a hash are spread across log files.
+func writeFragmentedHashes(db *LazyDB, hashes, fields int) error {
+	for f := 0; f < fields; f++ {
+		for h := 0; h < hashes; h++ {
+			if err := db.HSet(GetKey(h), []byte(fmt.Sprintf("field-%04d", f)), GetValue32()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestLazyDB_Defrag(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_defrag")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 1000
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	assert.Nil(t, writeFragmentedHashes(db, 10, 20))
+	// stale entries are reclaimed too
+	assert.Nil(t, db.HSet(GetKey(0), []byte("field-0000"), []byte("new")))
+	_, err = db.HDel(GetKey(1), []byte("field-0000"))
+	assert.Nil(t, err)
+
+	live := make(map[string][][]byte)
+	for h := 0; h < 10; h++ {
+		all, err := db.HGetAll(GetKey(h))
+		assert.Nil(t, err)
+		live[string(GetKey(h))] = all
+	}
+	oldFids := append([]uint32(nil), db.fidsMap[valueTypeHash].fids...)
+
+	assert.Nil(t, db.Defrag(valueTypeHash))
+	for _, fid := range oldFids {
+		assert.Nil(t, db.getArchivedLogFile(valueTypeHash, fid))
+	}
+
+	// fields of a hash are next to each other in order
+	for h := 0; h < 10; h++ {
+		var prev *Value
+		iter := db.hashIndex.trees[string(GetKey(h))].Iterator()
+		for iter.HasNext() {
+			node, err := iter.Next()
+			assert.Nil(t, err)
+			val := node.Value().(*Value)
+			if prev != nil && val.fid == prev.fid {
+				assert.Equal(t, prev.offset+int64(prev.entrySize), val.offset)
+			} else if prev != nil {
+				assert.Greater(t, val.fid, prev.fid)
+				assert.Equal(t, int64(0), val.offset)
+			}
+			prev = val
+		}
+	}
+
+	expected := func() {
+		for key, all := range live {
+			values, err := db.HGetAll([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, all, values)
+		}
+	}
+	expected()
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	expected()
+}
+
+func BenchmarkDefrag_HGetAll(b *testing.B) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_defrag_benchmark")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 64 << 10
+	db, err := Open(cfg)
+	assert.Nil(b, err)
+	defer destroyDB(db)
+	const hashes = 100
+	assert.Nil(b, writeFragmentedHashes(db, hashes, 50))
+
+	scan := func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := db.HGetAll(GetKey(i % hashes)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.Run("fragmented", scan)
+	assert.Nil(b, db.Defrag(valueTypeHash))
+	b.Run("defragmented", scan)
+}
@@ -148,6 +148,36 @@ func (d *discard) incrDiscard(fid uint32, delta int) {
 	}
 }
 
+// decrDiscard subtracts delta from the discarded size of the log file, e.g. when discarded entries are dropped from
+// it without removing the whole file, and the discarded size never goes below zero.
+func (d *discard) decrDiscard(fid uint32, delta int) {
+	if delta <= 0 {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	offset, ok := d.location[fid]
+	if !ok {
+		return
+	}
+	buf := make([]byte, 4)
+	offset += 8
+	if _, err := d.file.Read(buf, offset); err != nil {
+		log.Fatalf("decr value in discard err: %+v", err)
+		return
+	}
+
+	v := binary.LittleEndian.Uint32(buf[:4])
+	if uint32(delta) > v {
+		delta = int(v)
+	}
+	binary.LittleEndian.PutUint32(buf, v-uint32(delta))
+	if _, err := d.file.Write(buf, offset); err != nil {
+		log.Fatalf("decr value in discard err: %+v", err)
+		return
+	}
+}
+
 func (d *discard) alloc(fid uint32) (int64, error) {
 	if offset, ok := d.location[fid]; ok {
 		return offset, nil
@@ -0,0 +1,221 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/billsjc123/LazyDB/ds"
+	"github.com/billsjc123/LazyDB/logfile"
+)
+
+// dropIntentPrefix the prefix of files recording a DropType in progress, followed by the name of the type in names
+// of its log files, e.g. "DROP.hash". The file holds the largest fid being dropped.
+const dropIntentPrefix = "DROP."
+
+// DropType permanently removes all keys of the type along with its log files, index logs and checkpoint, and
+// frees its log files and indexes in memory, e.g. to reclaim everything of a type which is never used any more.
+// No active log file is created until the type is written again, and the log files created then take fids
+// after the dropped ones, so that reads in flight never see a new log file under a dropped fid.
+// All operations are blocked until it finishes. Registration of a custom type is kept.
+//
+// The largest fid being dropped is recorded in a file before any log file is removed, and the drop is completed by
+// Open if it is interrupted by a crash, so that values shadowed by removed log files never come back.
+// Log files are removed oldest first, so that even the files left behind only hold the latest values.
+func (db *LazyDB) DropType(typ valueType) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.IsClosed() {
+		return ErrDatabaseClosed
+	}
+	if db.readOnly() {
+		return ErrReadOnly
+	}
+	if typ >= logFileTypeNum && db.getCustomType(typ) == nil {
+		return ErrTypeNotRegistered
+	}
+	defer db.lockIndexes(typ)()
+
+	fids := db.fidsMap[typ]
+	fids.mu.Lock()
+	dropped := append([]uint32(nil), fids.fids...)
+	fids.fids = nil
+	fids.mu.Unlock()
+	sort.Slice(dropped, func(i, j int) bool {
+		return dropped[i] < dropped[j]
+	})
+	if len(dropped) > 0 {
+		if err := db.writeDropIntent(typ, dropped[len(dropped)-1]); err != nil {
+			return err
+		}
+	}
+
+	if activeLogFile := db.activeLogFileMap[typ]; activeLogFile != nil {
+		activeLogFile.mu.Lock()
+		if err := activeLogFile.closeIndexLog(); err != nil {
+			activeLogFile.mu.Unlock()
+			return err
+		}
+		delete(db.activeLogFileMap, typ)
+		db.archivedLogFile[typ].Set(activeLogFile.lf.Fid, &MutexLogFile{lf: activeLogFile.lf})
+		activeLogFile.mu.Unlock()
+	}
+	for _, fid := range dropped {
+		db.removeArchivedLogFile(typ, fid)
+	}
+	if len(dropped) > 0 {
+		fids.mu.Lock()
+		if last := dropped[len(dropped)-1]; last > fids.dropped {
+			fids.dropped = last
+		}
+		fids.mu.Unlock()
+	}
+	if !db.cfg.NoSyncDir {
+		if err := syncDir(db.cfg.DBPath); err != nil {
+			return err
+		}
+	}
+	path := db.checkpointPath(typ)
+	for _, p := range []string{path, path + ".tmp", db.dropIntentPath(typ)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	db.stepMerges.mu.Lock()
+	delete(db.stepMerges.offsets, typ)
+	db.stepMerges.mu.Unlock()
+	db.resetIndexOfType(typ)
+	return nil
+}
+
+// resetIndexOfType replaces the index of the type with an empty one. Index lock of the type must be held by the caller.
+func (db *LazyDB) resetIndexOfType(typ valueType) {
+	switch typ {
+	case valueTypeString:
+		db.strIndex.idxTree = ds.NewART()
+		db.strIndex.ttlTree = ds.NewART()
+		db.strIndex.interned = make(map[string]*internedValue)
+		db.strIndex.lruKeys = nil
+	case valueTypeHash:
+		db.hashIndex.trees = make(map[string]*ds.AdaptiveRadixTree)
+	case valueTypeList:
+		db.listIndex.trees = make(map[string]*ds.AdaptiveRadixTree)
+	case valueTypeSet:
+		db.setIndex.trees = make(map[string]*ds.AdaptiveRadixTree)
+	case valueTypeZSet:
+		db.zSetIndex.indexes = make(map[string]*ZSetIndex)
+	default:
+		if ct := db.getCustomType(typ); ct != nil {
+			ct.index.idxTree = ds.NewART()
+		}
+	}
+	db.unindexType(typ)
+}
+
+// dropIntentPath returns the path of the file recording a DropType of the type in progress.
+func (db *LazyDB) dropIntentPath(typ valueType) string {
+	name, _ := logfile.FileNamePrefix(logfile.FType(typ))
+	return filepath.Join(db.cfg.DBPath, dropIntentPrefix+name[len(logfile.FilePrefix):len(name)-1])
+}
+
+// writeDropIntent records that log files of the type up to lastFid are being dropped, see completeDrops.
+// The record replaces the old one atomically, and is synced along with the directory unless DBConfig.NoSyncDir is on.
+func (db *LazyDB) writeDropIntent(typ valueType, lastFid uint32) error {
+	path := db.dropIntentPath(typ)
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err = file.WriteString(strconv.FormatUint(uint64(lastFid), 10)); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	if db.cfg.NoSyncDir {
+		return nil
+	}
+	return syncDir(db.cfg.DBPath)
+}
+
+// completeDrops completes DropType interrupted by a crash before log files are built on opening. Log files recorded
+// by drop intents, along with their index logs and the checkpoint of the type, are removed, and then the intents.
+// Types are identified by names of their log files, so that drops of custom types not registered yet are completed.
+func (db *LazyDB) completeDrops() error {
+	if db.readOnly() {
+		return nil
+	}
+	entries, err := os.ReadDir(db.cfg.DBPath)
+	if err != nil {
+		return err
+	}
+	// the largest dropped fid by the prefix of names of log files, e.g. "log.hash."
+	dropped := make(map[string]uint64)
+	for _, ent := range entries {
+		name := ent.Name()
+		if !strings.HasPrefix(name, dropIntentPrefix) || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(db.cfg.DBPath, name))
+		if err != nil {
+			return err
+		}
+		// an intent is only in place once it is complete, see writeDropIntent
+		lastFid, err := strconv.ParseUint(string(data), 10, 32)
+		if err != nil {
+			return err
+		}
+		dropped[logfile.FilePrefix+name[len(dropIntentPrefix):]+"."] = lastFid
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+
+	for _, ent := range entries {
+		name := strings.TrimPrefix(ent.Name(), indexLogPrefix)
+		i := strings.LastIndexByte(name, '.')
+		if i < 0 {
+			continue
+		}
+		lastFid, ok := dropped[name[:i+1]]
+		if !ok {
+			continue
+		}
+		if fid, err := strconv.ParseUint(name[i+1:], 10, 32); err == nil && fid <= lastFid {
+			if err = os.Remove(filepath.Join(db.cfg.DBPath, ent.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	for prefix := range dropped {
+		typName := prefix[len(logfile.FilePrefix) : len(prefix)-1]
+		path := filepath.Join(db.cfg.DBPath, recoveryCheckpointPrefix+typName)
+		for _, p := range []string{path, path + ".tmp"} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	if !db.cfg.NoSyncDir {
+		if err = syncDir(db.cfg.DBPath); err != nil {
+			return err
+		}
+	}
+	for prefix := range dropped {
+		path := filepath.Join(db.cfg.DBPath, dropIntentPrefix+prefix[len(logfile.FilePrefix):len(prefix)-1])
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_DropType(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_drop_type")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 1000
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.HSet(GetKey(i), []byte("field"), GetValue32()))
+		assert.Nil(t, db.Set(GetKey(i), []byte("value")))
+	}
+	hashFids := append([]uint32(nil), db.fidsMap[valueTypeHash].fids...)
+	assert.Greater(t, len(hashFids), 1)
+
+	assert.Nil(t, db.DropType(valueTypeHash))
+	for _, fid := range hashFids {
+		_, err := os.Stat(logFileName(path, logfile.Hash, fid))
+		assert.True(t, os.IsNotExist(err))
+		assert.Nil(t, db.getArchivedLogFile(valueTypeHash, fid))
+	}
+	assert.Empty(t, db.fidsMap[valueTypeHash].fids)
+	assert.Nil(t, db.activeLogFileMap[valueTypeHash])
+	val, err := db.HGet(GetKey(0), []byte("field"))
+	assert.Nil(t, err)
+	assert.Nil(t, val)
+	assert.False(t, db.HExistsKey(GetKey(0)))
+
+	// strings are untouched
+	for i := 0; i < 50; i++ {
+		val, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value"), val)
+	}
+
+	// hashes are recreated on next use, in log files after the dropped ones
+	assert.Nil(t, db.HSet(GetKey(0), []byte("field"), []byte("new")))
+	assert.Greater(t, db.getActiveLogFile(valueTypeHash).lf.Fid, hashFids[len(hashFids)-1])
+	check := func() {
+		val, err := db.HGet(GetKey(0), []byte("field"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("new"), val)
+		val, err = db.HGet(GetKey(1), []byte("field"))
+		assert.Nil(t, err)
+		assert.Nil(t, val)
+		val, err = db.Get(GetKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value"), val)
+	}
+	check()
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	check()
+
+	assert.Equal(t, ErrTypeNotRegistered, db.DropType(valueType(100)))
+}
+
+func TestLazyDB_DropTypeInterrupted(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_drop_type_interrupted")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 100 // an entry in a file
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	// the stale value of the field in fid 1 is shadowed by the latest one in fid 3
+	key, field := GetKey(1), []byte("field")
+	assert.Nil(t, db.HSet(key, field, GetValue32()))
+	assert.Nil(t, db.HSet(GetKey(2), field, GetValue32()))
+	assert.Nil(t, db.HSet(key, field, GetValue32()))
+	assert.Nil(t, db.HSet(GetKey(3), field, GetValue32()))
+	assert.Nil(t, db.Set(key, []byte("value")))
+	hashFids := append([]uint32(nil), db.fidsMap[valueTypeHash].fids...)
+	assert.Equal(t, []uint32{1, 2, 3, 4}, hashFids)
+
+	// crash after the intent is recorded, when only the newest log files have been removed
+	assert.Nil(t, db.writeDropIntent(valueTypeHash, 4))
+	assert.Nil(t, db.Close())
+	for _, fid := range []uint32{4, 3} {
+		assert.Nil(t, os.Remove(logFileName(path, logfile.Hash, fid)))
+	}
+
+	// the drop is completed on opening, the stale value does not come back
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	for _, fid := range hashFids {
+		_, err := os.Stat(logFileName(path, logfile.Hash, fid))
+		assert.True(t, os.IsNotExist(err))
+	}
+	_, err = os.Stat(db.dropIntentPath(valueTypeHash))
+	assert.True(t, os.IsNotExist(err))
+	val, err := db.HGet(key, field)
+	assert.Nil(t, err)
+	assert.Nil(t, val)
+	val, err = db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+}
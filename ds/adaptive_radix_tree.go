@@ -1,9 +1,25 @@
 package ds
 
 import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
 	art "github.com/plar/go-adaptive-radix-tree"
 )
 
+// Estimated memory size in bytes of each kind of tree node on 64-bit platforms, including the node reference.
+// Keys held by leaves are not included.
+const (
+	ARTLeafSize    = 56
+	ARTNode4Size   = 80
+	ARTNode16Size  = 192
+	ARTNode48Size  = 712
+	ARTNode256Size = 2088
+)
+
 type AdaptiveRadixTree struct {
 	tree art.Tree
 }
@@ -24,13 +40,56 @@ func (t *AdaptiveRadixTree) Put(key []byte, value interface{}) (oldVal interface
 }
 
 func (t *AdaptiveRadixTree) Delete(key []byte) (val interface{}, updated bool) {
+	if len(key) == 0 {
+		return t.deleteEmptyKey()
+	}
 	return t.tree.Delete(key)
 }
 
+// deleteEmptyKey deletes the zero-length key.
+// The underlying tree can store a zero-length key but is not able to delete it, so the tree is rebuilt without it.
+// A nil value is treated as not existing.
+func (t *AdaptiveRadixTree) deleteEmptyKey() (val interface{}, updated bool) {
+	val, found := t.tree.Search(nil)
+	if !found || val == nil {
+		return nil, false
+	}
+	newTree := art.New()
+	t.tree.ForEach(func(node art.Node) bool {
+		if len(node.Key()) > 0 {
+			newTree.Insert(node.Key(), node.Value())
+		}
+		return true
+	})
+	t.tree = newTree
+	return val, true
+}
+
 func (t *AdaptiveRadixTree) Size() int {
 	return t.tree.Size()
 }
 
+// MemoryUsage estimates the bytes held by nodes and keys of the tree, values are not included.
+func (t *AdaptiveRadixTree) MemoryUsage() int64 {
+	var usage int64
+	t.tree.ForEach(func(node art.Node) bool {
+		switch node.Kind() {
+		case art.Leaf:
+			usage += ARTLeafSize + int64(len(node.Key()))
+		case art.Node4:
+			usage += ARTNode4Size
+		case art.Node16:
+			usage += ARTNode16Size
+		case art.Node48:
+			usage += ARTNode48Size
+		case art.Node256:
+			usage += ARTNode256Size
+		}
+		return true
+	}, art.TraverseAll)
+	return usage
+}
+
 func (t *AdaptiveRadixTree) Iterator() art.Iterator {
 	return t.tree.Iterator()
 }
@@ -59,3 +118,98 @@ func (t *AdaptiveRadixTree) PrefixScan(prefix []byte, count int) (keys [][]byte)
 	}
 	return
 }
+
+// Dump writes the structure of the tree to w, one line per node in order of keys, indented by its level:
+//
+//	Node4 depth=4 prefix="key-" children=2
+//	  Leaf key="key-1"
+//	  Leaf key="key-2"
+//
+// depth is the offset of the key byte children of a node are indexed by, prefix is the part of keys compressed into
+// the node since its parent, and children is its fan-out, including the child of a key ending at the node.
+// Keys are quoted by strconv.Quote, and every line starts with indent. Nothing is written for an empty tree.
+// The output only depends on keys and node types, so it is stable for the same tree.
+func (t *AdaptiveRadixTree) Dump(w io.Writer, indent string) error {
+	// the underlying tree does not expose its inner nodes, their shape is rebuilt from keys, which is unique
+	// for a path-compressed tree, and checked against node types traversed in the same order.
+	d := &artDumper{w: bufio.NewWriter(w), indent: indent}
+	t.tree.ForEach(func(node art.Node) bool {
+		d.kinds = append(d.kinds, node.Kind())
+		if node.Kind() == art.Leaf {
+			d.keys = append(d.keys, node.Key())
+		}
+		return true
+	}, art.TraverseAll)
+	if len(d.keys) > 0 {
+		if err := d.dump(0, len(d.keys), 0, 0); err != nil {
+			return err
+		}
+	}
+	if len(d.kinds) > 0 {
+		return fmt.Errorf("%d unexpected nodes left in tree", len(d.kinds))
+	}
+	return d.w.Flush()
+}
+
+type artDumper struct {
+	w      *bufio.Writer
+	indent string
+	kinds  []art.Kind // types of nodes in order of traversal, consumed by dump
+	keys   [][]byte   // keys of leaves in order
+}
+
+// dump writes the node holding keys[lo:hi], whose prefix starts at offset from of keys, and its children.
+func (d *artDumper) dump(lo, hi, level, from int) error {
+	if len(d.kinds) == 0 {
+		return fmt.Errorf("missing node of key %q", d.keys[lo])
+	}
+	kind := d.kinds[0]
+	d.kinds = d.kinds[1:]
+	d.w.WriteString(d.indent)
+	d.w.WriteString(strings.Repeat("  ", level))
+
+	if hi-lo == 1 {
+		if kind != art.Leaf {
+			return fmt.Errorf("unexpected %v node of key %q", kind, d.keys[lo])
+		}
+		d.w.WriteString("Leaf key=")
+		d.w.WriteString(strconv.Quote(string(d.keys[lo])))
+		d.w.WriteByte('\n')
+		return nil
+	}
+	if kind == art.Leaf {
+		return fmt.Errorf("unexpected leaf of key %q", d.keys[lo])
+	}
+
+	// keys are sorted, so the common prefix of the first and the last one is shared by all of them
+	first, last := d.keys[lo], d.keys[hi-1]
+	depth := 0
+	for depth < len(first) && depth < len(last) && first[depth] == last[depth] {
+		depth++
+	}
+	type child struct{ lo, hi, from int }
+	var children []child
+	for i := lo; i < hi; {
+		// a key ending at the node sorts first
+		if len(d.keys[i]) == depth {
+			children = append(children, child{lo: i, hi: i + 1, from: depth})
+			i++
+			continue
+		}
+		j := i + 1
+		for j < hi && d.keys[j][depth] == d.keys[i][depth] {
+			j++
+		}
+		children = append(children, child{lo: i, hi: j, from: depth + 1})
+		i = j
+	}
+
+	fmt.Fprintf(d.w, "%v depth=%d prefix=%s children=%d\n",
+		kind, depth, strconv.Quote(string(first[from:depth])), len(children))
+	for _, c := range children {
+		if err := d.dump(c.lo, c.hi, level+1, c.from); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -125,6 +125,25 @@ func TestAdaptiveRadixTree_Delete(t *testing.T) {
 	}
 }
 
+func TestAdaptiveRadixTree_DeleteEmptyKey(t *testing.T) {
+	tree := NewART()
+	tree.Put([]byte{}, "empty")
+	tree.Put([]byte("0"), 0)
+	tree.Put([]byte("11"), 11)
+
+	gotVal, gotUpdated := tree.Delete(nil)
+	assert.Equal(t, "empty", gotVal)
+	assert.True(t, gotUpdated)
+	assert.Nil(t, tree.Get([]byte{}))
+	assert.Equal(t, 2, tree.Size())
+	assert.Equal(t, 0, tree.Get([]byte("0")))
+	assert.Equal(t, 11, tree.Get([]byte("11")))
+
+	gotVal, gotUpdated = tree.Delete([]byte{})
+	assert.Nil(t, gotVal)
+	assert.False(t, gotUpdated)
+}
+
 func TestAdaptiveRadixTree_PrefixScan(t *testing.T) {
 	art := NewART()
 	art.Put([]byte("acse"), 123)
@@ -172,3 +191,19 @@ func TestAdaptiveRadixTree_Iterator(t *testing.T) {
 	}
 	assert.Equal(t, keys, targets)
 }
+
+func TestAdaptiveRadixTree_MemoryUsage(t *testing.T) {
+	tree := NewART()
+	assert.Equal(t, int64(0), tree.MemoryUsage())
+
+	tree.Put([]byte("a"), 1)
+	assert.Equal(t, int64(ARTLeafSize+1), tree.MemoryUsage())
+
+	tree.Put([]byte("bc"), 2)
+	assert.Equal(t, int64(ARTNode4Size+2*ARTLeafSize+3), tree.MemoryUsage())
+
+	for i := 0; i < 3; i++ {
+		tree.Put([]byte{'d' + byte(i)}, i)
+	}
+	assert.Equal(t, int64(ARTNode16Size+5*ARTLeafSize+6), tree.MemoryUsage())
+}
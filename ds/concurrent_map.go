@@ -10,6 +10,7 @@ const (
 )
 
 type MapShard[K comparable] struct {
+	stats        shardLockStats // first field, so that its uint64 counters are 64-bit aligned for atomic access
 	simpleMap    map[K]any
 	sync.RWMutex // r&w lock for every shard
 }
@@ -93,14 +94,24 @@ func SimpleSharding(key uint32) uint32 {
 
 // GetShard returns the MapShard under the given key.
 func (cm *ConcurrentMap[K]) GetShard(key K) *MapShard[K] {
-	return cm.shards[uint(cm.sharding(key))%uint(cm.shardCount)]
+	return cm.shards[cm.ShardIndex(key)]
+}
+
+// ShardIndex returns the index of the MapShard under the given key, which is the same as ShardStat.Shard.
+func (cm *ConcurrentMap[K]) ShardIndex(key K) int {
+	return int(uint(cm.sharding(key)) % uint(cm.shardCount))
+}
+
+// ShardCount returns the number of shards.
+func (cm *ConcurrentMap[K]) ShardCount() int {
+	return len(cm.shards)
 }
 
 // GetShardByReading returns the MapShard under the given key after RLocking.
 // Remember to unlock the shard!
 func (cm *ConcurrentMap[K]) GetShardByReading(key K) *MapShard[K] {
 	shard := cm.GetShard(key)
-	shard.RLock()
+	shard.lockShard(false)
 	// remember to RUnlock
 	return shard
 }
@@ -109,7 +120,7 @@ func (cm *ConcurrentMap[K]) GetShardByReading(key K) *MapShard[K] {
 // Remember to unlock the shard!
 func (cm *ConcurrentMap[K]) GetShardByWriting(key K) *MapShard[K] {
 	shard := cm.GetShard(key)
-	shard.Lock()
+	shard.lockShard(true)
 	// remember to Unlock
 	return shard
 }
@@ -152,3 +163,19 @@ func (cm *ConcurrentMap[K]) Size() int {
 	}
 	return cnt
 }
+
+// Update calls fn with every key and value under the write lock of its shard, the key is set to the value
+// returned by fn, or removed if fn returns false.
+func (cm *ConcurrentMap[K]) Update(fn func(key K, value any) (any, bool)) {
+	for _, shard := range cm.shards {
+		shard.Lock()
+		for key, value := range shard.simpleMap {
+			if newValue, ok := fn(key, value); ok {
+				shard.simpleMap[key] = newValue
+			} else {
+				delete(shard.simpleMap, key)
+			}
+		}
+		shard.Unlock()
+	}
+}
@@ -2,6 +2,7 @@ package ds
 
 import (
 	"reflect"
+	"strconv"
 	"testing"
 )
 
@@ -260,3 +261,24 @@ func TestNewConcurrentMap(t *testing.T) {
 		})
 	}
 }
+
+func TestConcurrentMap_Update(t *testing.T) {
+	cm := NewConcurrentMap(DefaultShardCount)
+	for i := 0; i < 100; i++ {
+		cm.GetShardByWriting(strconv.Itoa(i)).Set(strconv.Itoa(i), i)
+		cm.GetShard(strconv.Itoa(i)).Unlock()
+	}
+	// odd values are doubled and even ones removed
+	cm.Update(func(key string, value any) (any, bool) {
+		return value.(int) * 2, value.(int)%2 == 1
+	})
+	if cm.Size() != 50 {
+		t.Errorf("Size Got = %v, Want %v", cm.Size(), 50)
+	}
+	for i := 0; i < 100; i++ {
+		got, ok := cm.Get(strconv.Itoa(i))
+		if ok != (i%2 == 1) || ok && got != i*2 {
+			t.Errorf("Get(%d) Got = %v %v", i, got, ok)
+		}
+	}
+}
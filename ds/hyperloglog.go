@@ -0,0 +1,92 @@
+package ds
+
+import (
+	"math"
+	"math/bits"
+)
+
+// DefaultHLLPrecision is the precision of HyperLogLog used if none is given, 2^14 registers take 16KB,
+// and the standard error of estimates is about 0.81%.
+const DefaultHLLPrecision = 14
+
+// HyperLogLog estimates the number of distinct items added to it in bounded memory.
+// Items are added by their 64-bit hashes, which must be uniformly distributed.
+// The standard error of estimates is 1.04/sqrt(2^precision).
+type HyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+// NewHyperLogLog returns an empty HyperLogLog with 2^precision registers, precision must be in [4, 18].
+func NewHyperLogLog(precision uint8) *HyperLogLog {
+	if precision < 4 || precision > 18 {
+		panic("hyperloglog: precision out of range")
+	}
+	return &HyperLogLog{precision: precision, registers: make([]uint8, 1<<precision)}
+}
+
+// LoadHyperLogLog returns a HyperLogLog holding registers returned by Registers, the precision is derived from
+// the number of registers. It returns false if registers are not of a HyperLogLog.
+func LoadHyperLogLog(registers []uint8) (*HyperLogLog, bool) {
+	n := len(registers)
+	precision := bits.Len(uint(n)) - 1
+	if n == 0 || n&(n-1) != 0 || precision < 4 || precision > 18 {
+		return nil, false
+	}
+	for _, r := range registers {
+		if r > uint8(64-precision+1) {
+			return nil, false
+		}
+	}
+	return &HyperLogLog{precision: uint8(precision), registers: registers}, true
+}
+
+// Add adds an item by its hash, and returns whether the estimate may have changed.
+func (h *HyperLogLog) Add(hash uint64) bool {
+	idx := hash >> (64 - h.precision)
+	// the trailing bit bounds the rank when the remaining bits are all zero
+	rank := uint8(bits.LeadingZeros64(hash<<h.precision|1<<(h.precision-1))) + 1
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+		return true
+	}
+	return false
+}
+
+// Merge adds all items added to other, both must be of the same precision.
+func (h *HyperLogLog) Merge(other *HyperLogLog) {
+	if other.precision != h.precision {
+		panic("hyperloglog: merging different precisions")
+	}
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+}
+
+// Registers returns the state of h, which can be loaded by LoadHyperLogLog. It is not copied.
+func (h *HyperLogLog) Registers() []uint8 {
+	return h.registers
+}
+
+// Count returns the estimated number of distinct items added.
+func (h *HyperLogLog) Count() uint64 {
+	m := float64(len(h.registers))
+	var sum float64
+	var zeros int
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	// linear counting is more accurate for small cardinalities, the raw estimate is biased up to about 3m
+	if zeros > 0 {
+		if estimate := m * math.Log(m/float64(zeros)); estimate <= 3*m {
+			return uint64(estimate + 0.5)
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	return uint64(estimate + 0.5)
+}
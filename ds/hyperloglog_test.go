@@ -0,0 +1,31 @@
+package ds
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/billsjc123/LazyDB/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHyperLogLog_Count(t *testing.T) {
+	hll := NewHyperLogLog(DefaultHLLPrecision)
+	assert.Equal(t, uint64(0), hll.Count())
+
+	bound := 3 * 1.04 / math.Sqrt(float64(uint64(1)<<DefaultHLLPrecision))
+	buf := make([]byte, 8)
+	added := 0
+	for _, n := range []int{100, 10000, 40000, 50000, 200000} {
+		for ; added < n; added++ {
+			binary.LittleEndian.PutUint64(buf, uint64(added))
+			hll.Add(util.XXHash64Sum(buf))
+		}
+		// adding again changes nothing
+		binary.LittleEndian.PutUint64(buf, 0)
+		hll.Add(util.XXHash64Sum(buf))
+
+		count := float64(hll.Count())
+		assert.InDelta(t, float64(n), count, float64(n)*bound, "n = %d", n)
+	}
+}
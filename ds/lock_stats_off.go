@@ -0,0 +1,6 @@
+//go:build lazydb_nolockstats
+
+package ds
+
+// lockStatsEnabled counts lock acquisitions of shards, see ConcurrentMap.ShardStats.
+const lockStatsEnabled = false
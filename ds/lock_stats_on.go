@@ -0,0 +1,7 @@
+//go:build !lazydb_nolockstats
+
+package ds
+
+// lockStatsEnabled counts lock acquisitions of shards, see ConcurrentMap.ShardStats.
+// It is compiled out by build tag lazydb_nolockstats.
+const lockStatsEnabled = true
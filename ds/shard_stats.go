@@ -0,0 +1,71 @@
+package ds
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ShardStat lock statistics of a shard of a ConcurrentMap, see ConcurrentMap.ShardStats.
+type ShardStat struct {
+	Shard        int           // index of the shard
+	Keys         int           // number of keys in the shard
+	Acquisitions uint64        // number of times the shard is locked by GetShardByReading or GetShardByWriting
+	Contentions  uint64        // number of acquisitions which had to wait for the lock
+	WaitTime     time.Duration // total time waited for the lock by contended acquisitions
+}
+
+// shardLockStats counters of lock acquisitions of a MapShard, accessed atomically.
+type shardLockStats struct {
+	acquisitions uint64
+	contentions  uint64
+	waitNanos    uint64
+}
+
+// lockShard locks the shard for reading or writing, and counts the acquisition if lockStatsEnabled.
+// An uncontended acquisition only costs an extra atomic add, the lock is taken by TryLock first,
+// and the wait is timed only if it fails.
+func (ms *MapShard[K]) lockShard(write bool) {
+	if !lockStatsEnabled {
+		if write {
+			ms.Lock()
+		} else {
+			ms.RLock()
+		}
+		return
+	}
+
+	atomic.AddUint64(&ms.stats.acquisitions, 1)
+	if write && ms.TryLock() || !write && ms.TryRLock() {
+		return
+	}
+	start := time.Now()
+	if write {
+		ms.Lock()
+	} else {
+		ms.RLock()
+	}
+	atomic.AddUint64(&ms.stats.contentions, 1)
+	atomic.AddUint64(&ms.stats.waitNanos, uint64(time.Since(start)))
+}
+
+// ShardStats returns lock statistics of every shard, so that the shard count can be tuned,
+// e.g. by DBConfig.HashIndexShardCount. A shard with far more contentions than others is hot,
+// which means keys are skewed, and a high contention rate of all shards means there are too few shards.
+// Only locks taken by GetShardByReading and GetShardByWriting are counted.
+// Counters are always zero if the package is built with tag lazydb_nolockstats.
+func (cm *ConcurrentMap[K]) ShardStats() []ShardStat {
+	stats := make([]ShardStat, len(cm.shards))
+	for i, shard := range cm.shards {
+		shard.RLock()
+		keys := len(shard.simpleMap)
+		shard.RUnlock()
+		stats[i] = ShardStat{
+			Shard:        i,
+			Keys:         keys,
+			Acquisitions: atomic.LoadUint64(&shard.stats.acquisitions),
+			Contentions:  atomic.LoadUint64(&shard.stats.contentions),
+			WaitTime:     time.Duration(atomic.LoadUint64(&shard.stats.waitNanos)),
+		}
+	}
+	return stats
+}
@@ -0,0 +1,60 @@
+package ds
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrentMap_ShardStats(t *testing.T) {
+	if !lockStatsEnabled {
+		t.Skip("lock stats are compiled out")
+	}
+	cm := NewWithCustomShardingFunction[uint32](DefaultShardCount, SimpleSharding)
+	const hotKey = 7
+
+	// many writers on the hot key, a single writer on every other shard
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				shard := cm.GetShardByWriting(hotKey)
+				shard.Set(hotKey, j)
+				time.Sleep(10 * time.Microsecond)
+				shard.Unlock()
+			}
+		}()
+	}
+	for key := uint32(0); key < DefaultShardCount; key++ {
+		if key == hotKey {
+			continue
+		}
+		shard := cm.GetShardByReading(key)
+		shard.RUnlock()
+		shard = cm.GetShardByWriting(key)
+		shard.Set(key, key)
+		shard.Unlock()
+	}
+	wg.Wait()
+
+	stats := cm.ShardStats()
+	assert.Equal(t, DefaultShardCount, len(stats))
+	hot := stats[hotKey]
+	assert.Equal(t, hotKey, hot.Shard)
+	assert.Equal(t, 1, hot.Keys)
+	assert.Equal(t, uint64(8*200), hot.Acquisitions)
+	assert.Greater(t, hot.Contentions, uint64(0))
+	assert.Greater(t, hot.WaitTime, time.Duration(0))
+	for i, stat := range stats {
+		if i == hotKey {
+			continue
+		}
+		assert.Equal(t, uint64(2), stat.Acquisitions)
+		assert.Equal(t, uint64(0), stat.Contentions)
+		assert.Equal(t, 1, stat.Keys)
+	}
+}
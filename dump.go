@@ -0,0 +1,183 @@
+package lazydb
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/billsjc123/LazyDB/ds"
+)
+
+// dumpTypeNames names of value types in the output of DumpAll.
+var dumpTypeNames = map[valueType]string{
+	valueTypeString: "string",
+	valueTypeList:   "list",
+	valueTypeHash:   "hash",
+	valueTypeSet:    "set",
+	valueTypeZSet:   "zset",
+}
+
+// DumpAll writes all keys and values of every type into w in a human-readable text format, one line per entry:
+//
+//	string <key> <value>
+//	list <key> <index> <value>
+//	hash <key> <field> <value>
+//	set <key> <member>
+//	zset <key> <score> <member>
+//
+// Keys, fields and members are quoted by strconv.Quote. Types are written in order, keys of each type,
+// fields of a hash and members of a set are sorted, elements of a list are in list order and members of
+// a sorted set are in score order, then sorted. So the output is deterministic, and can be compared with a golden file.
+// Time to live of keys is not written. DumpAll is aborted by the first key denied by DBConfig.AccessControl. The dump is not a consistent snapshot if db is modified meanwhile.
+func (db *LazyDB) DumpAll(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for typ := valueType(0); typ < logFileTypeNum; typ++ {
+		keys, err := db.sortedKeys(typ)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := db.dumpKey(bw, typ, key); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// dumpKey writes the value of key of the type, nothing is written if key does not exist anymore.
+func (db *LazyDB) dumpKey(w *bufio.Writer, typ valueType, key []byte) error {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return err
+	}
+	write := func(fields ...string) {
+		w.WriteString(dumpTypeNames[typ])
+		w.WriteByte(' ')
+		w.WriteString(strconv.Quote(string(key)))
+		for _, field := range fields {
+			w.WriteByte(' ')
+			w.WriteString(field)
+		}
+		w.WriteByte('\n')
+	}
+
+	switch typ {
+	case valueTypeString:
+		val, err := db.Get(key)
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		write(strconv.Quote(string(val)))
+	case valueTypeList:
+		values, err := db.LGetAll(key)
+		if err != nil {
+			return err
+		}
+		for i, val := range values {
+			write(strconv.Itoa(i), strconv.Quote(string(val)))
+		}
+	case valueTypeHash:
+		pairs, err := db.HGetAll(key)
+		if err != nil {
+			return err
+		}
+		fields := make([]int, 0, len(pairs)/2)
+		for i := 0; i < len(pairs); i += 2 {
+			fields = append(fields, i)
+		}
+		sort.Slice(fields, func(i, j int) bool {
+			return bytes.Compare(pairs[fields[i]], pairs[fields[j]]) < 0
+		})
+		for _, i := range fields {
+			write(strconv.Quote(string(pairs[i])), strconv.Quote(string(pairs[i+1])))
+		}
+	case valueTypeSet:
+		members, err := db.SMembers(key)
+		if err != nil {
+			return err
+		}
+		sort.Slice(members, func(i, j int) bool {
+			return bytes.Compare(members[i], members[j]) < 0
+		})
+		for _, member := range members {
+			write(strconv.Quote(string(member)))
+		}
+	case valueTypeZSet:
+		members, scores, err := db.ZRangeWithScores(key, 0, -1)
+		if err != nil {
+			return err
+		}
+		zMembers := make([]ZMember, len(members))
+		for i := range members {
+			zMembers[i] = ZMember{Member: members[i], Score: scores[i]}
+		}
+		// order of members with the same score is not defined by the skip list
+		sort.SliceStable(zMembers, func(i, j int) bool {
+			if zMembers[i].Score != zMembers[j].Score {
+				return zMembers[i].Score < zMembers[j].Score
+			}
+			return bytes.Compare(zMembers[i].Member, zMembers[j].Member) < 0
+		})
+		for _, zm := range zMembers {
+			write(strconv.FormatFloat(zm.Score, 'g', -1, 64), strconv.Quote(string(zm.Member)))
+		}
+	}
+	return nil
+}
+
+// DumpIndexTree writes the structure of the adaptive radix trees indexing the type into w for diagnosing, see
+// ds.AdaptiveRadixTree.Dump for the format. It shows how keys share prefixes and how the tree fans out.
+// The type String and custom types have a single tree, while every key of collections has a tree of its own,
+// which is written after the line
+//
+//	key <key>
+//
+// in order of keys. Index lock of the type is held for reading meanwhile, so the output is consistent,
+// and the same for the same index.
+func (db *LazyDB) DumpIndexTree(typ valueType, w io.Writer) error {
+	if typ >= logFileTypeNum && db.getCustomType(typ) == nil {
+		return ErrTypeNotRegistered
+	}
+	mu := db.getIndexLock(typ)
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var trees map[string]*ds.AdaptiveRadixTree
+	switch typ {
+	case valueTypeString:
+		return db.strIndex.idxTree.Dump(w, "")
+	case valueTypeList:
+		trees = db.listIndex.trees
+	case valueTypeHash:
+		trees = db.hashIndex.trees
+	case valueTypeSet:
+		trees = db.setIndex.trees
+	case valueTypeZSet:
+		trees = make(map[string]*ds.AdaptiveRadixTree, len(db.zSetIndex.indexes))
+		for key, idx := range db.zSetIndex.indexes {
+			trees[key] = idx.tree
+		}
+	default:
+		return db.getCustomType(typ).index.idxTree.Dump(w, "")
+	}
+
+	keys := make([]string, 0, len(trees))
+	for key := range trees {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, err := io.WriteString(w, "key "+strconv.Quote(key)+"\n"); err != nil {
+			return err
+		}
+		if err := trees[key].Dump(w, "  "); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package lazydb
+
+import (
+	"bytes"
+	"github.com/billsjc123/LazyDB/util"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_DumpAll(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	assert.Nil(t, db.Set([]byte("s2"), []byte("v2")))
+	assert.Nil(t, db.Set([]byte("s1"), []byte("v1\n")))
+	assert.Nil(t, db.HSet([]byte("h1"), []byte("f2"), []byte("v2"), []byte("f1"), []byte("v1")))
+	assert.Nil(t, db.RPush([]byte("l1"), []byte("b"), []byte("c")))
+	assert.Nil(t, db.LPush([]byte("l1"), []byte("a")))
+	assert.Nil(t, db.SAdd([]byte("set1"), []byte("m2"), []byte("m1"), []byte("m3")))
+	assert.Nil(t, db.ZAdd([]byte("z1"), util.Float64ToByte(2), []byte("m2"), util.Float64ToByte(1.5), []byte("m1")))
+	assert.Nil(t, db.ZAdd([]byte("z1"), util.Float64ToByte(2), []byte("m0")))
+
+	golden, err := os.ReadFile(filepath.Join("testdata", "dump_all.golden"))
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		var buf bytes.Buffer
+		assert.Nil(t, db.DumpAll(&buf))
+		assert.Equal(t, string(golden), buf.String())
+	}
+}
+
+func TestLazyDB_DumpIndexTree(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+
+	for _, key := range []string{"user:1", "user:2", "user:10", "order:1"} {
+		assert.Nil(t, db.Set([]byte(key), GetValue32()))
+	}
+	expected := `Node4 depth=0 prefix="" children=2
+  Leaf key="order:1"
+  Node4 depth=5 prefix="ser:" children=2
+    Node4 depth=6 prefix="" children=2
+      Leaf key="user:1"
+      Leaf key="user:10"
+    Leaf key="user:2"
+`
+	// the output is stable
+	for i := 0; i < 2; i++ {
+		var buf bytes.Buffer
+		assert.Nil(t, db.DumpIndexTree(valueTypeString, &buf))
+		assert.Equal(t, expected, buf.String())
+	}
+
+	// nodes grow with fan-out
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.Set([]byte("user:3"+string(rune('a'+i))), GetValue32()))
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, db.DumpIndexTree(valueTypeString, &buf))
+	assert.Contains(t, buf.String(), "  Node4 depth=5 prefix=\"ser:\" children=3\n")
+	assert.Contains(t, buf.String(), "    Node48 depth=6 prefix=\"\" children=20\n")
+
+	// every key of collections has a tree
+	assert.Nil(t, db.SAdd([]byte("s2"), []byte("m")))
+	assert.Nil(t, db.SAdd([]byte("s1"), []byte("m1"), []byte("m2")))
+	buf.Reset()
+	assert.Nil(t, db.DumpIndexTree(valueTypeSet, &buf))
+	// members are indexed by their hashes
+	assert.Regexp(t, `^key "s1"\n  Node4 depth=0 prefix="" children=2\n    Leaf key=.*\n    Leaf key=.*\nkey "s2"\n  Leaf key=.*\n$`, buf.String())
+
+	assert.Equal(t, ErrTypeNotRegistered, db.DumpIndexTree(valueType(100), &buf))
+}
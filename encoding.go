@@ -0,0 +1,92 @@
+package lazydb
+
+import (
+	"strconv"
+
+	"github.com/billsjc123/LazyDB/util"
+)
+
+// Default thresholds of small collections reported by Encoding, they are the same as Redis.
+const (
+	defaultHashMaxListpackEntries = 128
+	defaultHashMaxListpackValue   = 64
+	defaultSetMaxIntsetEntries    = 512
+	defaultSetMaxListpackEntries  = 128
+	defaultSetMaxListpackValue    = 64
+	defaultZSetMaxListpackEntries = 128
+	defaultZSetMaxListpackValue   = 64
+	defaultListMaxListpackSize    = 128
+)
+
+// Encoding reports the encoding of the value stored at key like OBJECT ENCODING of Redis, so that users can reason
+// about memory by the familiar names. Strings are "int" if the value is an integer, otherwise "raw".
+// Small collections within thresholds of DBConfig, e.g. DBConfig.HashMaxListpackEntries, are "listpack" for hashes,
+// sorted sets and lists, and "intset" for sets of integers. Larger ones are "hashtable" for hashes and sets,
+// "skiplist" for sorted sets and "quicklist" for lists.
+// Types are looked up in the same order as GetAny, and ErrKeyNotFound is returned if the key does not exist.
+func (db *LazyDB) Encoding(key []byte) (string, error) {
+	val, typ, err := db.GetAny(key)
+	if err != nil {
+		return "", err
+	}
+	switch typ {
+	case valueTypeString:
+		if isInteger(val.([]byte)) {
+			return "int", nil
+		}
+		return "raw", nil
+	case valueTypeHash:
+		hash := val.(map[string][]byte)
+		small := len(hash) <= threshold(db.cfg.HashMaxListpackEntries, defaultHashMaxListpackEntries)
+		maxValue := threshold(db.cfg.HashMaxListpackValue, defaultHashMaxListpackValue)
+		for field, value := range hash {
+			if !small {
+				break
+			}
+			small = len(field) <= maxValue && len(value) <= maxValue
+		}
+		if small {
+			return "listpack", nil
+		}
+		return "hashtable", nil
+	case valueTypeList:
+		if len(val.([][]byte)) <= threshold(db.cfg.ListMaxListpackSize, defaultListMaxListpackSize) {
+			return "listpack", nil
+		}
+		return "quicklist", nil
+	case valueTypeSet:
+		members := val.([][]byte)
+		small := len(members) <= threshold(db.cfg.SetMaxIntsetEntries, defaultSetMaxIntsetEntries)
+		for i := 0; small && i < len(members); i++ {
+			small = isInteger(members[i])
+		}
+		if small {
+			return "intset", nil
+		}
+		return "hashtable", nil
+	default:
+		members := val.([]ZMember)
+		small := len(members) <= threshold(db.cfg.ZSetMaxListpackEntries, defaultZSetMaxListpackEntries)
+		maxValue := threshold(db.cfg.ZSetMaxListpackValue, defaultZSetMaxListpackValue)
+		for i := 0; small && i < len(members); i++ {
+			small = len(members[i].Member) <= maxValue
+		}
+		if small {
+			return "listpack", nil
+		}
+		return "skiplist", nil
+	}
+}
+
+func isInteger(b []byte) bool {
+	_, err := strconv.ParseInt(util.ByteToString(b), 10, 64)
+	return err == nil
+}
+
+// threshold returns v, or def if v is not positive.
+func threshold(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
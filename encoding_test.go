@@ -0,0 +1,62 @@
+package lazydb
+
+import (
+	"github.com/billsjc123/LazyDB/util"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_Encoding(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+	db.cfg.HashMaxListpackEntries = 4
+	db.cfg.SetMaxIntsetEntries = 4
+	db.cfg.ZSetMaxListpackEntries = 4
+	db.cfg.ListMaxListpackSize = 4
+
+	encoding := func(key string) string {
+		enc, err := db.Encoding([]byte(key))
+		assert.Nil(t, err)
+		return enc
+	}
+
+	assert.Nil(t, db.Set([]byte("int"), []byte("-12345")))
+	assert.Nil(t, db.Set([]byte("raw"), []byte("12345a")))
+	assert.Equal(t, "int", encoding("int"))
+	assert.Equal(t, "raw", encoding("raw"))
+
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, db.HSet([]byte("small_hash"), GetKey(i), GetValue32()))
+		assert.Nil(t, db.HSet([]byte("large_hash"), GetKey(i), GetValue32()))
+		assert.Nil(t, db.HSet([]byte("long_value_hash"), GetKey(i), GetValue32()))
+	}
+	assert.Nil(t, db.HSet([]byte("large_hash"), GetKey(4), GetValue32()))
+	assert.Nil(t, db.HSet([]byte("long_value_hash"), GetKey(0), GetValue(65)))
+	assert.Equal(t, "listpack", encoding("small_hash"))
+	assert.Equal(t, "hashtable", encoding("large_hash"))
+	assert.Equal(t, "hashtable", encoding("long_value_hash"))
+
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, db.SAdd([]byte("int_set"), []byte(strconv.Itoa(i))))
+		assert.Nil(t, db.RPush([]byte("small_list"), GetValue32()))
+		assert.Nil(t, db.ZAdd([]byte("small_zset"), util.Float64ToByte(float64(i)), GetKey(i)))
+	}
+	assert.Nil(t, db.SAdd([]byte("str_set"), []byte("a")))
+	assert.Equal(t, "intset", encoding("int_set"))
+	assert.Equal(t, "hashtable", encoding("str_set"))
+	assert.Equal(t, "listpack", encoding("small_list"))
+	assert.Equal(t, "listpack", encoding("small_zset"))
+
+	assert.Nil(t, db.SAdd([]byte("int_set"), []byte("4")))
+	assert.Nil(t, db.RPush([]byte("small_list"), GetValue32()))
+	assert.Nil(t, db.ZAdd([]byte("small_zset"), util.Float64ToByte(4), GetKey(4)))
+	assert.Equal(t, "hashtable", encoding("int_set"))
+	assert.Equal(t, "quicklist", encoding("small_list"))
+	assert.Equal(t, "skiplist", encoding("small_zset"))
+
+	_, err := db.Encoding([]byte("missing"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
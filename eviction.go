@@ -0,0 +1,227 @@
+package lazydb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/billsjc123/LazyDB/ds"
+	"log"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+)
+
+// ErrOOM is returned by writes when index memory exceeds DBConfig.MaxMemory and no key can be evicted.
+var ErrOOM = errors.New("index memory exceeds max memory")
+
+// EvictionPolicy decides which keys are evicted when index memory exceeds DBConfig.MaxMemory.
+// Only keys of type String are evicted, while indexes of all types count towards the memory.
+type EvictionPolicy uint8
+
+const (
+	// NoEviction never evicts keys, writes return ErrOOM once the memory exceeds the limit.
+	NoEviction EvictionPolicy = iota
+	// AllKeysLRU evicts the keys that have been idle for the longest time first, see IdleTime.
+	AllKeysLRU
+	// AllKeysRandom evicts random keys.
+	AllKeysRandom
+	// VolatileTTL evicts the keys with time to live which expire the soonest first,
+	// writes return ErrOOM if there is no such key.
+	VolatileTTL
+)
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case NoEviction:
+		return "noeviction"
+	case AllKeysLRU:
+		return "allkeys-lru"
+	case AllKeysRandom:
+		return "allkeys-random"
+	case VolatileTTL:
+		return "volatile-ttl"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(p))
+	}
+}
+
+// evictionSubBufferSize is the buffer size of a channel returned by SubscribeEviction.
+const evictionSubBufferSize = 1024
+
+// EvictionEvent is sent by SubscribeEviction once a key is evicted.
+type EvictionEvent struct {
+	Key []byte
+	// Reason the policy which evicted the key, AllKeysLRU, AllKeysRandom or VolatileTTL.
+	Reason EvictionPolicy
+}
+
+// SubscribeEviction returns a channel that receives keys of type String evicted because DBConfig.MaxMemory is exceeded,
+// along with the reason, so that evictions can be told apart from deletes. Events are sent after keys are removed
+// from the index. Events are dropped if the channel buffer is full, so subscribers should keep reading from the channel.
+// Call the returned function to unsubscribe, the channel will be closed then.
+func (db *LazyDB) SubscribeEviction() (<-chan EvictionEvent, func()) {
+	return db.evictionSubs.subscribe(evictionSubBufferSize)
+}
+
+func (db *LazyDB) notifyEvicted(key []byte) {
+	dropped := db.evictionSubs.publish(func() EvictionEvent {
+		k := make([]byte, len(key))
+		copy(k, key)
+		return EvictionEvent{Key: k, Reason: db.cfg.EvictionPolicy}
+	})
+	for i := 0; i < dropped; i++ {
+		log.Printf("eviction subscriber is full, drop key: %s", key)
+	}
+}
+
+// evict removes keys of type String by DBConfig.EvictionPolicy until index memory is within DBConfig.MaxMemory,
+// it is called before writes of type String. Tombstones of evicted keys are written like Delete.
+// Computing index memory walks all indexes, so it is only meant for caches of moderate size.
+// Lock of strIndex must be held by the caller.
+func (db *LazyDB) evict() error {
+	if db.cfg.MaxMemory <= 0 {
+		return nil
+	}
+	usage := make(map[valueType]int64, logFileTypeNum)
+	db.collectionMemoryUsage(usage)
+	used := treeMemoryUsage(db.strIndex.idxTree) + treeMemoryUsage(db.strIndex.ttlTree)
+	for _, u := range usage {
+		used += u
+	}
+	if used <= db.cfg.MaxMemory {
+		return nil
+	}
+	if db.cfg.EvictionPolicy == NoEviction {
+		return ErrOOM
+	}
+
+	next := db.evictionCandidates()
+	for key := next(); key != nil; key = next() {
+		if used <= db.cfg.MaxMemory {
+			return nil
+		}
+		if err := db.deleteStr(key); err != nil {
+			return err
+		}
+		db.notifyEvicted(key)
+		// inner nodes are not counted, so the freed memory is underestimated
+		used -= ds.ARTLeafSize + int64(len(key)) + indexValueSize
+	}
+	if used > db.cfg.MaxMemory {
+		return ErrOOM
+	}
+	return nil
+}
+
+// evictionCandidates returns a function which returns keys of type String one by one in the order they should be
+// evicted by DBConfig.EvictionPolicy, and nil once there are no more keys. The returned key must be evicted before
+// the next one is returned. Keys of VolatileTTL are looked up in the ttl index one at a time, while the others
+// walk and sort all keys once. Lock of strIndex must be held by the caller.
+func (db *LazyDB) evictionCandidates() func() []byte {
+	if db.cfg.EvictionPolicy == AllKeysLRU && db.cfg.LRUSamples > 0 {
+		return db.sampleLRUKey
+	}
+	if db.cfg.EvictionPolicy == VolatileTTL {
+		var last []byte
+		return func() []byte {
+			key := db.soonestExpiring()
+			// never loop on a key which is not removed from the ttl index
+			if key != nil && bytes.Equal(key, last) {
+				return nil
+			}
+			last = key
+			return key
+		}
+	}
+	type candidate struct {
+		key  []byte
+		rank int64
+	}
+	var candidates []candidate
+	iter := db.strIndex.idxTree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil {
+			break
+		}
+		idxNode, _ := node.Value().(*Value)
+		if idxNode == nil {
+			continue
+		}
+		c := candidate{key: node.Key()}
+		switch db.cfg.EvictionPolicy {
+		case AllKeysLRU:
+			c.rank = atomic.LoadInt64(&idxNode.lastAccess)
+		case AllKeysRandom:
+			c.rank = rand.Int63()
+		}
+		candidates = append(candidates, c)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].rank < candidates[j].rank
+	})
+
+	return func() []byte {
+		if len(candidates) == 0 {
+			return nil
+		}
+		key := candidates[0].key
+		candidates = candidates[1:]
+		return key
+	}
+}
+
+// sampleLRUKey returns the coldest of DBConfig.LRUSamples keys of type String picked at random, nil if there is no key.
+// Keys are picked from strIndex.lruKeys, which is taken again by walking the index once its size is far from
+// the size of the index, or no key picked is in the index any more. Lock of strIndex must be held by the caller.
+func (db *LazyDB) sampleLRUKey() []byte {
+	size := db.strIndex.idxTree.Size()
+	if size == 0 {
+		return nil
+	}
+	if keys := len(db.strIndex.lruKeys); keys == 0 || size > 2*keys || size < keys/2 {
+		db.resetLRUKeys()
+	}
+	for retried := false; ; retried = true {
+		var coldest int
+		var lastAccess int64
+		found := false
+		for _, i := range db.randPick(len(db.strIndex.lruKeys), -db.cfg.LRUSamples) {
+			idxNode, _ := db.strIndex.idxTree.Get(db.strIndex.lruKeys[i]).(*Value)
+			if idxNode == nil {
+				continue
+			}
+			if access := atomic.LoadInt64(&idxNode.lastAccess); !found || access < lastAccess {
+				coldest, lastAccess, found = i, access, true
+			}
+		}
+		if found {
+			// the key is evicted by the caller
+			keys := db.strIndex.lruKeys
+			key := keys[coldest]
+			keys[coldest] = keys[len(keys)-1]
+			db.strIndex.lruKeys = keys[:len(keys)-1]
+			return key
+		}
+		if retried {
+			return nil
+		}
+		db.resetLRUKeys()
+	}
+}
+
+// resetLRUKeys takes strIndex.lruKeys by walking the index.
+func (db *LazyDB) resetLRUKeys() {
+	keys := make([][]byte, 0, db.strIndex.idxTree.Size())
+	iter := db.strIndex.idxTree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil {
+			break
+		}
+		if _, ok := node.Value().(*Value); ok {
+			keys = append(keys, node.Key())
+		}
+	}
+	db.strIndex.lruKeys = keys
+}
@@ -0,0 +1,196 @@
+package lazydb
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func indexMemory(db *LazyDB) int64 {
+	var total int64
+	for _, usage := range db.IndexMemoryUsage() {
+		total += usage
+	}
+	return total
+}
+
+func TestLazyDB_EvictAllKeysLRU(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+		now = now.Add(time.Second)
+	}
+	// key 0 is accessed recently, key 1 becomes the coldest one
+	_, err := db.Get(GetKey(0))
+	assert.Nil(t, err)
+
+	db.cfg.MaxMemory = indexMemory(db) - 1
+	db.cfg.EvictionPolicy = AllKeysLRU
+	assert.Nil(t, db.Set(GetKey(10), GetValue32()))
+
+	_, err = db.Get(GetKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	for _, i := range []int{0, 2, 9, 10} {
+		_, err = db.Get(GetKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 10, db.Count())
+}
+
+func TestLazyDB_EvictVolatileTTL(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	assert.Nil(t, db.Set(GetKey(0), GetValue32()))
+	assert.Nil(t, db.SetEX(GetKey(1), GetValue32(), time.Hour))
+	assert.Nil(t, db.SetEX(GetKey(2), GetValue32(), time.Minute))
+
+	db.cfg.MaxMemory = indexMemory(db) - 1
+	db.cfg.EvictionPolicy = VolatileTTL
+	assert.Nil(t, db.Set(GetKey(3), GetValue32()))
+	_, err := db.Get(GetKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get(GetKey(1))
+	assert.Nil(t, err)
+
+	// keys without time to live are never evicted
+	db.cfg.MaxMemory = 1
+	assert.Equal(t, ErrOOM, db.Set(GetKey(4), GetValue32()))
+	_, err = db.Get(GetKey(0))
+	assert.Nil(t, err)
+}
+
+func TestLazyDB_NoEviction(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+	}
+	db.cfg.MaxMemory = indexMemory(db)
+	db.cfg.EvictionPolicy = NoEviction
+	// the write exceeding the limit is allowed
+	assert.Nil(t, db.Set(GetKey(10), GetValue32()))
+
+	// the store is full
+	assert.Equal(t, ErrOOM, db.Set(GetKey(11), GetValue32()))
+	_, err := db.Incr(GetKey(12))
+	assert.Equal(t, ErrOOM, err)
+	_, err = db.Get(GetKey(11))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 11, db.Count())
+
+	// deleting keys makes room
+	assert.Nil(t, db.Delete(GetKey(0)))
+	assert.Nil(t, db.Delete(GetKey(1)))
+	assert.Nil(t, db.Set(GetKey(11), GetValue32()))
+}
+
+func TestLazyDB_SubscribeEviction(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	events, cancel := db.SubscribeEviction()
+	defer cancel()
+
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+		now = now.Add(time.Second)
+	}
+	// explicit deletes are not eviction events
+	assert.Nil(t, db.Delete(GetKey(2)))
+
+	db.cfg.MaxMemory = indexMemory(db) - 1
+	db.cfg.EvictionPolicy = AllKeysLRU
+	assert.Nil(t, db.Set(GetKey(3), GetValue32()))
+	select {
+	case event := <-events:
+		assert.Equal(t, GetKey(0), event.Key)
+		assert.Equal(t, AllKeysLRU, event.Reason)
+		// removed from the index before the event is sent
+		_, err := db.Get(event.Key)
+		assert.Equal(t, ErrKeyNotFound, err)
+	default:
+		t.Fatal("no eviction event")
+	}
+
+	db.cfg.MaxMemory = 0
+	assert.Nil(t, db.SetEX(GetKey(4), GetValue32(), time.Minute))
+	db.cfg.MaxMemory = indexMemory(db) - 1
+	db.cfg.EvictionPolicy = VolatileTTL
+	assert.Nil(t, db.Set(GetKey(5), GetValue32()))
+	event := <-events
+	assert.Equal(t, GetKey(4), event.Key)
+	assert.Equal(t, VolatileTTL, event.Reason)
+	assert.Equal(t, "volatile-ttl", event.Reason.String())
+
+	db.cfg.MaxMemory = indexMemory(db) - 1
+	db.cfg.EvictionPolicy = AllKeysRandom
+	assert.Nil(t, db.Set(GetKey(6), GetValue32()))
+	event = <-events
+	assert.Equal(t, AllKeysRandom, event.Reason)
+	select {
+	case event = <-events:
+		t.Fatalf("unexpected eviction event: %s", event.Key)
+	default:
+	}
+
+	cancel()
+	_, ok := <-events
+	assert.False(t, ok)
+}
+
+func TestLazyDB_EvictLRUSamples(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	const n = 20000
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+		now = now.Add(time.Millisecond)
+	}
+
+	db.cfg.MaxMemory = indexMemory(db) - 1
+	db.cfg.EvictionPolicy = AllKeysLRU
+	db.cfg.LRUSamples = 5
+	db.cfg.RandSource = rand.NewSource(1)
+	assert.Nil(t, db.Set(GetKey(n), GetValue32()))
+	assert.Equal(t, n, db.Count())
+
+	// keys are accessed in order, the evicted one is in the colder half
+	evicted := -1
+	for i := 0; i < n; i++ {
+		if _, err := db.Get(GetKey(i)); err == ErrKeyNotFound {
+			evicted = i
+			break
+		}
+	}
+	assert.GreaterOrEqual(t, evicted, 0)
+	assert.Less(t, evicted, n/2)
+
+	// keys are picked without walking the index again
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+	keys := len(db.strIndex.lruKeys)
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		assert.NotNil(t, db.sampleLRUKey())
+	}
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, keys-1000, len(db.strIndex.lruKeys))
+}
@@ -0,0 +1,186 @@
+package lazydb
+
+import (
+	"github.com/billsjc123/LazyDB/logfile"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// expirySubBufferSize is the buffer size of a channel returned by SubscribeExpiry.
+	expirySubBufferSize = 1024
+
+	// defaultActiveExpireInterval interval of active expire turned on by SetActiveExpire
+	// if DBConfig.ActiveExpireInterval is not set.
+	defaultActiveExpireInterval = 100 * time.Millisecond
+)
+
+// SubscribeExpiry returns a channel that receives keys of type String once they are removed because of expiration,
+// either by lazy-expiry on reading or by the background active expire cycle.
+// Each expired key is sent exactly once. Expiration never waits for subscribers, so notifications are dropped if
+// the channel buffer is full, and counted by Stats.DroppedExpiryNotifications. Subscribers should keep reading
+// from the channel, and resync their caches if the counter grows.
+// Call the returned function to unsubscribe, the channel will be closed then.
+func (db *LazyDB) SubscribeExpiry() (<-chan []byte, func()) {
+	return db.expirySubs.subscribe(expirySubBufferSize)
+}
+
+func (db *LazyDB) notifyExpired(key []byte) {
+	dropped := db.expirySubs.publish(func() []byte {
+		k := make([]byte, len(key))
+		copy(k, key)
+		return k
+	})
+	if dropped > 0 {
+		atomic.AddUint64(&db.stats.DroppedExpiryNotifications, uint64(dropped))
+	}
+	for i := 0; i < dropped; i++ {
+		log.Printf("expiry subscriber is full, drop key: %s", key)
+	}
+}
+
+// isExpired returns whether the value has expired at ts(unix milliseconds).
+func (v *Value) isExpired(ts int64) bool {
+	return v != nil && v.expiredAt != 0 && v.expiredAt <= ts
+}
+
+// defaultExpiredAt returns expiredAt(unix milliseconds) of a key written at now without an explicit time to live,
+// 0 if DBConfig.DefaultTTL is not set.
+func (db *LazyDB) defaultExpiredAt(now time.Time) int64 {
+	if db.cfg.DefaultTTL <= 0 {
+		return 0
+	}
+	return now.Add(db.cfg.DefaultTTL).UnixMilli()
+}
+
+// expireStr removes the key of type String if it has expired.
+// Lock of strIndex must be held by the caller.
+func (db *LazyDB) expireStr(key []byte, ts int64) error {
+	rawValue := db.strIndex.idxTree.Get(key)
+	if rawValue == nil {
+		return nil
+	}
+	idxNode, _ := rawValue.(*Value)
+	if !idxNode.isExpired(ts) {
+		return nil
+	}
+
+	entry := &logfile.LogEntry{Key: key, Stat: logfile.SDelete}
+	pos, err := db.writeLogEntry(valueTypeString, entry)
+	if err != nil {
+		return err
+	}
+	delVal, updated := db.strIndex.idxTree.Delete(key)
+	db.replaceStrValue(key, delVal, nil)
+
+	// delete invalid entry
+	db.sendDiscard(delVal, updated, valueTypeString)
+	// also merge the delete entry
+	size := db.entrySize(entry)
+	node := &Value{fid: pos.fid, entrySize: size}
+	select {
+	case db.discardsMap[valueTypeString].valChan <- node:
+	default:
+		log.Fatal("send discard fail")
+	}
+
+	db.notifyExpired(key)
+	return nil
+}
+
+// lazyExpireStr removes the key of type String if it has expired when it is read.
+func (db *LazyDB) lazyExpireStr(key []byte) {
+	if db.readOnly() {
+		return
+	}
+	ts := db.now().UnixMilli()
+	db.strIndex.mu.RLock()
+	rawValue := db.strIndex.idxTree.Get(key)
+	db.strIndex.mu.RUnlock()
+	if rawValue == nil {
+		return
+	}
+	if idxNode, _ := rawValue.(*Value); !idxNode.isExpired(ts) {
+		return
+	}
+
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+	if err := db.expireStr(key, ts); err != nil {
+		log.Printf("lazy expire key err: %v", err)
+	}
+}
+
+// activeExpire removes all expired keys of type String.
+func (db *LazyDB) activeExpire() error {
+	ts := db.now().UnixMilli()
+
+	// keys are walked in order of expiredAt, until the first one not expired
+	var expiredKeys [][]byte
+	db.strIndex.mu.RLock()
+	db.ascendTTL(func(key []byte, expiredAt int64) bool {
+		if expiredAt > ts {
+			return false
+		}
+		expiredKeys = append(expiredKeys, key)
+		return true
+	})
+	db.strIndex.mu.RUnlock()
+
+	if len(expiredKeys) == 0 {
+		return nil
+	}
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+	for _, key := range expiredKeys {
+		if err := db.expireStr(key, ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runActiveExpire runs active expire cycle periodically until db is closed.
+func (db *LazyDB) runActiveExpire(interval time.Duration, closeCh <-chan struct{}) {
+	defer db.bgWg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closeCh:
+			return
+		case <-ticker.C:
+			if atomic.LoadInt32(&db.activeExpireOff) == 1 {
+				continue
+			}
+			if err := db.activeExpire(); err != nil {
+				log.Printf("active expire err: %v", err)
+			}
+		}
+	}
+}
+
+// SetActiveExpire turns the active expire cycle on or off at runtime, e.g. to pause it during heavy writes or benchmarks.
+// It takes effect on the next tick, and expired keys are still removed lazily when they are read while it is off.
+// The cycle runs every DBConfig.ActiveExpireInterval, or defaultActiveExpireInterval if it is not set.
+func (db *LazyDB) SetActiveExpire(enabled bool) {
+	if !enabled {
+		atomic.StoreInt32(&db.activeExpireOff, 1)
+		return
+	}
+	atomic.StoreInt32(&db.activeExpireOff, 0)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.activeExpireOn || db.closeCh == nil || db.readOnly() {
+		return
+	}
+	interval := db.cfg.ActiveExpireInterval
+	if interval <= 0 {
+		interval = defaultActiveExpireInterval
+	}
+	db.activeExpireOn = true
+	db.bgWg.Add(1)
+	go db.runActiveExpire(interval, db.closeCh)
+}
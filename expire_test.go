@@ -0,0 +1,195 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_SubscribeExpiry(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_subscribe_expiry")
+	cfg := DefaultDBConfig(path)
+	cfg.ActiveExpireInterval = 10 * time.Millisecond
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	ch, cancel := db.SubscribeExpiry()
+	defer cancel()
+
+	assert.Nil(t, db.PSetEX([]byte("k1"), []byte("v1"), 50))
+	assert.Nil(t, db.Set([]byte("k2"), []byte("v2")))
+
+	select {
+	case key := <-ch:
+		assert.Equal(t, []byte("k1"), key)
+	case <-time.After(2 * time.Second):
+		t.Fatal("expired key is not notified")
+	}
+
+	// expired key has been removed, reading it won`t notify again
+	_, err = db.Get([]byte("k1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	select {
+	case key := <-ch:
+		t.Fatalf("unexpected notification: %s", key)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	got, err := db.Get([]byte("k2"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), got)
+}
+
+func TestLazyDB_SubscribeExpiry_LazyExpire(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+
+	ch, cancel := db.SubscribeExpiry()
+	assert.Nil(t, db.PSetEX([]byte("k1"), []byte("v1"), 100))
+
+	now = now.Add(time.Second)
+	for i := 0; i < 3; i++ {
+		_, err := db.Get([]byte("k1"))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	cancel()
+
+	var keys [][]byte
+	for key := range ch {
+		keys = append(keys, key)
+	}
+	assert.Equal(t, [][]byte{[]byte("k1")}, keys)
+}
+
+func TestLazyDB_SubscribeExpiry_BufferFull(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+
+	idle, cancelIdle := db.SubscribeExpiry()
+	defer cancelIdle()
+	ch, cancel := db.SubscribeExpiry()
+	defer cancel()
+
+	n := expirySubBufferSize + 3
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.PSetEX(GetKey(i), GetValue32(), 100))
+	}
+	now = now.Add(time.Second)
+	for i := 0; i < n; i++ {
+		_, err := db.Get(GetKey(i))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Equal(t, GetKey(i), <-ch)
+	}
+
+	// keys beyond the buffer of the idle subscriber are dropped and counted, other subscribers still get them
+	assert.Equal(t, expirySubBufferSize, len(idle))
+	assert.Equal(t, uint64(3), db.Stats().DroppedExpiryNotifications)
+}
+
+func TestLazyDB_DefaultTTL(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+	db.cfg.DefaultTTL = time.Minute
+
+	assert.Nil(t, db.Set([]byte("k1"), []byte("v1")))
+	assert.Nil(t, db.MSet([]byte("k2"), []byte("v2")))
+	assert.Nil(t, db.SetWithOptions([]byte("k3"), []byte("v3"), WriteOptions{TTL: time.Hour}))
+	assert.Nil(t, db.SetWithOptions([]byte("k4"), []byte("v4"), WriteOptions{Persist: true}))
+	_, err := db.Incr([]byte("k5"))
+	assert.Nil(t, err)
+
+	ttl, err := db.PTTL([]byte("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute.Milliseconds(), ttl)
+	ttl, err = db.PTTL([]byte("k3"))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour.Milliseconds(), ttl)
+	ttl, err = db.PTTL([]byte("k4"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), ttl)
+
+	now = now.Add(2 * time.Minute)
+	for _, key := range []string{"k1", "k2", "k5"} {
+		_, err = db.Get([]byte(key))
+		assert.Equal(t, ErrKeyNotFound, err, key)
+	}
+	got, err := db.Get([]byte("k3"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v3"), got)
+	got, err = db.Get([]byte("k4"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v4"), got)
+
+	// Persist removes the default ttl as well
+	assert.Nil(t, db.Persist([]byte("k3")))
+	now = now.Add(2 * time.Hour)
+	got, err = db.Get([]byte("k3"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v3"), got)
+}
+
+func TestLazyDB_SetActiveExpire(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_set_active_expire")
+	cfg := DefaultDBConfig(path)
+	cfg.ActiveExpireInterval = 10 * time.Millisecond
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	inIndex := func(key []byte) bool {
+		db.strIndex.mu.RLock()
+		defer db.strIndex.mu.RUnlock()
+		return db.strIndex.idxTree.Get(key) != nil
+	}
+
+	db.SetActiveExpire(false)
+	assert.Nil(t, db.PSetEX([]byte("k1"), []byte("v1"), 20))
+	// the unread expired key is kept while active expire is off
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, inIndex([]byte("k1")))
+	activeOffset := db.getActiveLogFile(valueTypeString).lf.Offset
+
+	db.SetActiveExpire(true)
+	assert.Eventually(t, func() bool {
+		return !inIndex([]byte("k1"))
+	}, time.Second, 10*time.Millisecond)
+	// the tombstone is written
+	assert.Greater(t, db.getActiveLogFile(valueTypeString).lf.Offset, activeOffset)
+}
+
+func TestLazyDB_SetActiveExpire_NotConfigured(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	assert.Nil(t, db.PSetEX([]byte("k1"), []byte("v1"), 20))
+	time.Sleep(50 * time.Millisecond)
+	assert.NotNil(t, db.strIndex.idxTree.Get([]byte("k1")))
+
+	// starts the cycle with the default interval
+	db.SetActiveExpire(true)
+	db.SetActiveExpire(true)
+	assert.Eventually(t, func() bool {
+		db.strIndex.mu.RLock()
+		defer db.strIndex.mu.RUnlock()
+		return db.strIndex.idxTree.Get([]byte("k1")) == nil
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,275 @@
+package lazydb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/billsjc123/LazyDB/util"
+)
+
+// exportMagic is written at the beginning of the output of Export.
+const exportMagic = "LAZYDBX1"
+
+// ErrInvalidExport is returned by Import if the input is not written by Export or is broken.
+var ErrInvalidExport = errors.New("invalid export data")
+
+// ImportMode decides what Import does with a key which exists already.
+type ImportMode uint8
+
+const (
+	// ImportOverwrite replaces the existing key of any type by the imported one.
+	ImportOverwrite ImportMode = iota
+	// ImportKeepExisting keeps the existing key, and the imported one is skipped.
+	ImportKeepExisting
+)
+
+// ImportOptions options of Import.
+type ImportOptions struct {
+	Mode ImportMode
+}
+
+// ImportSummary reports what Import did with records of the input.
+type ImportSummary struct {
+	Imported int
+	Skipped  int   // keys kept by ImportKeepExisting
+	Errored  int   // records failed to be written
+	Err      error // error of the first errored record
+}
+
+// Export writes all keys and values of the types String, List, Hash, Set and ZSet into w in a compact binary format,
+// which can be loaded by Import into another db. Keys are written one at a time, so db is not loaded into memory,
+// but the export is not a consistent snapshot if db is modified meanwhile.
+// The remaining time to live of a key is exported, and it starts over from the time of importing.
+// Export is aborted by the first key denied by DBConfig.AccessControl.
+//
+// Format: magic | records..., a record is: type | key | ttl | number of elements | elements...,
+// ttl is in milliseconds and 0 if the key never expires, elements are the value of a String, elements of a List,
+// field value pairs of a Hash, members of a Set, and score member pairs of a ZSet.
+func (db *LazyDB) Export(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(exportMagic)
+	for typ := valueType(0); typ < logFileTypeNum; typ++ {
+		keys, err := db.sortedKeys(typ)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := db.exportKey(bw, typ, key); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// exportKey writes the record of key of the type, nothing is written if key does not exist anymore.
+func (db *LazyDB) exportKey(w *bufio.Writer, typ valueType, key []byte) error {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return err
+	}
+
+	var ttl int64
+	var elems [][]byte
+	var err error
+	switch typ {
+	case valueTypeString:
+		var val []byte
+		if val, ttl, err = db.getStrWithPTTL(key); err == ErrKeyNotFound {
+			return nil
+		}
+		elems = [][]byte{val}
+	case valueTypeList:
+		elems, err = db.LGetAll(key)
+	case valueTypeHash:
+		elems, err = db.HGetAll(key)
+	case valueTypeSet:
+		elems, err = db.SMembers(key)
+	case valueTypeZSet:
+		var members [][]byte
+		var scores []float64
+		members, scores, err = db.ZRangeWithScores(key, 0, -1)
+		for i, member := range members {
+			elems = append(elems, util.Float64ToByte(scores[i]), member)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(elems) == 0 {
+		return nil
+	}
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	putUvarint := func(v uint64) {
+		n := binary.PutUvarint(buf, v)
+		w.Write(buf[:n])
+	}
+	putBytes := func(b []byte) {
+		putUvarint(uint64(len(b)))
+		w.Write(b)
+	}
+	w.WriteByte(byte(typ))
+	putBytes(key)
+	putUvarint(uint64(ttl))
+	putUvarint(uint64(len(elems)))
+	for _, elem := range elems {
+		putBytes(elem)
+	}
+	return nil
+}
+
+// getStrWithPTTL returns the value of key of type String and its remaining time to live in milliseconds,
+// which is 0 if it never expires, and at least 1 otherwise.
+func (db *LazyDB) getStrWithPTTL(key []byte) ([]byte, int64, error) {
+	db.strIndex.mu.RLock()
+	defer db.strIndex.mu.RUnlock()
+	idxNode, _ := db.strIndex.idxTree.Get(key).(*Value)
+	val, err := db.getValue(db.strIndex.idxTree, key, valueTypeString)
+	if err != nil || idxNode == nil || idxNode.expiredAt == 0 {
+		return val, 0, err
+	}
+	ttl := idxNode.expiredAt - db.now().UnixMilli()
+	if ttl < 1 {
+		ttl = 1
+	}
+	return val, ttl, nil
+}
+
+// exportRecord is a record of the output of Export.
+type exportRecord struct {
+	typ   valueType
+	key   []byte
+	ttl   int64
+	elems [][]byte
+}
+
+// Import reads records written by Export from r one at a time and writes them into db, so the input is streamed
+// rather than loaded into memory. A key existing in any type is overwritten or kept by opts.Mode, a key repeated
+// in the input is handled in the same way. Time to live of keys is applied relative to the time of importing.
+// Writes are checked by DBConfig.AccessControl like other writes.
+//
+// A record which fails to be written is counted as errored, and Import moves on to the next one.
+// Note that the existing key has been removed then by ImportOverwrite.
+// ErrInvalidExport is returned along with the summary of records before if the input is broken,
+// records before are imported already.
+func (db *LazyDB) Import(r io.Reader, opts ImportOptions) (ImportSummary, error) {
+	var summary ImportSummary
+	if db.readOnly() {
+		return summary, ErrReadOnly
+	}
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(exportMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != exportMagic {
+		return summary, ErrInvalidExport
+	}
+
+	for {
+		rec, err := db.readExportRecord(br)
+		if err == io.EOF {
+			return summary, nil
+		}
+		if err != nil {
+			return summary, err
+		}
+		imported, err := db.importRecord(rec, opts)
+		switch {
+		case err != nil:
+			summary.Errored++
+			if summary.Err == nil {
+				summary.Err = err
+			}
+		case imported:
+			summary.Imported++
+		default:
+			summary.Skipped++
+		}
+	}
+}
+
+// readExportRecord reads the next record, it returns io.EOF if there is no more record.
+func (db *LazyDB) readExportRecord(r *bufio.Reader) (*exportRecord, error) {
+	typ, err := r.ReadByte()
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if valueType(typ) > valueTypeZSet {
+		return nil, ErrInvalidExport
+	}
+
+	broken := false
+	uvarint := func() uint64 {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			broken = true
+		}
+		return v
+	}
+	bytesOf := func() []byte {
+		// no entry is larger than a log file
+		size := uvarint()
+		if broken || size > uint64(db.cfg.MaxLogFileSize) {
+			broken = true
+			return nil
+		}
+		b := make([]byte, size)
+		if _, err := io.ReadFull(r, b); err != nil {
+			broken = true
+		}
+		return b
+	}
+
+	rec := &exportRecord{typ: valueType(typ), key: bytesOf(), ttl: int64(uvarint())}
+	num := uvarint()
+	for i := uint64(0); i < num && !broken; i++ {
+		rec.elems = append(rec.elems, bytesOf())
+	}
+	if broken || rec.ttl < 0 {
+		return nil, ErrInvalidExport
+	}
+	return rec, nil
+}
+
+// importRecord writes the record into db, and returns false if the existing key is kept.
+func (db *LazyDB) importRecord(rec *exportRecord, opts ImportOptions) (bool, error) {
+	key, elems := rec.key, rec.elems
+	if opts.Mode == ImportKeepExisting {
+		if db.keyExists(key) {
+			return false, nil
+		}
+	} else if _, err := db.Unlink(key); err != nil {
+		return false, err
+	}
+
+	var err error
+	switch rec.typ {
+	case valueTypeString:
+		if len(elems) != 1 {
+			return false, ErrInvalidParam
+		}
+		writeOpts := WriteOptions{Persist: true}
+		if rec.ttl > 0 {
+			writeOpts = WriteOptions{TTL: time.Duration(rec.ttl) * time.Millisecond}
+		}
+		err = db.SetWithOptions(key, elems[0], writeOpts)
+	case valueTypeList:
+		err = db.RPush(key, elems...)
+	case valueTypeHash:
+		err = db.HSet(key, elems...)
+	case valueTypeSet:
+		err = db.SAdd(key, elems...)
+	case valueTypeZSet:
+		for i := 0; i < len(elems); i += 2 {
+			if len(elems[i]) != 8 {
+				return false, ErrInvalidParam
+			}
+		}
+		err = db.ZAdd(key, elems...)
+	}
+	return err == nil, err
+}
@@ -0,0 +1,115 @@
+package lazydb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/billsjc123/LazyDB/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func openExportTestDB(t *testing.T, name string) *LazyDB {
+	wd, _ := os.Getwd()
+	db, err := Open(DefaultDBConfig(filepath.Join(wd, name)))
+	assert.Nil(t, err)
+	return db
+}
+
+func TestLazyDB_ExportImport(t *testing.T) {
+	src := openExportTestDB(t, "test_export_src")
+	defer destroyDB(src)
+	now := time.Now()
+	src.clock = func() time.Time { return now }
+
+	assert.Nil(t, src.Set([]byte("s1"), []byte("v1")))
+	assert.Nil(t, src.SetEX([]byte("s2"), []byte("v2"), time.Minute))
+	assert.Nil(t, src.RPush([]byte("l1"), []byte("a"), []byte("b")))
+	assert.Nil(t, src.HSet([]byte("h1"), []byte("f1"), []byte("v1"), []byte("f2"), []byte("v2")))
+	assert.Nil(t, src.SAdd([]byte("set1"), []byte("m1"), []byte("m2")))
+	assert.Nil(t, src.ZAdd([]byte("z1"), util.Float64ToByte(1.5), []byte("m1"), util.Float64ToByte(2), []byte("m2")))
+	// half of the time to live is left when exported
+	now = now.Add(30 * time.Second)
+	var data bytes.Buffer
+	assert.Nil(t, src.Export(&data))
+
+	var srcDump bytes.Buffer
+	assert.Nil(t, src.DumpAll(&srcDump))
+
+	t.Run("empty", func(t *testing.T) {
+		dst := openExportTestDB(t, "test_export_empty")
+		defer destroyDB(dst)
+		later := now.Add(time.Hour)
+		dst.clock = func() time.Time { return later }
+
+		summary, err := dst.Import(bytes.NewReader(data.Bytes()), ImportOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, ImportSummary{Imported: 6}, summary)
+		var dump bytes.Buffer
+		assert.Nil(t, dst.DumpAll(&dump))
+		assert.Equal(t, srcDump.String(), dump.String())
+
+		// time to live starts over from importing
+		ttl, err := dst.PTTL([]byte("s2"))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(30*time.Second/time.Millisecond), ttl)
+		ttl, err = dst.PTTL([]byte("s1"))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(0), ttl)
+	})
+
+	overlapping := func(t *testing.T, name string) *LazyDB {
+		dst := openExportTestDB(t, name)
+		assert.Nil(t, dst.Set([]byte("s1"), []byte("old")))
+		// same key of another type
+		assert.Nil(t, dst.Set([]byte("h1"), []byte("old")))
+		assert.Nil(t, dst.HSet([]byte("h2"), []byte("f"), []byte("old")))
+		return dst
+	}
+
+	t.Run("overwrite", func(t *testing.T) {
+		dst := overlapping(t, "test_export_overwrite")
+		defer destroyDB(dst)
+
+		summary, err := dst.Import(bytes.NewReader(data.Bytes()), ImportOptions{Mode: ImportOverwrite})
+		assert.Nil(t, err)
+		assert.Equal(t, ImportSummary{Imported: 6}, summary)
+		val, err := dst.Get([]byte("s1"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v1"), val)
+		_, err = dst.Get([]byte("h1"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Equal(t, 2, hLen(t, dst, []byte("h1")))
+		assert.Equal(t, 1, hLen(t, dst, []byte("h2")))
+	})
+
+	t.Run("keep existing", func(t *testing.T) {
+		dst := overlapping(t, "test_export_keep")
+		defer destroyDB(dst)
+
+		summary, err := dst.Import(bytes.NewReader(data.Bytes()), ImportOptions{Mode: ImportKeepExisting})
+		assert.Nil(t, err)
+		assert.Equal(t, ImportSummary{Imported: 4, Skipped: 2}, summary)
+		val, err := dst.Get([]byte("s1"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("old"), val)
+		val, err = dst.Get([]byte("h1"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("old"), val)
+		assert.Equal(t, 0, hLen(t, dst, []byte("h1")))
+		assert.Equal(t, 2, lLen(t, dst, []byte("l1")))
+	})
+
+	t.Run("broken", func(t *testing.T) {
+		dst := openExportTestDB(t, "test_export_broken")
+		defer destroyDB(dst)
+
+		_, err := dst.Import(bytes.NewReader([]byte("garbage")), ImportOptions{})
+		assert.Equal(t, ErrInvalidExport, err)
+		summary, err := dst.Import(bytes.NewReader(data.Bytes()[:data.Len()-1]), ImportOptions{})
+		assert.Equal(t, ErrInvalidExport, err)
+		assert.Equal(t, 5, summary.Imported)
+	})
+}
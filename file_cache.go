@@ -0,0 +1,127 @@
+package lazydb
+
+import (
+	"container/list"
+	"github.com/billsjc123/LazyDB/logfile"
+	"log"
+	"sync"
+	"time"
+)
+
+// logFileCache is a LRU cache of opened archived log files.
+// Least recently used files will be closed when the number of opened files exceeds capacity,
+// and they will be reopened lazily on access.
+type logFileCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[logFileCacheKey]*list.Element
+}
+
+type logFileCacheKey struct {
+	typ valueType
+	fid uint32
+}
+
+type logFileCacheItem struct {
+	key logFileCacheKey
+	lf  *logfile.LogFile
+}
+
+func newLogFileCache(capacity int) *logFileCache {
+	return &logFileCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[logFileCacheKey]*list.Element),
+	}
+}
+
+// access marks the log file as recently used and reopens it if necessary.
+// Least recently used log files beyond capacity will be closed.
+func (c *logFileCache) access(typ valueType, lf *logfile.LogFile) error {
+	key := logFileCacheKey{typ: typ, fid: lf.Fid}
+	var victims []*logfile.LogFile
+
+	c.mu.Lock()
+	if elem, ok := c.items[key]; ok {
+		c.ll.MoveToFront(elem)
+	} else {
+		c.items[key] = c.ll.PushFront(&logFileCacheItem{key: key, lf: lf})
+	}
+	for c.ll.Len() > c.capacity {
+		elem := c.ll.Back()
+		item := elem.Value.(*logFileCacheItem)
+		c.ll.Remove(elem)
+		delete(c.items, item.key)
+		victims = append(victims, item.lf)
+	}
+	c.mu.Unlock()
+
+	// never hold the cache lock while waiting for a log file
+	for _, victim := range victims {
+		victim.Mu.Lock()
+		if err := victim.Sync(); err != nil {
+			log.Printf("sync evicted log file err: %v", err)
+		}
+		if err := victim.Close(); err != nil {
+			log.Printf("close evicted log file err: %v", err)
+		}
+		victim.Mu.Unlock()
+	}
+
+	lf.Mu.Lock()
+	defer lf.Mu.Unlock()
+	return lf.Reopen()
+}
+
+// remove drops the log file from cache, it won`t be closed.
+func (c *logFileCache) remove(typ valueType, fid uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := logFileCacheKey{typ: typ, fid: fid}
+	if elem, ok := c.items[key]; ok {
+		c.ll.Remove(elem)
+		delete(c.items, key)
+	}
+}
+
+// pinLogFile opens the log file if it has been closed by the cache and RLocks it.
+// Remember to RUnlock the log file!
+func (db *LazyDB) pinLogFile(typ valueType, lf *logfile.LogFile) error {
+	return db.pinLogFileWithDeadline(typ, lf, time.Time{})
+}
+
+// pinLogFileWithDeadline is like pinLogFile, but gives up waiting for the lock of log file once deadline is exceeded.
+func (db *LazyDB) pinLogFileWithDeadline(typ valueType, lf *logfile.LogFile, deadline time.Time) error {
+	if db.fileCache == nil || db.isActiveLogFile(typ, lf) {
+		return rlockWithDeadline(&lf.Mu, deadline)
+	}
+	for {
+		if err := db.fileCache.access(typ, lf); err != nil {
+			return err
+		}
+		if err := rlockWithDeadline(&lf.Mu, deadline); err != nil {
+			return err
+		}
+		// the file may be evicted again before locking
+		if !lf.IsClosed() {
+			return nil
+		}
+		lf.Mu.RUnlock()
+	}
+}
+
+// cacheLogFile puts an opened archived log file into cache.
+func (db *LazyDB) cacheLogFile(typ valueType, lf *logfile.LogFile) {
+	if db.fileCache == nil {
+		return
+	}
+	if err := db.fileCache.access(typ, lf); err != nil {
+		log.Printf("cache log file err: %v", err)
+	}
+}
+
+func (db *LazyDB) isActiveLogFile(typ valueType, lf *logfile.LogFile) bool {
+	activeLogFile, ok := db.activeLogFileMap[typ]
+	return ok && activeLogFile.lf == lf
+}
@@ -0,0 +1,60 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_MaxOpenFiles(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_max_open_files")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 150 //  set max file so that it can only contain 2 entry in a file
+	cfg.MaxOpenFiles = 2
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	countOpened := func() int {
+		var opened int
+		for _, fid := range db.fidsMap[valueTypeString].fids {
+			mlf := db.getArchivedLogFile(valueTypeString, fid)
+			if mlf != nil && !mlf.lf.IsClosed() {
+				opened++
+			}
+		}
+		return opened
+	}
+
+	values := make([][]byte, 20)
+	for i := range values {
+		values[i] = GetValue32()
+		assert.Nil(t, db.Set(GetKey(i), values[i]))
+	}
+	assert.Greater(t, db.archivedLogFile[valueTypeString].Size(), cfg.MaxOpenFiles)
+	assert.LessOrEqual(t, countOpened(), cfg.MaxOpenFiles)
+
+	for i := range values {
+		got, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], got)
+		assert.LessOrEqual(t, countOpened(), cfg.MaxOpenFiles)
+	}
+
+	// reopen with existing log files
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, countOpened(), cfg.MaxOpenFiles)
+	for i := range values {
+		got, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], got)
+	}
+	assert.LessOrEqual(t, countOpened(), cfg.MaxOpenFiles)
+}
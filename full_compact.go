@@ -0,0 +1,109 @@
+package lazydb
+
+import (
+	"github.com/billsjc123/LazyDB/logfile"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// FullCompact rewrites live entries of all log files of the type into fresh log files, where they are densely
+// packed one after another, and then removes all the old log files. Unlike Merge, every log file is compacted
+// regardless of its discard ratio, so it is a heavy compaction to run in maintenance windows.
+// Writes of the type are blocked until the compaction finishes.
+//
+// It is crash-safe: the active log file is sealed first, so that fresh log files only hold rewritten entries,
+// and they are synced before any old log file is removed. Old log files are removed in order of fid,
+// so opening after a crash at any point builds the same index, as the fresh log files are replayed last.
+func (db *LazyDB) FullCompact(typ valueType) error {
+	if err := db.checkRewrite(); err != nil {
+		return err
+	}
+	mu := db.getIndexLock(typ)
+	mu.Lock()
+	defer mu.Unlock()
+
+	activeLogFile, oldFids, err := db.sealForCompaction(typ)
+	if err != nil || len(oldFids) == 0 {
+		return err
+	}
+
+	write := func(ent *logfile.LogEntry) (*ValuePos, error) {
+		return db.rewriteLogEntry(typ, ent)
+	}
+	for _, fid := range oldFids {
+		mlf := db.getArchivedLogFile(typ, fid)
+		if mlf == nil {
+			continue
+		}
+		if err := db.rewriteLiveEntries(typ, mlf.lf, write); err != nil {
+			return err
+		}
+	}
+
+	return db.removeCompacted(typ, activeLogFile, oldFids)
+}
+
+// sealForCompaction rotates the active log file of the type unless it is empty, so that fresh log files written by
+// a compaction only hold rewritten entries. It returns the new active log file, and fids of all log files before it
+// in order of fid. Index lock of the type must be held by the caller.
+func (db *LazyDB) sealForCompaction(typ valueType) (*MutexLogFile, []uint32, error) {
+	activeLogFile := db.getActiveLogFile(typ)
+	if activeLogFile == nil {
+		return nil, nil, ErrOpenLogFile
+	}
+	activeLogFile.mu.Lock()
+	if activeLogFile.lf.Offset > 0 {
+		if err := db.rotateActiveLogFile(typ, activeLogFile, time.Time{}); err != nil {
+			activeLogFile.mu.Unlock()
+			return nil, nil, err
+		}
+	}
+	activeFid := activeLogFile.lf.Fid
+	activeLogFile.mu.Unlock()
+
+	var oldFids []uint32
+	fids := db.fidsMap[typ]
+	fids.mu.RLock()
+	for _, fid := range fids.fids {
+		if fid != activeFid && db.getArchivedLogFile(typ, fid) != nil {
+			oldFids = append(oldFids, fid)
+		}
+	}
+	fids.mu.RUnlock()
+	sort.Slice(oldFids, func(i, j int) bool {
+		return oldFids[i] < oldFids[j]
+	})
+	return activeLogFile, oldFids, nil
+}
+
+// removeCompacted syncs the fresh log files written by a compaction, and then removes the old log files oldFids
+// in order of fid, they are counted as merged. Index lock of the type must be held by the caller.
+func (db *LazyDB) removeCompacted(typ valueType, activeLogFile *MutexLogFile, oldFids []uint32) error {
+	// fresh log files except the active one are synced by rotation
+	activeLogFile.mu.Lock()
+	err := activeLogFile.lf.Sync()
+	activeLogFile.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	removed := make(map[uint32]struct{}, len(oldFids))
+	for _, fid := range oldFids {
+		db.removeArchivedLogFile(typ, fid)
+		removed[fid] = struct{}{}
+	}
+	fids := db.fidsMap[typ]
+	fids.mu.Lock()
+	remaining := fids.fids[:0]
+	for _, fid := range fids.fids {
+		if _, ok := removed[fid]; !ok {
+			remaining = append(remaining, fid)
+		}
+	}
+	fids.fids = remaining
+	fids.mu.Unlock()
+
+	atomic.AddUint64(&db.stats.Merges, uint64(len(oldFids)))
+	return nil
+}
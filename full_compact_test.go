@@ -0,0 +1,95 @@
+package lazydb
+
+import (
+	"github.com/billsjc123/LazyDB/logfile"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_FullCompact(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_full_compact")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 500
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	// overwritten keys leave many sparse log files
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 20; i++ {
+			assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+		}
+	}
+	for i := 15; i < 20; i++ {
+		assert.Nil(t, db.Delete(GetKey(i)))
+	}
+	assert.Nil(t, db.PSetEX(GetKey(20), GetValue32(), 1))
+	time.Sleep(5 * time.Millisecond)
+
+	live := make(map[string][]byte)
+	for i := 0; i < 15; i++ {
+		val, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		live[string(GetKey(i))] = val
+	}
+	check := func() {
+		for key, want := range live {
+			val, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, want, val)
+		}
+		for i := 15; i <= 20; i++ {
+			_, err := db.Get(GetKey(i))
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+	}
+	logFiles := func() (int, int64) {
+		entries, err := os.ReadDir(path)
+		assert.Nil(t, err)
+		prefix, _ := logfile.FileNamePrefix(logfile.Strs)
+		var n int
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), prefix) {
+				n++
+			}
+		}
+		var size int64
+		for _, fid := range db.fidsMap[valueTypeString].fids {
+			if lf := db.getLogFile(valueTypeString, fid); lf != nil {
+				size += lf.Offset
+			}
+		}
+		return n, size
+	}
+
+	filesBefore, sizeBefore := logFiles()
+	assert.Greater(t, filesBefore, 10)
+	assert.Nil(t, db.FullCompact(valueTypeString))
+	filesAfter, sizeAfter := logFiles()
+	assert.LessOrEqual(t, filesAfter, 3)
+	assert.Less(t, sizeAfter*5, sizeBefore)
+	assert.Equal(t, filesAfter, len(db.fidsMap[valueTypeString].fids))
+	check()
+
+	// writes go on after compaction
+	assert.Nil(t, db.Set(GetKey(0), []byte("v0")))
+	live[string(GetKey(0))] = []byte("v0")
+	check()
+
+	// compacted files are recovered after reopen
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	check()
+
+	// nothing to compact
+	assert.Nil(t, db.FullCompact(valueTypeHash))
+}
@@ -0,0 +1,248 @@
+package lazydb
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/billsjc123/LazyDB/util"
+)
+
+// Limits of coordinates encoded by geohash, the same as Redis, latitudes beyond are not covered by Web Mercator.
+const (
+	geoLonMin = -180.0
+	geoLonMax = 180.0
+	geoLatMin = -85.05112878
+	geoLatMax = 85.05112878
+
+	// geoStep is the number of bits of each coordinate in a geohash, so geohashes are 52 bits
+	// and stored exactly as scores of sorted sets.
+	geoStep = 26
+
+	// geoEarthRadius is the earth radius in meters used by Redis for distances.
+	geoEarthRadius = 6372797.560856
+)
+
+// ErrInvalidCoordinates is returned by geo commands if the longitude or latitude is out of range.
+var ErrInvalidCoordinates = errors.New("invalid longitude or latitude")
+
+// GeoAdd adds member at the position lon, lat into the sorted set stored at key, the score of member is
+// the 52-bit geohash of the position as Redis does, so the sorted set can be used by other zset commands as well.
+// Longitudes are in [-180, 180], and latitudes are in [-85.05112878, 85.05112878].
+func (db *LazyDB) GeoAdd(key []byte, lon, lat float64, member []byte) error {
+	if !validCoordinates(lon, lat) {
+		return ErrInvalidCoordinates
+	}
+	return db.ZAdd(key, util.Float64ToByte(float64(geohashEncode(lon, lat, geoStep))), member)
+}
+
+// GeoPos returns positions of members of the sorted set stored at key as longitude, latitude pairs.
+// A position is the center of the geohash cell of member, which is within 1 meter of the position added.
+// Both coordinates are NaN for members not existing.
+func (db *LazyDB) GeoPos(key []byte, members ...[]byte) ([][2]float64, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
+	db.zSetIndex.mu.RLock()
+	defer db.zSetIndex.mu.RUnlock()
+
+	positions := make([][2]float64, len(members))
+	for i, member := range members {
+		score, err := db.zScore(key, member)
+		if errors.Is(err, ErrZSetKeyNotExist) || errors.Is(err, ErrZSetMemberNotExist) {
+			positions[i] = [2]float64{math.NaN(), math.NaN()}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		lon, lat := geohashDecode(uint64(score), geoStep)
+		positions[i] = [2]float64{lon, lat}
+	}
+	return positions, nil
+}
+
+// GeoSearch returns members of the sorted set stored at key within radius meters of the position lon, lat,
+// nearest first. Only geohash cells around the position are scanned, like GEOSEARCH of Redis.
+func (db *LazyDB) GeoSearch(key []byte, lon, lat, radius float64) ([][]byte, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
+	if !validCoordinates(lon, lat) {
+		return nil, ErrInvalidCoordinates
+	}
+	if radius < 0 || math.IsNaN(radius) {
+		return nil, ErrInvalidParam
+	}
+	db.zSetIndex.mu.RLock()
+	defer db.zSetIndex.mu.RUnlock()
+
+	idx := db.zSetIndex.indexes[util.ByteToString(key)]
+	if idx == nil || idx.skl == nil {
+		return nil, nil
+	}
+	type found struct {
+		member string
+		dist   float64
+	}
+	var results []found
+	for _, r := range geoSearchRanges(lon, lat, radius) {
+		zScoreRange(idx, r[0], r[1], func(node *Node) {
+			mLon, mLat := geohashDecode(uint64(node.score), geoStep)
+			if dist := geoDistance(lon, lat, mLon, mLat); dist <= radius {
+				results = append(results, found{member: node.member, dist: dist})
+			}
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].dist != results[j].dist {
+			return results[i].dist < results[j].dist
+		}
+		return results[i].member < results[j].member
+	})
+	members := make([][]byte, len(results))
+	for i, res := range results {
+		members[i] = []byte(res.member)
+	}
+	return members, nil
+}
+
+// zScoreRange calls fn with nodes of the sorted set whose scores are in [min, max) in order.
+// Lock of zSetIndex must be held by the caller.
+func zScoreRange(idx *ZSetIndex, min, max float64, fn func(node *Node)) {
+	// ranks are 1-based, find the first node whose score is not less than min
+	first := sort.Search(idx.skl.Len(), func(i int) bool {
+		return idx.skl.GetElementByRank(i+1).Value.(*Node).score >= min
+	}) + 1
+	if first > idx.skl.Len() {
+		return
+	}
+	for e := idx.skl.GetElementByRank(first); e != nil; e = e.Next() {
+		node := e.Value.(*Node)
+		if node.score >= max {
+			return
+		}
+		fn(node)
+	}
+}
+
+func validCoordinates(lon, lat float64) bool {
+	return lon >= geoLonMin && lon <= geoLonMax && lat >= geoLatMin && lat <= geoLatMax
+}
+
+// geoSearchRanges returns score ranges [min, max) of the geohash cells covering the circle of radius meters
+// around lon, lat. The cells are the one of the center and its neighbours, at the finest step whose cells are
+// not smaller than the radius, so that the circle never reaches beyond them.
+func geoSearchRanges(lon, lat, radius float64) [][2]float64 {
+	step := geoStep
+	for ; step > 0; step-- {
+		cells := float64(uint64(1) << step)
+		latHeight := (geoLatMax - geoLatMin) / cells * geoMetersPerDegree
+		// cells are narrowest at the latitude of the circle farthest from the equator
+		farLat := math.Min(math.Abs(lat)+radius/geoMetersPerDegree, 90)
+		lonWidth := (geoLonMax - geoLonMin) / cells * geoMetersPerDegree * math.Cos(farLat*math.Pi/180)
+		if latHeight >= radius && lonWidth >= radius {
+			break
+		}
+	}
+	shift := uint(2 * (geoStep - step))
+	if step == 0 {
+		return [][2]float64{{0, float64(uint64(1) << shift)}}
+	}
+
+	cells := int64(1) << step
+	lonCell, latCell := geoCell(lon, lat, step)
+	seen := make(map[uint64]struct{}, 9)
+	var ranges [][2]float64
+	for dLat := int64(-1); dLat <= 1; dLat++ {
+		y := latCell + dLat
+		if y < 0 || y >= cells {
+			continue
+		}
+		for dLon := int64(-1); dLon <= 1; dLon++ {
+			// longitudes wrap around the antimeridian
+			x := (lonCell + dLon + cells) % cells
+			hash := interleave(uint32(y), uint32(x))
+			if _, ok := seen[hash]; ok {
+				continue
+			}
+			seen[hash] = struct{}{}
+			ranges = append(ranges, [2]float64{float64(hash << shift), float64((hash + 1) << shift)})
+		}
+	}
+	return ranges
+}
+
+// geoMetersPerDegree is the length of a degree of latitude in meters.
+const geoMetersPerDegree = geoEarthRadius * math.Pi / 180
+
+// geoCell returns the cell of the position along longitude and latitude with step bits each.
+func geoCell(lon, lat float64, step int) (int64, int64) {
+	cells := float64(uint64(1) << step)
+	lonCell := int64((lon - geoLonMin) / (geoLonMax - geoLonMin) * cells)
+	latCell := int64((lat - geoLatMin) / (geoLatMax - geoLatMin) * cells)
+	// the maximum of a coordinate is in the last cell
+	if lonCell >= int64(cells) {
+		lonCell = int64(cells) - 1
+	}
+	if latCell >= int64(cells) {
+		latCell = int64(cells) - 1
+	}
+	return lonCell, latCell
+}
+
+// geohashEncode returns the geohash of the position with step bits of each coordinate,
+// bits of latitude are at even positions and bits of longitude are at odd positions like Redis.
+func geohashEncode(lon, lat float64, step int) uint64 {
+	lonCell, latCell := geoCell(lon, lat, step)
+	return interleave(uint32(latCell), uint32(lonCell))
+}
+
+// geohashDecode returns the center of the cell of hash.
+func geohashDecode(hash uint64, step int) (float64, float64) {
+	latCell, lonCell := deinterleave(hash)
+	cells := float64(uint64(1) << step)
+	lon := geoLonMin + (float64(lonCell)+0.5)/cells*(geoLonMax-geoLonMin)
+	lat := geoLatMin + (float64(latCell)+0.5)/cells*(geoLatMax-geoLatMin)
+	return lon, lat
+}
+
+// geoDistance returns the distance in meters between two positions by the haversine formula.
+func geoDistance(lon1, lat1, lon2, lat2 float64) float64 {
+	lat1r, lat2r := lat1*math.Pi/180, lat2*math.Pi/180
+	u := math.Sin((lat2r - lat1r) / 2)
+	v := math.Sin((lon2 - lon1) * math.Pi / 180 / 2)
+	return 2 * geoEarthRadius * math.Asin(math.Sqrt(u*u+math.Cos(lat1r)*math.Cos(lat2r)*v*v))
+}
+
+// interleave returns the bits of x at even positions and the bits of y at odd positions.
+func interleave(x, y uint32) uint64 {
+	return spread(x) | spread(y)<<1
+}
+
+// deinterleave is the reverse of interleave.
+func deinterleave(hash uint64) (uint32, uint32) {
+	return squash(hash), squash(hash >> 1)
+}
+
+// spread moves bit i of v to bit 2i.
+func spread(v uint32) uint64 {
+	x := uint64(v)
+	x = (x | x<<16) & 0x0000FFFF0000FFFF
+	x = (x | x<<8) & 0x00FF00FF00FF00FF
+	x = (x | x<<4) & 0x0F0F0F0F0F0F0F0F
+	x = (x | x<<2) & 0x3333333333333333
+	x = (x | x<<1) & 0x5555555555555555
+	return x
+}
+
+// squash moves bit 2i of x to bit i, it is the reverse of spread.
+func squash(x uint64) uint32 {
+	x &= 0x5555555555555555
+	x = (x | x>>1) & 0x3333333333333333
+	x = (x | x>>2) & 0x0F0F0F0F0F0F0F0F
+	x = (x | x>>4) & 0x00FF00FF00FF00FF
+	x = (x | x>>8) & 0x0000FFFF0000FFFF
+	x = (x | x>>16) & 0x00000000FFFFFFFF
+	return uint32(x)
+}
@@ -0,0 +1,97 @@
+package lazydb
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_GeoPos(t *testing.T) {
+	db := initTestZset()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("geo")
+	positions := [][2]float64{{13.361389, 38.115556}, {-179.999, -85.05}, {180, 85.05112878}, {0, 0}, {-73.9857, 40.7484}}
+	members := make([][]byte, len(positions))
+	for i, pos := range positions {
+		members[i] = []byte{byte('a' + i)}
+		assert.Nil(t, db.GeoAdd(key, pos[0], pos[1], members[i]))
+	}
+	got, err := db.GeoPos(key, append(members, []byte("missing"))...)
+	assert.Nil(t, err)
+	for i, pos := range positions {
+		assert.Less(t, geoDistance(pos[0], pos[1], got[i][0], got[i][1]), 1.0, "position %v", pos)
+	}
+	assert.True(t, math.IsNaN(got[len(positions)][0]))
+	assert.True(t, math.IsNaN(got[len(positions)][1]))
+
+	// the score is the geohash of Redis
+	score, err := db.ZScore(key, members[0])
+	assert.Nil(t, err)
+	assert.Equal(t, float64(3479099956230698), score)
+
+	assert.Equal(t, ErrInvalidCoordinates, db.GeoAdd(key, 181, 0, []byte("bad")))
+	assert.Equal(t, ErrInvalidCoordinates, db.GeoAdd(key, 0, 86, []byte("bad")))
+}
+
+func TestLazyDB_GeoSearch(t *testing.T) {
+	db := initTestZset()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("geo")
+	places := map[string][2]float64{
+		"Palermo":   {13.361389, 38.115556},
+		"Catania":   {15.087269, 37.502669},
+		"Rome":      {12.496366, 41.902782},
+		"east":      {179.95, 10},
+		"west":      {-179.95, 10},
+		"far east":  {178, 10},
+		"far north": {0, 85},
+	}
+	for name, pos := range places {
+		assert.Nil(t, db.GeoAdd(key, pos[0], pos[1], []byte(name)))
+	}
+
+	tests := []struct {
+		name     string
+		lon, lat float64
+		radius   float64
+		want     []string
+	}{
+		{"nearest first", 15, 37, 200000, []string{"Catania", "Palermo"}},
+		{"small radius", 15, 37, 100000, []string{"Catania"}},
+		{"zero radius", 15, 37, 0, []string{}},
+		{"across antimeridian", 180, 10, 50000, []string{"east", "west"}},
+		{"near the pole", 90, 85, 800000, []string{"far north"}},
+		{"whole earth", 0, 0, 30000000, []string{"Catania", "Palermo", "Rome", "far north", "far east", "east", "west"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			members, err := db.GeoSearch(key, tt.lon, tt.lat, tt.radius)
+			assert.Nil(t, err)
+			got := make([]string, len(members))
+			for i, member := range members {
+				got[i] = string(member)
+			}
+			assert.Equal(t, tt.want, got)
+			// every member within the radius is found
+			for name, pos := range places {
+				var found bool
+				for _, member := range got {
+					found = found || member == name
+				}
+				lon, lat := geohashDecode(geohashEncode(pos[0], pos[1], geoStep), geoStep)
+				assert.Equal(t, geoDistance(tt.lon, tt.lat, lon, lat) <= tt.radius, found, name)
+			}
+		})
+	}
+
+	members, err := db.GeoSearch([]byte("missing"), 0, 0, 1000)
+	assert.Nil(t, err)
+	assert.Empty(t, members)
+	_, err = db.GeoSearch(key, 0, 0, -1)
+	assert.Equal(t, ErrInvalidParam, err)
+}
@@ -2,10 +2,11 @@ package lazydb
 
 import (
 	"errors"
-	"github.com/billsjc123/LazyDB/ds"
 	"github.com/billsjc123/LazyDB/logfile"
 	"github.com/billsjc123/LazyDB/util"
 	"log"
+	"regexp"
+	"sort"
 )
 
 var (
@@ -15,26 +16,48 @@ var (
 // HSet is used to insert a field value pair for key. If key does not exist, a new key will be created.
 // If the field already exist, the value will be updated.
 // Multiple field-value pair could be inserted in the format of "key field1 value1 field2 value2"
+// Fields written into an expiring hash inherit its time to live, see CollectionWriteOptions.
 func (db *LazyDB) HSet(key []byte, args ...[]byte) error {
+	return db.HSetWithOptions(key, CollectionWriteOptions{}, args...)
+}
+
+// HSetWithOptions is like HSet, but the time to live of the whole hash can be overridden by opts.
+func (db *LazyDB) HSetWithOptions(key []byte, opts CollectionWriteOptions, args ...[]byte) error {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return err
+	}
 	if len(args)&1 == 1 {
 		return ErrInvalidParam
 	}
 	if len(args) == 0 {
 		return nil
 	}
+	fields := make([][]byte, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		fields = append(fields, args[i])
+	}
+	if err := db.checkSubKeySizes(key, fields...); err != nil {
+		return err
+	}
 	db.hashIndex.mu.Lock()
 	defer db.hashIndex.mu.Unlock()
 
-	strKey := util.ByteToString(key)
-	if db.hashIndex.trees[strKey] == nil {
-		db.hashIndex.trees[strKey] = ds.NewART()
+	db.removeExpiredCollection(valueTypeHash, key)
+	if err := db.checkHashLimit(key, args); err != nil {
+		return err
 	}
-
-	idxTree := db.hashIndex.trees[strKey]
+	expiredAt, err := db.prepareCollectionWrite(valueTypeHash, key, opts)
+	if err != nil {
+		return err
+	}
+	if packed, err := db.hSetPacked(key, args, expiredAt); packed || err != nil {
+		return err
+	}
+	idxTree := db.collectionTree(valueTypeHash, key)
 	for i := 0; i < len(args); i += 2 {
 		field, value := args[i], args[i+1]
-		hashKey := encodeKey(key, field)
-		entry := &logfile.LogEntry{Key: hashKey, Value: value}
+		hashKey := db.encodeKey(key, field)
+		entry := &logfile.LogEntry{Key: hashKey, Value: value, ExpiredAt: expiredAt}
 		valPos, err := db.writeLogEntry(valueTypeHash, entry)
 		if err != nil {
 			return err
@@ -48,17 +71,87 @@ func (db *LazyDB) HSet(key []byte, args ...[]byte) error {
 	return nil
 }
 
+// HSetMap is like HSet, but sets fields of the map, and returns the number of fields which are not in the hash before.
+// Fields are written in order with the active log file locked once, and synced by a single fsync,
+// unless the hash is packed by DBConfig.PackSmallHashes.
+func (db *LazyDB) HSetMap(key []byte, fields map[string][]byte) (int, error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return 0, err
+	}
+	if len(fields) == 0 {
+		return 0, nil
+	}
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+	args := make([][]byte, 0, 2*len(fields))
+	subKeys := make([][]byte, 0, len(fields))
+	for _, field := range names {
+		args = append(args, []byte(field), fields[field])
+		subKeys = append(subKeys, []byte(field))
+	}
+	if err := db.checkSubKeySizes(key, subKeys...); err != nil {
+		return 0, err
+	}
+	db.hashIndex.mu.Lock()
+	defer db.hashIndex.mu.Unlock()
+
+	db.removeExpiredCollection(valueTypeHash, key)
+	if err := db.checkHashLimit(key, args); err != nil {
+		return 0, err
+	}
+	expiredAt, err := db.prepareCollectionWrite(valueTypeHash, key, CollectionWriteOptions{})
+	if err != nil {
+		return 0, err
+	}
+	strKey := util.ByteToString(key)
+	var added int
+	ts := db.now().UnixMilli()
+	for _, field := range subKeys {
+		if idxTree := db.hashIndex.trees[strKey]; idxTree != nil {
+			if val, _ := idxTree.Get(db.encodeKey(key, field)).(*Value); val != nil && !val.isExpired(ts) {
+				continue
+			}
+		}
+		added++
+	}
+	if packed, err := db.hSetPacked(key, args, expiredAt); packed || err != nil {
+		return added, err
+	}
+	idxTree := db.collectionTree(valueTypeHash, key)
+	entries := make([]*logfile.LogEntry, 0, len(fields))
+	for i := 0; i < len(args); i += 2 {
+		entries = append(entries, &logfile.LogEntry{Key: db.encodeKey(key, args[i]), Value: args[i+1], ExpiredAt: expiredAt})
+	}
+	positions, err := db.writeLogEntries(valueTypeHash, entries)
+	// apply written entries even if writing fails halfway
+	for i, pos := range positions {
+		if updateErr := db.updateIndexTree(valueTypeHash, idxTree, entries[i], pos, true); updateErr != nil && err == nil {
+			err = updateErr
+		}
+	}
+	return added, err
+}
+
 // HGet returns value of given key and field. It will return empty if key is not found.
 func (db *LazyDB) HGet(key, field []byte) ([]byte, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
 	db.hashIndex.mu.RLock()
 	defer db.hashIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeHash, key); err != nil {
+		return nil, err
+	}
 
 	idxTree := db.hashIndex.trees[util.ByteToString(key)]
 	if idxTree == nil {
 		return nil, nil
 	}
 
-	hashKey := encodeKey(key, field)
+	hashKey := db.encodeKey(key, field)
 	val, err := db.getValue(idxTree, hashKey, valueTypeHash)
 	if err == ErrKeyNotFound {
 		return nil, nil
@@ -66,8 +159,22 @@ func (db *LazyDB) HGet(key, field []byte) ([]byte, error) {
 	return val, err
 }
 
+// HGetRange returns the substring of the value of the field of the hash stored at key, determined by the offsets
+// start and end like GetRange. An empty slice is returned if the key or the field does not exist.
+// The whole value is read, only the range is returned to the caller.
+func (db *LazyDB) HGetRange(key, field []byte, start, end int) ([]byte, error) {
+	val, err := db.HGet(key, field)
+	if err != nil {
+		return nil, err
+	}
+	return byteRange(val, start, end), nil
+}
+
 // HDel delete the field-value pair under the given key
 func (db *LazyDB) HDel(key []byte, fields ...[]byte) (int, error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return 0, err
+	}
 	db.hashIndex.mu.Lock()
 	defer db.hashIndex.mu.Unlock()
 
@@ -76,8 +183,16 @@ func (db *LazyDB) HDel(key []byte, fields ...[]byte) (int, error) {
 		return 0, nil
 	}
 	var count int
+	if values, packed, err := db.hDelPacked(key, fields); packed {
+		for _, val := range values {
+			if val != nil {
+				count++
+			}
+		}
+		return count, err
+	}
 	for _, field := range fields {
-		hashKey := encodeKey(key, field)
+		hashKey := db.encodeKey(key, field)
 		entry := &logfile.LogEntry{Key: hashKey, Stat: logfile.SDelete}
 		pos, err := db.writeLogEntry(valueTypeHash, entry)
 		if err != nil {
@@ -90,7 +205,7 @@ func (db *LazyDB) HDel(key []byte, fields ...[]byte) (int, error) {
 		// delete invalid entry
 		db.sendDiscard(val, updated, valueTypeHash)
 		// also merge the delete entry
-		_, size := logfile.EncodeEntry(entry)
+		size := db.entrySize(entry)
 		node := &Value{fid: pos.fid, entrySize: size}
 		select {
 		case db.discardsMap[valueTypeHash].valChan <- node:
@@ -98,21 +213,82 @@ func (db *LazyDB) HDel(key []byte, fields ...[]byte) (int, error) {
 			log.Fatal("send discard fail")
 		}
 	}
+	// remove the empty hash, so that it does not exist any more
+	if idxTree.Size() == 0 {
+		db.removeCollectionTree(valueTypeHash, key)
+	}
 	return count, nil
 }
 
+// HGetDel returns values of the fields in the hash stored at key and deletes them atomically,
+// the value is nil if the field does not exist.
+func (db *LazyDB) HGetDel(key []byte, fields ...[]byte) ([][]byte, error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrInvalidParam
+	}
+	db.hashIndex.mu.Lock()
+	defer db.hashIndex.mu.Unlock()
+
+	values := make([][]byte, len(fields))
+	idxTree := db.hashIndex.trees[util.ByteToString(key)]
+	if idxTree == nil {
+		return values, nil
+	}
+	if deleted, packed, err := db.hDelPacked(key, fields); packed {
+		if err != nil {
+			return nil, err
+		}
+		return deleted, nil
+	}
+	for i, field := range fields {
+		hashKey := db.encodeKey(key, field)
+		val, err := db.getValue(idxTree, hashKey, valueTypeHash)
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry := &logfile.LogEntry{Key: hashKey, Stat: logfile.SDelete}
+		pos, err := db.writeLogEntry(valueTypeHash, entry)
+		if err != nil {
+			return nil, err
+		}
+		oldVal, updated := idxTree.Delete(hashKey)
+		db.sendDiscard(oldVal, updated, valueTypeHash)
+		// also merge the delete entry
+		size := db.entrySize(entry)
+		db.sendDiscard(&Value{fid: pos.fid, entrySize: size}, true, valueTypeHash)
+		values[i] = val
+	}
+	// remove the empty hash, so that it does not exist any more
+	if idxTree.Size() == 0 {
+		db.removeCollectionTree(valueTypeHash, key)
+	}
+	return values, nil
+}
+
 // HExists returns whether the field exists in the hash stored at key
 // Returns false either key or field is not exist
 func (db *LazyDB) HExists(key []byte, field []byte) (bool, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return false, err
+	}
 	db.hashIndex.mu.RLock()
 	defer db.hashIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeHash, key); err != nil {
+		return false, err
+	}
 
 	idxTree := db.hashIndex.trees[util.ByteToString(key)]
 	if idxTree == nil {
 		return false, nil
 	}
 
-	hashkey := encodeKey(key, field)
+	hashkey := db.encodeKey(key, field)
 	_, err := db.getValue(idxTree, hashkey, valueTypeHash)
 	if err == ErrKeyNotFound {
 		return false, nil
@@ -125,8 +301,14 @@ func (db *LazyDB) HExists(key []byte, field []byte) (bool, error) {
 
 // HGetAll returns all field-value pair exist in the hash stored at key
 func (db *LazyDB) HGetAll(key []byte) ([][]byte, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
 	db.hashIndex.mu.RLock()
 	defer db.hashIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeHash, key); err != nil {
+		return nil, err
+	}
 
 	idxTree := db.hashIndex.trees[util.ByteToString(key)]
 	if idxTree == nil {
@@ -146,19 +328,80 @@ func (db *LazyDB) HGetAll(key []byte) ([][]byte, error) {
 		} else if err != nil {
 			return [][]byte{}, err
 		}
-		_, field := decodeKey(node.Key())
+		_, field := db.decodeKey(node.Key())
 		results = append(results, field)
 		results = append(results, value)
 	}
 	return results, nil
 }
 
+// HGetAllFunc calls fn with every field and value of the hash stored at key, without buffering all of them.
+// Iteration stops if fn returns false. Read lock of hash is held during iteration, so fn should be quick
+// and must not modify the db.
+func (db *LazyDB) HGetAllFunc(key []byte, fn func(field, value []byte) bool) error {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return err
+	}
+	db.hashIndex.mu.RLock()
+	defer db.hashIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeHash, key); err != nil {
+		return err
+	}
+
+	idxTree := db.hashIndex.trees[util.ByteToString(key)]
+	if idxTree == nil {
+		return nil
+	}
+	iter := idxTree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		value, err := db.getValue(idxTree, node.Key(), valueTypeHash)
+		if err == ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		_, field := db.decodeKey(node.Key())
+		if !fn(field, value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// HRandField returns count random fields of the hash stored at key like HRANDFIELD of Redis, fields are picked
+// the same way as SRandMember. Each field is followed by its value if withValues is true.
+func (db *LazyDB) HRandField(key []byte, count int, withValues bool) ([][]byte, error) {
+	pairs, err := db.HGetAll(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var results [][]byte
+	for _, i := range db.randPick(len(pairs)/2, count) {
+		results = append(results, pairs[2*i])
+		if withValues {
+			results = append(results, pairs[2*i+1])
+		}
+	}
+	return results, nil
+}
+
 // HKeys returns all fields exist in the hash stored at key
 func (db *LazyDB) HKeys(key []byte) ([][]byte, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
 	db.hashIndex.mu.RLock()
 	defer db.hashIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeHash, key); err != nil {
+		return nil, err
+	}
 
-	idxTree := db.hashIndex.trees[util.ByteToString(key)]
+	idxTree := db.liveCollection(valueTypeHash, key)
 	if idxTree == nil {
 		return [][]byte{}, nil
 	}
@@ -169,7 +412,7 @@ func (db *LazyDB) HKeys(key []byte) ([][]byte, error) {
 		if err != nil {
 			return nil, err
 		}
-		_, field := decodeKey(node.Key())
+		_, field := db.decodeKey(node.Key())
 		fields = append(fields, field)
 	}
 	return fields, nil
@@ -177,8 +420,14 @@ func (db *LazyDB) HKeys(key []byte) ([][]byte, error) {
 
 // HVals returns all values exist in the hash stored at key
 func (db *LazyDB) HVals(key []byte) ([][]byte, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
 	db.hashIndex.mu.RLock()
 	defer db.hashIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeHash, key); err != nil {
+		return nil, err
+	}
 
 	idxTree := db.hashIndex.trees[util.ByteToString(key)]
 	if idxTree == nil {
@@ -203,29 +452,115 @@ func (db *LazyDB) HVals(key []byte) ([][]byte, error) {
 	return values, nil
 }
 
+// HScan iterates over fields of the hash stored at key, and returns field-value pairs of at most count fields
+// like HGetAll, along with the cursor to continue with. Iteration starts with cursor 0, and finishes when the returned
+// cursor is 0. Fields are iterated in order of bytes, and only fields matching the regular expression match are
+// returned if it is not empty, so fewer than count fields may be returned before the iteration finishes.
+func (db *LazyDB) HScan(key []byte, cursor uint64, match string, count int) (uint64, [][]byte, error) {
+	return db.hScan(key, cursor, match, count, true)
+}
+
+// HScanNoValues is like HScan, but returns only fields. Values are not read from log files,
+// so it is much cheaper for wide hashes if only fields are needed.
+func (db *LazyDB) HScanNoValues(key []byte, cursor uint64, match string, count int) (uint64, [][]byte, error) {
+	return db.hScan(key, cursor, match, count, false)
+}
+
+func (db *LazyDB) hScan(key []byte, cursor uint64, match string, count int, withValues bool) (uint64, [][]byte, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return 0, nil, err
+	}
+	if count <= 0 {
+		return 0, nil, ErrInvalidParam
+	}
+	var reg *regexp.Regexp
+	if match != "" {
+		var err error
+		if reg, err = regexp.Compile(match); err != nil {
+			return 0, nil, err
+		}
+	}
+	db.hashIndex.mu.RLock()
+	defer db.hashIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeHash, key); err != nil {
+		return 0, nil, err
+	}
+
+	results := make([][]byte, 0)
+	idxTree := db.hashIndex.trees[util.ByteToString(key)]
+	if idxTree == nil {
+		return 0, results, nil
+	}
+	ts := db.now().UnixMilli()
+	iter := idxTree.Iterator()
+	// the cursor is the number of fields iterated before
+	for pos := uint64(0); pos < cursor && iter.HasNext(); pos++ {
+		if _, err := iter.Next(); err != nil {
+			return 0, nil, err
+		}
+	}
+	for n := 0; n < count && iter.HasNext(); n++ {
+		node, err := iter.Next()
+		if err != nil {
+			return 0, nil, err
+		}
+		cursor++
+		_, field := db.decodeKey(node.Key())
+		if reg != nil && !reg.Match(field) {
+			continue
+		}
+		if !withValues {
+			if val, _ := node.Value().(*Value); val == nil || val.isExpired(ts) {
+				continue
+			}
+			results = append(results, field)
+			continue
+		}
+		value, err := db.getValue(idxTree, node.Key(), valueTypeHash)
+		if err == ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return 0, nil, err
+		}
+		results = append(results, field, value)
+	}
+	if !iter.HasNext() {
+		cursor = 0
+	}
+	return cursor, results, nil
+}
+
 // HSetNX sets the given value if the key-field pair does not exist.
-// Creates a new hash if key is not exist.
+// Creates a new hash if key is not exist. It returns nil if the field already exists,
+// or ErrKeyExists if DBConfig.NXConflictError is set.
 func (db *LazyDB) HSetNX(key, field, value []byte) error {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return err
+	}
 	db.hashIndex.mu.Lock()
 	defer db.hashIndex.mu.Unlock()
 
-	strKey := util.ByteToString(key)
-	if db.hashIndex.trees[strKey] == nil {
-		db.hashIndex.trees[strKey] = ds.NewART()
-	}
-	idxTree := db.hashIndex.trees[strKey]
+	db.removeExpiredCollection(valueTypeHash, key)
+	idxTree := db.collectionTree(valueTypeHash, key)
+	expiredAt := collectionExpiredAt(valueTypeHash, idxTree, key)
 
-	hashKey := encodeKey(key, field)
+	hashKey := db.encodeKey(key, field)
 	_, err := db.getValue(idxTree, hashKey, valueTypeHash)
 	// field already exists
 	if err == nil {
-		return nil
+		return db.nxConflict()
 	}
 	if err != ErrKeyNotFound {
 		return err
 	}
+	if err = db.checkHashLimit(key, [][]byte{field, value}); err != nil {
+		return err
+	}
+	if packed, err := db.hSetPacked(key, [][]byte{field, value}, expiredAt); packed || err != nil {
+		return err
+	}
 
-	entry := &logfile.LogEntry{Key: hashKey, Value: value}
+	entry := &logfile.LogEntry{Key: hashKey, Value: value, ExpiredAt: expiredAt}
 	valPos, err := db.writeLogEntry(valueTypeHash, entry)
 	if err != nil {
 		return err
@@ -241,8 +576,14 @@ func (db *LazyDB) HSetNX(key, field, value []byte) error {
 // HMGet returns multiple values by given fields
 // It will skip those fields which don't exist.
 func (db *LazyDB) HMGet(key []byte, fields ...[]byte) ([][]byte, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
 	db.hashIndex.mu.RLock()
 	defer db.hashIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeHash, key); err != nil {
+		return nil, err
+	}
 
 	vals := make([][]byte, 0)
 	idxTree, ok := db.hashIndex.trees[util.ByteToString(key)]
@@ -251,7 +592,7 @@ func (db *LazyDB) HMGet(key []byte, fields ...[]byte) ([][]byte, error) {
 	}
 
 	for _, field := range fields {
-		hashKey := encodeKey(key, field)
+		hashKey := db.encodeKey(key, field)
 		val, err := db.getValue(idxTree, hashKey, valueTypeHash)
 		if err != nil && err != ErrKeyNotFound {
 			return nil, err
@@ -264,12 +605,31 @@ func (db *LazyDB) HMGet(key []byte, fields ...[]byte) ([][]byte, error) {
 	return vals, nil
 }
 
-func (db *LazyDB) HLen(key []byte) int {
+// HExistsKey returns whether the hash stored at key exists, only the index of Hash is looked up unlike Exists.
+func (db *LazyDB) HExistsKey(key []byte) bool {
+	return db.typedKeyExists(valueTypeHash, key)
+}
+
+// HLen returns the number of fields of the hash stored at key, 0 if key does not exist.
+func (db *LazyDB) HLen(key []byte) (int, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return 0, err
+	}
 	db.hashIndex.mu.RLock()
 	defer db.hashIndex.mu.RUnlock()
-	idxTree, ok := db.hashIndex.trees[util.ByteToString(key)]
-	if !ok {
-		return 0
+	if err := db.checkType(valueTypeHash, key); err != nil {
+		return 0, err
 	}
-	return idxTree.Size()
+	idxTree := db.liveCollection(valueTypeHash, key)
+	if idxTree == nil {
+		return 0, nil
+	}
+	return idxTree.Size(), nil
+}
+
+// HStrLen returns the length of the value of the field of the hash stored at key,
+// 0 if the key or the field does not exist.
+func (db *LazyDB) HStrLen(key, field []byte) (int, error) {
+	val, err := db.HGet(key, field)
+	return len(val), err
 }
@@ -0,0 +1,398 @@
+package lazydb
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/billsjc123/LazyDB/ds"
+	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/billsjc123/LazyDB/util"
+)
+
+// errInvalidPacked the value of a packed entry can't be decoded.
+var errInvalidPacked = errors.New("packed entry is invalid")
+
+// encodePacked encodes elements of a small collection into the value of a packed entry, they are fields and values
+// of a hash, members of a set, or members and scores of a sorted set.
+// Format: (element size | element)..., sizes are uvarints.
+func encodePacked(elems [][]byte) []byte {
+	size := 0
+	for _, b := range elems {
+		size += binary.MaxVarintLen32 + len(b)
+	}
+	buf := make([]byte, size)
+	var n int
+	for _, b := range elems {
+		n += binary.PutUvarint(buf[n:], uint64(len(b)))
+		n += copy(buf[n:], b)
+	}
+	return buf[:n]
+}
+
+// decodePacked decodes the value of a packed entry into elements, they refer to data.
+func decodePacked(data []byte) ([][]byte, error) {
+	var elems [][]byte
+	for len(data) > 0 {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < size {
+			return nil, errInvalidPacked
+		}
+		elems = append(elems, data[n:n+int(size)])
+		data = data[n+int(size):]
+	}
+	return elems, nil
+}
+
+// decodePackedHash decodes the value of a packed entry into fields and values, they refer to data.
+func decodePackedHash(data []byte) ([][]byte, error) {
+	pairs, err := decodePacked(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs)&1 == 1 {
+		return nil, errInvalidPacked
+	}
+	return pairs, nil
+}
+
+// packedHashValue returns the value of field in the value of a packed entry, or the score of a member
+// if the entry is of a sorted set.
+func packedHashValue(data, field []byte) ([]byte, bool) {
+	pairs, err := decodePackedHash(data)
+	if err != nil {
+		return nil, false
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		if string(pairs[i]) == string(field) {
+			return pairs[i+1], true
+		}
+	}
+	return nil, false
+}
+
+// packable returns whether a hash of pairs is packed into a single entry, see DBConfig.PackSmallHashes.
+func (db *LazyDB) packable(pairs [][]byte) bool {
+	if !db.cfg.PackSmallHashes || len(pairs)/2 > threshold(db.cfg.HashMaxListpackEntries, defaultHashMaxListpackEntries) {
+		return false
+	}
+	maxValue := threshold(db.cfg.HashMaxListpackValue, defaultHashMaxListpackValue)
+	for _, b := range pairs {
+		if len(b) > maxValue {
+			return false
+		}
+	}
+	return true
+}
+
+// isPacked returns whether all elements of the collection are in the same packed entry.
+func isPacked(idxTree *ds.AdaptiveRadixTree) bool {
+	if idxTree == nil || idxTree.Size() == 0 {
+		return false
+	}
+	var first *Value
+	iter := idxTree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil {
+			return false
+		}
+		val, _ := node.Value().(*Value)
+		if val == nil || !val.packed {
+			return false
+		}
+		if first == nil {
+			first = val
+		} else if val.fid != first.fid || val.offset != first.offset {
+			return false
+		}
+	}
+	return true
+}
+
+// packedEntry reads the packed entry which elements of the packed collection are in, nil if it is empty.
+func (db *LazyDB) packedEntry(typ valueType, idxTree *ds.AdaptiveRadixTree) (*logfile.LogEntry, error) {
+	var val *Value
+	iter := idxTree.Iterator()
+	for val == nil && iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		val, _ = node.Value().(*Value)
+	}
+	if val == nil {
+		return nil, nil
+	}
+	ent, _, err := db.readLogEntryInto(typ, val.fid, val.offset, nil, time.Time{})
+	return ent, err
+}
+
+// packedPairs returns fields and values of a packed hash, or members and scores of a packed sorted set,
+// by reading its packed entry once. Fields of the entry which have been deleted from the hash are left out.
+func (db *LazyDB) packedPairs(typ valueType, key []byte, idxTree *ds.AdaptiveRadixTree) ([][]byte, error) {
+	ent, err := db.packedEntry(typ, idxTree)
+	if ent == nil || err != nil {
+		return nil, err
+	}
+	pairs, err := decodePackedHash(ent.Value)
+	if err != nil {
+		return nil, err
+	}
+	live := make([][]byte, 0, len(pairs))
+	for i := 0; i < len(pairs); i += 2 {
+		if idxTree.Get(db.encodeKey(key, pairs[i])) != nil {
+			live = append(live, pairs[i], pairs[i+1])
+		}
+	}
+	return live, nil
+}
+
+// mergePairs sets fields and values of args into pairs, fields of args override the existing ones.
+func mergePairs(pairs, args [][]byte) [][]byte {
+	index := make(map[string]int, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		index[util.ByteToString(pairs[i])] = i
+	}
+	for i := 0; i < len(args); i += 2 {
+		if j, ok := index[util.ByteToString(args[i])]; ok {
+			pairs[j+1] = args[i+1]
+			continue
+		}
+		index[util.ByteToString(args[i])] = len(pairs)
+		pairs = append(pairs, args[i], args[i+1])
+	}
+	return pairs
+}
+
+// hSetPacked sets fields of args into the hash at key if it is packed, or it is created as a small one.
+// A packed hash which is no longer small is converted by rewriting all of its fields as normal entries.
+// It returns false if the hash is not packed, and args should be set as normal entries.
+// Entries are written with expiredAt of the hash, see CollectionWriteOptions.
+// Hash index lock must be held by the caller.
+func (db *LazyDB) hSetPacked(key []byte, args [][]byte, expiredAt int64) (bool, error) {
+	if !db.cfg.PackSmallHashes {
+		return false, nil
+	}
+	var pairs [][]byte
+	idxTree := db.hashIndex.trees[util.ByteToString(key)]
+	if idxTree != nil && idxTree.Size() > 0 {
+		if !isPacked(idxTree) {
+			return false, nil
+		}
+		var err error
+		if pairs, err = db.packedPairs(valueTypeHash, key, idxTree); err != nil {
+			return true, err
+		}
+	}
+	pairs = mergePairs(pairs, args)
+	if db.packable(pairs) {
+		return true, db.writePackedHash(key, pairs, expiredAt)
+	}
+	if idxTree == nil || idxTree.Size() == 0 {
+		return false, nil
+	}
+
+	// the packed entry is not live any more once all of its fields are rewritten
+	for i := 0; i < len(pairs); i += 2 {
+		entry := &logfile.LogEntry{Key: db.encodeKey(key, pairs[i]), Value: pairs[i+1], ExpiredAt: expiredAt}
+		valPos, err := db.writeLogEntry(valueTypeHash, entry)
+		if err != nil {
+			return true, err
+		}
+		if err = db.updateIndexTree(valueTypeHash, idxTree, entry, valPos, true); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// hDelPacked deletes fields from the hash at key if it is packed, and returns values of the deleted fields,
+// the value is nil if the field does not exist. It returns false if the hash is not packed.
+// Hash index lock must be held by the caller.
+func (db *LazyDB) hDelPacked(key []byte, fields [][]byte) ([][]byte, bool, error) {
+	idxTree := db.hashIndex.trees[util.ByteToString(key)]
+	if !db.cfg.PackSmallHashes || !isPacked(idxTree) {
+		return nil, false, nil
+	}
+	pairs, err := db.packedPairs(valueTypeHash, key, idxTree)
+	if err != nil {
+		return nil, true, err
+	}
+	values := make([][]byte, len(fields))
+	deleted := false
+	for i, field := range fields {
+		for j := 0; j < len(pairs); j += 2 {
+			if string(pairs[j]) == string(field) {
+				values[i] = pairs[j+1]
+				pairs = append(pairs[:j], pairs[j+2:]...)
+				deleted = true
+				break
+			}
+		}
+	}
+	if !deleted {
+		return values, true, nil
+	}
+	return values, true, db.writePackedHash(key, pairs, collectionExpiredAt(valueTypeHash, idxTree, key))
+}
+
+// writePackedHash writes all fields and values of the hash at key into a packed entry expiring at expiredAt,
+// and replaces fields of the hash by the ones of the entry.
+// Hash index lock must be held by the caller.
+func (db *LazyDB) writePackedHash(key []byte, pairs [][]byte, expiredAt int64) error {
+	entry := &logfile.LogEntry{Key: key, Value: encodePacked(pairs), Stat: logfile.SPacked, ExpiredAt: expiredAt}
+	valPos, err := db.writeLogEntry(valueTypeHash, entry)
+	if err != nil {
+		return err
+	}
+	return db.putPackedHash(entry, valPos, true)
+}
+
+// putPackedHash updates the index with the packed entry written at vPos. Fields of the hash from packed entries
+// are replaced by the ones of the entry, and fields written by normal entries are kept, so that entries of a hash
+// are applied in order of log files whether it is packed or not. The entry size is shared by its fields.
+// Hash index lock must be held by the caller.
+func (db *LazyDB) putPackedHash(entry *logfile.LogEntry, vPos *ValuePos, sendDiscard bool) error {
+	pairs, err := decodePackedHash(entry.Value)
+	if err != nil {
+		return err
+	}
+	key := entry.Key
+	idxTree := db.collectionTree(valueTypeHash, key)
+	if err = db.deletePackedValues(valueTypeHash, idxTree, sendDiscard); err != nil {
+		return err
+	}
+	db.putPackedValues(valueTypeHash, idxTree, db.packedHashKeys(key, pairs), vPos, entry)
+
+	if len(pairs) == 0 {
+		// also merge the empty packed entry
+		if sendDiscard {
+			if err = db.sendDiscard(&Value{fid: vPos.fid, entrySize: vPos.entrySize}, true, valueTypeHash); err != nil {
+				return err
+			}
+		}
+		// remove the empty hash, so that it does not exist any more
+		if idxTree.Size() == 0 {
+			db.removeCollectionTree(valueTypeHash, key)
+		}
+	}
+	return nil
+}
+
+// packedHashKeys returns keys in the index tree of fields of pairs, which are also the ones of members of pairs
+// of a sorted set.
+func (db *LazyDB) packedHashKeys(key []byte, pairs [][]byte) [][]byte {
+	idxKeys := make([][]byte, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		idxKeys = append(idxKeys, db.encodeKey(key, pairs[i]))
+	}
+	return idxKeys
+}
+
+// deletePackedValues deletes elements from packed entries from the index tree, elements written by normal entries
+// are kept. Index lock of the type must be held by the caller.
+func (db *LazyDB) deletePackedValues(typ valueType, idxTree *ds.AdaptiveRadixTree, sendDiscard bool) error {
+	var stale [][]byte
+	iter := idxTree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		if val, _ := node.Value().(*Value); val != nil && val.packed {
+			stale = append(stale, node.Key())
+		}
+	}
+	for _, idxKey := range stale {
+		oldVal, updated := idxTree.Delete(idxKey)
+		if sendDiscard {
+			if err := db.sendDiscard(oldVal, updated, typ); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// putPackedValues points idxKeys to the packed entry at vPos, the entry size is shared by them.
+func (db *LazyDB) putPackedValues(typ valueType, idxTree *ds.AdaptiveRadixTree, idxKeys [][]byte, vPos *ValuePos,
+	entry *logfile.LogEntry) {
+	n := len(idxKeys)
+	for i, idxKey := range idxKeys {
+		size := vPos.entrySize / n
+		if i == 0 {
+			size += vPos.entrySize % n
+		}
+		idxNode := &Value{vType: typ, fid: vPos.fid, offset: vPos.offset, entrySize: size, packed: true,
+			version: entry.Version, writtenAt: entry.WrittenAt}
+		if entry.ExpiredAt != 0 {
+			idxNode.expiredAt = expiredAtMilli(entry.ExpiredAt)
+		}
+		idxTree.Put(idxKey, idxNode)
+	}
+}
+
+// rewritePackedHash rewrites the packed entry at offset of log file fid by write if any of its fields is live.
+// Hash index lock must be held by the caller.
+func (db *LazyDB) rewritePackedHash(fid uint32, offset int64, ent *logfile.LogEntry,
+	write func(ent *logfile.LogEntry) (*ValuePos, error)) error {
+
+	idxTree := db.hashIndex.trees[util.ByteToString(ent.Key)]
+	if idxTree == nil {
+		return nil
+	}
+	pairs, err := decodePackedHash(ent.Value)
+	if err != nil {
+		return err
+	}
+	return db.rewritePacked(valueTypeHash, idxTree, fid, offset, ent, pairs, db.packedHashKeys(ent.Key, pairs), write)
+}
+
+// rewritePacked rewrites the packed entry at offset of log file fid by write if any of its elements is live.
+// elems are decoded from the entry, and idxKeys are the keys of them in the index tree, an element takes
+// len(elems)/len(idxKeys) of elems, e.g. a field and its value. Only the live elements are rewritten, so that
+// elements overridden or deleted later are not resurrected on recovery.
+// Index lock of the type must be held by the caller.
+func (db *LazyDB) rewritePacked(typ valueType, idxTree *ds.AdaptiveRadixTree, fid uint32, offset int64,
+	ent *logfile.LogEntry, elems, idxKeys [][]byte, write func(ent *logfile.LogEntry) (*ValuePos, error)) error {
+
+	if len(idxKeys) == 0 {
+		return nil
+	}
+	step := len(elems) / len(idxKeys)
+	live := make([][]byte, 0, len(elems))
+	liveKeys := make([][]byte, 0, len(idxKeys))
+	for i, idxKey := range idxKeys {
+		val, _ := idxTree.Get(idxKey).(*Value)
+		if val != nil && val.fid == fid && val.offset == offset {
+			live = append(live, elems[i*step:(i+1)*step]...)
+			liveKeys = append(liveKeys, idxKey)
+		}
+	}
+	if len(liveKeys) == 0 {
+		return nil
+	}
+	if len(liveKeys) < len(idxKeys) {
+		ent = &logfile.LogEntry{Key: ent.Key, Value: encodePacked(live), Stat: logfile.SPacked, Version: ent.Version,
+			WrittenAt: ent.WrittenAt, ExpiredAt: ent.ExpiredAt}
+	}
+	valPos, err := write(ent)
+	if err != nil {
+		return err
+	}
+	db.putPackedValues(typ, idxTree, liveKeys, valPos, ent)
+	return nil
+}
+
+// buildPackedHashIndex replays a packed entry when building indexes on opening.
+func (db *LazyDB) buildPackedHashIndex(entry *logfile.LogEntry, vPos *ValuePos) {
+	// fields of an expired hash are removed without delete entries, see removeExpiredCollection
+	if entry.ExpiredAt != 0 && expiredAtMilli(entry.ExpiredAt) <= db.now().UnixMilli() {
+		entry = &logfile.LogEntry{Key: entry.Key, Stat: logfile.SPacked, Version: entry.Version}
+	}
+	if err := db.putPackedHash(entry, vPos, false); err != nil {
+		log.Printf("replay packed hash %q at fid %d offset %d err: %v", entry.Key, vPos.fid, vPos.offset, err)
+	}
+}
@@ -0,0 +1,105 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_PackSmallHashes(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_pack_small_hashes")
+	cfg := DefaultDBConfig(path)
+	cfg.PackSmallHashes = true
+	cfg.HashMaxListpackEntries = 4
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+	key := []byte("packed")
+	packed := func() bool {
+		db.hashIndex.mu.RLock()
+		defer db.hashIndex.mu.RUnlock()
+		return isPacked(db.hashIndex.trees[string(key)])
+	}
+
+	// a small hash is written as a single entry
+	writes := db.Stats().Writes
+	assert.Nil(t, db.HSet(key, []byte("f1"), []byte("v1"), []byte("f2"), []byte("v2"), []byte("f3"), []byte("v3")))
+	assert.Equal(t, writes+1, db.Stats().Writes)
+	assert.True(t, packed())
+	val, err := db.HGet(key, []byte("f2"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+
+	count, err := db.HDel(key, []byte("f2"), []byte("missing"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	values, err := db.HGetDel(key, []byte("f3"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("v3")}, values)
+	assert.Nil(t, db.HSetNX(key, []byte("f1"), []byte("ignored")))
+	assert.Nil(t, db.HSetNX(key, []byte("f2"), []byte("v2")))
+	assert.True(t, packed())
+	all, err := db.HGetAll(key)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("f1"), []byte("v1"), []byte("f2"), []byte("v2")}, all)
+
+	// exceeding the threshold converts it into entries for each field transparently
+	writes = db.Stats().Writes
+	assert.Nil(t, db.HSet(key, []byte("f3"), []byte("v3"), []byte("f4"), []byte("v4"), []byte("f5"), []byte("v5")))
+	assert.Equal(t, writes+5, db.Stats().Writes)
+	assert.False(t, packed())
+	assert.Nil(t, db.HSet(key, []byte("f1"), []byte("v1")))
+	assert.False(t, packed())
+	assert.Equal(t, 5, hLen(t, db, key))
+
+	// a large value is not packed either
+	assert.Nil(t, db.HSet([]byte("large"), []byte("f"), GetValue(128)))
+	db.hashIndex.mu.RLock()
+	assert.False(t, isPacked(db.hashIndex.trees["large"]))
+	db.hashIndex.mu.RUnlock()
+
+	small := []byte("small")
+	assert.Nil(t, db.HSet(small, []byte("f1"), []byte("v1"), []byte("f2"), []byte("v2")))
+	assert.Nil(t, db.HSet(small, []byte("f2"), []byte("new")))
+	expected := func() {
+		all, err := db.HGetAll(key)
+		assert.Nil(t, err)
+		assert.Equal(t, 10, len(all))
+		for i := 0; i < len(all); i += 2 {
+			assert.Equal(t, "v"+string(all[i][1:]), string(all[i+1]))
+		}
+		all, err = db.HGetAll(small)
+		assert.Nil(t, err)
+		assert.Equal(t, [][]byte{[]byte("f1"), []byte("v1"), []byte("f2"), []byte("new")}, all)
+	}
+	expected()
+
+	// recovered and compacted
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	expected()
+	assert.Nil(t, db.FullCompact(valueTypeHash))
+	expected()
+
+	// packed hashes are written as normal ones if it is off
+	assert.Nil(t, db.Close())
+	cfg.PackSmallHashes = false
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, db.HSet(small, []byte("f3"), []byte("v3")))
+	count, err = db.HDel(small, []byte("f1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	all, err = db.HGetAll(small)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("f2"), []byte("new"), []byte("f3"), []byte("v3")}, all)
+}
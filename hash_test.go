@@ -1,6 +1,7 @@
 package lazydb
 
 import (
+	"encoding/binary"
 	"github.com/billsjc123/LazyDB/util"
 	"os"
 	"path/filepath"
@@ -156,6 +157,36 @@ func TestLazyDB_HGet(t *testing.T) {
 
 }
 
+func TestLazyDB_HGetRange(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+
+	assert.Nil(t, db.HSet([]byte("k1"), []byte("f1"), []byte("Hello World")))
+
+	tests := []struct {
+		name       string
+		key, field []byte
+		start, end int
+		expected   []byte
+	}{
+		{"positive range", []byte("k1"), []byte("f1"), 0, 4, []byte("Hello")},
+		{"negative range", []byte("k1"), []byte("f1"), -5, -1, []byte("World")},
+		{"mixed range", []byte("k1"), []byte("f1"), 6, -1, []byte("World")},
+		{"end out of range", []byte("k1"), []byte("f1"), 6, 100, []byte("World")},
+		{"start out of range", []byte("k1"), []byte("f1"), -100, 4, []byte("Hello")},
+		{"empty range", []byte("k1"), []byte("f1"), 5, 2, []byte{}},
+		{"not existed field", []byte("k1"), []byte("f2"), 0, -1, []byte{}},
+		{"not existed key", []byte("k2"), []byte("f1"), 0, -1, []byte{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := db.HGetRange(tt.key, tt.field, tt.start, tt.end)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
 func TestLazyDB_HDel(t *testing.T) {
 	db := initTestDB()
 	defer destroyDB(db)
@@ -225,6 +256,60 @@ func TestLazyDB_HDel(t *testing.T) {
 	}
 }
 
+func TestLazyDB_HDelEmptyHash(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := GetKey(1)
+	assert.Nil(t, db.HSet(key, []byte("f1"), GetValue32(), []byte("f2"), GetValue32()))
+	count, err := db.HDel(key, []byte("f1"), []byte("f2"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+
+	_, ok := db.hashIndex.trees[string(key)]
+	assert.False(t, ok)
+	_, _, err = db.GetAny(key)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the hash can be created again
+	assert.Nil(t, db.HSet(key, []byte("f1"), GetValue32()))
+	assert.Equal(t, 1, hLen(t, db, key))
+}
+
+func TestLazyDB_HGetDel(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := GetKey(1)
+	v1, v2 := GetValue32(), GetValue32()
+	assert.Nil(t, db.HSet(key, []byte("f1"), v1, []byte("f2"), v2, []byte("f3"), GetValue32()))
+
+	values, err := db.HGetDel(key, []byte("f1"), []byte("f4"), []byte("f2"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{v1, nil, v2}, values)
+	assert.Equal(t, 1, hLen(t, db, key))
+	for _, field := range []string{"f1", "f2"} {
+		ok, err := db.HExists(key, []byte(field))
+		assert.Nil(t, err)
+		assert.False(t, ok)
+	}
+
+	// deleted fields are gone
+	values, err = db.HGetDel(key, []byte("f1"), []byte("f3"))
+	assert.Nil(t, err)
+	assert.Nil(t, values[0])
+	assert.NotNil(t, values[1])
+	_, ok := db.hashIndex.trees[string(key)]
+	assert.False(t, ok)
+
+	// missing hash
+	values, err = db.HGetDel(GetKey(2), []byte("f1"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{nil}, values)
+}
+
 func TestLazyDB_HExists(t *testing.T) {
 	db := initTestDB()
 	defer destroyDB(db)
@@ -579,19 +664,285 @@ func TestLazyDB_HLen(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := db.HLen(tt.args.key)
+			got, err := db.HLen(tt.args.key)
+			assert.Nil(t, err)
 			assert.Equal(t, tt.want, got)
 		})
 	}
 	// test deletion
 	db.HDel([]byte("k1"), GetKey(1))
 	t.Run("test deletion", func(t *testing.T) {
-		got := db.HLen([]byte("k1"))
+		got := hLen(t, db, []byte("k1"))
 		assert.Equal(t, 2, got)
 	})
 	db.HDel([]byte("k1"), GetKey(2), GetKey(3))
 	t.Run("test deletion_all", func(t *testing.T) {
-		got := db.HLen([]byte("k1"))
+		got := hLen(t, db, []byte("k1"))
 		assert.Equal(t, 0, got)
 	})
 }
+
+func TestLazyDB_HSetEmptyField(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	assert.Nil(t, db.HSet([]byte("h1"), []byte{}, []byte("v1")))
+	assert.Nil(t, db.HSet([]byte("h1"), []byte("f1"), []byte{}))
+
+	got, err := db.HGet([]byte("h1"), []byte{})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), got)
+
+	got, err = db.HGet([]byte("h1"), []byte("f1"))
+	assert.Nil(t, err)
+	assert.NotNil(t, got)
+	assert.Equal(t, 0, len(got))
+
+	exist, err := db.HExists([]byte("h1"), []byte{})
+	assert.Nil(t, err)
+	assert.True(t, exist)
+
+	keys, err := db.HKeys([]byte("h1"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{{}, []byte("f1")}, keys)
+
+	cnt, err := db.HDel([]byte("h1"), []byte{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, cnt)
+	got, err = db.HGet([]byte("h1"), []byte{})
+	assert.Nil(t, err)
+	assert.Nil(t, got)
+}
+
+func TestLazyDB_HGetAllFunc(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("my_hash")
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, db.HSet(key, GetKey(i), GetValue(i+1)))
+	}
+	want, err := db.HGetAll(key)
+	assert.Nil(t, err)
+
+	var all [][]byte
+	err = db.HGetAllFunc(key, func(field, value []byte) bool {
+		all = append(all, field, value)
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, want, all)
+
+	// stop early
+	var count int
+	err = db.HGetAllFunc(key, func(field, value []byte) bool {
+		count++
+		return count < 2
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+
+	err = db.HGetAllFunc([]byte("missing"), func(field, value []byte) bool {
+		t.Fatal("should not be called")
+		return true
+	})
+	assert.Nil(t, err)
+}
+
+func TestLazyDB_HScan(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("my_hash")
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.HSet(key, GetKey(i), GetValue(i+1)))
+	}
+	want, err := db.HGetAll(key)
+	assert.Nil(t, err)
+
+	scan := func(match string, noValues bool) [][]byte {
+		var all [][]byte
+		var cursor uint64
+		for {
+			var res [][]byte
+			if noValues {
+				cursor, res, err = db.HScanNoValues(key, cursor, match, 3)
+			} else {
+				cursor, res, err = db.HScan(key, cursor, match, 3)
+			}
+			assert.Nil(t, err)
+			all = append(all, res...)
+			if cursor == 0 {
+				return all
+			}
+		}
+	}
+	assert.Equal(t, want, scan("", false))
+
+	var reads int
+	readLogEntryHook = func(typ valueType, fid uint32, offset int64) {
+		reads++
+	}
+	defer func() {
+		readLogEntryHook = nil
+	}()
+	fields := scan("", true)
+	assert.Equal(t, 0, reads)
+	assert.Equal(t, 10, len(fields))
+	for i, field := range fields {
+		assert.Equal(t, want[2*i], field)
+	}
+
+	// only matching fields
+	assert.Equal(t, [][]byte{GetKey(3)}, scan("3$", true))
+	assert.Equal(t, [][]byte{GetKey(3), want[7]}, scan("3$", false))
+	// values of other fields are not read
+	assert.Equal(t, 1, reads)
+
+	_, res, err := db.HScanNoValues([]byte("missing"), 0, "", 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(res))
+	_, _, err = db.HScan(key, 0, "", 0)
+	assert.Equal(t, ErrInvalidParam, err)
+	_, _, err = db.HScan(key, 0, "(", 3)
+	assert.NotNil(t, err)
+}
+
+// compactCodec packs a key and a subKey by the uvarint length of the key, without the length of the subKey.
+type compactCodec struct{}
+
+func (compactCodec) Encode(key, subKey []byte) []byte {
+	buf := make([]byte, binary.MaxVarintLen64+len(key)+len(subKey))
+	n := binary.PutUvarint(buf, uint64(len(key)))
+	n += copy(buf[n:], key)
+	n += copy(buf[n:], subKey)
+	return buf[:n]
+}
+
+func (compactCodec) Decode(data []byte) ([]byte, []byte) {
+	keyLen, n := binary.Uvarint(data)
+	return data[n : n+int(keyLen)], data[n+int(keyLen):]
+}
+
+func TestLazyDB_HashCollectionCodec(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_collection_codec"))
+	cfg.MaxLogFileSize = 1000
+	cfg.CollectionCodec = compactCodec{}
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	key := []byte("codec")
+	want := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		field, value := GetKey(i%20), GetValue(16)
+		assert.Nil(t, db.HSet(key, field, value))
+		want[string(field)] = string(value)
+	}
+	_, err = db.HDel(key, GetKey(0))
+	assert.Nil(t, err)
+	delete(want, string(GetKey(0)))
+	assert.Less(t, len(cfg.CollectionCodec.Encode(key, GetKey(1))), len(encodeKey(key, GetKey(1))))
+
+	check := func() {
+		pairs, err := db.HGetAll(key)
+		assert.Nil(t, err)
+		got := make(map[string]string)
+		for i := 0; i < len(pairs); i += 2 {
+			got[string(pairs[i])] = string(pairs[i+1])
+		}
+		assert.Equal(t, want, got)
+	}
+	check()
+
+	// entries are unpacked by the codec on recovery and merge
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	check()
+	fids := append([]uint32{}, db.fidsMap[valueTypeHash].fids...)
+	assert.Greater(t, len(fids), 2)
+	for _, fid := range fids[:len(fids)-1] {
+		assert.Nil(t, db.Merge(valueTypeHash, fid, -1))
+	}
+	check()
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	check()
+}
+
+func TestLazyDB_HSetMap(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+
+	key := []byte("hset_map")
+	assert.Nil(t, db.HSet(key, GetKey(0), []byte("old"), GetKey(1), []byte("old")))
+	fields := make(map[string][]byte)
+	for i := 0; i < 10000; i++ {
+		fields[string(GetKey(i))] = GetValue(16)
+	}
+	// existing fields are updated without being counted
+	added, err := db.HSetMap(key, fields)
+	assert.Nil(t, err)
+	assert.Equal(t, 9998, added)
+	assert.Equal(t, 10000, hLen(t, db, key))
+	pairs, err := db.HGetAll(key)
+	assert.Nil(t, err)
+	got := make(map[string][]byte)
+	for i := 0; i < len(pairs); i += 2 {
+		got[string(pairs[i])] = pairs[i+1]
+	}
+	assert.Equal(t, fields, got)
+
+	added, err = db.HSetMap(key, map[string][]byte{string(GetKey(0)): []byte("new"), "another": []byte("v")})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, added)
+	val, err := db.HGet(key, GetKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), val)
+	added, err = db.HSetMap(key, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, added)
+}
+
+func BenchmarkLazyDB_HSetMap(b *testing.B) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "bench_hset_map")
+	db, err := Open(DefaultDBConfig(path))
+	assert.Nil(b, err)
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	fields := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		fields[string(GetKey(i))] = GetValue(64)
+	}
+	key := []byte("bench")
+	// looped HSet is synced as often as the map, so that only the cost of looping differs
+	b.Run("looped-hset", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for field, value := range fields {
+				assert.Nil(b, db.HSet(key, []byte(field), value))
+			}
+			assert.Nil(b, db.Sync())
+		}
+	})
+	b.Run("hset-map", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := db.HSetMap(key, fields)
+			assert.Nil(b, err)
+		}
+	})
+}
+
+// hLen returns HLen of key, asserting no error is returned.
+func hLen(t *testing.T, db *LazyDB, key []byte) int {
+	n, err := db.HLen(key)
+	assert.Nil(t, err)
+	return n
+}
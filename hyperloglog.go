@@ -0,0 +1,147 @@
+package lazydb
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/billsjc123/LazyDB/ds"
+	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/billsjc123/LazyDB/util"
+)
+
+// hllMagic prefixes the value of a key of type String holding a HyperLogLog, it is followed by the registers.
+const hllMagic = "HYLL"
+
+// ErrInvalidHLL is returned by PF commands if the value of key is not a HyperLogLog.
+var ErrInvalidHLL = errors.New("value is not a HyperLogLog")
+
+// PFAdd adds elements into the HyperLogLog stored at key, which is created if it does not exist.
+// The HyperLogLog is stored as a value of type String of about 16KB, and estimates the number of distinct elements
+// added with a standard error of 0.81%, see PFCount. It returns true if the estimate may have changed,
+// or the key is created.
+func (db *LazyDB) PFAdd(key []byte, elements ...[]byte) (bool, error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return false, err
+	}
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	if err := db.evict(); err != nil {
+		return false, err
+	}
+	hll, err := db.getHLL(key)
+	if err != nil {
+		return false, err
+	}
+	changed := hll == nil
+	if hll == nil {
+		hll = ds.NewHyperLogLog(ds.DefaultHLLPrecision)
+	}
+	for _, elem := range elements {
+		if hll.Add(util.XXHash64Sum(elem)) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, db.putHLL(key, hll)
+}
+
+// PFCount returns the estimated number of distinct elements added into the HyperLogLogs stored at keys,
+// which is the cardinality of the union of them if more than one key is given. Keys not existing are ignored.
+func (db *LazyDB) PFCount(keys ...[]byte) (int64, error) {
+	if err := db.checkAccess(OpRead, keys...); err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, ErrInvalidParam
+	}
+	db.strIndex.mu.RLock()
+	defer db.strIndex.mu.RUnlock()
+
+	union, err := db.mergeHLLs(keys)
+	if err != nil || union == nil {
+		return 0, err
+	}
+	return int64(union.Count()), nil
+}
+
+// PFMerge merges the HyperLogLogs stored at sources into the one stored at dest, which is created if it does not exist,
+// so that dest estimates the cardinality of the union of all of them.
+func (db *LazyDB) PFMerge(dest []byte, sources ...[]byte) error {
+	if err := db.checkAccess(OpRead, sources...); err != nil {
+		return err
+	}
+	if err := db.checkAccess(OpWrite, dest); err != nil {
+		return err
+	}
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	if err := db.evict(); err != nil {
+		return err
+	}
+	union, err := db.mergeHLLs(append([][]byte{dest}, sources...))
+	if err != nil {
+		return err
+	}
+	if union == nil {
+		union = ds.NewHyperLogLog(ds.DefaultHLLPrecision)
+	}
+	return db.putHLL(dest, union)
+}
+
+// mergeHLLs returns the union of the HyperLogLogs stored at keys, nil if none of keys exists.
+// Lock of strIndex must be held by the caller.
+func (db *LazyDB) mergeHLLs(keys [][]byte) (*ds.HyperLogLog, error) {
+	var union *ds.HyperLogLog
+	for _, key := range keys {
+		hll, err := db.getHLL(key)
+		if err != nil {
+			return nil, err
+		}
+		if hll == nil {
+			continue
+		}
+		if union == nil {
+			union = hll
+		} else {
+			union.Merge(hll)
+		}
+	}
+	return union, nil
+}
+
+// getHLL returns the HyperLogLog stored at key, nil if key does not exist.
+// Lock of strIndex must be held by the caller.
+func (db *LazyDB) getHLL(key []byte) (*ds.HyperLogLog, error) {
+	val, err := db.getValue(db.strIndex.idxTree, key, valueTypeString)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(val, []byte(hllMagic)) || len(val)-len(hllMagic) != 1<<ds.DefaultHLLPrecision {
+		return nil, ErrInvalidHLL
+	}
+	// val is read from log file, it is not shared
+	hll, ok := ds.LoadHyperLogLog(val[len(hllMagic):])
+	if !ok {
+		return nil, ErrInvalidHLL
+	}
+	return hll, nil
+}
+
+// putHLL stores hll at key. Lock of strIndex must be held by the caller.
+func (db *LazyDB) putHLL(key []byte, hll *ds.HyperLogLog) error {
+	value := make([]byte, 0, len(hllMagic)+len(hll.Registers()))
+	value = append(append(value, hllMagic...), hll.Registers()...)
+	entry := &logfile.LogEntry{Key: key, Value: value, ExpiredAt: db.defaultExpiredAt(db.now())}
+	valuePos, err := db.writeLogEntry(valueTypeString, entry)
+	if err != nil {
+		return err
+	}
+	return db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valuePos, true)
+}
@@ -0,0 +1,94 @@
+package lazydb
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/billsjc123/LazyDB/ds"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_PFAdd(t *testing.T) {
+	db := initTestDB()
+	defer func() {
+		destroyDB(db)
+	}()
+	assert.NotNil(t, db)
+
+	// 3 times the standard error
+	bound := 3 * 1.04 / math.Sqrt(float64(uint64(1)<<ds.DefaultHLLPrecision))
+	key := []byte("hll")
+	changed, err := db.PFAdd(key)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	count, err := db.PFCount(key)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), count)
+
+	const n = 50000
+	for i := 0; i < n; i += 1000 {
+		elements := make([][]byte, 1000)
+		for j := range elements {
+			elements[j] = []byte(fmt.Sprintf("element-%d", i+j))
+		}
+		_, err := db.PFAdd(key, elements...)
+		assert.Nil(t, err)
+	}
+	changed, err = db.PFAdd(key, []byte("element-0"))
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	count, err = db.PFCount(key)
+	assert.Nil(t, err)
+	assert.InDelta(t, float64(n), float64(count), n*bound)
+
+	// survives reopen
+	assert.Nil(t, db.Close())
+	db, err = Open(*db.cfg)
+	assert.Nil(t, err)
+	reopened, err := db.PFCount(key)
+	assert.Nil(t, err)
+	assert.Equal(t, count, reopened)
+
+	assert.Nil(t, db.Set([]byte("str"), []byte("v")))
+	_, err = db.PFAdd([]byte("str"), []byte("a"))
+	assert.Equal(t, ErrInvalidHLL, err)
+	_, err = db.PFCount()
+	assert.Equal(t, ErrInvalidParam, err)
+}
+
+func TestLazyDB_PFMerge(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	bound := 3 * 1.04 / math.Sqrt(float64(uint64(1)<<ds.DefaultHLLPrecision))
+	// 10000 elements each, overlapping by half
+	keys := [][]byte{[]byte("hll1"), []byte("hll2"), []byte("hll3")}
+	for i, key := range keys {
+		elements := make([][]byte, 10000)
+		for j := range elements {
+			elements[j] = []byte(fmt.Sprintf("element-%d", i*5000+j))
+		}
+		_, err := db.PFAdd(key, elements...)
+		assert.Nil(t, err)
+	}
+
+	union, err := db.PFCount(append(keys, []byte("missing"))...)
+	assert.Nil(t, err)
+	assert.InDelta(t, 20000, float64(union), 20000*bound)
+
+	assert.Nil(t, db.PFMerge(keys[0], keys[1:]...))
+	count, err := db.PFCount(keys[0])
+	assert.Nil(t, err)
+	assert.Equal(t, union, count)
+	// sources are not changed
+	count, err = db.PFCount(keys[1])
+	assert.Nil(t, err)
+	assert.InDelta(t, 10000, float64(count), 10000*bound)
+
+	assert.Nil(t, db.PFMerge([]byte("empty")))
+	count, err = db.PFCount([]byte("empty"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), count)
+}
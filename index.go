@@ -1,44 +1,96 @@
 package lazydb
 
 import (
+	"fmt"
 	"github.com/billsjc123/LazyDB/ds"
 	"github.com/billsjc123/LazyDB/logfile"
 	"github.com/billsjc123/LazyDB/util"
 	"io"
 	"log"
 	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
+// Estimated memory size in bytes of index components other than tree nodes.
+const (
+	// indexValueSize is the size of a *Value held by a leaf.
+	indexValueSize = int64(unsafe.Sizeof(Value{}))
+	// indexMapEntrySize is the size of a per-key entry in the index map, excluding the key.
+	indexMapEntrySize = 48
+	// zSetElementSize is the size of a member in the skiplist of sorted set, excluding the member.
+	zSetElementSize = 112
+)
+
+// String returns a human-readable summary of the index value for debugging.
+func (v *Value) String() string {
+	if v == nil {
+		return "Value<nil>"
+	}
+	ttl := "none"
+	if v.expiredAt != 0 {
+		ttl = time.Until(time.UnixMilli(expiredAtMilli(v.expiredAt))).Truncate(time.Millisecond).String()
+	}
+	return fmt.Sprintf("Value{type=%s fid=%d offset=%d entrySize=%d expiredAt=%d ttl=%s accessCount=%d}",
+		valueTypeName(v.vType), v.fid, v.offset, v.entrySize, v.expiredAt, ttl, atomic.LoadUint64(&v.accessCount))
+}
+
+// valueTypeName returns the name of the value type, which is the name of its log files for a custom type.
+func valueTypeName(typ valueType) string {
+	if name, ok := dumpTypeNames[typ]; ok {
+		return name
+	}
+	if prefix, ok := logfile.FileNamePrefix(logfile.FType(typ)); ok {
+		return strings.TrimSuffix(strings.TrimPrefix(prefix, "log."), ".")
+	}
+	return fmt.Sprintf("type(%d)", typ)
+}
+
 func (db *LazyDB) buildStrIndex(entry *logfile.LogEntry, vPos *ValuePos) {
 	if entry.Stat == logfile.SDelete {
-		db.strIndex.idxTree.Delete(entry.Key)
+		delVal, _ := db.strIndex.idxTree.Delete(entry.Key)
+		db.replaceStrValue(entry.Key, delVal, nil)
 		return
 	}
-	_, size := logfile.EncodeEntry(entry)
-	idxNode := &Value{fid: vPos.fid, offset: vPos.offset, entrySize: size}
-
-	// TODO: set expire time
+	// references are counted once all log files are replayed, see countInternedRefs
+	if entry.Stat == logfile.SValueBlob {
+		db.internedRef(entry.Key).pos = *vPos
+		return
+	}
+	idxNode := &Value{vType: valueTypeString, fid: vPos.fid, offset: vPos.offset, entrySize: vPos.entrySize,
+		version: entry.Version, writtenAt: entry.WrittenAt, lastAccess: db.now().UnixNano()}
+	if entry.ExpiredAt != 0 {
+		idxNode.expiredAt = expiredAtMilli(entry.ExpiredAt)
+	}
+	if entry.Stat == logfile.SValueRef {
+		idxNode.ref = db.internedRef(entry.Value)
+	}
 
-	db.strIndex.idxTree.Put(entry.Key, idxNode)
+	oldVal, _ := db.strIndex.idxTree.Put(entry.Key, idxNode)
+	db.replaceStrValue(entry.Key, oldVal, idxNode)
 }
 
 func (db *LazyDB) buildHashIndex(entry *logfile.LogEntry, vPos *ValuePos) {
-	key, _ := decodeKey(entry.Key)
-	db.hashIndex.mu.Lock()
-	defer db.hashIndex.mu.Unlock()
-	idxTree := db.hashIndex.trees[util.ByteToString(key)]
-	if entry.Stat == logfile.SDelete {
+	if entry.Stat == logfile.SPacked {
+		db.buildPackedHashIndex(entry, vPos)
+		return
+	}
+	key, _ := db.decodeKey(entry.Key)
+	idxTree := db.collectionTree(valueTypeHash, key)
+	// fields of an expired hash are removed without delete entries, see removeExpiredCollection
+	if entry.Stat == logfile.SDelete || (entry.ExpiredAt != 0 && expiredAtMilli(entry.ExpiredAt) <= db.now().UnixMilli()) {
 		idxTree.Delete(entry.Key)
 		return
 	}
 
-	_, size := logfile.EncodeEntry(entry)
-	idxNode := &Value{fid: vPos.fid, offset: vPos.offset, entrySize: size}
-
-	// TODO: set expire time
+	idxNode := &Value{vType: valueTypeHash, fid: vPos.fid, offset: vPos.offset, entrySize: vPos.entrySize,
+		version: entry.Version, writtenAt: entry.WrittenAt}
+	if entry.ExpiredAt != 0 {
+		idxNode.expiredAt = expiredAtMilli(entry.ExpiredAt)
+	}
 
 	idxTree.Put(entry.Key, idxNode)
 }
@@ -49,92 +101,338 @@ func (db *LazyDB) buildIndexByVType(typ valueType, entry *logfile.LogEntry, vPos
 		db.buildStrIndex(entry, vPos)
 	case valueTypeHash:
 		db.buildHashIndex(entry, vPos)
+	default:
+		if ct := db.getCustomType(typ); ct != nil {
+			db.buildCustomIndex(typ, ct, entry, vPos)
+		}
 	}
 }
 
 func (db *LazyDB) buildIndexFromLogFiles() error {
-	build := func(typ valueType, wg *sync.WaitGroup) {
-		defer wg.Done()
+	// limits the number of log files read at the same time, files of different types are read concurrently if nil
+	var sem chan struct{}
+	if db.cfg.RecoveryConcurrency > 0 {
+		sem = make(chan struct{}, db.cfg.RecoveryConcurrency)
+	}
 
-		mutexFids := db.fidsMap[typ]
-		fids := mutexFids.fids
-		if len(fids) == 0 {
-			return
+	types := db.valueTypes()
+	errs := make([]error, len(types))
+	wg := new(sync.WaitGroup)
+	wg.Add(len(types))
+	for i, typ := range types {
+		go func(i int, typ valueType) {
+			defer wg.Done()
+			errs[i] = db.buildIndexOfType(typ, sem)
+		}(i, typ)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
 		}
-		sort.Slice(fids, func(i, j int) bool {
-			return fids[i] < fids[j]
-		})
-
-		for i, fid := range fids {
-			var logFile *logfile.LogFile
-			if i == len(fids)-1 {
-				logFile = db.activeLogFileMap[typ].lf
-			} else {
-				mlf := db.getArchivedLogFile(typ, fid)
-				if mlf == nil {
-					log.Fatalf("log file is nil, failed to open db")
-				}
-				logFile = mlf.lf
-			}
-			if logFile == nil {
+	}
+	db.countInternedRefs()
+	return db.removeCheckpoints()
+}
+
+// buildIndexOfType builds the index of the type from its log files, sem limits the number of log files
+// read at the same time, and log files are read one by one if it is nil. The error of a corrupt log file is returned
+// unless DBConfig.SkipCorruptFiles is on, see skipCorruptFile.
+func (db *LazyDB) buildIndexOfType(typ valueType, sem chan struct{}) error {
+	mutexFids := db.fidsMap[typ]
+	fids := mutexFids.fids
+	if len(fids) == 0 {
+		return nil
+	}
+	sort.Slice(fids, func(i, j int) bool {
+		return fids[i] < fids[j]
+	})
+
+	logFiles := make([]*logfile.LogFile, len(fids))
+	for i, fid := range fids {
+		var logFile *logfile.LogFile
+		if i == len(fids)-1 {
+			logFile = db.activeLogFileMap[typ].lf
+		} else {
+			mlf := db.getArchivedLogFile(typ, fid)
+			if mlf == nil {
 				log.Fatalf("log file is nil, failed to open db")
 			}
+			logFile = mlf.lf
+		}
+		if logFile == nil {
+			log.Fatalf("log file is nil, failed to open db")
+		}
+		logFiles[i] = logFile
+	}
 
-			var offset int64
-			for {
-				entry, entSize, err := logFile.ReadLogEntry(offset)
-				if err != nil {
-					if err == io.EOF || err == logfile.ErrLogEndOfFile {
-						break
-					}
-					log.Fatalf("read log entry from file err: %v, failed to open db", err)
-				}
-				vPos := &ValuePos{fid: fid, offset: offset, entrySize: entSize}
+	build := func(entry *logfile.LogEntry, vPos *ValuePos) {
+		db.buildIndexByVType(typ, entry, vPos)
+	}
+	if db.cfg.VersionedEntries {
+		// versions of deleted keys, which are not in the index any more
+		deleted := make(map[string]uint64)
+		build = func(entry *logfile.LogEntry, vPos *ValuePos) {
+			if db.replayedNewerVersion(typ, entry, deleted) {
 				db.buildIndexByVType(typ, entry, vPos)
-				offset += int64(entSize)
 			}
-			// set latest log file`s WriteAt.
-			if i == len(fids)-1 {
-				atomic.StoreInt64(&logFile.Offset, offset)
+		}
+	} else if db.cfg.RecoveryReadRepair && db.cfg.RecordTimestamps && typ == valueTypeHash {
+		// timestamps of deleted fields, which are not in the index any more
+		deleted := make(map[string]int64)
+		build = func(entry *logfile.LogEntry, vPos *ValuePos) {
+			if db.replayedLaterWrite(typ, entry, deleted) {
+				db.buildIndexByVType(typ, entry, vPos)
 			}
 		}
 	}
 
-	wg := new(sync.WaitGroup)
-	wg.Add(logFileTypeNum)
-	for i := 0; i < logFileTypeNum; i++ {
-		go build(valueType(i), wg)
+	if filter := db.cfg.RecoveryFilter; filter != nil {
+		buildEntry := build
+		build = func(entry *logfile.LogEntry, vPos *ValuePos) {
+			if key, ok := db.recoveryKey(typ, entry); !ok || filter(key, typ) {
+				buildEntry(entry, vPos)
+			}
+		}
 	}
-	wg.Wait()
-	return nil
+
+	// entries of transactions interrupted before their commit markers are discarded, see Tx.Exec
+	buildCommitted := build
+	build = func(entry *logfile.LogEntry, vPos *ValuePos) {
+		if !db.txDiscarded(entry) {
+			buildCommitted(entry, vPos)
+		}
+	}
+
+	// log files covered by the checkpoint need not to be replayed, except entries written after it was taken
+	progress := db.newRecoveryProgress(typ, logFiles)
+	start := db.resumeFromCheckpoint(typ, logFiles)
+	for i, logFile := range logFiles[:start] {
+		offset, err := db.replayLogFile(typ, logFile, logFile.Offset, build)
+		if err != nil {
+			if err = db.skipCorruptFile(typ, logFile.Fid, offset, err); err != nil {
+				return err
+			}
+		}
+		atomic.StoreInt64(&logFile.Offset, offset)
+		progress.fileDone(i)
+	}
+
+	if sem == nil {
+		for i := start; i < len(logFiles); i++ {
+			logFile := logFiles[i]
+			offset, err := db.recoverLogFile(typ, logFile, build)
+			// entries before the corrupt one are kept
+			if err != nil {
+				if err = db.skipCorruptFile(typ, logFile.Fid, offset, err); err != nil {
+					return err
+				}
+			}
+			// set log file`s WriteAt, archived log files can also be appended by MergeInto.
+			atomic.StoreInt64(&logFile.Offset, offset)
+			db.checkpointAfterReplay(typ, logFiles, i, i-start+1)
+			progress.fileDone(i)
+		}
+		return nil
+	}
+
+	// read log files concurrently, but build index in order of fid so that newer entries win
+	results := make([]chan *replayResult, len(logFiles))
+	for i := start; i < len(logFiles); i++ {
+		logFile := logFiles[i]
+		results[i] = make(chan *replayResult, 1)
+		go func(logFile *logfile.LogFile, resCh chan<- *replayResult) {
+			sem <- struct{}{}
+			res := &replayResult{}
+			res.offset, res.err = db.recoverLogFile(typ, logFile, func(entry *logfile.LogEntry, vPos *ValuePos) {
+				res.entries = append(res.entries, entry)
+				res.positions = append(res.positions, vPos)
+			})
+			<-sem
+			resCh <- res
+		}(logFile, results[i])
+	}
+	// all results are received even after a failure, so that no log file is still read once it returns
+	var err error
+	for i := start; i < len(logFiles); i++ {
+		res := <-results[i]
+		if err != nil {
+			continue
+		}
+		for k, entry := range res.entries {
+			build(entry, res.positions[k])
+		}
+		if res.err != nil {
+			if err = db.skipCorruptFile(typ, logFiles[i].Fid, res.offset, res.err); err != nil {
+				continue
+			}
+		}
+		atomic.StoreInt64(&logFiles[i].Offset, res.offset)
+		db.checkpointAfterReplay(typ, logFiles, i, i-start+1)
+		progress.fileDone(i)
+	}
+	return err
+}
+
+// recoveryKey returns the key of the entry passed to DBConfig.RecoveryFilter,
+// false if the entry is not filtered, e.g. an interned value which may be referenced by any key.
+func (db *LazyDB) recoveryKey(typ valueType, entry *logfile.LogEntry) ([]byte, bool) {
+	switch {
+	case typ == valueTypeString && entry.Stat == logfile.SValueBlob:
+		return nil, false
+	case typ == valueTypeHash && entry.Stat != logfile.SPacked:
+		key, _ := db.decodeKey(entry.Key)
+		return key, true
+	default:
+		return entry.Key, true
+	}
+}
+
+// Reload discards the in-memory indexes and rebuilds them from log files the same way as Open does,
+// while log files are kept open. All operations are blocked until rebuilding finishes.
+// It can be used to recover from suspected index corruption at runtime.
+func (db *LazyDB) Reload() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.IsClosed() {
+		return ErrDatabaseClosed
+	}
+	// indexes are built without locking, so hold all index locks here
+	defer db.lockIndexes(db.valueTypes()...)()
+
+	for _, typ := range db.valueTypes() {
+		db.resetIndexOfType(typ)
+	}
+	return db.buildIndexFromLogFiles()
+}
+
+// replayResult entries read from a log file during recovery.
+type replayResult struct {
+	entries   []*logfile.LogEntry
+	positions []*ValuePos
+	offset    int64
+	err       error
+}
+
+// replayLogFile reads entries of the log file from offset in order and calls fn with each of them.
+// It returns the offset where the entries end, and the error which stops reading at the offset if any.
+func (db *LazyDB) replayLogFile(typ valueType, logFile *logfile.LogFile, offset int64,
+	fn func(*logfile.LogEntry, *ValuePos)) (int64, error) {
+	for {
+		if err := db.pinLogFile(typ, logFile); err != nil {
+			return offset, err
+		}
+		entry, entSize, err := logFile.ReadLogEntry(offset)
+		logFile.Mu.RUnlock()
+		if err != nil {
+			if err == io.EOF || err == logfile.ErrLogEndOfFile {
+				break
+			}
+			return offset, err
+		}
+		fn(entry, &ValuePos{fid: logFile.Fid, offset: offset, entrySize: entSize})
+		offset += int64(entSize)
+	}
+	return offset, nil
 }
 
 func (db *LazyDB) getValue(idxTree *ds.AdaptiveRadixTree, key []byte, typ valueType) ([]byte, error) {
-	rawValue := idxTree.Get(key)
-	if rawValue == nil {
-		return nil, ErrKeyNotFound
+	return db.getValueWithDeadline(idxTree, key, typ, time.Time{})
+}
+
+// getValueWithDeadline is like getValue, but gives up waiting for the log file once deadline is exceeded.
+func (db *LazyDB) getValueWithDeadline(idxTree *ds.AdaptiveRadixTree, key []byte, typ valueType,
+	deadline time.Time) ([]byte, error) {
+	return db.getValueInto(idxTree, key, typ, nil, deadline)
+}
+
+// getValueInto is like getValueWithDeadline, but the value is appended to dst if dst is not nil.
+func (db *LazyDB) getValueInto(idxTree *ds.AdaptiveRadixTree, key []byte, typ valueType, dst []byte,
+	deadline time.Time) ([]byte, error) {
+	ref, err := db.lookupValue(idxTree, key, typ)
+	if err != nil {
+		return nil, err
 	}
-	val, ok := rawValue.(*Value)
-	if !ok {
+	return db.readValue(ref, key, dst, deadline)
+}
+
+// valueRef locates the entry of a value found by lookupValue, its log file is held until readValue releases it.
+type valueRef struct {
+	typ    valueType
+	val    *Value
+	lf     *logfile.LogFile
+	offset int64
+}
+
+// lookupValue finds the value of key in the index tree and holds its log file from being deleted by merge,
+// so that the entry can be read by readValue after the index lock is released, which keeps a slow read from
+// blocking writes of the type. Index lock of the type must be held by the caller.
+func (db *LazyDB) lookupValue(idxTree *ds.AdaptiveRadixTree, key []byte, typ valueType) (*valueRef, error) {
+	val, ok := idxTree.Get(key).(*Value)
+	if !ok || val == nil {
 		return nil, ErrKeyNotFound
 	}
-	ts := time.Now().Unix()
-
-	if val.expiredAt != 0 && val.expiredAt < ts {
+	if val.expiredAt != 0 && val.expiredAt < db.now().UnixMilli() {
 		return nil, ErrKeyNotFound
 	}
+	// the interned value is read instead of the reference
+	fid, offset := val.fid, val.offset
+	if val.ref != nil {
+		if val.ref.pos.entrySize == 0 {
+			return nil, ErrMissingInternedValue
+		}
+		fid, offset = val.ref.pos.fid, val.ref.pos.offset
+	}
+	lf, err := db.acquireLogFile(typ, fid)
+	if err != nil {
+		return nil, err
+	}
+	return &valueRef{typ: typ, val: val, lf: lf, offset: offset}, nil
+}
+
+// readValue reads the value of key located by lookupValue and releases its log file, index lock is not required.
+// The value is appended to dst if dst is not nil.
+func (db *LazyDB) readValue(ref *valueRef, key []byte, dst []byte, deadline time.Time) ([]byte, error) {
+	defer db.releaseLogFile(ref.typ, ref.lf.Fid)
+	return db.readHeldValue(ref, key, dst, deadline)
+}
 
-	ent, err := db.readLogEntry(typ, val.fid, val.offset)
+// readHeldValue is like readValue, but the log file is not released.
+func (db *LazyDB) readHeldValue(ref *valueRef, key []byte, dst []byte, deadline time.Time) ([]byte, error) {
+	n := len(dst)
+	ent, buf, err := db.readHeldLogEntry(ref.typ, ref.lf, ref.offset, dst, deadline)
 	if err != nil {
 		return nil, err
 	}
 
 	// check if key has been deleted or expired
-	if ent.Stat == logfile.SDelete || (ent.ExpiredAt != 0 && ent.ExpiredAt < ts) {
+	if ent.Stat == logfile.SDelete || (ent.ExpiredAt != 0 && expiredAtMilli(ent.ExpiredAt) < db.now().UnixMilli()) {
 		return nil, ErrKeyNotFound
 	}
+	value := ent.Value
+	if ent.Stat == logfile.SPacked {
+		var ok bool
+		if ref.typ == valueTypeSet {
+			// members of a set are indexed by their sums
+			value, ok = packedSetMember(ent.Value, key)
+		} else {
+			_, field := db.decodeKey(key)
+			value, ok = packedHashValue(ent.Value, field)
+		}
+		if !ok {
+			return nil, ErrKeyNotFound
+		}
+	}
+	if ent.Stat == logfile.SPadded {
+		value, _ = decodePadded(ent.Value)
+	}
 
-	return ent.Value, nil
+	if dst == nil {
+		return value, nil
+	}
+	// key is read in front of value, move value over it
+	copy(buf[n:], value)
+	return buf[:n+len(value)], nil
 }
 
 func (db *LazyDB) updateIndexTree(typ valueType, idxTree *ds.AdaptiveRadixTree, entry *logfile.LogEntry, vPos *ValuePos,
@@ -142,15 +440,36 @@ func (db *LazyDB) updateIndexTree(typ valueType, idxTree *ds.AdaptiveRadixTree,
 
 	var size = vPos.entrySize
 	if typ == valueTypeString || typ == valueTypeList {
-		_, size = logfile.EncodeEntry(entry)
+		size = db.entrySize(entry)
 	}
-	idxNode := &Value{fid: vPos.fid, offset: vPos.offset, entrySize: size}
+	idxNode := &Value{vType: typ, fid: vPos.fid, offset: vPos.offset, entrySize: size, version: entry.Version,
+		writtenAt: entry.WrittenAt}
 
 	if entry.ExpiredAt != 0 {
-		idxNode.expiredAt = entry.ExpiredAt
+		idxNode.expiredAt = expiredAtMilli(entry.ExpiredAt)
+	}
+	if typ == valueTypeString {
+		idxNode.lastAccess = db.now().UnixNano()
+	}
+	// the reference is counted before the older value is released, which may reference the same value
+	if typ == valueTypeString && entry.Stat == logfile.SValueRef {
+		idxNode.ref = db.internedRef(entry.Value)
+		if sendDiscard {
+			idxNode.ref.refs++
+		}
 	}
 
 	oldVal, updated := idxTree.Put(entry.Key, idxNode)
+	if typ == valueTypeString {
+		db.replaceStrValue(entry.Key, oldVal, idxNode)
+	}
+
+	// inherit access counter of the older value
+	if db.cfg.TrackAccess && updated {
+		if old, _ := oldVal.(*Value); old != nil {
+			atomic.AddUint64(&idxNode.accessCount, atomic.LoadUint64(&old.accessCount))
+		}
+	}
 
 	if sendDiscard {
 		if err := db.sendDiscard(oldVal, updated, typ); err != nil {
@@ -160,3 +479,310 @@ func (db *LazyDB) updateIndexTree(typ valueType, idxTree *ds.AdaptiveRadixTree,
 
 	return nil
 }
+
+// ReindexFile re-scans the log file of the given type and fid, and reconciles the in-memory index with its contents.
+// Index entries which point into this file but are stale will be fixed, and entries pointing to an older file will
+// be moved to the newer position in this file. Keys that are absent from the index or superseded by a newer file
+// are left untouched, so deleted keys will never be resurrected.
+func (db *LazyDB) ReindexFile(typ valueType, fid uint32) error {
+	lf := db.getLogFile(typ, fid)
+	if lf == nil {
+		return ErrLogFileNotExist
+	}
+
+	mu := db.getIndexLock(typ)
+	mu.Lock()
+	defer mu.Unlock()
+
+	// only the latest entry of a key in this file counts
+	latest := make(map[string]*reindexEntry)
+	var order []string
+	var offset int64
+	for {
+		if err := db.pinLogFile(typ, lf); err != nil {
+			return err
+		}
+		entry, entSize, err := lf.ReadLogEntry(offset)
+		lf.Mu.RUnlock()
+		if err != nil {
+			if err == io.EOF || err == logfile.ErrLogEndOfFile {
+				break
+			}
+			return err
+		}
+		idxTree, idxKey := db.locateIndex(typ, entry)
+		if idxTree != nil && !db.txDiscarded(entry) {
+			k := util.ByteToString(entry.Key) + util.ByteToString(idxKey)
+			if _, ok := latest[k]; !ok {
+				order = append(order, k)
+			}
+			latest[k] = &reindexEntry{
+				idxTree: idxTree,
+				idxKey:  idxKey,
+				entry:   entry,
+				vPos:    &ValuePos{fid: fid, offset: offset, entrySize: entSize},
+			}
+		}
+		offset += int64(entSize)
+	}
+
+	for _, k := range order {
+		re := latest[k]
+		rawValue := re.idxTree.Get(re.idxKey)
+		if rawValue == nil {
+			continue
+		}
+		cur, _ := rawValue.(*Value)
+		// superseded by a newer log file
+		if cur == nil || cur.fid > fid {
+			continue
+		}
+		if cur.fid == fid && cur.offset == re.vPos.offset && cur.entrySize == re.vPos.entrySize {
+			continue
+		}
+		if re.entry.Stat == logfile.SDelete {
+			re.idxTree.Delete(re.idxKey)
+			if typ == valueTypeString {
+				db.replaceStrValue(re.idxKey, cur, nil)
+			}
+			if cur.ref != nil {
+				db.releaseInterned(cur.ref)
+			}
+			continue
+		}
+		val := &Value{
+			vType:      typ,
+			fid:        re.vPos.fid,
+			offset:     re.vPos.offset,
+			entrySize:  re.vPos.entrySize,
+			expiredAt:  expiredAtMilli(re.entry.ExpiredAt),
+			lastAccess: atomic.LoadInt64(&cur.lastAccess),
+			version:    re.entry.Version,
+			writtenAt:  re.entry.WrittenAt,
+		}
+		if typ == valueTypeString && re.entry.Stat == logfile.SValueRef {
+			val.ref = db.internedRef(re.entry.Value)
+			val.ref.refs++
+		}
+		if cur.ref != nil {
+			db.releaseInterned(cur.ref)
+		}
+		re.idxTree.Put(re.idxKey, val)
+		if typ == valueTypeString {
+			db.replaceStrValue(re.idxKey, cur, val)
+		}
+		if typ == valueTypeZSet {
+			db.reindexZSetScore(re.entry)
+		}
+	}
+	return nil
+}
+
+type reindexEntry struct {
+	idxTree *ds.AdaptiveRadixTree
+	idxKey  []byte
+	entry   *logfile.LogEntry
+	vPos    *ValuePos
+}
+
+// locateIndex returns the index tree and the key in it which the entry belongs to.
+// Returns nil tree if the index tree does not exist.
+// Index lock of the type must be held by the caller.
+func (db *LazyDB) locateIndex(typ valueType, entry *logfile.LogEntry) (*ds.AdaptiveRadixTree, []byte) {
+	switch typ {
+	case valueTypeString:
+		return db.strIndex.idxTree, entry.Key
+	case valueTypeHash:
+		// elements of a packed entry are not located by a single key
+		if entry.Stat == logfile.SPacked {
+			return nil, nil
+		}
+		key, _ := db.decodeKey(entry.Key)
+		return db.hashIndex.trees[util.ByteToString(key)], entry.Key
+	case valueTypeZSet:
+		if entry.Stat == logfile.SPacked {
+			return nil, nil
+		}
+		key, _ := db.decodeKey(entry.Key)
+		idx := db.zSetIndex.indexes[util.ByteToString(key)]
+		if idx == nil {
+			return nil, nil
+		}
+		return idx.tree, entry.Key
+	case valueTypeList:
+		if entry.Stat == logfile.SListMeta {
+			return db.listIndex.trees[util.ByteToString(entry.Key)], entry.Key
+		}
+		key, _ := db.decodeListKey(entry.Key)
+		return db.listIndex.trees[util.ByteToString(key)], entry.Key
+	case valueTypeSet:
+		if entry.Stat == logfile.SPacked {
+			return nil, nil
+		}
+		// the value of a delete entry is the sum of the member
+		if entry.Stat == logfile.SDelete {
+			return db.setIndex.trees[util.ByteToString(entry.Key)], entry.Value
+		}
+		if err := db.setIndex.murHash.Write(entry.Value); err != nil {
+			return nil, nil
+		}
+		sum := db.setIndex.murHash.EncodeSum128()
+		db.setIndex.murHash.Reset()
+		return db.setIndex.trees[util.ByteToString(entry.Key)], sum
+	}
+	if ct := db.getCustomType(typ); ct != nil {
+		return ct.index.idxTree, entry.Key
+	}
+	return nil, nil
+}
+
+// reindexZSetScore keeps the skiplist consistent with the score in the reindexed entry.
+func (db *LazyDB) reindexZSetScore(entry *logfile.LogEntry) {
+	key, member := db.decodeKey(entry.Key)
+	idx := db.zSetIndex.indexes[util.ByteToString(key)]
+	if idx == nil || idx.skl == nil {
+		return
+	}
+	score := util.ByteToFloat64(entry.Value)
+	for e := idx.skl.Front(); e != nil; e = e.Next() {
+		node := e.Value.(*Node)
+		if node.member != util.ByteToString(member) {
+			continue
+		}
+		if node.score == score {
+			return
+		}
+		idx.skl.Remove(e)
+		break
+	}
+	idx.skl.Insert(&Node{score: score, member: string(member)})
+}
+
+// IndexMemoryUsage estimates the bytes held by the in-memory index of each type,
+// including tree nodes, keys, index values and the per-key trees of collection types.
+// It can be used to size the host memory.
+func (db *LazyDB) IndexMemoryUsage() map[valueType]int64 {
+	usage := make(map[valueType]int64, logFileTypeNum)
+
+	db.strIndex.mu.RLock()
+	usage[valueTypeString] = treeMemoryUsage(db.strIndex.idxTree) + treeMemoryUsage(db.strIndex.ttlTree)
+	db.strIndex.mu.RUnlock()
+
+	db.collectionMemoryUsage(usage)
+	return usage
+}
+
+// MemoryUsage estimates the bytes consumed by key like MEMORY USAGE of Redis, so that bloated keys can be found.
+// It is the size of its entries in log files plus its share of the index, which for collections is the size and
+// index overhead of every element. An interned value is counted in full for each key sharing it.
+// Types are looked up in the same order as GetAny, and ErrKeyNotFound is returned if the key does not exist.
+func (db *LazyDB) MemoryUsage(key []byte) (int64, error) {
+	typ, err := db.Type(key)
+	if err != nil {
+		return 0, err
+	}
+	mu := db.getIndexLock(typ)
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var tree *ds.AdaptiveRadixTree
+	var usage int64
+	switch typ {
+	case valueTypeString:
+		val, _ := db.strIndex.idxTree.Get(key).(*Value)
+		if val == nil {
+			return 0, ErrKeyNotFound
+		}
+		usage = ds.ARTLeafSize + int64(len(key)) + indexValueSize + int64(val.entrySize)
+		if val.ref != nil {
+			usage += int64(val.ref.pos.entrySize)
+		}
+		return usage, nil
+	case valueTypeHash:
+		tree = db.hashIndex.trees[util.ByteToString(key)]
+	case valueTypeList:
+		tree = db.listIndex.trees[util.ByteToString(key)]
+	case valueTypeSet:
+		tree = db.setIndex.trees[util.ByteToString(key)]
+	case valueTypeZSet:
+		if idx := db.zSetIndex.indexes[util.ByteToString(key)]; idx != nil {
+			tree = idx.tree
+			if idx.skl != nil {
+				usage += int64(idx.skl.Len()) * zSetElementSize
+			}
+		}
+	}
+	// removed after its type was looked up
+	if tree == nil {
+		return 0, ErrKeyNotFound
+	}
+	usage += indexMapEntrySize + int64(len(key)) + treeMemoryUsage(tree)
+
+	// elements of a packed collection share an entry
+	type entryPos struct {
+		fid    uint32
+		offset int64
+	}
+	seen := make(map[entryPos]struct{})
+	iter := tree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil {
+			return 0, err
+		}
+		val, _ := node.Value().(*Value)
+		if val == nil {
+			continue
+		}
+		pos := entryPos{fid: val.fid, offset: val.offset}
+		if _, ok := seen[pos]; ok {
+			continue
+		}
+		seen[pos] = struct{}{}
+		usage += int64(val.entrySize)
+	}
+	return usage, nil
+}
+
+// collectionMemoryUsage estimates the bytes held by indexes of collection types into usage.
+func (db *LazyDB) collectionMemoryUsage(usage map[valueType]int64) {
+	treesUsage := func(trees map[string]*ds.AdaptiveRadixTree) int64 {
+		var total int64
+		for key, tree := range trees {
+			total += indexMapEntrySize + int64(len(key)) + treeMemoryUsage(tree)
+		}
+		return total
+	}
+
+	db.hashIndex.mu.RLock()
+	usage[valueTypeHash] = treesUsage(db.hashIndex.trees)
+	db.hashIndex.mu.RUnlock()
+
+	db.listIndex.mu.RLock()
+	usage[valueTypeList] = treesUsage(db.listIndex.trees)
+	db.listIndex.mu.RUnlock()
+
+	db.setIndex.mu.RLock()
+	usage[valueTypeSet] = treesUsage(db.setIndex.trees)
+	db.setIndex.mu.RUnlock()
+
+	db.zSetIndex.mu.RLock()
+	var zsetUsage int64
+	for key, idx := range db.zSetIndex.indexes {
+		zsetUsage += indexMapEntrySize + int64(len(key)) + treeMemoryUsage(idx.tree)
+		if idx.skl != nil {
+			// the member string is shared with the tree key
+			zsetUsage += int64(idx.skl.Len()) * zSetElementSize
+		}
+	}
+	usage[valueTypeZSet] = zsetUsage
+	db.zSetIndex.mu.RUnlock()
+}
+
+// treeMemoryUsage estimates the bytes held by the tree and its index values.
+func treeMemoryUsage(tree *ds.AdaptiveRadixTree) int64 {
+	if tree == nil {
+		return 0
+	}
+	return tree.MemoryUsage() + int64(tree.Size())*indexValueSize
+}
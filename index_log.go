@@ -0,0 +1,243 @@
+package lazydb
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/billsjc123/LazyDB/logfile"
+)
+
+// indexLogPrefix prefix of index logs, the index log of a log file is named after it, like "INDEX.log.strs.0000000001".
+const indexLogPrefix = "INDEX."
+
+// indexRecordHeaderSize crc32 of the payload | payload size.
+const indexRecordHeaderSize = 8
+
+// indexRecord the position and metadata of an entry written into a log file, without its value.
+// Records are appended to the index log of the log file in the order entries are written, see DBConfig.IndexLog.
+type indexRecord struct {
+	entry *logfile.LogEntry // Value is nil
+	pos   ValuePos
+}
+
+// indexLogPath returns the path of the index log of the log file of the type and fid.
+func (db *LazyDB) indexLogPath(typ valueType, fid uint32) string {
+	name, _ := logfile.FileName(logfile.FType(typ), fid)
+	return filepath.Join(db.cfg.DBPath, indexLogPrefix+name)
+}
+
+// encodeIndexRecord encodes the record of entry written at pos.
+// Format: crc32 | payload size | payload, the payload is offset | entrySize | stat | txStat | txID | expiredAt |
+// version | writtenAt | key, all but the key are varints.
+func encodeIndexRecord(entry *logfile.LogEntry, pos *ValuePos) []byte {
+	buf := make([]byte, indexRecordHeaderSize+9*binary.MaxVarintLen64+len(entry.Key))
+	n := indexRecordHeaderSize
+	n += binary.PutUvarint(buf[n:], uint64(pos.offset))
+	n += binary.PutUvarint(buf[n:], uint64(pos.entrySize))
+	n += binary.PutUvarint(buf[n:], uint64(entry.Stat))
+	n += binary.PutUvarint(buf[n:], uint64(entry.TxStat))
+	n += binary.PutUvarint(buf[n:], entry.TxID)
+	n += binary.PutVarint(buf[n:], entry.ExpiredAt)
+	n += binary.PutUvarint(buf[n:], entry.Version)
+	n += binary.PutVarint(buf[n:], entry.WrittenAt)
+	n += copy(buf[n:], entry.Key)
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(n-indexRecordHeaderSize))
+	binary.LittleEndian.PutUint32(buf[:4], crc32.ChecksumIEEE(buf[indexRecordHeaderSize:n]))
+	return buf[:n]
+}
+
+// decodeIndexRecords decodes records of the log file fid from data. It returns the records, and the size of data
+// they take up, records after a torn or broken one are ignored.
+func decodeIndexRecords(data []byte, fid uint32) ([]indexRecord, int) {
+	var records []indexRecord
+	var pos int
+	for pos+indexRecordHeaderSize <= len(data) {
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		start := pos + indexRecordHeaderSize
+		if size > len(data)-start || crc32.ChecksumIEEE(data[start:start+size]) != binary.LittleEndian.Uint32(data[pos:pos+4]) {
+			break
+		}
+		payload := data[start : start+size]
+		var fields [8]uint64
+		var n int
+		for i := range fields {
+			var k int
+			if i == 5 || i == 7 {
+				var v int64
+				v, k = binary.Varint(payload[n:])
+				fields[i] = uint64(v)
+			} else {
+				fields[i], k = binary.Uvarint(payload[n:])
+			}
+			if k <= 0 {
+				return records, pos
+			}
+			n += k
+		}
+		key := make([]byte, len(payload)-n)
+		copy(key, payload[n:])
+		entry := &logfile.LogEntry{Key: key, Stat: logfile.Status(fields[2]), TxStat: logfile.TxStatus(fields[3]),
+			TxID: fields[4], ExpiredAt: int64(fields[5]), Version: fields[6], WrittenAt: int64(fields[7])}
+		records = append(records, indexRecord{
+			entry: entry,
+			pos:   ValuePos{fid: fid, offset: int64(fields[0]), entrySize: int(fields[1])},
+		})
+		pos = start + size
+	}
+	return records, pos
+}
+
+// needsValue returns whether the index can't be built from the record of the entry without its value.
+func needsValue(stat logfile.Status) bool {
+	return stat == logfile.SPacked || stat == logfile.SValueBlob || stat == logfile.SValueRef
+}
+
+// appendIndexRecord appends the record of entry written at pos to the index log of the active log file,
+// which is opened by the first record. Lock of activeLogFile must be held by the caller.
+func (db *LazyDB) appendIndexRecord(typ valueType, activeLogFile *MutexLogFile, entry *logfile.LogEntry,
+	pos *ValuePos) error {
+	if !db.cfg.IndexLog {
+		return nil
+	}
+	if activeLogFile.indexLog == nil {
+		file, err := os.OpenFile(db.indexLogPath(typ, pos.fid), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		activeLogFile.indexLog = file
+	}
+	_, err := activeLogFile.indexLog.Write(encodeIndexRecord(entry, pos))
+	return err
+}
+
+// closeIndexLog syncs and closes the index log of the log file, when it is archived or the db is closed.
+// Records need not to be synced with entries, since the ones missing are rebuilt from the log file on opening.
+func (mlf *MutexLogFile) closeIndexLog() error {
+	if mlf.indexLog == nil {
+		return nil
+	}
+	err := mlf.indexLog.Sync()
+	if closeErr := mlf.indexLog.Close(); err == nil {
+		err = closeErr
+	}
+	mlf.indexLog = nil
+	return err
+}
+
+// removeIndexLog removes the index log of the log file, along with the log file, or when the log file is written
+// without records, so that it is replayed in full by the next opening.
+func (db *LazyDB) removeIndexLog(typ valueType, fid uint32) {
+	if !db.cfg.IndexLog || db.readOnly() {
+		return
+	}
+	if err := os.Remove(db.indexLogPath(typ, fid)); err != nil && !os.IsNotExist(err) {
+		log.Printf("remove index log err: %v", err)
+	}
+}
+
+// removeIndexLogs removes all index logs when the db is opened with DBConfig.IndexLog off,
+// since they would be stale once entries are written without records.
+func (db *LazyDB) removeIndexLogs() error {
+	if db.cfg.IndexLog || db.readOnly() {
+		return nil
+	}
+	entries, err := os.ReadDir(db.cfg.DBPath)
+	if err != nil {
+		return err
+	}
+	for _, ent := range entries {
+		if strings.HasPrefix(ent.Name(), indexLogPrefix) {
+			if err = os.Remove(filepath.Join(db.cfg.DBPath, ent.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recoverLogFile is like replayLogFile from the start of the log file, but builds the index from records of the
+// index log of the log file if DBConfig.IndexLog is on, and replays only entries written after the last record.
+// Entries whose values are needed to build the index are still read from the log file, see needsValue.
+// The index log is rebuilt from the log file if it is missing, or its last record does not match the log file,
+// e.g. the record survived a crash while the entry did not.
+func (db *LazyDB) recoverLogFile(typ valueType, logFile *logfile.LogFile,
+	fn func(*logfile.LogEntry, *ValuePos)) (int64, error) {
+	if !db.cfg.IndexLog || db.readOnly() {
+		return db.replayLogFile(typ, logFile, 0, fn)
+	}
+
+	path := db.indexLogPath(typ, logFile.Fid)
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	records, valid := decodeIndexRecords(data, logFile.Fid)
+	var end int64
+	var last *indexRecord
+	for i := range records {
+		if recEnd := records[i].pos.offset + int64(records[i].pos.entrySize); recEnd > end {
+			end, last = recEnd, &records[i]
+		}
+	}
+	if last != nil {
+		if err = db.pinLogFile(typ, logFile); err != nil {
+			return 0, err
+		}
+		_, entSize, err := logFile.ReadLogEntry(last.pos.offset)
+		logFile.Mu.RUnlock()
+		if err != nil || entSize != last.pos.entrySize {
+			records, valid, end = nil, 0, 0
+		}
+	}
+
+	for _, rec := range records {
+		entry := rec.entry
+		if needsValue(entry.Stat) {
+			if err = db.pinLogFile(typ, logFile); err != nil {
+				return 0, err
+			}
+			entry, _, err = logFile.ReadLogEntry(rec.pos.offset)
+			logFile.Mu.RUnlock()
+			// entries before the corrupted one are kept, like replayLogFile
+			if err != nil {
+				return rec.pos.offset, err
+			}
+		}
+		pos := rec.pos
+		fn(entry, &pos)
+	}
+
+	// entries written after the last record, whose records were lost by a crash
+	var missing []byte
+	offset, err := db.replayLogFile(typ, logFile, end, func(entry *logfile.LogEntry, vPos *ValuePos) {
+		missing = append(missing, encodeIndexRecord(entry, vPos)...)
+		fn(entry, vPos)
+	})
+	if valid == len(data) && len(missing) == 0 {
+		return offset, err
+	}
+	if rebuildErr := rebuildIndexLog(path, valid, missing); rebuildErr != nil {
+		log.Printf("rebuild index log %s err: %v", path, rebuildErr)
+	}
+	return offset, err
+}
+
+// rebuildIndexLog truncates the index log to its valid records, and appends the missing ones.
+func rebuildIndexLog(path string, valid int, missing []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err = file.Truncate(int64(valid)); err != nil {
+		return err
+	}
+	if _, err = file.WriteAt(missing, int64(valid)); err != nil {
+		return err
+	}
+	return file.Sync()
+}
@@ -0,0 +1,199 @@
+package lazydb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func indexLogConfig(name string) DBConfig {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, name))
+	cfg.MaxLogFileSize = 1000
+	cfg.IndexLog = true
+	return cfg
+}
+
+// dumpStrIndex returns values of keys of type String along with their positions and metadata in the index.
+func dumpStrIndex(t *testing.T, db *LazyDB) map[string]string {
+	dump := make(map[string]string)
+	iter := db.strIndex.idxTree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		assert.Nil(t, err)
+		val, err := db.Get(node.Key())
+		assert.Nil(t, err)
+		v := node.Value().(*Value)
+		dump[string(node.Key())] = fmt.Sprintf("%d %d %d %d %d %d %s", v.fid, v.offset, v.entrySize, v.expiredAt,
+			v.version, v.writtenAt, val)
+	}
+	return dump
+}
+
+func TestLazyDB_IndexLog(t *testing.T) {
+	cfg := indexLogConfig("test_index_log")
+	cfg.VersionedEntries = true
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	writeRecoveryDataset(t, db, 400)
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.SetEX(GetKey(i), GetValue(16), time.Hour))
+	}
+	fids := append([]uint32{}, db.fidsMap[valueTypeString].fids...)
+	assert.Greater(t, len(fids), 10)
+	assert.Nil(t, db.Close())
+	for _, fid := range fids {
+		_, err = os.Stat(db.indexLogPath(valueTypeString, fid))
+		assert.Nil(t, err)
+	}
+
+	// indexes built from index logs match the ones built by replaying log files
+	var fromIndexLog map[string]string
+	var fromIndexLogHashes map[string]string
+	for _, concurrency := range []int{0, 8} {
+		cfg.RecoveryConcurrency = concurrency
+		db, err = Open(cfg)
+		assert.Nil(t, err)
+		fromIndexLog = dumpStrIndex(t, db)
+		fromIndexLogHashes = make(map[string]string)
+		for i := 0; i < 10; i++ {
+			pairs, err := db.HGetAll(GetKey(i))
+			assert.Nil(t, err)
+			for k := 0; k < len(pairs); k += 2 {
+				fromIndexLogHashes[string(GetKey(i))+string(pairs[k])] = string(pairs[k+1])
+			}
+		}
+		assert.Nil(t, db.Close())
+	}
+	cfg.IndexLog = false
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, fromIndexLog, dumpStrIndex(t, db))
+	for i := 0; i < 10; i++ {
+		pairs, err := db.HGetAll(GetKey(i))
+		assert.Nil(t, err)
+		for k := 0; k < len(pairs); k += 2 {
+			assert.Equal(t, fromIndexLogHashes[string(GetKey(i))+string(pairs[k])], string(pairs[k+1]))
+		}
+	}
+	assert.Nil(t, db.Close())
+
+	// index logs are removed once the db is opened without them, and rebuilt by opening with them
+	_, err = os.Stat(db.indexLogPath(valueTypeString, fids[0]))
+	assert.True(t, os.IsNotExist(err))
+	cfg.IndexLog = true
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	_, err = os.Stat(db.indexLogPath(valueTypeString, fids[0]))
+	assert.Nil(t, err)
+	assert.Equal(t, fromIndexLog, dumpStrIndex(t, db))
+}
+
+func TestLazyDB_IndexLogCrash(t *testing.T) {
+	cfg := indexLogConfig("test_index_log_crash")
+	cfg.MaxLogFileSize = 1 << 20
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue(16)))
+	}
+	want := dumpStrIndex(t, db)
+	lf := db.getActiveLogFile(valueTypeString).lf
+	path := db.indexLogPath(valueTypeString, lf.Fid)
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+
+	// records of the latest entries are lost by a crash, they are replayed from the log file and rebuilt
+	assert.Nil(t, os.Truncate(path, info.Size()/2+3))
+	crashed := db
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, want, dumpStrIndex(t, db))
+	rebuilt, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, info.Size(), rebuilt.Size())
+	assert.Nil(t, crashed.Close())
+
+	// a record survives a crash while its entry does not
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	lost := &logfile.LogEntry{Key: GetKey(0), Value: GetValue(16)}
+	_, err = file.Write(encodeIndexRecord(lost, &ValuePos{fid: lf.Fid, offset: lf.Offset, entrySize: 40}))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	crashed = db
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, want, dumpStrIndex(t, db))
+	rebuilt, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, info.Size(), rebuilt.Size())
+	assert.Nil(t, crashed.Close())
+}
+
+func TestLazyDB_IndexLogMerge(t *testing.T) {
+	cfg := indexLogConfig("test_index_log_merge")
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue(16)))
+	}
+	fid := db.fidsMap[valueTypeString].fids[0]
+	for i := 0; i < 40; i++ {
+		assert.Nil(t, db.Set(GetKey(i%5), GetValue(16)))
+	}
+	assert.Nil(t, db.Merge(valueTypeString, fid, -1))
+
+	// the index log is removed along with the merged log file, live entries are recorded again where they are rewritten
+	_, err = os.Stat(db.indexLogPath(valueTypeString, fid))
+	assert.True(t, os.IsNotExist(err))
+	want := dumpStrIndex(t, db)
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, want, dumpStrIndex(t, db))
+}
+
+func BenchmarkLazyDB_RecoveryIndexLog(b *testing.B) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "bench_recovery_index_log")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 4 << 20
+	cfg.IndexLog = true
+	cfg.DiscardBufferSize = 1024
+	db, err := Open(cfg)
+	assert.Nil(b, err)
+	defer os.RemoveAll(path)
+	value := GetValue(1024)
+	for i := 0; i < 20000; i++ {
+		assert.Nil(b, db.Set(GetKey(i), value))
+	}
+	assert.Nil(b, db.Close())
+
+	// opening without index logs removes them, so it goes last
+	for _, indexLog := range []bool{true, false} {
+		name := "replay"
+		if indexLog {
+			name = "index-log"
+		}
+		b.Run(name, func(b *testing.B) {
+			cfg.IndexLog = indexLog
+			for i := 0; i < b.N; i++ {
+				db, err := Open(cfg)
+				assert.Nil(b, err)
+				assert.Nil(b, db.Close())
+			}
+		})
+	}
+}
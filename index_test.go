@@ -1,6 +1,8 @@
 package lazydb
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/billsjc123/LazyDB/ds"
 	"github.com/billsjc123/LazyDB/logfile"
 	"github.com/billsjc123/LazyDB/util"
@@ -8,6 +10,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -58,3 +61,514 @@ func TestLazyDB_buildIndexFromLogFiles(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, true, reflect.DeepEqual(got, val3))
 }
+
+func TestLazyDB_ReindexFile(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_reindex_file")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 150 //  set max file so that it can only contain 2 entry in a file
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	val1 := GetValue32()
+	val2 := GetValue32()
+	val3 := GetValue32()
+	assert.Nil(t, db.Set(GetKey(1), val1)) // fid 1
+	assert.Nil(t, db.Set(GetKey(2), val2)) // fid 1
+	assert.Nil(t, db.Set(GetKey(1), val3)) // fid 2, supersedes key 1 in fid 1
+
+	// corrupt the index pointer of key 2 in fid 1
+	node := db.strIndex.idxTree.Get(GetKey(2)).(*Value)
+	assert.Equal(t, uint32(1), node.fid)
+	node.offset = 0
+	got, err := db.Get(GetKey(2))
+	assert.Nil(t, err)
+	assert.NotEqual(t, val2, got)
+
+	err = db.ReindexFile(valueTypeString, 1)
+	assert.Nil(t, err)
+
+	got, err = db.Get(GetKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, val2, got)
+
+	// newer value of key 1 must not be overwritten by the one in fid 1
+	got, err = db.Get(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, val3, got)
+
+	// deleted key must not be resurrected
+	assert.Nil(t, db.Delete(GetKey(2)))
+	err = db.ReindexFile(valueTypeString, 1)
+	assert.Nil(t, err)
+	_, err = db.Get(GetKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	err = db.ReindexFile(valueTypeString, 100)
+	assert.Equal(t, ErrLogFileNotExist, err)
+}
+
+func TestLazyDB_IndexMemoryUsage(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+
+	usage := db.IndexMemoryUsage()
+	assert.Equal(t, int64(0), usage[valueTypeString])
+	assert.Equal(t, int64(0), usage[valueTypeHash])
+
+	var strUsages, hashUsages []int64
+	for batch := 1; batch <= 3; batch++ {
+		for i := (batch - 1) * 1000; i < batch*1000; i++ {
+			assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+			assert.Nil(t, db.HSet(GetKey(i%10), GetKey(i), GetValue32()))
+		}
+		usage = db.IndexMemoryUsage()
+		strUsages = append(strUsages, usage[valueTypeString])
+		hashUsages = append(hashUsages, usage[valueTypeHash])
+	}
+
+	// the estimate grows roughly linearly as keys are added
+	for _, usages := range [][]int64{strUsages, hashUsages} {
+		assert.Greater(t, usages[0], int64(1000*(ds.ARTLeafSize+indexValueSize)))
+		assert.InDelta(t, 2*usages[0], usages[1], float64(usages[0])/5)
+		assert.InDelta(t, 3*usages[0], usages[2], float64(usages[0])/5)
+	}
+}
+
+func TestLazyDB_MemoryUsage(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+
+	_, err := db.MemoryUsage([]byte("missing"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.Nil(t, db.Set([]byte("small"), []byte("v")))
+	assert.Nil(t, db.Set([]byte("large"), make([]byte, 4096)))
+	small, err := db.MemoryUsage([]byte("small"))
+	assert.Nil(t, err)
+	large, err := db.MemoryUsage([]byte("large"))
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, large-small, int64(4096))
+
+	// usage of a hash scales with its fields
+	var usages []int64
+	for batch := 1; batch <= 3; batch++ {
+		for i := (batch - 1) * 100; i < batch*100; i++ {
+			assert.Nil(t, db.HSet([]byte("hash"), GetKey(i), GetValue32()))
+		}
+		usage, err := db.MemoryUsage([]byte("hash"))
+		assert.Nil(t, err)
+		usages = append(usages, usage)
+	}
+	assert.Greater(t, usages[0], int64(100*(32+indexValueSize)))
+	assert.InDelta(t, 2*usages[0], usages[1], float64(usages[0])/5)
+	assert.InDelta(t, 3*usages[0], usages[2], float64(usages[0])/5)
+}
+
+func TestValue_String(t *testing.T) {
+	v := &Value{vType: valueTypeHash, fid: 3, offset: 150, entrySize: 75, accessCount: 2}
+	assert.Equal(t, "Value{type=hash fid=3 offset=150 entrySize=75 expiredAt=0 ttl=none accessCount=2}", v.String())
+
+	v.expiredAt = time.Now().Add(time.Hour).UnixMilli()
+	assert.Contains(t, v.String(), fmt.Sprintf("expiredAt=%d ttl=59m59.", v.expiredAt))
+
+	v = nil
+	assert.Equal(t, "Value<nil>", v.String())
+
+	// values in the index know their type
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.Nil(t, db.Set([]byte("str"), []byte("v")))
+	assert.Nil(t, db.HSet([]byte("hash"), []byte("f"), []byte("v")))
+	v, _ = db.strIndex.idxTree.Get([]byte("str")).(*Value)
+	assert.Contains(t, v.String(), "Value{type=string ")
+	iter := db.hashIndex.trees["hash"].Iterator()
+	assert.True(t, iter.HasNext())
+	node, err := iter.Next()
+	assert.Nil(t, err)
+	v, _ = node.Value().(*Value)
+	assert.Contains(t, v.String(), "Value{type=hash ")
+}
+
+// writeRecoveryDataset writes keys of type String and Hash into many log files, with overwrites and deletes.
+func writeRecoveryDataset(t testing.TB, db *LazyDB, n int) {
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set(GetKey(i%(n/4)), GetValue32()))
+		assert.Nil(t, db.HSet(GetKey(i%10), GetKey(i%(n/4)), GetValue32()))
+		if i%7 == 0 {
+			assert.Nil(t, db.Delete(GetKey(i%(n/4))))
+			_, err := db.HDel(GetKey(i%10), GetKey(i%(n/4)))
+			assert.Nil(t, err)
+		}
+	}
+}
+
+func TestLazyDB_RecoveryConcurrency(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_recovery_concurrency")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 1000
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+	writeRecoveryDataset(t, db, 400)
+	assert.Nil(t, db.Close())
+
+	dump := func(db *LazyDB) (map[string][]byte, map[string]map[string][]byte) {
+		strs := make(map[string][]byte)
+		for i := 0; i < 100; i++ {
+			if val, err := db.Get(GetKey(i)); err == nil {
+				strs[string(GetKey(i))] = val
+			}
+		}
+		hashes := make(map[string]map[string][]byte)
+		for i := 0; i < 10; i++ {
+			hashes[string(GetKey(i))] = make(map[string][]byte)
+			for j := 0; j < 100; j++ {
+				if val, err := db.HGet(GetKey(i), GetKey(j)); err == nil {
+					hashes[string(GetKey(i))][string(GetKey(j))] = val
+				}
+			}
+		}
+		return strs, hashes
+	}
+
+	cfg.RecoveryConcurrency = 1
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Greater(t, len(db.fidsMap[valueTypeString].fids), 10)
+	wantStrs, wantHashes := dump(db)
+	assert.NotEmpty(t, wantStrs)
+	assert.Nil(t, db.Close())
+
+	for _, concurrency := range []int{0, 8} {
+		cfg.RecoveryConcurrency = concurrency
+		db, err = Open(cfg)
+		assert.Nil(t, err)
+		strs, hashes := dump(db)
+		assert.Equal(t, wantStrs, strs)
+		assert.Equal(t, wantHashes, hashes)
+		assert.Nil(t, db.Close())
+	}
+
+	// new entries are appended after recovered entries
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Set(GetKey(1), []byte("new")))
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	val, err := db.Get(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), val)
+}
+
+func BenchmarkLazyDB_Recovery(b *testing.B) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "bench_recovery")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 1 << 20
+	db, err := Open(cfg)
+	assert.Nil(b, err)
+	defer os.RemoveAll(path)
+	writeRecoveryDataset(b, db, 100000)
+	assert.Nil(b, db.Close())
+
+	// do not let allocating discard channels dominate
+	cfg.DiscardBufferSize = 1024
+
+	for _, concurrency := range []int{1, 8} {
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			cfg.RecoveryConcurrency = concurrency
+			for i := 0; i < b.N; i++ {
+				db, err := Open(cfg)
+				assert.Nil(b, err)
+				assert.Nil(b, db.Close())
+			}
+		})
+	}
+
+	// only the tail after the checkpoint is replayed
+	cfg.RecoveryConcurrency = 0
+	cfg.CheckpointInterval = time.Hour
+	db, err = Open(cfg)
+	assert.Nil(b, err)
+	assert.Nil(b, db.saveCheckpoints())
+	assert.Nil(b, db.Close())
+	b.Run("checkpoint", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			db, err := Open(cfg)
+			assert.Nil(b, err)
+			assert.Nil(b, db.Close())
+		}
+	})
+}
+
+func TestLazyDB_CheckpointInterval(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_checkpoint_interval")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 1000
+	cfg.CheckpointInterval = 10 * time.Millisecond
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+	dump := func(db *LazyDB) string {
+		var buf bytes.Buffer
+		assert.Nil(t, db.DumpAll(&buf))
+		return buf.String()
+	}
+
+	// saved periodically
+	writeRecoveryDataset(t, db, 400)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(db.checkpointPath(valueTypeHash))
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, db.Close())
+
+	// the tail written after the checkpoint spans the last checkpointed log file and new ones
+	cfg.CheckpointInterval = time.Hour
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, db.saveCheckpoints())
+	fids := db.fidsMap[valueTypeString].fids
+	for i := 0; i < 40; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+		assert.Nil(t, db.HSet(GetKey(i%10), GetKey(i), GetValue32()))
+		if i%3 == 0 {
+			assert.Nil(t, db.Delete(GetKey(i+50)))
+			_, err = db.HDel(GetKey(i%10), GetKey(i+50))
+			assert.Nil(t, err)
+		}
+	}
+	assert.Greater(t, len(db.fidsMap[valueTypeString].fids), len(fids))
+	want := dump(db)
+	assert.Nil(t, db.Close())
+
+	defer func() {
+		afterReplayHook = nil
+	}()
+	var replayed []uint32
+	afterReplayHook = func(typ valueType, fid uint32) {
+		if typ == valueTypeString {
+			replayed = append(replayed, fid)
+		}
+	}
+	for _, concurrency := range []int{0, 8} {
+		replayed = nil
+		cfg.RecoveryConcurrency = concurrency
+		db, err = Open(cfg)
+		assert.Nil(t, err)
+		// log files covered by the checkpoint are not replayed from the start
+		for _, fid := range replayed {
+			assert.Greater(t, fid, fids[len(fids)-1])
+		}
+		assert.Equal(t, want, dump(db))
+		assert.Nil(t, db.Close())
+	}
+
+	// the same as replaying all log files
+	cfg.CheckpointInterval = 0
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	_, err = os.Stat(db.checkpointPath(valueTypeString))
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, db.Close())
+	replayed = nil
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, fids[0], replayed[0])
+	assert.Equal(t, want, dump(db))
+}
+
+func TestLazyDB_Reload(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+
+	values := make([][]byte, 3)
+	for i := range values {
+		values[i] = GetValue32()
+		assert.Nil(t, db.Set(GetKey(i), values[i]))
+	}
+	assert.Nil(t, db.HSet([]byte("hash"), []byte("field"), []byte("value")))
+
+	// corrupt the index
+	db.strIndex.idxTree.Delete(GetKey(0))
+	node := db.strIndex.idxTree.Get(GetKey(2)).(*Value)
+	db.strIndex.idxTree.Put(GetKey(1), &Value{fid: node.fid, offset: node.offset, entrySize: node.entrySize})
+	db.strIndex.idxTree.Put(GetKey(3), &Value{fid: node.fid, offset: node.offset, entrySize: node.entrySize})
+	delete(db.hashIndex.trees, "hash")
+
+	assert.Nil(t, db.Reload())
+
+	assert.Equal(t, 3, db.strIndex.idxTree.Size())
+	for i := range values {
+		val, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+	}
+	_, err := db.Get(GetKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db.HGet([]byte("hash"), []byte("field"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+
+	// still writable after reloading
+	assert.Nil(t, db.Set(GetKey(3), values[0]))
+	val, err = db.Get(GetKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, values[0], val)
+}
+
+func TestLazyDB_RecoveryFilter(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_recovery_filter"))
+	cfg.MaxLogFileSize = 500
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	n := 20
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("user:%d", i)), GetKey(i)))
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("order:%d", i)), GetKey(i)))
+	}
+	assert.Nil(t, db.Delete([]byte("user:0")))
+	assert.Nil(t, db.HSet([]byte("user:hash"), []byte("field"), []byte("value")))
+	assert.Nil(t, db.HSet([]byte("order:hash"), []byte("field"), []byte("value")))
+	assert.Nil(t, db.Close())
+
+	cfg.RecoveryFilter = func(key []byte, typ valueType) bool {
+		return bytes.HasPrefix(key, []byte("user:"))
+	}
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, n-1, db.strIndex.idxTree.Size())
+	_, err = db.Get([]byte("user:0"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	for i := 1; i < n; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("user:%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, GetKey(i), val)
+		_, err = db.Get([]byte(fmt.Sprintf("order:%d", i)))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	val, err := db.HGet([]byte("user:hash"), []byte("field"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+	val, err = db.HGet([]byte("order:hash"), []byte("field"))
+	assert.Nil(t, err)
+	assert.Nil(t, val)
+
+	// log files are not rewritten, since skipped keys would be dropped
+	typ := valueTypeString
+	fid := db.fidsMap[typ].fids[0]
+	assert.Equal(t, ErrPartialIndex, db.Merge(typ, fid, 0))
+	assert.Equal(t, ErrPartialIndex, db.CompactActive(typ))
+	assert.Nil(t, db.Close())
+
+	// skipped keys remain on disk
+	cfg.RecoveryFilter = nil
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	for i := 0; i < n; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("order:%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, GetKey(i), val)
+	}
+	val, err = db.HGet([]byte("order:hash"), []byte("field"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+}
+
+func TestLazyDB_RecoveryCheckpoint(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_recovery_checkpoint")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 1000
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+	writeRecoveryDataset(t, db, 400)
+	assert.Nil(t, db.Close())
+
+	dump := func(db *LazyDB) (map[string][]byte, map[string][]byte) {
+		strs, hashes := make(map[string][]byte), make(map[string][]byte)
+		for i := 0; i < 100; i++ {
+			if val, err := db.Get(GetKey(i)); err == nil {
+				strs[string(GetKey(i))] = val
+			}
+			if val, err := db.HGet(GetKey(i%10), GetKey(i)); err == nil {
+				hashes[string(GetKey(i))] = val
+			}
+		}
+		return strs, hashes
+	}
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	fids := db.fidsMap[valueTypeString].fids
+	assert.Greater(t, len(fids), 5)
+	wantStrs, wantHashes := dump(db)
+	assert.Nil(t, db.Close())
+
+	// crash right after the checkpoint of the third log file is written
+	crashFid := fids[2]
+	checkpoint := filepath.Join(path, "checkpoint.bak")
+	defer func() {
+		afterReplayHook = nil
+	}()
+	afterReplayHook = func(typ valueType, fid uint32) {
+		if typ == valueTypeString && fid == crashFid {
+			data, err := os.ReadFile(db.checkpointPath(valueTypeString))
+			assert.Nil(t, err)
+			assert.Nil(t, os.WriteFile(checkpoint, data, 0644))
+		}
+	}
+	cfg.RecoveryCheckpointInterval = 1
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	// checkpoints are removed once recovery finishes
+	_, err = os.Stat(db.checkpointPath(valueTypeString))
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, db.Close())
+
+	// the next open resumes from the checkpoint
+	assert.Nil(t, os.Rename(checkpoint, db.checkpointPath(valueTypeString)))
+	for _, concurrency := range []int{0, 8} {
+		var replayed []uint32
+		afterReplayHook = func(typ valueType, fid uint32) {
+			if typ == valueTypeString {
+				replayed = append(replayed, fid)
+			}
+		}
+		cfg.RecoveryConcurrency = concurrency
+		db, err = Open(cfg)
+		assert.Nil(t, err)
+		if concurrency == 0 {
+			assert.Equal(t, fids[3:len(fids)-1], replayed)
+		} else {
+			// the checkpoint has been removed
+			assert.Equal(t, fids[:len(fids)-1], replayed)
+		}
+		strs, hashes := dump(db)
+		assert.Equal(t, wantStrs, strs)
+		assert.Equal(t, wantHashes, hashes)
+		assert.Nil(t, db.Close())
+	}
+
+	// broken checkpoints are ignored
+	assert.Nil(t, os.WriteFile(db.checkpointPath(valueTypeString), []byte("broken"), 0644))
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	strs, hashes := dump(db)
+	assert.Equal(t, wantStrs, strs)
+	assert.Equal(t, wantHashes, hashes)
+}
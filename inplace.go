@@ -0,0 +1,198 @@
+package lazydb
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/billsjc123/LazyDB/logfile"
+)
+
+// inPlaceJournalFileName the file of the entry being overwritten in place, see DBConfig.InPlaceUpdates.
+const inPlaceJournalFileName = "INPLACE"
+
+// inPlaceHeaderSize Fid | Offset | Size, followed by the entry and crc32 of them.
+const inPlaceHeaderSize = 4 + 8 + 4
+
+// overwriteHook is called before an entry is overwritten in place, the overwrite is given up if it returns an error.
+// It is only set by tests to simulate a crash while overwriting.
+var overwriteHook func(lf *logfile.LogFile, offset int64, buf []byte) error
+
+// inPlaceJournal the journal of entries overwritten in place. The new entry is recorded and synced before it
+// overwrites the older one, and the journal is cleared once it is done. An overwrite interrupted by a crash leaves
+// an entry failing its check sum, which is redone from the journal on opening.
+type inPlaceJournal struct {
+	path string
+	file *os.File // opened by the first overwrite
+}
+
+// loadInPlaceJournal redoes the overwrite left in the journal by a crash. The journal is checked even if
+// DBConfig.InPlaceUpdates is off, since it may be turned off after a crash, and padded values are overwritten anyway.
+func (db *LazyDB) loadInPlaceJournal() error {
+	db.inPlace.path = filepath.Join(db.cfg.DBPath, inPlaceJournalFileName)
+	data, err := os.ReadFile(db.inPlace.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if err = db.redoOverwrite(data); err != nil {
+		return err
+	}
+	return os.Truncate(db.inPlace.path, 0)
+}
+
+// redoOverwrite overwrites the entry recorded in data again if the entry in the log file fails its check sum.
+// A torn record is ignored, since the entry is only overwritten after the record is synced.
+func (db *LazyDB) redoOverwrite(data []byte) error {
+	if len(data) < inPlaceHeaderSize+4 {
+		return nil
+	}
+	size := int(binary.LittleEndian.Uint32(data[12:16]))
+	if len(data) != inPlaceHeaderSize+size+4 ||
+		crc32.ChecksumIEEE(data[:inPlaceHeaderSize+size]) != binary.LittleEndian.Uint32(data[inPlaceHeaderSize+size:]) {
+		return nil
+	}
+	fid := binary.LittleEndian.Uint32(data[:4])
+	offset := int64(binary.LittleEndian.Uint64(data[4:12]))
+	// the index record of the overwrite may be missing, so the log file is replayed in full instead
+	db.removeIndexLog(valueTypeString, fid)
+	// the log file may have been removed by merge
+	lf := db.getLogFile(valueTypeString, fid)
+	if lf == nil {
+		return nil
+	}
+	if _, _, err := lf.ReadLogEntry(offset); err == nil {
+		return nil
+	}
+	if err := lf.WriteAt(data[inPlaceHeaderSize:inPlaceHeaderSize+size], offset); err != nil {
+		return err
+	}
+	return lf.Sync()
+}
+
+// record records the entry buf overwriting the one at offset of log file fid, and syncs it.
+func (j *inPlaceJournal) record(fid uint32, offset int64, buf []byte) error {
+	rec := make([]byte, inPlaceHeaderSize+len(buf)+4)
+	binary.LittleEndian.PutUint32(rec[:4], fid)
+	binary.LittleEndian.PutUint64(rec[4:12], uint64(offset))
+	binary.LittleEndian.PutUint32(rec[12:16], uint32(len(buf)))
+	copy(rec[inPlaceHeaderSize:], buf)
+	binary.LittleEndian.PutUint32(rec[inPlaceHeaderSize+len(buf):], crc32.ChecksumIEEE(rec[:inPlaceHeaderSize+len(buf)]))
+	if j.file == nil {
+		file, err := os.OpenFile(j.path, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		j.file = file
+	}
+	if _, err := j.file.WriteAt(rec, 0); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// clear clears the journal once the overwrite is done, it is not synced since redoing a finished one does nothing.
+func (j *inPlaceJournal) clear() error {
+	return j.file.Truncate(0)
+}
+
+func (j *inPlaceJournal) close() error {
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// writeStrEntry writes the entry of type String, overwriting the older entry of its key in place if possible,
+// see DBConfig.InPlaceUpdates. It returns whether the entry is overwritten in place, the older entry is still live
+// then. Lock of strIndex must be held by the caller.
+func (db *LazyDB) writeStrEntry(entry *logfile.LogEntry, deadline time.Time) (*ValuePos, bool, error) {
+	if valuePos, err := db.overwriteInPlace(entry, deadline); valuePos != nil || err != nil {
+		return valuePos, valuePos != nil, err
+	}
+	valuePos, err := db.writeLogEntryWithDeadline(valueTypeString, entry, deadline)
+	return valuePos, false, err
+}
+
+// overwriteInPlace overwrites the older entry of the key with entry if both have no time to live, the older one is
+// in the active log file, and they have the same size. Padded values are overwritten even if DBConfig.InPlaceUpdates
+// is off, see SetWithCapacity. It returns nil if the entry is not overwritten in place.
+// Nothing is overwritten while a snapshot is open, since it may still read the older entry.
+// The active log file loses its footer, since the check sum of its entries changes.
+func (db *LazyDB) overwriteInPlace(entry *logfile.LogEntry, deadline time.Time) (*ValuePos, error) {
+	if !db.cfg.InPlaceUpdates && entry.Stat != logfile.SPadded {
+		return nil, nil
+	}
+	// a snapshot is taken with the read lock of strIndex, whose write lock is held here
+	if atomic.LoadInt32(&db.snapshots) > 0 {
+		return nil, nil
+	}
+	if db.readOnly() || db.valueCache != nil || db.cfg.InternValues || entry.ExpiredAt != 0 {
+		return nil, nil
+	}
+	idxNode, _ := db.strIndex.idxTree.Get(entry.Key).(*Value)
+	if idxNode == nil || idxNode.ref != nil || idxNode.expiredAt != 0 {
+		return nil, nil
+	}
+	if err := db.checkKeySize(entry); err != nil {
+		return nil, err
+	}
+	activeLogFile := db.getActiveLogFile(valueTypeString)
+	if activeLogFile == nil {
+		return nil, ErrOpenLogFile
+	}
+	if err := lockWithDeadline(&activeLogFile.mu, deadline); err != nil {
+		return nil, err
+	}
+	defer activeLogFile.mu.Unlock()
+
+	lf := activeLogFile.lf
+	if idxNode.fid != lf.Fid {
+		return nil, nil
+	}
+	// the entry keeps its version and timestamp if it is appended instead
+	db.stampVersion(entry)
+	db.stampWrittenAt(entry)
+	entBuf, entSize := db.encodeEntry(entry)
+	if entSize != idxNode.entrySize {
+		return nil, nil
+	}
+
+	if err := db.inPlace.record(lf.Fid, idxNode.offset, entBuf); err != nil {
+		return nil, err
+	}
+	if overwriteHook != nil {
+		if err := overwriteHook(lf, idxNode.offset, entBuf); err != nil {
+			return nil, err
+		}
+	}
+	// readers hold the read lock of the log file while reading it
+	lf.Mu.Lock()
+	err := lf.WriteAt(entBuf, idxNode.offset)
+	lf.Mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err = db.inPlace.clear(); err != nil {
+		return nil, err
+	}
+	activeLogFile.footer = nil
+	db.recordWrite(entSize)
+	valuePos := &ValuePos{fid: lf.Fid, offset: idxNode.offset, entrySize: entSize}
+	if err = db.appendIndexRecord(valueTypeString, activeLogFile, entry, valuePos); err != nil {
+		return nil, err
+	}
+	if db.cfg.IndexUpdateMode == IndexUpdateAfterSync {
+		if err = syncWithDeadline(lf, deadline); err != nil {
+			return nil, err
+		}
+	}
+	return valuePos, nil
+}
@@ -0,0 +1,135 @@
+package lazydb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func initInPlaceDB(name string) (*LazyDB, DBConfig, error) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, name))
+	cfg.InPlaceUpdates = true
+	db, err := Open(cfg)
+	return db, cfg, err
+}
+
+func TestLazyDB_InPlaceUpdates(t *testing.T) {
+	db, cfg, err := initInPlaceDB("test_in_place_updates")
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	activeOffset := func() int64 {
+		return db.getActiveLogFile(valueTypeString).lf.Offset
+	}
+	assert.Nil(t, db.Set(GetKey(0), []byte("value-1")))
+	assert.Nil(t, db.Set(GetKey(1), []byte("other")))
+	offset := activeOffset()
+
+	// values of the same size overwrite the entry
+	assert.Nil(t, db.Set(GetKey(0), []byte("value-2")))
+	assert.Equal(t, offset, activeOffset())
+	val, err := db.Get(GetKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-2"), val)
+
+	// counters of the same width too
+	assert.Nil(t, db.Set(GetKey(2), []byte("10")))
+	offset = activeOffset()
+	for i := 0; i < 80; i++ {
+		_, err = db.Incr(GetKey(2))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, offset, activeOffset())
+
+	// a value of another size or with time to live is appended
+	assert.Nil(t, db.Set(GetKey(0), []byte("value-10")))
+	assert.Greater(t, activeOffset(), offset)
+	offset = activeOffset()
+	assert.Nil(t, db.SetEX(GetKey(1), []byte("valu2"), time.Hour))
+	assert.Greater(t, activeOffset(), offset)
+
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	for key, want := range map[int]string{0: "value-10", 1: "valu2", 2: "90"} {
+		val, err = db.Get(GetKey(key))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(want), val)
+	}
+}
+
+func TestLazyDB_InPlaceUpdatesCrash(t *testing.T) {
+	db, cfg, err := initInPlaceDB("test_in_place_updates_crash")
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, db.Set(GetKey(i), []byte("value-1")))
+	}
+	assert.Nil(t, db.Sync())
+
+	// a crash in the middle of overwriting leaves a torn entry
+	defer func() {
+		overwriteHook = nil
+	}()
+	errCrash := errors.New("crash")
+	overwriteHook = func(lf *logfile.LogFile, offset int64, buf []byte) error {
+		assert.Nil(t, lf.WriteAt(buf[:len(buf)/2], offset))
+		return errCrash
+	}
+	assert.Equal(t, errCrash, db.Set(GetKey(1), []byte("value-2")))
+	overwriteHook = nil
+	lf := db.getActiveLogFile(valueTypeString).lf
+	idxNode := db.strIndex.idxTree.Get(GetKey(1)).(*Value)
+	_, _, err = lf.ReadLogEntry(idxNode.offset)
+	assert.Equal(t, logfile.ErrInvalidCrc, err)
+
+	// the overwrite is redone on opening
+	crashed := db
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	for i, want := range []string{"value-1", "value-2", "value-1"} {
+		val, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(want), val)
+	}
+	info, err := os.Stat(filepath.Join(cfg.DBPath, inPlaceJournalFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size())
+	assert.Nil(t, crashed.Close())
+}
+
+func BenchmarkLazyDB_SetSameSize(b *testing.B) {
+	for _, inPlace := range []bool{false, true} {
+		name := "append"
+		if inPlace {
+			name = "in-place"
+		}
+		b.Run(name, func(b *testing.B) {
+			db, _, err := initInPlaceDB("bench_set_same_size")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer destroyDB(db)
+			db.cfg.InPlaceUpdates = inPlace
+			key, value := GetKey(0), GetValue(64)
+
+			b.ResetTimer()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				value[0] = byte(i)
+				if err := db.Set(key, value); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(db.getActiveLogFile(valueTypeString).lf.Offset)/float64(b.N), "logbytes/op")
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package lazydb
+
+import (
+	"crypto/sha256"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/billsjc123/LazyDB/util"
+)
+
+// internMinValueSize values smaller than it are not interned, since a reference to them saves little.
+const internMinValueSize = 64
+
+// ErrMissingInternedValue the value referenced by the key has not been found in log files.
+var ErrMissingInternedValue = errors.New("interned value is missing")
+
+// internedValue a value of type String stored once and shared by keys referencing it, see DBConfig.InternValues.
+// It is guarded by the lock of strIndex.
+type internedValue struct {
+	hash []byte
+	pos  ValuePos // position of the blob entry, entrySize is 0 if it has not been found
+	refs int      // number of keys in the index referencing it
+}
+
+// internable returns whether the value is written as a reference to an interned value.
+func (db *LazyDB) internable(value []byte) bool {
+	return db.cfg.InternValues && len(value) >= internMinValueSize
+}
+
+// writeInterned writes the value of key as a reference to the interned value, the value itself is written
+// only if it is not interned yet. It returns the reference entry and its position.
+// Lock of strIndex must be held by the caller.
+func (db *LazyDB) writeInterned(key, value []byte, expiredAt int64, deadline time.Time) (*logfile.LogEntry, *ValuePos, error) {
+	sum := sha256.Sum256(value)
+	hash := sum[:]
+	iv := db.internedRef(hash)
+	if iv.pos.entrySize == 0 {
+		blob := &logfile.LogEntry{Key: hash, Value: value, Stat: logfile.SValueBlob}
+		pos, err := db.writeLogEntryWithDeadline(valueTypeString, blob, deadline)
+		if err != nil {
+			if iv.refs == 0 {
+				db.releaseInterned(iv)
+			}
+			return nil, nil, err
+		}
+		iv.pos = *pos
+	}
+
+	entry := &logfile.LogEntry{Key: key, Value: hash, Stat: logfile.SValueRef, ExpiredAt: expiredAt}
+	pos, err := db.writeLogEntryWithDeadline(valueTypeString, entry, deadline)
+	if err != nil {
+		// the value written just now is reclaimed by merge
+		if iv.refs == 0 {
+			db.releaseInterned(iv)
+		}
+		return nil, nil, err
+	}
+	return entry, pos, nil
+}
+
+// internedRef returns the interned value of hash, it is added without references if it does not exist.
+// Lock of strIndex must be held by the caller.
+func (db *LazyDB) internedRef(hash []byte) *internedValue {
+	iv := db.strIndex.interned[util.ByteToString(hash)]
+	if iv == nil {
+		iv = &internedValue{hash: append([]byte(nil), hash...)}
+		db.strIndex.interned[string(iv.hash)] = iv
+	}
+	return iv
+}
+
+// releaseInterned drops a reference to the interned value, the value is discarded once no key references it,
+// or if it has no references at all.
+// Lock of strIndex must be held by the caller.
+func (db *LazyDB) releaseInterned(iv *internedValue) {
+	if iv.refs > 0 {
+		iv.refs--
+	}
+	if iv.refs > 0 {
+		return
+	}
+	// it may have been replaced by the value written again
+	if db.strIndex.interned[util.ByteToString(iv.hash)] == iv {
+		delete(db.strIndex.interned, util.ByteToString(iv.hash))
+	}
+	if iv.pos.entrySize > 0 {
+		db.sendDiscard(&Value{fid: iv.pos.fid, entrySize: iv.pos.entrySize}, true, valueTypeString)
+	}
+}
+
+// rewriteInterned rewrites the blob entry at offset of the log file fid by write function
+// if it is still the interned value referenced by keys. Lock of strIndex must be held by the caller.
+func (db *LazyDB) rewriteInterned(fid uint32, offset int64, ent *logfile.LogEntry,
+	write func(ent *logfile.LogEntry) (*ValuePos, error)) error {
+
+	iv := db.strIndex.interned[util.ByteToString(ent.Key)]
+	if iv == nil || iv.pos.fid != fid || iv.pos.offset != offset {
+		return nil
+	}
+	pos, err := write(ent)
+	if err != nil {
+		return err
+	}
+	iv.pos = *pos
+	return nil
+}
+
+// countInternedRefs counts references to interned values after the index of type String is built from log files,
+// and drops interned values no key references any more, which are reclaimed by merge.
+func (db *LazyDB) countInternedRefs() {
+	if len(db.strIndex.interned) == 0 {
+		return
+	}
+	for _, iv := range db.strIndex.interned {
+		iv.refs = 0
+	}
+	iter := db.strIndex.idxTree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil {
+			break
+		}
+		if val, _ := node.Value().(*Value); val != nil && val.ref != nil {
+			val.ref.refs++
+		}
+	}
+	for hash, iv := range db.strIndex.interned {
+		if iv.refs == 0 {
+			delete(db.strIndex.interned, hash)
+		} else if iv.pos.entrySize == 0 {
+			log.Printf("interned value %x referenced by %d keys is missing", iv.hash, iv.refs)
+		}
+	}
+}
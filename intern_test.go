@@ -0,0 +1,78 @@
+package lazydb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_InternValues(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_intern_values"))
+	cfg.InternValues = true
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	typ := valueTypeString
+	value := bytes.Repeat([]byte("interned"), 4096)
+	n := 100
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set(GetKey(i), value))
+	}
+	// a single copy of the value is stored, keys only hold references to it
+	size := db.getActiveLogFile(typ).lf.Offset
+	assert.Less(t, size, int64(2*len(value)))
+	for i := 0; i < n; i++ {
+		val, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+	assert.Len(t, db.strIndex.interned, 1)
+
+	// small values are not interned
+	assert.Nil(t, db.Set(GetKey(0), []byte("small")))
+	for i := 1; i < n/2; i++ {
+		assert.Nil(t, db.Delete(GetKey(i)))
+	}
+	for _, iv := range db.strIndex.interned {
+		assert.Equal(t, n/2, iv.refs)
+	}
+
+	// references are counted again on opening
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Len(t, db.strIndex.interned, 1)
+	for _, iv := range db.strIndex.interned {
+		assert.Equal(t, n/2, iv.refs)
+	}
+
+	// the shared value survives compaction while it is still referenced
+	assert.Nil(t, db.CompactActive(typ))
+	assert.Less(t, db.getActiveLogFile(typ).lf.Offset, size)
+	for i := n / 2; i < n; i++ {
+		val, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+
+	// the value is dropped with its last reference
+	for i := n / 2; i < n-1; i++ {
+		assert.Nil(t, db.Delete(GetKey(i)))
+	}
+	val, err := db.Get(GetKey(n - 1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+	assert.Nil(t, db.Set(GetKey(n-1), GetValue32()))
+	assert.Empty(t, db.strIndex.interned)
+	assert.Nil(t, db.CompactActive(typ))
+	assert.Less(t, db.getActiveLogFile(typ).lf.Offset, int64(len(value)))
+
+	val, err = db.Get(GetKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("small"), val)
+}
@@ -0,0 +1,75 @@
+package iocontroller
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+)
+
+var (
+	// ErrReadOnly the file can not be modified.
+	ErrReadOnly = errors.New("file is read-only")
+
+	// ErrUnsupportedFile the file can not be read at an offset.
+	ErrUnsupportedFile = errors.New("file does not support reading at offset")
+)
+
+// FSIOController represents reading a file from fs.FS, it is read-only.
+type FSIOController struct {
+	file fs.File
+}
+
+// NewFSIOController opens file name from fsys.
+// The file must implement io.ReaderAt or io.ReadSeeker.
+func NewFSIOController(fsys fs.FS, name string) (IOController, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	switch file.(type) {
+	case io.ReaderAt, io.ReadSeeker:
+	default:
+		file.Close()
+		return nil, ErrUnsupportedFile
+	}
+	return &FSIOController{file: file}, nil
+}
+
+func (f *FSIOController) Write(b []byte, offset int64) (int, error) {
+	return 0, ErrReadOnly
+}
+
+// Read reads file at offset into slice b.
+// Reaching the end of file is not an error if some bytes have been read, the rest of b is left untouched.
+func (f *FSIOController) Read(b []byte, offset int64) (int, error) {
+	var n int
+	var err error
+	if r, ok := f.file.(io.ReaderAt); ok {
+		n, err = r.ReadAt(b, offset)
+	} else {
+		r := f.file.(io.ReadSeeker)
+		if _, err = r.Seek(offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+		n, err = io.ReadFull(r, b)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+	}
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *FSIOController) Sync() error {
+	return nil
+}
+
+func (f *FSIOController) Close() error {
+	return f.file.Close()
+}
+
+func (f *FSIOController) Delete() error {
+	return ErrReadOnly
+}
@@ -0,0 +1,81 @@
+package lazydb
+
+// approxKeySamples number of collections sampled by ApproxKeyCount, types holding no more are counted exactly.
+const approxKeySamples = 1024
+
+// ApproxKeyCount returns the approximate number of live keys of typ, without walking all keys of a huge keyspace
+// like keysOf does, e.g. for a rough number shown on dashboards.
+//
+// Indexes keep their sizes, but those include keys which have expired or become empty and are not removed yet.
+// Keys of String are counted exactly by walking only the expired ones in order of expiredAt, and keys of custom types
+// by the size of their index.
+// Hashes, lists, sets and sorted sets are counted exactly if there are at most 1024 of them, otherwise the share
+// of live ones among 1024 sampled is scaled by the size of the index. The standard error of the share is at most
+// 1/64 = 1.6%, so the estimate is within 5% of the exact count with a probability above 99.7%.
+func (db *LazyDB) ApproxKeyCount(typ valueType) (int64, error) {
+	if db.IsClosed() {
+		return 0, ErrDatabaseClosed
+	}
+	mu := db.getIndexLock(typ)
+	mu.RLock()
+	defer mu.RUnlock()
+
+	ts := db.now().UnixMilli()
+	switch typ {
+	case valueTypeString:
+		size := int64(db.strIndex.idxTree.Size())
+		db.ascendTTL(func(_ []byte, expiredAt int64) bool {
+			if expiredAt > ts {
+				return false
+			}
+			size--
+			return true
+		})
+		return size, nil
+	case valueTypeList, valueTypeHash, valueTypeSet:
+		trees := db.collectionTrees(typ)
+		return sampleKeyCount(len(trees), func(visit func(live bool) bool) {
+			for key, idxTree := range trees {
+				live := idxTree != nil && idxTree.Size() > 0 && !isExpiredAt(collectionExpiredAt(typ, idxTree, []byte(key)), ts)
+				if !visit(live) {
+					return
+				}
+			}
+		}), nil
+	case valueTypeZSet:
+		return sampleKeyCount(len(db.zSetIndex.indexes), func(visit func(live bool) bool) {
+			for _, idx := range db.zSetIndex.indexes {
+				if !visit(idx != nil && idx.tree != nil && idx.tree.Size() > 0) {
+					return
+				}
+			}
+		}), nil
+	}
+	ct := db.getCustomType(typ)
+	if ct == nil {
+		return 0, ErrTypeNotRegistered
+	}
+	return int64(ct.index.idxTree.Size()), nil
+}
+
+// sampleKeyCount estimates the number of live ones out of size keys. iterate calls visit with whether each key
+// is live until visit returns false, keys are visited in random order like ranging over a map.
+func sampleKeyCount(size int, iterate func(visit func(live bool) bool)) int64 {
+	var sampled, live int
+	iterate(func(ok bool) bool {
+		sampled++
+		if ok {
+			live++
+		}
+		return sampled < approxKeySamples
+	})
+	if sampled == 0 || sampled == size {
+		return int64(live)
+	}
+	return int64(float64(live) / float64(sampled) * float64(size))
+}
+
+// isExpiredAt returns whether expiredAt(unix milliseconds) has passed at ts, 0 means never expires.
+func isExpiredAt(expiredAt, ts int64) bool {
+	return expiredAt != 0 && expiredAt <= ts
+}
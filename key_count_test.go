@@ -0,0 +1,60 @@
+package lazydb
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_ApproxKeyCount(t *testing.T) {
+	wd, _ := os.Getwd()
+	db, err := Open(DefaultDBConfig(filepath.Join(wd, "test_approx_key_count")))
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+
+	// String: expired keys are not counted
+	for i := 0; i < 3000; i++ {
+		if i < 500 {
+			assert.Nil(t, db.SetEX(GetKey(i), GetValue(8), time.Second))
+		} else {
+			assert.Nil(t, db.Set(GetKey(i), GetValue(8)))
+		}
+	}
+	// Hash: more than sampled, and a fifth of them expire
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, db.HSet(GetKey(i), GetKey(0), GetValue(8)))
+		if i%5 == 0 {
+			assert.Nil(t, db.ExpireCollection(valueTypeHash, GetKey(i), time.Second))
+		}
+	}
+	// Set: fewer than sampled are counted exactly
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.SAdd(GetKey(i), GetValue(8)))
+	}
+	now = now.Add(2 * time.Second)
+
+	count, err := db.ApproxKeyCount(valueTypeString)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2500), count)
+
+	count, err = db.ApproxKeyCount(valueTypeHash)
+	assert.Nil(t, err)
+	assert.True(t, math.Abs(float64(count)-8000) <= 8000*0.05, "%d", count)
+
+	count, err = db.ApproxKeyCount(valueTypeSet)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), count)
+
+	count, err = db.ApproxKeyCount(valueTypeZSet)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), count)
+
+	_, err = db.ApproxKeyCount(valueType(100))
+	assert.Equal(t, ErrTypeNotRegistered, err)
+}
@@ -0,0 +1,113 @@
+package lazydb
+
+import (
+	"github.com/billsjc123/LazyDB/ds"
+	"github.com/billsjc123/LazyDB/util"
+)
+
+// keyEntry is the value of a key in db.index, which is the single record of the built-in types a key holds values
+// of, so that Type, Exists and DBConfig.WrongTypeError look up one map rather than the index of every type.
+// A key may hold values of several types at the same time, see Type.
+//
+// The bit of a type is set while the index of the type holds the key, so it is changed along with the index under
+// the index lock of the type. Expired values stay in the index until they are removed, so the bit only tells the
+// key may exist, and the value of String is kept to check its expiry without locking the index of String.
+// Values of custom types are not recorded.
+type keyEntry struct {
+	types uint8  // bit 1<<typ is set if the index of typ holds the key
+	str   *Value // value of the key in the index of String, nil if the bit of String is not set
+}
+
+// has returns whether the index of typ holds the key.
+func (e keyEntry) has(typ valueType) bool {
+	return e.types&(1<<typ) != 0
+}
+
+// indexKey records that the index of typ holds key, val is the value of key in the index of String.
+// Index lock of the type must be held by the caller.
+func (db *LazyDB) indexKey(typ valueType, key []byte, val *Value) {
+	if typ >= logFileTypeNum {
+		return
+	}
+	shard := db.index.GetShardByWriting(util.ByteToString(key))
+	defer shard.Unlock()
+	raw, _ := shard.Get(util.ByteToString(key))
+	entry, _ := raw.(keyEntry)
+	entry.types |= 1 << typ
+	if typ == valueTypeString {
+		entry.str = val
+	}
+	shard.Set(string(key), entry)
+}
+
+// unindexKey records that the index of typ does not hold key any more.
+// Index lock of the type must be held by the caller.
+func (db *LazyDB) unindexKey(typ valueType, key []byte) {
+	if typ >= logFileTypeNum {
+		return
+	}
+	shard := db.index.GetShardByWriting(util.ByteToString(key))
+	defer shard.Unlock()
+	raw, ok := shard.Get(util.ByteToString(key))
+	if !ok {
+		return
+	}
+	entry := raw.(keyEntry)
+	entry.types &^= 1 << typ
+	if typ == valueTypeString {
+		entry.str = nil
+	}
+	if entry.types == 0 {
+		shard.Remove(util.ByteToString(key))
+		return
+	}
+	shard.Set(util.ByteToString(key), entry)
+}
+
+// unindexType records that the index of typ holds no key, after it is cleared.
+// Index lock of the type must be held by the caller.
+func (db *LazyDB) unindexType(typ valueType) {
+	if typ >= logFileTypeNum {
+		return
+	}
+	db.index.Update(func(key string, raw any) (any, bool) {
+		entry := raw.(keyEntry)
+		entry.types &^= 1 << typ
+		if typ == valueTypeString {
+			entry.str = nil
+		}
+		return entry, entry.types != 0
+	})
+}
+
+// lookupKey returns the entry of key in db.index, whose types are empty if key is not held by any index.
+func (db *LazyDB) lookupKey(key []byte) keyEntry {
+	shard := db.index.GetShardByReading(util.ByteToString(key))
+	defer shard.RUnlock()
+	raw, _ := shard.Get(util.ByteToString(key))
+	entry, _ := raw.(keyEntry)
+	return entry
+}
+
+// collectionTree returns the index tree of the collection at key of typ, which is created if it does not exist.
+// Index lock of the type must be held by the caller.
+func (db *LazyDB) collectionTree(typ valueType, key []byte) *ds.AdaptiveRadixTree {
+	trees := db.collectionTrees(typ)
+	idxTree := trees[util.ByteToString(key)]
+	if idxTree == nil {
+		idxTree = ds.NewART()
+		trees[string(key)] = idxTree
+		db.indexKey(typ, key, nil)
+	}
+	return idxTree
+}
+
+// removeCollectionTree removes the index tree of the collection at key of typ.
+// Index lock of the type must be held by the caller.
+func (db *LazyDB) removeCollectionTree(typ valueType, key []byte) {
+	trees := db.collectionTrees(typ)
+	if _, ok := trees[util.ByteToString(key)]; ok {
+		delete(trees, util.ByteToString(key))
+		db.unindexKey(typ, key)
+	}
+}
@@ -0,0 +1,158 @@
+package lazydb
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/billsjc123/LazyDB/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// assertKeyIndexConsistent asserts that db.index records exactly the keys held by the index of every built-in type,
+// along with the value of type String.
+func assertKeyIndexConsistent(t *testing.T, db *LazyDB) {
+	want := make(map[string]keyEntry)
+	add := func(typ valueType, key string, val *Value) {
+		entry := want[key]
+		entry.types |= 1 << typ
+		if typ == valueTypeString {
+			entry.str = val
+		}
+		want[key] = entry
+	}
+	iter := db.strIndex.idxTree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		assert.Nil(t, err)
+		add(valueTypeString, string(node.Key()), node.Value().(*Value))
+	}
+	for _, typ := range []valueType{valueTypeList, valueTypeHash, valueTypeSet} {
+		for key := range db.collectionTrees(typ) {
+			add(typ, key, nil)
+		}
+	}
+	for key := range db.zSetIndex.indexes {
+		add(valueTypeZSet, key, nil)
+	}
+
+	got := make(map[string]keyEntry)
+	db.index.Update(func(key string, raw any) (any, bool) {
+		got[key] = raw.(keyEntry)
+		return raw, true
+	})
+	assert.Equal(t, want, got)
+}
+
+func TestLazyDB_KeyIndexConsistent(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_key_index_consistent"))
+	cfg.MaxLogFileSize = 4 << 10
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+
+	rnd := rand.New(rand.NewSource(1))
+	key := func() []byte { return []byte("key-" + strconv.Itoa(rnd.Intn(20))) }
+	for i := 0; i < 2000; i++ {
+		k, v := key(), []byte(strconv.Itoa(i))
+		switch rnd.Intn(16) {
+		case 0:
+			assert.Nil(t, db.Set(k, v))
+		case 1:
+			assert.Nil(t, db.SetEX(k, v, time.Second))
+		case 2:
+			_ = db.Delete(k)
+		case 3:
+			assert.Nil(t, db.HSet(k, v[:1], v))
+		case 4:
+			_, _ = db.HDel(k, v[:1])
+		case 5:
+			assert.Nil(t, db.LPush(k, v))
+		case 6:
+			_, _ = db.LPop(k)
+		case 7:
+			assert.Nil(t, db.SAdd(k, v[:1]))
+		case 8:
+			_ = db.SRem(k, v[:1])
+		case 9:
+			assert.Nil(t, db.ZAdd(k, util.Float64ToByte(float64(i)), v[:1]))
+		case 10:
+			_, _ = db.ZRem(k, v[:1])
+		case 11:
+			_, err := db.Unlink(k)
+			assert.Nil(t, err)
+		case 12:
+			tx, err := db.Begin(RWTX)
+			assert.Nil(t, err)
+			tx.Set(k, v)
+			tx.HSet(k, v[:1], v)
+			tx.SAdd(key(), v[:1])
+			assert.Nil(t, tx.Commit())
+		case 13:
+			_ = db.Expire(k, time.Second)
+		case 14:
+			now = now.Add(500 * time.Millisecond)
+			_, _ = db.Get(k)
+		case 15:
+			_, err := db.PruneEmptyCollections()
+			assert.Nil(t, err)
+		}
+	}
+	assertKeyIndexConsistent(t, db)
+
+	assert.Nil(t, db.Reload())
+	assertKeyIndexConsistent(t, db)
+
+	// live values are moved by merge
+	fids := append([]uint32(nil), db.fidsMap[valueTypeString].fids...)
+	sort.Slice(fids, func(i, j int) bool { return fids[i] < fids[j] })
+	assert.Nil(t, db.Merge(valueTypeString, fids[0], 0))
+	assertKeyIndexConsistent(t, db)
+	assert.Nil(t, db.Defrag(valueTypeString))
+	assertKeyIndexConsistent(t, db)
+
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assertKeyIndexConsistent(t, db)
+
+	assert.Nil(t, db.DropType(valueTypeHash))
+	assertKeyIndexConsistent(t, db)
+}
+
+func TestLazyDB_TypeByKeyIndex(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+
+	key := []byte("key")
+	_, err := db.Type(key)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.Nil(t, db.HSet(key, []byte("f"), []byte("v")))
+	assert.Nil(t, db.SetEX(key, []byte("v"), time.Second))
+	typ, err := db.Type(key)
+	assert.Nil(t, err)
+	assert.Equal(t, valueTypeString, typ)
+	assert.Equal(t, []valueType{valueTypeString, valueTypeHash}, db.keyTypes(key))
+
+	// the expired string is skipped by the recorded value before it is removed
+	now = now.Add(2 * time.Second)
+	assert.True(t, db.lookupKey(key).has(valueTypeString))
+	typ, err = db.Type(key)
+	assert.Nil(t, err)
+	assert.Equal(t, valueTypeHash, typ)
+
+	_, err = db.HDel(key, []byte("f"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, db.Exists(key))
+	assert.False(t, db.lookupKey(key).has(valueTypeHash))
+}
@@ -0,0 +1,45 @@
+package lazydb
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/billsjc123/LazyDB/logfile"
+)
+
+// ErrKeyTooLarge is returned by writes of keys larger than DBConfig.MaxKeySize, nothing is written then.
+var ErrKeyTooLarge = errors.New("key exceeds max size")
+
+// checkKeySize returns ErrKeyTooLarge if the key of the entry exceeds DBConfig.MaxKeySize.
+// Keys of entries of collections are encoded ones, delete entries are never limited.
+func (db *LazyDB) checkKeySize(entry *logfile.LogEntry) error {
+	if db.cfg.MaxKeySize > 0 && entry.Stat != logfile.SDelete && len(entry.Key) > db.cfg.MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	return nil
+}
+
+// checkSubKeySizes returns ErrKeyTooLarge if any of subKeys exceeds DBConfig.MaxKeySize once it is encoded with key
+// by encodeKey, so that writes of several subKeys fail before anything is written.
+func (db *LazyDB) checkSubKeySizes(key []byte, subKeys ...[]byte) error {
+	if db.cfg.MaxKeySize <= 0 {
+		return nil
+	}
+	if db.cfg.CollectionCodec != nil {
+		for _, subKey := range subKeys {
+			if len(db.encodeKey(key, subKey)) > db.cfg.MaxKeySize {
+				return ErrKeyTooLarge
+			}
+		}
+		return nil
+	}
+	var buf [binary.MaxVarintLen64]byte
+	keyHeader := binary.PutVarint(buf[:], int64(len(key)))
+	for _, subKey := range subKeys {
+		size := keyHeader + binary.PutVarint(buf[:], int64(len(subKey))) + len(key) + len(subKey)
+		if size > db.cfg.MaxKeySize {
+			return ErrKeyTooLarge
+		}
+	}
+	return nil
+}
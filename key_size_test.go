@@ -0,0 +1,47 @@
+package lazydb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_MaxKeySize(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_max_key_size")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxKeySize = 16
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	large := bytes.Repeat([]byte("k"), 17)
+	t.Run("string", func(t *testing.T) {
+		offset := db.getActiveLogFile(valueTypeString).lf.Offset
+		assert.Equal(t, ErrKeyTooLarge, db.Set(large, []byte("v")))
+		assert.Equal(t, ErrKeyTooLarge, db.MSet([]byte("k1"), []byte("v1"), large, []byte("v")))
+		assert.Equal(t, offset, db.getActiveLogFile(valueTypeString).lf.Offset)
+		_, err := db.Get([]byte("k1"))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		assert.Nil(t, db.Set(large[:16], []byte("v")))
+		assert.Nil(t, db.Delete(large[:16]))
+	})
+
+	t.Run("hash field", func(t *testing.T) {
+		key := []byte("hash")
+		offset := db.getActiveLogFile(valueTypeHash).lf.Offset
+		// key and field are encoded with 2 bytes of their lengths
+		assert.Equal(t, ErrKeyTooLarge, db.HSet(key, []byte("f1"), []byte("v1"), large[:11], []byte("v")))
+		assert.Equal(t, offset, db.getActiveLogFile(valueTypeHash).lf.Offset)
+		assert.Equal(t, 0, hLen(t, db, key))
+
+		assert.Nil(t, db.HSet(key, large[:10], []byte("v")))
+		val, err := db.HGet(key, large[:10])
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v"), val)
+	})
+}
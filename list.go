@@ -2,22 +2,47 @@ package lazydb
 
 import (
 	"encoding/binary"
+	"errors"
 	"github.com/billsjc123/LazyDB/ds"
 	"github.com/billsjc123/LazyDB/logfile"
+	"math"
+	"time"
 )
 
+var (
+	ErrListSeqExhausted = errors.New("list sequence is exhausted")
+	// ErrTimeout is returned by BLPop and BRPop if no element is available before the timeout.
+	ErrTimeout = errors.New("timeout waiting for list elements")
+)
+
+// LPush inserts all the specified values at the head of the list stored at key.
+// Elements pushed into an expiring list inherit its time to live, see CollectionWriteOptions.
 func (db *LazyDB) LPush(key []byte, args ...[]byte) (err error) {
+	return db.LPushWithOptions(key, CollectionWriteOptions{}, args...)
+}
+
+// LPushWithOptions is like LPush, but the time to live of the whole list can be overridden by opts.
+func (db *LazyDB) LPushWithOptions(key []byte, opts CollectionWriteOptions, args ...[]byte) (err error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return err
+	}
 	if len(args) == 0 {
 		return nil
 	}
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
 
-	if (db.listIndex.trees[string(key)]) == nil {
-		db.listIndex.trees[string(key)] = ds.NewART()
+	db.removeExpiredCollection(valueTypeList, key)
+	if err = db.checkListLimit(key, len(args)); err != nil {
+		return err
+	}
+	expiredAt, err := db.prepareCollectionWrite(valueTypeList, key, opts)
+	if err != nil {
+		return err
 	}
+	db.collectionTree(valueTypeList, key)
 	for _, arg := range args {
-		if err := db.push(key, arg, true); err != nil {
+		if err := db.push(key, arg, true, expiredAt); err != nil {
 			return err
 		}
 	}
@@ -25,17 +50,25 @@ func (db *LazyDB) LPush(key []byte, args ...[]byte) (err error) {
 }
 
 func (db *LazyDB) LPushX(key []byte, args ...[]byte) (err error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return err
+	}
 	if len(args) == 0 {
 		return nil
 	}
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
 
+	db.removeExpiredCollection(valueTypeList, key)
 	if (db.listIndex.trees[string(key)]) == nil {
 		return ErrKeyNotFound
 	}
+	if err = db.checkListLimit(key, len(args)); err != nil {
+		return err
+	}
+	expiredAt := collectionExpiredAt(valueTypeList, db.listIndex.trees[string(key)], key)
 	for _, arg := range args {
-		if err := db.push(key, arg, true); err != nil {
+		if err := db.push(key, arg, true, expiredAt); err != nil {
 			return err
 		}
 	}
@@ -43,24 +76,43 @@ func (db *LazyDB) LPushX(key []byte, args ...[]byte) (err error) {
 }
 
 func (db *LazyDB) LPop(key []byte) (value []byte, err error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return nil, err
+	}
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
 	value, err = db.pop(key, true)
 	return value, err
 }
 
+// RPush inserts all the specified values at the tail of the list stored at key.
+// Elements pushed into an expiring list inherit its time to live, see CollectionWriteOptions.
 func (db *LazyDB) RPush(key []byte, args ...[]byte) (err error) {
+	return db.RPushWithOptions(key, CollectionWriteOptions{}, args...)
+}
+
+// RPushWithOptions is like RPush, but the time to live of the whole list can be overridden by opts.
+func (db *LazyDB) RPushWithOptions(key []byte, opts CollectionWriteOptions, args ...[]byte) (err error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return err
+	}
 	if len(args) == 0 {
 		return nil
 	}
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
 
-	if (db.listIndex.trees[string(key)]) == nil {
-		db.listIndex.trees[string(key)] = ds.NewART()
+	db.removeExpiredCollection(valueTypeList, key)
+	if err = db.checkListLimit(key, len(args)); err != nil {
+		return err
+	}
+	expiredAt, err := db.prepareCollectionWrite(valueTypeList, key, opts)
+	if err != nil {
+		return err
 	}
+	db.collectionTree(valueTypeList, key)
 	for _, arg := range args {
-		if err := db.push(key, arg, false); err != nil {
+		if err := db.push(key, arg, false, expiredAt); err != nil {
 			return err
 		}
 	}
@@ -68,17 +120,25 @@ func (db *LazyDB) RPush(key []byte, args ...[]byte) (err error) {
 }
 
 func (db *LazyDB) RPushX(key []byte, args ...[]byte) (err error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return err
+	}
 	if len(args) == 0 {
 		return nil
 	}
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
 
+	db.removeExpiredCollection(valueTypeList, key)
 	if (db.listIndex.trees[string(key)]) == nil {
 		return ErrKeyNotFound
 	}
+	if err = db.checkListLimit(key, len(args)); err != nil {
+		return err
+	}
+	expiredAt := collectionExpiredAt(valueTypeList, db.listIndex.trees[string(key)], key)
 	for _, arg := range args {
-		if err := db.push(key, arg, false); err != nil {
+		if err := db.push(key, arg, false, expiredAt); err != nil {
 			return err
 		}
 	}
@@ -86,13 +146,159 @@ func (db *LazyDB) RPushX(key []byte, args ...[]byte) (err error) {
 }
 
 func (db *LazyDB) RPop(key []byte) (value []byte, err error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return nil, err
+	}
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
 	value, err = db.pop(key, false)
 	return value, err
 }
 
+// BLPop is the blocking version of LPop. It pops the first element of the first non-empty list of keys,
+// checked in the given order, and waits up to timeout for an element to be pushed if all of them are empty.
+// ErrTimeout is returned if there is still no element after timeout, and ErrDatabaseClosed if the db is closed while waiting.
+func (db *LazyDB) BLPop(timeout time.Duration, keys ...[]byte) (key, value []byte, err error) {
+	return db.bPop(timeout, keys, true)
+}
+
+// BRPop is the blocking version of RPop, see BLPop.
+func (db *LazyDB) BRPop(timeout time.Duration, keys ...[]byte) (key, value []byte, err error) {
+	return db.bPop(timeout, keys, false)
+}
+
+// LMPop pops up to count elements from the first non-empty list of keys, checked in the given order,
+// from the head of the list if left is true, or from the tail otherwise. numkeys must be the number of keys.
+// It returns the key of the list and popped elements in order of popping, or a nil key if all of the lists are empty.
+func (db *LazyDB) LMPop(numkeys int, keys [][]byte, left bool, count int) (key []byte, values [][]byte, err error) {
+	if err := db.checkAccess(OpWrite, keys...); err != nil {
+		return nil, nil, err
+	}
+	if numkeys <= 0 || numkeys != len(keys) || count <= 0 {
+		return nil, nil, ErrInvalidParam
+	}
+	db.listIndex.mu.Lock()
+	defer db.listIndex.mu.Unlock()
+
+	for _, key := range keys {
+		length, err := db.listLength(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if length == 0 {
+			continue
+		}
+		if count > length {
+			count = length
+		}
+		values = make([][]byte, 0, count)
+		for i := 0; i < count; i++ {
+			value, err := db.pop(key, left)
+			if err != nil {
+				return nil, nil, err
+			}
+			values = append(values, value)
+		}
+		return key, values, nil
+	}
+	return nil, nil, nil
+}
+
+func (db *LazyDB) bPop(timeout time.Duration, keys [][]byte, isLeft bool) ([]byte, []byte, error) {
+	if err := db.checkAccess(OpWrite, keys...); err != nil {
+		return nil, nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil, ErrInvalidParam
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	// buffered, so that pushes never block on a waiter
+	ready := make(chan struct{}, 1)
+
+	db.listIndex.mu.Lock()
+	defer db.listIndex.mu.Unlock()
+	for {
+		if db.listIndex.closed {
+			return nil, nil, ErrDatabaseClosed
+		}
+		for _, key := range keys {
+			if db.listIndex.trees[string(key)] == nil {
+				continue
+			}
+			value, err := db.pop(key, isLeft)
+			if err != nil {
+				return nil, nil, err
+			}
+			if value != nil {
+				return key, value, nil
+			}
+		}
+
+		db.addListWaiter(keys, ready)
+		db.listIndex.mu.Unlock()
+		timedOut := false
+		select {
+		case <-ready:
+		case <-timer.C:
+			timedOut = true
+		}
+		db.listIndex.mu.Lock()
+		db.removeListWaiter(keys, ready)
+		if timedOut {
+			return nil, nil, ErrTimeout
+		}
+	}
+}
+
+// addListWaiter registers ready as a waiter of lists of keys. Lock of listIndex must be held by the caller.
+func (db *LazyDB) addListWaiter(keys [][]byte, ready chan struct{}) {
+	for _, key := range keys {
+		waiters := db.listIndex.waiters[string(key)]
+		if waiters == nil {
+			waiters = make(map[chan struct{}]struct{})
+			db.listIndex.waiters[string(key)] = waiters
+		}
+		waiters[ready] = struct{}{}
+	}
+}
+
+// removeListWaiter unregisters ready from lists of keys. Lock of listIndex must be held by the caller.
+func (db *LazyDB) removeListWaiter(keys [][]byte, ready chan struct{}) {
+	for _, key := range keys {
+		waiters := db.listIndex.waiters[string(key)]
+		delete(waiters, ready)
+		if len(waiters) == 0 {
+			delete(db.listIndex.waiters, string(key))
+		}
+	}
+}
+
+// signalListWaiters wakes up waiters of the list of key after an element is pushed.
+// Lock of listIndex must be held by the caller.
+func (db *LazyDB) signalListWaiters(key []byte) {
+	for ready := range db.listIndex.waiters[string(key)] {
+		select {
+		case ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// wakeListWaiters wakes up all waiters of BLPop and BRPop with ErrDatabaseClosed, it is called by Close.
+func (db *LazyDB) wakeListWaiters() {
+	db.listIndex.mu.Lock()
+	defer db.listIndex.mu.Unlock()
+	db.listIndex.closed = true
+	for key := range db.listIndex.waiters {
+		db.signalListWaiters([]byte(key))
+	}
+}
+
 func (db *LazyDB) LSet(key []byte, index int, value []byte) (err error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return err
+	}
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
 	if (db.listIndex.trees[string(key)]) == nil {
@@ -108,7 +314,7 @@ func (db *LazyDB) LSet(key []byte, index int, value []byte) (err error) {
 		return ErrWrongIndex
 	}
 	encodeKey := db.encodeListKey(key, s)
-	entry := &logfile.LogEntry{Key: encodeKey, Value: value}
+	entry := &logfile.LogEntry{Key: encodeKey, Value: value, ExpiredAt: collectionExpiredAt(valueTypeList, idxTree, key)}
 	pos, err := db.writeLogEntry(valueTypeList, entry)
 	if err != nil {
 		return err
@@ -118,12 +324,18 @@ func (db *LazyDB) LSet(key []byte, index int, value []byte) (err error) {
 }
 
 func (db *LazyDB) LIndex(key []byte, index int) (value []byte, err error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
-	if (db.listIndex.trees[string(key)]) == nil {
+	if err := db.checkType(valueTypeList, key); err != nil {
+		return nil, err
+	}
+	idxTree := db.liveCollection(valueTypeList, key)
+	if idxTree == nil {
 		return nil, ErrKeyNotFound
 	}
-	idxTree := db.listIndex.trees[string(key)]
 	headSeq, tailSeq, err := db.lMeta(idxTree, key)
 	if err != nil {
 		return nil, err
@@ -140,42 +352,135 @@ func (db *LazyDB) LIndex(key []byte, index int) (value []byte, err error) {
 	return val, err
 }
 
-func (db *LazyDB) LLen(key []byte) (len int) {
+// LExistsKey returns whether the list stored at key exists, only the index of List is looked up unlike Exists.
+func (db *LazyDB) LExistsKey(key []byte) bool {
+	return db.typedKeyExists(valueTypeList, key)
+}
+
+// LLen returns the length of the list stored at key, 0 if key does not exist.
+func (db *LazyDB) LLen(key []byte) (int, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return 0, err
+	}
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
-	if (db.listIndex.trees[string(key)]) == nil {
-		return 0
+	if err := db.checkType(valueTypeList, key); err != nil {
+		return 0, err
+	}
+	idxTree := db.liveCollection(valueTypeList, key)
+	if idxTree == nil {
+		return 0, nil
 	}
-	idxTree := db.listIndex.trees[string(key)]
 	headSeq, tailSeq, err := db.lMeta(idxTree, key)
 	if err != nil {
-		return 0
+		return 0, err
 	}
-	len = int(tailSeq - headSeq - 1)
-	return len
+	return int(tailSeq - headSeq - 1), nil
 }
 
-func (db *LazyDB) LRange(key []byte, start int, stop int) (value [][]byte, err error) {
+// ListStats describes the layout of seqs of a list, see LazyDB.ListStats.
+type ListStats struct {
+	HeadSeq uint32 // free seq next to the head, see initialListSeq
+	TailSeq uint32 // free seq next to the tail
+	Len     int    // number of elements in the index
+	// Gaps number of seqs between HeadSeq and TailSeq without an element. Pushes and pops keep seqs contiguous,
+	// so a gap is left by an element missing from the index, and is fixed by rewriting the list.
+	Gaps int
+}
+
+// ListStats returns the layout of seqs of the list stored at key, ErrKeyNotFound if the list does not exist.
+func (db *LazyDB) ListStats(key []byte) (*ListStats, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
-	if (db.listIndex.trees[string(key)]) == nil {
+	if err := db.checkType(valueTypeList, key); err != nil {
+		return nil, err
+	}
+	idxTree := db.liveCollection(valueTypeList, key)
+	if idxTree == nil {
 		return nil, ErrKeyNotFound
 	}
-	idxTree := db.listIndex.trees[string(key)]
 	headSeq, tailSeq, err := db.lMeta(idxTree, key)
 	if err != nil {
 		return nil, err
 	}
-	startSeq, err := db.lSequence(headSeq, tailSeq, start)
+	stats := &ListStats{HeadSeq: headSeq, TailSeq: tailSeq}
+	iter := idxTree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		// the metadata is keyed by the key itself
+		if len(node.Key()) != len(key)+4 {
+			continue
+		}
+		if _, seq := db.decodeListKey(node.Key()); seq > headSeq && seq < tailSeq {
+			stats.Len++
+		}
+	}
+	stats.Gaps = int(tailSeq-headSeq-1) - stats.Len
+	return stats, nil
+}
+
+func (db *LazyDB) LRange(key []byte, start int, stop int) (value [][]byte, err error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
+	db.listIndex.mu.Lock()
+	defer db.listIndex.mu.Unlock()
+	if err := db.checkType(valueTypeList, key); err != nil {
+		return nil, err
+	}
+	err = db.lRange(key, start, stop, func(_ int, val []byte) bool {
+		value = append(value, val)
+		return true
+	})
 	if err != nil {
 		return nil, err
 	}
+	return value, nil
+}
+
+// LRangeFunc is like LRange, but calls fn with the index and the value of every element in the range in order,
+// rather than returning all of them, so that a large range is not buffered. Values are read lazily before fn is called.
+// Iteration stops if fn returns false. Read lock of list is held during iteration, so fn should be quick
+// and must not modify the db.
+func (db *LazyDB) LRangeFunc(key []byte, start, stop int, fn func(index int, value []byte) bool) error {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return err
+	}
+	db.listIndex.mu.RLock()
+	defer db.listIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeList, key); err != nil {
+		return err
+	}
+	return db.lRange(key, start, stop, fn)
+}
+
+// lRange calls fn with elements of the list from start to stop, negative indexes count from the tail.
+// Lock of listIndex must be held by the caller.
+func (db *LazyDB) lRange(key []byte, start, stop int, fn func(index int, value []byte) bool) error {
+	idxTree := db.liveCollection(valueTypeList, key)
+	if idxTree == nil {
+		return ErrKeyNotFound
+	}
+	headSeq, tailSeq, err := db.lMeta(idxTree, key)
+	if err != nil {
+		return err
+	}
+	startSeq, err := db.lSequence(headSeq, tailSeq, start)
+	if err != nil {
+		return err
+	}
 	stopSeq, err := db.lSequence(headSeq, tailSeq, stop)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	if startSeq > stopSeq || startSeq >= tailSeq || stopSeq <= headSeq {
-		return nil, ErrWrongIndex
+		return ErrWrongIndex
 	}
 	if startSeq <= headSeq {
 		startSeq = headSeq + 1
@@ -186,17 +491,81 @@ func (db *LazyDB) LRange(key []byte, start int, stop int) (value [][]byte, err e
 	for seq := startSeq; seq < stopSeq+1; seq++ {
 		encodeKey := db.encodeListKey(key, seq)
 		val, err := db.getValue(idxTree, encodeKey, valueTypeList)
+		if err != nil {
+			return err
+		}
+		if !fn(int(seq-headSeq-1), val) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// LGetAll returns all elements of the list stored at key from head to tail,
+// which is the order of their seqs: LPush takes seqs before the head and RPush after the tail.
+// An empty slice is returned if key does not exist.
+func (db *LazyDB) LGetAll(key []byte) ([][]byte, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
+	db.listIndex.mu.RLock()
+	defer db.listIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeList, key); err != nil {
+		return nil, err
+	}
+	idxTree := db.listIndex.trees[string(key)]
+	if idxTree == nil {
+		return [][]byte{}, nil
+	}
+	headSeq, tailSeq, err := db.lMeta(idxTree, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// seqs are not in the order of encoded keys, so put each element at its position directly
+	values := make([][]byte, tailSeq-headSeq-1)
+	iter := idxTree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
 		if err != nil {
 			return nil, err
 		}
-		value = append(value, val)
+		// skip list meta
+		if len(node.Key()) == len(key) {
+			continue
+		}
+		_, seq := db.decodeListKey(node.Key())
+		// popped elements are still in the tree
+		if seq <= headSeq || seq >= tailSeq {
+			continue
+		}
+		val, err := db.getValue(idxTree, node.Key(), valueTypeList)
+		if err != nil {
+			return nil, err
+		}
+		values[seq-headSeq-1] = val
 	}
-	return value, nil
+	return values, nil
 }
 
 func (db *LazyDB) LMove(sourceKey []byte, distKey []byte, sourceIsLeft bool, distIsLeft bool) (val []byte, err error) {
+	if err := db.checkAccess(OpWrite, sourceKey, distKey); err != nil {
+		return nil, err
+	}
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
+	// moving within the same list does not grow it
+	if string(sourceKey) != string(distKey) {
+		length, err := db.listLength(sourceKey)
+		if err != nil {
+			return nil, err
+		}
+		if length > 0 {
+			if err = db.checkListLimit(distKey, 1); err != nil {
+				return nil, err
+			}
+		}
+	}
 	val, err = db.pop(sourceKey, sourceIsLeft)
 	if err != nil {
 		return nil, err
@@ -204,10 +573,9 @@ func (db *LazyDB) LMove(sourceKey []byte, distKey []byte, sourceIsLeft bool, dis
 	if val == nil {
 		return nil, nil
 	}
-	if db.listIndex.trees[string(distKey)] == nil {
-		db.listIndex.trees[string(distKey)] = ds.NewART()
-	}
-	err = db.push(distKey, val, distIsLeft)
+	db.removeExpiredCollection(valueTypeList, distKey)
+	distTree := db.collectionTree(valueTypeList, distKey)
+	err = db.push(distKey, val, distIsLeft, collectionExpiredAt(valueTypeList, distTree, distKey))
 	if err != nil {
 		return nil, err
 	}
@@ -248,7 +616,8 @@ func (db *LazyDB) pop(key []byte, isLeft bool) (value []byte, err error) {
 	} else {
 		tailSeq--
 	}
-	if err = db.saveLMeta(idxTree, key, headSeq, tailSeq); err != nil {
+	expiredAt := collectionExpiredAt(valueTypeList, idxTree, key)
+	if err = db.saveLMeta(idxTree, key, headSeq, tailSeq, expiredAt); err != nil {
 		return nil, err
 	}
 
@@ -256,28 +625,36 @@ func (db *LazyDB) pop(key []byte, isLeft bool) (value []byte, err error) {
 
 	if tailSeq-headSeq-1 == 0 {
 		// reset meta
-		if headSeq != initialListSeq || tailSeq != initialListSeq+1 {
-			headSeq = initialListSeq
-			tailSeq = initialListSeq + 1
-			_ = db.saveLMeta(idxTree, key, headSeq, tailSeq)
+		initSeq := db.initialListSeq()
+		if headSeq != initSeq || tailSeq != initSeq+1 {
+			headSeq = initSeq
+			tailSeq = initSeq + 1
+			_ = db.saveLMeta(idxTree, key, headSeq, tailSeq, expiredAt)
 		}
-		delete(db.listIndex.trees, string(key))
+		db.removeCollectionTree(valueTypeList, key)
 	}
 	return value, nil
 }
 
-func (db *LazyDB) push(key []byte, arg []byte, isLeft bool) (err error) {
+// push inserts arg at the head or tail of the list at key, the element and metadata are written with expiredAt.
+func (db *LazyDB) push(key []byte, arg []byte, isLeft bool, expiredAt int64) (err error) {
 	idxTree := db.listIndex.trees[string(key)]
 	headSeq, tailSeq, err := db.lMeta(idxTree, key)
 	if err != nil {
 		return err
 	}
+	// no room on this end, the seq would wrap around
+	if (isLeft && headSeq == 0) || (!isLeft && tailSeq == math.MaxUint32) {
+		if headSeq, tailSeq, err = db.rebalanceList(idxTree, key, headSeq, tailSeq, expiredAt); err != nil {
+			return err
+		}
+	}
 	var s = headSeq
 	if isLeft != true {
 		s = tailSeq
 	}
 	encodeKey := db.encodeListKey(key, s)
-	entry := &logfile.LogEntry{Key: encodeKey, Value: arg}
+	entry := &logfile.LogEntry{Key: encodeKey, Value: arg, ExpiredAt: expiredAt}
 	vPos, err := db.writeLogEntry(valueTypeList, entry)
 	if err != nil {
 		return err
@@ -291,17 +668,22 @@ func (db *LazyDB) push(key []byte, arg []byte, isLeft bool) (err error) {
 	} else {
 		tailSeq++
 	}
-	err = db.saveLMeta(idxTree, key, headSeq, tailSeq)
-	return err
+	if err = db.saveLMeta(idxTree, key, headSeq, tailSeq, expiredAt); err != nil {
+		return err
+	}
+	db.signalListWaiters(key)
+	return nil
 }
 
+// lMeta returns headSeq and tailSeq of the list at key, the free seqs next to its head and tail, see initialListSeq.
+// They are the ones of an empty list if the list has no metadata.
 func (db *LazyDB) lMeta(idxTree *ds.AdaptiveRadixTree, key []byte) (headSeq uint32, tailSeq uint32, err error) {
 	value, err := db.getValue(idxTree, key, valueTypeList)
 	if err != nil && err != ErrKeyNotFound {
 		return 0, 0, err
 	}
-	headSeq = initialListSeq
-	tailSeq = initialListSeq + 1
+	headSeq = db.initialListSeq()
+	tailSeq = headSeq + 1
 	if len(value) != 0 {
 		headSeq = binary.LittleEndian.Uint32(value[:4])
 		tailSeq = binary.LittleEndian.Uint32(value[4:8])
@@ -309,11 +691,91 @@ func (db *LazyDB) lMeta(idxTree *ds.AdaptiveRadixTree, key []byte) (headSeq uint
 	return headSeq, tailSeq, nil
 }
 
-func (db *LazyDB) saveLMeta(idxTree *ds.AdaptiveRadixTree, key []byte, headSeq uint32, tailSeq uint32) (err error) {
+// rebalanceList rewrites elements of the list with seqs centered around initialListSeq,
+// so that there is room to push on both ends again. It returns the new headSeq and tailSeq.
+// Elements at new seqs, delete entries of old seqs and the new metadata are written as a transaction, which is
+// made durable by its commit marker before the index is updated, so that a crash in the middle never leaves
+// elements duplicated at both seqs, see Tx.Exec.
+func (db *LazyDB) rebalanceList(idxTree *ds.AdaptiveRadixTree, key []byte, headSeq, tailSeq uint32,
+	expiredAt int64) (uint32, uint32, error) {
+	length := uint64(tailSeq - headSeq - 1)
+	// at least one free seq is needed on both ends
+	if length+4 > math.MaxUint32 {
+		return 0, 0, ErrListSeqExhausted
+	}
+	newHeadSeq := uint32(uint64(initialListSeq) - length/2)
+	newTailSeq := uint32(uint64(newHeadSeq) + length + 1)
+
+	entries := make([]*logfile.LogEntry, 0, length+1)
+	for seq := headSeq + 1; seq < tailSeq; seq++ {
+		val, err := db.getValue(idxTree, db.encodeListKey(key, seq), valueTypeList)
+		if err != nil {
+			return 0, 0, err
+		}
+		newSeq := newHeadSeq + uint32(len(entries)) + 1
+		entries = append(entries, &logfile.LogEntry{Key: db.encodeListKey(key, newSeq), Value: val, ExpiredAt: expiredAt})
+	}
+	// remove elements at old seqs which are not overwritten
+	for seq := headSeq + 1; seq < tailSeq; seq++ {
+		if seq > newHeadSeq && seq < newTailSeq {
+			continue
+		}
+		entries = append(entries, &logfile.LogEntry{Key: db.encodeListKey(key, seq), Stat: logfile.SDelete})
+	}
+	meta := make([]byte, 8)
+	binary.LittleEndian.PutUint32(meta[:4], newHeadSeq)
+	binary.LittleEndian.PutUint32(meta[4:8], newTailSeq)
+	entries = append(entries, &logfile.LogEntry{Key: key, Value: meta, Stat: logfile.SListMeta, ExpiredAt: expiredAt})
+
+	txID, err := generateTxID()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, entry := range entries {
+		entry.TxID = txID
+		entry.TxStat = logfile.TxUncommited
+	}
+	positions, err := db.writeLogEntries(valueTypeList, entries)
+	if err != nil {
+		return 0, 0, err
+	}
+	var files []logFileCacheKey
+	for _, pos := range positions {
+		if file := (logFileCacheKey{typ: valueTypeList, fid: pos.fid}); len(files) == 0 || files[len(files)-1] != file {
+			files = append(files, file)
+		}
+	}
+	if err = db.txCommits.commit(txID, files); err != nil {
+		return 0, 0, err
+	}
+	if err = db.txCommits.sync(); err != nil {
+		return 0, 0, err
+	}
+
+	for i, entry := range entries {
+		switch entry.Stat {
+		case logfile.SDelete:
+			delVal, updated := idxTree.Delete(entry.Key)
+			db.sendDiscard(delVal, updated, valueTypeList)
+		case logfile.SListMeta:
+			err = db.updateIndexTree(valueTypeList, idxTree, entry, positions[i], false)
+		default:
+			err = db.updateIndexTree(valueTypeList, idxTree, entry, positions[i], true)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return newHeadSeq, newTailSeq, nil
+}
+
+// saveLMeta writes the metadata of the list at key, expiredAt of the metadata is the one of the whole list.
+func (db *LazyDB) saveLMeta(idxTree *ds.AdaptiveRadixTree, key []byte, headSeq uint32, tailSeq uint32,
+	expiredAt int64) (err error) {
 	buf := make([]byte, 8)
 	binary.LittleEndian.PutUint32(buf[:4], headSeq)
 	binary.LittleEndian.PutUint32(buf[4:8], tailSeq)
-	entry := &logfile.LogEntry{Key: key, Value: buf, Stat: logfile.SListMeta}
+	entry := &logfile.LogEntry{Key: key, Value: buf, Stat: logfile.SListMeta, ExpiredAt: expiredAt}
 	pos, err := db.writeLogEntry(valueTypeList, entry)
 	if err != nil {
 		return err
@@ -336,6 +798,14 @@ func (db *LazyDB) decodeListKey(buf []byte) (key []byte, seq uint32) {
 	return key, seq
 }
 
+// initialListSeq returns the headSeq of an empty list.
+func (db *LazyDB) initialListSeq() uint32 {
+	if db.listInitSeq == 0 {
+		return initialListSeq
+	}
+	return db.listInitSeq
+}
+
 func (db *LazyDB) lSequence(headSeq uint32, tailSeq uint32, index int) (seq uint32, err error) {
 	if index >= 0 {
 		seq = headSeq + uint32(index) + 1
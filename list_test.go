@@ -1,8 +1,13 @@
 package lazydb
 
 import (
+	"github.com/billsjc123/LazyDB/logfile"
 	"github.com/stretchr/testify/assert"
+	"math"
+	"os"
+	"strconv"
 	"testing"
+	"time"
 )
 
 // LPush LPushX LPop RPush RPushX RPop
@@ -100,7 +105,7 @@ func TestLazyDB_LPop(t *testing.T) {
 	assert.Nil(t, err)
 	var values [][]byte
 	// pop when there are multi values
-	for db.LLen(listKey) > 0 {
+	for lLen(t, db, listKey) > 0 {
 		v, err := db.LPop(listKey)
 		assert.Nil(t, err)
 		values = append(values, v)
@@ -207,7 +212,7 @@ func TestLazyDB_RPop(t *testing.T) {
 	assert.Nil(t, err)
 	var values [][]byte
 	// pop when there are multi values
-	for db.LLen(listKey) > 0 {
+	for lLen(t, db, listKey) > 0 {
 		v, err := db.RPop(listKey)
 		assert.Nil(t, err)
 		values = append(values, v)
@@ -343,7 +348,7 @@ func TestLazyDB_LLen(t *testing.T) {
 	listKey := []byte("my_list")
 	err := db.LPush(listKey, []byte("a"), []byte("b"), []byte("c"))
 	assert.Nil(t, err)
-	assert.Equal(t, 3, db.LLen(listKey))
+	assert.Equal(t, 3, lLen(t, db, listKey))
 }
 
 func TestLazyDB_LRange(t *testing.T) {
@@ -401,6 +406,38 @@ func TestLazyDB_LRange(t *testing.T) {
 	}
 }
 
+func TestLazyDB_LGetAll(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	values, err := db.LGetAll([]byte("missing"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{}, values)
+
+	listKey := []byte("my_list")
+	assert.Nil(t, db.RPush(listKey, []byte("c"), []byte("d")))
+	assert.Nil(t, db.LPush(listKey, []byte("b"), []byte("a")))
+	assert.Nil(t, db.RPush(listKey, []byte("e")))
+	want := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")}
+	values, err = db.LGetAll(listKey)
+	assert.Nil(t, err)
+	assert.Equal(t, want, values)
+
+	// popped elements are not returned
+	_, err = db.LPop(listKey)
+	assert.Nil(t, err)
+	_, err = db.RPop(listKey)
+	assert.Nil(t, err)
+	values, err = db.LGetAll(listKey)
+	assert.Nil(t, err)
+	assert.Equal(t, want[1:4], values)
+
+	all, err := db.LRange(listKey, 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, all, values)
+}
+
 func TestLazyDB_LMove(t *testing.T) {
 	db := initTestDB()
 	defer destroyDB(db)
@@ -453,3 +490,325 @@ func TestLazyDB_LMove(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, v, []byte("d"))
 }
+
+func TestLazyDB_ListSeqRebalance(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	// head seq reaches 0
+	db.listInitSeq = 2
+	listKey := []byte("left_list")
+	assert.Nil(t, db.RPush(listKey, []byte("d"), []byte("e")))
+	assert.Nil(t, db.LPush(listKey, []byte("c"), []byte("b"), []byte("a")))
+	headSeq, tailSeq, err := db.lMeta(db.listIndex.trees[string(listKey)], listKey)
+	assert.Nil(t, err)
+	assert.True(t, headSeq > 0 && tailSeq < math.MaxUint32)
+	assert.Equal(t, 5, lLen(t, db, listKey))
+	values, err := db.LRange(listKey, 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")}, values)
+	// elements at old seqs are removed
+	assert.Equal(t, 6, db.listIndex.trees[string(listKey)].Size())
+
+	// tail seq reaches math.MaxUint32
+	db.listInitSeq = math.MaxUint32 - 3
+	listKey = []byte("right_list")
+	assert.Nil(t, db.LPush(listKey, []byte("b"), []byte("a")))
+	assert.Nil(t, db.RPush(listKey, []byte("c"), []byte("d"), []byte("e")))
+	assert.Equal(t, 5, lLen(t, db, listKey))
+	values, err = db.LRange(listKey, 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")}, values)
+
+	val, err := db.LPop(listKey)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), val)
+	val, err = db.RPop(listKey)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("e"), val)
+	assert.Equal(t, 3, lLen(t, db, listKey))
+}
+
+func TestLazyDB_ListRebalanceAtomic(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+
+	// the next LPush rebalances the list
+	db.listInitSeq = 2
+	listKey := []byte("atomic_list")
+	assert.Nil(t, db.RPush(listKey, []byte("c"), []byte("d")))
+	assert.Nil(t, db.LPush(listKey, []byte("b"), []byte("a")))
+	lf := db.getActiveLogFile(valueTypeList).lf
+	offset := lf.Offset
+	assert.Nil(t, db.LPush(listKey, []byte("z")))
+	values, err := db.LRange(listKey, 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("z"), []byte("a"), []byte("b"), []byte("c"), []byte("d")}, values)
+
+	// elements, delete entries and the metadata of the rebalance are written as a single committed transaction,
+	// followed by the pushed element and its metadata
+	var rebalanced []*logfile.LogEntry
+	for {
+		ent, size, err := lf.ReadLogEntry(offset)
+		if err != nil {
+			break
+		}
+		rebalanced = append(rebalanced, ent)
+		offset += int64(size)
+	}
+	pushed := rebalanced[len(rebalanced)-2:]
+	rebalanced = rebalanced[:len(rebalanced)-2]
+	for _, ent := range pushed {
+		assert.Equal(t, logfile.TxStatus(0), ent.TxStat)
+	}
+	assert.Equal(t, logfile.SListMeta, rebalanced[len(rebalanced)-1].Stat)
+	for _, ent := range rebalanced {
+		assert.Equal(t, logfile.TxUncommited, ent.TxStat)
+		assert.Equal(t, rebalanced[0].TxID, ent.TxID)
+		assert.False(t, db.txDiscarded(ent))
+	}
+
+	// without the commit marker, e.g. a crash in the middle, recovery discards all of them
+	delete(db.txCommits.committed, rebalanced[0].TxID)
+	for _, ent := range rebalanced {
+		assert.True(t, db.txDiscarded(ent))
+	}
+}
+
+func TestLazyDB_ListFirstPush(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+
+	values := func(vals ...string) [][]byte {
+		res := make([][]byte, len(vals))
+		for i, v := range vals {
+			res[i] = []byte(v)
+		}
+		return res
+	}
+	check := func(key []byte, want [][]byte) {
+		got, err := db.LRange(key, 0, -1)
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+		assert.Equal(t, len(want), lLen(t, db, key))
+		// every element is at its own seq, along with the metadata
+		assert.Equal(t, len(want)+1, db.listIndex.trees[string(key)].Size())
+	}
+
+	// created by LPush
+	assert.Nil(t, db.LPush([]byte("lpush_first"), []byte("b")))
+	headSeq, tailSeq, err := db.lMeta(db.listIndex.trees["lpush_first"], []byte("lpush_first"))
+	assert.Nil(t, err)
+	assert.Equal(t, initialListSeq-1, headSeq)
+	assert.Equal(t, initialListSeq+1, tailSeq)
+	assert.Nil(t, db.RPush([]byte("lpush_first"), []byte("c")))
+	assert.Nil(t, db.LPush([]byte("lpush_first"), []byte("a")))
+	check([]byte("lpush_first"), values("a", "b", "c"))
+
+	// created by RPush
+	assert.Nil(t, db.RPush([]byte("rpush_first"), []byte("b")))
+	headSeq, tailSeq, err = db.lMeta(db.listIndex.trees["rpush_first"], []byte("rpush_first"))
+	assert.Nil(t, err)
+	assert.Equal(t, initialListSeq, headSeq)
+	assert.Equal(t, initialListSeq+2, tailSeq)
+	assert.Nil(t, db.LPush([]byte("rpush_first"), []byte("a")))
+	assert.Nil(t, db.RPush([]byte("rpush_first"), []byte("c")))
+	check([]byte("rpush_first"), values("a", "b", "c"))
+
+	// a list emptied by pops starts over from the initial seqs
+	for _, key := range []string{"lpush_first", "rpush_first"} {
+		for i := 0; i < 3; i++ {
+			_, err = db.RPop([]byte(key))
+			assert.Nil(t, err)
+		}
+	}
+	assert.Nil(t, db.RPush([]byte("lpush_first"), []byte("y")))
+	assert.Nil(t, db.LPush([]byte("lpush_first"), []byte("x")))
+	check([]byte("lpush_first"), values("x", "y"))
+	assert.Nil(t, db.LPush([]byte("rpush_first"), []byte("x")))
+	assert.Nil(t, db.RPush([]byte("rpush_first"), []byte("y")))
+	check([]byte("rpush_first"), values("x", "y"))
+}
+
+func TestLazyDB_ListStats(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+
+	_, err := db.ListStats([]byte("missing"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	key := []byte("list_stats")
+	assert.Nil(t, db.RPush(key, []byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e"), []byte("f")))
+	assert.Nil(t, db.LPush(key, []byte("z")))
+	_, err = db.LPop(key)
+	assert.Nil(t, err)
+	_, err = db.RPop(key)
+	assert.Nil(t, err)
+	stats, err := db.ListStats(key)
+	assert.Nil(t, err)
+	assert.Equal(t, &ListStats{HeadSeq: initialListSeq, TailSeq: initialListSeq + 6, Len: 5}, stats)
+
+	// elements removed from the middle leave gaps
+	idxTree := db.listIndex.trees[string(key)]
+	idxTree.Delete(db.encodeListKey(key, initialListSeq+2))
+	idxTree.Delete(db.encodeListKey(key, initialListSeq+4))
+	stats, err = db.ListStats(key)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, stats.Len)
+	assert.Equal(t, 2, stats.Gaps)
+	assert.Equal(t, 5, lLen(t, db, key))
+}
+
+func TestLazyDB_BLPop(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	// times out on empty lists
+	start := time.Now()
+	_, _, err := db.BLPop(50*time.Millisecond, []byte("l1"), []byte("l2"))
+	assert.Equal(t, ErrTimeout, err)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	_, _, err = db.BLPop(time.Second)
+	assert.Equal(t, ErrInvalidParam, err)
+
+	// pops from the first non-empty list immediately
+	assert.Nil(t, db.RPush([]byte("l2"), []byte("a"), []byte("b")))
+	key, value, err := db.BLPop(time.Second, []byte("l1"), []byte("l2"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("l2"), key)
+	assert.Equal(t, []byte("a"), value)
+	key, value, err = db.BRPop(time.Second, []byte("l1"), []byte("l2"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("l2"), key)
+	assert.Equal(t, []byte("b"), value)
+
+	// unblocked by a push from another goroutine
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		assert.Nil(t, db.LPush([]byte("l3"), []byte("c")))
+		assert.Nil(t, db.RPush([]byte("l1"), []byte("d")))
+	}()
+	start = time.Now()
+	key, value, err = db.BRPop(5*time.Second, []byte("l1"), []byte("l2"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("l1"), key)
+	assert.Equal(t, []byte("d"), value)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, 0, lLen(t, db, []byte("l1")))
+	assert.Equal(t, 1, lLen(t, db, []byte("l3")))
+	assert.Empty(t, db.listIndex.waiters)
+}
+
+func TestLazyDB_LMPop(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	keys := [][]byte{[]byte("l1"), []byte("l2"), []byte("l3")}
+	_, _, err := db.LMPop(2, keys, true, 1)
+	assert.Equal(t, ErrInvalidParam, err)
+	_, _, err = db.LMPop(3, keys, true, 0)
+	assert.Equal(t, ErrInvalidParam, err)
+
+	// nil key if all of the lists are empty
+	key, values, err := db.LMPop(3, keys, true, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, key)
+	assert.Nil(t, values)
+
+	// the first non-empty list is chosen
+	assert.Nil(t, db.RPush(keys[1], []byte("a"), []byte("b"), []byte("c")))
+	assert.Nil(t, db.RPush(keys[2], []byte("x")))
+	key, values, err = db.LMPop(3, keys, true, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, keys[1], key)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, values)
+
+	// no more than the length of the list
+	key, values, err = db.LMPop(3, keys, false, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, keys[1], key)
+	assert.Equal(t, [][]byte{[]byte("c")}, values)
+	assert.Equal(t, 0, lLen(t, db, keys[1]))
+
+	key, values, err = db.LMPop(3, keys, false, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, keys[2], key)
+	assert.Equal(t, [][]byte{[]byte("x")}, values)
+}
+
+func TestLazyDB_BLPopClose(t *testing.T) {
+	db := initTestDB()
+	defer os.RemoveAll(db.cfg.DBPath)
+	assert.NotNil(t, db)
+
+	errCh := make(chan error)
+	go func() {
+		_, _, err := db.BLPop(time.Minute, []byte("l1"))
+		errCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, db.Close())
+	select {
+	case err := <-errCh:
+		assert.Equal(t, ErrDatabaseClosed, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("BLPop is not woken up by Close")
+	}
+}
+
+func TestLazyDB_LRangeFunc(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	listKey := []byte("my_list")
+	const n = 1000
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.RPush(listKey, []byte(strconv.Itoa(i))))
+	}
+
+	sum := func(start, stop int) (int, int) {
+		var total, count int
+		err := db.LRangeFunc(listKey, start, stop, func(index int, value []byte) bool {
+			v, err := strconv.Atoi(string(value))
+			assert.Nil(t, err)
+			assert.Equal(t, v, index)
+			total += v
+			count++
+			return true
+		})
+		assert.Nil(t, err)
+		return total, count
+	}
+	total, count := sum(0, -1)
+	assert.Equal(t, n*(n-1)/2, total)
+	assert.Equal(t, n, count)
+	// negative indexes follow LRange
+	total, count = sum(-10, -1)
+	assert.Equal(t, 990*10+45, total)
+	assert.Equal(t, 10, count)
+
+	// stops early
+	var visited []int
+	err := db.LRangeFunc(listKey, 5, -1, func(index int, value []byte) bool {
+		visited = append(visited, index)
+		return len(visited) < 3
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{5, 6, 7}, visited)
+
+	err = db.LRangeFunc([]byte("missing"), 0, -1, func(int, []byte) bool { return true })
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = db.LRangeFunc(listKey, 5, 2, func(int, []byte) bool { return true })
+	assert.Equal(t, ErrWrongIndex, err)
+}
+
+// lLen returns LLen of key, asserting no error is returned.
+func lLen(t *testing.T, db *LazyDB, key []byte) int {
+	n, err := db.LLen(key)
+	assert.Nil(t, err)
+	return n
+}
@@ -0,0 +1,167 @@
+package lazydb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/billsjc123/LazyDB/util"
+	"sort"
+	"time"
+)
+
+// lockTokenSize is the number of random bytes of a lock token.
+const lockTokenSize = 16
+
+// keyLockStripes is the number of mutexes shared by all keys locked by Lock.
+const keyLockStripes = 256
+
+// AcquireLock acquires the lock named name if it is not held by others, the lock is a key of type String.
+// It returns the token of the lock and true if the lock is acquired, the token is needed to release the lock.
+// The lock is released automatically after ttl in case the holder never releases it.
+func (db *LazyDB) AcquireLock(name []byte, ttl time.Duration) ([]byte, bool, error) {
+	if err := db.checkAccess(OpWrite, name); err != nil {
+		return nil, false, err
+	}
+	if ttl <= 0 {
+		return nil, false, ErrInvalidParam
+	}
+	buf := make([]byte, lockTokenSize)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, false, err
+	}
+	token := make([]byte, hex.EncodedLen(lockTokenSize))
+	hex.Encode(token, buf)
+
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	_, err := db.getValue(db.strIndex.idxTree, name, valueTypeString)
+	if err == nil {
+		return nil, false, nil
+	}
+	if !errors.Is(err, ErrKeyNotFound) {
+		return nil, false, err
+	}
+	entry := &logfile.LogEntry{Key: name, Value: token, ExpiredAt: db.now().Add(ttl).UnixMilli()}
+	valuePos, err := db.writeLogEntry(valueTypeString, entry)
+	if err != nil {
+		return nil, false, err
+	}
+	if err = db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valuePos, true); err != nil {
+		return nil, false, err
+	}
+	return token, true, nil
+}
+
+// ReleaseLock releases the lock named name only if it is held by token, and returns whether it is released.
+// It returns false if the lock has expired or been acquired by others.
+func (db *LazyDB) ReleaseLock(name, token []byte) (bool, error) {
+	if err := db.checkAccess(OpWrite, name); err != nil {
+		return false, err
+	}
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	val, err := db.getValue(db.strIndex.idxTree, name, valueTypeString)
+	if errors.Is(err, ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(val, token) {
+		return false, nil
+	}
+	if err = db.deleteStr(name); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Lock locks key in process and returns the function to unlock it, so that callers can serialize
+// their own read-modify-write sequences across multiple operations, e.g. Get then Set.
+// It is only advisory: operations of the db never take it, so every writer of key must call Lock.
+//
+// Keys are hashed into a fixed number of mutexes to bound memory, so different keys may share a mutex,
+// and locking a key while holding another one may deadlock even if they are different.
+// Use LockKeys to hold several keys at the same time.
+func (db *LazyDB) Lock(key []byte) func() {
+	mu := &db.keyLocks[keyLockStripe(key)]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// LockKeys is like Lock, but locks all keys at once and returns the function to unlock them.
+// Mutexes are acquired in sorted order, so that callers locking overlapping keys never deadlock.
+func (db *LazyDB) LockKeys(keys ...[]byte) func() {
+	stripes := make([]int, 0, len(keys))
+	seen := make(map[int]struct{}, len(keys))
+	for _, key := range keys {
+		stripe := keyLockStripe(key)
+		if _, ok := seen[stripe]; ok {
+			continue
+		}
+		seen[stripe] = struct{}{}
+		stripes = append(stripes, stripe)
+	}
+	sort.Ints(stripes)
+	for _, stripe := range stripes {
+		db.keyLocks[stripe].Lock()
+	}
+	return func() {
+		for i := len(stripes) - 1; i >= 0; i-- {
+			db.keyLocks[stripes[i]].Unlock()
+		}
+	}
+}
+
+func keyLockStripe(key []byte) int {
+	return int(util.MemHash(key) % keyLockStripes)
+}
+
+// lockIndexes locks indexes of types in order of type, and returns the function to unlock them in reverse order.
+// Operations holding indexes of several types at once must lock them by it, so that they never deadlock with each
+// other whatever order types are given in. Repeated types are locked once.
+func (db *LazyDB) lockIndexes(types ...valueType) func() {
+	types = sortedTypes(types)
+	for _, typ := range types {
+		db.getIndexLock(typ).Lock()
+	}
+	return func() {
+		for i := len(types) - 1; i >= 0; i-- {
+			db.getIndexLock(types[i]).Unlock()
+		}
+	}
+}
+
+// rlockIndexes is like lockIndexes, but read locks the indexes.
+func (db *LazyDB) rlockIndexes(types ...valueType) func() {
+	types = sortedTypes(types)
+	for _, typ := range types {
+		db.getIndexLock(typ).RLock()
+	}
+	return func() {
+		for i := len(types) - 1; i >= 0; i-- {
+			db.getIndexLock(types[i]).RUnlock()
+		}
+	}
+}
+
+// sortedTypes returns a sorted copy of types without repeated ones.
+func sortedTypes(types []valueType) []valueType {
+	sorted := make([]valueType, 0, len(types))
+	seen := make(map[valueType]struct{}, len(types))
+	for _, typ := range types {
+		if _, ok := seen[typ]; ok {
+			continue
+		}
+		seen[typ] = struct{}{}
+		sorted = append(sorted, typ)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	return sorted
+}
@@ -0,0 +1,181 @@
+package lazydb
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_AcquireLock(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	_, _, err := db.AcquireLock([]byte("lock"), 0)
+	assert.Equal(t, ErrInvalidParam, err)
+
+	var wg sync.WaitGroup
+	tokens := make(chan []byte, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, ok, err := db.AcquireLock([]byte("lock"), time.Minute)
+			assert.Nil(t, err)
+			if ok {
+				tokens <- token
+			}
+		}()
+	}
+	wg.Wait()
+	close(tokens)
+	var winners [][]byte
+	for token := range tokens {
+		winners = append(winners, token)
+	}
+	assert.Equal(t, 1, len(winners))
+
+	// acquire again after release
+	ok, err := db.ReleaseLock([]byte("lock"), winners[0])
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, ok, err = db.AcquireLock([]byte("lock"), time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestLazyDB_ReleaseLock(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+
+	ok, err := db.ReleaseLock([]byte("lock"), []byte("token"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	token, ok, err := db.AcquireLock([]byte("lock"), time.Second)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// wrong token
+	ok, err = db.ReleaseLock([]byte("lock"), []byte("token"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	_, ok, err = db.AcquireLock([]byte("lock"), time.Second)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// the lock expires, and is acquired by another holder
+	now = now.Add(2 * time.Second)
+	newToken, ok, err := db.AcquireLock([]byte("lock"), time.Second)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.NotEqual(t, token, newToken)
+	ok, err = db.ReleaseLock([]byte("lock"), token)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	ok, err = db.ReleaseLock([]byte("lock"), newToken)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestLazyDB_Lock(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("counter")
+	assert.Nil(t, db.Set(key, []byte("0")))
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				unlock := db.Lock(key)
+				val, err := db.Get(key)
+				assert.Nil(t, err)
+				n, _ := strconv.Atoi(string(val))
+				assert.Nil(t, db.Set(key, []byte(strconv.Itoa(n+1))))
+				unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("500"), val)
+}
+
+func TestLazyDB_LockKeys(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	// locking overlapping keys in different order does not deadlock
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				var unlock func()
+				if i%2 == 0 {
+					unlock = db.LockKeys(GetKey(1), GetKey(2), GetKey(1))
+				} else {
+					unlock = db.LockKeys(GetKey(2), GetKey(1))
+				}
+				unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// keys are unlocked
+	unlock := db.Lock(GetKey(1))
+	unlock()
+}
+
+func TestLazyDB_LockIndexes(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	// types given in opposite orders, or repeated, must not deadlock
+	orders := [][]valueType{
+		{valueTypeString, valueTypeHash, valueTypeSet},
+		{valueTypeSet, valueTypeHash, valueTypeString, valueTypeSet},
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				unlock := db.lockIndexes(orders[i%2]...)
+				unlock()
+				runlock := db.rlockIndexes(orders[(i+1)%2]...)
+				runlock()
+			}
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlock locking indexes")
+	}
+}
@@ -0,0 +1,206 @@
+package logfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+var (
+	// ErrNoFooter there is no valid footer after the entries of the log file.
+	ErrNoFooter = errors.New("logfile: no footer")
+
+	// ErrFooterNoSpace the footer does not fit in the rest of the log file.
+	ErrFooterNoSpace = errors.New("logfile: no space for footer")
+
+	// ErrFooterMismatch entries of the log file do not match its footer, the log file is corrupted.
+	ErrFooterMismatch = errors.New("logfile: entries mismatch footer")
+)
+
+// A footer is written right after the last entry, it starts with footerZeros zero bytes, which are decoded as
+// the end of entries by ReadLogEntry, so that readers of entries stop before it:
+//
+//	zeros | magic | payload size uint32 | payload | crc32 of payload uint32
+//
+// the payload is Entries, DataSize as uvarints, MinKey and MaxKey prefixed by uvarint sizes and Checksum uint32.
+const (
+	footerZeros  = 10
+	footerMagic  = "LZFT"
+	footerPrefix = footerZeros + len(footerMagic) + 4
+	// maxFooterPayload bounds the payload read, keys in footers are at most this large
+	maxFooterPayload = 1 << 20
+)
+
+// Footer describes the entries of a sealed log file, so that it can be validated without decoding every entry.
+// Footers are accumulated by Add while entries are written.
+type Footer struct {
+	Entries  uint64 // number of entries
+	DataSize int64  // total size of entries, including padding, the footer starts there
+	MinKey   []byte // the min key of entries in order of bytes
+	MaxKey   []byte // the max key of entries in order of bytes
+	Checksum uint32 // crc32 of all bytes of entries
+}
+
+// Add adds the entry of key encoded in buf, which is written right after the entries added before.
+func (f *Footer) Add(key []byte, buf []byte) {
+	if f.Entries == 0 || bytes.Compare(key, f.MinKey) < 0 {
+		f.MinKey = append(f.MinKey[:0], key...)
+	}
+	if f.Entries == 0 || bytes.Compare(key, f.MaxKey) > 0 {
+		f.MaxKey = append(f.MaxKey[:0], key...)
+	}
+	f.Entries++
+	f.DataSize += int64(len(buf))
+	f.Checksum = crc32.Update(f.Checksum, crc32.IEEETable, buf)
+}
+
+func (f *Footer) encode() []byte {
+	size := footerPrefix + 4*binary.MaxVarintLen64 + len(f.MinKey) + len(f.MaxKey) + 8
+	buf := make([]byte, size)
+	copy(buf[footerZeros:], footerMagic)
+	offset := footerPrefix
+	offset += binary.PutUvarint(buf[offset:], f.Entries)
+	offset += binary.PutUvarint(buf[offset:], uint64(f.DataSize))
+	offset += binary.PutUvarint(buf[offset:], uint64(len(f.MinKey)))
+	offset += copy(buf[offset:], f.MinKey)
+	offset += binary.PutUvarint(buf[offset:], uint64(len(f.MaxKey)))
+	offset += copy(buf[offset:], f.MaxKey)
+	binary.LittleEndian.PutUint32(buf[offset:], f.Checksum)
+	offset += 4
+
+	payload := buf[footerPrefix:offset]
+	binary.LittleEndian.PutUint32(buf[footerZeros+len(footerMagic):], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[offset:], crc32.ChecksumIEEE(payload))
+	return buf[:offset+4]
+}
+
+func decodeFooter(payload []byte) (*Footer, bool) {
+	f := &Footer{}
+	var n int
+	if f.Entries, n = binary.Uvarint(payload); n <= 0 {
+		return nil, false
+	}
+	payload = payload[n:]
+	dataSize, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return nil, false
+	}
+	f.DataSize, payload = int64(dataSize), payload[n:]
+	for _, key := range []*[]byte{&f.MinKey, &f.MaxKey} {
+		size, n := binary.Uvarint(payload)
+		if n <= 0 || uint64(len(payload)-n) < size {
+			return nil, false
+		}
+		*key, payload = payload[n:n+int(size)], payload[n+int(size):]
+	}
+	if len(payload) != 4 {
+		return nil, false
+	}
+	f.Checksum = binary.LittleEndian.Uint32(payload)
+	return f, true
+}
+
+// WriteFooter writes footer f after the last entry of the log file, the offset of the log file is not moved,
+// so that entries written later overwrite it, see ClearFooter. f.DataSize must be the offset.
+// A log file of FileIO is extended if the footer does not fit in it, and ErrFooterNoSpace is returned for Mmap.
+func (lf *LogFile) WriteFooter(f *Footer) error {
+	if f.DataSize != lf.Offset {
+		return ErrFooterMismatch
+	}
+	buf := f.encode()
+	if lf.ioType != FileIO && lf.Offset+int64(len(buf)) > lf.fsize {
+		return ErrFooterNoSpace
+	}
+	size, err := lf.IoController.Write(buf, lf.Offset)
+	if err != nil {
+		return err
+	}
+	if size != len(buf) {
+		return ErrWriteSizeNotEqual
+	}
+	return nil
+}
+
+// ReadFooter reads the footer after the last entry of the log file, ErrNoFooter is returned if there is no valid one.
+func (lf *LogFile) ReadFooter() (*Footer, error) {
+	f, _, err := lf.readFooter()
+	return f, err
+}
+
+// readFooter returns the footer and its size.
+func (lf *LogFile) readFooter() (*Footer, int, error) {
+	prefix := make([]byte, footerPrefix)
+	if _, err := lf.IoController.Read(prefix, lf.Offset); err != nil {
+		if err == io.EOF {
+			return nil, 0, ErrNoFooter
+		}
+		return nil, 0, err
+	}
+	if !bytes.Equal(prefix[:footerZeros], make([]byte, footerZeros)) ||
+		string(prefix[footerZeros:footerZeros+len(footerMagic)]) != footerMagic {
+		return nil, 0, ErrNoFooter
+	}
+	size := binary.LittleEndian.Uint32(prefix[footerZeros+len(footerMagic):])
+	if size > maxFooterPayload {
+		return nil, 0, ErrNoFooter
+	}
+	buf := make([]byte, size+4)
+	if _, err := lf.IoController.Read(buf, lf.Offset+int64(footerPrefix)); err != nil {
+		if err == io.EOF {
+			return nil, 0, ErrNoFooter
+		}
+		return nil, 0, err
+	}
+	payload := buf[:size]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(buf[size:]) {
+		return nil, 0, ErrNoFooter
+	}
+	f, ok := decodeFooter(payload)
+	if !ok || f.DataSize != lf.Offset {
+		return nil, 0, ErrNoFooter
+	}
+	return f, footerPrefix + len(buf), nil
+}
+
+// VerifyFooter reads the footer and checks all bytes of entries against its checksum, which is much faster than
+// decoding entries one by one. ErrNoFooter is returned if there is no valid footer, and ErrFooterMismatch
+// if the entries are corrupted.
+func (lf *LogFile) VerifyFooter() (*Footer, error) {
+	f, err := lf.ReadFooter()
+	if err != nil {
+		return nil, err
+	}
+	var crc uint32
+	buf := make([]byte, 64<<10)
+	for offset := int64(0); offset < f.DataSize; {
+		n := int64(len(buf))
+		if rest := f.DataSize - offset; rest < n {
+			n = rest
+		}
+		if _, err := lf.IoController.Read(buf[:n], offset); err != nil {
+			return nil, err
+		}
+		crc = crc32.Update(crc, crc32.IEEETable, buf[:n])
+		offset += n
+	}
+	if crc != f.Checksum {
+		return nil, ErrFooterMismatch
+	}
+	return f, nil
+}
+
+// ClearFooter zeroes the footer after the last entry of the log file if there is one, it must be called before
+// writing more entries into a log file with a footer, so that the rest of the footer is not read as entries.
+func (lf *LogFile) ClearFooter() error {
+	_, size, err := lf.readFooter()
+	if err == ErrNoFooter {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = lf.IoController.Write(make([]byte, size), lf.Offset)
+	return err
+}
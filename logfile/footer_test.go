@@ -0,0 +1,74 @@
+package logfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogFile_Footer(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_log_file_footer")
+	err := os.MkdirAll(path, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(path)
+
+	lf, err := Open(path, 1, 1024, Strs, FileIO)
+	assert.Nil(t, err)
+	defer lf.Close()
+
+	_, err = lf.ReadFooter()
+	assert.Equal(t, ErrNoFooter, err)
+
+	footer := &Footer{}
+	for _, key := range []string{"b", "c", "a", "b"} {
+		buf, _ := EncodeEntry(&LogEntry{Key: []byte(key), Value: []byte("value")})
+		assert.Nil(t, lf.Write(buf))
+		footer.Add([]byte(key), buf)
+	}
+	assert.Nil(t, lf.WriteFooter(footer))
+
+	// readers of entries stop before the footer
+	_, _, err = lf.ReadLogEntry(lf.Offset)
+	assert.Equal(t, ErrLogEndOfFile, err)
+
+	got, err := lf.VerifyFooter()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), got.Entries)
+	assert.Equal(t, lf.Offset, got.DataSize)
+	assert.Equal(t, []byte("a"), got.MinKey)
+	assert.Equal(t, []byte("c"), got.MaxKey)
+	assert.Equal(t, footer.Checksum, got.Checksum)
+
+	// corrupt a byte of the value of the last entry
+	_, err = lf.IoController.Write([]byte{'V'}, lf.Offset-1)
+	assert.Nil(t, err)
+	_, err = lf.VerifyFooter()
+	assert.Equal(t, ErrFooterMismatch, err)
+
+	assert.Nil(t, lf.ClearFooter())
+	_, err = lf.ReadFooter()
+	assert.Equal(t, ErrNoFooter, err)
+	_, _, err = lf.ReadLogEntry(lf.Offset)
+	assert.Equal(t, ErrLogEndOfFile, err)
+
+	// a full log file is extended for the footer unless it is memory mapped
+	for _, ioType := range []IOType{FileIO, Mmap} {
+		full, err := Open(path, 2+uint32(ioType), 32, Strs, ioType)
+		assert.Nil(t, err)
+		buf, _ := EncodeEntry(&LogEntry{Key: []byte("a"), Value: []byte("value")})
+		assert.Nil(t, full.Write(buf))
+		footer = &Footer{}
+		footer.Add([]byte("a"), buf)
+		if ioType == FileIO {
+			assert.Nil(t, full.WriteFooter(footer))
+			_, err = full.VerifyFooter()
+			assert.Nil(t, err)
+		} else {
+			assert.Equal(t, ErrFooterNoSpace, full.WriteFooter(footer))
+		}
+		assert.Nil(t, full.Close())
+	}
+}
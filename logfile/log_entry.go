@@ -2,9 +2,18 @@ package logfile
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/billsjc123/LazyDB/util"
 )
 
+// ErrUnsupportedVersion entry is encoded by a newer version.
+var ErrUnsupportedVersion = errors.New("logfile: unsupported entry version")
+
 // Status of LogEntry.
 type Status uint8
 
@@ -13,8 +22,38 @@ const (
 	SDelete Status = iota + 1
 	// SListMeta represents entry is list meta.
 	SListMeta
+	// SPacked represents entry holds all fields and values of a small hash.
+	SPacked
+	// SValueBlob represents entry holds a value shared by keys, the key of the entry is the hash of the value.
+	SValueBlob
+	// SValueRef represents entry references a value shared by keys, the value of the entry is its hash.
+	SValueRef
+	// SPadded represents entry holds a value followed by padding reserved for it to grow in place,
+	// the value of the entry is the length of the value in 4 bytes, the value and the padding.
+	SPadded
 )
 
+func (s Status) String() string {
+	switch s {
+	case 0:
+		return "normal"
+	case SDelete:
+		return "delete"
+	case SListMeta:
+		return "list-meta"
+	case SPacked:
+		return "packed"
+	case SValueBlob:
+		return "value-blob"
+	case SValueRef:
+		return "value-ref"
+	case SPadded:
+		return "padded"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(s))
+	}
+}
+
 // TxStatus of LogEntry
 type TxStatus uint16
 
@@ -25,16 +64,80 @@ const (
 	TxUncommited
 )
 
+func (s TxStatus) String() string {
+	switch s {
+	case 0:
+		return "none"
+	case TxCommited:
+		return "committed"
+	case TxUncommited:
+		return "uncommitted"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint16(s))
+	}
+}
+
+// ChecksumType the algorithm of the checksum of LogEntry, it is recorded in the header of every entry.
+type ChecksumType uint8
+
+const (
+	// ChecksumCRC32 crc32 of IEEE, the default one.
+	ChecksumCRC32 ChecksumType = iota
+	// ChecksumNone no checksum, corrupted entries can't be detected.
+	ChecksumNone
+	// ChecksumXXHash the lower 32 bits of 64-bit xxHash, which is faster than crc32 for large values
+	// on platforms without hardware acceleration of crc32.
+	ChecksumXXHash
+)
+
+func (c ChecksumType) String() string {
+	switch c {
+	case ChecksumCRC32:
+		return "crc32"
+	case ChecksumNone:
+		return "none"
+	case ChecksumXXHash:
+		return "xxhash"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(c))
+	}
+}
+
+// maxPreviewSize max number of bytes of key or value shown by String.
+const maxPreviewSize = 32
+
 // MaxHeaderSize max entry header size.
-// 4    +    1    +    10    +    10    +    3    +    5    +    5   =   38
-// crc     stat     ExpiredAt   TxID     TxStatus   kSize    vSize
+// 4    +    1    +    1    +    10    +    10    +    10    +    10    +    3    +    5    +    5   =   59
+// crc    version    stat     Version   WrittenAt  ExpiredAt   TxID     TxStatus   kSize    vSize
 // (refer to binary.MaxVarintLen32 and binary.MaxVarintLen64)
-const MaxHeaderSize = 25
+// Version is only encoded in entries of entryVersionVersioned and entryVersionTimestamped,
+// and WrittenAt is only encoded in entries of entryVersionTimestamped.
+const MaxHeaderSize = 46
+
+const (
+	// entryVersionLegacy entries written before the version byte was introduced, they have no version byte.
+	entryVersionLegacy uint8 = 0
+	// EntryVersion current version of the entry encoding.
+	EntryVersion uint8 = 1
+	// entryVersionVersioned entries with a non-zero Version, which is encoded after the stat byte.
+	entryVersionVersioned uint8 = 2
+	// entryVersionTimestamped entries with a non-zero WrittenAt, which is encoded after Version.
+	entryVersionTimestamped uint8 = 3
+	// maxEntryVersion the newest version which can be decoded.
+	maxEntryVersion = entryVersionTimestamped
+
+	// versionFlag is set in the version byte, so that it can be distinguished from the stat byte of legacy entries.
+	versionFlag byte = 0x80
+	// the lower 4 bits of the version byte is the version, and the following 3 bits is the ChecksumType.
+	versionMask     byte = 0x0f
+	checksumShift        = 4
+	maxChecksumType      = ChecksumXXHash
+)
 
 // LogEntry is the data will be appended in log file.
 type LogEntry struct {
-	crc       uint32   // crc32 --check sum
-	ExpiredAt int64    // expire time
+	crc       uint32   // check sum, see Checksum
+	ExpiredAt int64    // expire time in unix milliseconds, unix seconds in older versions
 	Stat      Status   // delete or list meta
 	TxID      uint64   // transaction id
 	TxStat    TxStatus // committed / uncommitted
@@ -42,6 +145,57 @@ type LogEntry struct {
 	vSize     uint32   // value size
 	Key       []byte   // key
 	Value     []byte   // value
+	version   uint8    // encoding version
+
+	// Version orders writes of the same key regardless of their positions in log files, the greater one is newer.
+	// Zero means the entry is not versioned, see entryVersionVersioned.
+	Version uint64
+
+	// WrittenAt is when the entry was written first in unix milliseconds, it is kept when the entry is rewritten,
+	// e.g. by merge. Zero means it is not recorded, see entryVersionTimestamped.
+	WrittenAt int64
+
+	// Checksum the algorithm used to compute the check sum. It is set by the caller before encoding,
+	// and decoded from the header when reading. Legacy entries always use ChecksumCRC32.
+	Checksum ChecksumType
+}
+
+// String returns a human-readable summary of the entry for debugging.
+// Key and value are truncated, and non-printable bytes are hex-escaped.
+func (le *LogEntry) String() string {
+	if le == nil {
+		return "LogEntry<nil>"
+	}
+	return fmt.Sprintf("LogEntry{key=%s keySize=%d value=%s valueSize=%d stat=%s expiredAt=%d txID=%d txStat=%s}",
+		previewBytes(le.Key), len(le.Key), previewBytes(le.Value), len(le.Value),
+		le.Stat, le.ExpiredAt, le.TxID, le.TxStat)
+}
+
+// previewBytes returns a quoted preview of b for debugging, it is truncated to 32 bytes.
+// Printable ASCII characters are kept, and the others are hex-escaped like \x00.
+func previewBytes(b []byte) string {
+	if b == nil {
+		return "<nil>"
+	}
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i, c := range b {
+		if i == maxPreviewSize {
+			sb.WriteString("...")
+			break
+		}
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c >= 0x20 && c < 0x7f:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "\\x%02x", c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
 }
 
 // EncodeEntry encodes LogEntry into binary form, returns binary LogEntry and the size of LogEntry.
@@ -51,9 +205,23 @@ func EncodeEntry(le *LogEntry) ([]byte, int) {
 	}
 	var size = MaxHeaderSize
 	buf := make([]byte, size)
-	buf[4] = byte(le.Stat)
+	version := EntryVersion
+	switch {
+	case le.WrittenAt != 0:
+		version = entryVersionTimestamped
+	case le.Version != 0:
+		version = entryVersionVersioned
+	}
+	buf[4] = versionFlag | byte(le.Checksum)<<checksumShift | version
+	buf[5] = byte(le.Stat)
 
-	offset := 5
+	offset := 6
+	if version != EntryVersion {
+		offset += binary.PutUvarint(buf[offset:], le.Version)
+	}
+	if version == entryVersionTimestamped {
+		offset += binary.PutVarint(buf[offset:], le.WrittenAt)
+	}
 	expiredAtByte := binary.PutVarint(buf[offset:], le.ExpiredAt)
 	offset += expiredAtByte
 	txIDByte := binary.PutVarint(buf[offset:], int64(le.TxID))
@@ -72,21 +240,95 @@ func EncodeEntry(le *LogEntry) ([]byte, int) {
 	copy(newBuf[offset:], le.Key)
 	copy(newBuf[offset+len(le.Key):], le.Value)
 
-	crc := crc32.ChecksumIEEE(newBuf[4:])
-	binary.LittleEndian.PutUint32(newBuf[:4], crc)
+	binary.LittleEndian.PutUint32(newBuf[:4], checksum(le.Checksum, newBuf[4:]))
 	return newBuf, size
 }
 
+// EncodeEntryAligned is like EncodeEntry, but the binary LogEntry is padded with zeros
+// to a multiple of align if align is positive. The returned size includes the padding.
+func EncodeEntryAligned(le *LogEntry, align int64) ([]byte, int) {
+	buf, size := EncodeEntry(le)
+	if aligned := AlignSize(size, align); aligned > size {
+		newBuf := make([]byte, aligned)
+		copy(newBuf, buf)
+		buf, size = newBuf, aligned
+	}
+	return buf, size
+}
+
+// AlignSize rounds size up to a multiple of align, size is returned directly if align is not positive.
+func AlignSize(size int, align int64) int {
+	if align <= 0 {
+		return size
+	}
+	a := int(align)
+	return (size + a - 1) / a * a
+}
+
+// DecodeEntry decodes a binary LogEntry encoded by EncodeEntry from the start of buf, e.g. one returned by
+// LogFile.ReadRawLogEntry. It returns LogEntry whose Key and Value alias buf, and the size of the entry without
+// padding. ErrInvalidCrc is returned if the check sum does not match, and io.ErrUnexpectedEOF if buf is too short.
+func DecodeEntry(buf []byte) (*LogEntry, int, error) {
+	le, size := decodeHeader(buf)
+	if le == nil || size <= 0 || size > len(buf) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if le.version > maxEntryVersion || le.Checksum > maxChecksumType {
+		return nil, 0, ErrUnsupportedVersion
+	}
+	kSize, vSize := int(le.kSize), int(le.vSize)
+	if kSize < 0 || vSize < 0 || len(buf)-size < kSize+vSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	le.Key = buf[size : size+kSize : size+kSize]
+	le.Value = buf[size+kSize : size+kSize+vSize : size+kSize+vSize]
+	if crc := getEntryChecksum(buf[:size], le); crc != le.crc {
+		return nil, 0, ErrInvalidCrc
+	}
+	return le, size + kSize + vSize, nil
+}
+
 // decodeHeader decodes header from a bytes array to LogEntry struct, returns LogEntry and offset.
+// Offset will be 0 if the version of entry is not supported.
 func decodeHeader(buf []byte) (*LogEntry, int) {
 	if len(buf) <= 4 {
 		return nil, 0
 	}
 	le := &LogEntry{}
 	le.crc = binary.LittleEndian.Uint32(buf[0:4])
-	le.Stat = Status(buf[4])
+	if buf[4]&versionFlag == 0 {
+		le.version = entryVersionLegacy
+		le.Stat = Status(buf[4])
+		return le, decodeHeaderFields(buf, 5, le)
+	}
 
-	offset := 5
+	le.version = buf[4] & versionMask
+	le.Checksum = ChecksumType((buf[4] &^ versionFlag) >> checksumShift)
+	switch le.version {
+	case EntryVersion, entryVersionVersioned, entryVersionTimestamped:
+		if len(buf) <= 5 {
+			return nil, 0
+		}
+		le.Stat = Status(buf[5])
+		offset := 6
+		if le.version != EntryVersion {
+			version, size := binary.Uvarint(buf[offset:])
+			le.Version = version
+			offset += size
+		}
+		if le.version == entryVersionTimestamped {
+			writtenAt, size := binary.Varint(buf[offset:])
+			le.WrittenAt = writtenAt
+			offset += size
+		}
+		return le, decodeHeaderFields(buf, offset, le)
+	default:
+		return le, 0
+	}
+}
+
+// decodeHeaderFields decodes the varint fields of header starting at offset, returns the end offset of header.
+func decodeHeaderFields(buf []byte, offset int, le *LogEntry) int {
 	expiredAt, size := binary.Varint(buf[offset:])
 	le.ExpiredAt = expiredAt
 	offset += size
@@ -103,19 +345,34 @@ func decodeHeader(buf []byte) (*LogEntry, int) {
 	le.vSize = uint32(vSize)
 	offset += size
 
-	return le, offset
+	return offset
 }
 
-// getEntryCrc get the crc32 from the header without crc part, as well as the key and the value .
-func getEntryCrc(buf []byte, le *LogEntry) uint32 {
-	if len(buf) <= 4 {
+// checksum computes the check sum of data by algorithm c.
+func checksum(c ChecksumType, data ...[]byte) uint32 {
+	switch c {
+	case ChecksumNone:
 		return 0
+	case ChecksumXXHash:
+		h := util.NewXXHash64()
+		for _, d := range data {
+			h.Write(d)
+		}
+		return uint32(h.Sum64())
+	default:
+		var crc uint32
+		for _, d := range data {
+			crc = crc32.Update(crc, crc32.IEEETable, d)
+		}
+		return crc
 	}
-	if le == nil {
+}
+
+// getEntryChecksum get the check sum from the header without crc part, as well as the key and the value,
+// by the algorithm recorded in the header.
+func getEntryChecksum(buf []byte, le *LogEntry) uint32 {
+	if len(buf) <= 4 || le == nil {
 		return 0
 	}
-	crc := crc32.ChecksumIEEE(buf[4:])
-	crc = crc32.Update(crc, crc32.IEEETable, le.Key)
-	crc = crc32.Update(crc, crc32.IEEETable, le.Value)
-	return crc
+	return checksum(le.Checksum, buf[4:], le.Key, le.Value)
 }
@@ -19,16 +19,16 @@ func TestEncodeEntry(t *testing.T) {
 			"nil", args{e: nil}, nil, 0,
 		},
 		{
-			"crc", args{&LogEntry{crc: 1696784233}}, []byte{163, 161, 194, 177, 0, 0, 0, 0, 0, 0}, 10,
+			"crc", args{&LogEntry{crc: 1696784233}}, []byte{56, 62, 13, 179, 129, 0, 0, 0, 0, 0, 0}, 11,
 		},
 		{
-			"no_content", args{&LogEntry{}}, []byte{163, 161, 194, 177, 0, 0, 0, 0, 0, 0}, 10,
+			"no_content", args{&LogEntry{}}, []byte{56, 62, 13, 179, 129, 0, 0, 0, 0, 0, 0}, 11,
 		},
 		{
-			"expiredAt_key_value", args{&LogEntry{ExpiredAt: 1676969769, Stat: SListMeta, TxID: 11111111, TxStat: TxUncommited, Key: []byte("a"), Value: []byte("abc")}}, []byte{17, 148, 49, 87, 2, 210, 156, 164, 191, 12, 142, 171, 204, 10, 4, 2, 6, 97, 97, 98, 99}, 21,
+			"expiredAt_key_value", args{&LogEntry{ExpiredAt: 1676969769, Stat: SListMeta, TxID: 11111111, TxStat: TxUncommited, Key: []byte("a"), Value: []byte("abc")}}, []byte{129, 250, 252, 184, 129, 2, 210, 156, 164, 191, 12, 142, 171, 204, 10, 4, 2, 6, 97, 97, 98, 99}, 22,
 		},
 		{
-			"delete", args{&LogEntry{Stat: SDelete}}, []byte{6, 114, 158, 122, 1, 0, 0, 0, 0, 0}, 10,
+			"delete", args{&LogEntry{Stat: SDelete}}, []byte{157, 237, 81, 120, 129, 1, 0, 0, 0, 0, 0}, 11,
 		},
 	}
 	for _, tt := range tests {
@@ -66,6 +66,12 @@ func Test_decodeHeader(t *testing.T) {
 		{
 			"expiredAt", args{buf: []byte{43, 161, 225, 52, 2, 210, 156, 164, 191, 12, 142, 171, 204, 10, 2, 2, 6, 97, 97, 98, 99}}, &LogEntry{crc: 887202091, ExpiredAt: 1676969769, Stat: SListMeta, TxID: 11111111, TxStat: 1, kSize: 1, vSize: 3}, 17,
 		},
+		{
+			"current_version", args{buf: []byte{129, 250, 252, 184, 129, 2, 210, 156, 164, 191, 12, 142, 171, 204, 10, 4, 2, 6, 97, 97, 98, 99}}, &LogEntry{crc: 3103586945, ExpiredAt: 1676969769, Stat: SListMeta, TxID: 11111111, TxStat: TxUncommited, kSize: 1, vSize: 3, version: EntryVersion}, 18,
+		},
+		{
+			"future_version", args{buf: []byte{129, 250, 252, 184, 132, 2, 210, 156, 164, 191, 12, 142, 171, 204, 10, 4, 2, 6, 97, 97, 98, 99}}, &LogEntry{crc: 3103586945, version: maxEntryVersion + 1}, 0,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.situation, func(t *testing.T) {
@@ -80,7 +86,7 @@ func Test_decodeHeader(t *testing.T) {
 	}
 }
 
-func Test_getEntryCrc(t *testing.T) {
+func Test_getEntryChecksum(t *testing.T) {
 	type args struct {
 		buf []byte
 		le  *LogEntry
@@ -105,9 +111,44 @@ func Test_getEntryCrc(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.situation, func(t *testing.T) {
-			got := getEntryCrc(tt.args.buf, tt.args.le)
+			got := getEntryChecksum(tt.args.buf, tt.args.le)
 			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("getEntryCrc() got = %v, want %v", got, tt.want)
+				t.Errorf("getEntryChecksum() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogEntry_String(t *testing.T) {
+	tests := []struct {
+		name string
+		e    *LogEntry
+		want string
+	}{
+		{
+			"normal", &LogEntry{
+				Key:       []byte("key\x00\"1\""),
+				Value:     []byte("0123456789abcdefghijklmnopqrstuvwxyz"),
+				Stat:      SDelete,
+				ExpiredAt: 1700000000000,
+				TxID:      7,
+				TxStat:    TxCommited,
+			},
+			`LogEntry{key="key\x00\"1\"" keySize=7 value="0123456789abcdefghijklmnopqrstuv..." valueSize=36 ` +
+				`stat=delete expiredAt=1700000000000 txID=7 txStat=committed}`,
+		},
+		{
+			"empty", &LogEntry{Key: []byte{}, Stat: SListMeta},
+			`LogEntry{key="" keySize=0 value=<nil> valueSize=0 stat=list-meta expiredAt=0 txID=0 txStat=none}`,
+		},
+		{
+			"nil", nil, "LogEntry<nil>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.e.String(); got != tt.want {
+				t.Errorf("String() = %v, want %v", got, tt.want)
 			}
 		})
 	}
@@ -4,9 +4,15 @@ import (
 	"errors"
 	"fmt"
 	"github.com/billsjc123/LazyDB/iocontroller"
+	"io"
+	"io/fs"
+	"math"
+	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 )
 
 // IOType represents different types of file io: FileIO(standard file io).
@@ -30,6 +36,15 @@ var (
 
 	// ErrWriteSizeNotEqual write size is not equal to entry size.
 	ErrWriteSizeNotEqual = errors.New("logfile: write size is not equal to entry size")
+
+	// ErrDiskFull there is no space left on the device, or the write is short, nothing is written.
+	ErrDiskFull = errors.New("logfile: no space left on device")
+
+	// ErrInvalidFileTypeName name of a registered file type is empty or contains invalid characters.
+	ErrInvalidFileTypeName = errors.New("logfile: invalid file type name")
+
+	// ErrTooManyFileTypes no more file type can be registered.
+	ErrTooManyFileTypes = errors.New("logfile: too many file types")
 )
 
 const (
@@ -41,8 +56,12 @@ const (
 )
 
 const (
-	// FilePrefix log file prefix. Full name of a file for example file of strings is like: "path/log.strs.00000001".
+	// FilePrefix log file prefix. Full name of a file for example file of strings is like: "path/log.strs.0000000001".
 	FilePrefix = "log."
+
+	// FidWidth the width fids are zero-padded to in file names, it fits any uint32 so that names sort by fid.
+	// Files created before are padded to 8 digits, or not padded, and they are still opened by their names.
+	FidWidth = 10
 )
 
 // FileType represents different types of log file: wal and value log.
@@ -72,14 +91,90 @@ var (
 		Set:  "log.set.",
 		ZSet: "log.zset.",
 	}
+	// fileTypesMu protects FileTypesMap and FileNamesMap from RegisterFType
+	fileTypesMu sync.RWMutex
 )
 
+// RegisterFType registers a file type named name, whose files are named like "log.name.0000000001".
+// The same FType is returned if name has been registered. File types are shared by the whole process.
+func RegisterFType(name string) (FType, error) {
+	if name == "" || strings.ContainsAny(name, "./\\") {
+		return 0, ErrInvalidFileTypeName
+	}
+	fileTypesMu.Lock()
+	defer fileTypesMu.Unlock()
+	if ftype, ok := FileTypesMap[name]; ok {
+		return ftype, nil
+	}
+	if len(FileNamesMap) > math.MaxUint8 {
+		return 0, ErrTooManyFileTypes
+	}
+	ftype := FType(len(FileNamesMap))
+	FileTypesMap[name] = ftype
+	FileNamesMap[ftype] = FilePrefix + name + "."
+	return ftype, nil
+}
+
+// LookupFType returns the FType of the name in file names, e.g. "strs".
+func LookupFType(name string) (FType, bool) {
+	fileTypesMu.RLock()
+	defer fileTypesMu.RUnlock()
+	ftype, ok := FileTypesMap[name]
+	return ftype, ok
+}
+
+// FileNamePrefix returns the prefix of names of files of ftype, e.g. "log.strs.".
+func FileNamePrefix(ftype FType) (string, bool) {
+	fileTypesMu.RLock()
+	defer fileTypesMu.RUnlock()
+	prefix, ok := FileNamesMap[ftype]
+	return prefix, ok
+}
+
+// FileName returns the name of the file of ftype and fid, e.g. "log.strs.0000000001".
+func FileName(ftype FType, fid uint32) (string, bool) {
+	prefix, ok := FileNamePrefix(ftype)
+	if !ok {
+		return "", false
+	}
+	return paddedFileName(prefix, fid), true
+}
+
+func paddedFileName(prefix string, fid uint32) string {
+	return prefix + fmt.Sprintf("%0*d", FidWidth, fid)
+}
+
+// legacyFileNames returns names the file of fid may have been created with before fids are padded to FidWidth.
+func legacyFileNames(prefix string, fid uint32) []string {
+	return []string{prefix + fmt.Sprintf("%08d", fid), prefix + fmt.Sprintf("%d", fid)}
+}
+
+// existingFileName returns the name of the existing file of fid by stat, name is returned if there is none.
+func existingFileName(name, prefix string, fid uint32, stat func(name string) error) string {
+	if err := stat(name); !errors.Is(err, fs.ErrNotExist) {
+		return name
+	}
+	for _, legacy := range legacyFileNames(prefix, fid) {
+		if err := stat(legacy); err == nil {
+			return legacy
+		}
+	}
+	return name
+}
+
 // LogFile is an abstraction of a disk file, entry`s read and write will go through it.
 type LogFile struct {
 	Fid          uint32
 	Offset       int64 // WriteAt
 	IoController iocontroller.IOController
 	Mu           sync.RWMutex
+	BlockAlign   int64 // entries are padded to a multiple of BlockAlign if it is positive
+
+	fileName string
+	fsize    int64
+	ioType   IOType
+	fsys     fs.FS // not nil if the log file is read from fs.FS, it is read-only then
+	closed   bool
 }
 
 // Open opens an existing or create a new log file.
@@ -88,68 +183,226 @@ func Open(path string, fid uint32, fsize int64, ftype FType, ioType IOType) (*Lo
 	if fsize <= 0 {
 		return nil, ErrIllegalFileSize
 	}
-	if _, ok := FileNamesMap[ftype]; !ok {
+	prefix, ok := FileNamePrefix(ftype)
+	if !ok {
 		return nil, ErrUnsupportedFileType
 	}
-	fileName := filepath.Join(path, FileNamesMap[ftype]+fmt.Sprintf("%08d", fid))
-	lf := &LogFile{Fid: fid}
-	var controller iocontroller.IOController
-	var err error
+	fileName := existingFileName(paddedFileName(prefix, fid), prefix, fid, func(name string) error {
+		_, err := os.Stat(filepath.Join(path, name))
+		return err
+	})
+	fileName = filepath.Join(path, fileName)
+	lf := &LogFile{Fid: fid, fileName: fileName, fsize: fsize, ioType: ioType}
+	controller, err := newIOController(fileName, fsize, ioType)
+	if err != nil {
+		return nil, err
+	}
+	lf.IoController = controller
+	return lf, nil
+}
+
+// OpenFS opens an existing log file from fsys in read-only mode.
+// The log file is looked up in the root directory of fsys.
+func OpenFS(fsys fs.FS, fid uint32, ftype FType) (*LogFile, error) {
+	prefix, ok := FileNamePrefix(ftype)
+	if !ok {
+		return nil, ErrUnsupportedFileType
+	}
+	fileName := existingFileName(paddedFileName(prefix, fid), prefix, fid, func(name string) error {
+		_, err := fs.Stat(fsys, name)
+		return err
+	})
+	controller, err := iocontroller.NewFSIOController(fsys, fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &LogFile{Fid: fid, IoController: controller, fileName: fileName, fsys: fsys}, nil
+}
+
+func newIOController(fileName string, fsize int64, ioType IOType) (iocontroller.IOController, error) {
 	switch ioType {
 	case FileIO:
-		if controller, err = iocontroller.NewFileIOController(fileName, fsize); err != nil {
-			return nil, err
-		}
+		return iocontroller.NewFileIOController(fileName, fsize)
 	case Mmap:
-		if controller, err = iocontroller.NewMMapController(fileName, fsize); err != nil {
-			return nil, err
-		}
+		return iocontroller.NewMMapController(fileName, fsize)
 	default:
 		return nil, ErrUnsupportedIoType
 	}
+}
+
+// Reopen opens the log file again if it has been closed.
+func (lf *LogFile) Reopen() error {
+	if !lf.closed {
+		return nil
+	}
+	var controller iocontroller.IOController
+	var err error
+	if lf.fsys != nil {
+		controller, err = iocontroller.NewFSIOController(lf.fsys, lf.fileName)
+	} else {
+		controller, err = newIOController(lf.fileName, lf.fsize, lf.ioType)
+	}
+	if err != nil {
+		return err
+	}
 	lf.IoController = controller
-	return lf, nil
+	lf.closed = false
+	return nil
+}
+
+// IsClosed returns whether the log file has been closed.
+func (lf *LogFile) IsClosed() bool {
+	return lf.closed
+}
+
+// Path returns the path of the log file, e.g. "/data/log.strs.0000000001".
+func (lf *LogFile) Path() string {
+	return lf.fileName
+}
+
+// Size returns the size of the file on disk, which is the preallocated size for files opened by Open.
+func (lf *LogFile) Size() (int64, error) {
+	var info fs.FileInfo
+	var err error
+	if lf.fsys != nil {
+		info, err = fs.Stat(lf.fsys, lf.fileName)
+	} else {
+		info, err = os.Stat(lf.fileName)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
 }
 
 // ReadLogEntry read a LogEntry from log file at offset.
-// it returns LogEntry, entrySize and err if any
+// it returns LogEntry, entrySize and err if any.
+// entrySize is also returned with ErrInvalidCrc, so that the corrupted entry can be skipped.
 func (lf *LogFile) ReadLogEntry(offset int64) (*LogEntry, int, error) {
+	le, _, size, err := lf.ReadLogEntryInto(offset, nil)
+	return le, size, err
+}
+
+// ReadLogEntryInto is like ReadLogEntry, but key and value are appended to dst, which is grown only if it is too small.
+// It returns LogEntry whose Key and Value alias the returned slice, the extended dst, entrySize and err if any.
+func (lf *LogFile) ReadLogEntryInto(offset int64, dst []byte) (*LogEntry, []byte, int, error) {
 	headerBuf := make([]byte, MaxHeaderSize)
 	//read the header of the logEntry from the file
-	_, err := lf.IoController.Read(headerBuf, offset)
+	read, err := lf.IoController.Read(headerBuf, offset)
+	// the last entry of a full log file may be shorter than MaxHeaderSize
+	if err == io.EOF && read > 0 {
+		headerBuf, err = headerBuf[:read], nil
+	}
 	if err != nil {
-		return nil, 0, err
+		return nil, dst, 0, err
 	}
 	le, size := decodeHeader(headerBuf)
-	if le.crc == 0 && le.kSize == 0 && le.vSize == 0 {
-		return nil, 0, ErrLogEndOfFile
+	if le == nil {
+		return nil, dst, 0, io.EOF
+	}
+	if le.version > maxEntryVersion || le.Checksum > maxChecksumType {
+		return nil, dst, 0, ErrUnsupportedVersion
+	}
+	// entries of ChecksumNone have zero check sum, but their version byte is never zero
+	if le.crc == 0 && le.version == entryVersionLegacy && le.kSize == 0 && le.vSize == 0 {
+		return nil, dst, 0, ErrLogEndOfFile
 	}
 	kSize, vSize := int(le.kSize), int(le.vSize)
-	var entrySize = size + kSize + vSize
+	// padding is skipped by the caller reading entries one by one
+	var entrySize = AlignSize(size+kSize+vSize, lf.BlockAlign)
+
+	n := len(dst)
+	if cap(dst)-n < kSize+vSize || dst == nil {
+		newDst := make([]byte, n, n+kSize+vSize)
+		copy(newDst, dst)
+		dst = newDst
+	}
+	dst = dst[:n+kSize+vSize]
 	// use the size to read the key and value
-	var kvBuf []byte
+	// zero-length key and value are read as empty slices rather than nil
+	kvBuf := dst[n:]
 	if kSize > 0 || vSize > 0 {
-		kvBuf = make([]byte, kSize+vSize)
 		_, err = lf.IoController.Read(kvBuf, offset+int64(size))
 		if err != nil {
-			return nil, 0, err
+			return nil, dst[:n], 0, err
 		}
-		le.Key = kvBuf[:kSize]
-		le.Value = kvBuf[kSize:]
 	}
-	// check whether the crc is correct
-	if crc := getEntryCrc(headerBuf[:size], le); crc != le.crc {
-		return nil, 0, ErrInvalidCrc
+	le.Key = kvBuf[:kSize:kSize]
+	le.Value = kvBuf[kSize:]
+	// check whether the check sum is correct
+	if crc := getEntryChecksum(headerBuf[:size], le); crc != le.crc {
+		return nil, dst[:n], entrySize, ErrInvalidCrc
 	}
-	return le, entrySize, nil
+	return le, dst, entrySize, nil
+}
+
+// ReadRawLogEntry reads the binary LogEntry at offset as it is stored, without padding, e.g. to ship it verbatim.
+// The check sum is verified like ReadLogEntry, and the entry can be decoded by DecodeEntry.
+func (lf *LogFile) ReadRawLogEntry(offset int64) ([]byte, error) {
+	headerBuf := make([]byte, MaxHeaderSize)
+	read, err := lf.IoController.Read(headerBuf, offset)
+	if err == io.EOF && read > 0 {
+		headerBuf, err = headerBuf[:read], nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	le, size := decodeHeader(headerBuf)
+	if le == nil || size == 0 {
+		return nil, io.EOF
+	}
+	if le.crc == 0 && le.version == entryVersionLegacy && le.kSize == 0 && le.vSize == 0 {
+		return nil, ErrLogEndOfFile
+	}
+	buf := make([]byte, size+int(le.kSize)+int(le.vSize))
+	if _, err = lf.IoController.Read(buf, offset); err != nil {
+		return nil, err
+	}
+	if _, _, err = DecodeEntry(buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
 }
 
 // Write a byte slice at the end of log file.
+// If the write fails, bytes written partially are zeroed and the offset is not moved, so that readers stop at the
+// offset as before, and the next write starts there. ErrDiskFull is returned if the device is full or the write is short.
 func (lf *LogFile) Write(buf []byte) error {
 	if len(buf) <= 0 {
 		return nil
 	}
 	offset := atomic.LoadInt64(&lf.Offset)
+	size, err := lf.IoController.Write(buf, offset)
+	if err == nil && size == len(buf) {
+		atomic.AddInt64(&lf.Offset, int64(size))
+		return nil
+	}
+	// the space of written bytes has been allocated, so zeroing them does not need more
+	if size > 0 {
+		_, _ = lf.IoController.Write(make([]byte, size), offset)
+	}
+	if err == nil || errors.Is(err, syscall.ENOSPC) {
+		return ErrDiskFull
+	}
+	return err
+}
+
+// Revert zeroes bytes written after offset and moves the offset back to it, like a failed Write,
+// so that readers stop at offset and the next write starts there.
+func (lf *LogFile) Revert(offset int64) error {
+	end := atomic.LoadInt64(&lf.Offset)
+	if end <= offset {
+		return nil
+	}
+	if _, err := lf.IoController.Write(make([]byte, end-offset), offset); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&lf.Offset, offset)
+	return nil
+}
+
+// WriteAt overwrites written bytes at offset in place, the offset where entries are appended does not move.
+func (lf *LogFile) WriteAt(buf []byte, offset int64) error {
 	size, err := lf.IoController.Write(buf, offset)
 	if err != nil {
 		return err
@@ -157,21 +410,37 @@ func (lf *LogFile) Write(buf []byte) error {
 	if size != len(buf) {
 		return ErrWriteSizeNotEqual
 	}
-	atomic.AddInt64(&lf.Offset, int64(size))
 	return nil
 }
 
 // Sync commits the current contents of the log file to stable storage.
 func (lf *LogFile) Sync() error {
+	if lf.closed {
+		return nil
+	}
 	return lf.IoController.Sync()
 }
 
 // Close current log file.
 func (lf *LogFile) Close() error {
-	return lf.IoController.Close()
+	if lf.closed {
+		return nil
+	}
+	if err := lf.IoController.Close(); err != nil {
+		return err
+	}
+	lf.closed = true
+	return nil
 }
 
 // Delete delete current log file.
 func (lf *LogFile) Delete() error {
+	if lf.fsys != nil {
+		return iocontroller.ErrReadOnly
+	}
+	if lf.closed {
+		return os.Remove(lf.fileName)
+	}
+	lf.closed = true
 	return lf.IoController.Delete()
 }
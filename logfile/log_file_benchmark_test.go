@@ -0,0 +1,60 @@
+package logfile
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// go test -bench='WriteLogEntry' -benchtime=5s -count=1 -benchmem
+
+func benchmarkWriteLogEntry(b *testing.B, checksum ChecksumType, valueSize int) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_log_file_benchmark")
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	var fid uint32 = 1
+	lf, err := Open(path, fid, 256<<20, Strs, FileIO)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ent := &LogEntry{Key: []byte("benchmark-key"), Value: make([]byte, valueSize), Checksum: checksum}
+	b.SetBytes(int64(valueSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, size := EncodeEntry(ent)
+		if lf.Offset+int64(size) > 256<<20 {
+			_ = lf.Delete()
+			fid++
+			if lf, err = Open(path, fid, 256<<20, Strs, FileIO); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := lf.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	_ = lf.Delete()
+}
+
+func BenchmarkWriteLogEntry(b *testing.B) {
+	for _, checksum := range []ChecksumType{ChecksumNone, ChecksumCRC32, ChecksumXXHash} {
+		for _, valueSize := range []int{128, 4 << 10, 64 << 10} {
+			b.Run(checksum.String()+"/"+sizeName(valueSize), func(b *testing.B) {
+				benchmarkWriteLogEntry(b, checksum, valueSize)
+			})
+		}
+	}
+}
+
+func sizeName(size int) string {
+	if size >= 1<<10 {
+		return strconv.Itoa(size>>10) + "KB"
+	}
+	return strconv.Itoa(size) + "B"
+}
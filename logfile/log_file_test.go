@@ -0,0 +1,205 @@
+package logfile
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogFile_ReadLogEntry(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_log_file")
+	err := os.MkdirAll(path, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(path)
+
+	lf, err := Open(path, 1, 1024, Strs, FileIO)
+	assert.Nil(t, err)
+	defer lf.Close()
+
+	// legacy entry without version byte
+	legacy := []byte{43, 161, 225, 52, 2, 210, 156, 164, 191, 12, 142, 171, 204, 10, 2, 2, 6, 97, 97, 98, 99}
+	binary.LittleEndian.PutUint32(legacy[:4], getEntryChecksum(legacy[:17], &LogEntry{Key: legacy[17:18], Value: legacy[18:]}))
+	assert.Nil(t, lf.Write(legacy))
+
+	current, currentSize := EncodeEntry(&LogEntry{ExpiredAt: 1676969769, Stat: SListMeta, Key: []byte("a"), Value: []byte("abc")})
+	assert.Nil(t, lf.Write(current))
+
+	// simulate an entry written by a future version
+	future := make([]byte, len(current))
+	copy(future, current)
+	future[4] = versionFlag | (maxEntryVersion + 1)
+	assert.Nil(t, lf.Write(future))
+
+	ent, size, err := lf.ReadLogEntry(0)
+	assert.Nil(t, err)
+	assert.Equal(t, len(legacy), size)
+	assert.Equal(t, entryVersionLegacy, ent.version)
+	assert.Equal(t, []byte("a"), ent.Key)
+	assert.Equal(t, []byte("abc"), ent.Value)
+
+	ent, size, err = lf.ReadLogEntry(int64(len(legacy)))
+	assert.Nil(t, err)
+	assert.Equal(t, currentSize, size)
+	assert.Equal(t, EntryVersion, ent.version)
+	assert.Equal(t, SListMeta, ent.Stat)
+	assert.Equal(t, int64(1676969769), ent.ExpiredAt)
+	assert.Equal(t, []byte("a"), ent.Key)
+	assert.Equal(t, []byte("abc"), ent.Value)
+
+	_, _, err = lf.ReadLogEntry(int64(len(legacy) + currentSize))
+	assert.Equal(t, ErrUnsupportedVersion, err)
+}
+
+func TestLogFile_ReadLogEntryVersioned(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_log_file_versioned")
+	err := os.MkdirAll(path, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(path)
+
+	versioned, versionedSize := EncodeEntry(&LogEntry{Key: []byte("a"), Value: []byte("abc"), Version: 1 << 62, TxID: 1 << 62})
+	unversioned, unversionedSize := EncodeEntry(&LogEntry{Key: []byte("a")})
+	// the last entry ends at the end of the file, whose header is shorter than MaxHeaderSize
+	lf, err := Open(path, 1, int64(versionedSize+unversionedSize), Strs, FileIO)
+	assert.Nil(t, err)
+	defer lf.Close()
+	assert.Nil(t, lf.Write(versioned))
+	assert.Nil(t, lf.Write(unversioned))
+
+	ent, size, err := lf.ReadLogEntry(0)
+	assert.Nil(t, err)
+	assert.Equal(t, versionedSize, size)
+	assert.Equal(t, entryVersionVersioned, ent.version)
+	assert.Equal(t, uint64(1<<62), ent.Version)
+	assert.Equal(t, uint64(1<<62), ent.TxID)
+	assert.Equal(t, []byte("abc"), ent.Value)
+
+	ent, size, err = lf.ReadLogEntry(int64(versionedSize))
+	assert.Nil(t, err)
+	assert.Equal(t, unversionedSize, size)
+	assert.Equal(t, EntryVersion, ent.version)
+	assert.Equal(t, uint64(0), ent.Version)
+	assert.Equal(t, []byte("a"), ent.Key)
+}
+
+func TestLogFile_ReadLogEntryTimestamped(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_log_file_timestamped")
+	err := os.MkdirAll(path, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(path)
+
+	timestamped, timestampedSize := EncodeEntry(&LogEntry{Key: []byte("a"), Value: []byte("abc"), WrittenAt: 1700000000123})
+	both, bothSize := EncodeEntry(&LogEntry{Key: []byte("b"), Version: 1 << 62, WrittenAt: 1700000000456, TxID: 1 << 62})
+	lf, err := Open(path, 1, int64(timestampedSize+bothSize), Strs, FileIO)
+	assert.Nil(t, err)
+	defer lf.Close()
+	assert.Nil(t, lf.Write(timestamped))
+	assert.Nil(t, lf.Write(both))
+
+	ent, size, err := lf.ReadLogEntry(0)
+	assert.Nil(t, err)
+	assert.Equal(t, timestampedSize, size)
+	assert.Equal(t, entryVersionTimestamped, ent.version)
+	assert.Equal(t, uint64(0), ent.Version)
+	assert.Equal(t, int64(1700000000123), ent.WrittenAt)
+	assert.Equal(t, []byte("abc"), ent.Value)
+
+	ent, size, err = lf.ReadLogEntry(int64(timestampedSize))
+	assert.Nil(t, err)
+	assert.Equal(t, bothSize, size)
+	assert.Equal(t, uint64(1<<62), ent.Version)
+	assert.Equal(t, int64(1700000000456), ent.WrittenAt)
+	assert.Equal(t, uint64(1<<62), ent.TxID)
+	assert.Equal(t, []byte("b"), ent.Key)
+}
+
+func TestLogFile_ReadLogEntryAligned(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_log_file_aligned")
+	err := os.MkdirAll(path, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(path)
+
+	lf, err := Open(path, 1, 4096, Strs, FileIO)
+	assert.Nil(t, err)
+	defer lf.Close()
+	lf.BlockAlign = 512
+
+	entries := []*LogEntry{
+		{Key: []byte("a"), Value: []byte("abc")},
+		{Key: []byte("b"), Value: make([]byte, 600)},
+		{Key: []byte("c"), Stat: SDelete},
+	}
+	for _, ent := range entries {
+		buf, size := EncodeEntryAligned(ent, lf.BlockAlign)
+		assert.Equal(t, 0, size%512)
+		assert.Equal(t, size, len(buf))
+		assert.Nil(t, lf.Write(buf))
+	}
+
+	var offset int64
+	for _, want := range entries {
+		assert.Equal(t, int64(0), offset%512)
+		ent, size, err := lf.ReadLogEntry(offset)
+		assert.Nil(t, err)
+		assert.Equal(t, want.Key, ent.Key)
+		assert.Equal(t, len(want.Value), len(ent.Value))
+		assert.Equal(t, want.Stat, ent.Stat)
+		offset += int64(size)
+	}
+	assert.Equal(t, int64(2048), offset)
+	_, _, err = lf.ReadLogEntry(offset)
+	assert.Equal(t, ErrLogEndOfFile, err)
+}
+
+func TestLogFile_ReadLogEntryChecksum(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_log_file_checksum")
+	err := os.MkdirAll(path, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(path)
+
+	lf, err := Open(path, 1, 4096, Strs, FileIO)
+	assert.Nil(t, err)
+	defer lf.Close()
+
+	// entries of different algorithms are mixed in one file
+	entries := []*LogEntry{
+		{Key: []byte("a"), Value: []byte("abc"), Checksum: ChecksumCRC32},
+		{Key: []byte("b"), Value: make([]byte, 600), Checksum: ChecksumXXHash},
+		{Key: []byte("c"), Value: []byte("abc"), Checksum: ChecksumNone},
+		{Checksum: ChecksumNone},
+	}
+	var offsets []int64
+	for _, ent := range entries {
+		buf, _ := EncodeEntry(ent)
+		offsets = append(offsets, lf.Offset)
+		assert.Nil(t, lf.Write(buf))
+	}
+	for i, want := range entries {
+		ent, _, err := lf.ReadLogEntry(offsets[i])
+		assert.Nil(t, err)
+		assert.Equal(t, want.Checksum, ent.Checksum)
+		assert.Equal(t, len(want.Key), len(ent.Key))
+		assert.Equal(t, len(want.Value), len(ent.Value))
+	}
+	_, _, err = lf.ReadLogEntry(lf.Offset)
+	assert.Equal(t, ErrLogEndOfFile, err)
+
+	// corruption is detected by xxHash, but not without check sum
+	corrupted := func(ent *LogEntry) error {
+		buf, _ := EncodeEntry(ent)
+		buf[len(buf)-1] ^= 0xff
+		offset := lf.Offset
+		assert.Nil(t, lf.Write(buf))
+		_, _, err := lf.ReadLogEntry(offset)
+		return err
+	}
+	assert.Equal(t, ErrInvalidCrc, corrupted(&LogEntry{Key: []byte("d"), Value: []byte("abc"), Checksum: ChecksumXXHash}))
+	assert.Nil(t, corrupted(&LogEntry{Key: []byte("e"), Value: []byte("abc"), Checksum: ChecksumNone}))
+}
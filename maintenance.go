@@ -0,0 +1,182 @@
+package lazydb
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// defaultMaintenanceBatchSize see MaintenanceOptions.BatchSize.
+const defaultMaintenanceBatchSize = 1024
+
+// MaintenanceOptions selects the steps run by Maintenance, steps run in the order of the fields.
+type MaintenanceOptions struct {
+	// Context cancels Maintenance between batches, context.Background is used if it is nil.
+	Context context.Context
+
+	// PurgeExpired removes expired keys of type String like the active expire cycle.
+	PurgeExpired bool
+	// Merge merges archived log files of all types whose ratio of stale data exceeds GCRatio,
+	// DBConfig.LogFileGCRatio is used if GCRatio is not positive.
+	Merge   bool
+	GCRatio float64
+	// Verify checks the integrity of archived log files like LazyDB.Verify after merging.
+	Verify bool
+
+	// BatchSize max number of keys expired or entries merged while the index lock is held,
+	// so that reads are not blocked for long. defaultMaintenanceBatchSize is used if it is not positive.
+	BatchSize int
+}
+
+// MaintenanceReport is the result of Maintenance.
+type MaintenanceReport struct {
+	ExpiredKeys    int   // expired keys of type String removed
+	FilesRemoved   int   // archived log files merged and removed
+	BytesReclaimed int64 // size of the removed log files minus the size of live entries rewritten out of them
+
+	Verified *VerifyReport    // result of verifying, nil if it has not run
+	Issues   []CorruptLogFile // archived log files which failed merging or verifying because of corrupted entries
+}
+
+// Maintenance runs the housekeeping selected by opts in one call, e.g. from a cron job, and reports what it did.
+// Expired keys are removed and log files are merged batch by batch, see MaintenanceOptions.BatchSize,
+// and Maintenance stops with the error of opts.Context between batches once it is done, along with the report of
+// the work finished so far. A log file whose merge is stopped halfway is continued by the next Maintenance or
+// StepMerge. Log files failing to merge because of corrupted entries are reported in Issues and left intact.
+// Log files must not be merged by Merge or StepMerge meanwhile.
+func (db *LazyDB) Maintenance(opts MaintenanceOptions) (*MaintenanceReport, error) {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultMaintenanceBatchSize
+	}
+	report := &MaintenanceReport{}
+	if (opts.PurgeExpired || opts.Merge) && db.readOnly() {
+		return report, ErrReadOnly
+	}
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+
+	if opts.PurgeExpired {
+		n, err := db.purgeExpired(ctx, batchSize)
+		report.ExpiredKeys = n
+		if err != nil {
+			return report, err
+		}
+	}
+	if opts.Merge {
+		ratio := opts.GCRatio
+		if ratio <= 0 {
+			ratio = db.cfg.LogFileGCRatio
+		}
+		if err := db.mergeStale(ctx, ratio, batchSize, report); err != nil {
+			return report, err
+		}
+	}
+	if opts.Verify {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		verified, err := db.Verify()
+		if err != nil {
+			return report, err
+		}
+		report.Verified = &verified
+		report.Issues = append(report.Issues, verified.Corrupted...)
+	}
+	return report, nil
+}
+
+// purgeExpired removes expired keys of type String like activeExpire, but the index lock is held for
+// at most batchSize keys at a time, and it stops once ctx is done. It returns the number of keys removed.
+func (db *LazyDB) purgeExpired(ctx context.Context, batchSize int) (int, error) {
+	ts := db.now().UnixMilli()
+	var expiredKeys [][]byte
+	db.strIndex.mu.RLock()
+	db.ascendTTL(func(key []byte, expiredAt int64) bool {
+		if expiredAt > ts {
+			return false
+		}
+		expiredKeys = append(expiredKeys, key)
+		return true
+	})
+	db.strIndex.mu.RUnlock()
+
+	var n int
+	for len(expiredKeys) > 0 {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		batch := expiredKeys
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		expiredKeys = expiredKeys[len(batch):]
+
+		db.strIndex.mu.Lock()
+		for _, key := range batch {
+			// it may have been removed or written again meanwhile
+			if idxNode, _ := db.strIndex.idxTree.Get(key).(*Value); !idxNode.isExpired(ts) {
+				continue
+			}
+			if err := db.expireStr(key, ts); err != nil {
+				db.strIndex.mu.Unlock()
+				return n, err
+			}
+			n++
+		}
+		db.strIndex.mu.Unlock()
+	}
+	return n, nil
+}
+
+// mergeStale merges archived log files of all types whose ratio of stale data exceeds ratio by StepMerge,
+// batchSize entries a step, and adds the result into report.
+func (db *LazyDB) mergeStale(ctx context.Context, ratio float64, batchSize int, report *MaintenanceReport) error {
+	for _, typ := range db.valueTypes() {
+		// no log file of the type has been created
+		activeLogFile := db.activeLogFileMap[typ]
+		if activeLogFile == nil {
+			continue
+		}
+		discard := db.discardsMap[typ]
+		if err := discard.sync(); err != nil {
+			return err
+		}
+		ccl, err := discard.getCCL(activeLogFile.lf.Fid, ratio)
+		if err != nil {
+			return err
+		}
+
+		for _, fid := range ccl {
+			archivedFile := db.getArchivedLogFile(typ, fid)
+			if archivedFile == nil {
+				continue
+			}
+			size := archivedFile.lf.Offset
+			rewritten := atomic.LoadUint64(&db.stats.RewrittenBytes)
+			for done := false; !done; {
+				if err = ctx.Err(); err != nil {
+					return err
+				}
+				if done, err = db.StepMerge(typ, fid, batchSize); err != nil {
+					break
+				}
+			}
+			if errors.Is(err, ErrCorruptedEntry) {
+				report.Issues = append(report.Issues, CorruptLogFile{Type: typ, Fid: fid, Err: err})
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			report.FilesRemoved++
+			report.BytesReclaimed += size - int64(atomic.LoadUint64(&db.stats.RewrittenBytes)-rewritten)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package lazydb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_Maintenance(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_maintenance"))
+	cfg.MaxLogFileSize = 500
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	typ := valueTypeString
+	for i := 0; i < 40; i++ {
+		assert.Nil(t, db.Set(GetKey(i%4), GetKey(i)))
+	}
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, db.SetEX(GetKey(100+i), GetValue32(), time.Second))
+	}
+	assert.Eventually(t, func() bool {
+		ccl, err := db.discardsMap[typ].getCCL(db.getActiveLogFile(typ).lf.Fid, 0.5)
+		return err == nil && len(ccl) > 0
+	}, time.Second, 10*time.Millisecond)
+	ccl, err := db.discardsMap[typ].getCCL(db.getActiveLogFile(typ).lf.Fid, 0.5)
+	assert.Nil(t, err)
+
+	// a cancelled context stops before any work
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, err := db.Maintenance(MaintenanceOptions{Context: ctx, PurgeExpired: true, Merge: true})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, &MaintenanceReport{}, report)
+
+	now := time.Now().Add(2 * time.Second)
+	db.clock = func() time.Time { return now }
+	report, err = db.Maintenance(MaintenanceOptions{PurgeExpired: true, Merge: true, GCRatio: 0.5, Verify: true, BatchSize: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, report.ExpiredKeys)
+	assert.Equal(t, len(ccl), report.FilesRemoved)
+	assert.Greater(t, report.BytesReclaimed, int64(0))
+	for _, fid := range ccl {
+		assert.Nil(t, db.getArchivedLogFile(typ, fid))
+	}
+	assert.NotNil(t, report.Verified)
+	assert.Empty(t, report.Issues)
+
+	for i := 0; i < 4; i++ {
+		val, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, GetKey(36+i), val)
+	}
+	for i := 0; i < 5; i++ {
+		_, err := db.Get(GetKey(100 + i))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+}
@@ -0,0 +1,153 @@
+package lazydb
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/billsjc123/LazyDB/util"
+)
+
+// Namespace is a logical sub-database of a db, like SELECT of Redis but isolated by a key prefix rather than files.
+// Keys passed to its methods are prefixed with the prefix of the namespace transparently, and keys returned by it
+// are stripped of the prefix, so namespaces with different prefixes never see keys of each other, as long as
+// neither prefix is a prefix of the other. Keys written through the db directly are visible to a namespace
+// if they start with its prefix.
+type Namespace struct {
+	db     *LazyDB
+	prefix []byte
+}
+
+// Namespace returns the namespace of keys starting with prefix, e.g. "tenant1:".
+func (db *LazyDB) Namespace(prefix []byte) *Namespace {
+	return &Namespace{db: db, prefix: append([]byte(nil), prefix...)}
+}
+
+// Prefix returns the prefix of keys in the namespace.
+func (ns *Namespace) Prefix() []byte {
+	return ns.prefix
+}
+
+// key returns the key of the db for key in the namespace.
+func (ns *Namespace) key(key []byte) []byte {
+	nsKey := make([]byte, 0, len(ns.prefix)+len(key))
+	return append(append(nsKey, ns.prefix...), key...)
+}
+
+// Get gets the value of key in the namespace like LazyDB.Get.
+func (ns *Namespace) Get(key []byte) ([]byte, error) {
+	return ns.db.Get(ns.key(key))
+}
+
+// Set sets key in the namespace to hold the string value like LazyDB.Set.
+func (ns *Namespace) Set(key, value []byte) error {
+	return ns.db.Set(ns.key(key), value)
+}
+
+// Delete deletes key of type String in the namespace like LazyDB.Delete.
+func (ns *Namespace) Delete(key []byte) error {
+	return ns.db.Delete(ns.key(key))
+}
+
+// Keys returns all keys of all types in the namespace without the prefix, a key holding values of several types
+// is returned once. Keys are in order of DBConfig.KeyComparator.
+// All keys of the db are iterated, so it is expensive for a large db.
+func (ns *Namespace) Keys() ([][]byte, error) {
+	keys, err := ns.dbKeys()
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		keys[i] = key[len(ns.prefix):]
+	}
+	return keys, nil
+}
+
+// FlushNamespace removes all keys of all types in the namespace like LazyDB.Unlink, and returns the number of
+// keys removed. Keys of other namespaces are left intact.
+func (ns *Namespace) FlushNamespace() (int, error) {
+	keys, err := ns.dbKeys()
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+	return ns.db.Unlink(keys...)
+}
+
+// Move moves key of type String from the namespace src to dst along with its time to live, like MOVE of Redis.
+// It returns false and moves nothing if key does not exist in src, or already exists in dst.
+// Lock of strIndex is held throughout, so key exists in exactly one of the namespaces to readers. The key is
+// written into dst before it is deleted from src, so a crash in between leaves it in both rather than losing it.
+func (db *LazyDB) Move(key []byte, src, dst *Namespace) (bool, error) {
+	srcKey, dstKey := src.key(key), dst.key(key)
+	if err := db.checkAccess(OpWrite, srcKey, dstKey); err != nil {
+		return false, err
+	}
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	if err := db.evict(); err != nil {
+		return false, err
+	}
+	value, err := db.getValue(db.strIndex.idxTree, srcKey, valueTypeString)
+	if errors.Is(err, ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = db.getValue(db.strIndex.idxTree, dstKey, valueTypeString)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, ErrKeyNotFound) {
+		return false, err
+	}
+
+	expiredAt := db.strIndex.idxTree.Get(srcKey).(*Value).expiredAt
+	var entry *logfile.LogEntry
+	var valuePos *ValuePos
+	if db.internable(value) {
+		entry, valuePos, err = db.writeInterned(dstKey, value, expiredAt, time.Time{})
+	} else {
+		entry = &logfile.LogEntry{Key: dstKey, Value: value, ExpiredAt: expiredAt}
+		valuePos, err = db.writeLogEntry(valueTypeString, entry)
+	}
+	if err != nil {
+		return false, err
+	}
+	if err = db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valuePos, true); err != nil {
+		return false, err
+	}
+	if err = db.deleteStr(srcKey); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// dbKeys returns keys of the db in the namespace.
+func (ns *Namespace) dbKeys() ([][]byte, error) {
+	var keys [][]byte
+	seen := make(map[string]struct{})
+	for typ := valueType(0); typ < logFileTypeNum; typ++ {
+		typeKeys, err := ns.db.keysOf(typ)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range typeKeys {
+			if !bytes.HasPrefix(key, ns.prefix) {
+				continue
+			}
+			if _, ok := seen[util.ByteToString(key)]; ok {
+				continue
+			}
+			seen[string(key)] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return ns.db.compareKeys(keys[i], keys[j]) < 0
+	})
+	return keys, nil
+}
@@ -0,0 +1,115 @@
+package lazydb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_Namespace(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+
+	ns1 := db.Namespace([]byte("tenant1:"))
+	ns2 := db.Namespace([]byte("tenant2:"))
+
+	// the same inner key does not collide
+	assert.Nil(t, ns1.Set([]byte("k1"), []byte("v1")))
+	assert.Nil(t, ns2.Set([]byte("k1"), []byte("v2")))
+	val, err := ns1.Get([]byte("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	val, err = ns2.Get([]byte("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+	val, err = db.Get([]byte("tenant1:k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	_, err = db.Get([]byte("k1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.Nil(t, ns1.Set([]byte("k2"), []byte("v3")))
+	assert.Nil(t, db.HSet([]byte("tenant1:h"), []byte("f"), []byte("v")))
+	assert.Nil(t, db.SAdd([]byte("tenant1:k2"), []byte("m")))
+	assert.Nil(t, db.Set([]byte("other"), []byte("v")))
+	keys, err := ns1.Keys()
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("h"), []byte("k1"), []byte("k2")}, keys)
+	keys, err = ns2.Keys()
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("k1")}, keys)
+
+	assert.Nil(t, ns2.Delete([]byte("k1")))
+	_, err = ns2.Get([]byte("k1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = ns1.Get([]byte("k1"))
+	assert.Nil(t, err)
+
+	// flushing a namespace leaves others intact
+	assert.Nil(t, ns2.Set([]byte("k1"), []byte("v2")))
+	n, err := ns1.FlushNamespace()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	keys, err = ns1.Keys()
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+	assert.Equal(t, 0, hLen(t, db, []byte("tenant1:h")))
+	val, err = ns2.Get([]byte("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+	_, err = db.Get([]byte("other"))
+	assert.Nil(t, err)
+
+	n, err = ns1.FlushNamespace()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestLazyDB_Move(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+
+	src := db.Namespace([]byte("src:"))
+	dst := db.Namespace([]byte("dst:"))
+
+	t.Run("moved", func(t *testing.T) {
+		assert.Nil(t, db.SetEX(src.key([]byte("k1")), []byte("v1"), time.Hour))
+		moved, err := db.Move([]byte("k1"), src, dst)
+		assert.Nil(t, err)
+		assert.True(t, moved)
+
+		_, err = src.Get([]byte("k1"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		val, err := dst.Get([]byte("k1"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v1"), val)
+		// the time to live is moved along
+		ttl, err := db.TTL(dst.key([]byte("k1")))
+		assert.Nil(t, err)
+		assert.InDelta(t, time.Hour.Seconds(), ttl, 5)
+	})
+
+	t.Run("missing in source", func(t *testing.T) {
+		moved, err := db.Move([]byte("k2"), src, dst)
+		assert.Nil(t, err)
+		assert.False(t, moved)
+		_, err = dst.Get([]byte("k2"))
+		assert.Equal(t, ErrKeyNotFound, err)
+	})
+
+	t.Run("existing in destination", func(t *testing.T) {
+		assert.Nil(t, src.Set([]byte("k3"), []byte("v3")))
+		assert.Nil(t, dst.Set([]byte("k3"), []byte("old")))
+		moved, err := db.Move([]byte("k3"), src, dst)
+		assert.Nil(t, err)
+		assert.False(t, moved)
+
+		val, err := src.Get([]byte("k3"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v3"), val)
+		val, err = dst.Get([]byte("k3"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("old"), val)
+	})
+}
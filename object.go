@@ -0,0 +1,114 @@
+package lazydb
+
+import (
+	"time"
+
+	"github.com/billsjc123/LazyDB/ds"
+	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/billsjc123/LazyDB/util"
+)
+
+// ObjectInfo describes the value stored at a key, see LazyDB.ObjectInfo.
+type ObjectInfo struct {
+	Type valueType
+
+	// WrittenAt is when the key was written last, which is the latest write of any element of a collection.
+	// It is zero if DBConfig.RecordTimestamps was off then.
+	WrittenAt time.Time
+}
+
+// ObjectInfo returns metadata of the value stored at key, which is kept in index, so no value is read.
+// Types are looked up in the same order as GetAny, and ErrKeyNotFound is returned if the key does not exist.
+func (db *LazyDB) ObjectInfo(key []byte) (ObjectInfo, error) {
+	typ, err := db.Type(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info := ObjectInfo{Type: typ}
+	if writtenAt := db.lastWrittenAt(typ, key); writtenAt != 0 {
+		info.WrittenAt = time.UnixMilli(writtenAt)
+	}
+	return info, nil
+}
+
+// lastWrittenAt returns the latest written-at timestamp of entries of key of the type, 0 if none is recorded.
+func (db *LazyDB) lastWrittenAt(typ valueType, key []byte) int64 {
+	mu := db.getIndexLock(typ)
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var tree *ds.AdaptiveRadixTree
+	switch typ {
+	case valueTypeString:
+		val, _ := db.strIndex.idxTree.Get(key).(*Value)
+		if val == nil {
+			return 0
+		}
+		return val.writtenAt
+	case valueTypeHash:
+		tree = db.hashIndex.trees[util.ByteToString(key)]
+	case valueTypeList:
+		tree = db.listIndex.trees[util.ByteToString(key)]
+	case valueTypeSet:
+		tree = db.setIndex.trees[util.ByteToString(key)]
+	case valueTypeZSet:
+		if idx := db.zSetIndex.indexes[util.ByteToString(key)]; idx != nil {
+			tree = idx.tree
+		}
+	}
+	if tree == nil {
+		return 0
+	}
+	var last int64
+	iter := tree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil {
+			break
+		}
+		if val, _ := node.Value().(*Value); val != nil && val.writtenAt > last {
+			last = val.writtenAt
+		}
+	}
+	return last
+}
+
+// replayedLaterWrite returns whether the entry replayed when building indexes is not written before the indexed one
+// of its key, so that the entry written last wins rather than the last replayed one, see DBConfig.RecoveryReadRepair.
+// deleted holds timestamps of keys deleted by replayed entries, it is updated if the entry is a later delete.
+func (db *LazyDB) replayedLaterWrite(typ valueType, entry *logfile.LogEntry, deleted map[string]int64) bool {
+	idxTree, idxKey := db.locateIndex(typ, entry)
+	if idxKey == nil {
+		return true
+	}
+	var current int64
+	if idxTree != nil {
+		if val, _ := idxTree.Get(idxKey).(*Value); val != nil {
+			current = val.writtenAt
+		}
+	}
+	if t, ok := deleted[string(idxKey)]; ok && t > current {
+		current = t
+	}
+	if entry.WrittenAt < current {
+		return false
+	}
+	if entry.Stat == logfile.SDelete {
+		deleted[string(idxKey)] = entry.WrittenAt
+	} else {
+		delete(deleted, string(idxKey))
+	}
+	return true
+}
+
+// stampWrittenAt sets the written-at timestamp of entry to now if DBConfig.RecordTimestamps is on and it has none,
+// entries rewritten by merge or applied from a leader keep their timestamps.
+// Delete entries are also stamped if DBConfig.TombstoneGracePeriod is positive, which is measured from it.
+func (db *LazyDB) stampWrittenAt(entry *logfile.LogEntry) {
+	if entry.WrittenAt != 0 {
+		return
+	}
+	if db.cfg.RecordTimestamps || (entry.Stat == logfile.SDelete && db.cfg.TombstoneGracePeriod > 0) {
+		entry.WrittenAt = db.now().UnixMilli()
+	}
+}
@@ -0,0 +1,57 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_ObjectInfo(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_object_info")
+	cfg := DefaultDBConfig(path)
+	cfg.RecordTimestamps = true
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+	now := time.UnixMilli(1700000000000)
+	db.clock = func() time.Time { return now }
+
+	assert.Nil(t, db.Set([]byte("str"), []byte("v")))
+	assert.Nil(t, db.HSet([]byte("hash"), []byte("f1"), []byte("v1")))
+	now = now.Add(time.Minute)
+	assert.Nil(t, db.HSet([]byte("hash"), []byte("f2"), []byte("v2")))
+	assert.Nil(t, db.SAdd([]byte("set"), []byte("m")))
+
+	expected := func() {
+		info, err := db.ObjectInfo([]byte("str"))
+		assert.Nil(t, err)
+		assert.Equal(t, ObjectInfo{Type: valueTypeString, WrittenAt: time.UnixMilli(1700000000000)}, info)
+		// the latest write of fields
+		info, err = db.ObjectInfo([]byte("hash"))
+		assert.Nil(t, err)
+		assert.Equal(t, ObjectInfo{Type: valueTypeHash, WrittenAt: time.UnixMilli(1700000060000)}, info)
+	}
+	expected()
+	info, err := db.ObjectInfo([]byte("set"))
+	assert.Nil(t, err)
+	assert.Equal(t, ObjectInfo{Type: valueTypeSet, WrittenAt: now}, info)
+	_, err = db.ObjectInfo([]byte("missing"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// timestamps survive reopen, and entries written while it is off have none
+	assert.Nil(t, db.Close())
+	cfg.RecordTimestamps = false
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	expected()
+	assert.Nil(t, db.Set([]byte("untimed"), []byte("v")))
+	info, err = db.ObjectInfo([]byte("untimed"))
+	assert.Nil(t, err)
+	assert.True(t, info.WrittenAt.IsZero())
+}
@@ -0,0 +1,189 @@
+package lazydb
+
+import (
+	"errors"
+	"github.com/billsjc123/LazyDB/logfile"
+	"sync"
+	"time"
+)
+
+var ErrDeadlineExceeded = errors.New("deadline exceeded")
+
+const (
+	minLockBackoff = 10 * time.Microsecond
+	maxLockBackoff = time.Millisecond
+)
+
+// WriteOptions options of a write operation.
+type WriteOptions struct {
+	// Deadline bounds how long the operation waits for locks and fsync,
+	// ErrDeadlineExceeded is returned if it is exceeded. No deadline if it is zero.
+	// An entry whose fsync times out is rolled back, so it is not applied on recovery unless the fsync left running
+	// in background persists it before the rollback, see DBConfig.IndexUpdateMode.
+	Deadline time.Time
+
+	// TTL is the time to live of the written key, it overrides DBConfig.DefaultTTL if it is positive.
+	TTL time.Duration
+
+	// Persist makes the written key never expire, even if DBConfig.DefaultTTL is set.
+	Persist bool
+}
+
+// expiredAt returns expiredAt(unix milliseconds) of the key written with the options at now, 0 if it never expires.
+func (opts WriteOptions) expiredAt(db *LazyDB, now time.Time) int64 {
+	switch {
+	case opts.Persist:
+		return 0
+	case opts.TTL > 0:
+		return now.Add(opts.TTL).UnixMilli()
+	}
+	return db.defaultExpiredAt(now)
+}
+
+// ReadOptions options of a read operation.
+type ReadOptions struct {
+	// Deadline bounds how long the operation waits for locks,
+	// ErrDeadlineExceeded is returned if it is exceeded. No deadline if it is zero.
+	Deadline time.Time
+}
+
+// MergeOptions options of merging a log file.
+type MergeOptions struct {
+	// Force skips entries that fail the crc check rather than aborting the merge,
+	// the skipped entries are lost once the log file is removed.
+	Force bool
+
+	// Progress is called periodically during merge if it is not nil, total is the size of log files to merge
+	// and done is the size that has been processed. It is never called while holding the lock of a log file,
+	// and done reaches total once the merge finishes.
+	Progress func(done, total int64)
+
+	// Verify re-reads every merged log file before it is removed, and checks that none of its entries is still
+	// indexed, and that the entries which replace them can be read back under the same keys. If the check fails,
+	// the merge is aborted with ErrMergeVerification and the log file is kept, so that a buggy rewrite can't lose data.
+	Verify bool
+
+	// GroupByRecency rewrites live entries of the merged log file in order of their written-at timestamps rather than
+	// in order of offsets, so that entries written close together in time sit next to each other in the new log
+	// file, e.g. for time-series-like workloads reading keys written in the same period. It is an alternative to
+	// the grouping by keys of Defrag. Timestamps are recorded by DBConfig.RecordTimestamps, entries without one keep
+	// their order before the others, and tombstones are rewritten before all of them. Entries of the log file are
+	// held in memory until they are all rewritten.
+	GroupByRecency bool
+}
+
+// mergeProgressSteps is the number of times Progress is called at most for a merge, besides once per log file.
+const mergeProgressSteps = 100
+
+// mergeProgress reports progress of a merge across log files.
+type mergeProgress struct {
+	fn       func(done, total int64)
+	total    int64
+	step     int64
+	base     int64 // size of merged log files
+	reported int64
+}
+
+func newMergeProgress(fn func(done, total int64), total int64) *mergeProgress {
+	step := total / mergeProgressSteps
+	if step == 0 {
+		step = 1
+	}
+	return &mergeProgress{fn: fn, total: total, step: step}
+}
+
+// report reports that offset bytes of the current log file have been processed.
+// It is throttled unless force is true, and nothing is reported if done is not increased.
+func (p *mergeProgress) report(offset int64, force bool) {
+	if p.fn == nil {
+		return
+	}
+	done := p.base + offset
+	if done > p.total {
+		done = p.total
+	}
+	if done == p.reported || (!force && done-p.reported < p.step) {
+		return
+	}
+	p.reported = done
+	p.fn(done, p.total)
+}
+
+// finishFile reports that the current log file of size has been merged.
+func (p *mergeProgress) finishFile(size int64) {
+	p.report(size, true)
+	p.base += size
+}
+
+// lockWithDeadline locks mu, it gives up and returns ErrDeadlineExceeded once deadline is exceeded.
+// It blocks until mu is locked if deadline is zero.
+func lockWithDeadline(mu *sync.RWMutex, deadline time.Time) error {
+	if deadline.IsZero() {
+		mu.Lock()
+		return nil
+	}
+	return retryWithDeadline(mu.TryLock, deadline)
+}
+
+// rlockWithDeadline is like lockWithDeadline, but read-locks mu.
+func rlockWithDeadline(mu *sync.RWMutex, deadline time.Time) error {
+	if deadline.IsZero() {
+		mu.RLock()
+		return nil
+	}
+	return retryWithDeadline(mu.TryRLock, deadline)
+}
+
+// retryWithDeadline calls tryLock with backoff until it succeeds or deadline is exceeded.
+func retryWithDeadline(tryLock func() bool, deadline time.Time) error {
+	backoff := minLockBackoff
+	for !tryLock() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return ErrDeadlineExceeded
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxLockBackoff {
+			backoff = maxLockBackoff
+		}
+	}
+	return nil
+}
+
+// syncWithDeadline syncs the log file, it returns ErrDeadlineExceeded once deadline is exceeded,
+// and the fsync keeps running in background then.
+// It blocks until fsync finishes if deadline is zero.
+func syncWithDeadline(lf *logfile.LogFile, deadline time.Time) error {
+	if deadline.IsZero() {
+		return lf.Sync()
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- lf.Sync()
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case err := <-errCh:
+		return err
+	case <-timer.C:
+		return ErrDeadlineExceeded
+	}
+}
+
+// SortOptions options of Sort.
+type SortOptions struct {
+	// Alpha sorts elements lexicographically as bytes, otherwise they are sorted as float64 numbers.
+	Alpha bool
+
+	// Desc sorts elements from the largest to the smallest.
+	Desc bool
+
+	// Offset and Count return at most Count sorted elements after skipping the first Offset ones,
+	// like LIMIT of Redis. No limit if Count is not positive.
+	Offset int
+	Count  int
+}
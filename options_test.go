@@ -0,0 +1,116 @@
+package lazydb
+
+import (
+	"github.com/billsjc123/LazyDB/iocontroller"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// slowSyncIOController simulates a stalled disk on fsync.
+type slowSyncIOController struct {
+	iocontroller.IOController
+	delay time.Duration
+}
+
+func (c *slowSyncIOController) Sync() error {
+	time.Sleep(c.delay)
+	return c.IOController.Sync()
+}
+
+func TestLazyDB_SetWithOptions(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	assert.Nil(t, db.Set(GetKey(1), GetValue32()))
+	activeLogFile := db.getActiveLogFile(valueTypeString)
+
+	// the active log file is held by someone else
+	activeLogFile.mu.Lock()
+	start := time.Now()
+	err := db.SetWithOptions(GetKey(1), GetValue32(), WriteOptions{Deadline: time.Now().Add(50 * time.Millisecond)})
+	assert.Equal(t, ErrDeadlineExceeded, err)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// writes without deadline wait for the lock
+	done := make(chan error)
+	value := GetValue32()
+	go func() {
+		done <- db.SetWithOptions(GetKey(1), value, WriteOptions{})
+	}()
+	select {
+	case <-done:
+		t.Fatal("write should be blocked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	activeLogFile.mu.Unlock()
+	assert.Nil(t, <-done)
+
+	got, err := db.Get(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, got)
+
+	err = db.SetWithOptions(GetKey(2), value, WriteOptions{Deadline: time.Now().Add(time.Second)})
+	assert.Nil(t, err)
+}
+
+func TestLazyDB_SetWithOptions_SlowSync(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_slow_sync")
+	cfg := DefaultDBConfig(path)
+	cfg.IndexUpdateMode = IndexUpdateAfterSync
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	lf := db.getActiveLogFile(valueTypeString).lf
+	lf.IoController = &slowSyncIOController{IOController: lf.IoController, delay: 500 * time.Millisecond}
+
+	start := time.Now()
+	err = db.SetWithOptions(GetKey(1), GetValue32(), WriteOptions{Deadline: time.Now().Add(50 * time.Millisecond)})
+	assert.Equal(t, ErrDeadlineExceeded, err)
+	assert.Less(t, time.Since(start), 400*time.Millisecond)
+	// index is not updated
+	_, err = db.Get(GetKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the entry is rolled back, so the next write takes its place and it is not applied on recovery
+	value := GetValue32()
+	offset := lf.Offset
+	assert.Nil(t, db.Set(GetKey(2), value))
+	pos := db.getActiveLogFile(valueTypeString).last
+	assert.Equal(t, lf.Fid, pos.fid)
+	assert.Equal(t, offset, pos.offset)
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	_, err = db.Get(GetKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	got, err := db.Get(GetKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, value, got)
+}
+
+func TestLazyDB_GetWithOptions(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	value := GetValue32()
+	assert.Nil(t, db.Set(GetKey(1), value))
+
+	db.strIndex.mu.Lock()
+	_, err := db.GetWithOptions(GetKey(1), ReadOptions{Deadline: time.Now().Add(50 * time.Millisecond)})
+	assert.Equal(t, ErrDeadlineExceeded, err)
+	db.strIndex.mu.Unlock()
+
+	got, err := db.GetWithOptions(GetKey(1), ReadOptions{Deadline: time.Now().Add(time.Second)})
+	assert.Nil(t, err)
+	assert.Equal(t, value, got)
+}
@@ -0,0 +1,34 @@
+package lazydb
+
+// PruneEmptyCollections removes indexes of hashes, lists, sets and sorted sets which hold no entries, and returns
+// the number of them removed. Collections are removed from the index once they become empty by most writes, it
+// catches the ones left behind, so that memory of their map entries is reclaimed. Nothing is written into log files.
+func (db *LazyDB) PruneEmptyCollections() (int, error) {
+	if db.IsClosed() {
+		return 0, ErrDatabaseClosed
+	}
+	var pruned int
+	for _, typ := range []valueType{valueTypeList, valueTypeHash, valueTypeSet} {
+		mu := db.getIndexLock(typ)
+		mu.Lock()
+		trees := db.collectionTrees(typ)
+		for key, idxTree := range trees {
+			if idxTree == nil || idxTree.Size() == 0 {
+				db.removeCollectionTree(typ, []byte(key))
+				pruned++
+			}
+		}
+		mu.Unlock()
+	}
+
+	db.zSetIndex.mu.Lock()
+	for key, idx := range db.zSetIndex.indexes {
+		if idx == nil || idx.tree == nil || idx.tree.Size() == 0 {
+			delete(db.zSetIndex.indexes, key)
+			db.unindexKey(valueTypeZSet, []byte(key))
+			pruned++
+		}
+	}
+	db.zSetIndex.mu.Unlock()
+	return pruned, nil
+}
@@ -0,0 +1,68 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/billsjc123/LazyDB/ds"
+	"github.com/billsjc123/LazyDB/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// emptyTree deletes all entries of idxTree from the index, leaving the tree itself behind.
+func emptyTree(t *testing.T, idxTree *ds.AdaptiveRadixTree) {
+	var keys [][]byte
+	iter := idxTree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		assert.Nil(t, err)
+		keys = append(keys, node.Key())
+	}
+	for _, key := range keys {
+		idxTree.Delete(key)
+	}
+}
+
+func TestLazyDB_PruneEmptyCollections(t *testing.T) {
+	wd, _ := os.Getwd()
+	db, err := Open(DefaultDBConfig(filepath.Join(wd, "test_prune_empty")))
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 4; i++ {
+		key := GetKey(i)
+		assert.Nil(t, db.HSet(key, []byte("field"), GetValue(8)))
+		assert.Nil(t, db.RPush(key, GetValue(8)))
+		assert.Nil(t, db.SAdd(key, GetValue(8)))
+		assert.Nil(t, db.ZAdd(key, util.Float64ToByte(1), GetValue(8)))
+	}
+	// even keys are emptied without removing them from the index
+	for i := 0; i < 4; i += 2 {
+		key := string(GetKey(i))
+		emptyTree(t, db.hashIndex.trees[key])
+		emptyTree(t, db.listIndex.trees[key])
+		emptyTree(t, db.setIndex.trees[key])
+		emptyTree(t, db.zSetIndex.indexes[key].tree)
+	}
+
+	pruned, err := db.PruneEmptyCollections()
+	assert.Nil(t, err)
+	assert.Equal(t, 8, pruned)
+	for i := 0; i < 4; i++ {
+		key := string(GetKey(i))
+		_, ok := db.hashIndex.trees[key]
+		assert.Equal(t, i%2 == 1, ok)
+		_, ok = db.listIndex.trees[key]
+		assert.Equal(t, i%2 == 1, ok)
+		_, ok = db.setIndex.trees[key]
+		assert.Equal(t, i%2 == 1, ok)
+		_, ok = db.zSetIndex.indexes[key]
+		assert.Equal(t, i%2 == 1, ok)
+	}
+	assert.Equal(t, 1, lLen(t, db, GetKey(1)))
+
+	pruned, err = db.PruneEmptyCollections()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, pruned)
+}
@@ -0,0 +1,57 @@
+package lazydb
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// lockedRand is a rand.Rand safe for concurrent use, since rand.Source is not.
+// The zero value uses a time-seeded source, see DBConfig.RandSource.
+type lockedRand struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// pick returns indexes of count elements picked randomly out of size elements like SRANDMEMBER of Redis.
+// The indexes are distinct if count is positive, and at most size are picked. They may repeat if count is
+// negative, and -count are picked. None is picked if count is 0 or size is 0.
+func (r *lockedRand) pick(size, count int, src rand.Source) []int {
+	if size == 0 || count == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rnd == nil {
+		if src == nil {
+			src = rand.NewSource(time.Now().UnixNano())
+		}
+		r.rnd = rand.New(src)
+	}
+
+	if count < 0 {
+		indexes := make([]int, -count)
+		for i := range indexes {
+			indexes[i] = r.rnd.Intn(size)
+		}
+		return indexes
+	}
+	if count > size {
+		count = size
+	}
+	// partial Fisher-Yates shuffle
+	indexes := make([]int, size)
+	for i := range indexes {
+		indexes[i] = i
+	}
+	for i := 0; i < count; i++ {
+		j := i + r.rnd.Intn(size-i)
+		indexes[i], indexes[j] = indexes[j], indexes[i]
+	}
+	return indexes[:count]
+}
+
+// randPick returns indexes picked out of size elements by DBConfig.RandSource, see lockedRand.pick.
+func (db *LazyDB) randPick(size, count int) []int {
+	return db.rand.pick(size, count, db.cfg.RandSource)
+}
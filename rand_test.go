@@ -0,0 +1,76 @@
+package lazydb
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_RandSource(t *testing.T) {
+	wd, _ := os.Getwd()
+	values := make([][]byte, 50)
+	for i := range values {
+		values[i] = GetValue32()
+	}
+	open := func(name string, seed int64) *LazyDB {
+		cfg := DefaultDBConfig(filepath.Join(wd, name))
+		cfg.RandSource = rand.NewSource(seed)
+		db, err := Open(cfg)
+		assert.Nil(t, err)
+		for i := range values {
+			assert.Nil(t, db.SAdd([]byte("set"), GetKey(i)))
+			assert.Nil(t, db.HSet([]byte("hash"), GetKey(i), values[i]))
+			_, err = db.ZAddWithFlags([]byte("zset"), 0, ZMember{Member: GetKey(i), Score: float64(i)})
+			assert.Nil(t, err)
+		}
+		return db
+	}
+	db1 := open("test_rand_source_1", 42)
+	defer destroyDB(db1)
+	db2 := open("test_rand_source_2", 42)
+	defer destroyDB(db2)
+
+	sample := func(db *LazyDB) ([][][]byte, [][]ZMember) {
+		var samples [][][]byte
+		var zSamples [][]ZMember
+		for _, count := range []int{5, -5, 100} {
+			members, err := db.SRandMember([]byte("set"), count)
+			assert.Nil(t, err)
+			fields, err := db.HRandField([]byte("hash"), count, true)
+			assert.Nil(t, err)
+			zMembers, err := db.ZRandMember([]byte("zset"), count)
+			assert.Nil(t, err)
+			samples = append(samples, members, fields)
+			zSamples = append(zSamples, zMembers)
+		}
+		return samples, zSamples
+	}
+	samples1, zSamples1 := sample(db1)
+	samples2, zSamples2 := sample(db2)
+	assert.Equal(t, samples1, samples2)
+	assert.Equal(t, zSamples1, zSamples2)
+
+	// distinct members if count is positive, at most all of them
+	assert.Len(t, samples1[0], 5)
+	distinct := make(map[string]bool)
+	for _, member := range samples1[0] {
+		distinct[string(member)] = true
+	}
+	assert.Len(t, distinct, 5)
+	assert.Len(t, samples1[1], 10)
+	assert.Len(t, samples1[3], 10)
+	assert.Len(t, samples1[4], 50)
+	assert.Len(t, zSamples1[2], 50)
+	for i := 0; i < len(samples1[1]); i += 2 {
+		val, err := db1.HGet([]byte("hash"), samples1[1][i])
+		assert.Nil(t, err)
+		assert.Equal(t, val, samples1[1][i+1])
+	}
+
+	members, err := db1.SRandMember([]byte("missing"), 3)
+	assert.Nil(t, err)
+	assert.Empty(t, members)
+}
@@ -0,0 +1,269 @@
+package lazydb
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/billsjc123/LazyDB/logfile"
+)
+
+// RecoveryReport describes log files which are skipped when building indexes on opening,
+// see DBConfig.SkipCorruptFiles.
+type RecoveryReport struct {
+	SkippedFiles []SkippedLogFile
+
+	// CleanShutdown whether the db was closed cleanly by Close before opening, so that checkpoints were applied
+	// rather than replaying all log files. It is false if the db is created by opening.
+	CleanShutdown bool
+
+	// RenumberedFiles log files sharing a fid with others, which were given new fids on opening,
+	// see DBConfig.RepairDuplicateFids.
+	RenumberedFiles []RenumberedLogFile
+
+	// UnrecoveredFiles log files older than the latest ones recovered on opening, see DBConfig.RecoverLatestFiles.
+	UnrecoveredFiles []UnrecoveredLogFile
+}
+
+// UnrecoveredLogFile a log file which was not recovered on opening, Removed is true if it was removed.
+type UnrecoveredLogFile struct {
+	Type    valueType
+	Fid     uint32
+	Removed bool
+}
+
+// RenumberedLogFile a log file named Name which shared its fid with other log files, it was renamed with Fid.
+type RenumberedLogFile struct {
+	Type valueType
+	Name string
+	Fid  uint32
+}
+
+// SkippedLogFile a log file skipped on opening because of Err. Entries from Offset to the end of the file are lost,
+// Offset is 0 if the log file can't be opened at all.
+type SkippedLogFile struct {
+	Type   valueType
+	Fid    uint32
+	Offset int64
+	Err    error
+}
+
+// recoveryState collects the RecoveryReport while indexes of different types are built concurrently.
+type recoveryState struct {
+	mu     sync.Mutex
+	report RecoveryReport
+}
+
+// RecoveryReport returns log files skipped on opening, it is empty unless DBConfig.SkipCorruptFiles is on.
+func (db *LazyDB) RecoveryReport() RecoveryReport {
+	db.recovery.mu.Lock()
+	defer db.recovery.mu.Unlock()
+	skipped := make([]SkippedLogFile, len(db.recovery.report.SkippedFiles))
+	copy(skipped, db.recovery.report.SkippedFiles)
+	renumbered := make([]RenumberedLogFile, len(db.recovery.report.RenumberedFiles))
+	copy(renumbered, db.recovery.report.RenumberedFiles)
+	unrecovered := make([]UnrecoveredLogFile, len(db.recovery.report.UnrecoveredFiles))
+	copy(unrecovered, db.recovery.report.UnrecoveredFiles)
+	return RecoveryReport{SkippedFiles: skipped, CleanShutdown: db.recovery.report.CleanShutdown,
+		RenumberedFiles: renumbered, UnrecoveredFiles: unrecovered}
+}
+
+// dropUnrecoveredFiles returns the latest DBConfig.RecoverLatestFiles of fids sorted in order, the older log files
+// are reported, and removed if DBConfig.RemoveUnrecoveredFiles is on.
+func (db *LazyDB) dropUnrecoveredFiles(typ valueType, fids []uint32) []uint32 {
+	n := db.cfg.RecoverLatestFiles
+	if n <= 0 || len(fids) <= n {
+		return fids
+	}
+	older := fids[:len(fids)-n]
+	for _, fid := range older {
+		removed := false
+		if db.cfg.RemoveUnrecoveredFiles && !db.readOnly() {
+			if err := db.removeUnrecoveredFile(typ, fid); err != nil {
+				log.Printf("failed to remove unrecovered log file, type: %d, fid: %d, err: %v", typ, fid, err)
+			} else {
+				removed = true
+			}
+		}
+		db.recovery.mu.Lock()
+		db.recovery.report.UnrecoveredFiles = append(db.recovery.report.UnrecoveredFiles,
+			UnrecoveredLogFile{Type: typ, Fid: fid, Removed: removed})
+		db.recovery.mu.Unlock()
+	}
+	log.Printf("recover the latest %d log files, %d older ones are not recovered, type: %d", n, len(older), typ)
+	return fids[len(fids)-n:]
+}
+
+func (db *LazyDB) removeUnrecoveredFile(typ valueType, fid uint32) error {
+	lf, err := db.openLogFile(typ, fid)
+	if err != nil {
+		return err
+	}
+	if err = lf.Delete(); err != nil {
+		return err
+	}
+	db.removeIndexLog(typ, fid)
+	db.discardsMap[typ].clear(fid)
+	return nil
+}
+
+// skipCorruptFile reports the log file which fails at offset with err, and returns the error wrapping err
+// to fail opening the db unless DBConfig.SkipCorruptFiles is on.
+func (db *LazyDB) skipCorruptFile(typ valueType, fid uint32, offset int64, err error) error {
+	if !db.cfg.SkipCorruptFiles {
+		return fmt.Errorf("log file error: %w. Type: %v, Fid: %v, Offset: %v", err, typ, fid, offset)
+	}
+	log.Printf("skip corrupt log file, err: %v. Type: %v, Fid: %v, Offset: %v", err, typ, fid, offset)
+	db.recovery.mu.Lock()
+	defer db.recovery.mu.Unlock()
+	db.recovery.report.SkippedFiles = append(db.recovery.report.SkippedFiles,
+		SkippedLogFile{Type: typ, Fid: fid, Offset: offset, Err: err})
+	return nil
+}
+
+// availableFid returns fid, or the first one after it which is not taken by a log file skipped on opening,
+// so that new log files never overwrite the skipped ones.
+func (db *LazyDB) availableFid(typ valueType, fid uint32) uint32 {
+	db.recovery.mu.Lock()
+	defer db.recovery.mu.Unlock()
+	for {
+		taken := false
+		for _, s := range db.recovery.report.SkippedFiles {
+			if s.Type == typ && s.Fid == fid {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			return fid
+		}
+		fid = db.nextFid(fid)
+	}
+}
+
+// resolveDuplicateFids checks names of log files by type and fid, scanned from the db directory. If several files
+// share a fid in a type, which one is opened is ambiguous and the others would be shadowed silently, so opening fails
+// with ErrDuplicateFid listing them, unless DBConfig.RepairDuplicateFids is on. Then the least recently modified file
+// keeps the fid, and the others are renamed with fids after the last one of the type in order of modification,
+// so that entries of the most recently modified file win. names is updated with the new fids.
+func (db *LazyDB) resolveDuplicateFids(names map[valueType]map[uint32][]string) error {
+	var duplicates []string
+	for _, fids := range names {
+		for _, files := range fids {
+			if len(files) > 1 {
+				duplicates = append(duplicates, files...)
+			}
+		}
+	}
+	if len(duplicates) == 0 {
+		return nil
+	}
+	sort.Strings(duplicates)
+	if !db.cfg.RepairDuplicateFids || db.readOnly() {
+		return fmt.Errorf("%w: %s", ErrDuplicateFid, strings.Join(duplicates, ", "))
+	}
+	// checkpoints may have been taken from any of the files sharing a fid
+	if err := db.deleteCheckpoints(); err != nil {
+		return err
+	}
+
+	for typ, fids := range names {
+		var dupFids []uint32
+		var lastFid uint32
+		for fid, files := range fids {
+			if len(files) > 1 {
+				dupFids = append(dupFids, fid)
+			}
+			if fid > lastFid {
+				lastFid = fid
+			}
+		}
+		sort.Slice(dupFids, func(i, j int) bool { return dupFids[i] < dupFids[j] })
+		for _, fid := range dupFids {
+			files, err := db.sortByModTime(fids[fid])
+			if err != nil {
+				return err
+			}
+			fids[fid] = files[:1]
+			for _, name := range files[1:] {
+				lastFid++
+				newName, _ := logfile.FileName(logfile.FType(typ), lastFid)
+				if err := os.Rename(filepath.Join(db.cfg.DBPath, name), filepath.Join(db.cfg.DBPath, newName)); err != nil {
+					return err
+				}
+				log.Printf("renumber log file %s sharing fid %d to %s", name, fid, newName)
+				fids[lastFid] = []string{newName}
+				db.recovery.mu.Lock()
+				db.recovery.report.RenumberedFiles = append(db.recovery.report.RenumberedFiles,
+					RenumberedLogFile{Type: typ, Name: name, Fid: lastFid})
+				db.recovery.mu.Unlock()
+			}
+		}
+	}
+	if db.cfg.NoSyncDir {
+		return nil
+	}
+	return syncDir(db.cfg.DBPath)
+}
+
+// sortByModTime sorts names of files in the db directory from the least recently modified one.
+func (db *LazyDB) sortByModTime(names []string) ([]string, error) {
+	infos := make(map[string]fs.FileInfo, len(names))
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(db.cfg.DBPath, name))
+		if err != nil {
+			return nil, err
+		}
+		infos[name] = info
+	}
+	sorted := append([]string{}, names...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return infos[sorted[i]].ModTime().Before(infos[sorted[j]].ModTime())
+	})
+	return sorted, nil
+}
+
+// recoveryProgress reports progress of building the index of a type to DBConfig.RecoveryProgress.
+type recoveryProgress struct {
+	typ        valueType
+	report     func(typ valueType, filesDone, filesTotal int, bytesDone, bytesTotal int64)
+	sizes      []int64
+	filesDone  int
+	bytesDone  int64
+	bytesTotal int64
+}
+
+// newRecoveryProgress returns the progress of building the index of the type from logFiles, and reports
+// that nothing is read yet. It returns nil if DBConfig.RecoveryProgress is nil.
+func (db *LazyDB) newRecoveryProgress(typ valueType, logFiles []*logfile.LogFile) *recoveryProgress {
+	if db.cfg.RecoveryProgress == nil {
+		return nil
+	}
+	p := &recoveryProgress{typ: typ, report: db.cfg.RecoveryProgress, sizes: make([]int64, len(logFiles))}
+	for i, lf := range logFiles {
+		size, err := lf.Size()
+		if err != nil {
+			log.Printf("failed to get size of log file, type: %d, fid: %d, err: %v", typ, lf.Fid, err)
+			continue
+		}
+		p.sizes[i] = size
+		p.bytesTotal += size
+	}
+	p.report(typ, 0, len(logFiles), 0, p.bytesTotal)
+	return p
+}
+
+// fileDone reports that the i-th log file is read.
+func (p *recoveryProgress) fileDone(i int) {
+	if p == nil {
+		return
+	}
+	p.filesDone++
+	p.bytesDone += p.sizes[i]
+	p.report(p.typ, p.filesDone, len(p.sizes), p.bytesDone, p.bytesTotal)
+}
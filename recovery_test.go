@@ -0,0 +1,373 @@
+package lazydb
+
+import (
+	"bytes"
+	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/billsjc123/LazyDB/util"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_SkipCorruptFiles(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_skip_corrupt_files")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 150 //  set max file so that it can only contain 2 entry in a file
+	cfg.SkipCorruptFiles = true
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	values := make([][]byte, 6)
+	for i := range values {
+		values[i] = GetValue32()
+		assert.Nil(t, db.Set(GetKey(i), values[i]))
+	}
+	assert.Equal(t, []uint32{1, 2, 3}, db.fidsMap[valueTypeString].fids)
+	assert.Empty(t, db.RecoveryReport().SkippedFiles)
+	assert.Nil(t, db.Close())
+
+	// fid 2 holding key 2 and key 3 is overwritten with garbage
+	garbage := bytes.Repeat([]byte{0xff}, 150)
+	assert.Nil(t, os.WriteFile(logFileName(path, logfile.Strs, 2), garbage, 0644))
+	// opening fails with the error of the corrupt file unless it is skipped
+	cfg.SkipCorruptFiles = false
+	_, err = Open(cfg)
+	assert.ErrorIs(t, err, logfile.ErrUnsupportedVersion)
+	cfg.SkipCorruptFiles = true
+	// a log file which can't be opened
+	assert.Nil(t, os.MkdirAll(logFileName(path, logfile.Hash, 1), os.ModePerm))
+
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	for i := range values {
+		val, err := db.Get(GetKey(i))
+		if i == 2 || i == 3 {
+			assert.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+	}
+
+	report := db.RecoveryReport()
+	assert.Equal(t, 2, len(report.SkippedFiles))
+	skipped := make(map[valueType]SkippedLogFile)
+	for _, s := range report.SkippedFiles {
+		skipped[s.Type] = s
+	}
+	assert.Equal(t, uint32(2), skipped[valueTypeString].Fid)
+	assert.Equal(t, int64(0), skipped[valueTypeString].Offset)
+	assert.Equal(t, logfile.ErrUnsupportedVersion, skipped[valueTypeString].Err)
+	assert.Equal(t, uint32(1), skipped[valueTypeHash].Fid)
+	assert.NotNil(t, skipped[valueTypeHash].Err)
+
+	// the salvaged db is still writable
+	assert.Nil(t, db.Set(GetKey(2), values[2]))
+	val, err := db.Get(GetKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, values[2], val)
+	assert.Nil(t, db.HSet(GetKey(0), []byte("f"), values[0]))
+}
+
+func TestLazyDB_CleanShutdown(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_clean_shutdown")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 1000
+	cfg.CheckpointInterval = time.Hour
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+	assert.False(t, db.RecoveryReport().CleanShutdown)
+	dump := func(db *LazyDB) string {
+		var buf bytes.Buffer
+		assert.Nil(t, db.DumpAll(&buf))
+		return buf.String()
+	}
+
+	writeRecoveryDataset(t, db, 400)
+	fids := append([]uint32{}, db.fidsMap[valueTypeString].fids...)
+	assert.Greater(t, len(fids), 2)
+	want := dump(db)
+	assert.Nil(t, db.Close())
+	_, err = os.Stat(filepath.Join(path, cleanShutdownFileName))
+	assert.Nil(t, err)
+
+	defer func() {
+		afterReplayHook = nil
+	}()
+	var replayed []uint32
+	afterReplayHook = func(typ valueType, fid uint32) {
+		if typ == valueTypeString {
+			replayed = append(replayed, fid)
+		}
+	}
+
+	// the checkpoints saved on closing are applied, no log file is replayed from the start
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.True(t, db.RecoveryReport().CleanShutdown)
+	assert.Empty(t, replayed)
+	assert.Equal(t, want, dump(db))
+	// the marker is removed while the db is open
+	_, err = os.Stat(filepath.Join(path, cleanShutdownFileName))
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, db.Close())
+
+	// all log files are replayed without the marker, e.g. after a crash
+	assert.Nil(t, os.Remove(filepath.Join(path, cleanShutdownFileName)))
+	replayed = nil
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.False(t, db.RecoveryReport().CleanShutdown)
+	assert.Equal(t, fids[:len(fids)-1], replayed)
+	assert.Equal(t, want, dump(db))
+	_, err = os.Stat(db.checkpointPath(valueTypeString))
+	assert.True(t, os.IsNotExist(err))
+
+	// a crash while the db is open, synced entries are recovered by replaying
+	assert.Nil(t, db.Set(GetKey(1000), GetValue32()))
+	assert.Nil(t, db.Sync())
+	want = dump(db)
+	crashed := db
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.False(t, db.RecoveryReport().CleanShutdown)
+	assert.Equal(t, want, dump(db))
+	assert.Nil(t, crashed.Close())
+}
+
+func TestLazyDB_DuplicateFids(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_duplicate_fids")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 150
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	values := make([][]byte, 6)
+	for i := range values {
+		values[i] = GetValue32()
+		assert.Nil(t, db.Set(GetKey(i), values[i]))
+	}
+	fids := append([]uint32{}, db.fidsMap[valueTypeString].fids...)
+	assert.Nil(t, db.Close())
+
+	// a log file of fid 1 from another db is copied in with a legacy name
+	otherCfg := DefaultDBConfig(filepath.Join(wd, "test_duplicate_fids_other"))
+	otherCfg.MaxLogFileSize = 150
+	other, err := Open(otherCfg)
+	assert.Nil(t, err)
+	newValue := GetValue32()
+	assert.Nil(t, other.Set(GetKey(0), newValue))
+	data, err := os.ReadFile(logFileName(otherCfg.DBPath, logfile.Strs, 1))
+	assert.Nil(t, err)
+	destroyDB(other)
+	prefix, _ := logfile.FileNamePrefix(logfile.Strs)
+	duplicate := prefix + "1"
+	assert.Nil(t, os.WriteFile(filepath.Join(path, duplicate), data, 0644))
+	later := time.Now().Add(time.Hour)
+	assert.Nil(t, os.Chtimes(filepath.Join(path, duplicate), later, later))
+
+	// detected, opening fails rather than exiting
+	_, err = Open(cfg)
+	assert.ErrorIs(t, err, ErrDuplicateFid)
+	original, _ := logfile.FileName(logfile.Strs, 1)
+	assert.Contains(t, err.Error(), original)
+	assert.Contains(t, err.Error(), duplicate)
+	_, err = OpenFS(os.DirFS(path), cfg)
+	assert.ErrorIs(t, err, ErrDuplicateFid)
+
+	// repaired, the renamed file is the latest one
+	cfg.RepairDuplicateFids = true
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	newFid := fids[len(fids)-1] + 1
+	assert.Equal(t, []RenumberedLogFile{{Type: valueTypeString, Name: duplicate, Fid: newFid}},
+		db.RecoveryReport().RenumberedFiles)
+	assert.Equal(t, append(fids, newFid), db.fidsMap[valueTypeString].fids)
+	assert.False(t, util.PathExist(filepath.Join(path, duplicate)))
+	val, err := db.Get(GetKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, newValue, val)
+	for i := 1; i < len(values); i++ {
+		val, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+	}
+}
+
+func TestLazyDB_RecoveryProgress(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_recovery_progress")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 150
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	for i := 0; i < 6; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+	}
+	assert.Nil(t, db.HSet([]byte("hash"), []byte("field"), GetValue32()))
+	strFiles := len(db.fidsMap[valueTypeString].fids)
+	assert.Greater(t, strFiles, 1)
+	assert.Nil(t, db.Close())
+
+	type progress struct {
+		filesDone, filesTotal int
+		bytesDone, bytesTotal int64
+	}
+	var mu sync.Mutex
+	reported := make(map[valueType][]progress)
+	cfg.RecoveryProgress = func(typ valueType, filesDone, filesTotal int, bytesDone, bytesTotal int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		reported[typ] = append(reported[typ], progress{filesDone, filesTotal, bytesDone, bytesTotal})
+	}
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+
+	assert.Equal(t, strFiles+1, len(reported[valueTypeString]))
+	assert.Equal(t, 2, len(reported[valueTypeHash]))
+	for _, typ := range []valueType{valueTypeString, valueTypeHash} {
+		all := reported[typ]
+		assert.Equal(t, 0, all[0].filesDone)
+		assert.Equal(t, int64(0), all[0].bytesDone)
+		for i := 1; i < len(all); i++ {
+			assert.Equal(t, all[i-1].filesDone+1, all[i].filesDone)
+			assert.Greater(t, all[i].bytesDone, all[i-1].bytesDone)
+			assert.Equal(t, all[0].filesTotal, all[i].filesTotal)
+			assert.Equal(t, all[0].bytesTotal, all[i].bytesTotal)
+		}
+		last := all[len(all)-1]
+		assert.Equal(t, last.filesTotal, last.filesDone)
+		assert.Equal(t, last.bytesTotal, last.bytesDone)
+	}
+}
+
+func TestLazyDB_RecoverLatestFiles(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_recover_latest_files")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 150
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	const n = 30
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+	}
+	fids := append([]uint32{}, db.fidsMap[valueTypeString].fids...)
+	assert.Greater(t, len(fids), 5)
+	// keys in the latest 2 log files
+	var recent []int
+	for i := 0; i < n; i++ {
+		if db.strIndex.idxTree.Get(GetKey(i)).(*Value).fid >= fids[len(fids)-2] {
+			recent = append(recent, i)
+		}
+	}
+	assert.Nil(t, db.Close())
+
+	cfg.RecoverLatestFiles = 2
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, len(recent), db.Count())
+	for _, i := range recent {
+		_, err = db.Get(GetKey(i))
+		assert.Nil(t, err)
+	}
+	_, err = db.Get(GetKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	unrecovered := db.RecoveryReport().UnrecoveredFiles
+	assert.Equal(t, len(fids)-2, len(unrecovered))
+	assert.Equal(t, UnrecoveredLogFile{Type: valueTypeString, Fid: fids[0]}, unrecovered[0])
+	assert.Nil(t, db.Close())
+
+	// the older log files are kept unless they are removed
+	_, err = os.Stat(logFileName(path, logfile.Strs, fids[0]))
+	assert.Nil(t, err)
+	cfg.RemoveUnrecoveredFiles = true
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	for _, fid := range fids[:len(fids)-2] {
+		_, err = os.Stat(logFileName(path, logfile.Strs, fid))
+		assert.True(t, os.IsNotExist(err))
+	}
+	assert.True(t, db.RecoveryReport().UnrecoveredFiles[0].Removed)
+	assert.Nil(t, db.Set(GetKey(n), GetValue32()))
+	assert.Equal(t, len(recent)+1, db.Count())
+}
+
+func TestLazyDB_RecoveryReadRepair(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_recovery_read_repair"))
+	cfg.MaxLogFileAge = time.Hour
+	cfg.RecordTimestamps = true
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+
+	// fid 1 holds other fields, the stale entries of field are in fid 2, and newer ones in fid 3
+	key := []byte("read_repair")
+	assert.Nil(t, db.HSet(key, []byte("other"), []byte("v")))
+	now = now.Add(2 * time.Hour)
+	assert.Nil(t, db.HSet(key, []byte("field"), []byte("old")))
+	assert.Nil(t, db.HSet(key, []byte("deleted"), []byte("old")))
+	now = now.Add(2 * time.Hour)
+	assert.Nil(t, db.HSet(key, []byte("field"), []byte("new")))
+	now = now.Add(2 * time.Hour)
+	assert.Nil(t, db.HSet(key, []byte("active"), []byte("v")))
+	_, err = db.HDel(key, []byte("deleted"))
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{1, 2, 3, 4}, db.fidsMap[valueTypeHash].fids)
+
+	// the newer entry is moved before the stale one in order of log files, like MergeInto into an older file did
+	dest, target := db.getArchivedLogFile(valueTypeHash, 1), db.getArchivedLogFile(valueTypeHash, 3)
+	db.hashIndex.mu.Lock()
+	err = db.rewriteLiveEntries(valueTypeHash, target.lf, func(ent *logfile.LogEntry) (*ValuePos, error) {
+		return db.writeArchivedLogEntry(valueTypeHash, dest, ent)
+	})
+	db.hashIndex.mu.Unlock()
+	assert.Nil(t, err)
+	db.removeArchivedLogFile(valueTypeHash, 3)
+	assert.Nil(t, db.Close())
+
+	open := func(readRepair bool) {
+		cfg.RecoveryReadRepair = readRepair
+		db, err = Open(cfg)
+		assert.Nil(t, err)
+	}
+	open(false)
+	val, err := db.HGet(key, []byte("field"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("old"), val)
+	assert.Nil(t, db.Close())
+
+	open(true)
+	val, err = db.HGet(key, []byte("field"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), val)
+	val, err = db.HGet(key, []byte("deleted"))
+	assert.Nil(t, err)
+	assert.Nil(t, val)
+	for _, field := range []string{"other", "active"} {
+		val, err = db.HGet(key, []byte(field))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v"), val)
+	}
+}
@@ -0,0 +1,240 @@
+package lazydb
+
+import (
+	"errors"
+	"github.com/billsjc123/LazyDB/ds"
+	"github.com/billsjc123/LazyDB/logfile"
+	"sync"
+	"time"
+)
+
+// ErrApplyUnsupportedType is returned by ApplyEntry for types whose entries can't be applied.
+var ErrApplyUnsupportedType = errors.New("entries of the value type can't be applied")
+
+// replicaState positions of entries of a leader applied by ApplyEntry,
+// and positions of entries of this db applied by followers, reported by AckReplica.
+type replicaState struct {
+	mu      sync.Mutex
+	applied map[valueType]ValuePos
+	acks    map[string]map[valueType]ValuePos // by follower
+	ackCh   chan struct{}                     // closed and replaced by AckReplica, to wake up WaitReplicas
+}
+
+// ApplyEntry writes an entry streamed by Tail of a leader db into this db and updates the index like a local write,
+// so that this db can follow the leader as a replica. pos is the position of the entry in the log files of the leader,
+// it is the sequence of entries, and entries at or before the last applied position of the type are ignored,
+// so that a stream can be applied again from an earlier position. See AppliedPos.
+// Entries older than the indexed ones of their keys are ignored if DBConfig.VersionedEntries is on.
+// Only types whose indexes are built on opening are supported, they are String, Hash and custom types,
+// ErrApplyUnsupportedType is returned for the others. Applied positions are kept in memory, they are lost on Close.
+func (db *LazyDB) ApplyEntry(typ valueType, entry *logfile.LogEntry, pos ValuePos) error {
+	if db.readOnly() {
+		return ErrReadOnly
+	}
+	if !db.replicated(typ) {
+		return ErrApplyUnsupportedType
+	}
+	mu := db.getIndexLock(typ)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if applied, ok := db.AppliedPos(typ); ok && !pos.after(applied) {
+		return nil
+	}
+	// commit markers of transactions are not streamed, entries are committed once they are applied
+	txStat := entry.TxStat
+	if txStat == logfile.TxUncommited {
+		txStat = logfile.TxCommited
+	}
+	// entry of Tail must not be modified
+	ent := &logfile.LogEntry{
+		Key:       entry.Key,
+		Value:     entry.Value,
+		Stat:      entry.Stat,
+		ExpiredAt: entry.ExpiredAt,
+		TxID:      entry.TxID,
+		TxStat:    txStat,
+		Version:   entry.Version,
+		WrittenAt: entry.WrittenAt,
+	}
+	// an older entry of the leader loses to the indexed one
+	if !db.cfg.VersionedEntries || ent.Version == 0 || ent.Version >= db.indexedVersion(typ, ent) {
+		vPos, err := db.writeLogEntry(typ, ent)
+		if err != nil {
+			return err
+		}
+		if err = db.applyIndex(typ, ent, vPos); err != nil {
+			return err
+		}
+	}
+
+	db.replica.mu.Lock()
+	if db.replica.applied == nil {
+		db.replica.applied = make(map[valueType]ValuePos)
+	}
+	db.replica.applied[typ] = pos
+	db.replica.mu.Unlock()
+	return nil
+}
+
+// replicated returns whether entries of the type can be applied by ApplyEntry.
+func (db *LazyDB) replicated(typ valueType) bool {
+	return typ == valueTypeString || typ == valueTypeHash || db.getCustomType(typ) != nil
+}
+
+// AppliedPos returns the position in the log files of the leader of the last entry of the type applied by ApplyEntry,
+// the stream of the leader can be resumed by Tail from pos.Fid() and pos.Offset()+pos.EntrySize().
+// It returns false if no entry of the type has been applied since the db is opened.
+func (db *LazyDB) AppliedPos(typ valueType) (ValuePos, bool) {
+	db.replica.mu.Lock()
+	defer db.replica.mu.Unlock()
+	pos, ok := db.replica.applied[typ]
+	return pos, ok
+}
+
+// AckReplica records that the follower identified by id has applied entries of the type of this db up to pos,
+// which is reported by AppliedPos of the follower, see WaitReplicas. Positions older than the recorded one are ignored.
+func (db *LazyDB) AckReplica(id string, typ valueType, pos ValuePos) {
+	db.replica.mu.Lock()
+	defer db.replica.mu.Unlock()
+	if db.replica.acks == nil {
+		db.replica.acks = make(map[string]map[valueType]ValuePos)
+	}
+	acked := db.replica.acks[id]
+	if acked == nil {
+		acked = make(map[valueType]ValuePos)
+		db.replica.acks[id] = acked
+	}
+	if last, ok := acked[typ]; ok && !pos.after(last) {
+		return
+	}
+	acked[typ] = pos
+	if db.replica.ackCh != nil {
+		close(db.replica.ackCh)
+		db.replica.ackCh = nil
+	}
+}
+
+// WaitReplicas blocks until at least n followers have acknowledged by AckReplica applying all entries written into
+// this db so far, or timeout, and returns the number of followers that have. Only entries of types supported by
+// ApplyEntry which are written since the db is opened are waited for. It does not block if timeout is not positive,
+// and ErrDatabaseClosed is returned if the db is closed while waiting.
+func (db *LazyDB) WaitReplicas(n int, timeout time.Duration) (int, error) {
+	db.mu.RLock()
+	closeCh := db.closeCh
+	db.mu.RUnlock()
+	if closeCh == nil {
+		return 0, ErrDatabaseClosed
+	}
+	// entries written later are not waited for
+	written := make(map[valueType]ValuePos)
+	for _, typ := range db.valueTypes() {
+		if !db.replicated(typ) {
+			continue
+		}
+		mlf := db.activeLogFileMap[typ]
+		if mlf == nil {
+			continue
+		}
+		mlf.mu.RLock()
+		if last := mlf.last; last.entrySize > 0 {
+			written[typ] = last
+		}
+		mlf.mu.RUnlock()
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		db.replica.mu.Lock()
+		acked := db.replica.ackedFollowers(written)
+		if acked >= n || timeout <= 0 {
+			db.replica.mu.Unlock()
+			return acked, nil
+		}
+		if db.replica.ackCh == nil {
+			db.replica.ackCh = make(chan struct{})
+		}
+		ackCh := db.replica.ackCh
+		db.replica.mu.Unlock()
+
+		select {
+		case <-ackCh:
+		case <-timer.C:
+			db.replica.mu.Lock()
+			acked = db.replica.ackedFollowers(written)
+			db.replica.mu.Unlock()
+			return acked, nil
+		case <-closeCh:
+			return 0, ErrDatabaseClosed
+		}
+	}
+}
+
+// ackedFollowers returns the number of followers having acknowledged entries up to written by type.
+// Lock of rs must be held by the caller.
+func (rs *replicaState) ackedFollowers(written map[valueType]ValuePos) int {
+	var n int
+	for _, acked := range rs.acks {
+		caughtUp := true
+		for typ, pos := range written {
+			if ackPos, ok := acked[typ]; !ok || pos.after(ackPos) {
+				caughtUp = false
+				break
+			}
+		}
+		if caughtUp {
+			n++
+		}
+	}
+	return n
+}
+
+// applyIndex updates the index with the entry written at vPos by ApplyEntry.
+// Index lock of the type must be held by the caller.
+func (db *LazyDB) applyIndex(typ valueType, entry *logfile.LogEntry, vPos *ValuePos) error {
+	var idxTree *ds.AdaptiveRadixTree
+	switch typ {
+	case valueTypeString:
+		if entry.Stat == logfile.SValueBlob {
+			db.internedRef(entry.Key).pos = *vPos
+			return nil
+		}
+		idxTree = db.strIndex.idxTree
+	case valueTypeHash:
+		if entry.Stat == logfile.SPacked {
+			return db.putPackedHash(entry, vPos, true)
+		}
+		key, _ := db.decodeKey(entry.Key)
+		idxTree = db.collectionTree(valueTypeHash, key)
+		defer func() {
+			// remove the empty hash, so that it does not exist any more
+			if idxTree.Size() == 0 {
+				db.removeCollectionTree(valueTypeHash, key)
+			}
+		}()
+	default:
+		idxTree = db.getCustomType(typ).index.idxTree
+	}
+
+	if entry.Stat != logfile.SDelete {
+		return db.updateIndexTree(typ, idxTree, entry, vPos, true)
+	}
+	delVal, updated := idxTree.Delete(entry.Key)
+	if typ == valueTypeString {
+		db.replaceStrValue(entry.Key, delVal, nil)
+	}
+	if err := db.sendDiscard(delVal, updated, typ); err != nil {
+		return err
+	}
+	// also merge the delete entry
+	return db.sendDiscard(&Value{fid: vPos.fid, entrySize: db.entrySize(entry)}, true, typ)
+}
+
+// after returns whether vp is behind other in the log files.
+func (vp ValuePos) after(other ValuePos) bool {
+	if vp.fid != other.fid {
+		return vp.fid > other.fid
+	}
+	return vp.offset > other.offset
+}
@@ -0,0 +1,159 @@
+package lazydb
+
+import (
+	"github.com/billsjc123/LazyDB/logfile"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_ApplyEntry(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_apply_entry_leader"))
+	cfg.MaxLogFileSize = 150
+	leader, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(leader)
+	follower, err := Open(DefaultDBConfig(filepath.Join(wd, "test_apply_entry_follower")))
+	assert.Nil(t, err)
+	defer destroyDB(follower)
+
+	// replicate is called repeatedly, and resumes from the last applied position
+	replicate := func(typ valueType) {
+		var fromFid uint32
+		var fromOffset int64
+		if pos, ok := follower.AppliedPos(typ); ok {
+			fromFid, fromOffset = pos.Fid(), pos.Offset()+int64(pos.EntrySize())
+		}
+		assert.Nil(t, leader.Tail(typ, fromFid, fromOffset, func(entry *logfile.LogEntry, pos ValuePos) bool {
+			assert.Nil(t, follower.ApplyEntry(typ, entry, pos))
+			return true
+		}))
+	}
+	converged := func() {
+		for i := 0; i < 6; i++ {
+			want, wantErr := leader.Get(GetKey(i))
+			got, err := follower.Get(GetKey(i))
+			assert.Equal(t, wantErr, err)
+			assert.Equal(t, want, got)
+		}
+		want, err := leader.HGetAll([]byte("h"))
+		assert.Nil(t, err)
+		got, err := follower.HGetAll([]byte("h"))
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+	}
+
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, leader.Set(GetKey(i), GetValue32()))
+	}
+	assert.Nil(t, leader.SetEX(GetKey(4), GetValue32(), time.Hour))
+	assert.Nil(t, leader.HSet([]byte("h"), []byte("f1"), []byte("v1"), []byte("f2"), []byte("v2")))
+	replicate(valueTypeString)
+	replicate(valueTypeHash)
+	converged()
+	ttl, err := follower.TTL(GetKey(4))
+	assert.Nil(t, err)
+	assert.Greater(t, ttl, int64(60))
+
+	// updates and deletes
+	assert.Nil(t, leader.Set(GetKey(0), GetValue32()))
+	assert.Nil(t, leader.Delete(GetKey(1)))
+	assert.Nil(t, leader.Set(GetKey(5), GetValue32()))
+	_, err = leader.HDel([]byte("h"), []byte("f1"))
+	assert.Nil(t, err)
+	replicate(valueTypeString)
+	replicate(valueTypeHash)
+	converged()
+
+	// duplicate entries are ignored
+	writes := follower.Stats().Writes
+	assert.Nil(t, leader.Tail(valueTypeString, 0, 0, func(entry *logfile.LogEntry, pos ValuePos) bool {
+		assert.Nil(t, follower.ApplyEntry(valueTypeString, entry, pos))
+		return true
+	}))
+	assert.Equal(t, writes, follower.Stats().Writes)
+	converged()
+
+	err = follower.ApplyEntry(valueTypeList, &logfile.LogEntry{Key: []byte("l")}, ValuePos{fid: 1})
+	assert.Equal(t, ErrApplyUnsupportedType, err)
+}
+
+func TestLazyDB_WaitReplicas(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_wait_replicas_leader"))
+	cfg.MaxLogFileSize = 150
+	leader, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(leader)
+	follower, err := Open(DefaultDBConfig(filepath.Join(wd, "test_wait_replicas_follower")))
+	assert.Nil(t, err)
+	defer destroyDB(follower)
+
+	// nothing is written yet
+	acked, err := leader.WaitReplicas(0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, acked)
+
+	// a simulated follower replicates all entries written so far, and acks its applied positions
+	replicate := func(id string) {
+		for _, typ := range []valueType{valueTypeString, valueTypeHash} {
+			var fromFid uint32
+			var fromOffset int64
+			if pos, ok := follower.AppliedPos(typ); ok {
+				fromFid, fromOffset = pos.Fid(), pos.Offset()+int64(pos.EntrySize())
+			}
+			assert.Nil(t, leader.Tail(typ, fromFid, fromOffset, func(entry *logfile.LogEntry, pos ValuePos) bool {
+				assert.Nil(t, follower.ApplyEntry(typ, entry, pos))
+				return true
+			}))
+			if pos, ok := follower.AppliedPos(typ); ok {
+				leader.AckReplica(id, typ, pos)
+			}
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, leader.Set(GetKey(i), GetValue32()))
+	}
+	assert.Nil(t, leader.HSet([]byte("h"), []byte("f1"), []byte("v1")))
+	// lists are not replicated
+	assert.Nil(t, leader.RPush([]byte("l"), []byte("a")))
+	acked, err = leader.WaitReplicas(1, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, acked)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		replicate("f1")
+	}()
+	start := time.Now()
+	acked, err = leader.WaitReplicas(1, 5*time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, acked)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// the second follower never acks
+	acked, err = leader.WaitReplicas(2, 50*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, acked)
+
+	// a new write is not acked until it is replicated
+	assert.Nil(t, leader.Set(GetKey(0), GetValue32()))
+	acked, err = leader.WaitReplicas(1, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, acked)
+	replicate("f1")
+	acked, err = leader.WaitReplicas(1, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, acked)
+
+	// an older position does not move the ack back
+	leader.AckReplica("f1", valueTypeString, ValuePos{})
+	acked, err = leader.WaitReplicas(1, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, acked)
+}
@@ -1,85 +1,281 @@
 package lazydb
 
 import (
+	"bytes"
 	"github.com/billsjc123/LazyDB/ds"
 	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/billsjc123/LazyDB/util"
 	"log"
+	"sort"
 )
 
 // SAdd add the values the set stored at key.
+// Members added into an expiring set inherit its time to live, see CollectionWriteOptions.
 func (db *LazyDB) SAdd(key []byte, members ...[]byte) error {
+	return db.SAddWithOptions(key, CollectionWriteOptions{}, members...)
+}
+
+// SAddWithOptions is like SAdd, but the time to live of the whole set can be overridden by opts.
+func (db *LazyDB) SAddWithOptions(key []byte, opts CollectionWriteOptions, members ...[]byte) error {
+	_, err := db.sAdd(key, opts, members)
+	return err
+}
+
+// SAddGetAdded is like SAdd, but returns the members which are not in the set before, in the order they are given.
+// A member given more than once, or already in the set, is not returned.
+func (db *LazyDB) SAddGetAdded(key []byte, members ...[]byte) ([][]byte, error) {
+	return db.sAdd(key, CollectionWriteOptions{}, members)
+}
+
+// SAddAll is like SAdd, but returns the number of members which are not in the set before.
+// Members are written in order with the active log file locked once, and synced by a single fsync.
+func (db *LazyDB) SAddAll(key []byte, members [][]byte) (int, error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return 0, err
+	}
 	db.setIndex.mu.Lock()
 	defer db.setIndex.mu.Unlock()
 
-	if db.setIndex.trees[string(key)] == nil {
-		db.setIndex.trees[string(key)] = ds.NewART()
+	db.removeExpiredCollection(valueTypeSet, key)
+	if err := db.checkSetLimit(key, members); err != nil {
+		return 0, err
+	}
+	expiredAt, err := db.prepareCollectionWrite(valueTypeSet, key, CollectionWriteOptions{})
+	if err != nil {
+		return 0, err
+	}
+	if added, packed, err := db.sAddPacked(key, members, expiredAt); packed || err != nil {
+		return len(added), err
 	}
+	entries := make([]*logfile.LogEntry, 0, len(members))
+	sums := make([][]byte, 0, len(members))
+	for _, mem := range members {
+		if len(mem) == 0 {
+			continue
+		}
+		if err := db.setIndex.murHash.Write(mem); err != nil {
+			return 0, err
+		}
+		sums = append(sums, db.setIndex.murHash.EncodeSum128())
+		db.setIndex.murHash.Reset()
+		entries = append(entries, &logfile.LogEntry{Key: key, Value: mem, ExpiredAt: expiredAt})
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+	idxTree := db.collectionTree(valueTypeSet, key)
+	var added int
+	positions, err := db.writeLogEntries(valueTypeSet, entries)
+	// apply written entries even if writing fails halfway
+	for i, pos := range positions {
+		if idxTree.Get(sums[i]) == nil {
+			added++
+		}
+		entry := &logfile.LogEntry{Key: sums[i], Value: entries[i].Value, WrittenAt: entries[i].WrittenAt, ExpiredAt: expiredAt}
+		if updateErr := db.updateIndexTree(valueTypeSet, idxTree, entry, pos, false); updateErr != nil && err == nil {
+			err = updateErr
+		}
+	}
+	return added, err
+}
 
-	idxTree := db.setIndex.trees[string(key)]
+func (db *LazyDB) sAdd(key []byte, opts CollectionWriteOptions, members [][]byte) ([][]byte, error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return nil, err
+	}
+	db.setIndex.mu.Lock()
+	defer db.setIndex.mu.Unlock()
+
+	db.removeExpiredCollection(valueTypeSet, key)
+	if err := db.checkSetLimit(key, members); err != nil {
+		return nil, err
+	}
+	expiredAt, err := db.prepareCollectionWrite(valueTypeSet, key, opts)
+	if err != nil {
+		return nil, err
+	}
+	return db.sAddMembers(key, expiredAt, members)
+}
+
+// sAddMembers adds members into the set stored at key with expiredAt, and returns the ones not in the set before.
+// Lock of setIndex must be held by the caller.
+func (db *LazyDB) sAddMembers(key []byte, expiredAt int64, members [][]byte) ([][]byte, error) {
+	if added, packed, err := db.sAddPacked(key, members, expiredAt); packed || err != nil {
+		return added, err
+	}
+	idxTree := db.collectionTree(valueTypeSet, key)
+	var added [][]byte
 	for _, mem := range members {
 		if len(mem) == 0 {
 			continue
 		}
 		if err := db.setIndex.murHash.Write(mem); err != nil {
-			return err
+			return added, err
 		}
 
 		sum := db.setIndex.murHash.EncodeSum128()
 		db.setIndex.murHash.Reset()
 
-		ent := &logfile.LogEntry{Key: key, Value: mem}
+		ent := &logfile.LogEntry{Key: key, Value: mem, ExpiredAt: expiredAt}
 		valPos, err := db.writeLogEntry(valueTypeSet, ent)
 		if err != nil {
-			return err
+			return added, err
 		}
 
-		entry := &logfile.LogEntry{Key: sum, Value: mem}
-		_, size := logfile.EncodeEntry(ent)
+		entry := &logfile.LogEntry{Key: sum, Value: mem, WrittenAt: ent.WrittenAt, ExpiredAt: expiredAt}
+		size := db.entrySize(ent)
 		valPos.entrySize = size
 
+		exists := idxTree.Get(sum) != nil
 		if err := db.updateIndexTree(valueTypeSet, idxTree, entry, valPos, false); err != nil {
-			return err
+			return added, err
+		}
+		if !exists {
+			added = append(added, mem)
 		}
 	}
-	return nil
+	return added, nil
+}
+
+// SExistsKey returns whether the set stored at key exists, only the index of Set is looked up unlike Exists.
+func (db *LazyDB) SExistsKey(key []byte) bool {
+	return db.typedKeyExists(valueTypeSet, key)
 }
 
 // SIsMember returns if the argument is the one value of the set stored at key.
-func (db *LazyDB) SIsMember(key, member []byte) bool {
+func (db *LazyDB) SIsMember(key, member []byte) (bool, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return false, err
+	}
 	db.setIndex.mu.RLock()
 	defer db.setIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeSet, key); err != nil {
+		return false, err
+	}
 
-	if db.setIndex.trees[string(key)] == nil {
-		return false
+	idxTree := db.liveCollection(valueTypeSet, key)
+	if idxTree == nil {
+		return false, nil
 	}
-	idxTree := db.setIndex.trees[string(key)]
 	if err := db.setIndex.murHash.Write(member); err != nil {
-		return false
+		return false, err
 	}
 
 	sum := db.setIndex.murHash.EncodeSum128()
 	db.setIndex.murHash.Reset()
 	node := idxTree.Get(sum)
 
-	return node != nil
+	return node != nil, nil
+}
+
+// SCard returns the number of members of the set stored at key, 0 if key does not exist.
+func (db *LazyDB) SCard(key []byte) (int, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return 0, err
+	}
+	db.setIndex.mu.RLock()
+	defer db.setIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeSet, key); err != nil {
+		return 0, err
+	}
+	idxTree := db.liveCollection(valueTypeSet, key)
+	if idxTree == nil {
+		return 0, nil
+	}
+	return idxTree.Size(), nil
+}
+
+// SMIsMember returns whether each member is a member of the set stored at key, in the order of members.
+// All members are checked in a single pass holding the read lock, and all false is returned if key does not exist.
+func (db *LazyDB) SMIsMember(key []byte, members ...[]byte) ([]bool, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return nil, ErrInvalidParam
+	}
+	db.setIndex.mu.RLock()
+	defer db.setIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeSet, key); err != nil {
+		return nil, err
+	}
+
+	res := make([]bool, len(members))
+	idxTree := db.liveCollection(valueTypeSet, key)
+	if idxTree == nil {
+		return res, nil
+	}
+	// the shared hash of set index is not safe to use with read lock
+	murHash := util.NewMurmur128()
+	for i, member := range members {
+		if err := murHash.Write(member); err != nil {
+			return nil, err
+		}
+		sum := murHash.EncodeSum128()
+		murHash.Reset()
+		res[i] = idxTree.Get(sum) != nil
+	}
+	return res, nil
 }
 
 // SMembers returns all the values of the set value stored at key.
 func (db *LazyDB) SMembers(key []byte) ([][]byte, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
 	db.setIndex.mu.RLock()
 	defer db.setIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeSet, key); err != nil {
+		return nil, err
+	}
 
 	return db.sMembers(key)
 }
 
+// SMembersFunc calls fn with every member of the set stored at key, without buffering all of them.
+// Iteration stops if fn returns false. Read lock of set is held during iteration, so fn should be quick
+// and must not modify the db.
+func (db *LazyDB) SMembersFunc(key []byte, fn func(member []byte) bool) error {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return err
+	}
+	db.setIndex.mu.RLock()
+	defer db.setIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeSet, key); err != nil {
+		return err
+	}
+
+	idxTree := db.liveCollection(valueTypeSet, key)
+	if idxTree == nil {
+		return nil
+	}
+	iter := idxTree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		member, err := db.getValue(idxTree, node.Key(), valueTypeSet)
+		if err == ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !fn(member) {
+			return nil
+		}
+	}
+	return nil
+}
+
 // Helper for getting all members of the given set key.
 func (db *LazyDB) sMembers(key []byte) ([][]byte, error) {
-	if db.setIndex.trees[string(key)] == nil {
+	idxTree := db.liveCollection(valueTypeSet, key)
+	if idxTree == nil {
 		return nil, nil
 	}
 
 	var values [][]byte
-	idxTree := db.setIndex.trees[string(key)]
 	iterator := idxTree.Iterator()
 	for iterator.HasNext() {
 		node, _ := iterator.Next()
@@ -97,10 +293,13 @@ func (db *LazyDB) sMembers(key []byte) ([][]byte, error) {
 	return values, nil
 }
 
-func (db *LazyDB) sremInternal(key []byte, member []byte) error {
+func (db *LazyDB) sremInternal(key []byte, member []byte) (bool, error) {
+	if removed, packed, err := db.sRemPacked(key, [][]byte{member}); packed || err != nil {
+		return len(removed) > 0, err
+	}
 	idxTree := db.setIndex.trees[string(key)]
 	if err := db.setIndex.murHash.Write(member); err != nil {
-		return err
+		return false, err
 	}
 
 	sum := db.setIndex.murHash.EncodeSum128()
@@ -108,33 +307,37 @@ func (db *LazyDB) sremInternal(key []byte, member []byte) error {
 
 	val, updated := idxTree.Delete(sum)
 	if !updated {
-		return nil
+		return false, nil
 	}
 
 	entry := &logfile.LogEntry{Key: key, Value: sum, Stat: logfile.SDelete}
 	pos, err := db.writeLogEntry(valueTypeSet, entry)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	// delete invalid entry
 	db.sendDiscard(val, updated, valueTypeSet)
 	// also merge the delete entry
-	_, size := logfile.EncodeEntry(entry)
+	size := db.entrySize(entry)
 	node := &Value{fid: pos.fid, entrySize: size}
 	select {
 	case db.discardsMap[valueTypeSet].valChan <- node:
 	default:
 		log.Fatal("send discard fail")
 	}
-	return nil
+	return true, nil
 }
 
 // SPop removes and returns members from the set value store at key.
 func (db *LazyDB) SPop(key []byte, num uint) ([][]byte, error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return nil, err
+	}
 	db.setIndex.mu.Lock()
 	defer db.setIndex.mu.Unlock()
 
+	db.removeExpiredCollection(valueTypeSet, key)
 	if db.setIndex.trees[string(key)] == nil {
 		return nil, nil
 	}
@@ -158,26 +361,239 @@ func (db *LazyDB) SPop(key []byte, num uint) ([][]byte, error) {
 	}
 
 	for _, val := range values {
-		if err := db.sremInternal(key, val); err != nil {
+		if _, err := db.sremInternal(key, val); err != nil {
 			return nil, err
 		}
 	}
+	db.removeEmptySet(key)
 	return values, nil
 }
 
+// SRandMember returns count random members of the set stored at key like SRANDMEMBER of Redis. Members are
+// distinct if count is positive, and all members are returned if count exceeds the cardinality. Members may
+// repeat if count is negative, and -count members are returned. See DBConfig.RandSource.
+func (db *LazyDB) SRandMember(key []byte, count int) ([][]byte, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
+	db.setIndex.mu.RLock()
+	members, err := db.sMembers(key)
+	if err == nil {
+		err = db.checkType(valueTypeSet, key)
+	}
+	db.setIndex.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var picked [][]byte
+	for _, i := range db.randPick(len(members), count) {
+		picked = append(picked, members[i])
+	}
+	return picked, nil
+}
+
 // SRem remove the specified members from the set stored at key.
 func (db *LazyDB) SRem(key []byte, members ...[]byte) error {
+	_, err := db.SRemGetRemoved(key, members...)
+	return err
+}
+
+// SRemGetRemoved is like SRem, but returns the members which are removed from the set, in the order they are given.
+// A member given more than once, or not in the set, is not returned.
+func (db *LazyDB) SRemGetRemoved(key []byte, members ...[]byte) ([][]byte, error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return nil, err
+	}
 	db.setIndex.mu.Lock()
 	defer db.setIndex.mu.Unlock()
 
+	db.removeExpiredCollection(valueTypeSet, key)
 	if db.setIndex.trees[string(key)] == nil {
-		return nil
+		return nil, nil
 	}
 
+	if removed, packed, err := db.sRemPacked(key, members); packed || err != nil {
+		db.removeEmptySet(key)
+		return removed, err
+	}
+	var removed [][]byte
 	for _, mem := range members {
-		if err := db.sremInternal(key, mem); err != nil {
+		ok, err := db.sremInternal(key, mem)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed = append(removed, mem)
+		}
+	}
+	db.removeEmptySet(key)
+	return removed, nil
+}
+
+// SMove moves member from the set stored at source to the set stored at destination atomically, and returns whether
+// member is moved. It returns false if member is not a member of source, and member is only removed from source if
+// it is already a member of destination. The member inherits the time to live of destination.
+func (db *LazyDB) SMove(source, destination, member []byte) (bool, error) {
+	if err := db.checkAccess(OpWrite, source, destination); err != nil {
+		return false, err
+	}
+	// both keys are in the index of sets, so a single lock covers them
+	db.setIndex.mu.Lock()
+	defer db.setIndex.mu.Unlock()
+
+	db.removeExpiredCollection(valueTypeSet, source)
+	db.removeExpiredCollection(valueTypeSet, destination)
+	if err := db.setIndex.murHash.Write(member); err != nil {
+		return false, err
+	}
+	sum := db.setIndex.murHash.EncodeSum128()
+	db.setIndex.murHash.Reset()
+	srcTree := db.setIndex.trees[string(source)]
+	if srcTree == nil || srcTree.Get(sum) == nil {
+		return false, nil
+	}
+	if bytes.Equal(source, destination) {
+		return true, nil
+	}
+	dstTree := db.setIndex.trees[string(destination)]
+	exists := dstTree != nil && dstTree.Get(sum) != nil
+	if !exists {
+		if err := db.checkSetLimit(destination, [][]byte{member}); err != nil {
+			return false, err
+		}
+	}
+
+	if _, err := db.sremInternal(source, member); err != nil {
+		return false, err
+	}
+	db.removeEmptySet(source)
+	if exists {
+		return true, nil
+	}
+	expiredAt := collectionExpiredAt(valueTypeSet, dstTree, destination)
+	if _, err := db.sAddMembers(destination, expiredAt, [][]byte{member}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// removeEmptySet removes the set stored at key from index if it has no members,
+// so that it does not exist any more. Lock of setIndex must be held by the caller.
+func (db *LazyDB) removeEmptySet(key []byte) {
+	if idxTree := db.setIndex.trees[string(key)]; idxTree != nil && idxTree.Size() == 0 {
+		db.removeCollectionTree(valueTypeSet, key)
+	}
+}
+
+// SInterCard returns the cardinality of the intersection of all the given sets, without materializing it.
+// Counting stops once limit is reached, no limitation if limit is 0.
+func (db *LazyDB) SInterCard(limit int, keys ...[]byte) (int, error) {
+	if err := db.checkAccess(OpRead, keys...); err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 || limit < 0 {
+		return 0, ErrInvalidParam
+	}
+	db.setIndex.mu.RLock()
+	defer db.setIndex.mu.RUnlock()
+
+	trees := make([]*ds.AdaptiveRadixTree, len(keys))
+	for i, key := range keys {
+		if err := db.checkType(valueTypeSet, key); err != nil {
+			return 0, err
+		}
+		trees[i] = db.liveCollection(valueTypeSet, key)
+		// intersection with an empty set is empty
+		if trees[i] == nil || trees[i].Size() == 0 {
+			return 0, nil
+		}
+	}
+	// iterate the smallest set
+	sort.Slice(trees, func(i, j int) bool {
+		return trees[i].Size() < trees[j].Size()
+	})
+
+	var count int
+	iter := trees[0].Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil {
+			return 0, err
+		}
+		// members are indexed by their sums, which can be compared directly
+		inAll := true
+		for _, tree := range trees[1:] {
+			if tree.Get(node.Key()) == nil {
+				inAll = false
+				break
+			}
+		}
+		if !inAll {
+			continue
+		}
+		count++
+		if count == limit {
+			break
+		}
+	}
+	return count, nil
+}
+
+// SUnionCard returns the cardinality of the union of all the given sets, without materializing it.
+// Members are deduplicated by their sums in index, so no member is read from log files,
+// but memory is still O(size of the union) for deduplication, see SUnionCardApprox for bounded memory.
+func (db *LazyDB) SUnionCard(keys ...[]byte) (int, error) {
+	seen := make(map[string]struct{})
+	err := db.sUnionSums(keys, func(sum []byte) {
+		seen[string(sum)] = struct{}{}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(seen), nil
+}
+
+// SUnionCardApprox is like SUnionCard, but estimates the cardinality by HyperLogLog in 16KB of memory,
+// whatever the size of the union is. The standard error of the estimate is about 0.81%.
+func (db *LazyDB) SUnionCardApprox(keys ...[]byte) (int, error) {
+	hll := ds.NewHyperLogLog(ds.DefaultHLLPrecision)
+	err := db.sUnionSums(keys, func(sum []byte) {
+		hll.Add(util.XXHash64Sum(sum))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(hll.Count()), nil
+}
+
+// sUnionSums calls fn with the sum of every member of the given sets, a member in more than one set is repeated.
+func (db *LazyDB) sUnionSums(keys [][]byte, fn func(sum []byte)) error {
+	if err := db.checkAccess(OpRead, keys...); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return ErrInvalidParam
+	}
+	db.setIndex.mu.RLock()
+	defer db.setIndex.mu.RUnlock()
+
+	for _, key := range keys {
+		if err := db.checkType(valueTypeSet, key); err != nil {
 			return err
 		}
+		tree := db.liveCollection(valueTypeSet, key)
+		if tree == nil {
+			continue
+		}
+		iter := tree.Iterator()
+		for iter.HasNext() {
+			node, err := iter.Next()
+			if err != nil {
+				return err
+			}
+			fn(node.Key())
+		}
 	}
 	return nil
 }
@@ -0,0 +1,233 @@
+package lazydb
+
+import (
+	"github.com/billsjc123/LazyDB/ds"
+	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/billsjc123/LazyDB/util"
+)
+
+// packedSetMember returns the member whose sum is sum in the value of a packed entry of a set.
+// The sum is computed by its own hasher, since the one of setIndex may not be locked by the caller.
+func packedSetMember(data, sum []byte) ([]byte, bool) {
+	members, err := decodePacked(data)
+	if err != nil {
+		return nil, false
+	}
+	murHash := util.NewMurmur128()
+	for _, member := range members {
+		if err := murHash.Write(member); err != nil {
+			return nil, false
+		}
+		memSum := murHash.EncodeSum128()
+		murHash.Reset()
+		if string(memSum) == string(sum) {
+			return member, true
+		}
+	}
+	return nil, false
+}
+
+// setPackable returns whether a set of members is packed into a single entry, see DBConfig.PackSmallSets.
+func (db *LazyDB) setPackable(members [][]byte) bool {
+	if !db.cfg.PackSmallSets || len(members) > threshold(db.cfg.SetMaxListpackEntries, defaultSetMaxListpackEntries) {
+		return false
+	}
+	maxValue := threshold(db.cfg.SetMaxListpackValue, defaultSetMaxListpackValue)
+	for _, member := range members {
+		if len(member) > maxValue {
+			return false
+		}
+	}
+	return true
+}
+
+// memberSums returns the sums of members, by which they are indexed in their set.
+// Lock of setIndex must be held by the caller.
+func (db *LazyDB) memberSums(members [][]byte) ([][]byte, error) {
+	sums := make([][]byte, 0, len(members))
+	for _, member := range members {
+		if err := db.setIndex.murHash.Write(member); err != nil {
+			return nil, err
+		}
+		sums = append(sums, db.setIndex.murHash.EncodeSum128())
+		db.setIndex.murHash.Reset()
+	}
+	return sums, nil
+}
+
+// packedMembers returns members of a packed set by reading its packed entry once.
+// Members of the entry which have been removed from the set are left out.
+// Lock of setIndex must be held by the caller.
+func (db *LazyDB) packedMembers(idxTree *ds.AdaptiveRadixTree) ([][]byte, error) {
+	ent, err := db.packedEntry(valueTypeSet, idxTree)
+	if ent == nil || err != nil {
+		return nil, err
+	}
+	members, err := decodePacked(ent.Value)
+	if err != nil {
+		return nil, err
+	}
+	sums, err := db.memberSums(members)
+	if err != nil {
+		return nil, err
+	}
+	live := make([][]byte, 0, len(members))
+	for i, member := range members {
+		if idxTree.Get(sums[i]) != nil {
+			live = append(live, member)
+		}
+	}
+	return live, nil
+}
+
+// sAddPacked adds members into the set at key if it is packed, or it is created as a small one, and returns
+// the ones not in the set before. A packed set which is no longer small is converted by rewriting all of its members
+// as normal entries. It returns false if the set is not packed, and members should be added as normal entries.
+// Entries are written with expiredAt of the set, see CollectionWriteOptions.
+// Lock of setIndex must be held by the caller.
+func (db *LazyDB) sAddPacked(key []byte, members [][]byte, expiredAt int64) ([][]byte, bool, error) {
+	if !db.cfg.PackSmallSets {
+		return nil, false, nil
+	}
+	var current [][]byte
+	idxTree := db.setIndex.trees[util.ByteToString(key)]
+	if idxTree != nil && idxTree.Size() > 0 {
+		if !isPacked(idxTree) {
+			return nil, false, nil
+		}
+		var err error
+		if current, err = db.packedMembers(idxTree); err != nil {
+			return nil, true, err
+		}
+	}
+	exists := make(map[string]struct{}, len(current)+len(members))
+	for _, member := range current {
+		exists[util.ByteToString(member)] = struct{}{}
+	}
+	var added [][]byte
+	for _, member := range members {
+		if _, ok := exists[util.ByteToString(member)]; ok || len(member) == 0 {
+			continue
+		}
+		exists[util.ByteToString(member)] = struct{}{}
+		added = append(added, member)
+	}
+	all := append(current, added...)
+	if db.setPackable(all) {
+		if len(added) == 0 {
+			return nil, true, nil
+		}
+		return added, true, db.writePackedSet(key, all, expiredAt)
+	}
+	if idxTree == nil || idxTree.Size() == 0 {
+		return nil, false, nil
+	}
+
+	// the packed entry is not live any more once all of its members are rewritten
+	sums, err := db.memberSums(all)
+	if err != nil {
+		return nil, true, err
+	}
+	for i, member := range all {
+		ent := &logfile.LogEntry{Key: key, Value: member, ExpiredAt: expiredAt}
+		valPos, err := db.writeLogEntry(valueTypeSet, ent)
+		if err != nil {
+			return nil, true, err
+		}
+		valPos.entrySize = db.entrySize(ent)
+		entry := &logfile.LogEntry{Key: sums[i], Value: member, WrittenAt: ent.WrittenAt, ExpiredAt: expiredAt}
+		if err = db.updateIndexTree(valueTypeSet, idxTree, entry, valPos, true); err != nil {
+			return nil, true, err
+		}
+	}
+	return added, true, nil
+}
+
+// sRemPacked removes members from the set at key if it is packed, and returns the removed ones.
+// It returns false if the set is not packed. Lock of setIndex must be held by the caller.
+func (db *LazyDB) sRemPacked(key []byte, members [][]byte) ([][]byte, bool, error) {
+	idxTree := db.setIndex.trees[util.ByteToString(key)]
+	if !db.cfg.PackSmallSets || !isPacked(idxTree) {
+		return nil, false, nil
+	}
+	current, err := db.packedMembers(idxTree)
+	if err != nil {
+		return nil, true, err
+	}
+	var removed [][]byte
+	for _, member := range members {
+		for i := range current {
+			if string(current[i]) == string(member) {
+				removed = append(removed, member)
+				current = append(current[:i], current[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(removed) == 0 {
+		return nil, true, nil
+	}
+	return removed, true, db.writePackedSet(key, current, collectionExpiredAt(valueTypeSet, idxTree, key))
+}
+
+// writePackedSet writes all members of the set at key into a packed entry expiring at expiredAt,
+// and replaces members of the set by the ones of the entry.
+// Lock of setIndex must be held by the caller.
+func (db *LazyDB) writePackedSet(key []byte, members [][]byte, expiredAt int64) error {
+	entry := &logfile.LogEntry{Key: key, Value: encodePacked(members), Stat: logfile.SPacked, ExpiredAt: expiredAt}
+	valPos, err := db.writeLogEntry(valueTypeSet, entry)
+	if err != nil {
+		return err
+	}
+	return db.putPackedSet(entry, valPos, true)
+}
+
+// putPackedSet updates the index with the packed entry written at vPos, like putPackedHash.
+// Lock of setIndex must be held by the caller.
+func (db *LazyDB) putPackedSet(entry *logfile.LogEntry, vPos *ValuePos, sendDiscard bool) error {
+	members, err := decodePacked(entry.Value)
+	if err != nil {
+		return err
+	}
+	sums, err := db.memberSums(members)
+	if err != nil {
+		return err
+	}
+	key := entry.Key
+	idxTree := db.collectionTree(valueTypeSet, key)
+	if err = db.deletePackedValues(valueTypeSet, idxTree, sendDiscard); err != nil {
+		return err
+	}
+	db.putPackedValues(valueTypeSet, idxTree, sums, vPos, entry)
+
+	if len(members) == 0 {
+		// also merge the empty packed entry
+		if sendDiscard {
+			if err = db.sendDiscard(&Value{fid: vPos.fid, entrySize: vPos.entrySize}, true, valueTypeSet); err != nil {
+				return err
+			}
+		}
+		db.removeEmptySet(key)
+	}
+	return nil
+}
+
+// rewritePackedSet rewrites the packed entry at offset of log file fid by write if any of its members is live.
+// Lock of setIndex must be held by the caller.
+func (db *LazyDB) rewritePackedSet(fid uint32, offset int64, ent *logfile.LogEntry,
+	write func(ent *logfile.LogEntry) (*ValuePos, error)) error {
+
+	idxTree := db.setIndex.trees[util.ByteToString(ent.Key)]
+	if idxTree == nil {
+		return nil
+	}
+	members, err := decodePacked(ent.Value)
+	if err != nil {
+		return err
+	}
+	sums, err := db.memberSums(members)
+	if err != nil {
+		return err
+	}
+	return db.rewritePacked(valueTypeSet, idxTree, fid, offset, ent, members, sums, write)
+}
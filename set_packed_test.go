@@ -0,0 +1,99 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_PackSmallSets(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_pack_small_sets")
+	cfg := DefaultDBConfig(path)
+	cfg.PackSmallSets = true
+	cfg.SetMaxListpackEntries = 4
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+	key := []byte("packed")
+	packed := func() bool {
+		db.setIndex.mu.RLock()
+		defer db.setIndex.mu.RUnlock()
+		return isPacked(db.setIndex.trees[string(key)])
+	}
+	members := func(key []byte) []string {
+		all, err := db.SMembers(key)
+		assert.Nil(t, err)
+		var res []string
+		for _, m := range all {
+			res = append(res, string(m))
+		}
+		sort.Strings(res)
+		return res
+	}
+
+	// a small set is written as a single entry
+	writes := db.Stats().Writes
+	added, err := db.SAddGetAdded(key, []byte("m1"), []byte("m2"), []byte("m3"), []byte("m1"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("m1"), []byte("m2"), []byte("m3")}, added)
+	assert.Equal(t, writes+1, db.Stats().Writes)
+	assert.True(t, packed())
+	assert.True(t, sIsMember(t, db, key, []byte("m2")))
+	assert.False(t, sIsMember(t, db, key, []byte("missing")))
+
+	removed, err := db.SRemGetRemoved(key, []byte("m2"), []byte("missing"), []byte("m2"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("m2")}, removed)
+	n, err := db.SAddAll(key, [][]byte{[]byte("m1"), []byte("m4")})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.True(t, packed())
+	assert.Equal(t, []string{"m1", "m3", "m4"}, members(key))
+
+	// exceeding the threshold converts it into entries for each member transparently
+	writes = db.Stats().Writes
+	assert.Nil(t, db.SAdd(key, []byte("m5"), []byte("m6")))
+	assert.Equal(t, writes+5, db.Stats().Writes)
+	assert.False(t, packed())
+	assert.Nil(t, db.SRem(key, []byte("m6")))
+	assert.False(t, packed())
+	assert.Equal(t, []string{"m1", "m3", "m4", "m5"}, members(key))
+
+	// a large member is not packed either
+	assert.Nil(t, db.SAdd([]byte("large"), GetValue(128)))
+	db.setIndex.mu.RLock()
+	assert.False(t, isPacked(db.setIndex.trees["large"]))
+	db.setIndex.mu.RUnlock()
+
+	// the time to live of a packed set is rewritten into its packed entry
+	small := []byte("small")
+	assert.Nil(t, db.SAdd(small, []byte("a"), []byte("b")))
+	assert.Nil(t, db.SAddWithOptions(small, CollectionWriteOptions{TTL: time.Hour}, []byte("c")))
+	db.setIndex.mu.RLock()
+	assert.True(t, isPacked(db.setIndex.trees["small"]))
+	assert.NotZero(t, collectionExpiredAt(valueTypeSet, db.setIndex.trees["small"], small))
+	db.setIndex.mu.RUnlock()
+	popped, err := db.SPop(small, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(popped))
+	assert.Equal(t, 2, len(members(small)))
+
+	// only the live members of packed entries are compacted
+	expected := append(members(small), string(popped[0]))
+	sort.Strings(expected)
+	assert.Nil(t, db.SAdd(small, popped[0]))
+	assert.Nil(t, db.FullCompact(valueTypeSet))
+	assert.Equal(t, expected, members(small))
+	assert.Equal(t, []string{"m1", "m3", "m4", "m5"}, members(key))
+
+	// removing all members removes the set
+	assert.Nil(t, db.SRem(small, []byte("a"), []byte("b"), []byte("c")))
+	assert.False(t, db.SExistsKey(small))
+}
@@ -1,7 +1,12 @@
 package lazydb
 
 import (
+	"fmt"
+	"math"
 	"testing"
+	"time"
+
+	"github.com/billsjc123/LazyDB/ds"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -101,12 +106,33 @@ func TestLazyDB_SIsMember(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			res := db.SIsMember(tt.args.key, tt.args.member)
+			res, err := db.SIsMember(tt.args.key, tt.args.member)
+			assert.Nil(t, err)
 			assert.Equal(t, tt.want, res)
 		})
 	}
 }
 
+func TestLazyDB_SMIsMember(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	assert.Nil(t, db.SAdd([]byte("key1"), []byte("v1"), []byte("v2"), []byte("v3")))
+
+	res, err := db.SMIsMember([]byte("key1"), []byte("v1"), []byte("v4"), []byte("v3"), []byte("v1"), []byte(""))
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{true, false, true, true, false}, res)
+
+	// missing set
+	res, err = db.SMIsMember([]byte("key2"), []byte("v1"), []byte("v2"))
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{false, false}, res)
+
+	_, err = db.SMIsMember([]byte("key1"))
+	assert.Equal(t, ErrInvalidParam, err)
+}
+
 func TestLazyDB_SMembers(t *testing.T) {
 	db := initTestDB()
 	defer destroyDB(db)
@@ -311,3 +337,246 @@ func TestLazyDB_SRem(t *testing.T) {
 		})
 	}
 }
+
+func TestLazyDB_SRemEmptySet(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := GetKey(1)
+	assert.Nil(t, db.SAdd(key, []byte("m1"), []byte("m2")))
+	assert.Nil(t, db.SRem(key, []byte("m1"), []byte("m2")))
+	_, ok := db.setIndex.trees[string(key)]
+	assert.False(t, ok)
+
+	assert.Nil(t, db.SAdd(key, []byte("m1")))
+	members, err := db.SPop(key, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("m1")}, members)
+	_, ok = db.setIndex.trees[string(key)]
+	assert.False(t, ok)
+	_, _, err = db.GetAny(key)
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestLazyDB_SInterCard(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	assert.Nil(t, db.SAdd([]byte("s1"), []byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")))
+	assert.Nil(t, db.SAdd([]byte("s2"), []byte("a"), []byte("b"), []byte("c"), []byte("d")))
+	assert.Nil(t, db.SAdd([]byte("s3"), []byte("b"), []byte("c"), []byte("d"), []byte("f")))
+
+	tests := []struct {
+		name    string
+		limit   int
+		keys    [][]byte
+		want    int
+		wantErr error
+	}{
+		{"no limit", 0, [][]byte{[]byte("s1"), []byte("s2"), []byte("s3")}, 3, nil},
+		{"limit reached", 2, [][]byte{[]byte("s1"), []byte("s2"), []byte("s3")}, 2, nil},
+		{"limit not reached", 10, [][]byte{[]byte("s1"), []byte("s2")}, 4, nil},
+		{"single set", 0, [][]byte{[]byte("s3")}, 4, nil},
+		{"missing set", 0, [][]byte{[]byte("s1"), []byte("missing")}, 0, nil},
+		{"no keys", 0, nil, 0, ErrInvalidParam},
+		{"negative limit", -1, [][]byte{[]byte("s1")}, 0, ErrInvalidParam},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := db.SInterCard(tt.limit, tt.keys...)
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestLazyDB_SUnionCard(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	// sets of 20000 members overlapping by half, the union has 40000 members
+	const size = 20000
+	keys := [][]byte{[]byte("s1"), []byte("s2"), []byte("s3")}
+	for i, key := range keys {
+		members := make([][]byte, size)
+		for j := range members {
+			members[j] = []byte(fmt.Sprintf("member-%d", i*size/2+j))
+		}
+		assert.Nil(t, db.SAdd(key, members...))
+	}
+
+	exact, err := db.SUnionCard(keys...)
+	assert.Nil(t, err)
+	assert.Equal(t, 2*size, exact)
+	approx, err := db.SUnionCardApprox(keys...)
+	assert.Nil(t, err)
+	// 3 times the standard error of HyperLogLog
+	bound := 3 * 1.04 / math.Sqrt(float64(uint64(1)<<ds.DefaultHLLPrecision))
+	assert.InDelta(t, float64(exact), float64(approx), float64(exact)*bound)
+
+	count, err := db.SUnionCard([]byte("s1"), []byte("missing"))
+	assert.Nil(t, err)
+	assert.Equal(t, size, count)
+	count, err = db.SUnionCardApprox([]byte("missing"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+	_, err = db.SUnionCard()
+	assert.Equal(t, ErrInvalidParam, err)
+	_, err = db.SUnionCardApprox()
+	assert.Equal(t, ErrInvalidParam, err)
+}
+
+func TestLazyDB_SMembersFunc(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("my_set")
+	assert.Nil(t, db.SAdd(key, []byte("a"), []byte("b"), []byte("c")))
+	want, err := db.SMembers(key)
+	assert.Nil(t, err)
+
+	var all [][]byte
+	err = db.SMembersFunc(key, func(member []byte) bool {
+		all = append(all, member)
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, want, all)
+
+	// stop early
+	var count int
+	err = db.SMembersFunc(key, func(member []byte) bool {
+		count++
+		return false
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	// an expired member is skipped rather than stopping the iteration, the first member is left alone
+	// since the time to live of the whole set is read from it
+	var last *Value
+	iter := db.setIndex.trees[string(key)].Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		assert.Nil(t, err)
+		last = node.Value().(*Value)
+	}
+	last.expiredAt = time.Now().Add(-time.Second).UnixMilli()
+	all = nil
+	err = db.SMembersFunc(key, func(member []byte) bool {
+		all = append(all, member)
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, want[:len(want)-1], all)
+}
+
+func TestLazyDB_SMove(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	src, dst := []byte("src"), []byte("dst")
+	assert.Nil(t, db.SAdd(src, []byte("a"), []byte("b")))
+	assert.Nil(t, db.SAdd(dst, []byte("b")))
+
+	moved, err := db.SMove(src, dst, []byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, moved)
+	assert.False(t, sIsMember(t, db, src, []byte("a")))
+	assert.True(t, sIsMember(t, db, dst, []byte("a")))
+
+	moved, err = db.SMove(src, dst, []byte("missing"))
+	assert.Nil(t, err)
+	assert.False(t, moved)
+
+	// already a member of destination, only removed from source, which becomes empty
+	moved, err = db.SMove(src, dst, []byte("b"))
+	assert.Nil(t, err)
+	assert.True(t, moved)
+	members, err := db.SMembers(src)
+	assert.Nil(t, err)
+	assert.Empty(t, members)
+	members, err = db.SMembers(dst)
+	assert.Nil(t, err)
+	assert.Len(t, members, 2)
+
+	moved, err = db.SMove(dst, dst, []byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, moved)
+	members, err = db.SMembers(dst)
+	assert.Nil(t, err)
+	assert.Len(t, members, 2)
+}
+
+func TestLazyDB_SAddGetAddedSRemGetRemoved(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+
+	key := []byte("changed_members")
+	added, err := db.SAddGetAdded(key, []byte("a"), []byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, added)
+	// existing and duplicate members are not added
+	added, err = db.SAddGetAdded(key, []byte("b"), []byte("c"), []byte("c"), []byte("a"), []byte("d"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("c"), []byte("d")}, added)
+	added, err = db.SAddGetAdded(key, []byte("a"))
+	assert.Nil(t, err)
+	assert.Empty(t, added)
+
+	// missing and duplicate members are not removed
+	removed, err := db.SRemGetRemoved(key, []byte("x"), []byte("b"), []byte("b"), []byte("d"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("d")}, removed)
+	members, err := db.SMembers(key)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, [][]byte{[]byte("a"), []byte("c")}, members)
+
+	removed, err = db.SRemGetRemoved([]byte("missing"), []byte("a"))
+	assert.Nil(t, err)
+	assert.Empty(t, removed)
+	removed, err = db.SRemGetRemoved(key, []byte("a"), []byte("c"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("c")}, removed)
+	assert.False(t, db.SExistsKey(key))
+}
+
+func TestLazyDB_SAddAll(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+
+	key := []byte("sadd_all")
+	assert.Nil(t, db.SAdd(key, GetKey(0)))
+	members := make([][]byte, 0, 10001)
+	for i := 0; i < 10000; i++ {
+		members = append(members, GetKey(i))
+	}
+	// duplicate and existing members are not counted
+	members = append(members, GetKey(1), nil)
+	added, err := db.SAddAll(key, members)
+	assert.Nil(t, err)
+	assert.Equal(t, 9999, added)
+	got, err := db.SMembers(key)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, members[:10000], got)
+
+	added, err = db.SAddAll(key, [][]byte{GetKey(0), []byte("another")})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, added)
+	added, err = db.SAddAll([]byte("empty"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, added)
+	assert.False(t, db.SExistsKey([]byte("empty")))
+}
+
+// sIsMember returns SIsMember of key and member, asserting no error is returned.
+func sIsMember(t *testing.T, db *LazyDB, key, member []byte) bool {
+	ok, err := db.SIsMember(key, member)
+	assert.Nil(t, err)
+	return ok
+}
@@ -0,0 +1,29 @@
+package lazydb
+
+import "github.com/billsjc123/LazyDB/util"
+
+// KeyShard returns the shard of the sharded key map which key belongs to, which is FNV-32 of the key modulo
+// DBConfig.HashIndexShardCount. It is deterministic, so that hot shards can be traced back to keys when debugging.
+func (db *LazyDB) KeyShard(key []byte) int {
+	return db.index.ShardIndex(util.ByteToString(key))
+}
+
+// ShardSizes returns the number of keys of each shard by KeyShard, a key holding values of several types is
+// counted once. It shows how the keyspace is distributed, e.g. a few shards holding far more keys than others.
+// All keys are iterated, so it is expensive for a large db.
+func (db *LazyDB) ShardSizes() []int {
+	sizes := make([]int, db.index.ShardCount())
+	seen := make(map[string]struct{})
+	for _, typ := range db.valueTypes() {
+		// keys of the type are not counted if iterating its index fails
+		keys, _ := db.keysOf(typ)
+		for _, key := range keys {
+			if _, ok := seen[util.ByteToString(key)]; ok {
+				continue
+			}
+			seen[string(key)] = struct{}{}
+			sizes[db.KeyShard(key)]++
+		}
+	}
+	return sizes
+}
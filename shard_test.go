@@ -0,0 +1,35 @@
+package lazydb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_KeyShard(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+
+	n := 200
+	expected := make([]int, db.cfg.HashIndexShardCount)
+	for i := 0; i < n; i++ {
+		key := GetKey(i)
+		// the shard is deterministic
+		shard := db.KeyShard(key)
+		assert.Equal(t, shard, db.KeyShard(key))
+		expected[shard]++
+
+		// the key is stored in the shard reported
+		db.index.Set(string(key), struct{}{})
+		assert.Equal(t, expected[shard], db.index.ShardStats()[shard].Keys)
+
+		if i%2 == 0 {
+			assert.Nil(t, db.Set(key, GetValue32()))
+		} else {
+			assert.Nil(t, db.HSet(key, GetKey(i), GetValue32()))
+		}
+	}
+	// a key of several types is counted once
+	assert.Nil(t, db.SAdd(GetKey(0), GetValue32()))
+	assert.Equal(t, expected, db.ShardSizes())
+}
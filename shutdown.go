@@ -0,0 +1,74 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// cleanShutdownFileName the marker written by Close once everything is synced.
+const cleanShutdownFileName = "CLEAN_SHUTDOWN"
+
+func (db *LazyDB) cleanShutdownPath() string {
+	return filepath.Join(db.cfg.DBPath, cleanShutdownFileName)
+}
+
+// prepareRecovery decides how indexes are built on opening by the clean shutdown marker. If it exists, the db
+// was closed cleanly and checkpoints are trusted. Otherwise checkpoints, which may have been taken by a crashed
+// process, are removed so that all log files are replayed. The marker is then written back if recovery
+// checkpoints are on, so that a crash during this recovery resumes from the checkpoints it writes.
+func (db *LazyDB) prepareRecovery() error {
+	clean := false
+	if _, err := os.Stat(db.cleanShutdownPath()); err == nil {
+		clean = true
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	db.recovery.mu.Lock()
+	db.recovery.report.CleanShutdown = clean
+	db.recovery.mu.Unlock()
+	if clean {
+		return nil
+	}
+
+	if err := db.deleteCheckpoints(); err != nil {
+		return err
+	}
+	if db.cfg.RecoveryCheckpointInterval > 0 {
+		return db.writeCleanShutdown()
+	}
+	return nil
+}
+
+// writeCleanShutdown writes the clean shutdown marker durably.
+func (db *LazyDB) writeCleanShutdown() error {
+	file, err := os.OpenFile(db.cleanShutdownPath(), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if db.cfg.NoSyncDir {
+		return nil
+	}
+	return syncDir(db.cfg.DBPath)
+}
+
+// removeCleanShutdown removes the clean shutdown marker once indexes are built, so that the next opening
+// finds it missing if the db is not closed cleanly.
+func (db *LazyDB) removeCleanShutdown() error {
+	if err := os.Remove(db.cleanShutdownPath()); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if db.cfg.NoSyncDir {
+		return nil
+	}
+	return syncDir(db.cfg.DBPath)
+}
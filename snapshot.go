@@ -0,0 +1,237 @@
+package lazydb
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/billsjc123/LazyDB/ds"
+	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/billsjc123/LazyDB/util"
+)
+
+// ErrSnapshotClosed the snapshot has been closed.
+var ErrSnapshotClosed = errors.New("snapshot is closed")
+
+// Snapshot is a read-only view of strings, hashes and sets of a db as of the time it was taken, see LazyDB.Snapshot.
+// Lists and sorted sets are not part of it. It is safe for concurrent use.
+type Snapshot struct {
+	db     *LazyDB
+	mu     sync.RWMutex
+	closed bool
+
+	strIndex *ds.AdaptiveRadixTree
+	hashes   map[string]*ds.AdaptiveRadixTree
+	sets     map[string]*ds.AdaptiveRadixTree
+	// log files held from being deleted by merge until Close, entries in them are not moved by merge,
+	// and not overwritten in place while the snapshot is open, see overwriteInPlace
+	files map[logFileCacheKey]*logfile.LogFile
+}
+
+// Snapshot returns a consistent point-in-time view of strings, hashes and sets, whose reads observe the db as of
+// now, even as writes continue. Log files are append-only, so the snapshot copies the index entries pointing to
+// the current entries, and holds all log files from being deleted, so that the entries can still be read after
+// they are overwritten or rewritten by merge. Transactions being committed are waited for.
+//
+// Lists and sorted sets are not copied, they must be read from the db, which does not see them as of the snapshot.
+// Values are not overwritten in place by DBConfig.InPlaceUpdates or SetWithCapacity while a snapshot is open,
+// new entries are appended instead.
+//
+// Taking a snapshot copies the indexes of these types, which costs memory and time proportional to the number of
+// keys and elements. Log files removed by merge are only deleted from disk once the snapshot is closed, so it
+// should be closed as soon as possible, and before the db is closed.
+func (db *LazyDB) Snapshot() *Snapshot {
+	// an uncommitted transaction holds the lock of db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	s := &Snapshot{
+		db:     db,
+		hashes: make(map[string]*ds.AdaptiveRadixTree),
+		sets:   make(map[string]*ds.AdaptiveRadixTree),
+		files:  make(map[logFileCacheKey]*logfile.LogFile),
+	}
+	types := []valueType{valueTypeString, valueTypeHash, valueTypeSet}
+	// all locks are held until log files are held, so that the copies are taken at the same point of time
+	defer db.rlockIndexes(types...)()
+	atomic.AddInt32(&db.snapshots, 1)
+
+	s.strIndex = cloneIndexTree(db.strIndex.idxTree)
+	for key, tree := range db.hashIndex.trees {
+		s.hashes[key] = cloneIndexTree(tree)
+	}
+	for key, tree := range db.setIndex.trees {
+		s.sets[key] = cloneIndexTree(tree)
+	}
+
+	for _, typ := range types {
+		mutexFids := db.fidsMap[typ]
+		mutexFids.mu.RLock()
+		fids := make([]uint32, len(mutexFids.fids))
+		copy(fids, mutexFids.fids)
+		mutexFids.mu.RUnlock()
+		for _, fid := range fids {
+			// the log file of a type never written does not exist
+			if lf, err := db.acquireLogFile(typ, fid); err == nil {
+				s.files[logFileCacheKey{typ: typ, fid: fid}] = lf
+			}
+		}
+	}
+	return s
+}
+
+// cloneIndexTree copies the tree, index values are shared since they are replaced rather than modified on writes,
+// except the position of an interned value, which is copied.
+func cloneIndexTree(tree *ds.AdaptiveRadixTree) *ds.AdaptiveRadixTree {
+	clone := ds.NewART()
+	iter := tree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil {
+			break
+		}
+		val, _ := node.Value().(*Value)
+		if val != nil && val.ref != nil {
+			cp := *val
+			cp.ref = &internedValue{hash: val.ref.hash, pos: val.ref.pos}
+			val = &cp
+		}
+		clone.Put(node.Key(), val)
+	}
+	return clone
+}
+
+// Close releases log files held by the snapshot, so that log files removed by merge meanwhile are deleted.
+// Reads return ErrSnapshotClosed after Close.
+func (s *Snapshot) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSnapshotClosed
+	}
+	s.closed = true
+	atomic.AddInt32(&s.db.snapshots, -1)
+	for key := range s.files {
+		s.db.releaseLogFile(key.typ, key.fid)
+	}
+	s.files = nil
+	return nil
+}
+
+// Get gets the value of key as of the snapshot, ErrKeyNotFound is returned if the key does not exist.
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if err := s.db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrSnapshotClosed
+	}
+	return s.read(valueTypeString, s.strIndex, key)
+}
+
+// HGet gets the value of the field of the hash stored at key as of the snapshot, nil if it does not exist.
+func (s *Snapshot) HGet(key, field []byte) ([]byte, error) {
+	if err := s.db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrSnapshotClosed
+	}
+	idxTree := s.hashes[util.ByteToString(key)]
+	if idxTree == nil {
+		return nil, nil
+	}
+	val, err := s.read(valueTypeHash, idxTree, s.db.encodeKey(key, field))
+	if err == ErrKeyNotFound {
+		return nil, nil
+	}
+	return val, err
+}
+
+// HGetAll returns all fields and values of the hash stored at key as of the snapshot, like LazyDB.HGetAll.
+func (s *Snapshot) HGetAll(key []byte) ([][]byte, error) {
+	if err := s.db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrSnapshotClosed
+	}
+	results := make([][]byte, 0)
+	err := s.iterate(valueTypeHash, s.hashes[util.ByteToString(key)], func(idxKey, value []byte) {
+		_, field := s.db.decodeKey(idxKey)
+		results = append(results, field, value)
+	})
+	if err != nil {
+		return [][]byte{}, err
+	}
+	return results, nil
+}
+
+// SMembers returns all members of the set stored at key as of the snapshot, like LazyDB.SMembers.
+func (s *Snapshot) SMembers(key []byte) ([][]byte, error) {
+	if err := s.db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrSnapshotClosed
+	}
+	var members [][]byte
+	err := s.iterate(valueTypeSet, s.sets[util.ByteToString(key)], func(_, member []byte) {
+		members = append(members, member)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// iterate calls fn with every key in the index tree and its value in order, keys deleted or expired are skipped.
+func (s *Snapshot) iterate(typ valueType, idxTree *ds.AdaptiveRadixTree, fn func(idxKey, value []byte)) error {
+	if idxTree == nil {
+		return nil
+	}
+	iter := idxTree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		value, err := s.read(typ, idxTree, node.Key())
+		if err == ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		fn(node.Key(), value)
+	}
+	return nil
+}
+
+// read reads the value of key in the index tree copied by the snapshot from the log files held by it.
+func (s *Snapshot) read(typ valueType, idxTree *ds.AdaptiveRadixTree, key []byte) ([]byte, error) {
+	val, _ := idxTree.Get(key).(*Value)
+	if val == nil || val.isExpired(s.db.now().UnixMilli()) {
+		return nil, ErrKeyNotFound
+	}
+	fid, offset := val.fid, val.offset
+	if val.ref != nil {
+		if val.ref.pos.entrySize == 0 {
+			return nil, ErrMissingInternedValue
+		}
+		fid, offset = val.ref.pos.fid, val.ref.pos.offset
+	}
+	lf := s.files[logFileCacheKey{typ: typ, fid: fid}]
+	if lf == nil {
+		return nil, ErrLogFileNotExist
+	}
+	return s.db.readHeldValue(&valueRef{typ: typ, val: val, lf: lf, offset: offset}, key, nil, time.Time{})
+}
@@ -0,0 +1,114 @@
+package lazydb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_Snapshot(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+
+	n := 100
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetKey(i)))
+	}
+	assert.Nil(t, db.HSet([]byte("hash"), []byte("f1"), []byte("v1"), []byte("f2"), []byte("v2")))
+	assert.Nil(t, db.SAdd([]byte("set"), []byte("m1"), []byte("m2")))
+
+	snap := db.Snapshot()
+
+	// writes after the snapshot are not observed by it
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			assert.Nil(t, db.Delete(GetKey(i)))
+		} else {
+			assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+		}
+	}
+	assert.Nil(t, db.Set([]byte("new"), GetValue32()))
+	assert.Nil(t, db.HSet([]byte("hash"), []byte("f1"), []byte("v3")))
+	_, err := db.HDel([]byte("hash"), []byte("f2"))
+	assert.Nil(t, err)
+	assert.Nil(t, db.SRem([]byte("set"), []byte("m1")))
+	assert.Nil(t, db.SAdd([]byte("set"), []byte("m3")))
+
+	// log files rewritten by compaction are still readable by the snapshot
+	assert.Nil(t, db.FullCompact(valueTypeString))
+
+	for i := 0; i < n; i++ {
+		val, err := snap.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, GetKey(i), val)
+	}
+	_, err = snap.Get([]byte("new"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	val, err := snap.HGet([]byte("hash"), []byte("f1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	pairs, err := snap.HGetAll([]byte("hash"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("f1"), []byte("v1"), []byte("f2"), []byte("v2")}, pairs)
+	members, err := snap.SMembers([]byte("set"))
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, [][]byte{[]byte("m1"), []byte("m2")}, members)
+
+	// the db observes the writes
+	val, err = db.HGet([]byte("hash"), []byte("f1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v3"), val)
+	_, err = db.Get(GetKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.Nil(t, snap.Close())
+	_, err = snap.Get(GetKey(1))
+	assert.Equal(t, ErrSnapshotClosed, err)
+	assert.Equal(t, ErrSnapshotClosed, snap.Close())
+}
+
+func TestLazyDB_SnapshotInPlaceUpdates(t *testing.T) {
+	db, _, err := initInPlaceDB("test_snapshot_in_place_updates")
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	activeOffset := func() int64 {
+		return db.getActiveLogFile(valueTypeString).lf.Offset
+	}
+	counter, padded := []byte("counter"), []byte("padded")
+	assert.Nil(t, db.Set(counter, []byte("value-1")))
+	assert.Nil(t, db.SetWithCapacity(padded, []byte("abc"), 16))
+
+	snap := db.Snapshot()
+	// entries read by the snapshot are appended rather than overwritten
+	offset := activeOffset()
+	assert.Nil(t, db.Set(counter, []byte("value-2")))
+	_, err = db.SetRange(padded, 1, []byte("XY"))
+	assert.Nil(t, err)
+	assert.Greater(t, activeOffset(), offset)
+
+	val, err := snap.Get(counter)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-1"), val)
+	val, err = snap.Get(padded)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abc"), val)
+	val, err = db.Get(counter)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-2"), val)
+	val, err = db.Get(padded)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("aXY"), val)
+
+	// overwritten in place again once the snapshot is closed
+	assert.Nil(t, snap.Close())
+	offset = activeOffset()
+	assert.Nil(t, db.Set(counter, []byte("value-3")))
+	_, err = db.SetRange(padded, 0, []byte("Z"))
+	assert.Nil(t, err)
+	assert.Equal(t, offset, activeOffset())
+	val, err = db.Get(padded)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ZXY"), val)
+}
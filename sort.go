@@ -0,0 +1,95 @@
+package lazydb
+
+import (
+	"bytes"
+	"errors"
+	"github.com/billsjc123/LazyDB/util"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// ErrSortNotNumber is returned by Sort if an element is not a number while sorting numerically.
+var ErrSortNotNumber = errors.New("one or more elements can't be converted into a number")
+
+// Sort returns the elements of the list or set stored at key sorted by opts, a subset of SORT of Redis.
+// Elements are sorted as numbers unless opts.Alpha is set, and ErrSortNotNumber is returned if any of them
+// is not a number then. The list is used if both a list and a set are stored at key.
+// An empty result is returned if there is no such key. The stored elements are not changed.
+func (db *LazyDB) Sort(key []byte, opts SortOptions) ([][]byte, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
+	if opts.Offset < 0 {
+		return nil, ErrInvalidParam
+	}
+	elems, err := db.sortElements(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Alpha {
+		sort.SliceStable(elems, func(i, j int) bool {
+			if opts.Desc {
+				return bytes.Compare(elems[i], elems[j]) > 0
+			}
+			return bytes.Compare(elems[i], elems[j]) < 0
+		})
+	} else {
+		scores := make([]float64, len(elems))
+		for i, elem := range elems {
+			scores[i], err = strconv.ParseFloat(util.ByteToString(elem), 64)
+			if err != nil || math.IsNaN(scores[i]) {
+				return nil, ErrSortNotNumber
+			}
+		}
+		sort.Stable(&numericElements{elems: elems, scores: scores, desc: opts.Desc})
+	}
+
+	if opts.Offset >= len(elems) {
+		return [][]byte{}, nil
+	}
+	elems = elems[opts.Offset:]
+	if opts.Count > 0 && opts.Count < len(elems) {
+		elems = elems[:opts.Count]
+	}
+	return elems, nil
+}
+
+// sortElements returns the elements of the list or set stored at key.
+func (db *LazyDB) sortElements(key []byte) ([][]byte, error) {
+	db.listIndex.mu.RLock()
+	isList := db.listIndex.trees[string(key)] != nil
+	db.listIndex.mu.RUnlock()
+	if isList {
+		return db.LGetAll(key)
+	}
+	elems, err := db.SMembers(key)
+	if elems == nil && err == nil {
+		elems = [][]byte{}
+	}
+	return elems, err
+}
+
+// numericElements sorts elements by their scores parsed as numbers.
+type numericElements struct {
+	elems  [][]byte
+	scores []float64
+	desc   bool
+}
+
+func (n *numericElements) Len() int {
+	return len(n.elems)
+}
+
+func (n *numericElements) Less(i, j int) bool {
+	if n.desc {
+		return n.scores[i] > n.scores[j]
+	}
+	return n.scores[i] < n.scores[j]
+}
+
+func (n *numericElements) Swap(i, j int) {
+	n.elems[i], n.elems[j] = n.elems[j], n.elems[i]
+	n.scores[i], n.scores[j] = n.scores[j], n.scores[i]
+}
@@ -0,0 +1,80 @@
+package lazydb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_Sort(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	toBytes := func(elems ...string) [][]byte {
+		res := make([][]byte, len(elems))
+		for i, elem := range elems {
+			res[i] = []byte(elem)
+		}
+		return res
+	}
+	assert.Nil(t, db.RPush([]byte("list"), toBytes("3", "10", "-1.5", "2", "10")...))
+	assert.Nil(t, db.SAdd([]byte("set"), toBytes("banana", "apple", "cherry", "10", "9")...))
+
+	t.Run("numeric", func(t *testing.T) {
+		res, err := db.Sort([]byte("list"), SortOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, toBytes("-1.5", "2", "3", "10", "10"), res)
+		// the list is not changed
+		elems, err := db.LGetAll([]byte("list"))
+		assert.Nil(t, err)
+		assert.Equal(t, toBytes("3", "10", "-1.5", "2", "10"), elems)
+
+		_, err = db.Sort([]byte("set"), SortOptions{})
+		assert.Equal(t, ErrSortNotNumber, err)
+	})
+
+	t.Run("alpha", func(t *testing.T) {
+		res, err := db.Sort([]byte("set"), SortOptions{Alpha: true})
+		assert.Nil(t, err)
+		assert.Equal(t, toBytes("10", "9", "apple", "banana", "cherry"), res)
+		res, err = db.Sort([]byte("list"), SortOptions{Alpha: true})
+		assert.Nil(t, err)
+		assert.Equal(t, toBytes("-1.5", "10", "10", "2", "3"), res)
+	})
+
+	t.Run("desc", func(t *testing.T) {
+		res, err := db.Sort([]byte("list"), SortOptions{Desc: true})
+		assert.Nil(t, err)
+		assert.Equal(t, toBytes("10", "10", "3", "2", "-1.5"), res)
+		res, err = db.Sort([]byte("set"), SortOptions{Alpha: true, Desc: true})
+		assert.Nil(t, err)
+		assert.Equal(t, toBytes("cherry", "banana", "apple", "9", "10"), res)
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		var pages [][]byte
+		for offset := 0; offset < 5; offset += 2 {
+			res, err := db.Sort([]byte("list"), SortOptions{Offset: offset, Count: 2})
+			assert.Nil(t, err)
+			assert.LessOrEqual(t, len(res), 2)
+			pages = append(pages, res...)
+		}
+		assert.Equal(t, toBytes("-1.5", "2", "3", "10", "10"), pages)
+
+		res, err := db.Sort([]byte("list"), SortOptions{Offset: 3})
+		assert.Nil(t, err)
+		assert.Equal(t, toBytes("10", "10"), res)
+		res, err = db.Sort([]byte("list"), SortOptions{Offset: 10, Count: 2})
+		assert.Nil(t, err)
+		assert.Empty(t, res)
+		_, err = db.Sort([]byte("list"), SortOptions{Offset: -1})
+		assert.Equal(t, ErrInvalidParam, err)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		res, err := db.Sort([]byte("missing"), SortOptions{})
+		assert.Nil(t, err)
+		assert.Empty(t, res)
+	})
+}
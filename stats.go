@@ -0,0 +1,170 @@
+package lazydb
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/billsjc123/LazyDB/logfile"
+)
+
+// statsFileName the file persisting lifetime statistics, see DBConfig.PersistStats.
+const statsFileName = "STATS"
+
+// statsFileSize Writes | WrittenBytes | Merges | RewrittenBytes | crc32 of all above.
+const statsFileSize = 4*8 + 4
+
+// statsFileSizeV1 size of stats files written before RewrittenBytes was persisted.
+const statsFileSizeV1 = 3*8 + 4
+
+// Stats cumulative counters of a db. They are counted since the db is opened,
+// or over the lifetime of the db across restarts if DBConfig.PersistStats is on.
+type Stats struct {
+	Writes       uint64 // number of entries written into log files, including entries rewritten by merge
+	WrittenBytes uint64 // size of entries written into log files, including padding
+	Merges       uint64 // number of merged log files
+	// RewrittenBytes size of entries rewritten into log files by merge and compaction, it is part of WrittenBytes
+	RewrittenBytes uint64
+
+	// LazyFreePending number of keys removed by Unlink whose tombstones are being written in background,
+	// it is the current depth of the queue rather than a counter, and is never persisted.
+	LazyFreePending uint64
+
+	// DroppedExpiryNotifications number of keys not sent to subscribers of SubscribeExpiry because their channel
+	// buffers are full, one for each subscriber missing a key. It is never persisted.
+	DroppedExpiryNotifications uint64
+}
+
+// Stats returns a snapshot of the cumulative counters.
+func (db *LazyDB) Stats() Stats {
+	return Stats{
+		Writes:          atomic.LoadUint64(&db.stats.Writes),
+		WrittenBytes:    atomic.LoadUint64(&db.stats.WrittenBytes),
+		Merges:          atomic.LoadUint64(&db.stats.Merges),
+		RewrittenBytes:  atomic.LoadUint64(&db.stats.RewrittenBytes),
+		LazyFreePending: atomic.LoadUint64(&db.stats.LazyFreePending),
+
+		DroppedExpiryNotifications: atomic.LoadUint64(&db.stats.DroppedExpiryNotifications),
+	}
+}
+
+// WriteAmplification returns bytes written into log files per byte written by users, i.e. WrittenBytes over
+// WrittenBytes minus RewrittenBytes. It is 1 if merge has rewritten nothing, and 0 if nothing has been written.
+// A high ratio means merge rewrites lots of live data to reclaim little space, and may run less often, while
+// a ratio close to 1 along with a growing number of log files means stale entries pile up without being merged.
+func (s Stats) WriteAmplification() float64 {
+	if s.WrittenBytes <= s.RewrittenBytes {
+		return 0
+	}
+	return float64(s.WrittenBytes) / float64(s.WrittenBytes-s.RewrittenBytes)
+}
+
+// rewriteLogEntry writes an entry rewritten by merge or compaction into the active log file,
+// it is counted in Stats.RewrittenBytes besides Stats.WrittenBytes.
+func (db *LazyDB) rewriteLogEntry(typ valueType, ent *logfile.LogEntry) (*ValuePos, error) {
+	if rewriteLogEntryHook != nil {
+		rewriteLogEntryHook(typ, ent)
+	}
+	commitRewritten(ent)
+	// keys written before DBConfig.MaxKeySize is lowered are still rewritten
+	pos, err := db.appendLogEntry(typ, ent, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	db.recordRewrite(pos.entrySize)
+	return pos, nil
+}
+
+// rewriteLogEntryHook is called before an entry is rewritten by rewriteLogEntry, for testing.
+var rewriteLogEntryHook func(typ valueType, ent *logfile.LogEntry)
+
+// recordRewrite counts an entry of size rewritten by merge or compaction, after it is counted by recordWrite.
+func (db *LazyDB) recordRewrite(size int) {
+	atomic.AddUint64(&db.stats.RewrittenBytes, uint64(size))
+}
+
+// recordWrite counts an entry of size written into a log file.
+func (db *LazyDB) recordWrite(size int) {
+	atomic.AddUint64(&db.stats.Writes, 1)
+	atomic.AddUint64(&db.stats.WrittenBytes, uint64(size))
+}
+
+func (db *LazyDB) persistStatsEnabled() bool {
+	return db.cfg.PersistStats && !db.readOnly()
+}
+
+func (db *LazyDB) statsPath() string {
+	return filepath.Join(db.cfg.DBPath, statsFileName)
+}
+
+// loadStats loads the counters persisted by saveStats.
+// Counters start from zero if the stats file is missing or corrupt, it never fails opening the db.
+func (db *LazyDB) loadStats() {
+	data, err := os.ReadFile(db.statsPath())
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("read stats file err: %v", err)
+		return
+	}
+	size := len(data)
+	if (size != statsFileSize && size != statsFileSizeV1) ||
+		crc32.ChecksumIEEE(data[:size-4]) != binary.LittleEndian.Uint32(data[size-4:]) {
+		log.Printf("stats file is corrupt, counters are reset")
+		return
+	}
+	atomic.StoreUint64(&db.stats.Writes, binary.LittleEndian.Uint64(data[0:]))
+	atomic.StoreUint64(&db.stats.WrittenBytes, binary.LittleEndian.Uint64(data[8:]))
+	atomic.StoreUint64(&db.stats.Merges, binary.LittleEndian.Uint64(data[16:]))
+	if size == statsFileSize {
+		atomic.StoreUint64(&db.stats.RewrittenBytes, binary.LittleEndian.Uint64(data[24:]))
+	}
+}
+
+// saveStats persists the counters, it replaces the old stats file atomically.
+func (db *LazyDB) saveStats() error {
+	stats := db.Stats()
+	buf := make([]byte, statsFileSize)
+	binary.LittleEndian.PutUint64(buf[0:], stats.Writes)
+	binary.LittleEndian.PutUint64(buf[8:], stats.WrittenBytes)
+	binary.LittleEndian.PutUint64(buf[16:], stats.Merges)
+	binary.LittleEndian.PutUint64(buf[24:], stats.RewrittenBytes)
+	binary.LittleEndian.PutUint32(buf[statsFileSize-4:], crc32.ChecksumIEEE(buf[:statsFileSize-4]))
+
+	path := db.statsPath()
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.Write(buf); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// runPersistStats saves the counters every interval until closeCh is closed.
+func (db *LazyDB) runPersistStats(interval time.Duration, closeCh <-chan struct{}) {
+	defer db.bgWg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closeCh:
+			return
+		case <-ticker.C:
+			if err := db.saveStats(); err != nil {
+				log.Printf("persist stats err: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_PersistStats(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_persist_stats")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 150
+	cfg.PersistStats = true
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, db.Set(GetKey(0), GetValue32()))
+	}
+	stats := db.Stats()
+	assert.Equal(t, uint64(5), stats.Writes)
+	assert.Greater(t, stats.WrittenBytes, uint64(5*32))
+
+	fid := db.fidsMap[valueTypeString].fids[0]
+	assert.Eventually(t, func() bool {
+		ccl, err := db.discardsMap[valueTypeString].getCCL(db.getActiveLogFile(valueTypeString).lf.Fid, 0)
+		return err == nil && len(ccl) > 0 && ccl[0] == fid
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, db.Merge(valueTypeString, fid, 0))
+	stats = db.Stats()
+	assert.Equal(t, uint64(1), stats.Merges)
+
+	// carried over after reopen
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, stats, db.Stats())
+	assert.Nil(t, db.Set(GetKey(1), GetValue32()))
+	assert.Equal(t, stats.Writes+1, db.Stats().Writes)
+
+	// reset if the stats file is corrupt
+	assert.Nil(t, db.Close())
+	assert.Nil(t, os.WriteFile(filepath.Join(path, statsFileName), []byte("corrupt"), 0644))
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, Stats{}, db.Stats())
+
+	// reset if the stats file is missing
+	assert.Nil(t, db.Close())
+	assert.Nil(t, os.Remove(filepath.Join(path, statsFileName)))
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, Stats{}, db.Stats())
+}
+
+func TestLazyDB_StatsPersistInterval(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_stats_persist_interval")
+	cfg := DefaultDBConfig(path)
+	cfg.PersistStats = true
+	cfg.StatsPersistInterval = 10 * time.Millisecond
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	assert.Nil(t, db.Set(GetKey(0), GetValue32()))
+	// saved periodically without closing
+	assert.Eventually(t, func() bool {
+		crashed := newLazyDB(cfg)
+		crashed.loadStats()
+		return crashed.Stats() == db.Stats()
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestLazyDB_WriteAmplification(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+
+	n := 100
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+	}
+	for i := 0; i < n/2; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+	}
+	stats := db.Stats()
+	assert.Equal(t, uint64(0), stats.RewrittenBytes)
+	assert.Equal(t, float64(1), stats.WriteAmplification())
+
+	// live entries rewritten by compaction are counted as extra bytes
+	assert.Nil(t, db.FullCompact(valueTypeString))
+	compacted := db.Stats()
+	rewritten := compacted.WrittenBytes - stats.WrittenBytes
+	assert.Greater(t, rewritten, uint64(0))
+	assert.Equal(t, rewritten, compacted.RewrittenBytes)
+	assert.InDelta(t, float64(compacted.WrittenBytes)/float64(stats.WrittenBytes), compacted.WriteAmplification(), 1e-9)
+
+	// the second compaction rewrites the same live entries again
+	assert.Nil(t, db.FullCompact(valueTypeString))
+	assert.Equal(t, 2*rewritten, db.Stats().RewrittenBytes)
+	assert.Greater(t, db.Stats().WriteAmplification(), compacted.WriteAmplification())
+
+	assert.Equal(t, float64(0), Stats{}.WriteAmplification())
+}
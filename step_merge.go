@@ -0,0 +1,77 @@
+package lazydb
+
+import (
+	"github.com/billsjc123/LazyDB/logfile"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// stepMergeCursors offsets where StepMerge continues in archived log files, by type and fid.
+type stepMergeCursors struct {
+	mu      sync.Mutex
+	offsets map[valueType]map[uint32]int64
+}
+
+// StepMerge is the incremental version of Merge for the archived log file fid of the type, it reads at most
+// maxEntries entries of the log file and rewrites the live ones per call, then returns whether the log file
+// has been merged and removed. So that the compaction can be spread across time, rather than blocking writes
+// for a long time. The offset to continue with is kept per log file between calls, and it is lost on Close.
+// Calls of StepMerge are serialized, and the log file must not be merged by Merge meanwhile.
+func (db *LazyDB) StepMerge(typ valueType, fid uint32, maxEntries int) (done bool, err error) {
+	if err := db.checkRewrite(); err != nil {
+		return false, err
+	}
+	if maxEntries <= 0 {
+		return false, ErrInvalidParam
+	}
+	db.stepMerges.mu.Lock()
+	defer db.stepMerges.mu.Unlock()
+	if db.stepMerges.offsets == nil {
+		db.stepMerges.offsets = make(map[valueType]map[uint32]int64)
+	}
+	offsets := db.stepMerges.offsets[typ]
+	if offsets == nil {
+		offsets = make(map[uint32]int64)
+		db.stepMerges.offsets[typ] = offsets
+	}
+
+	archivedFile := db.getArchivedLogFile(typ, fid)
+	if archivedFile == nil {
+		delete(offsets, fid)
+		return false, ErrLogFileNotExist
+	}
+	offset := offsets[fid]
+	eof := offset >= archivedFile.lf.Offset
+	for i := 0; i < maxEntries && !eof; i++ {
+		if err := db.pinLogFile(typ, archivedFile.lf); err != nil {
+			return false, err
+		}
+		ent, size, err := archivedFile.lf.ReadLogEntry(offset)
+		archivedFile.lf.Mu.RUnlock()
+		if err == io.EOF || err == logfile.ErrLogEndOfFile {
+			eof = true
+			break
+		}
+		if err == logfile.ErrInvalidCrc {
+			return false, corruptedEntryError(fid, offset)
+		}
+		if err != nil {
+			return false, err
+		}
+		if err := db.mergeEntry(typ, fid, offset, ent); err != nil {
+			return false, err
+		}
+		offset += int64(size)
+		offsets[fid] = offset
+		eof = offset >= archivedFile.lf.Offset
+	}
+	if !eof {
+		return false, nil
+	}
+
+	db.removeArchivedLogFile(typ, fid)
+	delete(offsets, fid)
+	atomic.AddUint64(&db.stats.Merges, 1)
+	return true, nil
+}
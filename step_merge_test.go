@@ -0,0 +1,67 @@
+package lazydb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_StepMerge(t *testing.T) {
+	wd, _ := os.Getwd()
+	open := func(name string) *LazyDB {
+		cfg := DefaultDBConfig(filepath.Join(wd, name))
+		cfg.MaxLogFileSize = 500
+		db, err := Open(cfg)
+		assert.Nil(t, err)
+		// the same values are written, so that the results can be compared
+		for i := 0; i < 24; i++ {
+			assert.Nil(t, db.Set(GetKey(i%4), GetKey(i)))
+		}
+		assert.Nil(t, db.Delete(GetKey(3)))
+		return db
+	}
+	oneShot := open("test_step_merge_one_shot")
+	defer destroyDB(oneShot)
+	stepped := open("test_step_merge_stepped")
+	defer destroyDB(stepped)
+
+	typ := valueTypeString
+	for _, fid := range oneShot.fidsMap[typ].fids[:2] {
+		assert.Eventually(t, func() bool {
+			ccl, err := oneShot.discardsMap[typ].getCCL(oneShot.getActiveLogFile(typ).lf.Fid, 0)
+			return err == nil && len(ccl) > 0 && ccl[0] == fid
+		}, time.Second, 10*time.Millisecond)
+		assert.Nil(t, oneShot.Merge(typ, fid, 0))
+		assert.Nil(t, oneShot.getArchivedLogFile(typ, fid))
+
+		calls := 0
+		for {
+			done, err := stepped.StepMerge(typ, fid, 2)
+			assert.Nil(t, err)
+			calls++
+			if done {
+				break
+			}
+			// the log file is kept until it is fully merged
+			assert.NotNil(t, stepped.getArchivedLogFile(typ, fid))
+		}
+		assert.Greater(t, calls, 1)
+		assert.Nil(t, stepped.getArchivedLogFile(typ, fid))
+		_, err := stepped.StepMerge(typ, fid, 2)
+		assert.Equal(t, ErrLogFileNotExist, err)
+	}
+
+	var want, got bytes.Buffer
+	assert.Nil(t, oneShot.DumpAll(&want))
+	assert.Nil(t, stepped.DumpAll(&got))
+	assert.Equal(t, want.String(), got.String())
+	assert.Equal(t, oneShot.archivedLogFile[valueTypeString].Size(), stepped.archivedLogFile[valueTypeString].Size())
+	assert.Equal(t, uint64(2), stepped.Stats().Merges)
+
+	_, err := stepped.StepMerge(valueTypeString, 1, 0)
+	assert.Equal(t, ErrInvalidParam, err)
+}
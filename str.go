@@ -8,41 +8,224 @@ import (
 	"log"
 	"math"
 	"regexp"
+	"sort"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	ErrWrongValueType  = errors.New("value is not an integer")
 	ErrIntegerOverFlow = errors.New("integer overflow")
+	// ErrInvalidExpire is returned when the time to live is not positive, use Delete to remove a key instead.
+	ErrInvalidExpire = errors.New("invalid expire time")
 )
 
 // Set set key to hold the string value. If key already holds a value, it is overwritten.
-// Any previous time to live associated with the key is discarded on successful Set operation.
+// Any previous time to live associated with the key is discarded on successful Set operation,
+// and the key expires after DBConfig.DefaultTTL if it is set.
+// Nothing will be written if DBConfig.SkipDuplicateWrites is on and the key holds the same value without time to live.
 func (db *LazyDB) Set(key, value []byte) error {
-	db.strIndex.mu.Lock()
+	return db.SetWithOptions(key, value, WriteOptions{})
+}
+
+// SetWithOptions is like Set, but how long it waits for locks and fsync is bounded by opts,
+// and the time to live of key is decided by opts.
+// Note that the value may still be persisted if ErrDeadlineExceeded is returned while waiting for fsync.
+func (db *LazyDB) SetWithOptions(key, value []byte, opts WriteOptions) error {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return err
+	}
+	return db.setStr(key, value, opts)
+}
+
+// setStr is SetWithOptions without checking DBConfig.AccessControl.
+func (db *LazyDB) setStr(key, value []byte, opts WriteOptions) error {
+	if err := lockWithDeadline(db.strIndex.mu, opts.Deadline); err != nil {
+		return err
+	}
 	defer db.strIndex.mu.Unlock()
 
-	entry := &logfile.LogEntry{Key: key, Value: value}
-	valuePos, err := db.writeLogEntry(valueTypeString, entry)
+	if err := db.evict(); err != nil {
+		return err
+	}
+	expiredAt := opts.expiredAt(db, db.now())
+	if db.cfg.SkipDuplicateWrites && expiredAt == 0 && db.isDuplicateStr(key, value) {
+		return nil
+	}
+
+	var entry *logfile.LogEntry
+	var valuePos *ValuePos
+	var inPlace bool
+	var err error
+	if db.internable(value) {
+		entry, valuePos, err = db.writeInterned(key, value, expiredAt, opts.Deadline)
+	} else {
+		entry = &logfile.LogEntry{Key: key, Value: value, ExpiredAt: expiredAt}
+		valuePos, inPlace, err = db.writeStrEntry(entry, opts.Deadline)
+	}
 	if err != nil {
 		return err
 	}
-	err = db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valuePos, true)
+	// the older entry is still live if it is overwritten in place
+	err = db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valuePos, !inPlace)
 	return err
 }
 
+// isDuplicateStr returns whether the key holds the same value without time to live.
+// Lock of strIndex must be held by the caller.
+func (db *LazyDB) isDuplicateStr(key, value []byte) bool {
+	idxNode, _ := db.strIndex.idxTree.Get(key).(*Value)
+	if idxNode == nil || idxNode.expiredAt != 0 {
+		return false
+	}
+	oldValue, err := db.getValue(db.strIndex.idxTree, key, valueTypeString)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(oldValue, value)
+}
+
 // Get get the value of key.
 // If the key does not exist the error ErrKeyNotFound is returned.
 func (db *LazyDB) Get(key []byte) ([]byte, error) {
+	return db.GetWithOptions(key, ReadOptions{})
+}
+
+// GetWithOptions is like Get, but how long it waits for locks is bounded by opts.
+func (db *LazyDB) GetWithOptions(key []byte, opts ReadOptions) ([]byte, error) {
+	return db.getStr(key, nil, opts.Deadline)
+}
+
+// GetInto is like Get, but the value is appended to dst like append, so that buffers can be reused on hot paths.
+// dst is grown only if its spare capacity is less than the size of key and value,
+// so the returned slice may alias dst.
+func (db *LazyDB) GetInto(key []byte, dst []byte) ([]byte, error) {
+	return db.getStr(key, dst, time.Time{})
+}
+
+// GetWithTTL gets the value of key along with its remaining time to live in seconds, -1 if it never expires.
+// Both are read in a single lookup, so they are consistent with each other.
+// If the key does not exist or has expired the error ErrKeyNotFound is returned.
+func (db *LazyDB) GetWithTTL(key []byte) ([]byte, int64, error) {
+	val, idxNode, err := db.getStrValue(key, nil, time.Time{})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ttl int64 = -1
+	if idxNode.expiredAt != 0 {
+		if ttl = idxNode.expiredAt - db.now().UnixMilli(); ttl < 0 {
+			ttl = 0
+		}
+		ttl /= int64(time.Second / time.Millisecond)
+	}
+	return val, ttl, nil
+}
+
+// getStr gets the value of key, the value is appended to dst if dst is not nil.
+// The log file is read after the index lock is released, see lookupValue.
+func (db *LazyDB) getStr(key []byte, dst []byte, deadline time.Time) ([]byte, error) {
+	val, _, err := db.getStrValue(key, dst, deadline)
+	return val, err
+}
+
+// getStrValue is like getStr, but also returns the index value which the value is read by.
+func (db *LazyDB) getStrValue(key []byte, dst []byte, deadline time.Time) ([]byte, *Value, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, nil, err
+	}
+	if err := rlockWithDeadline(db.strIndex.mu, deadline); err != nil {
+		return nil, nil, err
+	}
+	if err := db.checkType(valueTypeString, key); err != nil {
+		db.strIndex.mu.RUnlock()
+		return nil, nil, err
+	}
+	ref, err := db.lookupValue(db.strIndex.idxTree, key, valueTypeString)
+	// the log file cache checks the active log file, which is only stable under the index lock
+	locked := db.fileCache != nil
+	if !locked {
+		db.strIndex.mu.RUnlock()
+	}
+
+	var val []byte
+	if err == nil {
+		if val, err = db.readCachedValue(ref, key, dst, deadline); err == nil {
+			db.recordAccess(ref.val)
+		}
+	}
+	if locked {
+		db.strIndex.mu.RUnlock()
+	}
+	if errors.Is(err, ErrKeyNotFound) {
+		db.lazyExpireStr(key)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return val, ref.val, nil
+}
+
+// readCachedValue is like readValue, but the value is read from DBConfig.ValueCacheSize cache if it is cached,
+// and cached after it is read otherwise.
+func (db *LazyDB) readCachedValue(ref *valueRef, key []byte, dst []byte, deadline time.Time) ([]byte, error) {
+	if db.valueCache == nil {
+		return db.readValue(ref, key, dst, deadline)
+	}
+	if val, ok := db.valueCache.get(ref.lf.Fid, ref.offset, dst); ok {
+		db.releaseLogFile(ref.typ, ref.lf.Fid)
+		return val, nil
+	}
+	n := len(dst)
+	val, err := db.readValue(ref, key, dst, deadline)
+	if err == nil {
+		db.valueCache.put(ref.lf.Fid, ref.offset, val[n:])
+	}
+	return val, err
+}
+
+// GetRaw returns the binary log entry of the live value of key as it is stored, header along with key and value,
+// so that it can be forwarded verbatim without decoding and encoding again, e.g. to a replica by ApplyEntry after
+// logfile.DecodeEntry. The check sum is verified before returning. If the value is interned, see
+// DBConfig.InternValues, the entry holds the reference to it rather than the value.
+// If the key does not exist or has expired the error ErrKeyNotFound is returned.
+func (db *LazyDB) GetRaw(key []byte) ([]byte, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
 	db.strIndex.mu.RLock()
 	defer db.strIndex.mu.RUnlock()
-	return db.getValue(db.strIndex.idxTree, key, valueTypeString)
+	if err := db.checkType(valueTypeString, key); err != nil {
+		return nil, err
+	}
+
+	val, _ := db.strIndex.idxTree.Get(key).(*Value)
+	if val == nil || val.isExpired(db.now().UnixMilli()) {
+		return nil, ErrKeyNotFound
+	}
+	lf, err := db.acquireLogFile(valueTypeString, val.fid)
+	if err != nil {
+		return nil, err
+	}
+	defer db.releaseLogFile(valueTypeString, val.fid)
+	if err = db.pinLogFile(valueTypeString, lf); err != nil {
+		return nil, err
+	}
+	defer lf.Mu.RUnlock()
+	buf, err := lf.ReadRawLogEntry(val.offset)
+	if err == logfile.ErrInvalidCrc {
+		return nil, corruptedEntryError(val.fid, val.offset)
+	}
+	return buf, err
 }
 
 // MGet get the values of all specified keys.
 // If the key that does not hold a string value or does not exist, nil is returned.
 func (db *LazyDB) MGet(keys [][]byte) ([][]byte, error) {
+	if err := db.checkAccess(OpRead, keys...); err != nil {
+		return nil, err
+	}
 	if len(keys) == 0 {
 		return nil, ErrInvalidParam
 	}
@@ -63,15 +246,27 @@ func (db *LazyDB) MGet(keys [][]byte) ([][]byte, error) {
 // GetRange returns the substring of the string value stored at key,
 // determined by the offsets start and end.
 func (db *LazyDB) GetRange(key []byte, start, end int) ([]byte, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
 	db.strIndex.mu.RLock()
 	defer db.strIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeString, key); err != nil {
+		return nil, err
+	}
 
 	val, err := db.getValue(db.strIndex.idxTree, key, valueTypeString)
 	if err != nil {
 		return nil, err
 	}
+	return byteRange(val, start, end), nil
+}
+
+// byteRange returns val[start:end+1], the offsets are inclusive, and negative offsets count from the end.
+// Offsets out of range are clamped, an empty slice is returned if the range is empty.
+func byteRange(val []byte, start, end int) []byte {
 	if len(val) == 0 {
-		return []byte{}, nil
+		return []byte{}
 	}
 	if start < 0 {
 		start = len(val) + start
@@ -89,14 +284,17 @@ func (db *LazyDB) GetRange(key []byte, start, end int) ([]byte, error) {
 		end = len(val) - 1
 	}
 	if start > len(val)-1 || start > end {
-		return []byte{}, nil
+		return []byte{}
 	}
-	return val[start : end+1], nil
+	return val[start : end+1]
 }
 
 // GetDel gets the value of the key and deletes the key. This method is similar
 // to Get method. It also deletes the key if it exists.
 func (db *LazyDB) GetDel(key []byte) ([]byte, error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return nil, err
+	}
 	db.strIndex.mu.Lock()
 	defer db.strIndex.mu.Unlock()
 
@@ -107,43 +305,37 @@ func (db *LazyDB) GetDel(key []byte) ([]byte, error) {
 	if val == nil {
 		return nil, nil
 	}
-
-	entry := &logfile.LogEntry{Key: key, Stat: logfile.SDelete}
-	pos, err := db.writeLogEntry(valueTypeString, entry)
-	if err != nil {
+	if err = db.deleteStr(key); err != nil {
 		return nil, err
 	}
-	delVal, updated := db.strIndex.idxTree.Delete(key)
-
-	// delete invalid entry
-	db.sendDiscard(delVal, updated, valueTypeString)
-	// also merge the delete entry
-	_, size := logfile.EncodeEntry(entry)
-	node := &Value{fid: pos.fid, entrySize: size}
-	select {
-	case db.discardsMap[valueTypeString].valChan <- node:
-	default:
-		log.Fatal("send discard fail")
-	}
 	return val, nil
 }
 
 // Delete value at the given key.
 func (db *LazyDB) Delete(key []byte) error {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return err
+	}
 	db.strIndex.mu.Lock()
 	defer db.strIndex.mu.Unlock()
+	return db.deleteStr(key)
+}
 
+// deleteStr deletes the key of type String.
+// Lock of strIndex must be held by the caller.
+func (db *LazyDB) deleteStr(key []byte) error {
 	entry := &logfile.LogEntry{Key: key, Stat: logfile.SDelete}
 	pos, err := db.writeLogEntry(valueTypeString, entry)
 	if err != nil {
 		return err
 	}
 	delVal, updated := db.strIndex.idxTree.Delete(key)
+	db.replaceStrValue(key, delVal, nil)
 
 	// delete invalid entry
 	db.sendDiscard(delVal, updated, valueTypeString)
 	// also merge the delete entry
-	_, size := logfile.EncodeEntry(entry)
+	size := db.entrySize(entry)
 	node := &Value{fid: pos.fid, entrySize: size}
 	select {
 	case db.discardsMap[valueTypeString].valChan <- node:
@@ -154,11 +346,26 @@ func (db *LazyDB) Delete(key []byte) error {
 }
 
 // SetEX set key to hold the string value and set key to timeout after the given duration.
+// ErrInvalidExpire is returned if duration is not positive.
 func (db *LazyDB) SetEX(key, value []byte, duration time.Duration) error {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return err
+	}
+	return db.setEX(key, value, duration)
+}
+
+// setEX is SetEX without checking DBConfig.AccessControl.
+func (db *LazyDB) setEX(key, value []byte, duration time.Duration) error {
+	if duration <= 0 {
+		return ErrInvalidExpire
+	}
 	db.strIndex.mu.Lock()
 	defer db.strIndex.mu.Unlock()
 
-	expiredAt := time.Now().Add(duration).Unix()
+	if err := db.evict(); err != nil {
+		return err
+	}
+	expiredAt := db.now().Add(duration).UnixMilli()
 	entry := &logfile.LogEntry{Key: key, Value: value, ExpiredAt: expiredAt}
 	valuePos, err := db.writeLogEntry(valueTypeString, entry)
 	if err != nil {
@@ -167,19 +374,33 @@ func (db *LazyDB) SetEX(key, value []byte, duration time.Duration) error {
 	return db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valuePos, true)
 }
 
-// SetNX sets the key-value pair if it is not exist. It returns nil if the key already exists.
+// PSetEX set key to hold the string value and set key to timeout after the given milliseconds.
+func (db *LazyDB) PSetEX(key, value []byte, ms int64) error {
+	return db.SetEX(key, value, time.Duration(ms)*time.Millisecond)
+}
+
+// SetNX sets the key-value pair if it is not exist. It returns nil if the key already exists,
+// or ErrKeyExists if DBConfig.NXConflictError is set. The check and the write are done under the same lock,
+// so exactly one of concurrent calls for the same absent key writes.
 func (db *LazyDB) SetNX(key, value []byte) error {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return err
+	}
 	db.strIndex.mu.Lock()
 	defer db.strIndex.mu.Unlock()
 
-	val, err := db.getValue(db.strIndex.idxTree, key, valueTypeString)
-	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+	if err := db.evict(); err != nil {
 		return err
 	}
-	if val != nil {
-		return nil
+	// a key holding an empty value exists as well
+	_, err := db.getValue(db.strIndex.idxTree, key, valueTypeString)
+	if err == nil {
+		return db.nxConflict()
+	}
+	if !errors.Is(err, ErrKeyNotFound) {
+		return err
 	}
-	entry := &logfile.LogEntry{Key: key, Value: value}
+	entry := &logfile.LogEntry{Key: key, Value: value, ExpiredAt: db.defaultExpiredAt(db.now())}
 	valuePos, err := db.writeLogEntry(valueTypeString, entry)
 	if err != nil {
 		return err
@@ -187,17 +408,70 @@ func (db *LazyDB) SetNX(key, value []byte) error {
 	return db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valuePos, true)
 }
 
+// nxConflict returns the error of a conditional write which writes nothing since the key exists,
+// see DBConfig.NXConflictError.
+func (db *LazyDB) nxConflict() error {
+	if db.cfg.NXConflictError {
+		return ErrKeyExists
+	}
+	return nil
+}
+
+// CompareAndSwap sets key to hold the new value only if its current value equals expected,
+// a nil expected means the key must not exist. It returns whether the value is swapped.
+// Any previous time to live associated with the key is discarded on successful swap.
+func (db *LazyDB) CompareAndSwap(key, expected, new []byte) (bool, error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return false, err
+	}
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	if err := db.evict(); err != nil {
+		return false, err
+	}
+	val, err := db.getValue(db.strIndex.idxTree, key, valueTypeString)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return false, err
+	}
+	exist := err == nil
+	if expected == nil && exist || expected != nil && (!exist || !bytes.Equal(val, expected)) {
+		return false, nil
+	}
+	entry := &logfile.LogEntry{Key: key, Value: new, ExpiredAt: db.defaultExpiredAt(db.now())}
+	valuePos, err := db.writeLogEntry(valueTypeString, entry)
+	if err != nil {
+		return false, err
+	}
+	if err = db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valuePos, true); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // MSet is multiple set command. Parameter order should be like "key", "value", "key", "value", ...
 func (db *LazyDB) MSet(args ...[]byte) error {
+	if err := db.checkPairsAccess(OpWrite, args); err != nil {
+		return err
+	}
 	if len(args) == 0 || len(args)%2 == 1 {
 		return ErrInvalidParam
 	}
+	// no key is set if any of them is too large
+	for i := 0; i < len(args); i += 2 {
+		if err := db.checkKeySize(&logfile.LogEntry{Key: args[i]}); err != nil {
+			return err
+		}
+	}
 	db.strIndex.mu.Lock()
 	defer db.strIndex.mu.Unlock()
 
+	if err := db.evict(); err != nil {
+		return err
+	}
 	for i := 0; i < len(args); i += 2 {
 		key, val := args[i], args[i+1]
-		entry := &logfile.LogEntry{Key: key, Value: val}
+		entry := &logfile.LogEntry{Key: key, Value: val, ExpiredAt: db.defaultExpiredAt(db.now())}
 		valuePos, err := db.writeLogEntry(valueTypeString, entry)
 		if err != nil {
 			return err
@@ -211,22 +485,29 @@ func (db *LazyDB) MSet(args ...[]byte) error {
 }
 
 // MSetNX sets given keys to their respective values. MSetNX will not perform
-// any operation at all even if just a single key already exists.
+// any operation at all even if just a single key already exists, and ErrKeyExists is returned then
+// if DBConfig.NXConflictError is set.
 func (db *LazyDB) MSetNX(args ...[]byte) error {
+	if err := db.checkPairsAccess(OpWrite, args); err != nil {
+		return err
+	}
 	if len(args) == 0 || len(args)%2 != 0 {
 		return ErrInvalidParam
 	}
 	db.strIndex.mu.Lock()
 	defer db.strIndex.mu.Unlock()
 
+	if err := db.evict(); err != nil {
+		return err
+	}
 	for i := 0; i < len(args); i += 2 {
 		key := args[i]
-		val, err := db.getValue(db.strIndex.idxTree, key, valueTypeString)
-		if err != nil && !errors.Is(err, ErrKeyNotFound) {
-			return err
+		_, err := db.getValue(db.strIndex.idxTree, key, valueTypeString)
+		if err == nil {
+			return db.nxConflict()
 		}
-		if val != nil {
-			return nil
+		if !errors.Is(err, ErrKeyNotFound) {
+			return err
 		}
 	}
 	var newKeys = make(map[uint64]struct{})
@@ -236,7 +517,7 @@ func (db *LazyDB) MSetNX(args ...[]byte) error {
 		if _, ok := newKeys[h]; ok {
 			continue
 		}
-		entry := &logfile.LogEntry{Key: key, Value: value}
+		entry := &logfile.LogEntry{Key: key, Value: value, ExpiredAt: db.defaultExpiredAt(db.now())}
 		valPos, err := db.writeLogEntry(valueTypeString, entry)
 		if err != nil {
 			return err
@@ -252,23 +533,25 @@ func (db *LazyDB) MSetNX(args ...[]byte) error {
 
 // Append appends the value at the end of the old value if key already exists.
 // It will be similar to Set if key does not exist.
+// The value grows in place within the capacity reserved by SetWithCapacity.
 func (db *LazyDB) Append(key, value []byte) error {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return err
+	}
 	db.strIndex.mu.Lock()
 	defer db.strIndex.mu.Unlock()
 
-	val, err := db.getValue(db.strIndex.idxTree, key, valueTypeString)
+	if err := db.evict(); err != nil {
+		return err
+	}
+	val, capacity, err := db.getStrWithCapacity(key)
 	if err != nil && !errors.Is(err, ErrKeyNotFound) {
 		return err
 	}
 	if val != nil {
 		value = append(val, value...)
 	}
-	entry := &logfile.LogEntry{Key: key, Value: value}
-	valuePos, err := db.writeLogEntry(valueTypeString, entry)
-	if err != nil {
-		return err
-	}
-	return db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valuePos, true)
+	return db.setGrown(key, value, capacity)
 }
 
 // Decr decrements the number stored at key by one. If the key does not exist,
@@ -276,6 +559,9 @@ func (db *LazyDB) Append(key, value []byte) error {
 // error if the value is not integer type. Also, it returns ErrIntegerOverflow
 // error if the value exceeds after decrementing the value.
 func (db *LazyDB) Decr(key []byte) (int64, error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return 0, err
+	}
 	db.strIndex.mu.Lock()
 	defer db.strIndex.mu.Unlock()
 	return db.incrDecrBy(key, -1)
@@ -286,6 +572,9 @@ func (db *LazyDB) Decr(key []byte) (int64, error) {
 // error if the value is not integer type. Also, it returns ErrIntegerOverflow
 // error if the value exceeds after decrementing the value.
 func (db *LazyDB) DecrBy(key []byte, decr int64) (int64, error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return 0, err
+	}
 	db.strIndex.mu.Lock()
 	defer db.strIndex.mu.Unlock()
 	return db.incrDecrBy(key, -decr)
@@ -296,6 +585,9 @@ func (db *LazyDB) DecrBy(key []byte, decr int64) (int64, error) {
 // error if the value is not integer type. Also, it returns ErrIntegerOverflow
 // error if the value exceeds after incrementing the value.
 func (db *LazyDB) Incr(key []byte) (int64, error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return 0, err
+	}
 	db.strIndex.mu.Lock()
 	defer db.strIndex.mu.Unlock()
 	return db.incrDecrBy(key, 1)
@@ -306,6 +598,9 @@ func (db *LazyDB) Incr(key []byte) (int64, error) {
 // error if the value is not integer type. Also, it returns ErrIntegerOverflow
 // error if the value exceeds after incrementing the value.
 func (db *LazyDB) IncrBy(key []byte, incr int64) (int64, error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return 0, err
+	}
 	db.strIndex.mu.Lock()
 	defer db.strIndex.mu.Unlock()
 	return db.incrDecrBy(key, incr)
@@ -313,6 +608,9 @@ func (db *LazyDB) IncrBy(key []byte, incr int64) (int64, error) {
 
 // incrDecrBy is a helper method for Incr, IncrBy, Decr, and DecrBy methods. It updates the key by incr.
 func (db *LazyDB) incrDecrBy(key []byte, incr int64) (int64, error) {
+	if err := db.evict(); err != nil {
+		return 0, err
+	}
 	val, err := db.getValue(db.strIndex.idxTree, key, valueTypeString)
 	if err != nil && !errors.Is(err, ErrKeyNotFound) {
 		return 0, err
@@ -330,12 +628,12 @@ func (db *LazyDB) incrDecrBy(key []byte, incr int64) (int64, error) {
 	}
 	valInt64 += incr
 	val = []byte(strconv.FormatInt(valInt64, 10))
-	entry := &logfile.LogEntry{Key: key, Value: val}
-	valuePos, err := db.writeLogEntry(valueTypeString, entry)
+	entry := &logfile.LogEntry{Key: key, Value: val, ExpiredAt: db.defaultExpiredAt(db.now())}
+	valuePos, inPlace, err := db.writeStrEntry(entry, time.Time{})
 	if err != nil {
 		return 0, err
 	}
-	err = db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valuePos, true)
+	err = db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valuePos, !inPlace)
 	if err != nil {
 		return 0, err
 	}
@@ -344,14 +642,20 @@ func (db *LazyDB) incrDecrBy(key []byte, incr int64) (int64, error) {
 
 // StrLen returns the length of the string value stored at key. If the key
 // doesn't exist, it returns 0.
-func (db *LazyDB) StrLen(key []byte) int {
+func (db *LazyDB) StrLen(key []byte) (int, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return 0, err
+	}
 	db.strIndex.mu.RLock()
 	defer db.strIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeString, key); err != nil {
+		return 0, err
+	}
 	val, err := db.getValue(db.strIndex.idxTree, key, valueTypeString)
-	if err != nil {
-		return 0
+	if errors.Is(err, ErrKeyNotFound) {
+		return 0, nil
 	}
-	return len(val)
+	return len(val), err
 }
 
 // Count returns the total number of keys of String.
@@ -364,6 +668,7 @@ func (db *LazyDB) Count() int {
 // Scan iterates over all keys of type String and finds its value.
 // Parameter prefix will match key`s prefix, and pattern is a regular expression that also matchs the key.
 // Parameter count limits the number of keys, a nil slice will be returned if count is not a positive number.
+// Keys are in order of DBConfig.KeyComparator, and the first count keys in that order are scanned.
 // The returned values will be a mixed data of keys and values, like [key1, value1, key2, value2, etc...].
 func (db *LazyDB) Scan(prefix []byte, pattern string, count int) ([][]byte, error) {
 	if count <= 0 {
@@ -381,7 +686,19 @@ func (db *LazyDB) Scan(prefix []byte, pattern string, count int) ([][]byte, erro
 	if db.strIndex.idxTree == nil {
 		return nil, nil
 	}
-	keys := db.strIndex.idxTree.PrefixScan(prefix, count)
+	var keys [][]byte
+	if db.cfg.KeyComparator == nil {
+		keys = db.strIndex.idxTree.PrefixScan(prefix, count)
+	} else {
+		// the first count keys in custom order may be anywhere in the index
+		keys = db.strIndex.idxTree.PrefixScan(prefix, -1)
+		sort.Slice(keys, func(i, j int) bool {
+			return db.compareKeys(keys[i], keys[j]) < 0
+		})
+		if len(keys) > count {
+			keys = keys[:count]
+		}
+	}
 	if len(keys) == 0 {
 		return nil, nil
 	}
@@ -402,9 +719,13 @@ func (db *LazyDB) Scan(prefix []byte, pattern string, count int) ([][]byte, erro
 }
 
 // Expire set the expiration time for the given key.
+// ErrInvalidExpire is returned if duration is not positive.
 func (db *LazyDB) Expire(key []byte, duration time.Duration) error {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return err
+	}
 	if duration <= 0 {
-		return nil
+		return ErrInvalidExpire
 	}
 	db.strIndex.mu.RLock()
 	val, err := db.getValue(db.strIndex.idxTree, key, valueTypeString)
@@ -413,11 +734,28 @@ func (db *LazyDB) Expire(key []byte, duration time.Duration) error {
 		return err
 	}
 	db.strIndex.mu.RUnlock()
-	return db.SetEX(key, val, duration)
+	return db.setEX(key, val, duration)
 }
 
-// TTL get ttl(time to live) for the given key.
+// PExpire set the expiration time in milliseconds for the given key.
+func (db *LazyDB) PExpire(key []byte, ms int64) error {
+	return db.Expire(key, time.Duration(ms)*time.Millisecond)
+}
+
+// TTL get ttl(time to live) in seconds for the given key.
 func (db *LazyDB) TTL(key []byte) (int64, error) {
+	ttl, err := db.PTTL(key)
+	if err != nil {
+		return 0, err
+	}
+	return ttl / int64(time.Second/time.Millisecond), nil
+}
+
+// PTTL get ttl(time to live) in milliseconds for the given key.
+func (db *LazyDB) PTTL(key []byte) (int64, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return 0, err
+	}
 	db.strIndex.mu.RLock()
 	defer db.strIndex.mu.RUnlock()
 
@@ -431,13 +769,16 @@ func (db *LazyDB) TTL(key []byte) (int64, error) {
 	}
 	var ttl int64
 	if idxNode.expiredAt != 0 {
-		ttl = idxNode.expiredAt - time.Now().Unix()
+		ttl = idxNode.expiredAt - db.now().UnixMilli()
 	}
 	return ttl, nil
 }
 
 // Persist remove the expiration time for the given key.
 func (db *LazyDB) Persist(key []byte) error {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return err
+	}
 	db.strIndex.mu.RLock()
 	val, err := db.getValue(db.strIndex.idxTree, key, valueTypeString)
 	if err != nil {
@@ -445,7 +786,7 @@ func (db *LazyDB) Persist(key []byte) error {
 		return err
 	}
 	db.strIndex.mu.RUnlock()
-	return db.Set(key, val)
+	return db.setStr(key, val, WriteOptions{Persist: true})
 }
 
 // GetStrsKeys get all stored keys of type String.
@@ -455,7 +796,7 @@ func (db *LazyDB) GetStrsKeys() ([][]byte, error) {
 
 	var keys [][]byte
 	iter := db.strIndex.idxTree.Iterator()
-	ts := time.Now().Unix()
+	ts := db.now().UnixMilli()
 	for iter.HasNext() {
 		node, err := iter.Next()
 		if err != nil {
@@ -472,3 +813,110 @@ func (db *LazyDB) GetStrsKeys() ([][]byte, error) {
 	}
 	return keys, nil
 }
+
+// Touch updates the access counter of the given keys of type String without reading their values,
+// and returns the number of keys that exist. Missing or expired keys are ignored.
+// The access counter is only updated when DBConfig.TrackAccess is on.
+func (db *LazyDB) Touch(keys ...[]byte) (int, error) {
+	if err := db.checkAccess(OpRead, keys...); err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, ErrInvalidParam
+	}
+	var count int
+	var expiredKeys [][]byte
+	ts := db.now().UnixMilli()
+	db.strIndex.mu.RLock()
+	for _, key := range keys {
+		idxNode, _ := db.strIndex.idxTree.Get(key).(*Value)
+		if idxNode == nil {
+			continue
+		}
+		if idxNode.isExpired(ts) {
+			expiredKeys = append(expiredKeys, key)
+			continue
+		}
+		db.recordAccess(idxNode)
+		count++
+	}
+	db.strIndex.mu.RUnlock()
+
+	for _, key := range expiredKeys {
+		db.lazyExpireStr(key)
+	}
+	return count, nil
+}
+
+// recordAccess records an access of the key of type String, see IdleTime and HotKeys.
+func (db *LazyDB) recordAccess(idxNode *Value) {
+	atomic.StoreInt64(&idxNode.lastAccess, db.now().UnixNano())
+	if db.cfg.TrackAccess {
+		atomic.AddUint64(&idxNode.accessCount, 1)
+	}
+}
+
+// IdleTime returns how long it has been since the key of type String was last read or written,
+// it does not count as an access itself. Access time is not persisted, so keys not accessed since opening the db
+// are idle since their index was built. If the key does not exist or has expired the error ErrKeyNotFound is returned.
+func (db *LazyDB) IdleTime(key []byte) (time.Duration, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return 0, err
+	}
+	db.strIndex.mu.RLock()
+	defer db.strIndex.mu.RUnlock()
+
+	now := db.now()
+	idxNode, _ := db.strIndex.idxTree.Get(key).(*Value)
+	if idxNode == nil || idxNode.isExpired(now.UnixMilli()) {
+		return 0, ErrKeyNotFound
+	}
+	idle := now.Sub(time.Unix(0, atomic.LoadInt64(&idxNode.lastAccess)))
+	if idle < 0 {
+		idle = 0
+	}
+	return idle, nil
+}
+
+// HotKeys returns the top n most accessed keys of type String, the most accessed one comes first.
+// It only works when DBConfig.TrackAccess is on, and keys that have never been accessed are not returned.
+func (db *LazyDB) HotKeys(n int) [][]byte {
+	if n <= 0 || !db.cfg.TrackAccess {
+		return nil
+	}
+	db.strIndex.mu.RLock()
+	defer db.strIndex.mu.RUnlock()
+
+	type hotKey struct {
+		key   []byte
+		count uint64
+	}
+	var hotKeys []hotKey
+	iter := db.strIndex.idxTree.Iterator()
+	ts := db.now().UnixMilli()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil {
+			break
+		}
+		indexNode, _ := node.Value().(*Value)
+		if indexNode == nil || indexNode.isExpired(ts) {
+			continue
+		}
+		count := atomic.LoadUint64(&indexNode.accessCount)
+		if count == 0 {
+			continue
+		}
+		hotKeys = append(hotKeys, hotKey{key: node.Key(), count: count})
+	}
+	sort.SliceStable(hotKeys, func(i, j int) bool {
+		return hotKeys[i].count > hotKeys[j].count
+	})
+
+	n = util.Min(n, len(hotKeys))
+	keys := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		keys[i] = hotKeys[i].key
+	}
+	return keys
+}
@@ -0,0 +1,629 @@
+package lazydb
+
+import (
+	"github.com/billsjc123/LazyDB/logfile"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_PSetEX(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+
+	err := db.PSetEX([]byte("k1"), []byte("v1"), 500)
+	assert.Nil(t, err)
+
+	now = now.Add(400 * time.Millisecond)
+	got, err := db.Get([]byte("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), got)
+	ttl, err := db.PTTL([]byte("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), ttl)
+	ttl, err = db.TTL([]byte("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), ttl)
+
+	now = now.Add(200 * time.Millisecond)
+	_, err = db.Get([]byte("k1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestLazyDB_PExpire(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+
+	err := db.PExpire([]byte("not_exist"), 100)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.Nil(t, db.Set([]byte("k1"), []byte("v1")))
+	assert.Nil(t, db.PExpire([]byte("k1"), 1500))
+	ttl, err := db.PTTL([]byte("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1500), ttl)
+	ttl, err = db.TTL([]byte("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), ttl)
+
+	now = now.Add(1501 * time.Millisecond)
+	_, err = db.Get([]byte("k1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestLazyDB_InvalidExpire(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("k1")
+	assert.Nil(t, db.Set(key, []byte("v1")))
+	for _, d := range []int64{0, -1} {
+		assert.Equal(t, ErrInvalidExpire, db.SetEX(key, []byte("v2"), time.Duration(d)*time.Second))
+		assert.Equal(t, ErrInvalidExpire, db.PSetEX(key, []byte("v2"), d))
+		assert.Equal(t, ErrInvalidExpire, db.Expire(key, time.Duration(d)*time.Second))
+		assert.Equal(t, ErrInvalidExpire, db.PExpire(key, d))
+		assert.Equal(t, ErrInvalidExpire, db.PExpire([]byte("not_exist"), d))
+	}
+
+	// the key is left untouched
+	got, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), got)
+	ttl, err := db.PTTL(key)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), ttl)
+}
+
+func TestLazyDB_SecondExpiredAtCompat(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+
+	// entries written by older versions hold expiredAt in seconds
+	entry := &logfile.LogEntry{Key: []byte("k1"), Value: []byte("v1"), ExpiredAt: now.Add(10 * time.Second).Unix()}
+	pos, err := db.writeLogEntry(valueTypeString, entry)
+	assert.Nil(t, err)
+	assert.Nil(t, db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, pos, true))
+
+	got, err := db.Get([]byte("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), got)
+	ttl, err := db.TTL([]byte("k1"))
+	assert.Nil(t, err)
+	assert.InDelta(t, 10, ttl, 1)
+
+	now = now.Add(11 * time.Second)
+	_, err = db.Get([]byte("k1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestLazyDB_HotKeys(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_hot_keys")
+	cfg := DefaultDBConfig(path)
+	cfg.TrackAccess = true
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+	}
+	reads := map[int]int{0: 1, 1: 5, 2: 3}
+	for i, cnt := range reads {
+		for j := 0; j < cnt; j++ {
+			_, err := db.Get(GetKey(i))
+			assert.Nil(t, err)
+		}
+	}
+	// counter is kept after updating
+	assert.Nil(t, db.Set(GetKey(1), GetValue32()))
+
+	assert.Equal(t, [][]byte{GetKey(1), GetKey(2), GetKey(0)}, db.HotKeys(10))
+	assert.Equal(t, [][]byte{GetKey(1), GetKey(2)}, db.HotKeys(2))
+	assert.Nil(t, db.HotKeys(0))
+}
+
+func TestLazyDB_EmptyKeyValue(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	// empty key
+	assert.Nil(t, db.Set([]byte{}, []byte("v1")))
+	got, err := db.Get(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), got)
+
+	// empty value is distinct from missing key
+	assert.Nil(t, db.Set([]byte("k1"), []byte{}))
+	got, err = db.Get([]byte("k1"))
+	assert.Nil(t, err)
+	assert.NotNil(t, got)
+	assert.Equal(t, 0, len(got))
+
+	// both empty
+	assert.Nil(t, db.Set([]byte{}, []byte{}))
+	got, err = db.Get([]byte{})
+	assert.Nil(t, err)
+	assert.NotNil(t, got)
+	assert.Equal(t, 0, len(got))
+
+	assert.Nil(t, db.Delete([]byte{}))
+	_, err = db.Get([]byte{})
+	assert.Equal(t, ErrKeyNotFound, err)
+	got, err = db.Get([]byte("k1"))
+	assert.Nil(t, err)
+	assert.NotNil(t, got)
+}
+
+func TestLazyDB_Touch(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_touch")
+	cfg := DefaultDBConfig(path)
+	cfg.TrackAccess = true
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	assert.Nil(t, db.Set(GetKey(0), GetValue32()))
+	assert.Nil(t, db.Set(GetKey(1), GetValue32()))
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+	assert.Nil(t, db.SetEX(GetKey(2), GetValue32(), time.Second))
+	now = now.Add(2 * time.Second)
+
+	_, err = db.Touch()
+	assert.Equal(t, ErrInvalidParam, err)
+
+	count, err := db.Touch(GetKey(0), GetKey(1), GetKey(2), GetKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	count, err = db.Touch(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	node := db.strIndex.idxTree.Get(GetKey(1)).(*Value)
+	assert.Equal(t, uint64(2), node.accessCount)
+	assert.Equal(t, [][]byte{GetKey(1), GetKey(0)}, db.HotKeys(10))
+
+	// expired key is removed
+	assert.Nil(t, db.strIndex.idxTree.Get(GetKey(2)))
+}
+
+func TestLazyDB_SkipDuplicateWrites(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_skip_duplicate_writes")
+	cfg := DefaultDBConfig(path)
+	cfg.SkipDuplicateWrites = true
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	key, value := GetKey(1), GetValue32()
+	assert.Nil(t, db.Set(key, value))
+	lf := db.getActiveLogFile(valueTypeString).lf
+	offset := lf.Offset
+
+	// identical re-set writes nothing, even concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, db.Set(key, value))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, offset, lf.Offset)
+
+	// different value is written
+	value = GetValue32()
+	assert.Nil(t, db.Set(key, value))
+	assert.Greater(t, lf.Offset, offset)
+	got, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, value, got)
+
+	// time to live is discarded, so it is not a duplicate write
+	assert.Nil(t, db.SetEX(key, value, time.Hour))
+	offset = lf.Offset
+	assert.Nil(t, db.Set(key, value))
+	assert.Greater(t, lf.Offset, offset)
+	ttl, err := db.TTL(key)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), ttl)
+}
+
+func TestLazyDB_CompareAndSwap(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := GetKey(1)
+	// nil expected requires the key to be absent
+	swapped, err := db.CompareAndSwap(key, nil, []byte("0"))
+	assert.Nil(t, err)
+	assert.True(t, swapped)
+	swapped, err = db.CompareAndSwap(key, nil, []byte("1"))
+	assert.Nil(t, err)
+	assert.False(t, swapped)
+	swapped, err = db.CompareAndSwap(GetKey(2), []byte{}, []byte("1"))
+	assert.Nil(t, err)
+	assert.False(t, swapped)
+
+	// only one of the concurrent attempts succeeds
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var winners []int
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			swapped, err := db.CompareAndSwap(key, []byte("0"), []byte(strconv.Itoa(i)))
+			assert.Nil(t, err)
+			if swapped {
+				mu.Lock()
+				winners = append(winners, i)
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, len(winners))
+	got, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(strconv.Itoa(winners[0])), got)
+
+	// concurrent counter built on CompareAndSwap
+	counterKey := GetKey(3)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				val, err := db.Get(counterKey)
+				var cur int
+				if err == nil {
+					cur, _ = strconv.Atoi(string(val))
+				}
+				swapped, err := db.CompareAndSwap(counterKey, val, []byte(strconv.Itoa(cur+1)))
+				assert.Nil(t, err)
+				if swapped {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	got, err = db.Get(counterKey)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("10"), got)
+}
+
+func TestLazyDB_SetNX(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_set_nx"))
+	cfg.NXConflictError = true
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// exactly one of the concurrent attempts writes
+	key := GetKey(1)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var winners []int
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := db.SetNX(key, []byte(strconv.Itoa(i)))
+			if err == ErrKeyExists {
+				return
+			}
+			assert.Nil(t, err)
+			mu.Lock()
+			winners = append(winners, i)
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, len(winners))
+	got, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(strconv.Itoa(winners[0])), got)
+
+	// a key holding an empty value exists
+	assert.Nil(t, db.Set(GetKey(2), []byte{}))
+	assert.Equal(t, ErrKeyExists, db.SetNX(GetKey(2), []byte("v")))
+	assert.Equal(t, ErrKeyExists, db.MSetNX(GetKey(3), []byte("v"), GetKey(2), []byte("v")))
+	_, err = db.Get(GetKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.HSetNX([]byte("hash"), []byte("field"), []byte("v1")))
+	assert.Equal(t, ErrKeyExists, db.HSetNX([]byte("hash"), []byte("field"), []byte("v2")))
+	val, err := db.HGet([]byte("hash"), []byte("field"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+}
+
+func TestLazyDB_GetRaw(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+
+	key, value := GetKey(1), GetValue32()
+	assert.Nil(t, db.SetEX(key, value, time.Hour))
+	assert.Nil(t, db.Set(GetKey(2), GetValue32()))
+
+	raw, err := db.GetRaw(key)
+	assert.Nil(t, err)
+	entry, size, err := logfile.DecodeEntry(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, len(raw), size)
+	assert.Equal(t, key, entry.Key)
+	assert.Equal(t, value, entry.Value)
+	idxNode := db.strIndex.idxTree.Get(key).(*Value)
+	assert.Equal(t, idxNode.expiredAt, entry.ExpiredAt)
+	assert.Equal(t, int64(idxNode.entrySize), int64(size))
+
+	_, err = db.GetRaw(GetKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the check sum is verified
+	lf := db.getActiveLogFile(valueTypeString).lf
+	_, err = lf.IoController.Write([]byte{^raw[len(raw)-1]}, idxNode.offset+int64(len(raw)-1))
+	assert.Nil(t, err)
+	_, err = db.GetRaw(key)
+	assert.ErrorIs(t, err, ErrCorruptedEntry)
+	_, _, err = logfile.DecodeEntry(raw[:len(raw)-1])
+	assert.NotNil(t, err)
+}
+
+func TestLazyDB_GetWithTTL(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+
+	_, _, err := db.GetWithTTL(GetKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.Nil(t, db.Set(GetKey(1), []byte("v1")))
+	val, ttl, err := db.GetWithTTL(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	assert.Equal(t, int64(-1), ttl)
+
+	assert.Nil(t, db.SetEX(GetKey(2), []byte("v2"), 10*time.Second))
+	var last int64 = math.MaxInt64
+	for i := 0; i < 3; i++ {
+		val, ttl, err = db.GetWithTTL(GetKey(2))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v2"), val)
+		assert.Equal(t, int64(10-3*i), ttl)
+		assert.Less(t, ttl, last)
+		last = ttl
+		now = now.Add(3 * time.Second)
+	}
+
+	now = now.Add(2 * time.Second)
+	_, _, err = db.GetWithTTL(GetKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestLazyDB_GetWithTTL_ReadUnlocked(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	value := GetValue32()
+	assert.Nil(t, db.SetEX(GetKey(1), value, time.Hour))
+	reading, proceed := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	readLogEntryHook = func(typ valueType, fid uint32, offset int64) {
+		if typ == valueTypeString {
+			once.Do(func() {
+				close(reading)
+				<-proceed
+			})
+		}
+	}
+	defer func() {
+		readLogEntryHook = nil
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		val, ttl, err := db.GetWithTTL(GetKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+		assert.InDelta(t, 3600, ttl, 1)
+	}()
+	<-reading
+
+	// the log file is read without holding the index lock, so writes are not blocked by it
+	err := db.SetWithOptions(GetKey(2), GetValue32(), WriteOptions{Deadline: time.Now().Add(time.Second)})
+	assert.Nil(t, err)
+	close(proceed)
+	<-done
+}
+
+func TestLazyDB_IdleTime(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+
+	_, err := db.IdleTime(GetKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.Nil(t, db.Set(GetKey(1), GetValue32()))
+	idle, err := db.IdleTime(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), idle)
+
+	// grows while the key is not accessed
+	now = now.Add(3 * time.Second)
+	idle, err = db.IdleTime(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, 3*time.Second, idle)
+	now = now.Add(2 * time.Second)
+	idle, err = db.IdleTime(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, 5*time.Second, idle)
+
+	// resets on read
+	_, err = db.Get(GetKey(1))
+	assert.Nil(t, err)
+	idle, err = db.IdleTime(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), idle)
+
+	// resets on write
+	now = now.Add(time.Second)
+	assert.Nil(t, db.Set(GetKey(1), GetValue32()))
+	now = now.Add(time.Second)
+	idle, err = db.IdleTime(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Second, idle)
+
+	// expired keys
+	assert.Nil(t, db.SetEX(GetKey(2), GetValue32(), time.Second))
+	now = now.Add(2 * time.Second)
+	_, err = db.IdleTime(GetKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestLazyDB_GetInto(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	value := GetValue32()
+	assert.Nil(t, db.Set(GetKey(1), value))
+	assert.Nil(t, db.Set(GetKey(2), []byte{}))
+
+	got, err := db.GetInto(GetKey(1), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, value, got)
+
+	// dst is too small
+	dst := []byte("prefix")
+	got, err = db.GetInto(GetKey(1), dst)
+	assert.Nil(t, err)
+	assert.Equal(t, append([]byte("prefix"), value...), got)
+
+	// dst is reused
+	buf := make([]byte, 0, 128)
+	got, err = db.GetInto(GetKey(1), buf)
+	assert.Nil(t, err)
+	assert.Equal(t, value, got)
+	assert.Equal(t, &buf[:1][0], &got[0])
+
+	got, err = db.GetInto(GetKey(2), buf[:0])
+	assert.Nil(t, err)
+	assert.NotNil(t, got)
+	assert.Equal(t, 0, len(got))
+
+	_, err = db.GetInto(GetKey(3), buf)
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func BenchmarkLazyDB_Get(b *testing.B) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.Nil(b, db.Set(GetKey(1), GetValue(512)))
+	key := GetKey(1)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Get(key); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLazyDB_GetInto(b *testing.B) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.Nil(b, db.Set(GetKey(1), GetValue(512)))
+	key := GetKey(1)
+	buf := make([]byte, 0, 1024)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		val, err := db.GetInto(key, buf[:0])
+		if err != nil {
+			b.Fatal(err)
+		}
+		buf = val
+	}
+}
+
+func BenchmarkLazyDB_GetParallel(b *testing.B) {
+	db := initTestDB()
+	defer destroyDB(db)
+	const keys = 1000
+	for i := 0; i < keys; i++ {
+		assert.Nil(b, db.Set(GetKey(i), GetValue(512)))
+	}
+
+	// reads of log files do not block writes, nor the other way round
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := db.Set(GetKey(i%keys), GetValue(512)); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			if _, err := db.Get(GetKey(i % keys)); err != nil {
+				b.Error(err)
+				return
+			}
+			i++
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
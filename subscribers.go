@@ -0,0 +1,56 @@
+package lazydb
+
+import "sync"
+
+// subscribers fans out events to subscribed channels, see SubscribeExpiry and SubscribeEviction.
+type subscribers[T any] struct {
+	mu   sync.RWMutex
+	next int
+	subs map[int]chan T
+}
+
+func newSubscribers[T any]() *subscribers[T] {
+	return &subscribers[T]{subs: make(map[int]chan T)}
+}
+
+// subscribe returns a channel of buffer size receiving events, and the function to unsubscribe,
+// which closes the channel.
+func (s *subscribers[T]) subscribe(size int) (<-chan T, func()) {
+	ch := make(chan T, size)
+
+	s.mu.Lock()
+	id := s.next
+	s.next++
+	s.subs[id] = ch
+	s.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			s.mu.Lock()
+			delete(s.subs, id)
+			s.mu.Unlock()
+			close(ch)
+		})
+	}
+	return ch, cancel
+}
+
+// publish sends an event created by newEvent to every subscriber, so that each of them owns its event.
+// The event is dropped for subscribers whose channel buffer is full, and the number of them is returned.
+func (s *subscribers[T]) publish(newEvent func() T) int {
+	if s == nil {
+		return 0
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var dropped int
+	for _, ch := range s.subs {
+		select {
+		case ch <- newEvent():
+		default:
+			dropped++
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,78 @@
+package lazydb
+
+import (
+	"github.com/billsjc123/LazyDB/logfile"
+	"io"
+	"sort"
+	"sync/atomic"
+)
+
+// Fid returns the fid of the log file where the entry is.
+func (vp ValuePos) Fid() uint32 {
+	return vp.fid
+}
+
+// Offset returns the offset of the entry in its log file.
+func (vp ValuePos) Offset() int64 {
+	return vp.offset
+}
+
+// EntrySize returns the size of the entry in its log file, including padding.
+func (vp ValuePos) EntrySize() int {
+	return vp.entrySize
+}
+
+// Tail calls fn with entries of log files of the type in the order they were written, starting from
+// the entry at fromOffset of log file fromFid, so that log files can be consumed as a change stream,
+// e.g. for replication or audit logs. Tombstones and entries overwritten later are included.
+// It stops once fn returns false or all entries written so far are read, the stream can be resumed from
+// pos.Fid() and pos.Offset()+pos.EntrySize() of the last entry, it moves to the next log file if the offset is
+// at the end of a log file. Log files removed by merge are skipped, so a slow consumer may miss entries.
+// The entry passed to fn must not be modified.
+func (db *LazyDB) Tail(typ valueType, fromFid uint32, fromOffset int64, fn func(entry *logfile.LogEntry, pos ValuePos) bool) error {
+	mutexFids := db.fidsMap[typ]
+	if mutexFids == nil {
+		return ErrTypeNotRegistered
+	}
+	mutexFids.mu.RLock()
+	fids := make([]uint32, len(mutexFids.fids))
+	copy(fids, mutexFids.fids)
+	mutexFids.mu.RUnlock()
+	sort.Slice(fids, func(i, j int) bool { return fids[i] < fids[j] })
+
+	for _, fid := range fids {
+		if fid < fromFid {
+			continue
+		}
+		lf := db.getLogFile(typ, fid)
+		if lf == nil {
+			continue
+		}
+		var offset int64
+		if fid == fromFid {
+			offset = fromOffset
+		}
+		// read up to the end of written entries, which moves on for the active log file
+		for offset < atomic.LoadInt64(&lf.Offset) {
+			if err := db.pinLogFile(typ, lf); err != nil {
+				return err
+			}
+			entry, entSize, err := lf.ReadLogEntry(offset)
+			lf.Mu.RUnlock()
+			if err == io.EOF || err == logfile.ErrLogEndOfFile {
+				break
+			}
+			if err == logfile.ErrInvalidCrc {
+				return corruptedEntryError(fid, offset)
+			}
+			if err != nil {
+				return err
+			}
+			if !fn(entry, ValuePos{fid: fid, offset: offset, entrySize: entSize}) {
+				return nil
+			}
+			offset += int64(entSize)
+		}
+	}
+	return nil
+}
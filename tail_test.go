@@ -0,0 +1,69 @@
+package lazydb
+
+import (
+	"github.com/billsjc123/LazyDB/logfile"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_Tail(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_tail")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 150 //  set max file so that it can only contain 2 entry in a file
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	var keys [][]byte
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+		keys = append(keys, GetKey(i))
+	}
+	assert.Nil(t, db.Delete(GetKey(0)))
+	keys = append(keys, GetKey(0))
+	assert.Greater(t, len(db.fidsMap[valueTypeString].fids), 2)
+
+	var got [][]byte
+	var positions []ValuePos
+	collect := func(entry *logfile.LogEntry, pos ValuePos) bool {
+		got = append(got, entry.Key)
+		positions = append(positions, pos)
+		return true
+	}
+	assert.Nil(t, db.Tail(valueTypeString, 0, 0, collect))
+	assert.Equal(t, keys, got)
+	for i := 1; i < len(positions); i++ {
+		prev, cur := positions[i-1], positions[i]
+		if cur.Fid() == prev.Fid() {
+			assert.Equal(t, prev.Offset()+int64(prev.EntrySize()), cur.Offset())
+		} else {
+			// crossed into the next log file
+			assert.Greater(t, cur.Fid(), prev.Fid())
+			assert.Equal(t, int64(0), cur.Offset())
+		}
+	}
+	assert.Equal(t, positions[len(positions)-1].Fid(), db.getActiveLogFile(valueTypeString).lf.Fid)
+
+	// stops once fn returns false
+	var n int
+	assert.Nil(t, db.Tail(valueTypeString, 0, 0, func(entry *logfile.LogEntry, pos ValuePos) bool {
+		n++
+		return n < 3
+	}))
+	assert.Equal(t, 3, n)
+
+	// resumes from the end of an entry at the end of a log file, and sees new entries
+	last := positions[1]
+	assert.NotEqual(t, last.Fid(), positions[2].Fid())
+	assert.Nil(t, db.Set(GetKey(5), GetValue32()))
+	keys = append(keys, GetKey(5))
+	got = nil
+	assert.Nil(t, db.Tail(valueTypeString, last.Fid(), last.Offset()+int64(last.EntrySize()), collect))
+	assert.Equal(t, keys[2:], got)
+}
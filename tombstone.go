@@ -0,0 +1,54 @@
+package lazydb
+
+import (
+	"github.com/billsjc123/LazyDB/logfile"
+)
+
+// keepTombstone returns whether the delete entry at offset of log file fid must survive a merge,
+// see DBConfig.TombstoneGracePeriod.
+func (db *LazyDB) keepTombstone(typ valueType, fid uint32, offset int64, ent *logfile.LogEntry) bool {
+	grace := db.cfg.TombstoneGracePeriod
+	if grace <= 0 {
+		return false
+	}
+	if ent.WrittenAt != 0 && db.now().UnixMilli()-ent.WrittenAt < grace.Milliseconds() {
+		return true
+	}
+	if !db.replicated(typ) {
+		return false
+	}
+	db.replica.mu.Lock()
+	defer db.replica.mu.Unlock()
+	return db.replica.ackedFollowers(map[valueType]ValuePos{typ: {fid: fid, offset: offset}}) < len(db.replica.acks)
+}
+
+// rewriteTombstone rewrites the delete entry kept by keepTombstone by write function.
+// Index lock of the type must be held by the caller.
+func (db *LazyDB) rewriteTombstone(typ valueType, ent *logfile.LogEntry,
+	write func(ent *logfile.LogEntry) (*ValuePos, error)) error {
+
+	// the key has been written again, and the rewritten delete entry would delete it when indexes are built
+	if idxTree, idxKey := db.locateIndex(typ, ent); idxTree != nil && idxTree.Get(idxKey) != nil {
+		return nil
+	}
+	vPos, err := write(ent)
+	if err != nil {
+		return err
+	}
+	// like the original one, the delete entry can be merged once it is old enough
+	return db.sendDiscard(&Value{fid: vPos.fid, entrySize: vPos.entrySize}, true, typ)
+}
+
+// hasOlderLogFile returns whether any log file of the type older than fid still exists, whose entries a delete
+// entry of fid may shadow when indexes are built.
+func (db *LazyDB) hasOlderLogFile(typ valueType, fid uint32) bool {
+	fids := db.fidsMap[typ]
+	fids.mu.RLock()
+	defer fids.mu.RUnlock()
+	for _, f := range fids.fids {
+		if f < fid && db.getArchivedLogFile(typ, f) != nil {
+			return true
+		}
+	}
+	return false
+}
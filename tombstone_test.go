@@ -0,0 +1,107 @@
+package lazydb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_TombstoneGracePeriod(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_tombstone_grace"))
+	cfg.MaxLogFileSize = 150
+	cfg.TombstoneGracePeriod = time.Hour
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+
+	typ := valueTypeString
+	// tombstones returns fids of log files holding delete entries of key
+	tombstones := func(key []byte) []uint32 {
+		var fids []uint32
+		assert.Nil(t, db.Tail(typ, 0, 0, func(entry *logfile.LogEntry, pos ValuePos) bool {
+			if entry.Stat == logfile.SDelete && bytes.Equal(entry.Key, key) {
+				fids = append(fids, pos.Fid())
+			}
+			return true
+		}))
+		return fids
+	}
+	// rotate archives the active log file
+	rotate := func() {
+		fid := db.getActiveLogFile(typ).lf.Fid
+		for i := 0; db.getActiveLogFile(typ).lf.Fid == fid; i++ {
+			assert.Nil(t, db.Set(GetKey(i%2), GetValue32()))
+		}
+	}
+	merge := func(fid uint32) {
+		assert.Eventually(t, func() bool {
+			ccl, err := db.discardsMap[typ].getCCL(db.getActiveLogFile(typ).lf.Fid, 0)
+			if err != nil {
+				return false
+			}
+			for _, f := range ccl {
+				if f == fid {
+					return true
+				}
+			}
+			return false
+		}, time.Second, 10*time.Millisecond)
+		assert.Nil(t, db.Merge(typ, fid, 0))
+		assert.Nil(t, db.getArchivedLogFile(typ, fid))
+	}
+
+	key := []byte("deleted")
+	assert.Nil(t, db.Set(key, GetValue32()))
+	assert.Nil(t, db.Delete(key))
+	fids := tombstones(key)
+	assert.Len(t, fids, 1)
+	rotate()
+	merge(fids[0])
+
+	// a fresh tombstone survives the merge
+	merged := tombstones(key)
+	assert.Len(t, merged, 1)
+	assert.NotEqual(t, fids[0], merged[0])
+
+	// a follower lagging behind has not read it yet after the grace period
+	db.AckReplica("follower", typ, ValuePos{fid: db.startFid()})
+	now = now.Add(2 * time.Hour)
+	rotate()
+	merge(merged[0])
+	merged = tombstones(key)
+	assert.Len(t, merged, 1)
+
+	// dropped once the follower catches up
+	rotate()
+	db.AckReplica("follower", typ, db.getActiveLogFile(typ).last)
+	merge(merged[0])
+	assert.Empty(t, tombstones(key))
+
+	// the tombstone of a key written again is obsolete
+	rewritten := []byte("rewritten")
+	assert.Nil(t, db.Set(rewritten, GetValue32()))
+	assert.Nil(t, db.Delete(rewritten))
+	assert.Nil(t, db.Set(rewritten, []byte("again")))
+	fids = tombstones(rewritten)
+	assert.Len(t, fids, 1)
+	rotate()
+	merge(fids[0])
+	assert.Empty(t, tombstones(rewritten))
+
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	_, err = db.Get(key)
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db.Get(rewritten)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("again"), val)
+}
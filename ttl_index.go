@@ -0,0 +1,68 @@
+package lazydb
+
+import (
+	"encoding/binary"
+)
+
+// ttlIndexKey is the key of ttlTree of strIndex: expiredAt in big endian | key,
+// so that keys are ordered by expiredAt, and then by key.
+func ttlIndexKey(expiredAt int64, key []byte) []byte {
+	buf := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(buf, uint64(expiredAt))
+	copy(buf[8:], key)
+	return buf
+}
+
+// replaceStrValue keeps ttlTree of strIndex and db.index consistent once the index value of key of type String
+// is replaced by newVal, or removed if newVal is nil. Lock of strIndex must be held by the caller.
+func (db *LazyDB) replaceStrValue(key []byte, oldVal any, newVal *Value) {
+	db.updateTTLIndex(key, oldVal, newVal)
+	if newVal != nil {
+		db.indexKey(valueTypeString, key, newVal)
+	} else {
+		db.unindexKey(valueTypeString, key)
+	}
+}
+
+// updateTTLIndex keeps ttlTree of strIndex consistent once the index value of key of type String is replaced
+// from oldVal to newVal, oldVal is the one returned by Put or Delete of idxTree, and newVal is nil if key is deleted.
+// Lock of strIndex must be held by the caller.
+func (db *LazyDB) updateTTLIndex(key []byte, oldVal any, newVal *Value) {
+	if old, _ := oldVal.(*Value); old != nil && old.expiredAt != 0 {
+		if newVal != nil && newVal.expiredAt == old.expiredAt {
+			return
+		}
+		db.strIndex.ttlTree.Delete(ttlIndexKey(old.expiredAt, key))
+	}
+	if newVal != nil && newVal.expiredAt != 0 {
+		db.strIndex.ttlTree.Put(ttlIndexKey(newVal.expiredAt, key), append([]byte(nil), key...))
+	}
+}
+
+// ascendTTL calls fn with keys of type String with time to live in order of expiredAt, the soonest to expire first,
+// until fn returns false. It walks the keys with time to live only, rather than all keys.
+// Lock of strIndex must be held by the caller, and fn must not modify the index.
+func (db *LazyDB) ascendTTL(fn func(key []byte, expiredAt int64) bool) {
+	iter := db.strIndex.ttlTree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil {
+			return
+		}
+		key, _ := node.Value().([]byte)
+		if !fn(key, int64(binary.BigEndian.Uint64(node.Key()))) {
+			return
+		}
+	}
+}
+
+// soonestExpiring returns the key of type String which expires the soonest, nil if no key has time to live.
+// Lock of strIndex must be held by the caller.
+func (db *LazyDB) soonestExpiring() []byte {
+	var soonest []byte
+	db.ascendTTL(func(key []byte, _ int64) bool {
+		soonest = key
+		return false
+	})
+	return soonest
+}
@@ -0,0 +1,67 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_TTLIndex(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_ttl_index")
+	cfg := DefaultDBConfig(path)
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+	soonest := func() []byte {
+		db.strIndex.mu.RLock()
+		defer db.strIndex.mu.RUnlock()
+		return db.soonestExpiring()
+	}
+	ttlKeys := func() int {
+		db.strIndex.mu.RLock()
+		defer db.strIndex.mu.RUnlock()
+		return db.strIndex.ttlTree.Size()
+	}
+
+	assert.Nil(t, soonest())
+	assert.Nil(t, db.SetEX([]byte("a"), GetValue32(), 10*time.Second))
+	assert.Nil(t, db.SetEX([]byte("b"), GetValue32(), 5*time.Second))
+	assert.Nil(t, db.SetEX([]byte("c"), GetValue32(), 20*time.Second))
+	assert.Nil(t, db.Set([]byte("d"), GetValue32()))
+	assert.Equal(t, []byte("b"), soonest())
+	assert.Equal(t, 3, ttlKeys())
+
+	// updated once the time to live changes
+	assert.Nil(t, db.Expire([]byte("b"), 30*time.Second))
+	assert.Equal(t, []byte("a"), soonest())
+	assert.Nil(t, db.Persist([]byte("a")))
+	assert.Equal(t, []byte("c"), soonest())
+	assert.Nil(t, db.Delete([]byte("c")))
+	assert.Equal(t, []byte("b"), soonest())
+	assert.Nil(t, db.Expire([]byte("d"), time.Second))
+	assert.Equal(t, []byte("d"), soonest())
+	assert.Nil(t, db.Set([]byte("d"), GetValue32()))
+	assert.Equal(t, []byte("b"), soonest())
+	assert.Equal(t, 1, ttlKeys())
+
+	// rebuilt on recovery
+	assert.Nil(t, db.PSetEX([]byte("e"), GetValue32(), 1))
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("e"), soonest())
+	assert.Equal(t, 2, ttlKeys())
+
+	// removed by active expire without walking all keys
+	time.Sleep(5 * time.Millisecond)
+	assert.Nil(t, db.activeExpire())
+	assert.Equal(t, []byte("b"), soonest())
+	_, err = db.Get([]byte("e"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
@@ -3,8 +3,9 @@ package lazydb
 import (
 	"errors"
 	"github.com/billsjc123/LazyDB/logfile"
+	"log"
 	"math/rand"
-	"sync"
+	"runtime"
 
 	"github.com/bwmarrin/snowflake"
 )
@@ -32,18 +33,41 @@ type pSet struct {
 	mem []byte
 }
 
+// pList an element pushed into a list by a transaction.
+type pList struct {
+	key    []byte
+	value  []byte
+	isLeft bool
+}
+
 type Tx struct {
-	id          uint64
-	db          *LazyDB
-	tType       TxType
-	status      TxStatus
+	id     uint64
+	db     *LazyDB
+	tType  TxType
+	status TxStatus
+	*txWrites
+	meta  *txMeta           // see ActiveTransactions
+	files []logFileCacheKey // log files holding written entries, recorded by the commit marker
+}
+
+// txWrites buffers writes of a transaction until it is committed.
+// It is shared with the registry, so that a transaction rolled back by the reaper frees it, see DBConfig.TxTimeout.
+type txWrites struct {
 	pendingStr  []*logfile.LogEntry
-	pendingList []*logfile.LogEntry
+	pendingList []*pList
 	pendingSet  []*pSet
 	pendingHash []*logfile.LogEntry
 	pendingZSet []*logfile.LogEntry
 }
 
+func (w *txWrites) reset() {
+	w.pendingStr = nil
+	w.pendingSet = nil
+	w.pendingList = nil
+	w.pendingZSet = nil
+	w.pendingHash = nil
+}
+
 func generateTxID() (uint64, error) {
 	nodeID := rand.Int63() % 1023
 	node, err := snowflake.NewNode(nodeID)
@@ -62,15 +86,17 @@ func newTx(db *LazyDB, txType TxType) (*Tx, error) {
 	}
 
 	tx := &Tx{
-		id:          txID,
-		db:          db,
-		tType:       txType,
-		status:      pending,
-		pendingStr:  []*logfile.LogEntry{},
-		pendingList: []*logfile.LogEntry{},
-		pendingHash: []*logfile.LogEntry{},
-		pendingSet:  []*pSet{},
-		pendingZSet: []*logfile.LogEntry{},
+		id:     txID,
+		db:     db,
+		tType:  txType,
+		status: pending,
+		txWrites: &txWrites{
+			pendingStr:  []*logfile.LogEntry{},
+			pendingList: []*pList{},
+			pendingHash: []*logfile.LogEntry{},
+			pendingSet:  []*pSet{},
+			pendingZSet: []*logfile.LogEntry{},
+		},
 	}
 
 	return tx, nil
@@ -92,8 +118,10 @@ func (tx *Tx) unlock() {
 	}
 }
 
+// IsClosed returns whether the transaction has been committed or rolled back,
+// including rolled back by the reaper, see DBConfig.TxTimeout.
 func (tx *Tx) IsClosed() bool {
-	return tx.db == nil
+	return tx.db == nil || (tx.meta != nil && tx.meta.closed())
 }
 
 func (db *LazyDB) Begin(txType TxType) (*Tx, error) {
@@ -107,6 +135,7 @@ func (db *LazyDB) Begin(txType TxType) (*Tx, error) {
 		return nil, ErrDatabaseClosed
 	}
 	tx.lock()
+	db.registerTx(tx)
 
 	return tx, nil
 }
@@ -124,19 +153,45 @@ func (tx *Tx) Rollback() error {
 		return ErrTxCommittingRollback
 	}
 
-	tx.unlock()
+	runtime.SetFinalizer(tx, nil)
+	// the lock of db is released by abortTx, unless the transaction is being committed concurrently or has been reaped
+	if err := tx.db.abortTx(tx.meta); err != nil {
+		return err
+	}
 
 	tx.db = nil
-	tx.pendingStr = nil
-	tx.pendingSet = nil
-	tx.pendingList = nil
-	tx.pendingZSet = nil
-	tx.pendingHash = nil
 	tx.status = pending
 
 	return nil
 }
 
+// checkAccess checks keys of buffered writes by DBConfig.AccessControl before they are committed.
+func (tx *Tx) checkAccess() error {
+	if err := tx.db.checkEntriesAccess(OpWrite, tx.pendingStr); err != nil {
+		return err
+	}
+	for _, pl := range tx.pendingList {
+		if err := tx.db.checkAccess(OpWrite, pl.key); err != nil {
+			return err
+		}
+	}
+	for _, entries := range [][]*logfile.LogEntry{tx.pendingHash, tx.pendingZSet} {
+		for _, e := range entries {
+			key, _ := tx.db.decodeKey(e.Key)
+			if err := tx.db.checkAccess(OpWrite, key); err != nil {
+				return err
+			}
+		}
+	}
+	for _, ps := range tx.pendingSet {
+		if err := tx.db.checkAccess(OpWrite, ps.e.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit commits buffered writes of all types atomically, see Exec.
 func (tx *Tx) Commit() error {
 	if tx.IsClosed() {
 		return ErrTxClosed
@@ -146,76 +201,138 @@ func (tx *Tx) Commit() error {
 		return ErrDatabaseClosed
 	}
 
+	if tx.db.readOnly() {
+		return ErrReadOnly
+	}
+
 	if tx.status == committing {
 		return nil
 	}
+	if err := tx.checkAccess(); err != nil {
+		return err
+	}
+	// the reaper leaves a committing transaction alone
+	if err := tx.meta.beginCommit(); err != nil {
+		return err
+	}
 
-	wg := sync.WaitGroup{}
-	wg.Add(5)
-
-	go func() {
-		defer wg.Done()
-		for _, e := range tx.pendingStr {
-			e.TxStat = logfile.TxCommited
-			valuePos, _ := tx.db.writeLogEntry(valueTypeString, e)
-			tx.db.updateIndexTree(valueTypeString, tx.db.strIndex.idxTree, e, valuePos, true)
-		}
-	}()
-
-	go func() {
-		defer wg.Done()
-		for _, e := range tx.pendingList {
-			e.TxStat = logfile.TxCommited
-			valuePos, _ := tx.db.writeLogEntry(valueTypeList, e)
-			tx.db.updateIndexTree(valueTypeList, tx.db.strIndex.idxTree, e, valuePos, true)
-		}
-	}()
-
-	go func() {
-		defer wg.Done()
-		for _, e := range tx.pendingHash {
-			e.TxStat = logfile.TxCommited
-			valuePos, _ := tx.db.writeLogEntry(valueTypeHash, e)
-			tx.db.updateIndexTree(valueTypeHash, tx.db.strIndex.idxTree, e, valuePos, true)
-		}
-	}()
-
-	go func() {
-		defer wg.Done()
-		for _, ps := range tx.pendingSet {
-			ps.e.TxStat = logfile.TxCommited
-			valuePos, _ := tx.db.writeLogEntry(valueTypeSet, ps.e)
+	db := tx.db
+	types := tx.writtenTypes()
+	// conditional writes like SetNX check and write under index locks rather than the lock of db
+	unlock := db.lockIndexes(types...)
+	applies, err := tx.write()
+	// the lock of db is released while the commit is made durable, so that transactions of other types can be
+	// committed and share fsyncs with it, indexes of written types stay locked until they are updated
+	db.endCommit(tx)
+	tx.unlock()
+	if err == nil && len(applies) > 0 {
+		err = tx.commit(types, applies)
+	}
+	unlock()
 
-			entry := &logfile.LogEntry{Key: ps.sum, Value: ps.mem}
-			_, size := logfile.EncodeEntry(ps.e)
-			valuePos.entrySize = size
+	tx.db = nil
+	tx.reset()
+	tx.status = pending
+	return err
+}
 
-			idxTree := tx.db.setIndex.trees[string(ps.e.Key)]
-			tx.db.updateIndexTree(valueTypeSet, idxTree, entry, valuePos, false)
+// Exec is the EXEC of MULTI/EXEC, it commits buffered writes of all types atomically.
+// Entries are written in order of String, List, Hash, Set and ZSet as uncommitted ones of the transaction,
+// then they are synced, the commit marker of the transaction is appended and synced, and indexes are updated
+// only after that. Recovery discards entries of transactions without markers, so a transaction interrupted by a crash
+// is either applied entirely or not at all, and writes of a transaction are never visible before it is durable.
+// If writing fails, indexes are left untouched. Commits of other types made durable at the same time share fsyncs
+// within DBConfig.CommitSyncWindow.
+func (tx *Tx) Exec() error {
+	return tx.Commit()
+}
 
+// beforeTxCommitHook is called before the commit marker of a transaction is appended, for testing.
+// The commit fails with its error as if the marker could not be written.
+var beforeTxCommitHook func() error
+
+// write writes buffered entries as uncommitted ones, and returns functions updating indexes by them.
+// Index locks of written types must be held by the caller.
+func (tx *Tx) write() ([]func() error, error) {
+	var applies []func() error
+	for _, write := range []func() (func() error, error){
+		tx.writeStr, tx.writeList, tx.writeHash, tx.writeSet, tx.writeZSet,
+	} {
+		apply, err := write()
+		if err != nil {
+			return nil, err
 		}
-	}()
-
-	go func() {
-		defer wg.Done()
-		for _, e := range tx.pendingZSet {
-			e.TxStat = logfile.TxCommited
-			valuePos, _ := tx.db.writeLogEntry(valueTypeZSet, e)
-			tx.db.updateIndexTree(valueTypeZSet, tx.db.strIndex.idxTree, e, valuePos, true)
+		if apply != nil {
+			applies = append(applies, apply)
 		}
-	}()
-
-	wg.Wait()
+	}
+	return applies, nil
+}
 
-	tx.unlock()
+// commit syncs entries written by write, then appends and syncs the commit marker, and updates indexes by applies
+// only after that. Index locks of written types must be held by the caller.
+func (tx *Tx) commit(types []valueType, applies []func() error) error {
+	db := tx.db
+	if err := db.syncCommit(types); err != nil {
+		return err
+	}
+	if beforeTxCommitHook != nil {
+		if err := beforeTxCommitHook(); err != nil {
+			return err
+		}
+	}
+	if err := db.txCommits.commit(tx.id, tx.files); err != nil {
+		return err
+	}
+	if err := db.txCommits.sync(); err != nil {
+		return err
+	}
+	for _, apply := range applies {
+		if err := apply(); err != nil {
+			return err
+		}
+	}
+	if err := db.compactTxCommits(false); err != nil {
+		log.Printf("compact transaction commits err: %v", err)
+	}
+	return nil
+}
 
-	tx.db = nil
-	tx.pendingStr = nil
-	tx.pendingSet = nil
-	tx.pendingList = nil
-	tx.pendingZSet = nil
-	tx.pendingHash = nil
-	tx.status = pending
+// writeEntry writes an entry of the transaction, it is uncommitted until the commit marker is appended.
+func (tx *Tx) writeEntry(typ valueType, e *logfile.LogEntry) (*ValuePos, error) {
+	e.TxID = tx.id
+	e.TxStat = logfile.TxUncommited
+	valuePos, err := tx.db.writeLogEntry(typ, e)
+	if err != nil {
+		return nil, err
+	}
+	file := logFileCacheKey{typ: typ, fid: valuePos.fid}
+	for _, f := range tx.files {
+		if f == file {
+			return valuePos, nil
+		}
+	}
+	tx.files = append(tx.files, file)
+	return valuePos, nil
+}
 
-	return nil
+// writtenTypes returns types of buffered writes.
+func (w *txWrites) writtenTypes() []valueType {
+	var types []valueType
+	if len(w.pendingStr) > 0 {
+		types = append(types, valueTypeString)
+	}
+	if len(w.pendingList) > 0 {
+		types = append(types, valueTypeList)
+	}
+	if len(w.pendingHash) > 0 {
+		types = append(types, valueTypeHash)
+	}
+	if len(w.pendingSet) > 0 {
+		types = append(types, valueTypeSet)
+	}
+	if len(w.pendingZSet) > 0 {
+		types = append(types, valueTypeZSet)
+	}
+	return types
 }
@@ -0,0 +1,246 @@
+package lazydb
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/billsjc123/LazyDB/logfile"
+)
+
+// txCommitFileName the file of commit markers of transactions, see Tx.Exec.
+const txCommitFileName = "TXCOMMIT"
+
+// txCommitCompactMin the number of markers from which TXCOMMIT is compacted, see compactTxCommits.
+const txCommitCompactMin = 1024
+
+// txCommitLog commit markers of transactions. Entries of a transaction are written as uncommitted along with its id,
+// and its marker is appended once all of them are written. Entries of transactions without markers are discarded
+// on recovery, so that a transaction interrupted by a crash is applied either entirely or not at all.
+//
+// A marker records the log files holding entries of the transaction. Merge and compaction rewrite committed entries
+// of transactions as plain committed ones, so a marker is no longer needed once all its log files are removed,
+// and such markers are dropped by compactTxCommits.
+type txCommitLog struct {
+	mu        sync.RWMutex
+	file      *os.File // nil if db is read-only
+	committed map[uint64][]logFileCacheKey
+	compacted int // number of markers after the last compaction
+}
+
+// encodeTxCommit encodes the marker of a transaction whose entries are in files:
+// TxID | number of files | (type | fid) of each file | crc32 of all before.
+func encodeTxCommit(txID uint64, files []logFileCacheKey) []byte {
+	rec := make([]byte, 8+2+len(files)*5+4)
+	binary.LittleEndian.PutUint64(rec[:8], txID)
+	binary.LittleEndian.PutUint16(rec[8:10], uint16(len(files)))
+	off := 10
+	for _, f := range files {
+		rec[off] = byte(f.typ)
+		binary.LittleEndian.PutUint32(rec[off+1:off+5], f.fid)
+		off += 5
+	}
+	binary.LittleEndian.PutUint32(rec[off:], crc32.ChecksumIEEE(rec[:off]))
+	return rec
+}
+
+// decodeTxCommit decodes the marker at the start of data, and returns its size, 0 if it is torn or corrupted.
+func decodeTxCommit(data []byte) (uint64, []logFileCacheKey, int) {
+	if len(data) < 10 {
+		return 0, nil, 0
+	}
+	n := int(binary.LittleEndian.Uint16(data[8:10]))
+	off := 10 + n*5
+	if len(data) < off+4 || crc32.ChecksumIEEE(data[:off]) != binary.LittleEndian.Uint32(data[off:off+4]) {
+		return 0, nil, 0
+	}
+	files := make([]logFileCacheKey, n)
+	for i := range files {
+		rec := data[10+i*5:]
+		files[i] = logFileCacheKey{typ: valueType(rec[0]), fid: binary.LittleEndian.Uint32(rec[1:5])}
+	}
+	return binary.LittleEndian.Uint64(data[:8]), files, off + 4
+}
+
+// loadTxCommits reads commit markers of transactions, a torn record at the end left by a crash is truncated.
+func (db *LazyDB) loadTxCommits() error {
+	if db.readOnly() {
+		data, err := fs.ReadFile(db.fsys, txCommitFileName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		db.txCommits.parse(data)
+		return nil
+	}
+
+	file, err := os.OpenFile(filepath.Join(db.cfg.DBPath, txCommitFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	size := db.txCommits.parse(data)
+	if size < len(data) {
+		if err = file.Truncate(int64(size)); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if _, err = file.Seek(int64(size), io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	db.txCommits.file = file
+	return nil
+}
+
+// parse adds transactions of records in data as committed, and returns the size of valid records.
+func (l *txCommitLog) parse(data []byte) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.committed == nil {
+		l.committed = make(map[uint64][]logFileCacheKey)
+	}
+	var size int
+	for size < len(data) {
+		txID, files, n := decodeTxCommit(data[size:])
+		if n == 0 {
+			break
+		}
+		l.committed[txID] = files
+		size += n
+	}
+	l.compacted = len(l.committed)
+	return size
+}
+
+// commit appends the marker of the transaction whose entries are in files, it is synced by sync.
+func (l *txCommitLog) commit(txID uint64, files []logFileCacheKey) error {
+	rec := encodeTxCommit(txID, files)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(rec); err != nil {
+		return err
+	}
+	l.committed[txID] = files
+	return nil
+}
+
+// compactTxCommits rewrites TXCOMMIT with markers whose log files still exist, once the number of markers has
+// doubled since the last compaction, or force is set. So that neither the file nor the markers in memory grow with
+// every transaction for the life of the db. The rewritten file replaces TXCOMMIT by a rename, so that a crash leaves
+// either of them.
+func (db *LazyDB) compactTxCommits(force bool) error {
+	l := &db.txCommits
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil || (!force && (len(l.committed) < txCommitCompactMin || len(l.committed) < 2*l.compacted)) {
+		return nil
+	}
+
+	exists := make(map[logFileCacheKey]bool)
+	fileExists := func(f logFileCacheKey) bool {
+		ok, checked := exists[f]
+		if !checked {
+			// files removed from memory are kept on disk until in-flight reads release them
+			name, _ := logfile.FileName(logfile.FType(f.typ), f.fid)
+			_, err := os.Stat(filepath.Join(db.cfg.DBPath, name))
+			ok = err == nil
+			exists[f] = ok
+		}
+		return ok
+	}
+	var buf []byte
+	committed := make(map[uint64][]logFileCacheKey)
+	for txID, files := range l.committed {
+		for _, f := range files {
+			if fileExists(f) {
+				committed[txID] = files
+				buf = append(buf, encodeTxCommit(txID, files)...)
+				break
+			}
+		}
+	}
+
+	if len(committed) == len(l.committed) {
+		l.compacted = len(committed)
+		return nil
+	}
+
+	path := filepath.Join(db.cfg.DBPath, txCommitFileName)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf, 0644); err != nil {
+		return err
+	}
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		tmp.Close()
+		return err
+	}
+	if !db.cfg.NoSyncDir {
+		if err = syncDir(db.cfg.DBPath); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if _, err = tmp.Seek(0, io.SeekEnd); err != nil {
+		tmp.Close()
+		return err
+	}
+	_ = l.file.Close()
+	l.file = tmp
+	l.committed = committed
+	l.compacted = len(committed)
+	return nil
+}
+
+func (l *txCommitLog) sync() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Sync()
+}
+
+func (l *txCommitLog) close() error {
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// commitRewritten marks an entry of a committed transaction rewritten by merge or compaction as a plain committed
+// one, so that the marker of the transaction is not needed for it any more, see compactTxCommits.
+func commitRewritten(ent *logfile.LogEntry) {
+	if ent.TxStat == logfile.TxUncommited {
+		ent.TxStat = logfile.TxCommited
+	}
+}
+
+// txDiscarded returns whether the entry was written by a transaction which has not been committed.
+// Entries written by transactions before commit markers existed are committed ones.
+func (db *LazyDB) txDiscarded(entry *logfile.LogEntry) bool {
+	if entry.TxStat != logfile.TxUncommited {
+		return false
+	}
+	db.txCommits.mu.RLock()
+	defer db.txCommits.mu.RUnlock()
+	_, ok := db.txCommits.committed[entry.TxID]
+	return !ok
+}
@@ -0,0 +1,75 @@
+package lazydb
+
+import (
+	"github.com/billsjc123/LazyDB/logfile"
+)
+
+// HSet sets field in the hash stored at key to value once the transaction is committed.
+func (tx *Tx) HSet(key, field, value []byte) {
+	entry := &logfile.LogEntry{Key: tx.db.encodeKey(key, field), Value: value}
+	tx.addWrites(valueTypeHash, 1, func() {
+		tx.pendingHash = append(tx.pendingHash, entry)
+	})
+}
+
+// writeHash writes buffered fields of hashes, and returns the function updating the index with them.
+// Fields inherit the time to live of their hashes. Hashes are written as normal entries, and a packed hash is
+// converted by rewriting all of its fields, see DBConfig.PackSmallHashes.
+func (tx *Tx) writeHash() (func() error, error) {
+	if len(tx.pendingHash) == 0 {
+		return nil, nil
+	}
+	db := tx.db
+	args := make(map[string][][]byte)
+	var keys []string
+	for _, e := range tx.pendingHash {
+		key, field := tx.db.decodeKey(e.Key)
+		if args[string(key)] == nil {
+			keys = append(keys, string(key))
+		}
+		args[string(key)] = append(args[string(key)], field, e.Value)
+	}
+
+	var entries []*logfile.LogEntry
+	var positions []*ValuePos
+	unpacked := make(map[string]bool)
+	for _, strKey := range keys {
+		key := []byte(strKey)
+		db.removeExpiredCollection(valueTypeHash, key)
+		if err := db.checkHashLimit(key, args[strKey]); err != nil {
+			return nil, err
+		}
+		idxTree := db.hashIndex.trees[strKey]
+		pairs := args[strKey]
+		if db.cfg.PackSmallHashes && isPacked(idxTree) {
+			packed, err := db.packedPairs(valueTypeHash, key, idxTree)
+			if err != nil {
+				return nil, err
+			}
+			// the packed entry is not live any more once all of its fields are rewritten
+			pairs = mergePairs(packed, pairs)
+			unpacked[strKey] = true
+		}
+		expiredAt := collectionExpiredAt(valueTypeHash, idxTree, key)
+		for i := 0; i < len(pairs); i += 2 {
+			entry := &logfile.LogEntry{Key: tx.db.encodeKey(key, pairs[i]), Value: pairs[i+1], ExpiredAt: expiredAt}
+			valuePos, err := tx.writeEntry(valueTypeHash, entry)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+			positions = append(positions, valuePos)
+		}
+	}
+
+	return func() error {
+		for i, e := range entries {
+			key, _ := tx.db.decodeKey(e.Key)
+			idxTree := db.collectionTree(valueTypeHash, key)
+			if err := db.updateIndexTree(valueTypeHash, idxTree, e, positions[i], unpacked[string(key)]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
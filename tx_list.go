@@ -0,0 +1,130 @@
+package lazydb
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/billsjc123/LazyDB/logfile"
+)
+
+// LPush inserts values at the head of the list stored at key once the transaction is committed.
+func (tx *Tx) LPush(key []byte, values ...[]byte) {
+	tx.push(key, values, true)
+}
+
+// RPush inserts values at the tail of the list stored at key once the transaction is committed.
+func (tx *Tx) RPush(key []byte, values ...[]byte) {
+	tx.push(key, values, false)
+}
+
+func (tx *Tx) push(key []byte, values [][]byte, isLeft bool) {
+	pushed := make([]*pList, 0, len(values))
+	for _, value := range values {
+		pushed = append(pushed, &pList{key: key, value: value, isLeft: isLeft})
+	}
+	tx.addWrites(valueTypeList, len(pushed), func() {
+		tx.pendingList = append(tx.pendingList, pushed...)
+	})
+}
+
+// txList the state of a list written by a transaction.
+type txList struct {
+	key       []byte
+	headSeq   uint32
+	tailSeq   uint32
+	expiredAt int64
+	entries   []*logfile.LogEntry
+	positions []*ValuePos
+}
+
+// writeList writes buffered elements of lists along with their metadata, and returns the function updating
+// the index with them. Elements inherit the time to live of their lists. Lists are not rebalanced within
+// a transaction, ErrListSeqExhausted is returned if there is no room on the end pushed.
+func (tx *Tx) writeList() (func() error, error) {
+	if len(tx.pendingList) == 0 {
+		return nil, nil
+	}
+	db := tx.db
+	lists := make(map[string]*txList)
+	var order []*txList
+	for _, pl := range tx.pendingList {
+		if lists[string(pl.key)] != nil {
+			continue
+		}
+		db.removeExpiredCollection(valueTypeList, pl.key)
+		l := &txList{key: pl.key, headSeq: db.initialListSeq()}
+		l.tailSeq = l.headSeq + 1
+		if idxTree := db.listIndex.trees[string(pl.key)]; idxTree != nil {
+			var err error
+			if l.headSeq, l.tailSeq, err = db.lMeta(idxTree, pl.key); err != nil {
+				return nil, err
+			}
+			l.expiredAt = collectionExpiredAt(valueTypeList, idxTree, pl.key)
+		}
+		lists[string(pl.key)] = l
+		order = append(order, l)
+	}
+	for _, l := range order {
+		var added int
+		for _, pl := range tx.pendingList {
+			if string(pl.key) == string(l.key) {
+				added++
+			}
+		}
+		if err := db.checkListLimit(l.key, added); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, pl := range tx.pendingList {
+		l := lists[string(pl.key)]
+		if (pl.isLeft && l.headSeq == 0) || (!pl.isLeft && l.tailSeq == math.MaxUint32) {
+			return nil, ErrListSeqExhausted
+		}
+		seq := l.tailSeq
+		if pl.isLeft {
+			seq = l.headSeq
+		}
+		entry := &logfile.LogEntry{Key: db.encodeListKey(pl.key, seq), Value: pl.value, ExpiredAt: l.expiredAt}
+		if err := l.write(tx, entry); err != nil {
+			return nil, err
+		}
+		if pl.isLeft {
+			l.headSeq--
+		} else {
+			l.tailSeq++
+		}
+	}
+	for _, l := range order {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint32(buf[:4], l.headSeq)
+		binary.LittleEndian.PutUint32(buf[4:8], l.tailSeq)
+		meta := &logfile.LogEntry{Key: l.key, Value: buf, Stat: logfile.SListMeta, ExpiredAt: l.expiredAt}
+		if err := l.write(tx, meta); err != nil {
+			return nil, err
+		}
+	}
+
+	return func() error {
+		for _, l := range order {
+			idxTree := db.collectionTree(valueTypeList, l.key)
+			for i, e := range l.entries {
+				if err := db.updateIndexTree(valueTypeList, idxTree, e, l.positions[i], false); err != nil {
+					return err
+				}
+			}
+			db.signalListWaiters(l.key)
+		}
+		return nil
+	}, nil
+}
+
+func (l *txList) write(tx *Tx, e *logfile.LogEntry) error {
+	valuePos, err := tx.writeEntry(valueTypeList, e)
+	if err != nil {
+		return err
+	}
+	l.entries = append(l.entries, e)
+	l.positions = append(l.positions, valuePos)
+	return nil
+}
@@ -0,0 +1,243 @@
+package lazydb
+
+import (
+	"log"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TxInfo describes an open transaction, see ActiveTransactions.
+type TxInfo struct {
+	ID        uint64
+	Type      TxType
+	StartedAt time.Time
+	Age       time.Duration // since StartedAt
+	Idle      time.Duration // since the last write was buffered, or since StartedAt if there is none
+
+	// number of writes waiting for Commit by type
+	PendingStr  int
+	PendingList int
+	PendingHash int
+	PendingSet  int
+	PendingZSet int
+}
+
+// States of a registered transaction.
+const (
+	txOpen int32 = iota
+	txCommitting
+	txClosed
+)
+
+type (
+	// txRegistry keeps track of open transactions, see ActiveTransactions. The zero value is ready to use.
+	txRegistry struct {
+		mu    sync.Mutex
+		metas map[uint64]*txMeta
+	}
+
+	// txMeta is what the registry knows about an open transaction. It does not reference the Tx,
+	// so that an abandoned Tx can be collected and rolled back by its finalizer.
+	txMeta struct {
+		id        uint64
+		tType     TxType
+		startedAt time.Time
+		pending   [valueTypeZSet + 1]int64 // by type, accessed atomically
+
+		mu         sync.Mutex // protects the fields below
+		state      int32      // txOpen, txCommitting or txClosed
+		lastActive time.Time
+		writes     *txWrites // buffered writes of Tx are only changed while it is open
+	}
+)
+
+// ActiveTransactions returns transactions begun but not committed or rolled back yet, oldest first.
+// It is meant for diagnosing stuck or long-running transactions, e.g. an RWTX blocks all other transactions.
+// A transaction which is no longer referenced is rolled back and unregistered once it is garbage collected,
+// and an idle one is rolled back after DBConfig.TxTimeout if it is set.
+func (db *LazyDB) ActiveTransactions() []TxInfo {
+	now := db.now()
+	db.txs.mu.Lock()
+	infos := make([]TxInfo, 0, len(db.txs.metas))
+	for _, meta := range db.txs.metas {
+		meta.mu.Lock()
+		lastActive := meta.lastActive
+		meta.mu.Unlock()
+		infos = append(infos, TxInfo{
+			ID:          meta.id,
+			Type:        meta.tType,
+			StartedAt:   meta.startedAt,
+			Age:         now.Sub(meta.startedAt),
+			Idle:        now.Sub(lastActive),
+			PendingStr:  int(atomic.LoadInt64(&meta.pending[valueTypeString])),
+			PendingList: int(atomic.LoadInt64(&meta.pending[valueTypeList])),
+			PendingHash: int(atomic.LoadInt64(&meta.pending[valueTypeHash])),
+			PendingSet:  int(atomic.LoadInt64(&meta.pending[valueTypeSet])),
+			PendingZSet: int(atomic.LoadInt64(&meta.pending[valueTypeZSet])),
+		})
+	}
+	db.txs.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		if !infos[i].StartedAt.Equal(infos[j].StartedAt) {
+			return infos[i].StartedAt.Before(infos[j].StartedAt)
+		}
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// registerTx adds the transaction to the registry once it has begun.
+func (db *LazyDB) registerTx(tx *Tx) {
+	now := db.now()
+	tx.meta = &txMeta{id: tx.id, tType: tx.tType, startedAt: now, lastActive: now, writes: tx.txWrites}
+	db.txs.mu.Lock()
+	if db.txs.metas == nil {
+		db.txs.metas = make(map[uint64]*txMeta)
+	}
+	db.txs.metas[tx.id] = tx.meta
+	db.txs.mu.Unlock()
+	runtime.SetFinalizer(tx, finalizeTx)
+}
+
+// unregisterTx removes the transaction from the registry.
+func (db *LazyDB) unregisterTx(meta *txMeta) {
+	db.txs.mu.Lock()
+	delete(db.txs.metas, meta.id)
+	db.txs.mu.Unlock()
+}
+
+// abortTx rolls back the open transaction: its buffered writes are freed, it is unregistered,
+// and the lock of db held by it is released. It returns ErrTxCommittingRollback if the transaction is being committed,
+// or ErrTxClosed if it has been closed, e.g. by the reaper.
+func (db *LazyDB) abortTx(meta *txMeta) error {
+	switch state, ok := meta.close(nil); {
+	case ok:
+		db.releaseTx(meta)
+		return nil
+	case state == txCommitting:
+		return ErrTxCommittingRollback
+	default:
+		return ErrTxClosed
+	}
+}
+
+// close closes the transaction if it is open, and idle reports true for when it was last active if idle is not nil.
+// Buffered writes are freed then. It returns the state of the transaction before, and whether it is closed by the call.
+func (meta *txMeta) close(idle func(lastActive time.Time) bool) (int32, bool) {
+	meta.mu.Lock()
+	defer meta.mu.Unlock()
+	state := meta.state
+	if state != txOpen || (idle != nil && !idle(meta.lastActive)) {
+		return state, false
+	}
+	meta.state = txClosed
+	meta.writes.reset()
+	return state, true
+}
+
+// releaseTx unregisters the transaction closed by txMeta.close, and releases the lock of db held by it.
+func (db *LazyDB) releaseTx(meta *txMeta) {
+	db.unregisterTx(meta)
+	if meta.tType == RWTX {
+		db.mu.Unlock()
+	} else {
+		db.mu.RUnlock()
+	}
+}
+
+// beginCommit marks the open transaction as committing, so that the reaper leaves it alone.
+// It returns ErrTxClosed if the transaction has been closed, e.g. by the reaper.
+func (meta *txMeta) beginCommit() error {
+	meta.mu.Lock()
+	defer meta.mu.Unlock()
+	if meta.state != txOpen {
+		return ErrTxClosed
+	}
+	meta.state = txCommitting
+	return nil
+}
+
+// endCommit closes and unregisters the committed transaction, the lock of db is released by the caller.
+func (db *LazyDB) endCommit(tx *Tx) {
+	runtime.SetFinalizer(tx, nil)
+	tx.meta.mu.Lock()
+	tx.meta.state = txClosed
+	tx.meta.mu.Unlock()
+	db.unregisterTx(tx.meta)
+}
+
+func (meta *txMeta) closed() bool {
+	meta.mu.Lock()
+	defer meta.mu.Unlock()
+	return meta.state == txClosed
+}
+
+// finalizeTx rolls back an abandoned transaction, which can never be committed,
+// so that the lock of db held by it is released.
+func finalizeTx(tx *Tx) {
+	if tx.db != nil {
+		_ = tx.db.abortTx(tx.meta)
+	}
+}
+
+// addWrites buffers n writes of the type by add, unless the transaction has been closed, e.g. by the reaper.
+func (tx *Tx) addWrites(typ valueType, n int, add func()) {
+	meta := tx.meta
+	meta.mu.Lock()
+	defer meta.mu.Unlock()
+	if meta.state != txOpen {
+		return
+	}
+	add()
+	atomic.AddInt64(&meta.pending[typ], int64(n))
+	meta.lastActive = tx.db.now()
+}
+
+// runTxReaper rolls back transactions idle longer than timeout periodically until db is closed.
+func (db *LazyDB) runTxReaper(timeout time.Duration, closeCh <-chan struct{}) {
+	defer db.bgWg.Done()
+	interval := timeout / 2
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closeCh:
+			return
+		case <-ticker.C:
+			db.reapTxs(timeout)
+		}
+	}
+}
+
+// reapTxs rolls back open transactions idle longer than timeout, and returns the number of them.
+// Transactions being committed are left alone.
+func (db *LazyDB) reapTxs(timeout time.Duration) int {
+	db.txs.mu.Lock()
+	metas := make([]*txMeta, 0, len(db.txs.metas))
+	for _, meta := range db.txs.metas {
+		metas = append(metas, meta)
+	}
+	db.txs.mu.Unlock()
+
+	now := db.now()
+	idle := func(lastActive time.Time) bool {
+		return now.Sub(lastActive) > timeout
+	}
+	var reaped int
+	for _, meta := range metas {
+		// checked again under the lock of the transaction, it may be written, committed or rolled back in the meantime
+		if _, ok := meta.close(idle); ok {
+			db.releaseTx(meta)
+			reaped++
+			log.Printf("transaction %d rolled back after being idle for more than %v", meta.id, timeout)
+		}
+	}
+	return reaped
+}
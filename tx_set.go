@@ -1,29 +1,72 @@
 package lazydb
 
 import (
-	"github.com/billsjc123/LazyDB/ds"
 	"github.com/billsjc123/LazyDB/logfile"
 )
 
 func (tx *Tx) SAdd(key []byte, members ...[]byte) {
-	if tx.db.setIndex.trees[string(key)] == nil {
-		tx.db.setIndex.trees[string(key)] = ds.NewART()
-	}
-
+	var added []*pSet
 	for _, mem := range members {
 		if len(mem) == 0 {
 			continue
 		}
-		tx.db.setIndex.murHash.Write(mem)
-
-		sum := tx.db.setIndex.murHash.EncodeSum128()
-		tx.db.setIndex.murHash.Reset()
-
 		ent := &logfile.LogEntry{Key: key, Value: mem}
-		tx.pendingSet = append(tx.pendingSet, &pSet{
+		added = append(added, &pSet{
 			e:   ent,
-			sum: sum,
 			mem: mem,
 		})
 	}
+	tx.addWrites(valueTypeSet, len(added), func() {
+		tx.pendingSet = append(tx.pendingSet, added...)
+	})
+}
+
+// writeSet writes buffered members of sets, and returns the function updating the index with them.
+// Members inherit the time to live of their sets.
+func (tx *Tx) writeSet() (func() error, error) {
+	if len(tx.pendingSet) == 0 {
+		return nil, nil
+	}
+	db := tx.db
+	members := make(map[string][][]byte)
+	for _, ps := range tx.pendingSet {
+		members[string(ps.e.Key)] = append(members[string(ps.e.Key)], ps.mem)
+	}
+	expiredAts := make(map[string]int64, len(members))
+	for key, mems := range members {
+		db.removeExpiredCollection(valueTypeSet, []byte(key))
+		if err := db.checkSetLimit([]byte(key), mems); err != nil {
+			return nil, err
+		}
+		expiredAts[key] = collectionExpiredAt(valueTypeSet, db.setIndex.trees[key], []byte(key))
+	}
+
+	positions := make([]*ValuePos, len(tx.pendingSet))
+	for i, ps := range tx.pendingSet {
+		if err := db.setIndex.murHash.Write(ps.mem); err != nil {
+			return nil, err
+		}
+		ps.sum = db.setIndex.murHash.EncodeSum128()
+		db.setIndex.murHash.Reset()
+
+		ps.e.ExpiredAt = expiredAts[string(ps.e.Key)]
+		valuePos, err := tx.writeEntry(valueTypeSet, ps.e)
+		if err != nil {
+			return nil, err
+		}
+		valuePos.entrySize = db.entrySize(ps.e)
+		positions[i] = valuePos
+	}
+
+	pending := tx.pendingSet
+	return func() error {
+		for i, ps := range pending {
+			idxTree := db.collectionTree(valueTypeSet, ps.e.Key)
+			entry := &logfile.LogEntry{Key: ps.sum, Value: ps.mem, WrittenAt: ps.e.WrittenAt, ExpiredAt: ps.e.ExpiredAt}
+			if err := db.updateIndexTree(valueTypeSet, idxTree, entry, positions[i], false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
 }
@@ -5,6 +5,33 @@ import (
 )
 
 func (tx *Tx) Set(key, value []byte) {
-	entry := &logfile.LogEntry{Key: key, Value: value}
-	tx.pendingStr = append(tx.pendingStr, entry)
+	entry := &logfile.LogEntry{Key: key, Value: value, ExpiredAt: tx.db.defaultExpiredAt(tx.db.now())}
+	tx.addWrites(valueTypeString, 1, func() {
+		tx.pendingStr = append(tx.pendingStr, entry)
+	})
+}
+
+// writeStr writes buffered strings, and returns the function updating the index with them.
+func (tx *Tx) writeStr() (func() error, error) {
+	if len(tx.pendingStr) == 0 {
+		return nil, nil
+	}
+	positions := make([]*ValuePos, len(tx.pendingStr))
+	for i, e := range tx.pendingStr {
+		valuePos, err := tx.writeEntry(valueTypeString, e)
+		if err != nil {
+			return nil, err
+		}
+		positions[i] = valuePos
+	}
+
+	db, entries := tx.db, tx.pendingStr
+	return func() error {
+		for i, e := range entries {
+			if err := db.updateIndexTree(valueTypeString, db.strIndex.idxTree, e, positions[i], true); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
 }
@@ -1,7 +1,13 @@
 package lazydb
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -25,7 +31,7 @@ func TestTx(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, string(val), "val1")
 
-	got := db.SIsMember([]byte("add2"), []byte("v1"))
+	got := sIsMember(t, db, []byte("add2"), []byte("v1"))
 	assert.Equal(t, got, true)
 
 	val, err = db.Get([]byte("3"))
@@ -48,3 +54,361 @@ func TestTx(t *testing.T) {
 	assert.Error(t, err)
 
 }
+
+func TestTx_Exec(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_tx_exec"))
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	exec := func() error {
+		tx, err := db.Begin(RWTX)
+		assert.Nil(t, err)
+		tx.Set([]byte("str"), []byte("v1"))
+		tx.HSet([]byte("hash"), []byte("field"), []byte("v2"))
+		tx.RPush([]byte("list"), []byte("a"), []byte("b"))
+		tx.SAdd([]byte("set"), []byte("m"))
+		tx.ZAdd([]byte("zset"), 1.5, []byte("m"))
+		return tx.Exec()
+	}
+	assertApplied := func(applied bool) {
+		val, err := db.Get([]byte("str"))
+		if applied {
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("v1"), val)
+		} else {
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+		val, err = db.HGet([]byte("hash"), []byte("field"))
+		assert.Nil(t, err)
+		assert.Equal(t, applied, val != nil)
+	}
+
+	// crash after all entries are written, but before the commit marker
+	errCrash := errors.New("crash")
+	beforeTxCommitHook = func() error { return errCrash }
+	assert.Equal(t, errCrash, exec())
+	beforeTxCommitHook = nil
+	assertApplied(false)
+	assert.Equal(t, 0, lLen(t, db, []byte("list")))
+	assert.False(t, sIsMember(t, db, []byte("set"), []byte("m")))
+	_, err = db.ZScore([]byte("zset"), []byte("m"))
+	assert.NotNil(t, err)
+
+	// entries of the interrupted transaction are discarded on recovery
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assertApplied(false)
+
+	assert.Nil(t, exec())
+	assertApplied(true)
+	values, err := db.LRange([]byte("list"), 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, values)
+	assert.True(t, sIsMember(t, db, []byte("set"), []byte("m")))
+	score, err := db.ZScore([]byte("zset"), []byte("m"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1.5, score)
+
+	// the committed transaction survives recovery, the marker is kept after a torn record
+	assert.Nil(t, db.Close())
+	file, err := os.OpenFile(filepath.Join(cfg.DBPath, txCommitFileName), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte{1, 2, 3})
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assertApplied(true)
+}
+
+func TestLazyDB_ActiveTransactions(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+
+	assert.Equal(t, 0, len(db.ActiveTransactions()))
+	tx1, err := db.Begin(RTX)
+	assert.NoError(t, err)
+	now = now.Add(time.Second)
+	tx2, err := db.Begin(RTX)
+	assert.NoError(t, err)
+	tx2.Set([]byte("1"), []byte("val1"))
+	tx2.SAdd([]byte("set"), []byte("v1"), []byte("v2"))
+
+	now = now.Add(time.Second)
+	infos := db.ActiveTransactions()
+	assert.Equal(t, 2, len(infos))
+	assert.Equal(t, tx1.id, infos[0].ID)
+	assert.Equal(t, RTX, infos[0].Type)
+	assert.Equal(t, 2*time.Second, infos[0].Age)
+	assert.Equal(t, 0, infos[0].PendingStr)
+	assert.Equal(t, tx2.id, infos[1].ID)
+	assert.Equal(t, time.Second, infos[1].Age)
+	assert.Equal(t, 1, infos[1].PendingStr)
+	assert.Equal(t, 2, infos[1].PendingSet)
+
+	// listed until committed or rolled back
+	assert.NoError(t, tx1.Commit())
+	infos = db.ActiveTransactions()
+	assert.Equal(t, 1, len(infos))
+	assert.Equal(t, tx2.id, infos[0].ID)
+	assert.NoError(t, tx2.Rollback())
+	assert.Equal(t, 0, len(db.ActiveTransactions()))
+
+	// an abandoned transaction is rolled back once it is collected
+	func() {
+		tx, err := db.Begin(RWTX)
+		assert.NoError(t, err)
+		tx.Set([]byte("2"), []byte("val2"))
+		assert.Equal(t, 1, len(db.ActiveTransactions()))
+	}()
+	for i := 0; i < 100 && len(db.ActiveTransactions()) > 0; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, len(db.ActiveTransactions()))
+	tx, err := db.Begin(RWTX)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Rollback())
+}
+
+func TestLazyDB_TxTimeout(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_tx_timeout")
+	cfg := DefaultDBConfig(path)
+	cfg.TxTimeout = 50 * time.Millisecond
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	tx, err := db.Begin(RWTX)
+	assert.NoError(t, err)
+	tx.Set([]byte("1"), []byte("val1"))
+	for i := 0; i < 100 && len(db.ActiveTransactions()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, len(db.ActiveTransactions()))
+
+	// buffered writes are freed and the lock of db is released
+	assert.True(t, tx.IsClosed())
+	assert.Nil(t, tx.pendingStr)
+	tx.Set([]byte("2"), []byte("val2"))
+	assert.Nil(t, tx.pendingStr)
+	assert.Equal(t, ErrTxClosed, tx.Commit())
+	assert.Equal(t, ErrTxClosed, tx.Rollback())
+	_, err = db.Get([]byte("1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	tx, err = db.Begin(RWTX)
+	assert.NoError(t, err)
+	tx.Set([]byte("3"), []byte("val3"))
+	assert.NoError(t, tx.Commit())
+	val, err := db.Get([]byte("3"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("val3"), val)
+}
+
+func TestLazyDB_ReapTxs(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	now := time.Now()
+	db.clock = func() time.Time { return now }
+
+	idle, err := db.Begin(RTX)
+	assert.NoError(t, err)
+	active, err := db.Begin(RTX)
+	assert.NoError(t, err)
+	now = now.Add(time.Second)
+	active.Set([]byte("1"), []byte("val1"))
+
+	// only transactions idle longer than timeout are rolled back
+	now = now.Add(500 * time.Millisecond)
+	assert.Equal(t, 1, db.reapTxs(time.Second))
+	assert.True(t, idle.IsClosed())
+	assert.False(t, active.IsClosed())
+
+	// a committing transaction is left alone
+	assert.NoError(t, active.meta.beginCommit())
+	now = now.Add(time.Hour)
+	assert.Equal(t, 0, db.reapTxs(time.Second))
+	assert.Equal(t, ErrTxCommittingRollback, db.abortTx(active.meta))
+	assert.Equal(t, 1, len(db.ActiveTransactions()))
+	db.endCommit(active)
+	active.unlock()
+	assert.Equal(t, 0, len(db.ActiveTransactions()))
+}
+
+func TestTx_CommitSyncWindow(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_commit_sync_window"))
+	cfg.CommitSyncWindow = 100 * time.Millisecond
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	lf := db.getActiveLogFile(valueTypeString).lf
+	controller := &crashIOController{IOController: lf.IoController}
+	lf.IoController = controller
+
+	// concurrent commits of different types share fsyncs, rather than waiting for the window one after another
+	start := time.Now()
+	wg := new(sync.WaitGroup)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		tx, err := db.Begin(RWTX)
+		assert.Nil(t, err)
+		tx.Set(GetKey(0), GetValue32())
+		assert.Nil(t, tx.Commit())
+	}()
+	go func() {
+		defer wg.Done()
+		tx, err := db.Begin(RWTX)
+		assert.Nil(t, err)
+		tx.HSet(GetKey(0), []byte("field"), GetValue32())
+		assert.Nil(t, tx.Commit())
+	}()
+	wg.Wait()
+	assert.Less(t, time.Since(start), 2*cfg.CommitSyncWindow)
+
+	n := 5
+	for i := 1; i < n; i++ {
+		tx, err := db.Begin(RWTX)
+		assert.Nil(t, err)
+		tx.Set(GetKey(i), GetValue32())
+		assert.Nil(t, tx.Commit())
+	}
+
+	// all commits are durable once they return
+	assert.Nil(t, controller.crash())
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	for i := 0; i < n; i++ {
+		_, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+	}
+	val, err := db.HGet(GetKey(0), []byte("field"))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+}
+
+func TestTx_CommitDurableBeforeVisible(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_tx_durable_before_visible"))
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	lf := db.getActiveLogFile(valueTypeString).lf
+	controller := &crashIOController{IOController: lf.IoController}
+	lf.IoController = controller
+
+	// entries are synced before the marker is appended, and indexes are not updated yet
+	beforeTxCommitHook = func() error {
+		assert.Equal(t, controller.written, controller.synced)
+		assert.Nil(t, db.strIndex.idxTree.Get([]byte("str")))
+		return nil
+	}
+	defer func() { beforeTxCommitHook = nil }()
+	tx, err := db.Begin(RWTX)
+	assert.Nil(t, err)
+	tx.Set([]byte("str"), []byte("v1"))
+	assert.Nil(t, tx.Exec())
+	val, err := db.Get([]byte("str"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+
+	// the commit survives a crash right after Exec returns
+	assert.Nil(t, controller.crash())
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	val, err = db.Get([]byte("str"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+}
+
+func TestTx_CompactTxCommits(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_compact_tx_commits"))
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	exec := func(key []byte) {
+		tx, err := db.Begin(RWTX)
+		assert.Nil(t, err)
+		tx.Set(key, key)
+		tx.HSet(key, key, key)
+		assert.Nil(t, tx.Exec())
+	}
+	exec([]byte("k1"))
+	exec([]byte("k2"))
+	assert.Equal(t, 2, len(db.txCommits.committed))
+
+	// committed entries are rewritten as plain ones, so markers are dropped once their log files are removed
+	assert.Nil(t, db.FullCompact(valueTypeString))
+	assert.Nil(t, db.compactTxCommits(true))
+	assert.Equal(t, 2, len(db.txCommits.committed))
+	assert.Nil(t, db.FullCompact(valueTypeHash))
+	assert.Nil(t, db.compactTxCommits(true))
+	assert.Equal(t, 0, len(db.txCommits.committed))
+	info, err := os.Stat(filepath.Join(cfg.DBPath, txCommitFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size())
+
+	// markers of transactions whose log files still exist are kept through reopening
+	exec([]byte("k3"))
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(db.txCommits.committed))
+	for _, key := range []string{"k1", "k2", "k3"} {
+		val, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(key), val)
+		val, err = db.HGet([]byte(key), []byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(key), val)
+	}
+}
+
+func BenchmarkTx_CommitSync(b *testing.B) {
+	for _, bm := range []struct {
+		name   string
+		window time.Duration
+	}{
+		{"per-commit", 0},
+		{"coalesced", 200 * time.Microsecond},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			wd, _ := os.Getwd()
+			cfg := DefaultDBConfig(filepath.Join(wd, "test_bench_commit_sync"))
+			cfg.CommitSyncWindow = bm.window
+			db, err := Open(cfg)
+			assert.Nil(b, err)
+			defer destroyDB(db)
+
+			value := GetValue32()
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					tx, err := db.Begin(RWTX)
+					if err != nil {
+						b.Fatal(err)
+					}
+					tx.Set(GetKey(i), value)
+					if err := tx.Commit(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package lazydb
+
+import (
+	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/billsjc123/LazyDB/util"
+)
+
+// ZAdd adds member with score into the sorted set stored at key once the transaction is committed,
+// the score of an existing member is replaced.
+func (tx *Tx) ZAdd(key []byte, score float64, member []byte) {
+	entry := &logfile.LogEntry{Key: tx.db.encodeKey(key, member), Value: util.Float64ToByte(score)}
+	tx.addWrites(valueTypeZSet, 1, func() {
+		tx.pendingZSet = append(tx.pendingZSet, entry)
+	})
+}
+
+// writeZSet writes buffered members of sorted sets, and returns the function updating the index with them.
+// Current scores of members are read here, so that updating the index reads no log file.
+func (tx *Tx) writeZSet() (func() error, error) {
+	if len(tx.pendingZSet) == 0 {
+		return nil, nil
+	}
+	db := tx.db
+	// score of a member before each entry is applied, nil if the member does not exist
+	scores := make(map[string][]byte)
+	oriScores := make([][]byte, len(tx.pendingZSet))
+	positions := make([]*ValuePos, len(tx.pendingZSet))
+	for i, e := range tx.pendingZSet {
+		score, ok := scores[string(e.Key)]
+		if !ok {
+			key, _ := tx.db.decodeKey(e.Key)
+			if idx := db.zSetIndex.indexes[string(key)]; idx != nil && idx.tree != nil && idx.tree.Get(e.Key) != nil {
+				var err error
+				if score, err = db.getValue(idx.tree, e.Key, valueTypeZSet); err != nil {
+					return nil, err
+				}
+			}
+		}
+		oriScores[i] = score
+		scores[string(e.Key)] = e.Value
+
+		valuePos, err := tx.writeEntry(valueTypeZSet, e)
+		if err != nil {
+			return nil, err
+		}
+		positions[i] = valuePos
+	}
+
+	entries := tx.pendingZSet
+	return func() error {
+		var added bool
+		for i, e := range entries {
+			key, member := tx.db.decodeKey(e.Key)
+			idx := db.getOrCreateZSetIndex(key)
+			if oriScores[i] != nil {
+				idx.skl.Delete(&Node{score: util.ByteToFloat64(oriScores[i]), member: util.ByteToString(member)})
+			} else {
+				added = true
+			}
+			if err := db.updateIndexTree(valueTypeZSet, idx.tree, e, positions[i], true); err != nil {
+				return err
+			}
+			idx.skl.Insert(&Node{score: util.ByteToFloat64(e.Value), member: string(member)})
+		}
+		if added {
+			// wake up ZPopMinTimeout waiting for members
+			db.zSetIndex.cond.Broadcast()
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,282 @@
+package lazydb
+
+import (
+	"github.com/billsjc123/LazyDB/ds"
+	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/billsjc123/LazyDB/util"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// unlinkBatchSize is the number of entries cleaned up each time the index lock is held by Unlink in background.
+const unlinkBatchSize = 1024
+
+const (
+	// lazyFreeThreshold keys with more entries than it are cleaned up in background by Unlink, like Redis.
+	lazyFreeThreshold = 64
+	// defaultLazyFreeQueueSize see DBConfig.LazyFreeQueueSize.
+	defaultLazyFreeQueueSize = 128
+)
+
+// unlinkedKey holds the index of a key removed by Unlink, whose tombstones have not been written.
+type unlinkedKey struct {
+	key  []byte
+	str  *Value
+	hash *ds.AdaptiveRadixTree
+	list *ds.AdaptiveRadixTree
+	set  *ds.AdaptiveRadixTree
+	zset *ZSetIndex
+}
+
+// Unlink removes keys of all types like Redis UNLINK, and returns the number of keys that were present.
+// Keys are removed from index immediately, so they are invisible once Unlink returns,
+// while tombstones of large collections are written in background, so that deleting a huge collection does not block.
+// Unlink blocks if too many keys are waiting to be cleaned up, see DBConfig.LazyFreeQueueSize.
+// Close waits for the background work to finish.
+func (db *LazyDB) Unlink(keys ...[]byte) (int, error) {
+	if err := db.checkAccess(OpWrite, keys...); err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, ErrInvalidParam
+	}
+	if db.readOnly() {
+		return 0, ErrReadOnly
+	}
+
+	var count int
+	for _, key := range keys {
+		uk, present := db.unlinkIndex(key)
+		if present {
+			count++
+		}
+		if uk == nil {
+			continue
+		}
+		if uk.size() <= lazyFreeThreshold {
+			if err := db.cleanupUnlinked(uk); err != nil {
+				return count, err
+			}
+			continue
+		}
+		atomic.AddUint64(&db.stats.LazyFreePending, 1)
+		db.lazyFreeCh <- uk
+	}
+	return count, nil
+}
+
+// runLazyFree cleans up keys removed by Unlink one by one until closeCh is closed,
+// and then cleans up the rest in the queue before returning.
+func (db *LazyDB) runLazyFree(closeCh <-chan struct{}) {
+	defer db.bgWg.Done()
+	for {
+		select {
+		case uk := <-db.lazyFreeCh:
+			db.lazyFree(uk)
+		case <-closeCh:
+			for {
+				select {
+				case uk := <-db.lazyFreeCh:
+					db.lazyFree(uk)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// lazyFree cleans up the key removed by Unlink in background.
+func (db *LazyDB) lazyFree(uk *unlinkedKey) {
+	if err := db.cleanupUnlinked(uk); err != nil {
+		log.Printf("cleanup unlinked key err: %v", err)
+	}
+	atomic.AddUint64(&db.stats.LazyFreePending, ^uint64(0))
+}
+
+// unlinkIndex removes key from indexes of all types, and returns whether key was present.
+// It returns nil if key is not in any index, an expired string is not present but still needs a tombstone.
+func (db *LazyDB) unlinkIndex(key []byte) (*unlinkedKey, bool) {
+	// key is used in background, the caller may reuse it
+	uk := &unlinkedKey{key: append([]byte(nil), key...)}
+	present := false
+
+	db.strIndex.mu.Lock()
+	if oldVal, updated := db.strIndex.idxTree.Delete(key); updated {
+		db.replaceStrValue(key, oldVal, nil)
+		uk.str, _ = oldVal.(*Value)
+		present = !uk.str.isExpired(db.now().UnixMilli())
+	}
+	db.strIndex.mu.Unlock()
+
+	uk.hash = db.detachTree(valueTypeHash, key)
+	uk.list = db.detachTree(valueTypeList, key)
+	uk.set = db.detachTree(valueTypeSet, key)
+
+	db.zSetIndex.mu.Lock()
+	if idx := db.zSetIndex.indexes[util.ByteToString(key)]; idx != nil {
+		delete(db.zSetIndex.indexes, util.ByteToString(key))
+		db.unindexKey(valueTypeZSet, key)
+		uk.zset = idx
+	}
+	db.zSetIndex.mu.Unlock()
+
+	present = present || uk.hash != nil || uk.list != nil || uk.set != nil || uk.zset != nil
+	if !present && uk.str == nil {
+		return nil, false
+	}
+	return uk, present
+}
+
+// size returns the number of entries of the unlinked key.
+func (uk *unlinkedKey) size() int {
+	n := 0
+	if uk.str != nil {
+		n++
+	}
+	for _, tree := range []*ds.AdaptiveRadixTree{uk.hash, uk.list, uk.set} {
+		if tree != nil {
+			n += tree.Size()
+		}
+	}
+	if uk.zset != nil && uk.zset.tree != nil {
+		n += uk.zset.tree.Size()
+	}
+	return n
+}
+
+// detachTree removes the tree of the collection at key of typ from its index, and returns it.
+func (db *LazyDB) detachTree(typ valueType, key []byte) *ds.AdaptiveRadixTree {
+	mu := db.getIndexLock(typ)
+	mu.Lock()
+	defer mu.Unlock()
+	tree := db.collectionTrees(typ)[util.ByteToString(key)]
+	if tree != nil {
+		db.removeCollectionTree(typ, key)
+	}
+	return tree
+}
+
+// cleanupUnlinked writes tombstones of the unlinked key.
+// A tombstone is skipped if the entry has been written again after Unlink, since the new entry supersedes the old one.
+func (db *LazyDB) cleanupUnlinked(uk *unlinkedKey) error {
+	key := uk.key
+	if uk.str != nil {
+		db.strIndex.mu.Lock()
+		err := db.cleanupEntries(valueTypeString, db.strIndex.idxTree, [][]byte{key}, []*Value{uk.str},
+			func(idxKey []byte) *logfile.LogEntry {
+				return &logfile.LogEntry{Key: idxKey, Stat: logfile.SDelete}
+			})
+		db.strIndex.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	if uk.hash != nil {
+		err := db.cleanupTree(valueTypeHash, db.hashIndex.mu, uk.hash,
+			func() *ds.AdaptiveRadixTree { return db.hashIndex.trees[util.ByteToString(key)] },
+			func(idxKey []byte) *logfile.LogEntry {
+				return &logfile.LogEntry{Key: idxKey, Stat: logfile.SDelete}
+			})
+		if err != nil {
+			return err
+		}
+	}
+
+	if uk.list != nil {
+		err := db.cleanupTree(valueTypeList, db.listIndex.mu, uk.list,
+			func() *ds.AdaptiveRadixTree { return db.listIndex.trees[string(key)] },
+			func(idxKey []byte) *logfile.LogEntry {
+				return &logfile.LogEntry{Key: idxKey, Stat: logfile.SDelete}
+			})
+		if err != nil {
+			return err
+		}
+	}
+
+	if uk.set != nil {
+		err := db.cleanupTree(valueTypeSet, db.setIndex.mu, uk.set,
+			func() *ds.AdaptiveRadixTree { return db.setIndex.trees[string(key)] },
+			func(sum []byte) *logfile.LogEntry {
+				return &logfile.LogEntry{Key: key, Value: sum, Stat: logfile.SDelete}
+			})
+		if err != nil {
+			return err
+		}
+	}
+
+	if uk.zset != nil {
+		err := db.cleanupTree(valueTypeZSet, db.zSetIndex.mu, uk.zset.tree,
+			func() *ds.AdaptiveRadixTree {
+				if idx := db.zSetIndex.indexes[util.ByteToString(key)]; idx != nil {
+					return idx.tree
+				}
+				return nil
+			},
+			func(idxKey []byte) *logfile.LogEntry {
+				return &logfile.LogEntry{Key: idxKey, Stat: logfile.SDelete}
+			})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanupTree writes tombstones of all entries in the detached tree in batches,
+// mu is held while writing each batch. current returns the tree of the key in index now, which may be nil.
+func (db *LazyDB) cleanupTree(typ valueType, mu *sync.RWMutex, tree *ds.AdaptiveRadixTree,
+	current func() *ds.AdaptiveRadixTree, tombstone func(idxKey []byte) *logfile.LogEntry) error {
+
+	// the detached tree is not visible to others, so it is safe to iterate without lock
+	var idxKeys [][]byte
+	var values []*Value
+	iter := tree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		val, _ := node.Value().(*Value)
+		idxKeys = append(idxKeys, node.Key())
+		values = append(values, val)
+	}
+
+	for start := 0; start < len(idxKeys); start += unlinkBatchSize {
+		end := start + unlinkBatchSize
+		if end > len(idxKeys) {
+			end = len(idxKeys)
+		}
+		mu.Lock()
+		err := db.cleanupEntries(typ, current(), idxKeys[start:end], values[start:end], tombstone)
+		mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanupEntries writes tombstones of entries which are not in cur, and discards the old values.
+// Index lock of the type must be held by the caller.
+func (db *LazyDB) cleanupEntries(typ valueType, cur *ds.AdaptiveRadixTree, idxKeys [][]byte, values []*Value,
+	tombstone func(idxKey []byte) *logfile.LogEntry) error {
+
+	for i, idxKey := range idxKeys {
+		db.sendDiscard(values[i], true, typ)
+		if cur != nil && cur.Get(idxKey) != nil {
+			continue
+		}
+		entry := tombstone(idxKey)
+		pos, err := db.writeLogEntry(typ, entry)
+		if err != nil {
+			return err
+		}
+		// also merge the delete entry
+		size := db.entrySize(entry)
+		db.sendDiscard(&Value{fid: pos.fid, entrySize: size}, true, typ)
+	}
+	return nil
+}
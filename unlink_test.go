@@ -0,0 +1,124 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_Unlink(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_unlink")
+	cfg := DefaultDBConfig(path)
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	_, err = db.Unlink()
+	assert.Equal(t, ErrInvalidParam, err)
+
+	assert.Nil(t, db.Set(GetKey(1), GetValue32()))
+	for i := 0; i < 3000; i++ {
+		assert.Nil(t, db.HSet(GetKey(2), GetKey(i), GetValue32()))
+	}
+	assert.Nil(t, db.SAdd(GetKey(3), GetKey(1), GetKey(2)))
+	assert.Nil(t, db.RPush(GetKey(4), GetKey(1), GetKey(2)))
+	assert.Nil(t, db.Set(GetKey(5), GetValue32()))
+	// key 6 holds both a string and a hash
+	assert.Nil(t, db.Set(GetKey(6), GetValue32()))
+	assert.Nil(t, db.HSet(GetKey(6), GetKey(1), GetValue32()))
+
+	count, err := db.Unlink(GetKey(1), GetKey(2), GetKey(3), GetKey(4), GetKey(6), GetKey(100))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, count)
+
+	// keys are gone immediately
+	_, err = db.Get(GetKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 0, hLen(t, db, GetKey(2)))
+	assert.False(t, sIsMember(t, db, GetKey(3), GetKey(1)))
+	assert.Equal(t, 0, lLen(t, db, GetKey(4)))
+	_, err = db.Get(GetKey(6))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 0, hLen(t, db, GetKey(6)))
+
+	// written again after unlink, the new value survives
+	value := GetValue32()
+	assert.Nil(t, db.HSet(GetKey(2), GetKey(1), value))
+
+	// tombstones are written before close
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+
+	_, err = db.Get(GetKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get(GetKey(5))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, hLen(t, db, GetKey(2)))
+	got, err := db.HGet(GetKey(2), GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, got)
+	_, err = db.Get(GetKey(6))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 0, hLen(t, db, GetKey(6)))
+}
+
+func TestLazyDB_UnlinkLazyFree(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_unlink_lazy_free")
+	cfg := DefaultDBConfig(path)
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	// a small collection is cleaned up by Unlink itself
+	for i := 0; i < lazyFreeThreshold; i++ {
+		assert.Nil(t, db.HSet(GetKey(1), GetKey(i), GetValue32()))
+	}
+	writes := db.Stats().Writes
+	_, err = db.Unlink(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, writes+lazyFreeThreshold, db.Stats().Writes)
+
+	n := 20000
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.HSet(GetKey(2), GetKey(i), GetValue32()))
+	}
+	writes = db.Stats().Writes
+	count, err := db.Unlink(GetKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, 0, hLen(t, db, GetKey(2)))
+
+	// the cleanup can't finish while the index is read
+	db.hashIndex.mu.RLock()
+	assert.Equal(t, uint64(1), db.Stats().LazyFreePending)
+	assert.Less(t, db.Stats().Writes, writes+uint64(n))
+	db.hashIndex.mu.RUnlock()
+	assert.Eventually(t, func() bool {
+		return db.Stats().LazyFreePending == 0
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, writes+uint64(n), db.Stats().Writes)
+
+	// keys waiting in the queue are cleaned up before close
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.HSet(GetKey(3), GetKey(i), GetValue32()))
+	}
+	_, err = db.Unlink(GetKey(3))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+	assert.Equal(t, uint64(0), db.Stats().LazyFreePending)
+
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, hLen(t, db, GetKey(2)))
+	assert.Equal(t, 0, hLen(t, db, GetKey(3)))
+}
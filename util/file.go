@@ -8,3 +8,16 @@ func PathExist(path string) bool {
 	}
 	return true
 }
+
+// SyncDir fsyncs the directory, so that entries of files created in it survive a crash.
+func SyncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err = dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
@@ -0,0 +1,118 @@
+package util
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// primes of xxHash, they are variables so that arithmetic on them wraps around rather than overflows at compile time
+var (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// XXHash64 computes the 64-bit xxHash of data written into it with seed 0.
+type XXHash64 struct {
+	v1, v2, v3, v4 uint64
+	total          uint64
+	mem            [32]byte
+	n              int // number of bytes buffered in mem
+}
+
+func NewXXHash64() *XXHash64 {
+	h := &XXHash64{}
+	h.Reset()
+	return h
+}
+
+func (h *XXHash64) Reset() {
+	h.v1 = xxPrime1 + xxPrime2
+	h.v2 = xxPrime2
+	h.v3 = 0
+	h.v4 = -xxPrime1
+	h.total = 0
+	h.n = 0
+}
+
+func (h *XXHash64) Write(p []byte) {
+	h.total += uint64(len(p))
+	if h.n+len(p) < 32 {
+		h.n += copy(h.mem[h.n:], p)
+		return
+	}
+	if h.n > 0 {
+		c := copy(h.mem[h.n:], p)
+		h.v1 = xxRound(h.v1, binary.LittleEndian.Uint64(h.mem[0:8]))
+		h.v2 = xxRound(h.v2, binary.LittleEndian.Uint64(h.mem[8:16]))
+		h.v3 = xxRound(h.v3, binary.LittleEndian.Uint64(h.mem[16:24]))
+		h.v4 = xxRound(h.v4, binary.LittleEndian.Uint64(h.mem[24:32]))
+		p = p[c:]
+		h.n = 0
+	}
+	for ; len(p) >= 32; p = p[32:] {
+		h.v1 = xxRound(h.v1, binary.LittleEndian.Uint64(p[0:8]))
+		h.v2 = xxRound(h.v2, binary.LittleEndian.Uint64(p[8:16]))
+		h.v3 = xxRound(h.v3, binary.LittleEndian.Uint64(p[16:24]))
+		h.v4 = xxRound(h.v4, binary.LittleEndian.Uint64(p[24:32]))
+	}
+	h.n = copy(h.mem[:], p)
+}
+
+func (h *XXHash64) Sum64() uint64 {
+	var acc uint64
+	if h.total >= 32 {
+		acc = bits.RotateLeft64(h.v1, 1) + bits.RotateLeft64(h.v2, 7) +
+			bits.RotateLeft64(h.v3, 12) + bits.RotateLeft64(h.v4, 18)
+		acc = xxMergeRound(acc, h.v1)
+		acc = xxMergeRound(acc, h.v2)
+		acc = xxMergeRound(acc, h.v3)
+		acc = xxMergeRound(acc, h.v4)
+	} else {
+		acc = h.v3 + xxPrime5
+	}
+	acc += h.total
+
+	p := h.mem[:h.n]
+	for ; len(p) >= 8; p = p[8:] {
+		acc ^= xxRound(0, binary.LittleEndian.Uint64(p))
+		acc = bits.RotateLeft64(acc, 27)*xxPrime1 + xxPrime4
+	}
+	if len(p) >= 4 {
+		acc ^= uint64(binary.LittleEndian.Uint32(p)) * xxPrime1
+		acc = bits.RotateLeft64(acc, 23)*xxPrime2 + xxPrime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		acc ^= uint64(b) * xxPrime5
+		acc = bits.RotateLeft64(acc, 11) * xxPrime1
+	}
+
+	acc ^= acc >> 33
+	acc *= xxPrime2
+	acc ^= acc >> 29
+	acc *= xxPrime3
+	acc ^= acc >> 32
+	return acc
+}
+
+// XXHash64Sum returns the 64-bit xxHash of data.
+func XXHash64Sum(data []byte) uint64 {
+	h := NewXXHash64()
+	h.Write(data)
+	return h.Sum64()
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	val = xxRound(0, val)
+	acc ^= val
+	return acc*xxPrime1 + xxPrime4
+}
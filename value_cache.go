@@ -0,0 +1,100 @@
+package lazydb
+
+import (
+	"container/list"
+	"sync"
+)
+
+// valueCache is a LRU cache of values of type String read from log files, bounded by the total size of values.
+// Values are cached by the position of their entries, which are never rewritten in place, so a cached value
+// is never stale: a key written again is indexed to a new position. Positions of overwritten or deleted keys and
+// of removed log files are still invalidated to free the memory early.
+type valueCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	ll       *list.List
+	items    map[uint32]map[int64]*list.Element // fid -> offset -> element
+}
+
+type valueCacheItem struct {
+	fid    uint32
+	offset int64
+	value  []byte
+}
+
+func newValueCache(capacity int64) *valueCache {
+	return &valueCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[uint32]map[int64]*list.Element),
+	}
+}
+
+// get appends the value cached at the position to dst, and marks it as recently used.
+func (c *valueCache) get(fid uint32, offset int64, dst []byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[fid][offset]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	// the value is copied, so that callers are free to modify it
+	value := elem.Value.(*valueCacheItem).value
+	if dst == nil {
+		dst = make([]byte, 0, len(value))
+	}
+	return append(dst, value...), true
+}
+
+// put caches a copy of the value at the position, least recently used values beyond capacity are dropped.
+// Values larger than capacity are not cached.
+func (c *valueCache) put(fid uint32, offset int64, value []byte) {
+	if int64(len(value)) > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[fid][offset]; ok {
+		return
+	}
+	offsets := c.items[fid]
+	if offsets == nil {
+		offsets = make(map[int64]*list.Element)
+		c.items[fid] = offsets
+	}
+	offsets[offset] = c.ll.PushFront(&valueCacheItem{fid: fid, offset: offset, value: append([]byte{}, value...)})
+	c.size += int64(len(value))
+	for c.size > c.capacity {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// remove drops the value cached at the position.
+func (c *valueCache) remove(fid uint32, offset int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[fid][offset]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// removeFile drops all values cached in the log file.
+func (c *valueCache) removeFile(fid uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, elem := range c.items[fid] {
+		c.removeElement(elem)
+	}
+}
+
+func (c *valueCache) removeElement(elem *list.Element) {
+	item := c.ll.Remove(elem).(*valueCacheItem)
+	c.size -= int64(len(item.value))
+	offsets := c.items[item.fid]
+	delete(offsets, item.offset)
+	if len(offsets) == 0 {
+		delete(c.items, item.fid)
+	}
+}
@@ -0,0 +1,146 @@
+package lazydb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_ValueCache(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_value_cache"))
+	cfg.MaxLogFileSize = 500
+	cfg.ValueCacheSize = 4 * 32
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	cached := func(key []byte) bool {
+		val := db.strIndex.idxTree.Get(key).(*Value)
+		_, ok := db.valueCache.get(val.fid, val.offset, nil)
+		return ok
+	}
+
+	key := GetKey(1)
+	value := GetValue32()
+	assert.Nil(t, db.Set(key, value))
+	assert.False(t, cached(key))
+	for i := 0; i < 2; i++ {
+		got, err := db.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, value, got)
+		assert.True(t, cached(key))
+	}
+	// the cached value is copied out
+	got, _ := db.Get(key)
+	got[0] ^= 0xff
+	got, _ = db.Get(key)
+	assert.Equal(t, value, got)
+	got, err = db.GetInto(key, []byte("prefix"))
+	assert.Nil(t, err)
+	assert.Equal(t, append([]byte("prefix"), value...), got)
+
+	// a read after overwrite or delete never returns the cached value
+	for i := 0; i < 20; i++ {
+		value = GetValue32()
+		assert.Nil(t, db.Set(key, value))
+		got, err := db.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, value, got)
+	}
+	assert.Nil(t, db.Delete(key))
+	_, err = db.Get(key)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// least recently read values beyond the size are dropped
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+		_, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+	}
+	assert.LessOrEqual(t, db.valueCache.size, cfg.ValueCacheSize)
+	assert.Equal(t, 4, db.valueCache.ll.Len())
+	assert.True(t, cached(GetKey(9)))
+	assert.False(t, cached(GetKey(0)))
+
+	// values of merged log files are dropped
+	fid := db.strIndex.idxTree.Get(GetKey(6)).(*Value).fid
+	assert.NotEqual(t, db.getActiveLogFile(valueTypeString).lf.Fid, fid)
+	assert.True(t, cached(GetKey(6)))
+	assert.Nil(t, db.Merge(valueTypeString, fid, -1))
+	assert.Nil(t, db.getArchivedLogFile(valueTypeString, fid))
+	assert.Empty(t, db.valueCache.items[fid])
+	for i := 6; i < 10; i++ {
+		_, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+	}
+}
+
+func TestLazyDB_ValueCacheConcurrentOverwrite(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_value_cache_concurrent"))
+	cfg.MaxLogFileSize = 4 << 10
+	cfg.ValueCacheSize = 1 << 10
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			key := GetKey(g)
+			for i := 0; i < 200; i++ {
+				value := []byte(fmt.Sprintf("value-%d-%d", g, i))
+				assert.Nil(t, db.Set(key, value))
+				// read twice, the second one is served by the cache
+				for j := 0; j < 2; j++ {
+					got, err := db.Get(key)
+					assert.Nil(t, err)
+					if !bytes.Equal(value, got) {
+						t.Errorf("stale value %q, want %q", got, value)
+						return
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func BenchmarkLazyDB_GetValueCache(b *testing.B) {
+	for _, size := range []int64{0, 4 << 20} {
+		b.Run(fmt.Sprintf("ValueCacheSize=%d", size), func(b *testing.B) {
+			wd, _ := os.Getwd()
+			cfg := DefaultDBConfig(filepath.Join(wd, "bench_value_cache"))
+			cfg.MaxLogFileSize = 64 << 10
+			cfg.ValueCacheSize = size
+			db, err := Open(cfg)
+			assert.Nil(b, err)
+			defer destroyDB(db)
+
+			// hot keys in archived log files
+			const keys = 1000
+			for i := 0; i < keys; i++ {
+				assert.Nil(b, db.Set(GetKey(i), GetValue(512)))
+			}
+			for i := 0; i < keys; i++ {
+				assert.Nil(b, db.Set(GetKey(keys+i), GetValue(512)))
+			}
+
+			b.ResetTimer()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Get(GetKey(i % keys)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package lazydb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/billsjc123/LazyDB/logfile"
+)
+
+// VerifyReport is the result of Verify.
+type VerifyReport struct {
+	Files     int    // archived log files checked
+	ByFooter  int    // archived log files validated by their footers, without decoding entries
+	Entries   uint64 // entries in archived log files checked
+	Corrupted []CorruptLogFile
+}
+
+// CorruptLogFile an archived log file failing Verify because of Err, which is logfile.ErrFooterMismatch
+// or wraps ErrCorruptedEntry.
+type CorruptLogFile struct {
+	Type valueType
+	Fid  uint32
+	Err  error
+}
+
+// Verify checks the integrity of archived log files of all types. A log file sealed with a footer is validated by
+// the checksum in its footer, which is much faster than decoding entries, others are scanned entry by entry.
+// Log files archived by this process have footers unless they are memory mapped and full,
+// or written by MergeInto later. The active log files are not checked, since they are still being written.
+func (db *LazyDB) Verify() (VerifyReport, error) {
+	var report VerifyReport
+	for _, typ := range db.valueTypes() {
+		mutexFids := db.fidsMap[typ]
+		if mutexFids == nil {
+			continue
+		}
+		mutexFids.mu.RLock()
+		fids := make([]uint32, len(mutexFids.fids))
+		copy(fids, mutexFids.fids)
+		mutexFids.mu.RUnlock()
+		sort.Slice(fids, func(i, j int) bool { return fids[i] < fids[j] })
+
+		for _, fid := range fids {
+			// archived log files removed by merge are skipped
+			mlf := db.getArchivedLogFile(typ, fid)
+			if mlf == nil {
+				continue
+			}
+			entries, err := db.verifyLogFile(typ, mlf)
+			if err == logfile.ErrFooterMismatch || errors.Is(err, ErrCorruptedEntry) {
+				report.Corrupted = append(report.Corrupted, CorruptLogFile{Type: typ, Fid: fid, Err: err})
+			} else if err != nil && err != logfile.ErrNoFooter {
+				return report, err
+			}
+			report.Files++
+			report.Entries += entries
+			if err == nil {
+				report.ByFooter++
+			}
+		}
+	}
+	return report, nil
+}
+
+// verifyLogFile validates the archived log file by its footer, and returns the number of entries.
+// logfile.ErrNoFooter is returned along with the number of entries if it is scanned without a footer.
+func (db *LazyDB) verifyLogFile(typ valueType, mlf *MutexLogFile) (uint64, error) {
+	// MergeInto may append entries into the log file
+	mlf.mu.RLock()
+	defer mlf.mu.RUnlock()
+	lf := mlf.lf
+
+	if err := db.pinLogFile(typ, lf); err != nil {
+		return 0, err
+	}
+	footer, err := lf.VerifyFooter()
+	lf.Mu.RUnlock()
+	if err != logfile.ErrNoFooter {
+		if err != nil {
+			return 0, err
+		}
+		return footer.Entries, nil
+	}
+
+	var entries uint64
+	for offset := int64(0); offset < lf.Offset; {
+		if err := db.pinLogFile(typ, lf); err != nil {
+			return entries, err
+		}
+		_, size, err := lf.ReadLogEntry(offset)
+		lf.Mu.RUnlock()
+		if err == io.EOF || err == logfile.ErrLogEndOfFile {
+			break
+		}
+		if err == logfile.ErrInvalidCrc {
+			return entries, corruptedEntryError(lf.Fid, offset)
+		}
+		if err != nil {
+			return entries, err
+		}
+		entries++
+		offset += int64(size)
+	}
+	return entries, logfile.ErrNoFooter
+}
+
+// verifyMerged checks the log file after its live entries are rewritten by merge, see MergeOptions.Verify.
+// None of its entries may still be indexed, and the entry an index points to instead must be readable and
+// located by the same key. Keys deleted meanwhile are not indexed, and they are not checked.
+func (db *LazyDB) verifyMerged(typ valueType, lf *logfile.LogFile) error {
+	mu := db.getIndexLock(typ)
+	var offset int64
+	for {
+		if err := db.pinLogFile(typ, lf); err != nil {
+			return err
+		}
+		ent, size, err := lf.ReadLogEntry(offset)
+		lf.Mu.RUnlock()
+		if err == io.EOF || err == logfile.ErrLogEndOfFile {
+			return nil
+		}
+		if err != nil {
+			// entries failing the crc check have been skipped by MergeOptions.Force
+			if err == logfile.ErrInvalidCrc {
+				offset += int64(size)
+				continue
+			}
+			return err
+		}
+		// locating members of sets uses the shared hasher
+		mu.Lock()
+		err = db.verifyMergedEntry(typ, lf.Fid, offset, ent)
+		mu.Unlock()
+		if err != nil {
+			return err
+		}
+		offset += int64(size)
+	}
+}
+
+// verifyMergedEntry checks the entry at offset of the merged log file fid. Index lock of the type must be held.
+func (db *LazyDB) verifyMergedEntry(typ valueType, fid uint32, offset int64, ent *logfile.LogEntry) error {
+	if ent.Stat == logfile.SDelete || ent.Stat == logfile.SValueBlob {
+		return nil
+	}
+	idxTree, idxKey := db.locateIndex(typ, ent)
+	if idxTree == nil {
+		return nil
+	}
+	val, _ := idxTree.Get(idxKey).(*Value)
+	if val == nil {
+		return nil
+	}
+	if val.fid == fid {
+		// a newer entry of the key in the log file is checked by itself, and expired entries are left to be
+		// removed lazily
+		if val.offset != offset || (ent.ExpiredAt != 0 && expiredAtMilli(ent.ExpiredAt) <= db.now().UnixMilli()) {
+			return nil
+		}
+		return fmt.Errorf("%w, fid: %d, offset: %d, still indexed", ErrMergeVerification, fid, offset)
+	}
+	// elements of a packed collection share the packed entry
+	if val.packed {
+		return nil
+	}
+	replaced, _, err := db.readLogEntryInto(typ, val.fid, val.offset, nil, time.Time{})
+	if err != nil {
+		return fmt.Errorf("%w, fid: %d, offset: %d, replaced at fid: %d, offset: %d: %v",
+			ErrMergeVerification, fid, offset, val.fid, val.offset, err)
+	}
+	if _, replacedKey := db.locateIndex(typ, replaced); !bytes.Equal(replacedKey, idxKey) {
+		return fmt.Errorf("%w, fid: %d, offset: %d, replaced at fid: %d, offset: %d by another key",
+			ErrMergeVerification, fid, offset, val.fid, val.offset)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_Verify(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_verify"))
+	cfg.MaxLogFileSize = 500
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	typ := valueTypeString
+	for i := 0; i < 40; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+	}
+	report, err := db.Verify()
+	assert.Nil(t, err)
+	assert.Empty(t, report.Corrupted)
+	assert.Greater(t, report.Files, 1)
+	// all archived log files are sealed with footers
+	assert.Equal(t, report.Files, report.ByFooter)
+	var archived uint64
+	assert.Nil(t, db.Tail(typ, 0, 0, func(entry *logfile.LogEntry, pos ValuePos) bool {
+		if pos.Fid() != db.getActiveLogFile(typ).lf.Fid {
+			archived++
+		}
+		return true
+	}))
+	assert.Equal(t, archived, report.Entries)
+
+	// the active log file opened again has no footer when it is archived, it is scanned instead
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue32()))
+	}
+	report, err = db.Verify()
+	assert.Nil(t, err)
+	assert.Empty(t, report.Corrupted)
+	assert.Equal(t, report.Files-1, report.ByFooter)
+
+	// corrupt a byte of the value of the first entry
+	fid := db.fidsMap[typ].fids[0]
+	name := logFileName(cfg.DBPath, logfile.Strs, fid)
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{'!'}, 40)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	report, err = db.Verify()
+	assert.Nil(t, err)
+	assert.Equal(t, []CorruptLogFile{{Type: typ, Fid: fid, Err: logfile.ErrFooterMismatch}}, report.Corrupted)
+}
@@ -0,0 +1,82 @@
+package lazydb
+
+import (
+	"github.com/billsjc123/LazyDB/logfile"
+	"sync/atomic"
+)
+
+// stampVersion sets the version of entry to a new one if DBConfig.VersionedEntries is on and it has no version,
+// entries rewritten by merge or applied from a leader keep their versions.
+func (db *LazyDB) stampVersion(entry *logfile.LogEntry) {
+	if entry.Version != 0 {
+		db.observeVersion(entry.Version)
+		return
+	}
+	if db.cfg.VersionedEntries {
+		entry.Version = db.nextVersion()
+	}
+}
+
+// nextVersion returns a version greater than all versions seen by the db.
+// It is the current time in unix nanoseconds if the clock is ahead, so that versions of writers on different dbs
+// are comparable, and the last writer wins.
+func (db *LazyDB) nextVersion() uint64 {
+	for {
+		last := atomic.LoadUint64(&db.lastVersion)
+		next := uint64(db.now().UnixNano())
+		if next <= last {
+			next = last + 1
+		}
+		if atomic.CompareAndSwapUint64(&db.lastVersion, last, next) {
+			return next
+		}
+	}
+}
+
+// observeVersion makes versions returned by nextVersion greater than version.
+func (db *LazyDB) observeVersion(version uint64) {
+	for {
+		last := atomic.LoadUint64(&db.lastVersion)
+		if version <= last || atomic.CompareAndSwapUint64(&db.lastVersion, last, version) {
+			return
+		}
+	}
+}
+
+// indexedVersion returns the version of the value of entry`s key in the index, zero if the key does not exist.
+// Index lock of the type must be held by the caller.
+func (db *LazyDB) indexedVersion(typ valueType, entry *logfile.LogEntry) uint64 {
+	idxTree, idxKey := db.locateIndex(typ, entry)
+	if idxTree == nil {
+		return 0
+	}
+	if val, _ := idxTree.Get(idxKey).(*Value); val != nil {
+		return val.version
+	}
+	return 0
+}
+
+// replayedNewerVersion returns whether the entry replayed when building indexes is not older than
+// the indexed one of its key, so that the entry of the highest version wins rather than the last replayed one.
+// deleted holds versions of keys deleted by replayed entries, it is updated if the entry is a newer delete.
+// Entries of the same version are resolved by the order they are replayed.
+func (db *LazyDB) replayedNewerVersion(typ valueType, entry *logfile.LogEntry, deleted map[string]uint64) bool {
+	db.observeVersion(entry.Version)
+	_, idxKey := db.locateIndex(typ, entry)
+	if idxKey == nil {
+		return true
+	}
+	current := db.indexedVersion(typ, entry)
+	if v, ok := deleted[string(idxKey)]; ok && v > current {
+		current = v
+	}
+	if entry.Version < current {
+		return false
+	}
+	if entry.Stat == logfile.SDelete {
+		deleted[string(idxKey)] = entry.Version
+	} else {
+		delete(deleted, string(idxKey))
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package lazydb
+
+import (
+	"github.com/billsjc123/LazyDB/logfile"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_VersionedEntries(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_versioned_entries")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 200
+	cfg.VersionedEntries = true
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	// entries written out of order, e.g. by replication or merge
+	write := func(key, value string, version uint64, stat logfile.Status) {
+		entry := &logfile.LogEntry{Key: []byte(key), Value: []byte(value), Version: version, Stat: stat}
+		_, err := db.writeLogEntry(valueTypeString, entry)
+		assert.Nil(t, err)
+	}
+	write("k1", "new", 200, 0)
+	write("k1", "old", 100, 0)
+	// older delete loses
+	write("k2", "v2", 400, 0)
+	write("k2", "", 300, logfile.SDelete)
+	// older put after a delete loses
+	write("k3", "v3", 450, 0)
+	write("k3", "", 500, logfile.SDelete)
+	write("k3", "old", 460, 0)
+	// same version is resolved by order
+	write("k4", "first", 600, 0)
+	write("k4", "second", 600, 0)
+	// unversioned entries, e.g. written before VersionedEntries is on, are older
+	write("k5", "versioned", 700, 0)
+	db.cfg.VersionedEntries = false
+	write("k5", "unversioned", 0, 0)
+	db.cfg.VersionedEntries = true
+	assert.Greater(t, len(db.fidsMap[valueTypeString].fids), 1)
+
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	check := func(key, want string) {
+		val, err := db.Get([]byte(key))
+		if want == "" {
+			assert.Equal(t, ErrKeyNotFound, err, key)
+			return
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, want, string(val), key)
+	}
+	check("k1", "new")
+	check("k2", "v2")
+	check("k3", "")
+	check("k4", "second")
+	check("k5", "versioned")
+
+	// versions of new writes are greater than all replayed ones
+	assert.Nil(t, db.Set([]byte("k1"), []byte("newest")))
+	idxNode := db.strIndex.idxTree.Get([]byte("k1")).(*Value)
+	assert.Greater(t, idxNode.version, uint64(700))
+	version := idxNode.version
+	assert.Nil(t, db.Set([]byte("k1"), []byte("newest")))
+	assert.Greater(t, db.strIndex.idxTree.Get([]byte("k1")).(*Value).version, version)
+	check("k1", "newest")
+}
+
+func TestLazyDB_ApplyEntryVersioned(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_apply_entry_versioned"))
+	cfg.VersionedEntries = true
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	apply := func(value string, version uint64, offset int64) {
+		entry := &logfile.LogEntry{Key: []byte("k"), Value: []byte(value), Version: version}
+		assert.Nil(t, db.ApplyEntry(valueTypeString, entry, ValuePos{fid: 1, offset: offset}))
+	}
+	apply("new", 200, 0)
+	apply("old", 100, 10)
+	val, err := db.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), val)
+	// still advanced
+	pos, ok := db.AppliedPos(valueTypeString)
+	assert.True(t, ok)
+	assert.Equal(t, int64(10), pos.Offset())
+
+	apply("newer", 300, 20)
+	val, err = db.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("newer"), val)
+	assert.Equal(t, uint64(300), db.strIndex.idxTree.Get([]byte("k")).(*Value).version)
+}
+
+func TestLazyDB_UnversionedEntries(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	assert.Nil(t, db.Set(GetKey(1), GetValue32()))
+	assert.Equal(t, uint64(0), db.strIndex.idxTree.Get(GetKey(1)).(*Value).version)
+}
@@ -0,0 +1,139 @@
+package lazydb
+
+import (
+	"github.com/billsjc123/LazyDB/logfile"
+	"time"
+)
+
+// WriteBatch accumulates writes of type String and applies them together by Commit,
+// it is the cheapest way of bulk loading independent keys.
+// Unlike Tx, a batch is not atomic, if Commit fails halfway, writes before the failure are applied and the others are not.
+// A WriteBatch is not safe for concurrent use.
+type WriteBatch struct {
+	db      *LazyDB
+	entries []*logfile.LogEntry
+}
+
+// NewWriteBatch returns an empty batch of db.
+func (db *LazyDB) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{db: db}
+}
+
+// Set adds setting key to hold the string value into the batch, it expires by DBConfig.DefaultTTL.
+func (wb *WriteBatch) Set(key, value []byte) {
+	entry := &logfile.LogEntry{Key: key, Value: value, ExpiredAt: wb.db.defaultExpiredAt(wb.db.now())}
+	wb.entries = append(wb.entries, entry)
+}
+
+// Delete adds deleting key into the batch.
+func (wb *WriteBatch) Delete(key []byte) {
+	wb.entries = append(wb.entries, &logfile.LogEntry{Key: key, Stat: logfile.SDelete})
+}
+
+// Len returns the number of writes in the batch.
+func (wb *WriteBatch) Len() int {
+	return len(wb.entries)
+}
+
+// Reset discards all writes in the batch, so that it can be reused.
+func (wb *WriteBatch) Reset() {
+	wb.entries = wb.entries[:0]
+}
+
+// Commit writes all entries in the batch in order, taking the locks of the index and the active log file once,
+// and syncs them by a single fsync before they become visible, so the batch is durable once Commit returns.
+// Log files are rotated in the middle of the batch if it does not fit into the active one.
+// DBConfig.SkipDuplicateWrites is not applied to batches. The batch is reset after Commit, whether it fails or not.
+func (wb *WriteBatch) Commit() error {
+	db := wb.db
+	defer wb.Reset()
+	if len(wb.entries) == 0 {
+		return nil
+	}
+	if db.readOnly() {
+		return ErrReadOnly
+	}
+	// nothing is written if any key is denied
+	if err := db.checkEntriesAccess(OpWrite, wb.entries); err != nil {
+		return err
+	}
+
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+	if err := db.evict(); err != nil {
+		return err
+	}
+
+	positions, err := db.writeLogEntries(valueTypeString, wb.entries)
+	// apply written entries even if the batch fails halfway
+	for i, pos := range positions {
+		if applyErr := db.applyBatchEntry(wb.entries[i], pos); applyErr != nil && err == nil {
+			err = applyErr
+		}
+	}
+	return err
+}
+
+// applyBatchEntry updates the index of type String with an entry written by WriteBatch.Commit.
+// Lock of strIndex must be held by the caller.
+func (db *LazyDB) applyBatchEntry(entry *logfile.LogEntry, pos *ValuePos) error {
+	if entry.Stat != logfile.SDelete {
+		return db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, pos, true)
+	}
+	delVal, updated := db.strIndex.idxTree.Delete(entry.Key)
+	db.replaceStrValue(entry.Key, delVal, nil)
+	if err := db.sendDiscard(delVal, updated, valueTypeString); err != nil {
+		return err
+	}
+	// also merge the delete entry
+	return db.sendDiscard(&Value{fid: pos.fid, entrySize: pos.entrySize}, true, valueTypeString)
+}
+
+// writeLogEntries is like writeLogEntry, but writes entries in order with the active log file locked once,
+// and syncs them at the end. It returns positions of entries written before an error.
+func (db *LazyDB) writeLogEntries(typ valueType, entries []*logfile.LogEntry) ([]*ValuePos, error) {
+	if db.readOnly() {
+		return nil, ErrReadOnly
+	}
+	// nothing is written if any key is too large
+	for _, entry := range entries {
+		if err := db.checkKeySize(entry); err != nil {
+			return nil, err
+		}
+	}
+	activeLogFile := db.getActiveLogFile(typ)
+	if activeLogFile == nil {
+		return nil, ErrOpenLogFile
+	}
+	activeLogFile.mu.Lock()
+	defer activeLogFile.mu.Unlock()
+
+	positions := make([]*ValuePos, 0, len(entries))
+	for _, entry := range entries {
+		db.stampVersion(entry)
+		db.stampWrittenAt(entry)
+		entBuf, entSize := db.encodeEntry(entry)
+		// maxsize or max age exceeded, the archived log file is synced by rotating
+		if db.shouldRotate(activeLogFile, entSize) {
+			if err := db.rotateActiveLogFile(typ, activeLogFile, time.Time{}); err != nil {
+				return positions, err
+			}
+		}
+		lf := activeLogFile.lf
+		writeAt := lf.Offset
+		if err := lf.Write(entBuf); err != nil {
+			return positions, err
+		}
+		if activeLogFile.footer != nil {
+			activeLogFile.footer.Add(entry.Key, entBuf)
+		}
+		db.recordWrite(entSize)
+		pos := &ValuePos{fid: lf.Fid, offset: writeAt, entrySize: entSize}
+		if err := db.appendIndexRecord(typ, activeLogFile, entry, pos); err != nil {
+			return positions, err
+		}
+		activeLogFile.last = *pos
+		positions = append(positions, pos)
+	}
+	return positions, activeLogFile.lf.Sync()
+}
@@ -0,0 +1,113 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteBatch_Commit(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_write_batch")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 500
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	assert.Nil(t, db.Set(GetKey(0), GetValue32()))
+	wb := db.NewWriteBatch()
+	for i := 1; i <= 50; i++ {
+		wb.Set(GetKey(i), GetValue32())
+	}
+	wb.Set(GetKey(1), []byte("v1"))
+	wb.Delete(GetKey(0))
+	wb.Delete(GetKey(2))
+	assert.Equal(t, 53, wb.Len())
+
+	// not visible before commit
+	_, err = db.Get(GetKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	fids := len(db.fidsMap[valueTypeString].fids)
+	assert.Nil(t, wb.Commit())
+	assert.Equal(t, 0, wb.Len())
+	// rolled over in the middle of the batch
+	assert.Greater(t, len(db.fidsMap[valueTypeString].fids), fids)
+
+	check := func() {
+		val, err := db.Get(GetKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v1"), val)
+		for _, i := range []int{0, 2} {
+			_, err = db.Get(GetKey(i))
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+		for i := 3; i <= 50; i++ {
+			_, err = db.Get(GetKey(i))
+			assert.Nil(t, err)
+		}
+	}
+	check()
+
+	// empty batch
+	assert.Nil(t, wb.Commit())
+
+	// recovered after reopen
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	check()
+}
+
+func TestWriteBatch_Reset(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	wb := db.NewWriteBatch()
+	wb.Set(GetKey(1), GetValue32())
+	wb.Reset()
+	assert.Equal(t, 0, wb.Len())
+	assert.Nil(t, wb.Commit())
+	_, err := db.Get(GetKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func BenchmarkLazyDB_Set(b *testing.B) {
+	db := initTestDB()
+	defer destroyDB(db)
+	value := GetValue(512)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := db.Set(GetKey(i), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+	// make the writes durable like a batch
+	if err := db.Sync(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkWriteBatch_Commit(b *testing.B) {
+	db := initTestDB()
+	defer destroyDB(db)
+	value := GetValue(512)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	wb := db.NewWriteBatch()
+	for i := 0; i < b.N; i++ {
+		wb.Set(GetKey(i), value)
+	}
+	if err := wb.Commit(); err != nil {
+		b.Fatal(err)
+	}
+}
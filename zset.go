@@ -7,11 +7,16 @@ import (
 	"github.com/billsjc123/LazyDB/util"
 	"github.com/gansidui/skiplist"
 	"log"
+	"math"
+	"time"
 )
 
 var (
 	ErrZSetKeyNotExist    = errors.New("zset key not exist")
 	ErrZSetMemberNotExist = errors.New("zset member not exist")
+	ErrInvalidLexRange    = errors.New("min or max is not valid string range item")
+	// ErrNaNScore is returned if a score is NaN, or an increment results in NaN, e.g. +inf plus -inf.
+	ErrNaNScore = errors.New("score is not a number")
 )
 
 type ZSetIndex struct {
@@ -19,6 +24,12 @@ type ZSetIndex struct {
 	skl  *skiplist.SkipList
 }
 
+// ZMember is a member of sorted set with its score.
+type ZMember struct {
+	Member []byte
+	Score  float64
+}
+
 type Node struct {
 	score  float64
 	member string
@@ -28,68 +39,210 @@ func (n *Node) Less(other interface{}) bool {
 	if n.score < other.(*Node).score {
 		return true
 	}
-	if n.score == other.(*Node).score && len(n.member) < len(other.(*Node).member) {
+	// members with equal score are ordered lexicographically, see ZRangeByLex
+	if n.score == other.(*Node).score && n.member < other.(*Node).member {
 		return true
 	}
 	return false
 }
 
 // ZAdd adds the specified member with the specified score to the sorted set stored at key.
+// Scores may be +inf or -inf, which are ordered after and before all other scores, but not NaN.
 func (db *LazyDB) ZAdd(key []byte, args ...[]byte) error {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return err
+	}
 	if len(args)&1 == 1 {
 		return ErrInvalidParam
 	}
 	if len(args) == 0 {
 		return nil
 	}
+	for i := 0; i < len(args); i += 2 {
+		if math.IsNaN(util.ByteToFloat64(args[i])) {
+			return ErrNaNScore
+		}
+	}
+	db.zSetIndex.mu.Lock()
+	defer db.zSetIndex.mu.Unlock()
+
+	pairs := make([][]byte, 0, len(args))
+	for i := 0; i < len(args); i += 2 {
+		pairs = append(pairs, args[i+1], args[i])
+	}
+	if err := db.zAddPairs(key, pairs); err != nil {
+		return err
+	}
+	// wake up ZPopMinTimeout waiting for members
+	db.zSetIndex.cond.Broadcast()
+	return nil
+}
+
+// ZAddFlags are options of ZAddWithFlags, which are the same as those of Redis ZADD.
+type ZAddFlags uint8
+
+const (
+	// ZAddNX only adds new members, and never updates existing ones.
+	ZAddNX ZAddFlags = 1 << iota
+	// ZAddXX only updates existing members, and never adds new ones.
+	ZAddXX
+	// ZAddGT only updates existing members if the new score is greater than the current one, new members are still added.
+	ZAddGT
+	// ZAddLT only updates existing members if the new score is less than the current one, new members are still added.
+	ZAddLT
+	// ZAddCH counts changed members, i.e. added ones and those whose score is updated, rather than only added ones.
+	ZAddCH
+)
+
+// ErrZAddFlagsConflict is returned by ZAddWithFlags if more than one of ZAddNX, ZAddGT and ZAddLT,
+// or both ZAddNX and ZAddXX are specified.
+var ErrZAddFlagsConflict = errors.New("zadd flags conflict")
+
+// ZAddWithFlags is like ZAdd, but members are added or updated as specified by flags.
+// It returns the number of added members, or the number of changed members if ZAddCH is specified.
+// Members whose score does not change are neither written nor counted.
+func (db *LazyDB) ZAddWithFlags(key []byte, flags ZAddFlags, members ...ZMember) (int, error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return 0, err
+	}
+	nx, xx, gt, lt := flags&ZAddNX != 0, flags&ZAddXX != 0, flags&ZAddGT != 0, flags&ZAddLT != 0
+	if (nx && xx) || (gt && lt) || (nx && (gt || lt)) {
+		return 0, ErrZAddFlagsConflict
+	}
+	if len(members) == 0 {
+		return 0, nil
+	}
+	for _, zMember := range members {
+		if math.IsNaN(zMember.Score) {
+			return 0, ErrNaNScore
+		}
+		if err := db.checkSubKeySizes(key, zMember.Member); err != nil {
+			return 0, err
+		}
+	}
 	db.zSetIndex.mu.Lock()
 	defer db.zSetIndex.mu.Unlock()
 
+	var added, updated int
+	var pairs [][]byte
+	// scores of members given more than once are the ones to be written
+	written := make(map[string][]byte)
+	idx := db.zSetIndex.indexes[util.ByteToString(key)]
+	for _, zMember := range members {
+		oriScore, ok := written[util.ByteToString(zMember.Member)]
+		if !ok && idx != nil && idx.tree != nil {
+			score, err := db.getValue(idx.tree, db.encodeKey(key, zMember.Member), valueTypeZSet)
+			if err != nil && err != ErrKeyNotFound {
+				return 0, err
+			}
+			oriScore = score
+		}
+
+		if oriScore == nil {
+			if xx {
+				continue
+			}
+			added++
+		} else {
+			cur := util.ByteToFloat64(oriScore)
+			if nx || cur == zMember.Score || (gt && zMember.Score <= cur) || (lt && zMember.Score >= cur) {
+				continue
+			}
+			updated++
+		}
+		score := util.Float64ToByte(zMember.Score)
+		written[util.ByteToString(zMember.Member)] = score
+		pairs = append(pairs, zMember.Member, score)
+	}
+	if len(pairs) > 0 {
+		if err := db.zAddPairs(key, pairs); err != nil {
+			return 0, err
+		}
+	}
+	if added > 0 {
+		// wake up ZPopMinTimeout waiting for members
+		db.zSetIndex.cond.Broadcast()
+	}
+	if flags&ZAddCH != 0 {
+		return added + updated, nil
+	}
+	return added, nil
+}
+
+// getOrCreateZSetIndex returns the index of the sorted set stored at key, which is created if it does not exist.
+// Lock of zSetIndex must be held by the caller.
+func (db *LazyDB) getOrCreateZSetIndex(key []byte) *ZSetIndex {
 	strKey := util.ByteToString(key)
 	if db.zSetIndex.indexes[strKey] == nil {
-		tree := ds.NewART()
-		skl := skiplist.New()
-		db.zSetIndex.indexes[strKey] = &ZSetIndex{
-			tree: tree,
-			skl:  skl,
+		db.zSetIndex.indexes[string(key)] = &ZSetIndex{
+			tree: ds.NewART(),
+			skl:  skiplist.New(),
 		}
+		db.indexKey(valueTypeZSet, key, nil)
 	}
-	tree := db.zSetIndex.indexes[strKey].tree
-	skl := db.zSetIndex.indexes[strKey].skl
-	for i := 0; i < len(args); i += 2 {
-		score, member := args[i], args[i+1]
-		zsetKey := encodeKey(key, member)
-		entry := &logfile.LogEntry{Key: zsetKey, Value: score}
-		valPos, err := db.writeLogEntry(valueTypeZSet, entry)
-		if err != nil {
+	return db.zSetIndex.indexes[strKey]
+}
+
+// zAddPairs writes members with scores of pairs into the sorted set stored at key, which is created if it does not
+// exist, and packed if it is small, see DBConfig.PackSmallZSets.
+// Lock of zSetIndex must be held by the caller.
+func (db *LazyDB) zAddPairs(key []byte, pairs [][]byte) error {
+	idx := db.getOrCreateZSetIndex(key)
+	if packed, err := db.zAddPacked(key, idx, pairs); packed || err != nil {
+		return err
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		if err := db.zAddMember(key, idx, pairs[i], pairs[i+1]); err != nil {
 			return err
 		}
-		if tree.Get(zsetKey) != nil {
-			oriScore, err := db.getValue(tree, zsetKey, valueTypeZSet)
-			if err != nil {
-				return err
-			}
-			skl.Delete(&Node{score: util.ByteToFloat64(oriScore), member: util.ByteToString(member)})
-		}
-		err = db.updateIndexTree(valueTypeZSet, tree, entry, valPos, true)
+	}
+	return nil
+}
+
+// zAddMember writes member with score into the sorted set idx stored at key, replacing its current score if any.
+// Lock of zSetIndex must be held by the caller.
+func (db *LazyDB) zAddMember(key []byte, idx *ZSetIndex, member, score []byte) error {
+	zsetKey := db.encodeKey(key, member)
+	entry := &logfile.LogEntry{Key: zsetKey, Value: score}
+	valPos, err := db.writeLogEntry(valueTypeZSet, entry)
+	if err != nil {
+		return err
+	}
+	if idx.tree.Get(zsetKey) != nil {
+		oriScore, err := db.getValue(idx.tree, zsetKey, valueTypeZSet)
 		if err != nil {
 			return err
 		}
-		skl.Insert(&Node{score: util.ByteToFloat64(score), member: util.ByteToString(member)})
+		idx.skl.Delete(&Node{score: util.ByteToFloat64(oriScore), member: util.ByteToString(member)})
+	}
+	err = db.updateIndexTree(valueTypeZSet, idx.tree, entry, valPos, true)
+	if err != nil {
+		return err
 	}
+	idx.skl.Insert(&Node{score: util.ByteToFloat64(score), member: util.ByteToString(member)})
 	return nil
 }
 
 // ZScore returns the score of member in the sorted set at key.
 func (db *LazyDB) ZScore(key, member []byte) (score float64, err error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return 0, err
+	}
 	db.zSetIndex.mu.RLock()
 	defer db.zSetIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeZSet, key); err != nil {
+		return 0, err
+	}
+	return db.zScore(key, member)
+}
 
+// zScore returns the score of member in the sorted set at key, lock of zSetIndex must be held by the caller.
+func (db *LazyDB) zScore(key, member []byte) (float64, error) {
 	idx := db.zSetIndex.indexes[util.ByteToString(key)]
 	if idx == nil || idx.tree == nil {
 		return 0, ErrZSetKeyNotExist
 	}
-	zsetKey := encodeKey(key, member)
+	zsetKey := db.encodeKey(key, member)
 	val, err := db.getValue(idx.tree, zsetKey, valueTypeZSet)
 	if err != nil {
 		return 0, ErrZSetMemberNotExist
@@ -98,25 +251,60 @@ func (db *LazyDB) ZScore(key, member []byte) (score float64, err error) {
 	return util.ByteToFloat64(val), nil
 }
 
+// ZExistsKey returns whether the sorted set stored at key exists, only the index of ZSet is looked up unlike Exists.
+func (db *LazyDB) ZExistsKey(key []byte) bool {
+	return db.typedKeyExists(valueTypeZSet, key)
+}
+
 // ZCard returns the sorted set cardinality (number of elements) of the sorted set stored at key.
-func (db *LazyDB) ZCard(key []byte) int {
+func (db *LazyDB) ZCard(key []byte) (int, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return 0, err
+	}
 	db.zSetIndex.mu.RLock()
 	defer db.zSetIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeZSet, key); err != nil {
+		return 0, err
+	}
 
 	idx := db.zSetIndex.indexes[util.ByteToString(key)]
 	if idx == nil || idx.tree == nil {
-		return 0
+		return 0, nil
+	}
+	return idx.tree.Size(), nil
+}
+
+// ZRandMember returns count random members along with their scores of the sorted set stored at key
+// like ZRANDMEMBER of Redis, members are picked the same way as SRandMember.
+func (db *LazyDB) ZRandMember(key []byte, count int) ([]ZMember, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
+	members, scores, err := db.ZRangeWithScores(key, 0, -1)
+	if err != nil {
+		return nil, err
 	}
-	return idx.tree.Size()
+
+	var picked []ZMember
+	for _, i := range db.randPick(len(members), count) {
+		picked = append(picked, ZMember{Member: members[i], Score: scores[i]})
+	}
+	return picked, nil
 }
 
 // ZRank returns the rank of member in the sorted set stored at key, with the scores ordered from low to high.
 // The rank (or index) is 0-based, which means that the member with the lowest score has rank 0.
 func (db *LazyDB) ZRank(key, member []byte) (rank int, err error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return 0, err
+	}
 	db.zSetIndex.mu.RLock()
 	defer db.zSetIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeZSet, key); err != nil {
+		return 0, err
+	}
 
-	score, err := db.ZScore(key, member)
+	score, err := db.zScore(key, member)
 	if err != nil {
 		return -1, err
 	}
@@ -127,10 +315,16 @@ func (db *LazyDB) ZRank(key, member []byte) (rank int, err error) {
 // ZRevRank returns the rank of member in the sorted set stored at key, with the scores ordered from high to low.
 // The rank (or index) is 0-based, which means that the member with the highest score has rank 0.
 func (db *LazyDB) ZRevRank(key, member []byte) (rank int, err error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return 0, err
+	}
 	db.zSetIndex.mu.RLock()
 	defer db.zSetIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeZSet, key); err != nil {
+		return 0, err
+	}
 
-	score, err := db.ZScore(key, member)
+	score, err := db.zScore(key, member)
 	if err != nil {
 		return -1, err
 	}
@@ -139,13 +333,19 @@ func (db *LazyDB) ZRevRank(key, member []byte) (rank int, err error) {
 }
 
 // ZRange returns the specified range of elements in the sorted set stored at <key>.
-func (db *LazyDB) ZRange(key []byte, start, stop int) (members [][]byte) {
+func (db *LazyDB) ZRange(key []byte, start, stop int) (members [][]byte, err error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
 	db.zSetIndex.mu.RLock()
 	defer db.zSetIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeZSet, key); err != nil {
+		return nil, err
+	}
 
 	idx := db.zSetIndex.indexes[util.ByteToString(key)]
 	if idx == nil || idx.skl == nil {
-		return nil
+		return nil, nil
 	}
 	if start < 0 {
 		start += idx.skl.Len()
@@ -161,17 +361,23 @@ func (db *LazyDB) ZRange(key []byte, start, stop int) (members [][]byte) {
 		members = append(members, util.StringToByte(e.Value.(*Node).member))
 		e = e.Next()
 	}
-	return members
+	return members, nil
 }
 
 // ZRangeWithScores returns the specified range of elements in the sorted set stored at key.
-func (db *LazyDB) ZRangeWithScores(key []byte, start, stop int) (members [][]byte, scores []float64) {
+func (db *LazyDB) ZRangeWithScores(key []byte, start, stop int) (members [][]byte, scores []float64, err error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, nil, err
+	}
 	db.zSetIndex.mu.RLock()
 	defer db.zSetIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeZSet, key); err != nil {
+		return nil, nil, err
+	}
 
 	idx := db.zSetIndex.indexes[util.ByteToString(key)]
 	if idx == nil || idx.skl == nil {
-		return nil, nil
+		return nil, nil, nil
 	}
 	if start < 0 {
 		start += idx.skl.Len()
@@ -188,19 +394,25 @@ func (db *LazyDB) ZRangeWithScores(key []byte, start, stop int) (members [][]byt
 		scores = append(scores, e.Value.(*Node).score)
 		e = e.Next()
 	}
-	return members, scores
+	return members, scores, nil
 }
 
 // ZRevRange returns the specified range of elements in the sorted set stored at key.
 // The elements are considered to be ordered from the highest to the lowest score.
 // Descending lexicographical order is used for elements with equal score.
-func (db *LazyDB) ZRevRange(key []byte, start, stop int) (members [][]byte) {
+func (db *LazyDB) ZRevRange(key []byte, start, stop int) (members [][]byte, err error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
 	db.zSetIndex.mu.RLock()
 	defer db.zSetIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeZSet, key); err != nil {
+		return nil, err
+	}
 
 	idx := db.zSetIndex.indexes[util.ByteToString(key)]
 	if idx == nil || idx.skl == nil {
-		return nil
+		return nil, nil
 	}
 	if start < 0 {
 		start += idx.skl.Len()
@@ -216,19 +428,25 @@ func (db *LazyDB) ZRevRange(key []byte, start, stop int) (members [][]byte) {
 		members = append(members, util.StringToByte(e.Value.(*Node).member))
 		e = e.Prev()
 	}
-	return members
+	return members, nil
 }
 
 // ZRevRangeWithScores returns the specified range of elements in the sorted set stored at key.
 // The elements are considered to be ordered from the highest to the lowest score.
 // Descending lexicographical order is used for elements with equal score.
-func (db *LazyDB) ZRevRangeWithScores(key []byte, start, stop int) (members [][]byte, scores []float64) {
+func (db *LazyDB) ZRevRangeWithScores(key []byte, start, stop int) (members [][]byte, scores []float64, err error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, nil, err
+	}
 	db.zSetIndex.mu.RLock()
 	defer db.zSetIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeZSet, key); err != nil {
+		return nil, nil, err
+	}
 
 	idx := db.zSetIndex.indexes[util.ByteToString(key)]
 	if idx == nil || idx.skl == nil {
-		return nil, nil
+		return nil, nil, nil
 	}
 	if start < 0 {
 		start += idx.skl.Len()
@@ -245,13 +463,116 @@ func (db *LazyDB) ZRevRangeWithScores(key []byte, start, stop int) (members [][]
 		scores = append(scores, e.Value.(*Node).score)
 		e = e.Prev()
 	}
-	return members, scores
+	return members, scores, nil
+}
+
+// lexBound a bound of the range of ZRangeByLex.
+type lexBound struct {
+	value     string
+	exclusive bool
+	inf       int // -1 for "-", 1 for "+", 0 if value is the bound
+}
+
+// parseLexBound parses a bound like Redis, it must start with "[" or "(", or be "-" or "+".
+func parseLexBound(b []byte) (lexBound, error) {
+	if len(b) == 0 {
+		return lexBound{}, ErrInvalidLexRange
+	}
+	switch b[0] {
+	case '-', '+':
+		if len(b) != 1 {
+			return lexBound{}, ErrInvalidLexRange
+		}
+		if b[0] == '-' {
+			return lexBound{inf: -1}, nil
+		}
+		return lexBound{inf: 1}, nil
+	case '[', '(':
+		return lexBound{value: string(b[1:]), exclusive: b[0] == '('}, nil
+	}
+	return lexBound{}, ErrInvalidLexRange
+}
+
+// aboveMin returns whether member is not less than min.
+func (min lexBound) aboveMin(member string) bool {
+	if min.inf != 0 {
+		return min.inf < 0
+	}
+	if min.exclusive {
+		return member > min.value
+	}
+	return member >= min.value
+}
+
+// belowMax returns whether member is not greater than max.
+func (max lexBound) belowMax(member string) bool {
+	if max.inf != 0 {
+		return max.inf > 0
+	}
+	if max.exclusive {
+		return member < max.value
+	}
+	return member <= max.value
+}
+
+// ZRangeByLex returns members of the sorted set stored at key between min and max in lexicographical order
+// like ZRANGEBYLEX of Redis, all members are expected to have the same score. A bound starting with "[" is inclusive
+// and one starting with "(" is exclusive, "-" and "+" are the lowest and highest bounds.
+// The first offset members in the range are skipped, and all of the rest are returned if count is negative.
+func (db *LazyDB) ZRangeByLex(key []byte, min, max []byte, offset, count int) ([][]byte, error) {
+	if err := db.checkAccess(OpRead, key); err != nil {
+		return nil, err
+	}
+	minBound, err := parseLexBound(min)
+	if err != nil {
+		return nil, err
+	}
+	maxBound, err := parseLexBound(max)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || count == 0 {
+		return nil, nil
+	}
+	db.zSetIndex.mu.RLock()
+	defer db.zSetIndex.mu.RUnlock()
+	if err := db.checkType(valueTypeZSet, key); err != nil {
+		return nil, err
+	}
+
+	idx := db.zSetIndex.indexes[util.ByteToString(key)]
+	if idx == nil || idx.skl == nil {
+		return nil, nil
+	}
+	var members [][]byte
+	for e := idx.skl.Front(); e != nil; e = e.Next() {
+		member := e.Value.(*Node).member
+		if !minBound.aboveMin(member) {
+			continue
+		}
+		if !maxBound.belowMax(member) {
+			break
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		members = append(members, []byte(member))
+		if count > 0 && len(members) == count {
+			break
+		}
+	}
+	return members, nil
 }
 
 // ZIncrBy increments the score of member in the sorted set stored at key by increment.
 // If member does not exist in the sorted set, it is added with increment as its score (as if its previous score was 0.0).
 // If key does not exist, a new sorted set with the specified member as its sole member is created.
+// ErrNaNScore is returned and nothing is written if increment is NaN, or the new score would be NaN, e.g. +inf plus -inf.
 func (db *LazyDB) ZIncrBy(key []byte, increment float64, member []byte) (float64, error) {
+	if math.IsNaN(increment) {
+		return 0, ErrNaNScore
+	}
 	score, _ := db.ZScore(key, member)
 	err := db.ZAdd(key, util.Float64ToByte(score+increment), member)
 	if err != nil {
@@ -263,6 +584,9 @@ func (db *LazyDB) ZIncrBy(key []byte, increment float64, member []byte) (float64
 // ZRem removes the specified members from the sorted set stored at key. Non existing members are ignored.
 // An error is returned when key exists and does not hold a sorted set.
 func (db *LazyDB) ZRem(key []byte, members ...[]byte) (number int, err error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return 0, err
+	}
 	db.zSetIndex.mu.Lock()
 	defer db.zSetIndex.mu.Unlock()
 
@@ -270,9 +594,19 @@ func (db *LazyDB) ZRem(key []byte, members ...[]byte) (number int, err error) {
 	if idx == nil || idx.tree == nil {
 		return 0, nil
 	}
+	return db.zRem(key, idx, members...)
+}
+
+// zRem removes the members from the sorted set idx stored at key.
+// Lock of zSetIndex must be held by the caller.
+func (db *LazyDB) zRem(key []byte, idx *ZSetIndex, members ...[]byte) (int, error) {
+	if count, packed, err := db.zRemPacked(key, idx, members); packed || err != nil {
+		db.removeEmptyZSet(key, idx)
+		return count, err
+	}
 	var count int
 	for _, member := range members {
-		zSetKey := encodeKey(key, member)
+		zSetKey := db.encodeKey(key, member)
 		entry := &logfile.LogEntry{Key: zSetKey, Stat: logfile.SDelete}
 		pos, err := db.writeLogEntry(valueTypeZSet, entry)
 		if err != nil {
@@ -291,7 +625,7 @@ func (db *LazyDB) ZRem(key []byte, members ...[]byte) (number int, err error) {
 		// delete invalid entry
 		db.sendDiscard(val, updated, valueTypeZSet)
 		// also merge the delete entry
-		_, size := logfile.EncodeEntry(entry)
+		size := db.entrySize(entry)
 		node := &Value{fid: pos.fid, entrySize: size}
 		select {
 		case db.discardsMap[valueTypeZSet].valChan <- node:
@@ -299,95 +633,212 @@ func (db *LazyDB) ZRem(key []byte, members ...[]byte) (number int, err error) {
 			log.Fatal("send discard fail")
 		}
 	}
+	db.removeEmptyZSet(key, idx)
 	return count, nil
 }
 
-// ZPopMax Removes and returns up to count members with the highest scores in the sorted set stored at key.
-// When left unspecified, the default value for count is 1.
-// Specifying a count value that is higher than the sorted set's cardinality will not produce an error.
-func (db *LazyDB) ZPopMax(key []byte) ([]byte, float64, error) {
+// removeEmptyZSet removes the sorted set idx stored at key from index if it has no members,
+// so that it does not exist any more. Lock of zSetIndex must be held by the caller.
+func (db *LazyDB) removeEmptyZSet(key []byte, idx *ZSetIndex) {
+	if idx.tree.Size() == 0 {
+		delete(db.zSetIndex.indexes, util.ByteToString(key))
+		db.unindexKey(valueTypeZSet, key)
+	}
+}
+
+// ZPopMax removes and returns up to count members with the highest scores in the sorted set stored at key,
+// the member with the highest score comes first. Members are removed atomically with their tombstones written.
+// Specifying a count value that is higher than the sorted set's cardinality will not produce an error,
+// and nothing is returned if count is not positive or key does not exist.
+func (db *LazyDB) ZPopMax(key []byte, count int) ([]ZMember, error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return nil, err
+	}
 	db.zSetIndex.mu.Lock()
+	defer db.zSetIndex.mu.Unlock()
+	return db.zPop(key, count, true)
+}
 
-	idx := db.zSetIndex.indexes[util.ByteToString(key)]
-	if idx == nil || idx.tree == nil || idx.skl == nil || idx.skl.Len() == 0 {
-		return nil, 0, nil
+// ZPopMaxWithCount is like ZPopMax, but returns members and scores separately.
+func (db *LazyDB) ZPopMaxWithCount(key []byte, count int) (members [][]byte, scores []float64, err error) {
+	zMembers, err := db.ZPopMax(key, count)
+	if err != nil {
+		return nil, nil, err
 	}
-	element := idx.skl.GetElementByRank(idx.skl.Len())
-	member := element.Value.(*Node).member
-	score := element.Value.(*Node).score
+	members, scores = splitZMembers(zMembers)
+	return
+}
 
-	db.zSetIndex.mu.Unlock()
+// ZPopMin removes and returns up to count members with the lowest scores in the sorted set stored at key,
+// the member with the lowest score comes first. Members are removed atomically with their tombstones written.
+// Specifying a count value that is higher than the sorted set's cardinality will not produce an error,
+// and nothing is returned if count is not positive or key does not exist.
+func (db *LazyDB) ZPopMin(key []byte, count int) ([]ZMember, error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return nil, err
+	}
+	db.zSetIndex.mu.Lock()
+	defer db.zSetIndex.mu.Unlock()
+	return db.zPop(key, count, false)
+}
 
-	_, err := db.ZRem(key, util.StringToByte(member))
+// ZPopMinWithCount is like ZPopMin, but returns members and scores separately.
+func (db *LazyDB) ZPopMinWithCount(key []byte, count int) (members [][]byte, scores []float64, err error) {
+	zMembers, err := db.ZPopMin(key, count)
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, err
 	}
-	return util.StringToByte(member), score, nil
+	members, scores = splitZMembers(zMembers)
+	return
 }
 
-func (db *LazyDB) ZPopMaxWithCount(key []byte, count int) (members [][]byte, scores []float64, err error) {
+// ZPopMinTimeout removes and returns the member with the lowest score in the sorted set stored at key,
+// it waits up to timeout for a member to be added by ZAdd if the sorted set is empty, so that the sorted set can be
+// used as a priority queue. It returns false if no member is popped before timeout, and does not wait if timeout
+// is not positive.
+func (db *LazyDB) ZPopMinTimeout(key []byte, timeout time.Duration) (ZMember, bool, error) {
+	if err := db.checkAccess(OpWrite, key); err != nil {
+		return ZMember{}, false, err
+	}
+	deadline := time.Now().Add(timeout)
 	db.zSetIndex.mu.Lock()
+	defer db.zSetIndex.mu.Unlock()
 
-	idx := db.zSetIndex.indexes[util.ByteToString(key)]
-	if idx == nil || idx.tree == nil || idx.skl == nil {
-		return nil, nil, nil
+	// wake up the waiter on timeout, the lock makes sure it is waiting then
+	timer := time.AfterFunc(timeout, func() {
+		db.zSetIndex.mu.Lock()
+		db.zSetIndex.cond.Broadcast()
+		db.zSetIndex.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	for {
+		zMembers, err := db.zPop(key, 1, false)
+		if err != nil {
+			return ZMember{}, false, err
+		}
+		if len(zMembers) > 0 {
+			return zMembers[0], true, nil
+		}
+		if !time.Now().Before(deadline) {
+			return ZMember{}, false, nil
+		}
+		db.zSetIndex.cond.Wait()
 	}
-	count = util.Min(count, idx.skl.Len())
+}
 
-	db.zSetIndex.mu.Unlock()
+// ZMPop removes and returns up to count members from the first non-empty sorted set of keys, checked in the given order,
+// the members with the highest scores if max is true, or those with the lowest scores otherwise, like ZPopMax and ZPopMin.
+// numkeys must be the number of keys. It returns a nil key if all of the sorted sets are empty.
+func (db *LazyDB) ZMPop(numkeys int, keys [][]byte, max bool, count int) (key []byte, members []ZMember, err error) {
+	if err := db.checkAccess(OpWrite, keys...); err != nil {
+		return nil, nil, err
+	}
+	if numkeys <= 0 || numkeys != len(keys) || count <= 0 {
+		return nil, nil, ErrInvalidParam
+	}
+	db.zSetIndex.mu.Lock()
+	defer db.zSetIndex.mu.Unlock()
 
-	for i := 0; i < count; i++ {
-		member, score, err := db.ZPopMax(key)
+	for _, key := range keys {
+		idx := db.zSetIndex.indexes[util.ByteToString(key)]
+		if idx == nil || idx.skl == nil || idx.skl.Len() == 0 {
+			continue
+		}
+		members, err = db.zPop(key, count, max)
 		if err != nil {
 			return nil, nil, err
 		}
-		members = append(members, member)
-		scores = append(scores, score)
+		return key, members, nil
 	}
-	return
+	return nil, nil, nil
 }
 
-// ZPopMin Removes and returns up to count members with the lowest scores in the sorted set stored at key.
-// When left unspecified, the default value for count is 1.
-// Specifying a count value that is higher than the sorted set's cardinality will not produce an error.
-func (db *LazyDB) ZPopMin(key []byte) ([]byte, float64, error) {
-	db.zSetIndex.mu.Lock()
-
+// zPop removes and returns up to count members with the highest or lowest scores.
+// Lock of zSetIndex must be held by the caller.
+func (db *LazyDB) zPop(key []byte, count int, max bool) ([]ZMember, error) {
 	idx := db.zSetIndex.indexes[util.ByteToString(key)]
-	if idx == nil || idx.tree == nil || idx.skl == nil || idx.skl.Len() == 0 {
-		return nil, 0, nil
+	if count <= 0 || idx == nil || idx.tree == nil || idx.skl == nil {
+		return nil, nil
 	}
-	element := idx.skl.GetElementByRank(1)
-	member := element.Value.(*Node).member
-	score := element.Value.(*Node).score
-
-	db.zSetIndex.mu.Unlock()
+	count = util.Min(count, idx.skl.Len())
 
-	_, err := db.ZRem(key, util.StringToByte(member))
-	if err != nil {
-		return nil, 0, err
+	zMembers := make([]ZMember, 0, count)
+	members := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		rank := i + 1
+		if max {
+			rank = idx.skl.Len() - i
+		}
+		node := idx.skl.GetElementByRank(rank).Value.(*Node)
+		member := []byte(node.member)
+		zMembers = append(zMembers, ZMember{Member: member, Score: node.score})
+		members = append(members, member)
+	}
+	if _, err := db.zRem(key, idx, members...); err != nil {
+		return nil, err
 	}
-	return util.StringToByte(member), score, nil
+	return zMembers, nil
 }
 
-func (db *LazyDB) ZPopMinWithCount(key []byte, count int) (members [][]byte, scores []float64, err error) {
-	db.zSetIndex.mu.Lock()
+// splitZMembers returns members and scores of zMembers separately, nil if zMembers is empty.
+func splitZMembers(zMembers []ZMember) (members [][]byte, scores []float64) {
+	for _, zMember := range zMembers {
+		members = append(members, zMember.Member)
+		scores = append(scores, zMember.Score)
+	}
+	return
+}
 
-	idx := db.zSetIndex.indexes[util.ByteToString(key)]
-	if idx == nil || idx.tree == nil || idx.skl == nil {
-		return nil, nil, nil
+// ZDiff returns members of the first sorted set that are not present in the other ones, ordered by score.
+func (db *LazyDB) ZDiff(keys ...[]byte) ([][]byte, error) {
+	zMembers, err := db.ZDiffWithScores(keys...)
+	if err != nil {
+		return nil, err
 	}
-	count = util.Min(count, idx.skl.Len())
+	members := make([][]byte, len(zMembers))
+	for i, zMember := range zMembers {
+		members[i] = zMember.Member
+	}
+	return members, nil
+}
 
-	db.zSetIndex.mu.Unlock()
+// ZDiffWithScores returns members of the first sorted set that are not present in the other ones
+// along with their scores in the first sorted set, ordered by score.
+func (db *LazyDB) ZDiffWithScores(keys ...[]byte) ([]ZMember, error) {
+	if err := db.checkAccess(OpRead, keys...); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, ErrInvalidParam
+	}
+	db.zSetIndex.mu.RLock()
+	defer db.zSetIndex.mu.RUnlock()
+	for _, key := range keys {
+		if err := db.checkType(valueTypeZSet, key); err != nil {
+			return nil, err
+		}
+	}
 
-	for i := 0; i < count; i++ {
-		member, score, err := db.ZPopMin(key)
-		if err != nil {
-			return nil, nil, err
+	idx := db.zSetIndex.indexes[util.ByteToString(keys[0])]
+	if idx == nil || idx.skl == nil {
+		return nil, nil
+	}
+	var zMembers []ZMember
+	for e := idx.skl.Front(); e != nil; e = e.Next() {
+		node := e.Value.(*Node)
+		member := util.StringToByte(node.member)
+		found := false
+		for _, key := range keys[1:] {
+			other := db.zSetIndex.indexes[util.ByteToString(key)]
+			if other != nil && other.tree != nil && other.tree.Get(db.encodeKey(key, member)) != nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			zMembers = append(zMembers, ZMember{Member: []byte(node.member), Score: node.score})
 		}
-		members = append(members, member)
-		scores = append(scores, score)
 	}
-	return
+	return zMembers, nil
 }
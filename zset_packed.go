@@ -0,0 +1,134 @@
+package lazydb
+
+import (
+	"github.com/billsjc123/LazyDB/logfile"
+	"github.com/billsjc123/LazyDB/util"
+)
+
+// zsetPackable returns whether a sorted set of pairs, which are members and scores, is packed into a single entry,
+// see DBConfig.PackSmallZSets.
+func (db *LazyDB) zsetPackable(pairs [][]byte) bool {
+	if !db.cfg.PackSmallZSets || len(pairs)/2 > threshold(db.cfg.ZSetMaxListpackEntries, defaultZSetMaxListpackEntries) {
+		return false
+	}
+	maxValue := threshold(db.cfg.ZSetMaxListpackValue, defaultZSetMaxListpackValue)
+	for i := 0; i < len(pairs); i += 2 {
+		if len(pairs[i]) > maxValue {
+			return false
+		}
+	}
+	return true
+}
+
+// zAddPacked sets members and scores of pairs into the sorted set idx stored at key if it is packed, or it is created
+// as a small one. A packed sorted set which is no longer small is converted by rewriting all of its members as normal
+// entries. It returns false if the sorted set is not packed, and pairs should be added as normal entries.
+// Lock of zSetIndex must be held by the caller.
+func (db *LazyDB) zAddPacked(key []byte, idx *ZSetIndex, pairs [][]byte) (bool, error) {
+	if !db.cfg.PackSmallZSets {
+		return false, nil
+	}
+	var current [][]byte
+	if idx.tree.Size() > 0 {
+		if !isPacked(idx.tree) {
+			return false, nil
+		}
+		var err error
+		if current, err = db.packedPairs(valueTypeZSet, key, idx.tree); err != nil {
+			return true, err
+		}
+	}
+	// current is kept to update the skip list, mergePairs overrides scores in place
+	all := mergePairs(append([][]byte(nil), current...), pairs)
+	if db.zsetPackable(all) {
+		if err := db.writePackedZSet(key, idx, all); err != nil {
+			return true, err
+		}
+		for i := 0; i < len(current); i += 2 {
+			idx.skl.Delete(&Node{score: util.ByteToFloat64(current[i+1]), member: string(current[i])})
+		}
+		for i := 0; i < len(all); i += 2 {
+			idx.skl.Insert(&Node{score: util.ByteToFloat64(all[i+1]), member: string(all[i])})
+		}
+		return true, nil
+	}
+	if idx.tree.Size() == 0 {
+		return false, nil
+	}
+
+	// the packed entry is not live any more once all of its members are rewritten
+	for i := 0; i < len(all); i += 2 {
+		if err := db.zAddMember(key, idx, all[i], all[i+1]); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// zRemPacked removes members from the sorted set idx stored at key if it is packed, and returns the number of
+// removed ones. It returns false if the sorted set is not packed. Lock of zSetIndex must be held by the caller.
+func (db *LazyDB) zRemPacked(key []byte, idx *ZSetIndex, members [][]byte) (int, bool, error) {
+	if !db.cfg.PackSmallZSets || !isPacked(idx.tree) {
+		return 0, false, nil
+	}
+	pairs, err := db.packedPairs(valueTypeZSet, key, idx.tree)
+	if err != nil {
+		return 0, true, err
+	}
+	var removed []*Node
+	for _, member := range members {
+		for i := 0; i < len(pairs); i += 2 {
+			if string(pairs[i]) == string(member) {
+				removed = append(removed, &Node{score: util.ByteToFloat64(pairs[i+1]), member: string(member)})
+				pairs = append(pairs[:i], pairs[i+2:]...)
+				break
+			}
+		}
+	}
+	if len(removed) == 0 {
+		return 0, true, nil
+	}
+	if err = db.writePackedZSet(key, idx, pairs); err != nil {
+		return 0, true, err
+	}
+	for _, node := range removed {
+		idx.skl.Delete(node)
+	}
+	return len(removed), true, nil
+}
+
+// writePackedZSet writes all members and scores of the sorted set idx stored at key into a packed entry,
+// and replaces members in the index tree by the ones of the entry. The skip list is left to the caller.
+// Lock of zSetIndex must be held by the caller.
+func (db *LazyDB) writePackedZSet(key []byte, idx *ZSetIndex, pairs [][]byte) error {
+	entry := &logfile.LogEntry{Key: key, Value: encodePacked(pairs), Stat: logfile.SPacked}
+	valPos, err := db.writeLogEntry(valueTypeZSet, entry)
+	if err != nil {
+		return err
+	}
+	if err = db.deletePackedValues(valueTypeZSet, idx.tree, true); err != nil {
+		return err
+	}
+	db.putPackedValues(valueTypeZSet, idx.tree, db.packedHashKeys(key, pairs), valPos, entry)
+	if len(pairs) == 0 {
+		// also merge the empty packed entry
+		return db.sendDiscard(&Value{fid: valPos.fid, entrySize: valPos.entrySize}, true, valueTypeZSet)
+	}
+	return nil
+}
+
+// rewritePackedZSet rewrites the packed entry at offset of log file fid by write if any of its members is live.
+// Lock of zSetIndex must be held by the caller.
+func (db *LazyDB) rewritePackedZSet(fid uint32, offset int64, ent *logfile.LogEntry,
+	write func(ent *logfile.LogEntry) (*ValuePos, error)) error {
+
+	idx := db.zSetIndex.indexes[util.ByteToString(ent.Key)]
+	if idx == nil {
+		return nil
+	}
+	pairs, err := decodePackedHash(ent.Value)
+	if err != nil {
+		return err
+	}
+	return db.rewritePacked(valueTypeZSet, idx.tree, fid, offset, ent, pairs, db.packedHashKeys(ent.Key, pairs), write)
+}
@@ -0,0 +1,100 @@
+package lazydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/billsjc123/LazyDB/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_PackSmallZSets(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_pack_small_zsets")
+	cfg := DefaultDBConfig(path)
+	cfg.PackSmallZSets = true
+	cfg.ZSetMaxListpackEntries = 4
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+	key := []byte("packed")
+	packed := func() bool {
+		db.zSetIndex.mu.RLock()
+		defer db.zSetIndex.mu.RUnlock()
+		idx := db.zSetIndex.indexes[string(key)]
+		return idx != nil && isPacked(idx.tree)
+	}
+	rangeWithScores := func(key []byte) []ZMember {
+		members, scores, err := db.ZRangeWithScores(key, 0, -1)
+		assert.Nil(t, err)
+		res := make([]ZMember, len(members))
+		for i := range members {
+			res[i] = ZMember{Member: members[i], Score: scores[i]}
+		}
+		return res
+	}
+
+	// a small sorted set is written as a single entry
+	writes := db.Stats().Writes
+	assert.Nil(t, db.ZAdd(key, util.Float64ToByte(3), []byte("m3"), util.Float64ToByte(1), []byte("m1"),
+		util.Float64ToByte(2), []byte("m2")))
+	assert.Equal(t, writes+1, db.Stats().Writes)
+	assert.True(t, packed())
+	score, err := db.ZScore(key, []byte("m2"))
+	assert.Nil(t, err)
+	assert.Equal(t, float64(2), score)
+
+	// scores are updated in the skip list as well
+	score, err = db.ZIncrBy(key, 10, []byte("m1"))
+	assert.Nil(t, err)
+	assert.Equal(t, float64(11), score)
+	count, err := db.ZAddWithFlags(key, ZAddGT|ZAddCH, ZMember{Member: []byte("m2"), Score: 1},
+		ZMember{Member: []byte("m3"), Score: 4}, ZMember{Member: []byte("m4"), Score: 0},
+		ZMember{Member: []byte("m4"), Score: 5})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+	count, err = db.ZRem(key, []byte("m2"), []byte("missing"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	assert.True(t, packed())
+	expected := []ZMember{{Member: []byte("m3"), Score: 4}, {Member: []byte("m4"), Score: 5},
+		{Member: []byte("m1"), Score: 11}}
+	assert.Equal(t, expected, rangeWithScores(key))
+
+	// exceeding the threshold converts it into entries for each member transparently
+	writes = db.Stats().Writes
+	assert.Nil(t, db.ZAdd(key, util.Float64ToByte(6), []byte("m6"), util.Float64ToByte(7), []byte("m7")))
+	assert.Equal(t, writes+5, db.Stats().Writes)
+	assert.False(t, packed())
+	count, err = db.ZRem(key, []byte("m7"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	assert.False(t, packed())
+	expected = []ZMember{{Member: []byte("m3"), Score: 4}, {Member: []byte("m4"), Score: 5},
+		{Member: []byte("m6"), Score: 6}, {Member: []byte("m1"), Score: 11}}
+	assert.Equal(t, expected, rangeWithScores(key))
+
+	// a large member is not packed either
+	assert.Nil(t, db.ZAdd([]byte("large"), util.Float64ToByte(1), GetValue(128)))
+	db.zSetIndex.mu.RLock()
+	assert.False(t, isPacked(db.zSetIndex.indexes["large"].tree))
+	db.zSetIndex.mu.RUnlock()
+
+	// only the live members of packed entries are compacted
+	small := []byte("small")
+	assert.Nil(t, db.ZAdd(small, util.Float64ToByte(1), []byte("a"), util.Float64ToByte(2), []byte("b")))
+	assert.Nil(t, db.ZAdd(small, util.Float64ToByte(3), []byte("a")))
+	assert.Nil(t, db.FullCompact(valueTypeZSet))
+	assert.Equal(t, []ZMember{{Member: []byte("b"), Score: 2}, {Member: []byte("a"), Score: 3}}, rangeWithScores(small))
+	assert.Equal(t, expected, rangeWithScores(key))
+
+	// popping all members removes the sorted set
+	popped, err := db.ZPopMin(small, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(popped))
+	assert.Equal(t, 0, zCard(t, db, small))
+	assert.False(t, db.ZExistsKey(small))
+}
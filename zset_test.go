@@ -3,9 +3,11 @@ package lazydb
 import (
 	"github.com/billsjc123/LazyDB/util"
 	"github.com/stretchr/testify/assert"
+	"math"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func initTestZset() *LazyDB {
@@ -89,6 +91,85 @@ func TestLazyDB_ZAdd(t *testing.T) {
 	}
 }
 
+func TestLazyDB_ZAddWithFlags(t *testing.T) {
+	db := initTestZset()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("zset_flags")
+	score := func(member string) float64 {
+		s, err := db.ZScore(key, []byte(member))
+		assert.Nil(t, err)
+		return s
+	}
+	n, err := db.ZAddWithFlags(key, 0, ZMember{Member: []byte("a"), Score: 1}, ZMember{Member: []byte("b"), Score: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	t.Run("conflict", func(t *testing.T) {
+		for _, flags := range []ZAddFlags{ZAddNX | ZAddXX, ZAddGT | ZAddLT, ZAddNX | ZAddGT, ZAddNX | ZAddLT} {
+			_, err := db.ZAddWithFlags(key, flags, ZMember{Member: []byte("a"), Score: 10})
+			assert.Equal(t, ErrZAddFlagsConflict, err)
+		}
+		assert.Equal(t, float64(1), score("a"))
+	})
+
+	t.Run("nx", func(t *testing.T) {
+		n, err := db.ZAddWithFlags(key, ZAddNX, ZMember{Member: []byte("a"), Score: 10}, ZMember{Member: []byte("c"), Score: 3})
+		assert.Nil(t, err)
+		assert.Equal(t, 1, n)
+		assert.Equal(t, float64(1), score("a"))
+		assert.Equal(t, float64(3), score("c"))
+	})
+
+	t.Run("xx", func(t *testing.T) {
+		n, err := db.ZAddWithFlags(key, ZAddXX, ZMember{Member: []byte("a"), Score: 5}, ZMember{Member: []byte("d"), Score: 4})
+		assert.Nil(t, err)
+		assert.Equal(t, 0, n)
+		assert.Equal(t, float64(5), score("a"))
+		_, err = db.ZScore(key, []byte("d"))
+		assert.Equal(t, ErrZSetMemberNotExist, err)
+		// nothing is created for a missing key
+		n, err = db.ZAddWithFlags([]byte("missing"), ZAddXX, ZMember{Member: []byte("a"), Score: 1})
+		assert.Nil(t, err)
+		assert.Equal(t, 0, n)
+		assert.Equal(t, 0, zCard(t, db, []byte("missing")))
+	})
+
+	t.Run("gt", func(t *testing.T) {
+		n, err := db.ZAddWithFlags(key, ZAddGT|ZAddCH, ZMember{Member: []byte("a"), Score: 4},
+			ZMember{Member: []byte("b"), Score: 6}, ZMember{Member: []byte("e"), Score: 1})
+		assert.Nil(t, err)
+		assert.Equal(t, 2, n)
+		assert.Equal(t, float64(5), score("a"))
+		assert.Equal(t, float64(6), score("b"))
+		assert.Equal(t, float64(1), score("e"))
+	})
+
+	t.Run("lt", func(t *testing.T) {
+		n, err := db.ZAddWithFlags(key, ZAddLT|ZAddCH, ZMember{Member: []byte("a"), Score: 0},
+			ZMember{Member: []byte("b"), Score: 7})
+		assert.Nil(t, err)
+		assert.Equal(t, 1, n)
+		assert.Equal(t, float64(0), score("a"))
+		assert.Equal(t, float64(6), score("b"))
+	})
+
+	t.Run("ch", func(t *testing.T) {
+		members := []ZMember{{Member: []byte("a"), Score: 0}, {Member: []byte("b"), Score: 8}, {Member: []byte("f"), Score: 9}}
+		// an unchanged score is not counted
+		n, err := db.ZAddWithFlags(key, ZAddCH, members...)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, n)
+		n, err = db.ZAddWithFlags(key, 0, ZMember{Member: []byte("b"), Score: 1}, ZMember{Member: []byte("g"), Score: 1})
+		assert.Nil(t, err)
+		assert.Equal(t, 1, n)
+		assert.Equal(t, float64(1), score("b"))
+	})
+
+	assert.Equal(t, 6, zCard(t, db, key))
+}
+
 func TestLazyDB_ZScore(t *testing.T) {
 	db := initTestZset()
 	defer destroyDB(db)
@@ -185,7 +266,8 @@ func TestLazyDB_ZCard(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := db.ZCard(tt.args.key)
+			got, err := db.ZCard(tt.args.key)
+			assert.Nil(t, err)
 			assert.Equal(t, tt.want, got)
 		})
 	}
@@ -379,7 +461,8 @@ func TestLazyDB_ZRange(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := db.ZRange(tt.args.key, tt.args.start, tt.args.stop)
+			got, err := db.ZRange(tt.args.key, tt.args.start, tt.args.stop)
+			assert.Nil(t, err)
 			assert.Equal(t, tt.expectedValue, got)
 		})
 	}
@@ -443,7 +526,8 @@ func TestLazyDB_ZRevRange(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := db.ZRevRange(tt.args.key, tt.args.start, tt.args.stop)
+			got, err := db.ZRevRange(tt.args.key, tt.args.start, tt.args.stop)
+			assert.Nil(t, err)
 			assert.Equal(t, tt.expectedValue, got)
 		})
 	}
@@ -583,52 +667,70 @@ func TestLazyDB_ZPopMax(t *testing.T) {
 		util.Float64ToByte(3), []byte("k1_m3"), util.Float64ToByte(4), []byte("k1_m4"), util.Float64ToByte(5), []byte("k1_m5"))
 
 	type args struct {
-		key []byte
+		key   []byte
+		count int
 	}
 
 	tests := []struct {
-		name           string
-		args           args
-		expectedMember []byte
-		expectedScore  float64
-		expectedErr    error
+		name            string
+		args            args
+		expectedMembers []ZMember
+		expectedErr     error
 	}{
 		{
 			name: "existed key and member",
 			args: args{
-				key: []byte("k1"),
+				key:   []byte("k1"),
+				count: 1,
 			},
-			expectedMember: util.StringToByte("k1_m5"),
-			expectedScore:  5,
-			expectedErr:    nil,
+			expectedMembers: []ZMember{{Member: util.StringToByte("k1_m5"), Score: 5}},
+			expectedErr:     nil,
 		},
 		{
 			name: "second pop",
 			args: args{
-				key: []byte("k1"),
+				key:   []byte("k1"),
+				count: 1,
 			},
-			expectedMember: util.StringToByte("k1_m4"),
-			expectedScore:  4,
-			expectedErr:    nil,
+			expectedMembers: []ZMember{{Member: util.StringToByte("k1_m4"), Score: 4}},
+			expectedErr:     nil,
+		},
+		{
+			name: "count is 2",
+			args: args{
+				key:   []byte("k1"),
+				count: 2,
+			},
+			expectedMembers: []ZMember{{Member: util.StringToByte("k1_m3"), Score: 3}, {Member: util.StringToByte("k1_m2"), Score: 2}},
+			expectedErr:     nil,
+		},
+		{
+			name: "count is not positive",
+			args: args{
+				key:   []byte("k1"),
+				count: 0,
+			},
+			expectedMembers: nil,
+			expectedErr:     nil,
 		},
 		{
 			name: "not existed key",
 			args: args{
-				key: []byte("k2"),
+				key:   []byte("k2"),
+				count: 1,
 			},
-			expectedMember: nil,
-			expectedScore:  0,
-			expectedErr:    nil,
+			expectedMembers: nil,
+			expectedErr:     nil,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			member, score, err := db.ZPopMax(tt.args.key)
-			assert.Equal(t, tt.expectedMember, member)
-			assert.Equal(t, tt.expectedScore, score)
+			members, err := db.ZPopMax(tt.args.key, tt.args.count)
+			assert.Equal(t, tt.expectedMembers, members)
 			assert.Equal(t, tt.expectedErr, err)
 		})
 	}
+	assert.Equal(t, 1, zCard(t, db, []byte("k1")))
 }
 
 func TestLazyDB_ZPopMaxWithCount(t *testing.T) {
@@ -710,52 +812,70 @@ func TestLazyDB_ZPopMin(t *testing.T) {
 		util.Float64ToByte(3), []byte("k1_m3"), util.Float64ToByte(4), []byte("k1_m4"), util.Float64ToByte(5), []byte("k1_m5"))
 
 	type args struct {
-		key []byte
+		key   []byte
+		count int
 	}
 
 	tests := []struct {
-		name           string
-		args           args
-		expectedMember []byte
-		expectedScore  float64
-		expectedErr    error
+		name            string
+		args            args
+		expectedMembers []ZMember
+		expectedErr     error
 	}{
 		{
 			name: "existed key and member",
 			args: args{
-				key: []byte("k1"),
+				key:   []byte("k1"),
+				count: 1,
 			},
-			expectedMember: util.StringToByte("k1_m1"),
-			expectedScore:  1,
-			expectedErr:    nil,
+			expectedMembers: []ZMember{{Member: util.StringToByte("k1_m1"), Score: 1}},
+			expectedErr:     nil,
 		},
 		{
 			name: "second pop",
 			args: args{
-				key: []byte("k1"),
+				key:   []byte("k1"),
+				count: 1,
+			},
+			expectedMembers: []ZMember{{Member: util.StringToByte("k1_m2"), Score: 2}},
+			expectedErr:     nil,
+		},
+		{
+			name: "count is 2",
+			args: args{
+				key:   []byte("k1"),
+				count: 2,
+			},
+			expectedMembers: []ZMember{{Member: util.StringToByte("k1_m3"), Score: 3}, {Member: util.StringToByte("k1_m4"), Score: 4}},
+			expectedErr:     nil,
+		},
+		{
+			name: "count is not positive",
+			args: args{
+				key:   []byte("k1"),
+				count: 0,
 			},
-			expectedMember: util.StringToByte("k1_m2"),
-			expectedScore:  2,
-			expectedErr:    nil,
+			expectedMembers: nil,
+			expectedErr:     nil,
 		},
 		{
 			name: "not existed key",
 			args: args{
-				key: []byte("k2"),
+				key:   []byte("k2"),
+				count: 1,
 			},
-			expectedMember: nil,
-			expectedScore:  0,
-			expectedErr:    nil,
+			expectedMembers: nil,
+			expectedErr:     nil,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			member, score, err := db.ZPopMin(tt.args.key)
-			assert.Equal(t, tt.expectedMember, member)
-			assert.Equal(t, tt.expectedScore, score)
+			members, err := db.ZPopMin(tt.args.key, tt.args.count)
+			assert.Equal(t, tt.expectedMembers, members)
 			assert.Equal(t, tt.expectedErr, err)
 		})
 	}
+	assert.Equal(t, 1, zCard(t, db, []byte("k1")))
 }
 
 func TestLazyDB_ZPopMinWithCount(t *testing.T) {
@@ -827,3 +947,207 @@ func TestLazyDB_ZPopMinWithCount(t *testing.T) {
 		})
 	}
 }
+
+func TestLazyDB_ZDiff(t *testing.T) {
+	db := initTestZset()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	assert.Nil(t, db.ZAdd([]byte("z1"),
+		util.Float64ToByte(3), []byte("c"), util.Float64ToByte(1), []byte("a"),
+		util.Float64ToByte(2.5), []byte("b"), util.Float64ToByte(4), []byte("d")))
+	assert.Nil(t, db.ZAdd([]byte("z2"), util.Float64ToByte(100), []byte("b")))
+	assert.Nil(t, db.ZAdd([]byte("z3"), util.Float64ToByte(0), []byte("d"), util.Float64ToByte(0), []byte("e")))
+
+	// scores in the first sorted set are kept
+	zMembers, err := db.ZDiffWithScores([]byte("z1"), []byte("z2"), []byte("z3"), []byte("missing"))
+	assert.Nil(t, err)
+	assert.Equal(t, []ZMember{{Member: []byte("a"), Score: 1}, {Member: []byte("c"), Score: 3}}, zMembers)
+
+	members, err := db.ZDiff([]byte("z1"), []byte("z2"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("c"), []byte("d")}, members)
+
+	members, err = db.ZDiff([]byte("z1"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}, members)
+
+	members, err = db.ZDiff([]byte("missing"), []byte("z1"))
+	assert.Nil(t, err)
+	assert.Empty(t, members)
+
+	_, err = db.ZDiff()
+	assert.Equal(t, ErrInvalidParam, err)
+}
+
+func TestLazyDB_ZPopMinTimeout(t *testing.T) {
+	db := initTestZset()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	// times out on an empty sorted set
+	start := time.Now()
+	_, ok, err := db.ZPopMinTimeout([]byte("k1"), 50*time.Millisecond)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// pops immediately if there are members
+	assert.Nil(t, db.ZAdd([]byte("k1"), util.Float64ToByte(2), []byte("m2"), util.Float64ToByte(1), []byte("m1")))
+	zMember, ok, err := db.ZPopMinTimeout([]byte("k1"), time.Second)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, ZMember{Member: []byte("m1"), Score: 1}, zMember)
+	_, err = db.ZPopMin([]byte("k1"), 1)
+	assert.Nil(t, err)
+
+	// satisfied by a concurrent ZAdd
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		assert.Nil(t, db.ZAdd([]byte("k2"), util.Float64ToByte(3), []byte("m3")))
+		assert.Nil(t, db.ZAdd([]byte("k1"), util.Float64ToByte(3), []byte("m3")))
+	}()
+	start = time.Now()
+	zMember, ok, err = db.ZPopMinTimeout([]byte("k1"), 5*time.Second)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, ZMember{Member: []byte("m3"), Score: 3}, zMember)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, 0, zCard(t, db, []byte("k1")))
+	assert.Equal(t, 1, zCard(t, db, []byte("k2")))
+}
+
+func TestLazyDB_ZMPop(t *testing.T) {
+	db := initTestZset()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	keys := [][]byte{[]byte("z1"), []byte("z2"), []byte("z3")}
+	_, _, err := db.ZMPop(4, keys, false, 1)
+	assert.Equal(t, ErrInvalidParam, err)
+
+	key, members, err := db.ZMPop(3, keys, false, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, key)
+	assert.Nil(t, members)
+
+	assert.Nil(t, db.ZAdd(keys[1], util.Float64ToByte(1), []byte("a"), util.Float64ToByte(2), []byte("bb"),
+		util.Float64ToByte(3), []byte("ccc")))
+	assert.Nil(t, db.ZAdd(keys[2], util.Float64ToByte(10), []byte("x")))
+
+	key, members, err = db.ZMPop(3, keys, false, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, keys[1], key)
+	assert.Equal(t, []ZMember{{Member: []byte("a"), Score: 1}, {Member: []byte("bb"), Score: 2}}, members)
+
+	key, members, err = db.ZMPop(3, keys, true, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, keys[1], key)
+	assert.Equal(t, []ZMember{{Member: []byte("ccc"), Score: 3}}, members)
+	assert.Equal(t, 0, zCard(t, db, keys[1]))
+
+	key, members, err = db.ZMPop(3, keys, true, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, keys[2], key)
+	assert.Equal(t, []ZMember{{Member: []byte("x"), Score: 10}}, members)
+}
+
+func TestLazyDB_ZRangeByLex(t *testing.T) {
+	db := initTestZset()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("lex")
+	score := util.Float64ToByte(0)
+	assert.Nil(t, db.ZAdd(key, score, []byte("e"), score, []byte("bb"), score, []byte("a"), score, []byte("c"),
+		score, []byte("d"), score, []byte("b")))
+	members, err := db.ZRange(key, 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("bb"), []byte("c"), []byte("d"), []byte("e")}, members)
+
+	tests := []struct {
+		name     string
+		min, max string
+		offset   int
+		count    int
+		want     [][]byte
+	}{
+		{name: "inclusive", min: "[b", max: "[d", count: -1,
+			want: [][]byte{[]byte("b"), []byte("bb"), []byte("c"), []byte("d")}},
+		{name: "exclusive", min: "(b", max: "(d", count: -1, want: [][]byte{[]byte("bb"), []byte("c")}},
+		{name: "mixed", min: "(a", max: "[bb", count: -1, want: [][]byte{[]byte("b"), []byte("bb")}},
+		{name: "all", min: "-", max: "+", count: -1,
+			want: [][]byte{[]byte("a"), []byte("b"), []byte("bb"), []byte("c"), []byte("d"), []byte("e")}},
+		{name: "lowest", min: "-", max: "(b", count: -1, want: [][]byte{[]byte("a")}},
+		{name: "highest", min: "[d", max: "+", count: -1, want: [][]byte{[]byte("d"), []byte("e")}},
+		{name: "limit", min: "-", max: "+", offset: 1, count: 2, want: [][]byte{[]byte("b"), []byte("bb")}},
+		{name: "empty", min: "(c", max: "(c", count: -1, want: nil},
+		{name: "reversed", min: "+", max: "-", count: -1, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			members, err := db.ZRangeByLex(key, []byte(tt.min), []byte(tt.max), tt.offset, tt.count)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, members)
+		})
+	}
+
+	_, err = db.ZRangeByLex(key, []byte("b"), []byte("+"), 0, -1)
+	assert.Equal(t, ErrInvalidLexRange, err)
+	members, err = db.ZRangeByLex([]byte("missing"), []byte("-"), []byte("+"), 0, -1)
+	assert.Nil(t, err)
+	assert.Nil(t, members)
+}
+
+func TestLazyDB_ZSetNaNAndInfScores(t *testing.T) {
+	db := initTestZset()
+	defer destroyDB(db)
+
+	key := []byte("inf_scores")
+	nan := util.Float64ToByte(math.NaN())
+	assert.Equal(t, ErrNaNScore, db.ZAdd(key, util.Float64ToByte(1), []byte("a"), nan, []byte("b")))
+	_, err := db.ZAddWithFlags(key, 0, ZMember{Member: []byte("b"), Score: math.NaN()})
+	assert.Equal(t, ErrNaNScore, err)
+	_, err = db.ZIncrBy(key, math.NaN(), []byte("b"))
+	assert.Equal(t, ErrNaNScore, err)
+	assert.Equal(t, 0, zCard(t, db, key))
+
+	// infinities are ordered at both ends, and read back from log files
+	assert.Nil(t, db.ZAdd(key,
+		util.Float64ToByte(math.Inf(1)), []byte("pos_inf"),
+		util.Float64ToByte(-1e308), []byte("min"),
+		util.Float64ToByte(math.Inf(-1)), []byte("neg_inf"),
+		util.Float64ToByte(1e308), []byte("max"),
+		util.Float64ToByte(0), []byte("zero"),
+		util.Float64ToByte(math.Inf(1)), []byte("another_pos_inf"),
+	))
+	members, scores, err := db.ZRangeWithScores(key, 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("neg_inf"), []byte("min"), []byte("zero"), []byte("max"),
+		[]byte("another_pos_inf"), []byte("pos_inf")}, members)
+	assert.Equal(t, []float64{math.Inf(-1), -1e308, 0, 1e308, math.Inf(1), math.Inf(1)}, scores)
+	score, err := db.ZScore(key, []byte("neg_inf"))
+	assert.Nil(t, err)
+	assert.True(t, math.IsInf(score, -1))
+
+	// the score is kept if the increment would make it NaN
+	_, err = db.ZIncrBy(key, math.Inf(-1), []byte("pos_inf"))
+	assert.Equal(t, ErrNaNScore, err)
+	score, err = db.ZScore(key, []byte("pos_inf"))
+	assert.Nil(t, err)
+	assert.True(t, math.IsInf(score, 1))
+	score, err = db.ZIncrBy(key, math.Inf(1), []byte("max"))
+	assert.Nil(t, err)
+	assert.True(t, math.IsInf(score, 1))
+	// members of the same infinite score are ordered lexicographically
+	rank, err := db.ZRank(key, []byte("max"))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, rank)
+}
+
+// zCard returns ZCard of key, asserting no error is returned.
+func zCard(t *testing.T, db *LazyDB, key []byte) int {
+	n, err := db.ZCard(key)
+	assert.Nil(t, err)
+	return n
+}